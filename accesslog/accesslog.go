@@ -0,0 +1,130 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+/*
+  Filters the access log, i.e. the lines logged for requests, such as
+  "200 GET /foo (...)", so that health checks, metrics scrapes and busy
+  paths do not drown out the rest on a busy mirror. Server errors are
+  always logged. See Rule and Wrap().
+*/
+package accesslog
+
+import (
+         "fmt"
+         "net"
+         "context"
+         "strconv"
+         "strings"
+         "net/http"
+         "sync/atomic"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../status"
+       )
+
+// Which requests are logged.
+type Rule struct {
+  // If not "", the rule only applies to requests for this host name
+  // (the Host header without port).
+  Host string
+  
+  // The rule applies to requests whose path starts with Prefix.
+  Prefix string
+  
+  // Only 1 in Sample requests is logged. 0 means none.
+  Sample uint64
+  
+  // The number of requests the rule has applied to. Atomic.
+  requests uint64
+}
+
+// The rules. The one with the longest Prefix that applies to a request
+// decides, and rules with a Host win over those without.
+var Rules []*Rule
+
+var suppressed = status.NewCounter("garcon_access_log_suppressed_total", "Requests whose lines have been left out of the access log.")
+
+/*
+  Parses "[host]/prefix", e.g. "/healthz" or "mirror.example.com/pool/",
+  followed by ":N" if sample is true. The Rule excludes the requests from
+  the log or, with sample, logs 1 in N of them.
+*/
+func ParseRule(s string, sample bool) (*Rule, error) {
+  rule := &Rule{}
+  spec := s
+  if sample {
+    i := strings.LastIndex(spec, ":")
+    var err error
+    if i >= 0 { rule.Sample, err = strconv.ParseUint(spec[i+1:], 10, 64) }
+    if i < 0 || err != nil || rule.Sample == 0 { return nil, fmt.Errorf("Expected [host]/prefix:N with N > 0, got %v", s) }
+    spec = spec[0:i]
+  }
+  i := strings.Index(spec, "/")
+  if i < 0 { return nil, fmt.Errorf("Expected [host]/prefix, got %v", s) }
+  rule.Host, rule.Prefix = strings.ToLower(spec[0:i]), spec[i:]
+  return rule, nil
+}
+
+// Returns true if rule applies to r.
+func (rule *Rule) applies(r *http.Request) bool {
+  if !strings.HasPrefix(r.URL.Path, rule.Prefix) { return false }
+  if rule.Host == "" { return true }
+  host, _, err := net.SplitHostPort(r.Host)
+  if err != nil { host = r.Host }
+  return strings.ToLower(host) == rule.Host
+}
+
+// Returns the rule that decides whether r is logged, or nil.
+func ruleFor(r *http.Request) *Rule {
+  var best *Rule
+  for _, rule := range Rules {
+    if !rule.applies(r) { continue }
+    if best == nil || len(rule.Prefix) > len(best.Prefix) || (len(rule.Prefix) == len(best.Prefix) && best.Host == "") { best = rule }
+  }
+  return best
+}
+
+type quietKey struct{}
+
+/*
+  Passes the requests on to h. Those that Rules leave out of the access
+  log are marked, so that Log() skips their lines.
+*/
+func Wrap(h http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if rule := ruleFor(r); rule != nil {
+      n := atomic.AddUint64(&rule.requests, 1)
+      if rule.Sample == 0 || (n - 1) % rule.Sample != 0 {
+        suppressed.Inc()
+        r = r.WithContext(context.WithValue(r.Context(), quietKey{}, true))
+      }
+    }
+    h.ServeHTTP(w, r)
+  })
+}
+
+// Returns true if the lines for r are left out of the access log.
+func Quiet(r *http.Request) bool {
+  return r.Context().Value(quietKey{}) != nil
+}
+
+/*
+  Logs a line of the access log for r like util.Log(level, format, args...)
+  unless Rules leave r out.
+*/
+func Log(r *http.Request, level int, format string, args ...interface{}) {
+  if Quiet(r) { return }
+  util.Log(level, format, args...)
+}
@@ -0,0 +1,207 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+/*
+  Reads Arch Linux packages and writes the repository databases
+  (<repo>.db.tar.gz and <repo>.files.tar.gz) that pacman downloads to
+  find packages in a repository.
+*/
+package arch
+
+import (
+         "io"
+         "fmt"
+         "time"
+         "bufio"
+         "bytes"
+         "errors"
+         "strings"
+         "strconv"
+         "archive/tar"
+         "encoding/base64"
+         "compress/gzip"
+       )
+
+var errNoPkgInfo = errors.New("no .PKGINFO in package")
+
+// The information about a package from its .PKGINFO and its file list.
+type Package struct {
+  Name, Base, Version, Desc, URL, Arch, Packager string
+  
+  // Seconds since epoch.
+  BuildDate int64
+  
+  // Size in bytes of the installed files.
+  InstalledSize int64
+  
+  Licenses, Groups, Replaces, Conflicts, Provides []string
+  Depends, OptDepends, MakeDepends, CheckDepends []string
+  
+  // Paths of the files and directories (with trailing "/") in the
+  // package without leading "/", excluding .PKGINFO and the like.
+  Files []string
+}
+
+/*
+  Reads a package from r, which must be the uncompressed tar archive
+  (i.e. the .pkg.tar.zst file already run through a decompressor).
+*/
+func Read(r io.Reader) (*Package, error) {
+  var p *Package
+  files := []string{}
+  tr := tar.NewReader(r)
+  for {
+    hdr, err := tr.Next()
+    if err == io.EOF { break }
+    if err != nil { return nil, err }
+    name := strings.TrimPrefix(hdr.Name, "./")
+    if name == ".PKGINFO" {
+      p, err = readPkgInfo(tr)
+      if err != nil { return nil, err }
+    } else if name != "" && !strings.HasPrefix(name, ".") {
+      if hdr.Typeflag == tar.TypeDir && !strings.HasSuffix(name, "/") { name += "/" }
+      files = append(files, name)
+    }
+  }
+  if p == nil { return nil, errNoPkgInfo }
+  p.Files = files
+  return p, nil
+}
+
+// Parses the "key = value" lines of .PKGINFO.
+func readPkgInfo(r io.Reader) (*Package, error) {
+  p := &Package{}
+  scanner := bufio.NewScanner(r)
+  for scanner.Scan() {
+    line := scanner.Text()
+    if strings.HasPrefix(line, "#") { continue }
+    i := strings.Index(line, " = ")
+    if i < 0 { continue }
+    key, value := line[0:i], line[i+3:]
+    switch key {
+      case "pkgname": p.Name = value
+      case "pkgbase": p.Base = value
+      case "pkgver": p.Version = value
+      case "pkgdesc": p.Desc = value
+      case "url": p.URL = value
+      case "arch": p.Arch = value
+      case "packager": p.Packager = value
+      case "builddate": p.BuildDate, _ = strconv.ParseInt(value, 10, 64)
+      case "size": p.InstalledSize, _ = strconv.ParseInt(value, 10, 64)
+      case "license": p.Licenses = append(p.Licenses, value)
+      case "group": p.Groups = append(p.Groups, value)
+      case "replaces": p.Replaces = append(p.Replaces, value)
+      case "conflict": p.Conflicts = append(p.Conflicts, value)
+      case "provides": p.Provides = append(p.Provides, value)
+      case "depend": p.Depends = append(p.Depends, value)
+      case "optdepend": p.OptDepends = append(p.OptDepends, value)
+      case "makedepend": p.MakeDepends = append(p.MakeDepends, value)
+      case "checkdepend": p.CheckDepends = append(p.CheckDepends, value)
+    }
+  }
+  if err := scanner.Err(); err != nil { return nil, err }
+  if p.Name == "" || p.Version == "" { return nil, errors.New(".PKGINFO lacks pkgname or pkgver") }
+  return p, nil
+}
+
+// A package in a repository.
+type Entry struct {
+  *Package
+  
+  // Name of the package file, e.g. "foo-1.0-1-x86_64.pkg.tar.zst".
+  Filename string
+  
+  // Size of the package file and its MD5 and SHA-256 (hex).
+  Size int64
+  MD5, SHA256 string
+  
+  // The detached signature of the package file (<Filename>.sig) or nil.
+  Signature []byte
+}
+
+/*
+  Writes the database for entries as .tar.gz to out. If files is true,
+  the file lists are included (<repo>.files), otherwise only the package
+  descriptions (<repo>.db). mtime is used for all members of the archive.
+*/
+func WriteDB(out io.Writer, entries []Entry, files bool, mtime time.Time) error {
+  zip := gzip.NewWriter(out)
+  tw := tar.NewWriter(zip)
+  for _, e := range entries {
+    dir := e.Name + "-" + e.Version + "/"
+    err := tw.WriteHeader(&tar.Header{Name:dir, Typeflag:tar.TypeDir, Mode:0755, ModTime:mtime})
+    if err != nil { return err }
+    members := [][]byte{desc(e)}
+    names := []string{"desc"}
+    if files {
+      members = append(members, fileList(e.Package))
+      names = append(names, "files")
+    }
+    for i, data := range members {
+      err = tw.WriteHeader(&tar.Header{Name:dir + names[i], Typeflag:tar.TypeReg, Mode:0644, Size:int64(len(data)), ModTime:mtime})
+      if err == nil { _, err = tw.Write(data) }
+      if err != nil { return err }
+    }
+  }
+  if err := tw.Close(); err != nil { return err }
+  return zip.Close()
+}
+
+// Returns the desc file of e.
+func desc(e Entry) []byte {
+  var b bytes.Buffer
+  field := func(name string, values ...string) {
+    lines := []string{}
+    for _, v := range values {
+      if v != "" { lines = append(lines, v) }
+    }
+    if len(lines) == 0 { return }
+    fmt.Fprintf(&b, "%%%v%%\n%v\n\n", name, strings.Join(lines, "\n"))
+  }
+  sig := ""
+  if e.Signature != nil { sig = base64.StdEncoding.EncodeToString(e.Signature) }
+  field("FILENAME", e.Filename)
+  field("NAME", e.Name)
+  field("BASE", e.Base)
+  field("VERSION", e.Version)
+  field("DESC", e.Desc)
+  field("GROUPS", e.Groups...)
+  field("CSIZE", strconv.FormatInt(e.Size, 10))
+  field("ISIZE", strconv.FormatInt(e.InstalledSize, 10))
+  field("MD5SUM", e.MD5)
+  field("SHA256SUM", e.SHA256)
+  field("PGPSIG", sig)
+  field("URL", e.URL)
+  field("LICENSE", e.Licenses...)
+  field("ARCH", e.Arch)
+  field("BUILDDATE", strconv.FormatInt(e.BuildDate, 10))
+  field("PACKAGER", e.Packager)
+  field("REPLACES", e.Replaces...)
+  field("CONFLICTS", e.Conflicts...)
+  field("PROVIDES", e.Provides...)
+  field("DEPENDS", e.Depends...)
+  field("OPTDEPENDS", e.OptDepends...)
+  field("MAKEDEPENDS", e.MakeDepends...)
+  field("CHECKDEPENDS", e.CheckDepends...)
+  return b.Bytes()
+}
+
+// Returns the files file of p.
+func fileList(p *Package) []byte {
+  var b bytes.Buffer
+  b.WriteString("%FILES%\n")
+  for _, f := range p.Files { fmt.Fprintf(&b, "%v\n", f) }
+  b.WriteString("\n")
+  return b.Bytes()
+}
@@ -0,0 +1,527 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+/*
+  Authentication of users and authorization of requests based on the
+  path prefix and the user's name, groups and other claims.
+*/
+package auth
+
+import (
+         "fmt"
+         "net"
+         "path"
+         "time"
+         "strings"
+         "context"
+         "net/url"
+         "encoding/json"
+         "net/http"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../status"
+         "../problem"
+         "../accesslog"
+       )
+
+// What a Grant allows.
+type Permission int
+
+const (
+  // GET and HEAD requests.
+  READ Permission = 1 << iota
+  // All other requests, e.g. uploads.
+  WRITE
+)
+
+func (p Permission) String() string {
+  s := ""
+  if p & READ != 0 { s += "r" }
+  if p & WRITE != 0 { s += "w" }
+  return s
+}
+
+// Parses "r", "w" or "rw".
+func ParsePermission(s string) (Permission, error) {
+  var p Permission
+  for _, c := range s {
+    switch c {
+      case 'r': p |= READ
+      case 'w': p |= WRITE
+      default: return 0, fmt.Errorf("Illegal permission: %v", s)
+    }
+  }
+  if p == 0 { return 0, fmt.Errorf("Illegal permission: %v", s) }
+  return p, nil
+}
+
+// An authenticated user.
+type User struct {
+  // The user name, e.g. "alice".
+  Name string
+  
+  // The groups the user belongs to.
+  Groups []string
+  
+  // Further attributes, e.g. the claims of an OpenID Connect ID token.
+  // Values are strings or lists of strings.
+  Claims map[string]interface{}
+}
+
+// Returns true if u has the claim name with the value value (or a list of values that contains it).
+func (u *User) HasClaim(name, value string) bool {
+  switch v := u.Claims[name].(type) {
+    case string: return v == value
+    case []interface{}:
+      for _, x := range v {
+        if s, ok := x.(string); ok && s == value { return true }
+      }
+    case []string:
+      for _, s := range v {
+        if s == value { return true }
+      }
+  }
+  return false
+}
+
+/*
+  Gives the users selected by Who the permissions Perm for all paths
+  below Prefix.
+*/
+type Grant struct {
+  // A path prefix like "/internal". "/" covers everything. A path segment
+  // "{user}" stands for the name of the user, e.g. "/incoming/{user}"
+  // gives each user access to their own directory below /incoming.
+  Prefix string
+  
+  Perm Permission
+  
+  // "*" selects all authenticated users, "user:name" the user name,
+  // "group:name" the members of group name and "claim=value" the users
+  // that have the claim with the value value.
+  Who string
+}
+
+// Parses the Grant "/prefix:perm:who", e.g. "/internal:rw:group:staff".
+func ParseGrant(s string) (Grant, error) {
+  parts := strings.SplitN(s, ":", 3)
+  if len(parts) != 3 || !strings.HasPrefix(parts[0], "/") || parts[2] == "" {
+    return Grant{}, fmt.Errorf("Expected /prefix:perm:who, got %v", s)
+  }
+  perm, err := ParsePermission(parts[1])
+  if err != nil { return Grant{}, err }
+  who := parts[2]
+  if who != "*" && !strings.HasPrefix(who, "user:") && !strings.HasPrefix(who, "group:") && !strings.Contains(who, "=") {
+    return Grant{}, fmt.Errorf("Expected *, user:name, group:name or claim=value, got %v", who)
+  }
+  return Grant{Prefix:strings.TrimSuffix(path.Clean(parts[0]), "/"), Perm:perm, Who:who}, nil
+}
+
+/*
+  Returns true if g applies to the path clean for user u. If u is nil,
+  a "{user}" segment in g.Prefix matches any user's name.
+*/
+func (g *Grant) covers(clean string, u *User) bool {
+  if !strings.Contains(g.Prefix, "{user}") {
+    return clean == g.Prefix || strings.HasPrefix(clean, g.Prefix + "/")
+  }
+  want := strings.Split(g.Prefix, "/")
+  have := strings.Split(clean, "/")
+  if len(have) < len(want) { return false }
+  for i, seg := range want {
+    if seg == "{user}" {
+      if have[i] == "" || (u != nil && have[i] != u.Name) { return false }
+    } else if seg != have[i] {
+      return false
+    }
+  }
+  return true
+}
+
+// Returns true if g applies to u.
+func (g *Grant) selects(u *User) bool {
+  switch {
+    case g.Who == "*": return true
+    case strings.HasPrefix(g.Who, "user:"): return u.Name == g.Who[5:]
+    case strings.HasPrefix(g.Who, "group:"):
+      for _, group := range u.Groups {
+        if group == g.Who[6:] { return true }
+      }
+      return false
+  }
+  kv := strings.SplitN(g.Who, "=", 2)
+  return u.HasClaim(kv[0], kv[1])
+}
+
+/*
+  Restricts access to the paths covered by Grants. Requests for all other
+  paths are passed on without authentication.
+*/
+type Policy struct {
+  Grants []Grant
+  
+  // If not nil, users log in via this OpenID Connect provider.
+  OIDC *OIDC
+  
+  // If not nil, users can log in with HTTP Basic authentication
+  // using their accounts on the host.
+  PAM *PAM
+  
+  // If not nil, users that have a TOTP secret must confirm a code
+  // before they can make write requests.
+  TOTP *TOTP
+  
+  // If not nil, scripts can authenticate with API tokens.
+  Tokens *Tokens
+  
+  // If not nil, anyone with a URL signed by a user who may read its path
+  // may read it, too, until it expires.
+  URLs *URLSigner
+  
+  // Signs the session cookies. Set by NewPolicy().
+  sessions *sessions
+}
+
+// Returns a new Policy without Grants.
+func NewPolicy() *Policy {
+  return &Policy{sessions:newSessions()}
+}
+
+var (
+  authRequired = status.NewCounter(`garcon_auth_rejected_requests_total{reason="unauthenticated"}`, "Requests rejected by the access policy.")
+  authForbidden = status.NewCounter(`garcon_auth_rejected_requests_total{reason="forbidden"}`, "Requests rejected by the access policy.")
+  csrfRejected = status.NewCounter(`garcon_auth_rejected_requests_total{reason="csrf"}`, "Requests rejected by the access policy.")
+  totpRequired = status.NewCounter(`garcon_auth_rejected_requests_total{reason="totp"}`, "Requests rejected by the access policy.")
+)
+
+// The URL path below which the login, logout and session pages are served.
+const AuthPath = "/.garcon/auth/"
+
+/*
+  Sets the key that signs the session cookies. This way sessions survive
+  restarts and can be shared by several instances with the same key.
+  key must have at least 32 bytes. Call before Wrap().
+*/
+func (p *Policy) SetSessionKey(key []byte) error {
+  if len(key) < 32 { return fmt.Errorf("Session key must have at least 32 bytes") }
+  p.sessions.key = key
+  return nil
+}
+
+// Returns true if p restricts anything at all.
+func (p *Policy) Active() bool {
+  return len(p.Grants) > 0
+}
+
+/*
+  Returns the Permission the request method requires.
+*/
+func required(method string) Permission {
+  switch method {
+    case "", "GET", "HEAD", "OPTIONS": return READ
+  }
+  return WRITE
+}
+
+/*
+  Returns true if u (nil if not logged in) may access the path clean with
+  permission perm. The second result is true if the path is covered
+  by any Grant.
+*/
+func (p *Policy) Allowed(u *User, clean string, perm Permission) (allowed bool, protected bool) {
+  for i := range p.Grants {
+    g := &p.Grants[i]
+    if !g.covers(clean, nil) { continue }
+    protected = true
+    if u != nil && g.Perm & perm == perm && g.selects(u) && g.covers(clean, u) { return true, true }
+  }
+  return !protected, protected
+}
+
+type contextKey int
+
+const (
+  userKey contextKey = iota
+  // The URL path of a request that is allowed by its signature.
+  signedKey
+)
+
+// Returns the user who made the request r or nil if r is anonymous.
+// Only works for requests that have passed through Policy.Wrap().
+func UserFrom(r *http.Request) *User {
+  u, _ := r.Context().Value(userKey).(*User)
+  return u
+}
+
+/*
+  Returns true if the request r may read the URL path clean. Unlike Wrap(),
+  which only checks the path of r, this can be used for every other path
+  r makes the handler read or list, e.g. the entries of a generated index
+  or the other suite of a diff. r must have passed through Wrap(). If r
+  is nil, the result is true only for paths anyone may read.
+  A signed URL only allows its own path.
+*/
+func (p *Policy) MayRead(r *http.Request, clean string) bool {
+  var u *User
+  if r != nil { u = UserFrom(r) }
+  if allowed, _ := p.Allowed(u, clean, READ); allowed { return true }
+  if r == nil { return false }
+  signed, _ := r.Context().Value(signedKey).(string)
+  return signed != "" && clean == signed
+}
+
+/*
+  Returns true if the request r may modify the URL path clean. Like MayRead()
+  this is for paths other than the path of r, which Wrap() checks, e.g. the
+  file the admin API removes. r must have passed through Wrap(). Signed URLs
+  never allow writing.
+*/
+func (p *Policy) MayWrite(r *http.Request, clean string) bool {
+  var u *User
+  if r != nil { u = UserFrom(r) }
+  allowed, _ := p.Allowed(u, clean, WRITE)
+  return allowed
+}
+
+/*
+  Returns a handler that serves the login, logout and session pages below
+  AuthPath, rejects requests that p does not allow and passes all other
+  requests on to h. The logged in user is available to h via UserFrom().
+*/
+func (p *Policy) Wrap(h http.Handler) http.Handler {
+  p.sessions.secure = p.OIDC != nil && strings.HasPrefix(p.OIDC.RedirectURL, "https://")
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if strings.HasPrefix(r.URL.Path, AuthPath) && r.URL.Path != AuthPath + "sign" {
+      p.serveAuth(w, r)
+      return
+    }
+    
+    sess := p.sessions.current(r)
+    var u *User
+    if sess != nil { u = sess.User }
+    token := false
+    if t := bearerToken(r); t != "" && p.Tokens != nil {
+      u = p.Tokens.user(t)
+      if u == nil {
+        authRequired.Inc()
+        problem.Log(r, http.StatusUnauthorized, problem.InvalidToken, "")
+        problem.Write(w, r, http.StatusUnauthorized, problem.InvalidToken, "Invalid or expired token")
+        return
+      }
+      sess = nil
+      token = true
+    }
+    if name, password, ok := r.BasicAuth(); ok && u == nil && p.PAM != nil {
+      var err error
+      u, err = p.PAM.Authenticate(name, password, clientAddr(r))
+      if err != nil {
+        authRequired.Inc()
+        problem.Log(r, http.StatusUnauthorized, problem.LoginFailed, "%v", err)
+        p.challenge(w)
+        problem.Write(w, r, http.StatusUnauthorized, problem.LoginFailed, "Wrong user name or password")
+        return
+      }
+    }
+    
+    if r.URL.Path == AuthPath + "sign" {
+      if reason := p.csrfReason(r, sess); u != nil && !token && reason != "" {
+        csrfRejected.Inc()
+        problem.Log(r, http.StatusForbidden, problem.CSRFRejected, "user %v: %v", u.Name, reason)
+        problem.Write(w, r, http.StatusForbidden, problem.CSRFRejected, reason)
+        return
+      }
+      p.serveSign(w, r, u)
+      return
+    }
+    
+    clean := path.Clean("/" + r.URL.Path)
+    perm := required(r.Method)
+    signed := false
+    if perm == READ && p.URLs != nil && strings.Contains(r.URL.RawQuery, SignatureParam + "=") {
+      r2, err := p.URLs.verify(r, clean)
+      if err != nil {
+        problem.Log(r, http.StatusForbidden, problem.InvalidSignature, "%v", err)
+        problem.Write(w, r, http.StatusForbidden, problem.InvalidSignature, err.Error())
+        return
+      }
+      r = r2
+      signed = true
+    }
+    allowed, _ := p.Allowed(u, clean, perm)
+    if !allowed && signed {
+      util.Log(2, "Signed URL: %v %v", r.Method, r.URL.Path)
+      allowed = true
+      r = r.WithContext(context.WithValue(r.Context(), signedKey, clean))
+    }
+    if !allowed {
+      if u == nil {
+        authRequired.Inc()
+        p.requireLogin(w, r)
+        return
+      }
+      authForbidden.Inc()
+      problem.Log(r, http.StatusForbidden, problem.Forbidden, "user %v lacks permission %v", u.Name, perm)
+      problem.Write(w, r, http.StatusForbidden, problem.Forbidden, "")
+      return
+    }
+    
+    // Browsers send session cookies and Basic authentication with every
+    // request, even if another site has triggered it (cross-site request
+    // forgery). So for write requests the browser must confirm that the
+    // request comes from this site and requests authenticated via the
+    // session cookie must carry the session's CSRF token, which only
+    // pages from this site can obtain (see serveAuth()).
+    if u != nil && perm == WRITE && !token {
+      if reason := p.csrfReason(r, sess); reason != "" {
+        csrfRejected.Inc()
+        problem.Log(r, http.StatusForbidden, problem.CSRFRejected, "user %v: %v", u.Name, reason)
+        problem.Write(w, r, http.StatusForbidden, problem.CSRFRejected, reason)
+        return
+      }
+    }
+    
+    if u != nil && perm == WRITE && !token && p.TOTP != nil && p.TOTP.Enrolled(u.Name) && (sess == nil || sess.Verified <= time.Now().Unix()) {
+      totpRequired.Inc()
+      problem.Log(r, http.StatusForbidden, problem.SecondFactorRequired, "user %v", u.Name)
+      problem.Write(w, r, http.StatusForbidden, problem.SecondFactorRequired, "Second factor required. Confirm it at " + AuthPath + "totp")
+      return
+    }
+    
+    if u != nil {
+      util.Log(2, "User %v: %v %v", u.Name, r.Method, r.URL.Path)
+      r = r.WithContext(context.WithValue(r.Context(), userKey, u))
+    }
+    h.ServeHTTP(w, r)
+  })
+}
+
+/*
+  Answers the request r of a client that is not logged in but needs to be.
+  Browsers are sent to the OpenID Connect login page. Other clients get 401
+  with a request for Basic authentication if PAM is used.
+*/
+func (p *Policy) requireLogin(w http.ResponseWriter, r *http.Request) {
+  if p.OIDC != nil && r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+    login := AuthPath + "login?next=" + url.QueryEscape(r.URL.RequestURI())
+    accesslog.Log(r, 1, "%v %v %v (login required)", http.StatusFound, r.Method, r.URL.Path)
+    http.Redirect(w, r, login, http.StatusFound)
+    return
+  }
+  problem.Log(r, http.StatusUnauthorized, problem.LoginRequired, "")
+  p.challenge(w)
+  problem.Write(w, r, http.StatusUnauthorized, problem.LoginRequired, "Login required")
+}
+
+/*
+  Returns why the write request r of a user who is logged in via the session
+  sess (nil for Basic authentication) looks like cross-site request forgery
+  or "" if it doesn't.
+*/
+func (p *Policy) csrfReason(r *http.Request, sess *session) string {
+  if crossSite(r) { return "cross-site request" }
+  if sess != nil && !p.sessions.checkCSRF(r, sess) { return "CSRF token missing or wrong" }
+  return ""
+}
+
+/*
+  Returns true if the browser says that r has been triggered by a page
+  from another origin. Clients other than browsers send neither
+  Sec-Fetch-Site nor Origin.
+*/
+func crossSite(r *http.Request) bool {
+  switch r.Header.Get("Sec-Fetch-Site") {
+    case "same-origin", "none": return false
+    case "": // older browser; check Origin
+    default: return true
+  }
+  origin := r.Header.Get("Origin")
+  if origin == "" { return false }
+  u, err := url.Parse(origin)
+  return err != nil || u.Host != r.Host
+}
+
+// Returns the address of the client that has sent r.
+func clientAddr(r *http.Request) string {
+  client, _, err := net.SplitHostPort(r.RemoteAddr)
+  if err != nil { client = r.RemoteAddr }
+  return client
+}
+
+// Asks the client for Basic authentication if p supports it.
+func (p *Policy) challenge(w http.ResponseWriter) {
+  if p.PAM != nil {
+    w.Header().Set("WWW-Authenticate", `Basic realm="Garçon", charset="UTF-8"`)
+  }
+}
+
+// Serves the pages below AuthPath.
+func (p *Policy) serveAuth(w http.ResponseWriter, r *http.Request) {
+  switch strings.TrimPrefix(r.URL.Path, AuthPath) {
+    case "login": if p.OIDC != nil {
+                    p.OIDC.login(w, r, p.sessions)
+                    return
+                  }
+    case "callback": if p.OIDC != nil {
+                       p.OIDC.callback(w, r, p.sessions)
+                       return
+                     }
+    case "logout": util.Log(1, "Logout: %v", p.sessions.user(r))
+                   p.sessions.logout(w, r)
+                   http.Redirect(w, r, "/", http.StatusFound)
+                   return
+    case "session": p.serveSession(w, r)
+                    return
+    case "totp": if p.TOTP != nil {
+                   p.serveTOTP(w, r)
+                   return
+                 }
+  }
+  problem.Log(r, http.StatusNotFound, problem.NotFound, "")
+  problem.Write(w, r, http.StatusNotFound, problem.NotFound, "")
+}
+
+func (u *User) String() string {
+  if u == nil { return "(anonymous)" }
+  return u.Name
+}
+
+/*
+  Answers with a JSON object that describes the session of the logged in
+  user, e.g. {"user":"alice","groups":["staff"],"expires":1466073600,"csrf_token":"..."}
+  and, if the second factor is confirmed, "totp_verified_until".
+  Scripts of the web interface send the csrf_token in the X-CSRF-Token
+  header of write requests. Other sites can not read the response, because
+  it is not served with CORS headers. If there is no session, 401 is sent.
+*/
+func (p *Policy) serveSession(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Cache-Control", "no-store")
+  sess := p.sessions.current(r)
+  if sess == nil {
+    problem.WriteJSON(w, r, http.StatusUnauthorized, problem.LoginRequired, "No session")
+    return
+  }
+  p.writeSession(w, sess)
+}
+
+// Sends the JSON description of sess (see serveSession()).
+func (p *Policy) writeSession(w http.ResponseWriter, sess *session) {
+  groups := sess.User.Groups
+  if groups == nil { groups = []string{} }
+  info := map[string]interface{}{"user":sess.User.Name, "groups":groups, "expires":sess.Expires, "csrf_token":p.sessions.csrfToken(sess)}
+  if sess.Verified > time.Now().Unix() { info["totp_verified_until"] = sess.Verified }
+  data, _ := json.Marshal(info)
+  w.Header().Set("Content-Type", "application/json")
+  w.Write(data)
+}
@@ -0,0 +1,312 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package auth
+
+import (
+         "fmt"
+         "net"
+         "time"
+         "context"
+         "strings"
+         "net/url"
+         "net/http"
+         "crypto/rand"
+         "encoding/hex"
+         "encoding/json"
+         "encoding/base64"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../status"
+         "../problem"
+       )
+
+/*
+  Logs users in via an OpenID Connect provider (Keycloak, Dex, Azure AD,
+  Google,...) with the authorization code flow. Create with Discover().
+*/
+type OIDC struct {
+  Issuer string
+  ClientID string
+  ClientSecret string
+  
+  // The URL of the callback page (AuthPath + "callback") as seen by the
+  // provider and the browser, e.g. "https://files.example.com/.garcon/auth/callback".
+  // It must be registered with the provider.
+  RedirectURL string
+  
+  // Requested in addition to "openid", e.g. "profile", "email", "groups".
+  Scopes []string
+  
+  // The claim that contains the user name. If the ID token does not have
+  // it, "sub" is used.
+  UsernameClaim string
+  
+  // The claim that contains the list of groups of the user.
+  GroupsClaim string
+  
+  authorizationEndpoint string
+  tokenEndpoint string
+  
+  // Used for all requests to the provider.
+  client *http.Client
+}
+
+// The name of the cookie that holds state and nonce during login.
+const loginCookie = "garcon_login"
+
+// The contents of the loginCookie.
+type loginState struct {
+  State string `json:"state"`
+  Nonce string `json:"nonce"`
+  Next string `json:"next"`
+  Expires int64 `json:"exp"`
+}
+
+// ID token claims that are only relevant for verifying the token.
+// They are not stored in User.Claims.
+var protocolClaims = map[string]bool{"iss":true, "aud":true, "exp":true, "iat":true, "nbf":true, "nonce":true, "azp":true, "at_hash":true, "c_hash":true, "auth_time":true, "sid":true, "jti":true}
+
+var oidcLogins = status.NewCounter(`garcon_auth_logins_total{method="oidc"}`, "Successful logins.")
+var oidcFailures = status.NewCounter(`garcon_auth_login_failures_total{method="oidc"}`, "Failed logins.")
+
+/*
+  Fetches the configuration of the provider issuer from
+  issuer/.well-known/openid-configuration.
+  
+  Must be called before chroot. Besides reading the CA certificates for
+  the HTTPS connections, this resolves the host name of the provider's
+  token endpoint, because the DNS configuration is not available after
+  chroot. The addresses are reused for all later requests to that host.
+*/
+func Discover(issuer, clientID, clientSecret string) (*OIDC, error) {
+  issuer = strings.TrimSuffix(issuer, "/")
+  o := &OIDC{Issuer:issuer, ClientID:clientID, ClientSecret:clientSecret, UsernameClaim:"preferred_username", GroupsClaim:"groups"}
+  
+  resolved := map[string][]string{}
+  dialer := &net.Dialer{Timeout:30*time.Second}
+  transport := &http.Transport{
+    Proxy: http.ProxyFromEnvironment,
+    DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+      host, port, err := net.SplitHostPort(addr)
+      if err != nil { return nil, err }
+      for _, ip := range resolved[host] {
+        conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+        if err == nil { return conn, nil }
+      }
+      return dialer.DialContext(ctx, network, addr)
+    },
+    TLSHandshakeTimeout: 30*time.Second,
+  }
+  o.client = &http.Client{Transport:transport, Timeout:30*time.Second}
+  
+  resp, err := o.client.Get(issuer + "/.well-known/openid-configuration")
+  if err != nil { return nil, err }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    return nil, fmt.Errorf("%v/.well-known/openid-configuration: %v", issuer, resp.Status)
+  }
+  var conf struct {
+    Issuer string `json:"issuer"`
+    AuthorizationEndpoint string `json:"authorization_endpoint"`
+    TokenEndpoint string `json:"token_endpoint"`
+  }
+  err = json.NewDecoder(resp.Body).Decode(&conf)
+  if err != nil { return nil, err }
+  if conf.Issuer != issuer {
+    return nil, fmt.Errorf("Provider claims to be %q instead of %q", conf.Issuer, issuer)
+  }
+  if conf.AuthorizationEndpoint == "" || conf.TokenEndpoint == "" {
+    return nil, fmt.Errorf("%v: Authorization or token endpoint missing", issuer)
+  }
+  o.authorizationEndpoint = conf.AuthorizationEndpoint
+  o.tokenEndpoint = conf.TokenEndpoint
+  
+  u, err := url.Parse(o.tokenEndpoint)
+  if err != nil { return nil, err }
+  if net.ParseIP(u.Hostname()) == nil {
+    addrs, err := net.LookupHost(u.Hostname())
+    if err != nil { return nil, err }
+    resolved[u.Hostname()] = addrs
+  }
+  
+  util.Log(1, "OpenID Connect provider %v: token endpoint %v", issuer, o.tokenEndpoint)
+  return o, nil
+}
+
+// Returns a random hex string.
+func randomString() string {
+  b := make([]byte, 16)
+  _, err := rand.Read(b)
+  if err != nil { panic(err) }
+  return hex.EncodeToString(b)
+}
+
+// Returns next if it is a local path to return to after the login, "/" otherwise.
+func localPath(next string) string {
+  if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+    return "/"
+  }
+  return next
+}
+
+// Sends the browser to the provider's login page.
+func (o *OIDC) login(w http.ResponseWriter, r *http.Request, s *sessions) {
+  st := &loginState{State:randomString(), Nonce:randomString(), Next:localPath(r.URL.Query().Get("next")), Expires:time.Now().Add(10*time.Minute).Unix()}
+  value, err := s.seal(loginCookie, st)
+  if err != nil {
+    util.Log(0, "ERROR! Login: %v", err)
+    problem.Log(r, http.StatusInternalServerError, problem.Internal, "")
+    problem.Write(w, r, http.StatusInternalServerError, problem.Internal, "")
+    return
+  }
+  s.set(w, loginCookie, AuthPath, value, 10*time.Minute)
+  
+  q := url.Values{}
+  q.Set("response_type", "code")
+  q.Set("client_id", o.ClientID)
+  q.Set("redirect_uri", o.RedirectURL)
+  q.Set("scope", strings.Join(append([]string{"openid"}, o.Scopes...), " "))
+  q.Set("state", st.State)
+  q.Set("nonce", st.Nonce)
+  sep := "?"
+  if strings.Contains(o.authorizationEndpoint, "?") { sep = "&" }
+  http.Redirect(w, r, o.authorizationEndpoint + sep + q.Encode(), http.StatusFound)
+}
+
+/*
+  Answers the redirect from the provider after the user has logged in
+  by exchanging the code for an ID token and starting a session for the
+  user it identifies.
+*/
+func (o *OIDC) callback(w http.ResponseWriter, r *http.Request, s *sessions) {
+  fail := func(status int, format string, args ...interface{}) {
+    oidcFailures.Inc()
+    problem.Log(r, status, problem.LoginFailed, format, args...)
+    problem.Write(w, r, status, problem.LoginFailed, "Login failed")
+  }
+  
+  var st loginState
+  if !s.open(r, loginCookie, &st) || time.Now().Unix() >= st.Expires {
+    fail(http.StatusBadRequest, "login cookie missing or expired")
+    return
+  }
+  q := r.URL.Query()
+  if q.Get("state") != st.State {
+    fail(http.StatusBadRequest, "state mismatch")
+    return
+  }
+  if e := q.Get("error"); e != "" {
+    fail(http.StatusForbidden, "%v: %v", e, q.Get("error_description"))
+    return
+  }
+  
+  claims, err := o.exchange(q.Get("code"))
+  if err != nil {
+    fail(http.StatusBadGateway, "%v", err)
+    return
+  }
+  if err = o.verify(claims, st.Nonce); err != nil {
+    fail(http.StatusForbidden, "%v", err)
+    return
+  }
+  
+  u := &User{Claims:map[string]interface{}{}}
+  u.Name, _ = claims[o.UsernameClaim].(string)
+  if u.Name == "" { u.Name, _ = claims["sub"].(string) }
+  if groups, ok := claims[o.GroupsClaim].([]interface{}); ok {
+    for _, g := range groups {
+      if name, ok := g.(string); ok { u.Groups = append(u.Groups, name) }
+    }
+  }
+  for k, v := range claims {
+    if protocolClaims[k] || k == o.GroupsClaim { continue }
+    u.Claims[k] = v
+  }
+  
+  if err = s.login(w, u); err != nil {
+    fail(http.StatusInternalServerError, "%v", err)
+    return
+  }
+  http.SetCookie(w, &http.Cookie{Name:loginCookie, Value:"", Path:AuthPath, MaxAge:-1})
+  oidcLogins.Inc()
+  util.Log(1, "Login: %v (groups %v) via %v", u.Name, u.Groups, o.Issuer)
+  http.Redirect(w, r, st.Next, http.StatusFound)
+}
+
+/*
+  Exchanges the authorization code for tokens at the token endpoint and
+  returns the claims of the ID token.
+  
+  The signature of the ID token is not checked, because the token is
+  received directly from the token endpoint via TLS, which already
+  authenticates the provider (OpenID Connect Core 1.0, section 3.1.3.7).
+  The token endpoint must therefore use https.
+*/
+func (o *OIDC) exchange(code string) (map[string]interface{}, error) {
+  if code == "" { return nil, fmt.Errorf("No code") }
+  if !strings.HasPrefix(o.tokenEndpoint, "https://") {
+    return nil, fmt.Errorf("Token endpoint %v does not use https", o.tokenEndpoint)
+  }
+  form := url.Values{}
+  form.Set("grant_type", "authorization_code")
+  form.Set("code", code)
+  form.Set("redirect_uri", o.RedirectURL)
+  req, err := http.NewRequest("POST", o.tokenEndpoint, strings.NewReader(form.Encode()))
+  if err != nil { return nil, err }
+  req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+  req.SetBasicAuth(url.QueryEscape(o.ClientID), url.QueryEscape(o.ClientSecret))
+  
+  resp, err := o.client.Do(req)
+  if err != nil { return nil, err }
+  defer resp.Body.Close()
+  var tokens struct {
+    IDToken string `json:"id_token"`
+    Error string `json:"error"`
+  }
+  err = json.NewDecoder(resp.Body).Decode(&tokens)
+  if err != nil { return nil, fmt.Errorf("Token endpoint: %v %v", resp.Status, err) }
+  if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+    return nil, fmt.Errorf("Token endpoint: %v %v", resp.Status, tokens.Error)
+  }
+  
+  parts := strings.Split(tokens.IDToken, ".")
+  if len(parts) != 3 { return nil, fmt.Errorf("Malformed ID token") }
+  payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+  if err != nil { return nil, fmt.Errorf("Malformed ID token: %v", err) }
+  claims := map[string]interface{}{}
+  err = json.Unmarshal(payload, &claims)
+  if err != nil { return nil, fmt.Errorf("Malformed ID token: %v", err) }
+  return claims, nil
+}
+
+// Checks that the ID token claims have been issued for this login.
+func (o *OIDC) verify(claims map[string]interface{}, nonce string) error {
+  if iss, _ := claims["iss"].(string); iss != o.Issuer {
+    return fmt.Errorf("ID token issued by %q", iss)
+  }
+  audOK := false
+  switch aud := claims["aud"].(type) {
+    case string: audOK = aud == o.ClientID
+    case []interface{}:
+      for _, a := range aud { audOK = audOK || a == o.ClientID }
+      if azp, ok := claims["azp"].(string); ok && azp != o.ClientID { audOK = false }
+  }
+  if !audOK { return fmt.Errorf("ID token not issued for %v", o.ClientID) }
+  exp, _ := claims["exp"].(float64)
+  if time.Now().Unix() >= int64(exp) { return fmt.Errorf("ID token expired") }
+  if n, _ := claims["nonce"].(string); n != nonce { return fmt.Errorf("Nonce mismatch") }
+  return nil
+}
@@ -0,0 +1,410 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package auth
+
+import (
+         "os"
+         "fmt"
+         "sync"
+         "time"
+         "bytes"
+         "errors"
+         "os/user"
+         "syscall"
+         "os/exec"
+         "crypto/hmac"
+         "crypto/sha256"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../linux"
+         "../status"
+       )
+
+/*
+  Checks the passwords of HTTP Basic authentication against the host's
+  PAM stack. PAM modules need the host's /etc (pam.d, shadow, nsswitch.conf,...),
+  their shared libraries and usually root privileges, none of which are
+  available after chroot and dropping privileges. Therefore the checks are
+  done by helper processes that keep the privileges Garçon was started with.
+  They are started on demand by a supervisor process that StartPAM() starts
+  before chroot, so that a helper that has crashed or hangs can be replaced
+  later. A helper only answers whether a user name and password are valid
+  and which groups the user is in.
+  
+  Because Basic authentication sends the password with every request,
+  successful checks are cached for PAMCacheTime.
+*/
+type PAM struct {
+  // The PAM service, i.e. the name of the file in /etc/pam.d.
+  Service string
+  
+  // Connection to the supervisor, which starts helpers. Protected by supmutex.
+  supervisor *os.File
+  supmutex sync.Mutex
+  
+  // Connections to the idle helpers. nil stands for a helper that
+  // has to be started first.
+  idle chan *os.File
+  
+  // Maps user names to the results of successful checks.
+  cache map[string]*pamResult
+  cachemutex sync.Mutex
+  
+  // Failed checks per user name and per client ("@" + address).
+  // Protected by cachemutex.
+  failures map[string]*pamFailed
+  
+  // Key for the HMAC of the cached passwords.
+  key []byte
+}
+
+type pamResult struct {
+  mac []byte
+  groups []string
+  expires time.Time
+}
+
+type pamFailed struct {
+  count int
+  since time.Time
+}
+
+// How long a successful password check is remembered.
+var PAMCacheTime = 5*time.Minute
+
+// The number of helpers that check passwords at the same time.
+var PAMHelpers = 4
+
+// How long a check waits for an idle helper and for the helper's answer.
+var PAMTimeout = 30*time.Second
+
+// Failed checks allowed per user name and per client in PAMFailWindow.
+// Further attempts are rejected without asking PAM until the window has passed.
+var PAMMaxFailures = 5
+var PAMMaxClientFailures = 20
+var PAMFailWindow = 15*time.Minute
+
+// Returned by Authenticate() if the user or client has had too many failed attempts.
+var errPAMLimited = errors.New("Too many failed attempts. Try again later.")
+
+// If this environment variable is set, the process is the PAM supervisor.
+const pamHelperEnv = "GARCON_PAM_HELPER"
+
+// If this environment variable is set, the process is a PAM helper.
+const pamWorkerEnv = "GARCON_PAM_WORKER"
+
+var pamLogins = status.NewCounter(`garcon_auth_logins_total{method="pam"}`, "Successful logins.")
+var pamFailures = status.NewCounter(`garcon_auth_login_failures_total{method="pam"}`, "Failed logins.")
+var pamLimited = status.NewCounter(`garcon_auth_pam_rate_limited_total`, "PAM logins rejected because of too many failed attempts.")
+var pamRestarts = status.NewCounter(`garcon_auth_pam_helper_restarts_total`, "PAM helpers replaced because they crashed or did not answer.")
+
+/*
+  Starts the supervisor process that starts the helpers which check
+  passwords with the PAM service. Must be called before chroot and before
+  dropping privileges. The supervisor and the helpers are copies of the
+  running program, so main() must call PAMHelperMain() first thing.
+*/
+func StartPAM(service string) (*PAM, error) {
+  if !linux.PAMSupported {
+    return nil, fmt.Errorf("This binary has been built without PAM support (build with \"-tags pam\")")
+  }
+  mine, theirs, err := pamSocketpair()
+  if err != nil { return nil, err }
+  defer theirs.Close()
+  
+  cmd := pamCommand(pamHelperEnv + "=" + service, theirs)
+  err = cmd.Start()
+  if err != nil {
+    mine.Close()
+    return nil, err
+  }
+  go func() {
+    err := cmd.Wait()
+    util.Log(0, "ERROR! PAM supervisor for service %v has exited (%v). PAM logins fail from now on.", service, err)
+  }()
+  
+  p := &PAM{Service:service, supervisor:mine, idle:make(chan *os.File, PAMHelpers), cache:map[string]*pamResult{}, failures:map[string]*pamFailed{}, key:newSessions().key}
+  for i := 0; i < PAMHelpers; i++ {
+    conn, err := p.startHelper()
+    if err != nil {
+      p.Close()
+      return nil, err
+    }
+    p.idle <- conn
+  }
+  util.Log(1, "PAM supervisor for service %v started with PID %v", service, cmd.Process.Pid)
+  return p, nil
+}
+
+/*
+  Stops the supervisor and the helpers. Checks that are running may
+  still finish.
+*/
+func (p *PAM) Close() {
+  p.supmutex.Lock()
+  p.supervisor.Close()
+  p.supmutex.Unlock()
+  for {
+    select {
+      case conn := <-p.idle: if conn != nil { conn.Close() }
+      default: return
+    }
+  }
+}
+
+// Returns both ends of a new socket pair for talking to a helper or the supervisor.
+func pamSocketpair() (mine, theirs *os.File, err error) {
+  fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+  if err != nil { return nil, nil, os.NewSyscallError("socketpair", err) }
+  return os.NewFile(uintptr(fds[0]), "pam helper"), os.NewFile(uintptr(fds[1]), "pam helper"), nil
+}
+
+// Returns the command that runs a copy of the program with env and conn as fd 3.
+func pamCommand(env string, conn *os.File) *exec.Cmd {
+  cmd := exec.Command("/proc/self/exe")
+  cmd.Env = []string{env, "PATH=/usr/sbin:/usr/bin:/sbin:/bin"}
+  cmd.ExtraFiles = []*os.File{conn} // fd 3
+  cmd.Stderr = os.Stderr
+  cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig:syscall.SIGKILL}
+  return cmd
+}
+
+/*
+  Asks the supervisor for a new helper and returns the connection to it.
+  Reads from the connection can time out.
+*/
+func (p *PAM) startHelper() (*os.File, error) {
+  p.supmutex.Lock()
+  defer p.supmutex.Unlock()
+  _, err := p.supervisor.Write([]byte("start"))
+  if err != nil { return nil, fmt.Errorf("PAM supervisor: %v", err) }
+  
+  sc, err := p.supervisor.SyscallConn()
+  if err != nil { return nil, err }
+  msg := make([]byte, 1024)
+  oob := make([]byte, syscall.CmsgSpace(4))
+  var n, oobn int
+  cerr := sc.Read(func(fd uintptr) bool {
+    n, oobn, _, _, err = syscall.Recvmsg(int(fd), msg, oob, syscall.MSG_CMSG_CLOEXEC)
+    return err != syscall.EAGAIN
+  })
+  if err == nil { err = cerr }
+  if err == nil && n == 0 { err = fmt.Errorf("connection closed") }
+  if err != nil { return nil, fmt.Errorf("PAM supervisor: %v", err) }
+  
+  var fds []int
+  if scms, err := syscall.ParseSocketControlMessage(oob[:oobn]); err == nil && len(scms) == 1 {
+    fds, _ = syscall.ParseUnixRights(&scms[0])
+  }
+  if len(fds) != 1 {
+    for _, fd := range fds { syscall.Close(fd) }
+    return nil, fmt.Errorf("PAM supervisor: %s", bytes.TrimPrefix(msg[:n], []byte("fail\x00")))
+  }
+  // Non-blocking, so that reads can have a deadline.
+  syscall.SetNonblock(fds[0], true)
+  return os.NewFile(uintptr(fds[0]), "pam helper"), nil
+}
+
+/*
+  If the process has been started by StartPAM() or by the supervisor,
+  serves as supervisor or helper until Garçon exits and does not return.
+  Otherwise returns immediately.
+*/
+func PAMHelperMain() {
+  if service := os.Getenv(pamWorkerEnv); service != "" { pamWorkerMain(service) }
+  if service := os.Getenv(pamHelperEnv); service != "" { pamSupervisorMain(service) }
+}
+
+/*
+  Starts a new helper for every request from Garçon and sends the
+  connection to it back. Exits when Garçon closes the connection.
+*/
+func pamSupervisorMain(service string) {
+  conn := os.NewFile(3, "pam supervisor")
+  buf := make([]byte, 64)
+  for {
+    n, err := conn.Read(buf)
+    if err != nil || n == 0 { os.Exit(0) }
+    
+    mine, theirs, err := pamSocketpair()
+    if err == nil {
+      cmd := pamCommand(pamWorkerEnv + "=" + service, theirs)
+      err = cmd.Start()
+      theirs.Close()
+      if err == nil { go cmd.Wait() }
+    }
+    if err != nil {
+      _, err = conn.Write([]byte("fail\x00" + err.Error()))
+    } else {
+      err = syscall.Sendmsg(int(conn.Fd()), []byte("ok"), syscall.UnixRights(int(mine.Fd())), nil, 0)
+      mine.Close()
+    }
+    if err != nil { os.Exit(0) }
+  }
+}
+
+// Serves password checks until Garçon closes the connection.
+func pamWorkerMain(service string) {
+  conn := os.NewFile(3, "pam helper")
+  buf := make([]byte, 4096)
+  for {
+    n, err := conn.Read(buf)
+    if err != nil || n == 0 { os.Exit(0) }
+    parts := bytes.SplitN(buf[:n], []byte{0}, 2)
+    var reply []byte
+    if len(parts) != 2 {
+      reply = []byte("fail\x00malformed request")
+    } else {
+      name := string(parts[0])
+      err = linux.PAMAuthenticate(service, name, string(parts[1]))
+      for i := range parts[1] { parts[1][i] = 0 }
+      if err != nil {
+        reply = []byte("fail\x00" + err.Error())
+      } else {
+        reply = []byte("ok")
+        for _, g := range userGroups(name) { reply = append(reply, append([]byte{0}, g...)...) }
+      }
+    }
+    _, err = conn.Write(reply)
+    if err != nil { os.Exit(0) }
+  }
+}
+
+// Returns the names of the groups of the user name.
+func userGroups(name string) []string {
+  groups := []string{}
+  u, err := user.Lookup(name)
+  if err != nil { return groups }
+  gids, err := u.GroupIds()
+  if err != nil { return groups }
+  for _, gid := range gids {
+    if g, err := user.LookupGroupId(gid); err == nil { groups = append(groups, g.Name) }
+  }
+  return groups
+}
+
+func (p *PAM) mac(name, password string) []byte {
+  m := hmac.New(sha256.New, p.key)
+  m.Write([]byte(name + "\x00" + password))
+  return m.Sum(nil)
+}
+
+/*
+  Returns true if key (a user name or "@" + client address) has had too
+  many failed checks in the current PAMFailWindow. If failed is true,
+  a failed check is counted first. Must be called with cachemutex held.
+*/
+func (p *PAM) limited(key string, max int, failed bool) bool {
+  now := time.Now()
+  f := p.failures[key]
+  if f == nil || now.Sub(f.since) >= PAMFailWindow {
+    if !failed { return false }
+    if len(p.failures) >= 100000 {
+      for k, old := range p.failures {
+        if now.Sub(old.since) >= PAMFailWindow { delete(p.failures, k) }
+      }
+    }
+    f = &pamFailed{since:now}
+    p.failures[key] = f
+  }
+  if failed { f.count++ }
+  return f.count >= max
+}
+
+/*
+  Returns the User if name and password are valid for p.Service.
+  client is the address the request comes from. At most PAMHelpers checks
+  run at the same time, further ones wait up to PAMTimeout. A failed check
+  usually takes a few seconds (a delay imposed by PAM modules against
+  password guessing). After PAMMaxFailures failed checks for name or
+  PAMMaxClientFailures from client in PAMFailWindow, passwords are not
+  checked but rejected until the window has passed.
+*/
+func (p *PAM) Authenticate(name, password, client string) (*User, error) {
+  if name == "" || len(name) + len(password) > 2048 {
+    return nil, fmt.Errorf("Illegal user name or password")
+  }
+  mac := p.mac(name, password)
+  p.cachemutex.Lock()
+  cached := p.cache[name]
+  limited := p.limited(name, PAMMaxFailures, false) || p.limited("@" + client, PAMMaxClientFailures, false)
+  p.cachemutex.Unlock()
+  if cached != nil && time.Now().Before(cached.expires) && hmac.Equal(cached.mac, mac) {
+    return &User{Name:name, Groups:cached.groups}, nil
+  }
+  if limited {
+    pamLimited.Inc()
+    return nil, fmt.Errorf("%v from %v: %v", name, client, errPAMLimited)
+  }
+  
+  var conn *os.File
+  select {
+    case conn = <-p.idle:
+    case <-time.After(PAMTimeout): return nil, fmt.Errorf("PAM helper: all %v helpers busy", PAMHelpers)
+  }
+  reply, err := p.check(&conn, name, password)
+  p.idle <- conn
+  if err != nil { return nil, fmt.Errorf("PAM helper: %v", err) }
+  
+  parts := bytes.Split(reply, []byte{0})
+  if string(parts[0]) != "ok" {
+    pamFailures.Inc()
+    p.cachemutex.Lock()
+    p.limited(name, PAMMaxFailures, true)
+    p.limited("@" + client, PAMMaxClientFailures, true)
+    p.cachemutex.Unlock()
+    msg := ""
+    if len(parts) > 1 { msg = string(parts[1]) }
+    return nil, fmt.Errorf("%v: %v", name, msg)
+  }
+  groups := []string{}
+  for _, g := range parts[1:] { groups = append(groups, string(g)) }
+  
+  pamLogins.Inc()
+  p.cachemutex.Lock()
+  p.cache[name] = &pamResult{mac:mac, groups:groups, expires:time.Now().Add(PAMCacheTime)}
+  p.cachemutex.Unlock()
+  util.Log(1, "Login: %v (groups %v) via PAM", name, groups)
+  return &User{Name:name, Groups:groups}, nil
+}
+
+/*
+  Sends name and password to the helper *conn and returns its reply. A
+  helper that is not started yet (nil) is started first. If the helper
+  fails or does not answer within PAMTimeout, it is dropped and *conn is
+  set to nil, so that the next check starts a new one.
+*/
+func (p *PAM) check(conn **os.File, name, password string) ([]byte, error) {
+  var err error
+  if *conn == nil {
+    if *conn, err = p.startHelper(); err != nil { return nil, err }
+  }
+  reply := make([]byte, 65536)
+  _, err = (*conn).Write([]byte(name + "\x00" + password))
+  n := 0
+  if err == nil { err = (*conn).SetReadDeadline(time.Now().Add(PAMTimeout)) }
+  if err == nil { n, err = (*conn).Read(reply) }
+  if err == nil && n == 0 { err = fmt.Errorf("helper has exited") }
+  if err != nil {
+    pamRestarts.Inc()
+    util.Log(0, "ERROR! PAM helper failed: %v. Starting a new one.", err)
+    // Closing the connection makes the helper exit once it is done.
+    (*conn).Close()
+    *conn = nil
+    return nil, err
+  }
+  return reply[:n], nil
+}
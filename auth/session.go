@@ -0,0 +1,187 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package auth
+
+import (
+         "sync"
+         "time"
+         "strings"
+         "net/http"
+         "crypto/hmac"
+         "crypto/rand"
+         "crypto/sha256"
+         "encoding/json"
+         "encoding/base64"
+       )
+
+// How long a login is valid.
+var SessionLifetime = 8*time.Hour
+
+// The name of the cookie that holds the session.
+const sessionCookie = "garcon_session"
+
+// The request header that carries the CSRF token (see Policy.Wrap()).
+const CSRFHeader = "X-CSRF-Token"
+
+// The form field that carries the CSRF token in form submissions.
+const csrfField = "csrf_token"
+
+/*
+  Sessions are stored entirely in cookies that are signed with a key.
+  Unless the key is set with Policy.SetSessionKey(), it is generated at
+  startup, so a restart logs out all users.
+*/
+type sessions struct {
+  key []byte
+  
+  // If true, cookies are only sent over HTTPS.
+  secure bool
+  
+  // Protects revoked.
+  mutex sync.Mutex
+  
+  // Maps the Ids of sessions ended by logout to their expiry time.
+  // Cookies of these sessions are no longer accepted, even if the browser
+  // (or someone who has copied the cookie) still has them.
+  revoked map[string]int64
+}
+
+func newSessions() *sessions {
+  key := make([]byte, 32)
+  _, err := rand.Read(key)
+  if err != nil { panic(err) }
+  return &sessions{key:key, revoked:map[string]int64{}}
+}
+
+// The contents of a session cookie.
+type session struct {
+  // Random identifier of the session. The CSRF token is derived from it.
+  Id string `json:"id"`
+  User *User `json:"user"`
+  Expires int64 `json:"exp"`
+  
+  // Until when the user's second factor is confirmed (see TOTP).
+  Verified int64 `json:"totp,omitempty"`
+}
+
+// Returns the base64 encoded HMAC of data.
+func (s *sessions) mac(data string) string {
+  m := hmac.New(sha256.New, s.key)
+  m.Write([]byte(data))
+  return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+/*
+  Returns a value for a cookie named name that contains v (which is encoded
+  as JSON) and is valid until expires. The cookie's name is part of the
+  signature, so that one cookie can not be passed off as another.
+*/
+func (s *sessions) seal(name string, v interface{}) (string, error) {
+  data, err := json.Marshal(v)
+  if err != nil { return "", err }
+  payload := base64.RawURLEncoding.EncodeToString(data)
+  return payload + "." + s.mac(name + "=" + payload), nil
+}
+
+// Decodes the value of cookie name that was created by seal() into v.
+// Returns false if there is no such cookie or the signature is wrong.
+func (s *sessions) open(r *http.Request, name string, v interface{}) bool {
+  c, err := r.Cookie(name)
+  if err != nil { return false }
+  parts := strings.SplitN(c.Value, ".", 2)
+  if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(s.mac(name + "=" + parts[0]))) {
+    return false
+  }
+  data, err := base64.RawURLEncoding.DecodeString(parts[0])
+  if err != nil { return false }
+  return json.Unmarshal(data, v) == nil
+}
+
+// Sets cookie name with value to expire after lifetime.
+func (s *sessions) set(w http.ResponseWriter, name, path, value string, lifetime time.Duration) {
+  http.SetCookie(w, &http.Cookie{
+    Name:name,
+    Value:value,
+    Path:path,
+    MaxAge:int(lifetime/time.Second),
+    Secure:s.secure,
+    HttpOnly:true,
+    SameSite:http.SameSiteLaxMode,
+  })
+}
+
+// Starts a session for u.
+func (s *sessions) login(w http.ResponseWriter, u *User) error {
+  return s.start(w, &session{User:u, Expires:time.Now().Add(SessionLifetime).Unix()})
+}
+
+// Sets the cookie for sess with a new Id, which changes the CSRF token.
+func (s *sessions) start(w http.ResponseWriter, sess *session) error {
+  sess.Id = randomString()
+  value, err := s.seal(sessionCookie, sess)
+  if err != nil { return err }
+  s.set(w, sessionCookie, "/", value, time.Until(time.Unix(sess.Expires, 0)))
+  return nil
+}
+
+// Returns r's session or nil if there is no valid session.
+func (s *sessions) current(r *http.Request) *session {
+  var sess session
+  now := time.Now().Unix()
+  if !s.open(r, sessionCookie, &sess) || now >= sess.Expires || sess.User == nil {
+    return nil
+  }
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  if _, revoked := s.revoked[sess.Id]; revoked { return nil }
+  return &sess
+}
+
+// Returns the user of r's session or nil if there is no valid session.
+func (s *sessions) user(r *http.Request) *User {
+  if sess := s.current(r); sess != nil { return sess.User }
+  return nil
+}
+
+// Returns the CSRF token for sess.
+func (s *sessions) csrfToken(sess *session) string {
+  return s.mac("csrf=" + sess.Id)
+}
+
+/*
+  Returns true if r carries the CSRF token of sess, either in the CSRFHeader
+  or, for form submissions, in the form field "csrf_token".
+*/
+func (s *sessions) checkCSRF(r *http.Request, sess *session) bool {
+  token := r.Header.Get(CSRFHeader)
+  if token == "" && r.Method == "POST" && r.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
+    token = r.PostFormValue(csrfField)
+  }
+  return token != "" && hmac.Equal([]byte(token), []byte(s.csrfToken(sess)))
+}
+
+// Ends r's session, so that its cookie is no longer accepted.
+func (s *sessions) logout(w http.ResponseWriter, r *http.Request) {
+  if sess := s.current(r); sess != nil {
+    now := time.Now().Unix()
+    s.mutex.Lock()
+    for id, expires := range s.revoked {
+      if expires <= now { delete(s.revoked, id) }
+    }
+    s.revoked[sess.Id] = sess.Expires
+    s.mutex.Unlock()
+  }
+  http.SetCookie(w, &http.Cookie{Name:sessionCookie, Value:"", Path:"/", MaxAge:-1, Secure:s.secure, HttpOnly:true})
+}
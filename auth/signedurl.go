@@ -0,0 +1,305 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package auth
+
+import (
+         "os"
+         "fmt"
+         "path"
+         "sync"
+         "time"
+         "bufio"
+         "strconv"
+         "strings"
+         "net/url"
+         "net/http"
+         "crypto/hmac"
+         "crypto/sha256"
+         "encoding/json"
+         "encoding/base64"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../status"
+         "../problem"
+       )
+
+// The query parameters of a signed URL.
+const (
+  ExpiresParam = "expires"
+  SignatureParam = "signature"
+  // The nonce of a single-use URL.
+  OnceParam = "once"
+  // Whom the URL has been given to. Only used for logging.
+  RecipientParam = "for"
+)
+
+// The longest lifetime a signed URL can be given.
+var SignedURLMaxLifetime = 7*24*time.Hour
+
+/*
+  Signs URLs that allow reading a single path until they expire without
+  logging in, so that operators can hand out temporary links to files in
+  protected directories. The signature is an HMAC-SHA256 of the path and
+  the expiry time, so verifying it needs no state. Only single-use URLs
+  need a token store (see SetTokenStore()) that records which have been used.
+*/
+type URLSigner struct {
+  key []byte
+  
+  // Protects used and store.
+  mutex sync.Mutex
+  
+  // Maps the nonces of the single-use URLs that have been used to their
+  // expiry time. nil if there is no token store.
+  used map[string]int64
+  
+  // The file that used is persisted in.
+  store *os.File
+  
+  // When used was last cleared of expired nonces.
+  pruned time.Time
+}
+
+/*
+  Returns a URLSigner with the given key, which must have at least 32 bytes.
+  All URLs signed with a key become invalid when the key is changed.
+*/
+func NewURLSigner(key []byte) (*URLSigner, error) {
+  if len(key) < 32 { return nil, fmt.Errorf("URL signing key must have at least 32 bytes") }
+  return &URLSigner{key:key}, nil
+}
+
+var (
+  signedValid = status.NewCounter(`garcon_auth_signed_urls_total{result="ok"}`, "Requests with a signed URL.")
+  signedExpired = status.NewCounter(`garcon_auth_signed_urls_total{result="expired"}`, "Requests with a signed URL.")
+  signedInvalid = status.NewCounter(`garcon_auth_signed_urls_total{result="invalid"}`, "Requests with a signed URL.")
+  signedReused = status.NewCounter(`garcon_auth_signed_urls_total{result="used"}`, "Requests with a signed URL.")
+)
+
+/*
+  Makes s support single-use URLs, whose nonces are recorded in the file f
+  (opened for reading and writing), so that they stay used across restarts.
+  The nonces in f that have not expired are read and f is rewritten
+  without the expired ones.
+*/
+func (s *URLSigner) SetTokenStore(f *os.File) error {
+  used := map[string]int64{}
+  now := time.Now().Unix()
+  scanner := bufio.NewScanner(f)
+  for scanner.Scan() {
+    fields := strings.Fields(scanner.Text())
+    if len(fields) != 2 { continue }
+    exp, err := strconv.ParseInt(fields[1], 10, 64)
+    if err == nil && exp > now { used[fields[0]] = exp }
+  }
+  if err := scanner.Err(); err != nil { return err }
+  
+  err := f.Truncate(0)
+  if err != nil { return err }
+  _, err = f.Seek(0, 0)
+  if err != nil { return err }
+  w := bufio.NewWriter(f)
+  for nonce, exp := range used { fmt.Fprintf(w, "%v %v\n", nonce, exp) }
+  err = w.Flush()
+  if err != nil { return err }
+  
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  s.used = used
+  s.store = f
+  s.pruned = time.Now()
+  return nil
+}
+
+// Returns true if s can sign single-use URLs.
+func (s *URLSigner) SingleUse() bool {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  return s.used != nil
+}
+
+/*
+  Records the nonce of a single-use URL that expires at exp as used.
+  Returns false if it has been used before. If the token store can not
+  be written, the URL is not accepted either, so that it can not be used
+  again after a restart.
+*/
+func (s *URLSigner) use(nonce string, exp int64) (bool, error) {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  if _, used := s.used[nonce]; used { return false, nil }
+  _, err := fmt.Fprintf(s.store, "%v %v\n", nonce, exp)
+  if err != nil { return false, err }
+  s.used[nonce] = exp
+  if time.Since(s.pruned) > time.Hour {
+    now := time.Now().Unix()
+    for n, e := range s.used {
+      if e <= now { delete(s.used, n) }
+    }
+    s.pruned = time.Now()
+  }
+  return true, nil
+}
+
+/*
+  Returns the signature for the URL path clean expiring at the Unix time expires
+  with the nonce (for single-use URLs) and recipient, both of which may be "".
+*/
+func (s *URLSigner) signature(clean string, expires int64, nonce, recipient string) string {
+  mac := hmac.New(sha256.New, s.key)
+  fmt.Fprintf(mac, "%v\x00%v", clean, expires)
+  if nonce != "" || recipient != "" { fmt.Fprintf(mac, "\x00%v\x00%v", nonce, recipient) }
+  return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+/*
+  Returns the URL (path and query) that allows reading the URL path clean until
+  expires. If once is true, the URL can be used for a single GET request, which
+  requires a token store. recipient is logged when the URL is used and may be "".
+*/
+func (s *URLSigner) Sign(clean string, expires time.Time, recipient string, once bool) string {
+  exp := expires.Unix()
+  q := url.Values{ExpiresParam:{strconv.FormatInt(exp, 10)}}
+  nonce := ""
+  if once {
+    nonce = randomString()
+    q.Set(OnceParam, nonce)
+  }
+  if recipient != "" { q.Set(RecipientParam, recipient) }
+  q.Set(SignatureParam, s.signature(clean, exp, nonce, recipient))
+  u := url.URL{Path:clean, RawQuery:q.Encode()}
+  return u.String()
+}
+
+/*
+  Checks the signature of r for the URL path clean. If it is valid, returns
+  a copy of r without the signature parameters, so that they are neither
+  passed upstream by a proxy nor confused with the parameters of the page.
+*/
+func (s *URLSigner) verify(r *http.Request, clean string) (*http.Request, error) {
+  q := r.URL.Query()
+  exp, err := strconv.ParseInt(q.Get(ExpiresParam), 10, 64)
+  nonce, recipient := q.Get(OnceParam), q.Get(RecipientParam)
+  if err != nil || !hmac.Equal([]byte(q.Get(SignatureParam)), []byte(s.signature(clean, exp, nonce, recipient))) {
+    signedInvalid.Inc()
+    return nil, fmt.Errorf("Invalid signature")
+  }
+  if time.Now().Unix() >= exp {
+    signedExpired.Inc()
+    return nil, fmt.Errorf("Signed URL has expired")
+  }
+  if nonce != "" {
+    if !s.SingleUse() {
+      signedInvalid.Inc()
+      return nil, fmt.Errorf("Single-use URLs are not supported")
+    }
+    // Only the download itself uses up the URL.
+    if r.Method == "GET" {
+      ok, err := s.use(nonce, exp)
+      if err != nil {
+        util.Log(0, "ERROR! Recording use of signed URL: %v", err)
+        return nil, fmt.Errorf("Single-use URLs are not available")
+      }
+      if !ok {
+        signedReused.Inc()
+        return nil, fmt.Errorf("Signed URL has already been used")
+      }
+    } else {
+      s.mutex.Lock()
+      _, used := s.used[nonce]
+      s.mutex.Unlock()
+      if used {
+        signedReused.Inc()
+        return nil, fmt.Errorf("Signed URL has already been used")
+      }
+    }
+  }
+  if recipient != "" || nonce != "" {
+    util.Log(1, "Signed URL for %v used for %v %v (once: %v)", recipient, r.Method, clean, nonce != "")
+  }
+  signedValid.Inc()
+  q.Del(ExpiresParam)
+  q.Del(SignatureParam)
+  q.Del(OnceParam)
+  q.Del(RecipientParam)
+  u := *r.URL
+  u.RawQuery = q.Encode()
+  r2 := r.WithContext(r.Context())
+  r2.URL = &u
+  r2.RequestURI = u.RequestURI()
+  return r2, nil
+}
+
+/*
+  Answers a POST request for AuthPath+"sign?path=/file&lifetime=24h" of
+  the logged in user u with a JSON object {"url":"...","expires":...} that
+  contains the signed URL for path. The user must be allowed to read path.
+  With once=1 the URL can only be used for one download and with
+  for=recipient its uses are logged with recipient.
+*/
+func (p *Policy) serveSign(w http.ResponseWriter, r *http.Request, u *User) {
+  w.Header().Set("Cache-Control", "no-store")
+  fail := func(status int, msg string) {
+    problem.Log(r, status, problem.CodeFor(status), "%v", msg)
+    problem.WriteJSON(w, r, status, problem.CodeFor(status), msg)
+  }
+  if p.URLs == nil {
+    fail(http.StatusNotFound, "Signed URLs are not enabled")
+    return
+  }
+  if r.Method != "POST" {
+    w.Header().Set("Allow", "POST")
+    fail(http.StatusMethodNotAllowed, "Signing requires POST")
+    return
+  }
+  if u == nil {
+    authRequired.Inc()
+    p.requireLogin(w, r)
+    return
+  }
+  q := r.URL.Query()
+  if q.Get("path") == "" {
+    fail(http.StatusBadRequest, "path missing")
+    return
+  }
+  clean := path.Clean("/" + q.Get("path"))
+  lifetime := 24*time.Hour
+  if l := q.Get("lifetime"); l != "" {
+    var err error
+    lifetime, err = time.ParseDuration(l)
+    if err != nil || lifetime <= 0 || lifetime > SignedURLMaxLifetime {
+      fail(http.StatusBadRequest, fmt.Sprintf("lifetime must be a duration up to %v", SignedURLMaxLifetime))
+      return
+    }
+  }
+  once := q.Get("once") != ""
+  if once && !p.URLs.SingleUse() {
+    fail(http.StatusBadRequest, "Single-use URLs require a token store")
+    return
+  }
+  if allowed, _ := p.Allowed(u, clean, READ); !allowed {
+    authForbidden.Inc()
+    fail(http.StatusForbidden, fmt.Sprintf("user %v may not read %v", u.Name, clean))
+    return
+  }
+  expires := time.Now().Add(lifetime)
+  recipient := q.Get("for")
+  util.Log(0, "User %v signed %v until %v (for: %v, once: %v)", u.Name, clean, expires.Format(time.RFC3339), recipient, once)
+  w.Header().Set("Content-Type", "application/json")
+  enc := json.NewEncoder(w)
+  enc.SetEscapeHTML(false) // keep the & in the URL readable
+  enc.Encode(map[string]interface{}{"url":p.URLs.Sign(clean, expires, recipient, once), "expires":expires.Unix()})
+}
@@ -0,0 +1,85 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package auth
+
+import (
+         "io"
+         "fmt"
+         "bufio"
+         "strings"
+         "net/http"
+         "crypto/sha256"
+         "encoding/hex"
+       )
+
+/*
+  API tokens for scripts and automation, which send them in the header
+    Authorization: Bearer <token>
+  A token stands for a user and that user's groups, so the Grants apply as
+  for a logged in user. Because browsers never send such headers on their
+  own, requests with a token need no CSRF protection and no second factor.
+*/
+type Tokens struct {
+  // The users by the SHA-256 (hex) of their tokens.
+  users map[string]*User
+}
+
+/*
+  Reads the tokens from r. Each line has the form
+    sha256 user [group ...]
+  where sha256 is the SHA-256 (hex) of the token, so that the file does not
+  contain the tokens themselves. Empty lines and lines starting with "#" are
+  ignored. NewToken() creates such lines.
+*/
+func ReadTokens(r io.Reader) (*Tokens, error) {
+  t := &Tokens{users:map[string]*User{}}
+  scanner := bufio.NewScanner(r)
+  lineno := 0
+  for scanner.Scan() {
+    lineno++
+    fields := strings.Fields(scanner.Text())
+    if len(fields) == 0 || strings.HasPrefix(fields[0], "#") { continue }
+    if len(fields) < 2 { return nil, fmt.Errorf("Line %v: Expected token hash and user", lineno) }
+    if h, err := hex.DecodeString(fields[0]); err != nil || len(h) != sha256.Size {
+      return nil, fmt.Errorf("Line %v: Illegal token hash", lineno)
+    }
+    t.users[strings.ToLower(fields[0])] = &User{Name:fields[1], Groups:fields[2:]}
+  }
+  return t, scanner.Err()
+}
+
+/*
+  Creates a new token for user with the given groups. Returns the line for
+  the file read by ReadTokens() and the token to give to the user.
+*/
+func NewToken(user string, groups []string) (line string, token string) {
+  token = randomString() + randomString()
+  sum := sha256.Sum256([]byte(token))
+  line = strings.Join(append([]string{hex.EncodeToString(sum[:]), user}, groups...), " ")
+  return line, token
+}
+
+// Returns the bearer token of r or "" if it has none.
+func bearerToken(r *http.Request) string {
+  h := r.Header.Get("Authorization")
+  if len(h) < 7 || !strings.EqualFold(h[0:7], "Bearer ") { return "" }
+  return strings.TrimSpace(h[7:])
+}
+
+// Returns the user of token or nil if token is not valid.
+func (t *Tokens) user(token string) *User {
+  sum := sha256.Sum256([]byte(token))
+  return t.users[hex.EncodeToString(sum[:])]
+}
@@ -0,0 +1,282 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package auth
+
+import (
+         "io"
+         "fmt"
+         "sync"
+         "time"
+         "bufio"
+         "html"
+         "errors"
+         "strings"
+         "net/url"
+         "net/http"
+         "crypto/hmac"
+         "crypto/rand"
+         "crypto/sha1"
+         "crypto/sha256"
+         "encoding/hex"
+         "encoding/base32"
+         "encoding/binary"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../status"
+         "../problem"
+       )
+
+/*
+  Time-based one-time passwords (RFC 6238 with SHA-1, 6 digits and a
+  30s time step, as used by all common authenticator apps) as second
+  factor for users whose writes can do damage. Users that have a secret
+  must confirm a code (or one of their recovery codes) before their write
+  requests are accepted. The confirmation lasts for TOTPLifetime.
+*/
+type TOTP struct {
+  // Protects everything below.
+  mutex sync.Mutex
+  
+  // The users' shared secrets.
+  secrets map[string][]byte
+  
+  // The SHA-256 (hex) of each user's unused recovery codes.
+  recovery map[string]map[string]bool
+  
+  // The last time step for which a code has been accepted per user.
+  // Older and equal steps are rejected, so a code can not be used twice.
+  laststep map[string]int64
+  
+  // Failed verifications per user since failwindow[user].
+  failures map[string]int
+  failwindow map[string]time.Time
+}
+
+// Returned by Verify() if the user has had too many failed attempts.
+var errTOTPLimited = errors.New("Too many failed attempts. Try again later.")
+
+// How long a confirmed second factor lasts.
+var TOTPLifetime = 15*time.Minute
+
+// Failed verifications allowed per user in TOTPFailWindow. Further attempts
+// are rejected without checking the code until the window has passed.
+var TOTPMaxFailures = 5
+var TOTPFailWindow = 15*time.Minute
+
+var totpVerified = status.NewCounter(`garcon_auth_totp_total{result="ok"}`, "Second factor verifications.")
+var totpFailed = status.NewCounter(`garcon_auth_totp_total{result="failed"}`, "Second factor verifications.")
+var totpLimited = status.NewCounter(`garcon_auth_totp_total{result="rate-limited"}`, "Second factor verifications.")
+
+/*
+  Reads the TOTP secrets from r. Each line has the form
+    user base32secret [recovery ...]
+  where each recovery is the SHA-256 (hex) of a recovery code.
+  Empty lines and lines starting with "#" are ignored.
+  NewTOTPSecret() creates such lines.
+*/
+func ReadTOTP(r io.Reader) (*TOTP, error) {
+  t := &TOTP{secrets:map[string][]byte{}, recovery:map[string]map[string]bool{}, laststep:map[string]int64{}, failures:map[string]int{}, failwindow:map[string]time.Time{}}
+  scanner := bufio.NewScanner(r)
+  lineno := 0
+  for scanner.Scan() {
+    lineno++
+    fields := strings.Fields(scanner.Text())
+    if len(fields) == 0 || strings.HasPrefix(fields[0], "#") { continue }
+    if len(fields) < 2 { return nil, fmt.Errorf("Line %v: Expected user and secret", lineno) }
+    secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(strings.TrimRight(fields[1], "=")))
+    if err != nil || len(secret) < 10 { return nil, fmt.Errorf("Line %v: Illegal secret", lineno) }
+    t.secrets[fields[0]] = secret
+    t.recovery[fields[0]] = map[string]bool{}
+    for _, h := range fields[2:] { t.recovery[fields[0]][strings.ToLower(h)] = true }
+  }
+  return t, scanner.Err()
+}
+
+/*
+  Creates a new secret and 8 recovery codes for user. Returns the line for
+  the file read by ReadTOTP(), the otpauth:// URI for authenticator apps
+  (usually shown as QR code) and the recovery codes to give to the user.
+*/
+func NewTOTPSecret(user, issuer string) (line string, uri string, codes []string) {
+  secret := make([]byte, 20)
+  _, err := rand.Read(secret)
+  if err != nil { panic(err) }
+  s := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+  line = user + " " + s
+  for i := 0; i < 8; i++ {
+    code := randomString()[:10]
+    codes = append(codes, code)
+    sum := sha256.Sum256([]byte(code))
+    line += " " + hex.EncodeToString(sum[:])
+  }
+  uri = "otpauth://totp/" + url.PathEscape(issuer + ":" + user) + "?secret=" + s + "&issuer=" + url.QueryEscape(issuer)
+  return line, uri, codes
+}
+
+// Returns true if user needs a second factor.
+func (t *TOTP) Enrolled(user string) bool {
+  t.mutex.Lock()
+  defer t.mutex.Unlock()
+  _, ok := t.secrets[user]
+  return ok
+}
+
+// Returns the 6 digit code for secret and time step.
+func totpCode(secret []byte, step int64) string {
+  var msg [8]byte
+  binary.BigEndian.PutUint64(msg[:], uint64(step))
+  m := hmac.New(sha1.New, secret)
+  m.Write(msg[:])
+  sum := m.Sum(nil)
+  offset := sum[len(sum)-1] & 0xf
+  n := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+  return fmt.Sprintf("%06d", n % 1000000)
+}
+
+/*
+  Checks code, which is either the current TOTP code of user (the previous
+  and the next are accepted, too, to allow for clock differences) or one of
+  their unused recovery codes, which is used up by this. Returns an error if
+  the code is wrong or has been used before or if user has had too many
+  failed attempts recently.
+*/
+func (t *TOTP) Verify(user, code string) error {
+  t.mutex.Lock()
+  defer t.mutex.Unlock()
+  secret, ok := t.secrets[user]
+  if !ok { return fmt.Errorf("%v has no TOTP secret", user) }
+  
+  now := time.Now()
+  if now.Sub(t.failwindow[user]) >= TOTPFailWindow {
+    t.failwindow[user] = now
+    t.failures[user] = 0
+  }
+  if t.failures[user] >= TOTPMaxFailures {
+    totpLimited.Inc()
+    return errTOTPLimited
+  }
+  
+  code = strings.TrimSpace(code)
+  if len(code) == 6 {
+    step := now.Unix() / 30
+    for s := step - 1; s <= step + 1; s++ {
+      if hmac.Equal([]byte(totpCode(secret, s)), []byte(code)) {
+        if s <= t.laststep[user] { break } // replayed
+        t.laststep[user] = s
+        totpVerified.Inc()
+        return nil
+      }
+    }
+  } else if code != "" {
+    sum := sha256.Sum256([]byte(code))
+    h := hex.EncodeToString(sum[:])
+    if t.recovery[user][h] {
+      delete(t.recovery[user], h)
+      totpVerified.Inc()
+      util.Log(0, "WARNING! %v has used recovery code %v... (%v left). Remove it from the TOTP file, or it becomes usable again after a restart.", user, h[:12], len(t.recovery[user]))
+      return nil
+    }
+  }
+  
+  t.failures[user]++
+  totpFailed.Inc()
+  return fmt.Errorf("Wrong or used code for %v", user)
+}
+
+// The form for entering the code. %v are the CSRF token and the next page.
+const totpForm = `<!DOCTYPE html>
+<html>
+<head><meta charset="UTF-8" /><title>Second factor</title></head>
+<body>
+<form method="post">
+<p><label>Code from your authenticator app or recovery code: <input name="code" autocomplete="one-time-code" autofocus="autofocus" /></label></p>
+<input type="hidden" name="csrf_token" value="%v" />
+<input type="hidden" name="next" value="%v" />
+<p><input type="submit" value="Confirm" /></p>
+</form>
+</body>
+</html>
+`
+
+/*
+  GET shows a form for entering the code. POST with the form field "code"
+  confirms the second factor of the logged in user (via session or Basic
+  authentication) for TOTPLifetime. This starts a new session whose cookie
+  must be sent with the following write requests. If the form field "next"
+  is a local path, the browser is redirected there, otherwise the new
+  session is described as by serveSession(), including the new CSRF token.
+*/
+func (p *Policy) serveTOTP(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Cache-Control", "no-store")
+  sess := p.sessions.current(r)
+  if sess == nil {
+    sess = &session{Expires:time.Now().Add(SessionLifetime).Unix()}
+    if name, password, ok := r.BasicAuth(); ok && p.PAM != nil {
+      sess.User, _ = p.PAM.Authenticate(name, password, clientAddr(r))
+    }
+  }
+  if sess.User == nil {
+    authRequired.Inc()
+    p.requireLogin(w, r)
+    return
+  }
+  u := sess.User
+  
+  switch r.Method {
+    case "GET", "HEAD":
+      token := ""
+      if sess.Id != "" { token = p.sessions.csrfToken(sess) }
+      w.Header().Set("Content-Type", "text/html; charset=utf-8")
+      fmt.Fprintf(w, totpForm, html.EscapeString(token), html.EscapeString(localPath(r.URL.Query().Get("next"))))
+      return
+    case "POST":
+    default:
+      w.Header().Set("Allow", "GET, HEAD, POST")
+      problem.Log(r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "")
+      problem.Write(w, r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "")
+      return
+  }
+  
+  if crossSite(r) || (sess.Id != "" && !p.sessions.checkCSRF(r, sess)) {
+    csrfRejected.Inc()
+    problem.Log(r, http.StatusForbidden, problem.CSRFRejected, "user %v: cross-site request or CSRF token wrong", u.Name)
+    problem.Write(w, r, http.StatusForbidden, problem.CSRFRejected, "Cross-site request or CSRF token wrong")
+    return
+  }
+  
+  err := p.TOTP.Verify(u.Name, r.PostFormValue("code"))
+  if err != nil {
+    status, code := http.StatusForbidden, problem.SecondFactorFailed
+    if err == errTOTPLimited { status, code = http.StatusTooManyRequests, problem.RateLimited }
+    problem.Log(r, status, code, "user %v: %v", u.Name, err)
+    problem.Write(w, r, status, code, err.Error())
+    return
+  }
+  
+  sess.Verified = time.Now().Add(TOTPLifetime).Unix()
+  if err = p.sessions.start(w, sess); err != nil {
+    util.Log(0, "ERROR! %v", err)
+    problem.Log(r, http.StatusInternalServerError, problem.Internal, "")
+    problem.Write(w, r, http.StatusInternalServerError, problem.Internal, "")
+    return
+  }
+  util.Log(1, "Second factor confirmed: %v", u.Name)
+  if next := r.PostFormValue("next"); next != "" {
+    http.Redirect(w, r, localPath(next), http.StatusSeeOther)
+    return
+  }
+  p.writeSession(w, sess)
+}
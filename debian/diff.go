@@ -0,0 +1,179 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package debian
+
+import (
+         "io"
+         "sort"
+         "bufio"
+         "strings"
+         "html/template"
+       )
+
+// A package listed in a Packages or Sources file of a suite.
+type Package struct {
+  Name string `json:"name"`
+  Version string `json:"version"`
+  // "source" for source packages.
+  Architecture string `json:"architecture"`
+  Component string `json:"component"`
+}
+
+/*
+  Reads the Packages or Sources file r of component and returns the
+  packages listed in it. Source packages get the Architecture "source".
+*/
+func ReadPackages(r io.Reader, component string, sources bool) ([]Package, error) {
+  var pkgs []Package
+  var p Package
+  flush := func() {
+    if p.Name != "" {
+      if sources { p.Architecture = "source" }
+      p.Component = component
+      pkgs = append(pkgs, p)
+    }
+    p = Package{}
+  }
+  scanner := bufio.NewScanner(r)
+  scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+  for scanner.Scan() {
+    line := scanner.Text()
+    if strings.TrimSpace(line) == "" {
+      flush()
+      continue
+    }
+    if line[0] == ' ' || line[0] == '\t' { continue } // continuation of a multi-line field
+    kv := strings.SplitN(line, ":", 2)
+    if len(kv) != 2 { continue }
+    value := strings.TrimSpace(kv[1])
+    switch kv[0] {
+      case "Package": p.Name = value
+      case "Version": p.Version = value
+      case "Architecture": p.Architecture = value
+    }
+  }
+  flush()
+  return pkgs, scanner.Err()
+}
+
+// A package whose version differs between two suites.
+type Change struct {
+  Name string `json:"name"`
+  Architecture string `json:"architecture"`
+  Component string `json:"component"`
+  // "" if the package is not in the old or new suite, respectively.
+  Old string `json:"old,omitempty"`
+  New string `json:"new,omitempty"`
+}
+
+// The differences between the packages of two suites.
+type Diff struct {
+  Old string `json:"old"`
+  New string `json:"new"`
+  Added []Change `json:"added"`
+  Removed []Change `json:"removed"`
+  Upgraded []Change `json:"upgraded"`
+  Downgraded []Change `json:"downgraded"`
+}
+
+/*
+  Compares the packages of the suites old and new (named oldname and newname).
+  If a suite has several versions of a package for the same architecture,
+  the highest one counts.
+*/
+func DiffPackages(oldname string, old []Package, newname string, new []Package) *Diff {
+  d := &Diff{Old:oldname, New:newname, Added:[]Change{}, Removed:[]Change{}, Upgraded:[]Change{}, Downgraded:[]Change{}}
+  o, n := latest(old), latest(new)
+  for key, np := range n {
+    c := Change{Name:np.Name, Architecture:np.Architecture, Component:np.Component, New:np.Version}
+    op, ok := o[key]
+    if !ok {
+      d.Added = append(d.Added, c)
+      continue
+    }
+    c.Old = op.Version
+    switch CompareVersions(op.Version, np.Version) {
+      case -1: d.Upgraded = append(d.Upgraded, c)
+      case 1: d.Downgraded = append(d.Downgraded, c)
+    }
+  }
+  for key, op := range o {
+    if _, ok := n[key]; !ok {
+      d.Removed = append(d.Removed, Change{Name:op.Name, Architecture:op.Architecture, Component:op.Component, Old:op.Version})
+    }
+  }
+  for _, changes := range [][]Change{d.Added, d.Removed, d.Upgraded, d.Downgraded} {
+    sort.Slice(changes, func(i, j int) bool {
+      if changes[i].Name != changes[j].Name { return changes[i].Name < changes[j].Name }
+      return changes[i].Architecture < changes[j].Architecture
+    })
+  }
+  return d
+}
+
+// Returns the highest version of each package of pkgs by name and architecture.
+func latest(pkgs []Package) map[string]Package {
+  m := map[string]Package{}
+  for _, p := range pkgs {
+    key := p.Name + " " + p.Architecture
+    if q, ok := m[key]; !ok || CompareVersions(q.Version, p.Version) < 0 { m[key] = p }
+  }
+  return m
+}
+
+var diffPage = template.Must(template.New("diff").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>{{.Old}} &rarr; {{.New}}</title>
+<style>
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { text-align: left; padding: 0.2em 1em 0.2em 0; }
+.old { color: #a00; }
+.new { color: #070; }
+</style>
+</head>
+<body>
+<h1>{{.Old}} &rarr; {{.New}}</h1>
+<p>{{len .Added}} added, {{len .Removed}} removed, {{len .Upgraded}} upgraded, {{len .Downgraded}} downgraded</p>
+{{- range $section := .Sections}}
+{{- if .Changes}}
+<h2>{{.Title}}</h2>
+<table>
+<thead><tr><th>Package</th><th>Architecture</th><th>Component</th><th>{{$.Old}}</th><th>{{$.New}}</th></tr></thead>
+<tbody>
+{{- range .Changes}}
+<tr><td>{{.Name}}</td><td>{{.Architecture}}</td><td>{{.Component}}</td><td class="old">{{.Old}}</td><td class="new">{{.New}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+{{- end}}
+{{- end}}
+</body>
+</html>
+`))
+
+// A table of the diff page.
+type diffSection struct {
+  Title string
+  Changes []Change
+}
+
+// Writes d as HTML page to w.
+func (d *Diff) WriteHTML(w io.Writer) error {
+  return diffPage.Execute(w, struct{
+    *Diff
+    Sections []diffSection
+  }{d, []diffSection{{"Added", d.Added}, {"Removed", d.Removed}, {"Upgraded", d.Upgraded}, {"Downgraded", d.Downgraded}}})
+}
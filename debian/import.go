@@ -0,0 +1,202 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+/*
+  Imports the published parts of Debian repositories maintained by reprepro
+  or aptly into a directory served by Garçon, so that the repository can be
+  served without the tool's private files (conf/, db/, aptly's internal pool),
+  and compares the packages of suites.
+*/
+package debian
+
+import (
+         "io"
+         "os"
+         "fmt"
+         "path"
+         "bufio"
+         "strings"
+         "io/ioutil"
+         "path/filepath"
+       )
+
+// What an import has done.
+type ImportStats struct {
+  // Files that have been hard linked or copied.
+  Linked, Copied int
+  
+  // Files that were already there with the same size and mtime.
+  Unchanged int
+  
+  // Bytes copied.
+  Bytes int64
+}
+
+func (s *ImportStats) String() string {
+  return fmt.Sprintf("%v files linked, %v copied (%v bytes), %v unchanged", s.Linked, s.Copied, s.Bytes, s.Unchanged)
+}
+
+/*
+  Imports the pool/ and dists/ directories of the reprepro repository with
+  the base directory basedir (the one with conf/distributions) into dest.
+  If conf/options sets outdir, they are taken from there.
+*/
+func ImportReprepro(basedir, dest string) (*ImportStats, error) {
+  if _, err := os.Stat(path.Join(basedir, "conf", "distributions")); err != nil {
+    return nil, fmt.Errorf("%v is not a reprepro base directory: %v", basedir, err)
+  }
+  outdir, err := repreproOutdir(basedir)
+  if err != nil { return nil, err }
+  return importTree(outdir, dest, []string{"pool", "dists"})
+}
+
+// Returns the directory that contains pool/ and dists/ of the reprepro
+// repository basedir according to its conf/options.
+func repreproOutdir(basedir string) (string, error) {
+  outdir := basedir
+  f, err := os.Open(path.Join(basedir, "conf", "options"))
+  if os.IsNotExist(err) { return outdir, nil }
+  if err != nil { return "", err }
+  defer f.Close()
+  scanner := bufio.NewScanner(f)
+  for scanner.Scan() {
+    fields := strings.Fields(scanner.Text())
+    if len(fields) < 2 || strings.TrimPrefix(fields[0], "--") != "outdir" { continue }
+    dir := fields[1]
+    switch {
+      case strings.HasPrefix(dir, "+b/"): outdir = path.Join(basedir, dir[3:])
+      case strings.HasPrefix(dir, "+"): return "", fmt.Errorf("%v/conf/options: Unsupported outdir %v", basedir, dir)
+      case path.IsAbs(dir): outdir = dir
+      default: outdir = path.Join(basedir, dir)
+    }
+  }
+  return outdir, scanner.Err()
+}
+
+/*
+  Imports the published repositories of aptly (everything in the public/
+  directory of its rootDir, i.e. all publishing prefixes) into dest.
+  rootdir can also be the public/ directory itself.
+*/
+func ImportAptly(rootdir, dest string) (*ImportStats, error) {
+  public := path.Join(rootdir, "public")
+  if fi, err := os.Stat(public); err != nil || !fi.IsDir() {
+    if _, err := os.Stat(path.Join(rootdir, "db")); err == nil {
+      return nil, fmt.Errorf("%v has nothing published yet", rootdir)
+    }
+    public = rootdir
+  }
+  fis, err := ioutil.ReadDir(public)
+  if err != nil { return nil, err }
+  names := []string{}
+  for _, fi := range fis { names = append(names, fi.Name()) }
+  if len(names) == 0 { return nil, fmt.Errorf("%v is empty", public) }
+  return importTree(public, dest, names)
+}
+
+// The files that list the checksums of a suite's metadata.
+var releaseFiles = map[string]bool{"Release":true, "InRelease":true, "Release.gpg":true}
+
+/*
+  Hard links or copies the entries names of the directory src and everything
+  below them into dest, replacing files that differ. Symlinks (e.g. suite
+  aliases like dists/stable) are recreated. The Release files are written
+  last, so that a running Garçon switches to the new metadata of a suite only
+  when everything it refers to is in place.
+*/
+func importTree(src, dest string, names []string) (*ImportStats, error) {
+  stats := &ImportStats{}
+  releases := []string{}
+  for _, name := range names {
+    top := path.Join(src, name)
+    if _, err := os.Lstat(top); os.IsNotExist(err) { continue }
+    err := filepath.Walk(top, func(p string, fi os.FileInfo, err error) error {
+      if err != nil { return err }
+      rel := strings.TrimPrefix(p, src + "/")
+      target := path.Join(dest, rel)
+      switch {
+        case fi.IsDir():
+          err = os.MkdirAll(target, fi.Mode().Perm())
+        case fi.Mode() & os.ModeSymlink != 0:
+          err = importSymlink(p, target)
+        case !fi.Mode().IsRegular():
+          // Sockets, FIFOs and such are not part of a repository.
+        case releaseFiles[fi.Name()]:
+          releases = append(releases, rel)
+        default:
+          err = importFile(p, target, fi, stats)
+      }
+      return err
+    })
+    if err != nil { return stats, err }
+  }
+  for _, rel := range releases {
+    p := path.Join(src, rel)
+    fi, err := os.Stat(p)
+    if err == nil { err = importFile(p, path.Join(dest, rel), fi, stats) }
+    if err != nil { return stats, err }
+  }
+  return stats, nil
+}
+
+// Recreates the symlink p as target unless it is already there.
+func importSymlink(p, target string) error {
+  link, err := os.Readlink(p)
+  if err != nil { return err }
+  if old, err := os.Readlink(target); err == nil && old == link { return nil }
+  tmp := path.Join(path.Dir(target), ".import-" + path.Base(target))
+  os.Remove(tmp)
+  err = os.Symlink(link, tmp)
+  if err == nil { err = os.Rename(tmp, target) }
+  return err
+}
+
+/*
+  Puts the file p with the FileInfo fi at target, unless target already has
+  the same size and mtime. A hard link is used if possible. Otherwise p is
+  copied. Either way, target is replaced atomically.
+*/
+func importFile(p, target string, fi os.FileInfo, stats *ImportStats) error {
+  if old, err := os.Stat(target); err == nil && old.Mode().IsRegular() && old.Size() == fi.Size() && old.ModTime().Equal(fi.ModTime()) {
+    stats.Unchanged++
+    return nil
+  }
+  
+  tmp := path.Join(path.Dir(target), ".import-" + path.Base(target))
+  os.Remove(tmp)
+  if os.Link(p, tmp) == nil {
+    err := os.Rename(tmp, target)
+    if err != nil { return err }
+    stats.Linked++
+    return nil
+  }
+  
+  in, err := os.Open(p)
+  if err != nil { return err }
+  defer in.Close()
+  out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+  if err != nil { return err }
+  n, err := io.Copy(out, in)
+  if err == nil { err = out.Sync() }
+  if err2 := out.Close(); err == nil { err = err2 }
+  if err == nil { err = os.Chtimes(tmp, fi.ModTime(), fi.ModTime()) }
+  if err == nil { err = os.Rename(tmp, target) }
+  if err != nil {
+    os.Remove(tmp)
+    return err
+  }
+  stats.Copied++
+  stats.Bytes += n
+  return nil
+}
@@ -0,0 +1,72 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package debian
+
+import (
+         "io"
+         "path"
+         "bufio"
+         "strconv"
+         "strings"
+       )
+
+/*
+  Reads the Packages or Sources file r and adds the files in pool/ it
+  refers to (paths relative to the repository's root) with their sizes
+  to files. Files listed more than once (e.g. in the Packages files of
+  several suites) are only added once.
+*/
+func ReadPoolFiles(r io.Reader, sources bool, files map[string]int64) error {
+  filename := ""
+  size := int64(-1)
+  directory := ""
+  var srcfiles [][2]string
+  flush := func() {
+    if filename != "" && size >= 0 { files[filename] = size }
+    for _, f := range srcfiles {
+      if n, err := strconv.ParseInt(f[0], 10, 64); err == nil && directory != "" { files[path.Join(directory, f[1])] = n }
+    }
+    filename, size, directory, srcfiles = "", -1, "", nil
+  }
+  scanner := bufio.NewScanner(r)
+  scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+  field := ""
+  for scanner.Scan() {
+    line := scanner.Text()
+    if strings.TrimSpace(line) == "" {
+      flush()
+      continue
+    }
+    if line[0] == ' ' || line[0] == '\t' {
+      // " md5 size name" lines of the Files field of a source package
+      if sources && field == "Files" {
+        f := strings.Fields(line)
+        if len(f) == 3 { srcfiles = append(srcfiles, [2]string{f[1], f[2]}) }
+      }
+      continue
+    }
+    kv := strings.SplitN(line, ":", 2)
+    if len(kv) != 2 { continue }
+    field = kv[0]
+    value := strings.TrimSpace(kv[1])
+    switch field {
+      case "Filename":  if !sources { filename = value }
+      case "Size":      if n, err := strconv.ParseInt(value, 10, 64); err == nil && !sources { size = n }
+      case "Directory": directory = value
+    }
+  }
+  flush()
+  return scanner.Err()
+}
@@ -0,0 +1,93 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package debian
+
+import (
+         "strconv"
+         "strings"
+       )
+
+/*
+  Compares the Debian versions a and b like dpkg --compare-versions
+  (e.g. 1.0~rc1 < 1.0 < 1.0-1 < 1.0a < 1:0.9) and returns -1, 0 or 1.
+*/
+func CompareVersions(a, b string) int {
+  ea, ua, ra := splitVersion(a)
+  eb, ub, rb := splitVersion(b)
+  if ea != eb {
+    if ea < eb { return -1 }
+    return 1
+  }
+  if c := compareFragment(ua, ub); c != 0 { return c }
+  return compareFragment(ra, rb)
+}
+
+// Splits the version v into epoch, upstream version and Debian revision.
+func splitVersion(v string) (int, string, string) {
+  epoch := 0
+  if i := strings.Index(v, ":"); i >= 0 {
+    epoch, _ = strconv.Atoi(v[0:i])
+    v = v[i+1:]
+  }
+  revision := ""
+  if i := strings.LastIndex(v, "-"); i >= 0 {
+    revision = v[i+1:]
+    v = v[0:i]
+  }
+  return epoch, v, revision
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// Returns the weight of the character at s[i] in the non-digit parts of a
+// version: "~" sorts before everything, even the end of the part, and
+// letters sort before other characters.
+func order(s string, i int) int {
+  if i >= len(s) { return 0 }
+  c := s[i]
+  switch {
+    case isDigit(c): return 0
+    case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z': return int(c)
+    case c == '~': return -1
+  }
+  return int(c) + 256
+}
+
+// Compares upstream versions or revisions like dpkg's verrevcmp().
+func compareFragment(a, b string) int {
+  i, j := 0, 0
+  for i < len(a) || j < len(b) {
+    for (i < len(a) && !isDigit(a[i])) || (j < len(b) && !isDigit(b[j])) {
+      ac, bc := order(a, i), order(b, j)
+      if ac < bc { return -1 }
+      if ac > bc { return 1 }
+      i++
+      j++
+    }
+    for i < len(a) && a[i] == '0' { i++ }
+    for j < len(b) && b[j] == '0' { j++ }
+    diff := 0
+    for i < len(a) && isDigit(a[i]) && j < len(b) && isDigit(b[j]) {
+      if diff == 0 { diff = int(a[i]) - int(b[j]) }
+      i++
+      j++
+    }
+    if i < len(a) && isDigit(a[i]) { return 1 }
+    if j < len(b) && isDigit(b[j]) { return -1 }
+    if diff < 0 { return -1 }
+    if diff > 0 { return 1 }
+  }
+  return 0
+}
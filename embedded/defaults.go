@@ -9,6 +9,8 @@ var DefaultIndex = []byte(`<!DOCTYPE html>
 <?garçon description?>
 </head>
 <body>
+<?garçon heading?>
+<?garçon index?>
 </body>
 </html>
 `)
@@ -0,0 +1,26 @@
+package embedded
+
+// Landing page shown instead of files matching --download-page.
+// <?garçon title?> is replaced by the file's name and <?garçon content?>
+// by the table with the file's details and download links.
+var DownloadPage = []byte(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="UTF-8" />
+<meta name="viewport" content="width=device-width, initial-scale=1" />
+<?garçon title?>
+<style>
+body { max-width: 50em; margin: 2em auto; padding: 0 1em; font-family: sans-serif; }
+table.download th { text-align: left; padding-right: 1em; vertical-align: top; }
+code { word-break: break-all; }
+.passed { color: #070; }
+.failed { color: #a00; }
+td pre { white-space: pre-wrap; margin: 0.3em 0; }
+a.download { display: inline-block; margin: 1em 0; padding: 0.5em 1.5em; background: #2a6ebb; color: #fff; text-decoration: none; border-radius: 0.3em; }
+</style>
+</head>
+<body>
+<?garçon content?>
+</body>
+</html>
+`)
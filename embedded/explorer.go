@@ -0,0 +1,119 @@
+package embedded
+
+// Page of the admin API that lists the operations of the OpenAPI document
+// and lets the user try them out. <?garçon openapi?> is replaced by the URL
+// of the document and <?garçon session?> by the URL of the session info,
+// from which the page takes the CSRF token for write requests.
+var APIExplorer = []byte(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="UTF-8" />
+<meta name="viewport" content="width=device-width, initial-scale=1" />
+<title>Garçon API</title>
+<style>
+body { max-width: 60em; margin: 2em auto; padding: 0 1em; font-family: sans-serif; }
+details { border: 1px solid #ccc; border-radius: 0.3em; margin: 0.5em 0; padding: 0.3em 0.6em; }
+summary { cursor: pointer; }
+.method { display: inline-block; min-width: 4em; font-weight: bold; font-family: monospace; }
+.get { color: #2a6ebb; }
+.put { color: #b86e00; }
+.post { color: #070; }
+label { display: block; margin: 0.4em 0; }
+label span { display: inline-block; min-width: 10em; font-family: monospace; }
+label small { color: #666; }
+input[type=text] { width: 25em; }
+pre { white-space: pre-wrap; word-break: break-all; background: #f4f4f4; padding: 0.5em; }
+</style>
+</head>
+<body>
+<h1>Garçon API</h1>
+<p>The operations of the <a href="<?garçon openapi?>">OpenAPI document</a>.
+Requests are sent with your login session or, if given, with this token:
+<input type="password" id="token" placeholder="API token" /></p>
+<div id="ops"></div>
+<script>
+var csrf = null;
+fetch('<?garçon session?>', {credentials: 'same-origin'}).then(function(r) {
+  return r.ok ? r.json() : {};
+}).then(function(s) { csrf = s.csrf_token || null; });
+
+function el(tag, text, cls) {
+  var e = document.createElement(tag);
+  if (text) e.textContent = text;
+  if (cls) e.className = cls;
+  return e;
+}
+
+function send(method, tmpl, op, form, out) {
+  var url = tmpl, query = [], headers = {}, body = null;
+  (op.parameters || []).forEach(function(p) {
+    var v = form.elements[p.in + ':' + p.name].value;
+    if (p.in == 'path') {
+      url = url.replace('{' + p.name + '}', v.replace(/^\/+/, '').split('/').map(encodeURIComponent).join('/'));
+    } else if (p.in == 'query' && v != '') {
+      query.push(encodeURIComponent(p.name) + '=' + encodeURIComponent(v));
+    } else if (p.in == 'header' && v != '') {
+      headers[p.name] = v;
+    }
+  });
+  if (query.length) url += '?' + query.join('&');
+  if (op.requestBody && form.elements.body.files.length) body = form.elements.body.files[0];
+  var token = document.getElementById('token').value;
+  if (token) headers['Authorization'] = 'Bearer ' + token;
+  else if (csrf && method != 'get') headers['X-CSRF-Token'] = csrf;
+  out.textContent = method.toUpperCase() + ' ' + url + ' ...';
+  fetch(url, {method: method.toUpperCase(), headers: headers, body: body, credentials: 'same-origin'}).then(function(r) {
+    return r.text().then(function(t) {
+      if ((r.headers.get('Content-Type') || '').indexOf('text/html') == 0) t = '(' + t.length + ' bytes of HTML)';
+      out.textContent = method.toUpperCase() + ' ' + url + '\n' + r.status + ' ' + r.statusText + '\n\n' + t;
+    });
+  }).catch(function(e) { out.textContent = String(e); });
+}
+
+fetch('<?garçon openapi?>').then(function(r) { return r.json(); }).then(function(doc) {
+  var ops = document.getElementById('ops');
+  Object.keys(doc.paths).sort().forEach(function(tmpl) {
+    Object.keys(doc.paths[tmpl]).forEach(function(method) {
+      var op = doc.paths[tmpl][method];
+      var d = el('details'), s = el('summary');
+      s.appendChild(el('span', method.toUpperCase(), 'method ' + method));
+      s.appendChild(el('code', tmpl));
+      s.appendChild(document.createTextNode(' ' + (op.summary || '')));
+      d.appendChild(s);
+      if (op.description) d.appendChild(el('p', op.description));
+      var form = el('form');
+      (op.parameters || []).forEach(function(p) {
+        var l = el('label');
+        l.appendChild(el('span', p.name + (p.required ? '*' : '')));
+        var i = el('input');
+        i.type = 'text';
+        i.name = p.in + ':' + p.name;
+        l.appendChild(i);
+        if (p.description) l.appendChild(el('small', ' ' + p.description));
+        form.appendChild(l);
+      });
+      if (op.requestBody) {
+        var l = el('label');
+        l.appendChild(el('span', 'body'));
+        var i = el('input');
+        i.type = 'file';
+        i.name = 'body';
+        l.appendChild(i);
+        form.appendChild(l);
+      }
+      var b = el('button', 'Send'), out = el('pre');
+      form.appendChild(b);
+      form.onsubmit = function(e) {
+        e.preventDefault();
+        send(method, tmpl, op, form, out);
+      };
+      d.appendChild(form);
+      d.appendChild(out);
+      ops.appendChild(d);
+    });
+  });
+});
+</script>
+</body>
+</html>
+`)
@@ -0,0 +1,17 @@
+package embedded
+
+// SVG sprite with the icons used in generated index pages. Each icon is
+// a <symbol> referenced as <use href="#icon-NAME"/>.
+var IndexIcons = []byte(`<svg xmlns="http://www.w3.org/2000/svg" style="display:none">
+<symbol id="icon-parent" viewBox="0 0 16 16"><path d="M8 2 2 8h4v6h4V8h4z" fill="#666"/></symbol>
+<symbol id="icon-dir" viewBox="0 0 16 16"><path d="M1 3h5l2 2h7v9H1z" fill="#e8b64c" stroke="#a07a1c"/></symbol>
+<symbol id="icon-file" viewBox="0 0 16 16"><path d="M3 1h7l3 3v11H3z" fill="#fff" stroke="#777"/><path d="M10 1v3h3" fill="none" stroke="#777"/></symbol>
+<symbol id="icon-text" viewBox="0 0 16 16"><path d="M3 1h7l3 3v11H3z" fill="#fff" stroke="#777"/><path d="M5 6h6M5 8h6M5 10h6M5 12h4" stroke="#555"/></symbol>
+<symbol id="icon-image" viewBox="0 0 16 16"><path d="M1 3h14v10H1z" fill="#fff" stroke="#777"/><path d="M2 12l4-5 3 3 2-2 3 4z" fill="#4c9a4c"/><circle cx="11" cy="6" r="1.5" fill="#e8b64c"/></symbol>
+<symbol id="icon-audio" viewBox="0 0 16 16"><path d="M6 3v8.5a2 2 0 1 1-1-1.7V3l8-2v8.5a2 2 0 1 1-1-1.7V2.3z" fill="#5470b0"/></symbol>
+<symbol id="icon-video" viewBox="0 0 16 16"><path d="M1 3h14v10H1z" fill="#333"/><path d="M6 5v6l5-3z" fill="#fff"/></symbol>
+<symbol id="icon-archive" viewBox="0 0 16 16"><path d="M2 2h12v12H2z" fill="#c8a070" stroke="#80603a"/><path d="M7 2h2v2H7zm0 3h2v2H7zm0 3h2v2H7z" fill="#80603a"/></symbol>
+<symbol id="icon-package" viewBox="0 0 16 16"><path d="M8 1l6 3v8l-6 3-6-3V4z" fill="#d7a04c" stroke="#80603a"/><path d="M2 4l6 3 6-3M8 7v8" fill="none" stroke="#80603a"/></symbol>
+<symbol id="icon-pdf" viewBox="0 0 16 16"><path d="M3 1h7l3 3v11H3z" fill="#fff" stroke="#b03030"/><path d="M4 9h8v4H4z" fill="#b03030"/></symbol>
+</svg>
+`)
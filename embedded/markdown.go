@@ -0,0 +1,29 @@
+package embedded
+
+// Page into which rendered Markdown documents are inserted.
+// <?garçon title?> is replaced by the document's title, <?garçon raw?> by the
+// URL of the unrendered document and <?garçon content?> by the rendered HTML.
+var MarkdownPage = []byte(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="UTF-8" />
+<meta name="viewport" content="width=device-width, initial-scale=1" />
+<?garçon title?>
+<style>
+body { max-width: 50em; margin: 2em auto; padding: 0 1em; font-family: sans-serif; line-height: 1.5; color: #222; }
+pre { background: #f4f4f4; padding: 0.8em; overflow: auto; }
+code { background: #f4f4f4; padding: 0 0.2em; }
+pre code { padding: 0; }
+blockquote { margin-left: 0; padding-left: 1em; border-left: 0.25em solid #ccc; color: #555; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; }
+img { max-width: 100%; }
+.raw { float: right; font-size: small; }
+</style>
+</head>
+<body>
+<a class="raw" href="<?garçon raw?>">raw</a>
+<?garçon content?>
+</body>
+</html>
+`)
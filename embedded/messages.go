@@ -0,0 +1,34 @@
+package embedded
+
+// Translations of the English strings that appear in generated index pages.
+// The outer key is the language tag, the inner key the English original.
+var Messages = map[string]map[string]string{
+  "de": {
+    "Name": "Name",
+    "Size": "Größe",
+    "Last modified": "Zuletzt geändert",
+    "Description": "Beschreibung",
+    "Parent directory": "Übergeordnetes Verzeichnis",
+  },
+  "fr": {
+    "Name": "Nom",
+    "Size": "Taille",
+    "Last modified": "Dernière modification",
+    "Description": "Description",
+    "Parent directory": "Répertoire parent",
+  },
+  "es": {
+    "Name": "Nombre",
+    "Size": "Tamaño",
+    "Last modified": "Última modificación",
+    "Description": "Descripción",
+    "Parent directory": "Directorio superior",
+  },
+  "it": {
+    "Name": "Nome",
+    "Size": "Dimensione",
+    "Last modified": "Ultima modifica",
+    "Description": "Descrizione",
+    "Parent directory": "Cartella superiore",
+  },
+}
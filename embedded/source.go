@@ -0,0 +1,35 @@
+package embedded
+
+// Page into which highlighted source files are inserted.
+// <?garçon title?> is replaced by the file's name, <?garçon raw?> by the
+// URL of the unrendered file and <?garçon content?> by the highlighted source.
+var SourcePage = []byte(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="UTF-8" />
+<?garçon title?>
+<style>
+body { margin: 0; font-family: sans-serif; }
+.raw { position: fixed; top: 0.3em; right: 1em; font-size: small; }
+table.source { border-collapse: collapse; font-family: monospace; font-size: 0.9em; }
+table.source td { padding: 0 0.8em; vertical-align: top; white-space: pre-wrap; }
+td.ln { text-align: right; color: #999; background: #f4f4f4; user-select: none; }
+td.ln a { color: inherit; text-decoration: none; }
+tr:target { background: #ffc; }
+.comment { color: #777; font-style: italic; }
+.string { color: #a31515; }
+.number { color: #098658; }
+.keyword { color: #00f; font-weight: bold; }
+.tag { color: #800000; }
+.ins { color: #080; background: #efe; }
+.del { color: #a00; background: #fee; }
+.hunk { color: #909; }
+.meta { font-weight: bold; }
+</style>
+</head>
+<body>
+<a class="raw" href="<?garçon raw?>">raw</a>
+<?garçon content?>
+</body>
+</html>
+`)
@@ -0,0 +1,24 @@
+package embedded
+
+// Form for entering the password of a directory protected with the
+// password directive. <?garçon title?> is replaced by the directory's
+// path and <?garçon content?> by the form.
+var UnlockPage = []byte(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="UTF-8" />
+<meta name="viewport" content="width=device-width, initial-scale=1" />
+<meta name="robots" content="noindex, nofollow" />
+<?garçon title?>
+<style>
+body { max-width: 30em; margin: 4em auto; padding: 0 1em; font-family: sans-serif; }
+input[type=password] { width: 100%; box-sizing: border-box; padding: 0.4em; margin: 0.5em 0 1em 0; }
+button { padding: 0.5em 1.5em; background: #2a6ebb; color: #fff; border: none; border-radius: 0.3em; }
+.error { color: #a00; }
+</style>
+</head>
+<body>
+<?garçon content?>
+</body>
+</html>
+`)
@@ -0,0 +1,114 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+/*
+  Rules for rejecting abusive requests (vulnerability scanners, exploit
+  probes,...) before they reach any handler and for limiting the responses
+  to requests.
+*/
+package filter
+
+import (
+         "regexp"
+         "strings"
+         "net/http"
+         
+         "../status"
+         "../privacy"
+         "../problem"
+       )
+
+// The request filtering rules. The zero value does not reject anything.
+type Rules struct {
+  // Requests whose User-Agent header matches any of these are rejected with 403.
+  UserAgents []*regexp.Regexp
+  
+  // Requests whose (unescaped) path matches any of these are rejected with 403.
+  Paths []*regexp.Regexp
+  
+  // If > 0, requests whose URL is longer are rejected with 414.
+  MaxURLLength int
+  
+  // If true, requests whose URL contains percent-encoded traversal sequences
+  // (e.g. %2e%2e, %2f, %5c, %00, double encoding) or literal ".." segments
+  // are rejected with 400.
+  BlockEncodedTraversal bool
+  
+  // Limits for the responses to matching requests. The first match applies.
+  Limits []ResponseLimit
+}
+
+var (
+  userAgentBlocked = status.NewCounter(`garcon_filtered_requests_total{rule="user-agent"}`, "Requests rejected by request filter rules.")
+  pathBlocked      = status.NewCounter(`garcon_filtered_requests_total{rule="path"}`, "Requests rejected by request filter rules.")
+  urlTooLong       = status.NewCounter(`garcon_filtered_requests_total{rule="url-length"}`, "Requests rejected by request filter rules.")
+  traversal        = status.NewCounter(`garcon_filtered_requests_total{rule="traversal"}`, "Requests rejected by request filter rules.")
+)
+
+// Sequences in the lower-cased raw request URI that indicate traversal attempts.
+var traversalSequences = []string{"%2e%2e", ".%2e", "%2e.", "%2f", "%5c", "%00", "%25", "%c0%ae", "%c1%9c"}
+
+// Returns true if rules rejects anything at all.
+func (rules *Rules) Active() bool {
+  return len(rules.UserAgents) > 0 || len(rules.Paths) > 0 || rules.MaxURLLength > 0 || rules.BlockEncodedTraversal || len(rules.Limits) > 0
+}
+
+/*
+  Checks r against rules. If r is to be rejected, returns the HTTP status
+  code to use and the counter to increment. Otherwise returns 0, nil.
+*/
+func (rules *Rules) check(r *http.Request) (int, *status.Counter) {
+  if rules.MaxURLLength > 0 && len(r.RequestURI) > rules.MaxURLLength {
+    return http.StatusRequestURITooLong, urlTooLong
+  }
+  
+  if rules.BlockEncodedTraversal {
+    uri := strings.ToLower(strings.SplitN(r.RequestURI, "?", 2)[0])
+    for _, seq := range traversalSequences {
+      if strings.Contains(uri, seq) { return http.StatusBadRequest, traversal }
+    }
+    for _, segment := range strings.Split(uri, "/") {
+      if segment == ".." { return http.StatusBadRequest, traversal }
+    }
+  }
+  
+  ua := r.Header.Get("User-Agent")
+  for _, re := range rules.UserAgents {
+    if re.MatchString(ua) { return http.StatusForbidden, userAgentBlocked }
+  }
+  
+  for _, re := range rules.Paths {
+    if re.MatchString(r.URL.Path) { return http.StatusForbidden, pathBlocked }
+  }
+  
+  return 0, nil
+}
+
+// Returns a handler that rejects requests according to rules and passes
+// all other requests on to h, with their responses limited by rules.Limits.
+func (rules *Rules) Wrap(h http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if code, counter := rules.check(r); code != 0 {
+      counter.Inc()
+      problem.Log(r, code, problem.Filtered, "User-Agent: %q", privacy.UserAgent(r.Header.Get("User-Agent")))
+      problem.Write(w, r, code, problem.Filtered, "")
+      return
+    }
+    if limit := rules.limitFor(r); limit != nil {
+      serveLimited(h, w, r, limit)
+      return
+    }
+    h.ServeHTTP(w, r)
+  })
+}
@@ -0,0 +1,151 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package filter
+
+import (
+         "fmt"
+         "time"
+         "regexp"
+         "strconv"
+         "context"
+         "net/http"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../status"
+         "../problem"
+       )
+
+/*
+  Limits for the responses to requests whose (unescaped) path matches Path,
+  e.g. generated index pages and archives, so that a pathological response
+  can not tie up the server.
+*/
+type ResponseLimit struct {
+  Path *regexp.Regexp
+  
+  // If > 0, a response that is not complete after Deadline is aborted.
+  // Handlers that honor the request's context stop at the deadline.
+  Deadline time.Duration
+  
+  // If > 0, a response whose body would be larger is aborted.
+  MaxBytes int64
+}
+
+var (
+  deadlineExceeded = status.NewCounter(`garcon_response_limit_exceeded_total{limit="deadline"}`, "Responses aborted because they exceeded a response limit.")
+  maxBytesExceeded = status.NewCounter(`garcon_response_limit_exceeded_total{limit="bytes"}`, "Responses aborted because they exceeded a response limit.")
+)
+
+// Returns the first of rules.Limits whose Path matches r, or nil.
+func (rules *Rules) limitFor(r *http.Request) *ResponseLimit {
+  for i := range rules.Limits {
+    if rules.Limits[i].Path.MatchString(r.URL.Path) { return &rules.Limits[i] }
+  }
+  return nil
+}
+
+/*
+  Passes the response on to the ResponseWriter until it exceeds its limits.
+  It does not implement io.ReaderFrom, so that every byte goes through
+  Write(), i.e. limited responses are not sent with sendfile().
+*/
+type limitedWriter struct {
+  http.ResponseWriter
+  r *http.Request
+  limit *ResponseLimit
+  deadline time.Time
+  bytes int64
+  wroteHeader bool
+  // Not nil when the response has exceeded its limits.
+  err error
+}
+
+/*
+  Called when the response exceeds its limits. Logs the event and sends an
+  error if nothing has been sent yet. Otherwise the response can not be
+  ended cleanly without the client taking it for complete, so the
+  connection is aborted.
+*/
+func (l *limitedWriter) exceeded(counter *status.Counter, code int, why string) error {
+  counter.Inc()
+  util.Log(0, "WARNING! %v %v: Aborted after %v bytes: %v", l.r.Method, l.r.URL.Path, l.bytes, why)
+  l.err = fmt.Errorf("Response limit exceeded: %v", why)
+  if l.wroteHeader { panic(http.ErrAbortHandler) }
+  l.wroteHeader = true
+  l.Header().Del("Content-Length")
+  l.Header().Del("Content-Encoding")
+  problem.Write(l.ResponseWriter, l.r, code, problem.ResponseLimit, "The response exceeded the server's limits")
+  return l.err
+}
+
+// Returns an error if the response has passed its deadline.
+func (l *limitedWriter) checkDeadline() error {
+  if l.limit.Deadline > 0 && time.Now().After(l.deadline) {
+    return l.exceeded(deadlineExceeded, http.StatusServiceUnavailable, fmt.Sprintf("Deadline of %v exceeded", l.limit.Deadline))
+  }
+  return nil
+}
+
+func (l *limitedWriter) WriteHeader(code int) {
+  if l.err != nil || l.wroteHeader { return }
+  if l.checkDeadline() != nil { return }
+  if l.limit.MaxBytes > 0 {
+    // Reject a response that announces that it is too large before anything is sent.
+    if n, err := strconv.ParseInt(l.Header().Get("Content-Length"), 10, 64); err == nil && n > l.limit.MaxBytes {
+      l.exceeded(maxBytesExceeded, http.StatusInternalServerError, fmt.Sprintf("Content-Length %v exceeds %v bytes", n, l.limit.MaxBytes))
+      return
+    }
+  }
+  l.wroteHeader = true
+  l.ResponseWriter.WriteHeader(code)
+}
+
+func (l *limitedWriter) Write(data []byte) (int, error) {
+  if l.err != nil { return 0, l.err }
+  if !l.wroteHeader { l.WriteHeader(http.StatusOK) }
+  if l.err != nil { return 0, l.err }
+  if err := l.checkDeadline(); err != nil { return 0, err }
+  if l.limit.MaxBytes > 0 && l.bytes + int64(len(data)) > l.limit.MaxBytes {
+    return 0, l.exceeded(maxBytesExceeded, http.StatusInternalServerError, fmt.Sprintf("More than %v bytes", l.limit.MaxBytes))
+  }
+  n, err := l.ResponseWriter.Write(data)
+  l.bytes += int64(n)
+  return n, err
+}
+
+func (l *limitedWriter) Flush() {
+  if !l.wroteHeader { l.WriteHeader(http.StatusOK) }
+  if f, ok := l.ResponseWriter.(http.Flusher); ok && l.err == nil { f.Flush() }
+}
+
+// Lets http.ResponseController reach the underlying ResponseWriter, e.g. for write deadlines.
+func (l *limitedWriter) Unwrap() http.ResponseWriter {
+  return l.ResponseWriter
+}
+
+// Passes r on to h with the ResponseWriter w limited according to limit.
+func serveLimited(h http.Handler, w http.ResponseWriter, r *http.Request, limit *ResponseLimit) {
+  l := &limitedWriter{ResponseWriter:w, r:r, limit:limit}
+  if limit.Deadline > 0 {
+    l.deadline = time.Now().Add(limit.Deadline)
+    ctx, cancel := context.WithDeadline(r.Context(), l.deadline)
+    defer cancel()
+    r = r.WithContext(ctx)
+  }
+  h.ServeHTTP(l, r)
+  // A handler that has given up because of the context has not written anything.
+  if l.err == nil && !l.wroteHeader { l.checkDeadline() }
+}
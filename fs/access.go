@@ -0,0 +1,70 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "net/http"
+       )
+
+/*
+  If not nil, decides whether the request r may read the URL path clean
+  (e.g. auth.Policy.MayRead). It is consulted for every path that is
+  served, listed or read on behalf of a request, not only for the path
+  of the request, which the access policy checks before ServeHTTP() is
+  called. r is nil when the answer must hold for anyone, e.g. for the
+  entries of the generated index pages, which are the same for all users.
+  Must be set before NewFileManager() is called.
+*/
+var Authorize func(r *http.Request, clean string) bool
+
+/*
+  If not nil, decides whether the request r may modify the URL path clean
+  (e.g. auth.Policy.MayWrite). It is consulted for paths that a request
+  modifies other than its own, e.g. the file that the admin API removes.
+  Must be set before NewFileManager() is called.
+*/
+var AuthorizeWrite func(r *http.Request, clean string) bool
+
+/*
+  Returns true if the request r may read the URL path clean, i.e. Authorize
+  allows it and r has unlocked all password protected directories it is in.
+  If r is nil, true is returned only for paths anyone may read.
+*/
+func (fm *FileManager) mayRead(r *http.Request, clean string) bool {
+  if Authorize != nil && !Authorize(r, clean) { return false }
+  if len(fm.current().indexes.passwords) == 0 { return true }
+  dir, _ := fm.lockedDir(r, clean)
+  return dir == ""
+}
+
+/*
+  Returns true if the request r may read and modify the URL path clean,
+  i.e. mayRead() and AuthorizeWrite allow it.
+*/
+func (fm *FileManager) mayWrite(r *http.Request, clean string) bool {
+  return fm.mayRead(r, clean) && (AuthorizeWrite == nil || AuthorizeWrite(r, clean))
+}
+
+/*
+  Returns true if the entry with URL path clean may be listed in the
+  generated index of the directory dir. As the index is the same for
+  everyone, indexes that anyone may read do not list entries that require
+  a login. Everyone who may read a protected directory may read all
+  entries below it, so its index lists them all. Directories protected
+  with a password directive are listed, so that they can be unlocked.
+*/
+func listable(dir, clean string) bool {
+  return Authorize == nil || !Authorize(nil, dir) || Authorize(nil, clean)
+}
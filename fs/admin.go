@@ -0,0 +1,588 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "os"
+         "fmt"
+         "bytes"
+         "path"
+         "sort"
+         "time"
+         "strings"
+         "net/http"
+         "io/ioutil"
+         "sync/atomic"
+         "encoding/json"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../auth"
+         "../embedded"
+         "../notify"
+         "../problem"
+         "../accesslog"
+       )
+
+// The URL path below which the admin API is served (see ServeAdmin()).
+const AdminPath = "/.garcon/admin/"
+
+// How long "rescan?wait=1" waits for the scan.
+var AdminWaitTimeout = 60*time.Second
+
+/*
+  Makes the OpenAPI document (see ServeOpenAPI()) describe the admin API.
+  The caller serves it by passing the requests below AdminPath to
+  ServeAdmin(). Call before ServeHTTP() is called for the first time.
+*/
+func (fm *FileManager) EnableAdminAPI() {
+  fm.admin_api = true
+  if TrashRetention > 0 { go fm.expireTrashPeriodically() }
+}
+
+/*
+  Serves the admin API below AdminPath, so that automation can operate the
+  repository without shell access to the server. Only requests of logged in
+  users (e.g. with an API token) are accepted, so the access policy must
+  cover AdminPath (see auth.Policy). AdminPath itself serves a page to try
+  out the APIs described by the OpenAPI document (see ServeOpenAPI()).
+  Answers are JSON objects, errors application/problem+json objects
+  (see problem.Problem) whose detail describes the error. Paths
+  the user may not read (see Authorize) are left out of them.
+  The endpoints (see adminOps) are
+    GET  stats[?path=/prefix]
+         Number of files and directories, total size and newest mtime of
+         the tree (or the part below /prefix), the suites in it, the current
+         Generation() and the memory statistics.
+    POST rescan[?wait=1]
+         Makes the tree be scanned again. With wait=1, the answer is sent
+         when the new tree is served.
+    POST regenerate
+         Makes the next scan regenerate (and sign anew) the metadata of all
+         RPM, Arch, PyPI and Maven repositories, even if nothing has changed.
+    POST snapshot?suite=/debian/dists/stable[&name=stable-2016-06-01]
+         Copies the metadata of the Debian suite, as served, to a new suite
+         next to it, e.g. to keep the state of a release. The default name
+         is the suite's name with the current time (UTC) appended.
+    POST promote?from=/debian/dists/testing&to=/debian/dists/stable
+         Replaces the metadata of the suite "to" with a copy of "from", as
+         served. The Release files are replaced last, so that clients see
+         the promotion all at once. As the Release files are copied
+         unchanged, their Suite and Codename fields are the ones of "from".
+    POST purge?path=/prefix
+         Removes the files below /prefix from the cache and, below a
+         --proxy or --apt-proxy prefix, the cached copies of upstream's files.
+    POST remove?path=/incoming/foo.deb
+         Moves the file to the trash (see TrashDir) and stops serving it
+         right away. Files are deleted for good after TrashRetention.
+         Requires read and write permission for the file.
+    GET  trash
+         Lists the files in the trash with their ids, newest first.
+    POST restore?id=1835155476501
+         Moves the file from the trash back to where it was removed from.
+         Fails with 409 if a file of that name exists there now.
+         Requires read and write permission for that path.
+    GET  verify[?suite=/debian/dists/stable]
+         Checks the metadata of the suite (or of all suites), as served,
+         against the sizes and SHA-256 checksums in its Release file. The
+         answer has the list "suites" with the result for each suite and
+         "ok", which is false if any suite has problems.
+    GET  diff[?state=.garcon-state.yesterday]
+         Compares the tree with StateFile (see SaveState()) or a copy of it
+         next to it (e.g. made by a cron job every night) and lists the
+         files added, removed and changed since it was saved.
+    POST publish?name=2016-06-01
+         Serves the directory name in PublishDir instead of the current
+         tree (see PublishTree()). The answer is sent when the new tree
+         is served.
+*/
+func (fm *FileManager) ServeAdmin(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Cache-Control", "no-store")
+  user := auth.UserFrom(r)
+  if user == nil {
+    adminError(w, r, http.StatusUnauthorized, fmt.Errorf("Login required"))
+    return
+  }
+  
+  op := strings.TrimPrefix(r.URL.Path, AdminPath)
+  if op == "" {
+    fm.serveExplorer(w, r)
+    return
+  }
+  
+  want := "POST"
+  if o := adminOpNamed(op); o != nil { want = o.method }
+  if r.Method != want && !(want == "GET" && r.Method == "HEAD") {
+    w.Header().Set("Allow", want)
+    adminError(w, r, http.StatusMethodNotAllowed, fmt.Errorf("%v requires %v", op, want))
+    return
+  }
+  
+  q := r.URL.Query()
+  var result interface{}
+  var err error
+  status := http.StatusOK
+  switch op {
+    case "stats":
+      result, err = fm.treeStats(r, q.Get("path"))
+    case "rescan":
+      gen := fm.Generation()
+      fm.requestScan()
+      if q.Get("wait") != "" {
+        deadline := time.Now().Add(AdminWaitTimeout)
+        for fm.Generation() == gen && time.Now().Before(deadline) { time.Sleep(100*time.Millisecond) }
+      }
+      if fm.Generation() == gen { status = http.StatusAccepted }
+      result = map[string]uint64{"generation":fm.Generation()}
+    case "regenerate":
+      fm.Regenerate()
+      status = http.StatusAccepted
+      result = map[string]interface{}{}
+    case "snapshot":
+      result, err = fm.snapshotSuite(q.Get("suite"), q.Get("name"))
+      status = http.StatusCreated
+    case "promote":
+      result, err = fm.copySuite(path.Clean("/" + q.Get("from")), path.Clean("/" + q.Get("to")), true)
+    case "purge":
+      if q.Get("path") == "" {
+        err = fmt.Errorf("path missing")
+        break
+      }
+      result = fm.purge(path.Clean("/" + q.Get("path")))
+    case "remove":
+      if q.Get("path") == "" {
+        err = fmt.Errorf("path missing")
+        break
+      }
+      result, err = fm.remove(r, path.Clean("/" + q.Get("path")))
+    case "trash":
+      result, err = fm.listTrash(r)
+    case "restore":
+      result, err = fm.restore(r, q.Get("id"))
+    case "verify":
+      result, err = fm.verifySuites(r, q.Get("suite"))
+    case "diff":
+      result, err = fm.diffStateNamed(r, q.Get("state"))
+    case "publish":
+      result, err = fm.publish(q.Get("name"))
+    default:
+      adminError(w, r, http.StatusNotFound, fmt.Errorf("Unknown operation: %v", op))
+      return
+  }
+  
+  if err != nil {
+    if e, ok := err.(*adminErr); ok {
+      adminError(w, r, e.status, e)
+    } else {
+      adminError(w, r, http.StatusBadRequest, err)
+    }
+    return
+  }
+  if want == "POST" { util.Log(0, "Admin %v: %v %v", user.Name, r.Method, r.URL.RequestURI()) }
+  data, _ := json.Marshal(result)
+  accesslog.Log(r, 1, "%v %v %v", status, r.Method, r.URL.Path)
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(status)
+  if r.Method != "HEAD" { w.Write(append(data, '\n')) }
+}
+
+// Serves the API explorer page.
+func (fm *FileManager) serveExplorer(w http.ResponseWriter, r *http.Request) {
+  if r.Method != "GET" && r.Method != "HEAD" {
+    w.Header().Set("Allow", "GET, HEAD")
+    adminError(w, r, http.StatusMethodNotAllowed, fmt.Errorf("The explorer requires GET"))
+    return
+  }
+  page := bytes.Replace(embedded.APIExplorer, []byte("<?garçon openapi?>"), []byte(OpenAPIPath), -1)
+  page = bytes.Replace(page, []byte("<?garçon session?>"), []byte(auth.AuthPath + "session"), -1)
+  w.Header().Set("Content-Type", "text/html; charset=utf-8")
+  accesslog.Log(r, 1, "%v %v %v", http.StatusOK, r.Method, r.URL.Path)
+  if r.Method != "HEAD" { w.Write(page) }
+}
+
+// An error of the admin API with an HTTP status other than 400.
+type adminErr struct {
+  status int
+  msg string
+}
+
+func (e *adminErr) Error() string { return e.msg }
+
+// Sends err as application/problem+json object with the generic code for status.
+func adminError(w http.ResponseWriter, r *http.Request, status int, err error) {
+  code := problem.CodeFor(status)
+  problem.Log(r, status, code, "%v", err)
+  problem.WriteJSON(w, r, status, code, err.Error())
+}
+
+// The answer to "stats".
+type treeStats struct {
+  Path string `json:"path"`
+  Generation uint64 `json:"generation"`
+  Files int `json:"files"`
+  Directories int `json:"directories"`
+  Bytes int64 `json:"bytes"`
+  Newest time.Time `json:"newest"`
+  Suites []string `json:"suites"`
+  Memory MemoryStats `json:"memory"`
+}
+
+/*
+  Returns the statistics of the tree below the URL path clean ("" for all).
+  Directories that r may not read are left out.
+*/
+func (fm *FileManager) treeStats(r *http.Request, clean string) (*treeStats, error) {
+  clean = path.Clean("/" + clean)
+  stats := &treeStats{Path:clean, Suites:[]string{}, Memory:fm.MemoryStats()}
+  state := fm.current()
+  stats.Generation = state.generation
+  dir := state.root
+  if clean != "/" { dir = fileAt(state.root.Contents, clean[1:]) }
+  if dir == nil || !dir.Info.IsDir() || !fm.mayRead(r, clean) { return nil, &adminErr{http.StatusNotFound, clean + ": No such directory"} }
+  var walk func(dirpath string, d map[string]*File)
+  walk = func(dirpath string, d map[string]*File) {
+    if isSuite(d) { stats.Suites = append(stats.Suites, dirpath) }
+    for name, x := range d {
+      if x.Info.IsDir() && !fm.mayRead(r, path.Join(dirpath, name)) { continue }
+      if x.Info.ModTime().After(stats.Newest) { stats.Newest = x.Info.ModTime() }
+      if x.Info.IsDir() {
+        stats.Directories++
+        walk(path.Join(dirpath, name), x.Contents)
+      } else if x.Encoding == "" {
+        stats.Files++
+        stats.Bytes += x.Info.Size()
+      }
+    }
+  }
+  walk(clean, dir.Contents)
+  sort.Strings(stats.Suites)
+  return stats, nil
+}
+
+// The answer to "snapshot" and "promote".
+type suiteCopy struct {
+  From string `json:"from"`
+  To string `json:"to"`
+  Copied int `json:"copied"`
+  Removed int `json:"removed"`
+}
+
+/*
+  Copies the files of the suite from (its metadata as currently served) to
+  the suite directory to. If replace is false, to must not exist. Otherwise
+  files of to that from does not have are removed afterwards.
+*/
+func (fm *FileManager) copySuite(from, to string, replace bool) (*suiteCopy, error) {
+  if from == to { return nil, fmt.Errorf("Source and target are the same") }
+  for _, part := range strings.Split(to, "/") {
+    if part != "" && fm.handlingFor(part).Hide { return nil, fmt.Errorf("Illegal target: %v", to) }
+  }
+  
+  files := map[string]*File{}
+  tree := fm.current().root.Contents
+  src := fileAt(tree, strings.TrimPrefix(from, "/"))
+  parent := fileAt(tree, strings.TrimPrefix(path.Dir(to), "/"))
+  existing := fileAt(tree, strings.TrimPrefix(to, "/"))
+  if src != nil && src.Info.IsDir() && isSuite(src.Contents) { collectCopyable("", src.Contents, files) }
+  
+  if len(files) == 0 { return nil, &adminErr{http.StatusNotFound, from + " is not a suite"} }
+  if path.Dir(to) != "/" && (parent == nil || !parent.Info.IsDir()) {
+    return nil, &adminErr{http.StatusNotFound, path.Dir(to) + ": No such directory"}
+  }
+  if existing != nil && !replace { return nil, &adminErr{http.StatusConflict, to + " exists"} }
+  
+  fm.uploadmutex.Lock()
+  defer fm.uploadmutex.Unlock()
+  res := &suiteCopy{From:from, To:to}
+  var releases []string
+  for rel := range files {
+    if releaseFiles[path.Base(rel)] {
+      releases = append(releases, rel)
+      continue
+    }
+    if err := fm.copySuiteFile(files[rel], to, rel); err != nil { return res, err }
+    res.Copied++
+  }
+  for _, rel := range releases {
+    if err := fm.copySuiteFile(files[rel], to, rel); err != nil { return res, err }
+    res.Copied++
+  }
+  
+  if replace {
+    base := path.Join(fm.root(), to)
+    var prune func(rel string)
+    prune = func(rel string) {
+      fis, _ := ioutil.ReadDir(path.Join(base, rel))
+      for _, fi := range fis {
+        p := path.Join(rel, fi.Name())
+        switch {
+          case fm.handlingFor(fi.Name()).Hide:
+          case fi.IsDir(): prune(p)
+          case files[p] == nil:
+            if err := os.Remove(path.Join(base, p)); err != nil {
+              util.Log(0, "WARNING! Promote %v: %v", to, err)
+            } else {
+              res.Removed++
+            }
+        }
+      }
+    }
+    prune("")
+  }
+  util.Log(1, "Copied suite %v to %v (%v files copied, %v removed)", from, to, res.Copied, res.Removed)
+  notify.Send(notify.RepoPublished, to, fmt.Sprintf("Suite %v published", to), fmt.Sprintf("The metadata of %v has been copied to %v (%v files copied, %v removed).", from, to, res.Copied, res.Removed))
+  return res, nil
+}
+
+// The files of a suite's Release, InRelease and Release.gpg.
+var releaseFiles = map[string]bool{"Release":true, "InRelease":true, "Release.gpg":true}
+
+/*
+  Adds the real files (not compressed aliases or generated pages) below dir,
+  whose path relative to the suite is dirpath, to files.
+*/
+func collectCopyable(dirpath string, dir map[string]*File, files map[string]*File) {
+  for name, x := range dir {
+    switch x.Data.(type) {
+      case string, *os.File:
+      default: continue
+    }
+    if x.Info.IsDir() {
+      collectCopyable(dirpath + name + "/", x.Contents, files)
+    } else if x.Encoding == "" {
+      files[dirpath + name] = x
+    }
+  }
+}
+
+// Copies x to the path rel below the directory to (a URL path).
+// The caller must hold uploadmutex.
+func (fm *FileManager) copySuiteFile(x *File, to, rel string) error {
+  clean := path.Join(to, rel)
+  err := fm.makeParents(path.Dir(to), clean)
+  if err != nil { return err }
+  stream, _, err := x.GetStream(true)
+  if err != nil { return err }
+  defer stream.Close()
+  u, err := stageUpload(path.Join(fm.root(), path.Dir(clean)), stream, x.Info.Size(), x.Info.ModTime())
+  if err != nil { return err }
+  defer u.discard()
+  _, err = u.install(path.Base(clean))
+  return err
+}
+
+// The answer to "purge".
+type purgeResult struct {
+  CacheEntries int `json:"cache_entries"`
+  Proxied int `json:"proxied"`
+}
+
+/*
+  Removes the files below the URL path clean from the cache and the files
+  fetched from upstream below a proxy prefix.
+*/
+func (fm *FileManager) purge(clean string) *purgeResult {
+  res := &purgeResult{}
+  files := map[string]*File{}
+  x := fm.current().root
+  if clean != "/" { x = fileAt(x.Contents, clean[1:]) }
+  if x != nil {
+    if x.Info.IsDir() {
+      collectCopyable(strings.TrimSuffix(clean, "/") + "/", x.Contents, files)
+    } else {
+      files[clean] = x
+    }
+  }
+  
+  for p, x := range files {
+    if fm.cache != nil {
+      if _, ok := fm.cache.Get(x.Id, RAW); ok { res.CacheEntries++ }
+      fm.cache.Remove(x.Id)
+    }
+    if proxy := fm.proxyFor(p); proxy != nil {
+      local := path.Join(fm.root(), p)
+      metafile := path.Join(path.Dir(local), "." + path.Base(local) + ".proxy")
+      if readProxyMeta(metafile) == nil { continue } // not from upstream
+      unlock := proxy.lock(strings.TrimPrefix(p, proxy.prefix + "/"))
+      fm.removeProxied(proxy, p, metafile)
+      unlock()
+      res.Proxied++
+    }
+  }
+  util.Log(1, "Purged %v: %v cache entries, %v proxied files", clean, res.CacheEntries, res.Proxied)
+  return res
+}
+
+/*
+  Forgets what the metadata of the repositories was generated from, if
+  regeneration has been requested via the admin API, so that it is
+  generated anew. Must only be called by the goroutine that scans the tree.
+*/
+func (fm *FileManager) forgetRepoStates() {
+  if !atomic.CompareAndSwapInt32(&fm.regenerate, 1, 0) { return }
+  util.Log(1, "Regenerating the metadata of all repositories")
+  for _, repo := range fm.rpm_repos { repo.state = "" }
+  for _, repo := range fm.arch_repos { repo.state = "" }
+  for _, repo := range fm.pypi_repos { repo.state = "" }
+  for _, repo := range fm.maven_repos { repo.state = "" }
+}
+
+// The answer to "remove".
+type removeResult struct {
+  Path string `json:"path"`
+}
+
+/*
+  Moves the file at the URL path clean to the trash (or, if TrashRetention
+  is 0, deletes it), removes its validation results and unpublishes it,
+  so that clients do not get it even before the next rescan. Generated
+  files can not be removed. r must be allowed to read and modify clean.
+*/
+func (fm *FileManager) remove(r *http.Request, clean string) (*removeResult, error) {
+  if !fm.mayRead(r, clean) { return nil, &adminErr{http.StatusNotFound, clean + ": No such file"} }
+  if !fm.mayWrite(r, clean) { return nil, &adminErr{http.StatusForbidden, clean + ": Permission denied"} }
+  for _, part := range strings.Split(clean, "/") {
+    if part != "" && fm.handlingFor(part).Hide { return nil, fmt.Errorf("Illegal path: %v", clean) }
+  }
+  x := fileAt(fm.current().root.Contents, strings.TrimPrefix(clean, "/"))
+  if x == nil { return nil, &adminErr{http.StatusNotFound, clean + ": No such file"} }
+  if x.Info.IsDir() { return nil, &adminErr{http.StatusConflict, clean + " is a directory"} }
+  if _, ondisk := x.Data.(string); !ondisk || x.Encoding != "" || x.Info.Name() != path.Base(clean) {
+    return nil, &adminErr{http.StatusConflict, clean + " is generated"}
+  }
+  
+  fm.uploadmutex.Lock()
+  defer fm.uploadmutex.Unlock()
+  dir := path.Join(fm.root(), path.Dir(clean))
+  var err error
+  if TrashRetention > 0 {
+    err = fm.moveToTrash(dir, path.Base(clean), clean, x.Info.Size())
+  } else {
+    err = os.Remove(path.Join(dir, path.Base(clean)))
+  }
+  if os.IsNotExist(err) { return nil, &adminErr{http.StatusNotFound, clean + ": No such file"} }
+  if err != nil { return nil, err }
+  if err = writeValidations(dir, path.Base(clean), nil); err != nil {
+    util.Log(0, "WARNING! Removing validation results of %v: %v", clean, err)
+  }
+  if fm.cache != nil { fm.cache.Remove(x.Id) }
+  t := fm.Begin()
+  t.Remove(clean)
+  if err = t.Commit(); err != nil {
+    util.Log(0, "ERROR! Unpublishing %v: %v", clean, err)
+  }
+  return &removeResult{Path:clean}, nil
+}
+
+// The answer to "verify".
+type verifyResult struct {
+  OK bool `json:"ok"`
+  Suites []*suiteCheck `json:"suites"`
+}
+
+// The result of checking one suite.
+type suiteCheck struct {
+  Suite string `json:"suite"`
+  // True if the suite has InRelease or Release.gpg.
+  Signed bool `json:"signed"`
+  // The number of files listed in Release that have been checked.
+  Checked int `json:"checked"`
+  Problems []string `json:"problems"`
+}
+
+/*
+  Checks the metadata of the suite at the URL path suite or, if suite is "",
+  of all suites that r may read against their Release files, like
+  takeSnapshot() does for the files on disk. Files listed in Release that
+  do not exist are ignored.
+*/
+func (fm *FileManager) verifySuites(r *http.Request, suite string) (*verifyResult, error) {
+  // The directory maps of a published tree are not modified.
+  suites := map[string]map[string]*File{}
+  tree := fm.current().root.Contents
+  if suite != "" {
+    suite = path.Clean("/" + suite)
+    x := fileAt(tree, strings.TrimPrefix(suite, "/"))
+    if x != nil && x.Info.IsDir() && isSuite(x.Contents) && fm.mayRead(r, suite) { suites[suite] = x.Contents }
+  } else {
+    var walk func(dirpath string, d map[string]*File)
+    walk = func(dirpath string, d map[string]*File) {
+      if isSuite(d) { suites[dirpath] = d }
+      for name, x := range d {
+        if x.Info.IsDir() && fm.mayRead(r, dirpath + "/" + name) { walk(dirpath + "/" + name, x.Contents) }
+      }
+    }
+    walk("", tree)
+  }
+  if suite != "" && len(suites) == 0 { return nil, &adminErr{http.StatusNotFound, suite + " is not a suite"} }
+  
+  names := []string{}
+  for name := range suites { names = append(names, name) }
+  sort.Strings(names)
+  res := &verifyResult{OK:true, Suites:[]*suiteCheck{}}
+  for _, name := range names {
+    check := fm.verifySuite(suites[name])
+    check.Suite = name
+    if len(check.Problems) > 0 { res.OK = false }
+    res.Suites = append(res.Suites, check)
+  }
+  return res, nil
+}
+
+// Checks the files of the suite directory dir against its Release file.
+func (fm *FileManager) verifySuite(dir map[string]*File) *suiteCheck {
+  check := &suiteCheck{Problems:[]string{}}
+  problem := func(format string, args ...interface{}) {
+    check.Problems = append(check.Problems, fmt.Sprintf(format, args...))
+  }
+  var release []byte
+  if x := fileAt(dir, "Release"); x != nil {
+    data, err := readFile(x)
+    if err != nil { problem("Release: %v", err) }
+    release = data
+  }
+  if x := fileAt(dir, "InRelease"); x != nil {
+    check.Signed = true
+    data, err := readFile(x)
+    if err == nil { data, err = clearsignedText(data) }
+    if err != nil {
+      problem("InRelease: %v", err)
+    } else if release == nil {
+      release = data
+    } else if !bytes.Equal(bytes.TrimSpace(data), bytes.TrimSpace(release)) {
+      problem("InRelease does not match Release")
+    }
+  }
+  if fileAt(dir, "Release.gpg") != nil { check.Signed = true }
+  
+  for _, e := range releaseEntries(release) {
+    x := fileAt(dir, e.name)
+    // Compressed aliases are checked via the file they are derived from.
+    if x == nil || x.Info.IsDir() || x.Encoding != "" { continue }
+    check.Checked++
+    if x.Info.Size() != e.size {
+      problem("%v has size %v but Release says %v", e.name, x.Info.Size(), e.size)
+      continue
+    }
+    if e.sha256 == "" { continue }
+    sum, err := fm.checksum(x)
+    if err != nil {
+      problem("%v: %v", e.name, err)
+    } else if sum != e.sha256 {
+      problem("SHA-256 of %v does not match Release", e.name)
+    }
+  }
+  return check
+}
@@ -0,0 +1,270 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "io"
+         "fmt"
+         "path"
+         "strings"
+         "net/http"
+         "io/ioutil"
+         
+         "../debian"
+       )
+
+/*
+  The parts of a Debian mirror that an apt proxy fetches from upstream.
+  See SelectApt().
+*/
+type AptSelection struct {
+  // The suites, e.g. "bookworm" and "bookworm-updates". Empty means all.
+  Suites []string
+  
+  // The components, e.g. "main". Empty means all.
+  Components []string
+  
+  // The architectures, e.g. "amd64". Packages for "all" are always
+  // included. Empty means all.
+  Architectures []string
+  
+  // If true, source packages are fetched as well.
+  Source bool
+}
+
+/*
+  Parses "suites:components:architectures[:source]", where each of the
+  first three is a comma-separated list or "*" for all, e.g.
+  "bookworm,bookworm-updates:main:amd64,arm64".
+*/
+func ParseAptSelection(s string) (AptSelection, error) {
+  var sel AptSelection
+  parts := strings.Split(s, ":")
+  if len(parts) < 3 || len(parts) > 4 || (len(parts) == 4 && parts[3] != "source") {
+    return sel, fmt.Errorf("Expected suites:components:architectures[:source], got %v", s)
+  }
+  list := func(l string) []string {
+    if l == "*" || l == "" { return nil }
+    var items []string
+    for _, item := range strings.Split(l, ",") {
+      if item = strings.Trim(strings.TrimSpace(item), "/"); item != "" { items = append(items, item) }
+    }
+    return items
+  }
+  sel.Suites = list(parts[0])
+  sel.Components = list(parts[1])
+  sel.Architectures = list(parts[2])
+  sel.Source = len(parts) == 4
+  return sel, nil
+}
+
+/*
+  Restricts the apt proxy at prefix (see AddAptProxy()) to sel. Requests
+  for files outside of sel are answered with 404 Not Found without asking
+  upstream, so that clients cannot fill the disk with parts of the mirror
+  that are not needed.
+  Call before ServeHTTP() is called for the first time.
+*/
+func (fm *FileManager) SelectApt(prefix string, sel AptSelection) error {
+  prefix = strings.TrimSuffix(path.Clean(prefix), "/")
+  for _, p := range fm.proxies {
+    if p.prefix == prefix && p.debian {
+      p.selection = &sel
+      return nil
+    }
+  }
+  return fmt.Errorf("%v is not an apt proxy", prefix)
+}
+
+// Returns true if list is empty (i.e. everything) or contains item.
+func selected(list []string, item string) bool {
+  if len(list) == 0 { return true }
+  for _, x := range list {
+    if x == item { return true }
+  }
+  return false
+}
+
+// Returns true if packages for arch are selected.
+func (sel *AptSelection) hasArch(arch string) bool {
+  if arch == "source" { return sel.Source }
+  return arch == "all" || selected(sel.Architectures, arch)
+}
+
+/*
+  Splits rest into the selected component it starts with and the part after
+  it. Components may contain "/" (e.g. "updates/main"). ok is false if rest
+  is not in a selected component.
+*/
+func (sel *AptSelection) component(rest string) (sub string, ok bool) {
+  if len(sel.Components) == 0 {
+    parts := strings.SplitN(rest, "/", 2)
+    if len(parts) == 1 { return "", true }
+    return parts[1], true
+  }
+  for _, c := range sel.Components {
+    if rest == c { return "", true }
+    if strings.HasPrefix(rest, c + "/") { return rest[len(c)+1:], true }
+  }
+  return "", false
+}
+
+/*
+  Returns false if the file name in dists/ is for an architecture that is
+  not selected, e.g. Contents-arm64.gz or Components-arm64.yml.xz.
+*/
+func (sel *AptSelection) allowsArchFile(name string) bool {
+  for _, prefix := range []string{"Contents-udeb-", "Contents-", "Components-"} {
+    if strings.HasPrefix(name, prefix) {
+      return sel.hasArch(strings.SplitN(name[len(prefix):], ".", 2)[0])
+    }
+  }
+  return true
+}
+
+// Returns true if the file rel (relative to the apt proxy prefix) is selected.
+func (sel *AptSelection) allows(rel string) bool {
+  parts := strings.SplitN(rel, "/", 3)
+  switch {
+    case parts[0] == "dists" && len(parts) >= 2:
+      if !selected(sel.Suites, parts[1]) { return false }
+      if len(parts) == 2 { return true }
+      if !strings.Contains(parts[2], "/") { return sel.allowsArchFile(parts[2]) } // Release, Contents-amd64.gz,...
+      sub, ok := sel.component(parts[2])
+      if !ok { return false }
+      for _, seg := range strings.Split(sub, "/") {
+        switch {
+          case strings.HasPrefix(seg, "binary-"): return sel.hasArch(seg[len("binary-"):])
+          case seg == "source": return sel.Source
+          case seg == "by-hash": return true
+        }
+        if !sel.allowsArchFile(seg) { return false }
+      }
+      return true
+    
+    case parts[0] == "pool" && len(parts) >= 2:
+      if _, ok := sel.component(strings.TrimPrefix(rel, "pool/")); !ok { return false }
+      name := path.Base(rel)
+      for _, ext := range []string{".deb", ".udeb", ".ddeb"} {
+        if strings.HasSuffix(name, ext) {
+          name = strings.TrimSuffix(name, ext)
+          return sel.hasArch(name[strings.LastIndex(name, "_")+1:])
+        }
+      }
+      // .dsc, .orig.tar.xz, .debian.tar.xz, .diff.gz,...
+      return len(parts) == 2 || sel.Source
+  }
+  return true
+}
+
+// The result of EstimateApt().
+type AptEstimate struct {
+  // The number of files in pool/ and their total size.
+  Files int
+  Bytes int64
+  
+  // The total size of the Release files and package indexes.
+  Metadata int64
+}
+
+// Returns the file rel (relative to the base URL) from up.
+func (up *Upstream) open(rel string) (io.ReadCloser, error) {
+  u := up.fileURL(rel)
+  req, err := http.NewRequest("GET", u, nil)
+  if err != nil { return nil, err }
+  req.Header.Set("User-Agent", "Garçon")
+  req.Header.Set("Accept-Encoding", "identity")
+  resp, err := up.client.Do(req)
+  if err != nil { return nil, err }
+  if resp.StatusCode != http.StatusOK {
+    resp.Body.Close()
+    return nil, fmt.Errorf("%v: %v", u, resp.Status)
+  }
+  return resp.Body, nil
+}
+
+// Returns the whitespace-separated values of the field name of the Release file data.
+func releaseField(data []byte, name string) []string {
+  for _, line := range strings.Split(string(data), "\n") {
+    if strings.HasPrefix(line, name + ":") { return strings.Fields(line[len(name)+1:]) }
+  }
+  return nil
+}
+
+/*
+  Computes how much sel would fetch from the Debian mirror up if apt
+  clients requested all of it, from the Release files of the selected
+  suites and the Packages (and Sources) files they list. sel must list
+  the suites, because the mirror's suites cannot be listed. Nothing
+  is stored.
+*/
+func EstimateApt(up *Upstream, sel AptSelection) (*AptEstimate, error) {
+  if len(sel.Suites) == 0 { return nil, fmt.Errorf("The suites must be listed for an estimate") }
+  est := &AptEstimate{}
+  files := map[string]int64{}
+  for _, suite := range sel.Suites {
+    stream, err := up.open("dists/" + suite + "/Release")
+    if err != nil { return nil, err }
+    release, err := ioutil.ReadAll(stream)
+    stream.Close()
+    if err != nil { return nil, err }
+    est.Metadata += int64(len(release))
+    
+    sizes := map[string]int64{}
+    for _, e := range releaseEntries(release) { sizes[e.name] = e.size }
+    comps := sel.Components
+    if len(comps) == 0 { comps = releaseField(release, "Components") }
+    archs := sel.Architectures
+    if len(archs) == 0 { archs = releaseField(release, "Architectures") }
+    var indexes []string
+    for _, comp := range comps {
+      for _, arch := range archs {
+        if arch != "all" { indexes = append(indexes, comp + "/binary-" + arch + "/Packages") }
+      }
+      // apt reads binary-all/Packages as well, if there is one.
+      indexes = append(indexes, comp + "/binary-all/Packages")
+      if sel.Source { indexes = append(indexes, comp + "/source/Sources") }
+    }
+    
+    for _, index := range indexes {
+      // apt prefers the smallest variant, which is usually the .xz.
+      for _, v := range []int{1, 2, 4, 3, 0} {
+        variant := indexVariants[v]
+        size, ok := sizes[index + variant.ext]
+        if !ok { continue }
+        est.Metadata += size
+        stream, err := up.open("dists/" + suite + "/" + index + variant.ext)
+        if err != nil { return nil, err }
+        var r io.ReadCloser = stream
+        if variant.encoding != "" {
+          r, err = NewDecompressor(variant.encoding, stream)
+          if err != nil {
+            stream.Close()
+            return nil, err
+          }
+        }
+        err = debian.ReadPoolFiles(r, path.Base(index) == "Sources", files)
+        r.Close()
+        if err != nil { return nil, fmt.Errorf("%v/%v: %v", suite, index, err) }
+        break
+      }
+    }
+  }
+  for _, size := range files {
+    est.Files++
+    est.Bytes += size
+  }
+  return est, nil
+}
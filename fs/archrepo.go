@@ -0,0 +1,214 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "io"
+         "os"
+         "fmt"
+         "path"
+         "sort"
+         "time"
+         "bytes"
+         "regexp"
+         "strings"
+         "io/ioutil"
+         "crypto/md5"
+         "crypto/sha256"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../arch"
+         "../pgp"
+       )
+
+/*
+  A directory whose pacman databases <name>.db and <name>.files are
+  generated from the packages (*.pkg.tar.zst, .xz, .gz or .bz2) in it,
+  so that pacman can use it as repository, e.g.
+    [name]
+    Server = https://example.com/arch
+  A detached signature <package>.sig next to a package is included in
+  the database. Whenever the scan finds that packages or signatures have
+  been added, replaced or removed, the databases are rewritten.
+*/
+type archRepo struct {
+  // URL path of the directory (without trailing slash).
+  prefix string
+  
+  // The repository name, i.e. the name of the section in pacman.conf.
+  name string
+  
+  // The keys that sign the databases (<name>.db.sig,...). Their public
+  // keys are in <name>.key.
+  keys *pgp.Keyring
+  
+  // Describes the packages the current databases have been generated from.
+  state string
+}
+
+// Matches the names of package files and the extension that tells their compression.
+var archPackage = regexp.MustCompile(`\.pkg\.tar(\.zst|\.xz|\.gz|\.bz2)?$`)
+
+var archEncodings = map[string]string{".zst":"zstd", ".xz":"xz", ".gz":"gzip", ".bz2":"bzip2"}
+
+/*
+  Makes the directory prefix an Arch Linux repository called name (see
+  archRepo). The databases are signed with the keys of keys that sign at
+  the time (which may be none or nil). They are generated by AutoUpdate(),
+  starting right away.
+  Call before AutoUpdate().
+*/
+func (fm *FileManager) AddArchRepo(prefix, name string, keys *pgp.Keyring) {
+  fm.arch_repos = append(fm.arch_repos, &archRepo{prefix:strings.TrimSuffix(path.Clean(prefix), "/"), name:name, keys:keys})
+}
+
+/*
+  Rewrites the databases of every Arch repository in tree whose packages
+  have changed since its last update. The new files are picked up by the
+  next scan.
+  Must only be called by the goroutine that scans the directory tree.
+*/
+func (fm *FileManager) updateArchRepos(tree map[string]*File) {
+  packages := map[uint64]*arch.Entry{}
+  for _, repo := range fm.arch_repos {
+    dir := fileAt(tree, strings.TrimPrefix(repo.prefix, "/"))
+    if dir == nil || !dir.Info.IsDir() {
+      if repo.state != "-" { util.Log(0, "WARNING! Arch repository %v: No such directory", repo.prefix) }
+      repo.state = "-"
+      continue
+    }
+    
+    names := []string{}
+    for name, x := range dir.Contents {
+      if archPackage.MatchString(name) && !x.Info.IsDir() && x.Encoding == "" { names = append(names, name) }
+    }
+    sort.Strings(names)
+    var state bytes.Buffer
+    state.WriteString(signingState(repo.keys, time.Now()))
+    for _, name := range names {
+      fmt.Fprintf(&state, "%v %v\n", name, dir.Contents[name].Id)
+      if sig := dir.Contents[name + ".sig"]; sig != nil { fmt.Fprintf(&state, "%v.sig %v\n", name, sig.Id) }
+    }
+    if state.String() == repo.state {
+      for _, name := range names {
+        x := dir.Contents[name]
+        if e := fm.arch_packages[x.Id]; e != nil { packages[x.Id] = e }
+      }
+      continue
+    }
+    
+    entries := []arch.Entry{}
+    for _, name := range names {
+      x := dir.Contents[name]
+      e := fm.arch_packages[x.Id]
+      if e == nil {
+        var err error
+        e, err = readArchPackage(x, archEncodings[archPackage.FindStringSubmatch(name)[1]])
+        if err != nil {
+          util.Log(0, "WARNING! Arch repository %v: Skipping %v: %v", repo.prefix, name, err)
+          continue
+        }
+      }
+      packages[x.Id] = e
+      entry := *e
+      entry.Filename = name
+      if sig := dir.Contents[name + ".sig"]; sig != nil {
+        var err error
+        entry.Signature, err = readAll(sig)
+        if err != nil { util.Log(0, "WARNING! Arch repository %v: %v", repo.prefix, err) }
+      }
+      entries = append(entries, entry)
+    }
+    
+    err := fm.writeArchDBs(repo, entries)
+    if err != nil {
+      util.Log(0, "ERROR! Arch repository %v: %v", repo.prefix, err)
+      continue
+    }
+    util.Log(1, "Arch repository %v: Databases for %v packages written", repo.prefix, len(entries))
+    repo.state = state.String()
+  }
+  // Forget the packages that are gone.
+  fm.arch_packages = packages
+}
+
+// Reads the package x, which is compressed with encoding, and computes its checksums.
+func readArchPackage(x *File, encoding string) (*arch.Entry, error) {
+  stream, _, err := x.GetStream(true)
+  if err != nil { return nil, err }
+  defer stream.Close()
+  md5sum, sha256sum := md5.New(), sha256.New()
+  raw := io.TeeReader(stream, io.MultiWriter(md5sum, sha256sum))
+  var tar io.Reader = raw
+  if encoding != "" {
+    decomp, err := NewDecompressor(encoding, raw)
+    if err != nil { return nil, err }
+    tar = decomp
+  }
+  p, err := arch.Read(tar)
+  if err != nil { return nil, err }
+  // The checksums cover the whole file, including what follows the tar archive.
+  _, err = io.Copy(ioutil.Discard, raw)
+  if err != nil { return nil, err }
+  return &arch.Entry{Package:p, Size:x.Info.Size(), MD5:fmt.Sprintf("%x", md5sum.Sum(nil)), SHA256:fmt.Sprintf("%x", sha256sum.Sum(nil))}, nil
+}
+
+// Returns the contents of x.
+func readAll(x *File) ([]byte, error) {
+  stream, _, err := x.GetStream(true)
+  if err != nil { return nil, err }
+  defer stream.Close()
+  return ioutil.ReadAll(stream)
+}
+
+/*
+  Writes <name>.db.tar.gz and <name>.files.tar.gz for entries to the
+  directory of repo on disk, together with the copies <name>.db and
+  <name>.files that pacman downloads, their signatures and the public
+  keys <name>.key.
+*/
+func (fm *FileManager) writeArchDBs(repo *archRepo, entries []arch.Entry) error {
+  dir := path.Join(fm.scanroot, repo.prefix)
+  now := time.Now()
+  // The new key must be available before anything is signed with it.
+  err := writeKeyring(dir, repo.name + ".key", repo.keys, now)
+  if err != nil { return err }
+  signed := false
+  for _, typ := range []string{"db", "files"} {
+    var db bytes.Buffer
+    err := arch.WriteDB(&db, entries, typ == "files", now)
+    if err != nil { return err }
+    sig, err := repo.keys.Sign(db.Bytes(), now)
+    if err != nil { return err }
+    signed = sig != nil
+    for _, name := range []string{repo.name + "." + typ + ".tar.gz", repo.name + "." + typ} {
+      err = writeFileAtomic(dir, name, db.Bytes())
+      if err == nil && sig != nil { err = writeFileAtomic(dir, name + ".sig", sig) }
+      if err != nil { return err }
+    }
+  }
+  
+  if !signed {
+    // Remove signatures from when a key was signing, which no longer match.
+    for _, typ := range []string{"db", "files"} {
+      for _, name := range []string{repo.name + "." + typ + ".tar.gz.sig", repo.name + "." + typ + ".sig"} {
+        err := os.Remove(path.Join(dir, name))
+        if err != nil && !os.IsNotExist(err) { util.Log(0, "WARNING! %v", err) }
+      }
+    }
+  }
+  return nil
+}
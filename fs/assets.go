@@ -0,0 +1,116 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "os"
+         "fmt"
+         "path"
+         "time"
+         "bytes"
+         "strings"
+         "net/http"
+         "io/ioutil"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../embedded"
+         "../problem"
+         "../accesslog"
+       )
+
+/*
+  The URL path below which the files from the assets directory that do not
+  replace an embedded file are served, e.g. a stylesheet or logo referenced
+  by the replaced templates.
+*/
+const AssetsPath = "/.garcon/assets/"
+
+// An embedded file that can be replaced by a file in the assets directory.
+type embeddedAsset struct {
+  data *[]byte
+  // A processing instruction the replacement must contain. "" if none.
+  required string
+}
+
+// Maps the names of the files in the assets directory to the embedded files they replace.
+var embeddedAssets = map[string]embeddedAsset{
+  "index.xhtml":    {&embedded.DefaultIndex, "<?garçon index?>"},
+  "icons.svg":      {&embedded.IndexIcons, ""},
+  "download.xhtml": {&embedded.DownloadPage, "<?garçon content?>"},
+  "markdown.xhtml": {&embedded.MarkdownPage, "<?garçon content?>"},
+  "source.xhtml":   {&embedded.SourcePage, "<?garçon content?>"},
+  "unlock.xhtml":   {&embedded.UnlockPage, "<?garçon content?>"},
+}
+
+// A file served below AssetsPath.
+type asset struct {
+  data []byte
+  modtime time.Time
+}
+
+// Maps names to the files served below AssetsPath. Set by LoadAssets().
+var assets = map[string]*asset{}
+
+/*
+  Reads the files in the directory dir. Those named like an entry of
+  embeddedAssets (e.g. index.xhtml for the template of the generated
+  index pages) replace the embedded file, all others are served below
+  AssetsPath. Subdirectories and files starting with "." are ignored.
+  Must be called before NewFileManager().
+*/
+func LoadAssets(dir string) error {
+  fis, err := ioutil.ReadDir(dir)
+  if err != nil { return err }
+  for _, fi := range fis {
+    name := fi.Name()
+    if strings.HasPrefix(name, ".") || !fi.Mode().IsRegular() { continue }
+    data, err := ioutil.ReadFile(path.Join(dir, name))
+    if err != nil { return err }
+    if e, ok := embeddedAssets[name]; ok {
+      if e.required != "" && !bytes.Contains(data, []byte(e.required)) {
+        return fmt.Errorf("%v: %v missing", path.Join(dir, name), e.required)
+      }
+      *e.data = data
+      util.Log(1, "Using %v instead of the built-in %v", path.Join(dir, name), name)
+    } else {
+      assets[name] = &asset{data, fi.ModTime()}
+      util.Log(1, "Serving %v as %v", path.Join(dir, name), AssetsPath + name)
+    }
+  }
+  defaultIndex.Data = embedded.DefaultIndex
+  defaultIndex.Info = &FileInfo{"index.xhtml",int64(len(embedded.DefaultIndex)),os.ModeDir|0777,time.Now(),false}
+  return nil
+}
+
+// Answers r with the file from the assets directory it asks for.
+func serveAsset(w http.ResponseWriter, r *http.Request) {
+  name := strings.TrimPrefix(r.URL.Path, AssetsPath)
+  a := assets[name]
+  if a == nil {
+    problem.Log(r, http.StatusNotFound, problem.NotFound, "")
+    problem.Write(w, r, http.StatusNotFound, problem.NotFound, "")
+    return
+  }
+  if r.Method != "" && r.Method != "GET" && r.Method != "HEAD" {
+    w.Header().Set("Allow", "GET, HEAD")
+    problem.Log(r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "")
+    problem.Write(w, r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "")
+    return
+  }
+  w.Header()["Content-Type"] = contentTypeHeader(mimeType(name))
+  accesslog.Log(r, 1, "%v %v %v", http.StatusOK, r.Method, r.URL.Path)
+  http.ServeContent(w, r, name, a.modtime, bytes.NewReader(a.data))
+}
@@ -0,0 +1,336 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+
+package fs
+
+import (
+         "io"
+         "os"
+         "sync"
+         "bytes"
+         "io/ioutil"
+         "container/list"
+         
+         "../status"
+       )
+
+/*
+  If false, sparse files (see File.Sparse) are never cached, because their
+  logical size, which the cache accounts for, may have little to do with
+  the cost of reading them, e.g. for disk images full of holes.
+*/
+var CacheSparseFiles = true
+
+/*
+  An in-memory LRU cache for the contents of small files. Entries are
+  keyed by File.Id, so a file that changes on disk (and therefore gets a
+  new Id on the next scan) will never be served from a stale entry.
+  Because a compressed alias has the same Id as the file it was created from,
+  both share the same cache entry for the raw data. The decompressed data of
+  an alias is stored as a separate variant under the same Id, so that
+  Remove() clears all variants at once.
+*/
+type Cache struct {
+  // Protects all of the following members.
+  mutex sync.Mutex
+  
+  // The total number of bytes the cache may hold.
+  maxsize int64
+  
+  // The number of bytes the cache may hold at the moment. This is
+  // less than maxsize if the global MemoryBudget requires it.
+  limit int64
+  
+  // Files larger than this will not be cached.
+  maxfile int64
+  
+  // The total number of bytes currently held.
+  size int64
+  
+  // Maps (File.Id, encoding) to an element of lru whose Value is a *cacheEntry.
+  entries map[cacheKey]*list.Element
+  
+  // Least recently used entries are at the back.
+  lru *list.List
+  
+  // The entries that are being loaded. See once().
+  loading map[cacheKey]*loadCall
+}
+
+// The encodings of data stored in the cache.
+const (
+  // The data as stored on disk (possibly compressed).
+  RAW = 0
+  // The decompressed data of a compressed alias.
+  DECOMPRESSED = 1
+)
+
+type cacheKey struct {
+  id uint64
+  encoding int
+}
+
+type cacheEntry struct {
+  key cacheKey
+  data []byte
+}
+
+// The loading of a cache entry in progress. See Cache.once().
+type loadCall struct {
+  // Closed when data and err are set.
+  done chan struct{}
+  data []byte
+  err error
+}
+
+var cacheCoalesced = status.NewCounter("garcon_cache_coalesced_total", "Cache misses that waited for the same entry being loaded by another request instead of reading the file themselves.")
+
+var (
+  rangesFromMemory = status.NewCounter(`garcon_range_requests_total{source="memory"}`, "Range requests by whether they were served from memory (cache or in-memory files) or from disk.")
+  rangesFromDisk = status.NewCounter(`garcon_range_requests_total{source="disk"}`, "Range requests by whether they were served from memory (cache or in-memory files) or from disk.")
+)
+
+// Counts a range request that is served from stream.
+func countRange(stream io.ReadCloser) {
+  if _, inMemory := stream.(*BytesReadCloser); inMemory {
+    rangesFromMemory.Inc()
+  } else {
+    rangesFromDisk.Inc()
+  }
+}
+
+/*
+  Returns a new Cache that holds at most maxsize bytes and does not
+  accept files larger than maxfile bytes.
+*/
+func NewCache(maxsize int64, maxfile int64) *Cache {
+  if maxfile > maxsize { maxfile = maxsize }
+  return &Cache{maxsize:maxsize, limit:maxsize, maxfile:maxfile, entries:map[cacheKey]*list.Element{}, lru:list.New(), loading:map[cacheKey]*loadCall{}}
+}
+
+// Returns the size of the largest file the cache will accept.
+func (c *Cache) MaxFile() int64 {
+  return c.maxfile
+}
+
+/*
+  Returns the cached data for Id id in the given encoding (RAW or DECOMPRESSED)
+  and true, or nil and false if the cache has no such entry.
+*/
+func (c *Cache) Get(id uint64, encoding int) ([]byte, bool) {
+  c.mutex.Lock()
+  defer c.mutex.Unlock()
+  if e, ok := c.entries[cacheKey{id, encoding}]; ok {
+    c.lru.MoveToFront(e)
+    return e.Value.(*cacheEntry).data, true
+  }
+  return nil, false
+}
+
+/*
+  Stores data under id in the given encoding (RAW or DECOMPRESSED), evicting
+  least recently used entries as necessary.
+  If data is larger than the cache's file size limit, nothing happens.
+*/
+func (c *Cache) Put(id uint64, encoding int, data []byte) {
+  if int64(len(data)) > c.maxfile { return }
+  key := cacheKey{id, encoding}
+  c.mutex.Lock()
+  defer c.mutex.Unlock()
+  if e, ok := c.entries[key]; ok {
+    c.lru.MoveToFront(e)
+    return
+  }
+  c.entries[key] = c.lru.PushFront(&cacheEntry{key:key, data:data})
+  c.size += int64(len(data))
+  for c.size > c.limit {
+    c.remove(c.lru.Back())
+  }
+}
+
+// Removes e from the cache. c.mutex must be held by the caller.
+func (c *Cache) remove(e *list.Element) {
+  entry := c.lru.Remove(e).(*cacheEntry)
+  delete(c.entries, entry.key)
+  c.size -= int64(len(entry.data))
+}
+
+// Removes all variants stored for Id id from the cache.
+func (c *Cache) Remove(id uint64) {
+  c.mutex.Lock()
+  defer c.mutex.Unlock()
+  for _, encoding := range []int{RAW, DECOMPRESSED} {
+    if e, ok := c.entries[cacheKey{id, encoding}]; ok {
+      c.remove(e)
+    }
+  }
+}
+
+/*
+  Returns the raw data (i.e. still compressed if f.Encoding != "") of file f, either from
+  the cache or by reading it and adding it to the cache.
+  Returns nil and no error if f is not suitable for caching because it is
+  too large, because its size no longer matches f.Info or because its data
+  is in memory anyway.
+*/
+func (c *Cache) Load(f *File) ([]byte, error) {
+  switch f.Data.(type) {
+    case string, *os.File: // on disk
+    default: return nil, nil
+  }
+  if f.Info.IsDir() || f.Info.Size() > c.maxfile || (f.Sparse && !CacheSparseFiles) {
+    return nil, nil
+  }
+  
+  if data, ok := c.Get(f.Id, RAW); ok {
+    return data, nil
+  }
+  
+  return c.once(cacheKey{f.Id, RAW}, func() ([]byte, error) {
+    stream, _, err := f.GetStream(true)
+    if err != nil { return nil, err }
+    defer stream.Close()
+    // The file may have grown since it was scanned. Read at most 1 byte more
+    // than allowed, and do not cache data that does not match f.Info.
+    data, err := ioutil.ReadAll(io.LimitReader(stream, c.maxfile+1))
+    if err != nil { return nil, err }
+    if int64(len(data)) > c.maxfile || int64(len(data)) != f.Info.Size() { return nil, nil }
+    c.Put(f.Id, RAW, data)
+    return data, nil
+  })
+}
+
+/*
+  Like Load() but for a compressed alias f returns the decompressed data.
+  If the decompressed data exceeds the cache's file size limit,
+  nil and no error is returned.
+*/
+func (c *Cache) LoadDecompressed(f *File) ([]byte, error) {
+  if f.Encoding == "" { return c.Load(f) }
+  
+  if data, ok := c.Get(f.Id, DECOMPRESSED); ok {
+    return data, nil
+  }
+  
+  return c.once(cacheKey{f.Id, DECOMPRESSED}, func() ([]byte, error) {
+    raw, err := c.Load(f)
+    if raw == nil || err != nil { return nil, err }
+    
+    decomp, err := NewDecompressor(f.Encoding, bytes.NewReader(raw))
+    if err != nil { return nil, err }
+    defer decomp.Close()
+    // Read at most 1 byte more than allowed so that we can detect oversized data
+    data, err := ioutil.ReadAll(io.LimitReader(decomp, c.maxfile+1))
+    if err != nil { return nil, err }
+    if int64(len(data)) > c.maxfile { return nil, nil }
+    c.Put(f.Id, DECOMPRESSED, data)
+    return data, nil
+  })
+}
+
+/*
+  Returns the result of load(), which loads the entry key into the cache,
+  unless another goroutine is loading key already, in which case its result
+  is returned when it is done. This way many clients that request the same
+  uncached file at once (e.g. apt clients fetching Packages.gz right after
+  a rescan) cause only one read and decompression.
+*/
+func (c *Cache) once(key cacheKey, load func() ([]byte, error)) ([]byte, error) {
+  c.mutex.Lock()
+  if call, ok := c.loading[key]; ok {
+    c.mutex.Unlock()
+    cacheCoalesced.Inc()
+    <-call.done
+    return call.data, call.err
+  }
+  // The entry may have been added after the caller's Get().
+  if e, ok := c.entries[key]; ok {
+    c.lru.MoveToFront(e)
+    c.mutex.Unlock()
+    return e.Value.(*cacheEntry).data, nil
+  }
+  call := &loadCall{done:make(chan struct{})}
+  c.loading[key] = call
+  c.mutex.Unlock()
+  
+  // Waiters must not hang if load() panics. They get nil, nil then,
+  // i.e. they read the file themselves.
+  defer func() {
+    c.mutex.Lock()
+    delete(c.loading, key)
+    c.mutex.Unlock()
+    close(call.done)
+  }()
+  call.data, call.err = load()
+  return call.data, call.err
+}
+
+/*
+  Like File.GetStream() but serves f from the cache (loading it if necessary).
+  If f is not suitable for caching, stream will be nil. The stream implements
+  io.Seeker and io.ReaderAt, so that ranges (e.g. apt resuming a partial
+  download) are served from memory without reading the file again.
+  
+  NOTE: If stream != nil, the caller must call stream.Close() when done.
+*/
+func (c *Cache) GetStream(f *File, keep_encoded bool) (stream io.ReadCloser, is_encoded bool, err error) {
+  if f.Encoding != "" && !keep_encoded {
+    data, err := c.LoadDecompressed(f)
+    if data == nil || err != nil { return nil, false, err }
+    return &BytesReadCloser{*bytes.NewReader(data)}, false, nil
+  }
+  
+  data, err := c.Load(f)
+  if data == nil || err != nil { return nil, false, err }
+  return &BytesReadCloser{*bytes.NewReader(data)}, f.Encoding != "", nil
+}
+
+/*
+  Restricts the cache to at most limit bytes (but never more than the maximum
+  size passed to NewCache()) and evicts entries as necessary.
+*/
+func (c *Cache) Limit(limit int64) {
+  if limit > c.maxsize { limit = c.maxsize }
+  if limit < 0 { limit = 0 }
+  c.mutex.Lock()
+  defer c.mutex.Unlock()
+  c.limit = limit
+  for c.size > c.limit {
+    c.remove(c.lru.Back())
+  }
+}
+
+/*
+  Removes all entries whose Id is not contained in ids.
+  Returns the number of removed entries.
+*/
+func (c *Cache) Retain(ids map[uint64]bool) (removed int) {
+  c.mutex.Lock()
+  defer c.mutex.Unlock()
+  for key, e := range c.entries {
+    if !ids[key.id] {
+      c.remove(e)
+      removed++
+    }
+  }
+  return
+}
+
+// Returns the number of entries and the number of bytes in the cache.
+func (c *Cache) Stats() (entries int, size int64) {
+  c.mutex.Lock()
+  defer c.mutex.Unlock()
+  return len(c.entries), c.size
+}
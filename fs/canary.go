@@ -0,0 +1,81 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "os"
+         "sync"
+         "time"
+         "math/rand"
+         "net/http"
+       )
+
+/*
+  If non-nil, the template (like index.xhtml) of an alternative version of
+  the generated index pages, which is served to CanaryPercent percent of
+  the clients so that changes of the pages can be tried on some users
+  first. Only directories without their own index.xhtml get the
+  alternative. Must be set before NewFileManager().
+*/
+var CanaryIndex []byte
+
+// The percentage (0 to 100) of clients that get the CanaryIndex pages.
+var CanaryPercent = 0.0
+
+// The cookie that keeps a client in the group it has been assigned to.
+const canaryCookie = "garcon_canary"
+
+// How long a client stays in its group.
+const canaryCookieLifetime = 30*24*time.Hour
+
+// The groups of clients. The group is logged with each generated index.
+const (
+  groupControl = "control"
+  groupCanary = "canary"
+)
+
+var canaryOnce sync.Once
+var canaryIndexFile *File
+
+// Returns the File with CanaryIndex or nil if there is none.
+func canaryIndex() *File {
+  canaryOnce.Do(func() {
+    if CanaryIndex == nil { return }
+    canaryIndexFile = &File{
+      Info: &FileInfo{"index.xhtml",int64(len(CanaryIndex)),os.ModeDir|0777,time.Now(),false},
+      Id:0,
+      Contents:nil,
+      Encoding:"",
+      Data:CanaryIndex,
+    }
+  })
+  return canaryIndexFile
+}
+
+/*
+  Returns the group of the client of r (groupControl or groupCanary). A client
+  without the group cookie is assigned to a group at random according to
+  CanaryPercent and the cookie is set in w.
+*/
+func canaryGroup(w http.ResponseWriter, r *http.Request) string {
+  w.Header().Add("Vary", "Cookie")
+  if c, err := r.Cookie(canaryCookie); err == nil && (c.Value == groupControl || c.Value == groupCanary) {
+    return c.Value
+  }
+  group := groupControl
+  if rand.Float64()*100 < CanaryPercent { group = groupCanary }
+  http.SetCookie(w, &http.Cookie{Name:canaryCookie, Value:group, Path:"/", MaxAge:int(canaryCookieLifetime/time.Second), HttpOnly:true, SameSite:http.SameSiteLaxMode})
+  return group
+}
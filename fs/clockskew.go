@@ -0,0 +1,111 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "io"
+         "fmt"
+         "time"
+         "net/http"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../status"
+       )
+
+/*
+  Files whose mtime is further in the future than this when they are
+  scanned are reported as affected by clock skew (e.g. after restoring an
+  image made on a machine with a wrong clock).
+*/
+var ClockSkewTolerance = time.Minute
+
+// The number of files with future mtimes that are listed on the status page.
+const maxSkewedListed = 100
+
+// A file whose mtime was in the future when it was scanned.
+type SkewedFile struct {
+  // The path relative to the server root.
+  Path string
+  
+  ModTime time.Time
+}
+
+// The files with future mtimes found by a scan.
+type clockSkew struct {
+  // The number of files.
+  Count int
+  
+  // The first maxSkewedListed files.
+  Files []SkewedFile
+  
+  // The latest of the mtimes.
+  Latest time.Time
+}
+
+/*
+  Returns the Last-Modified time to send for x in answer to r. A modification
+  time in the future is replaced with the current time, so that clients do
+  not send it back in If-Modified-Since and get "304 Not Modified" for every
+  change until that time has passed. For the same reason, an If-Modified-Since
+  in the future (sent by clients that got the wrong Last-Modified before) is
+  removed from r. Conditional requests still work via the ETag.
+*/
+func lastModified(r *http.Request, x *File) time.Time {
+  mtime := x.Info.ModTime()
+  now := time.Now()
+  if !mtime.After(now) { return mtime }
+  if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && ims.After(now) {
+    r.Header.Del("If-Modified-Since")
+  }
+  return now
+}
+
+/*
+  Records the file name in the filesystem directory dir if its mtime is in
+  the future. changed is true if the file is new or has changed since the
+  last scan. Only those are logged, so that each rescan does not repeat
+  the same warnings.
+*/
+func (fm *FileManager) checkClockSkew(dir, name string, mtime time.Time, changed bool) {
+  if !mtime.After(time.Now().Add(ClockSkewTolerance)) { return }
+  p := fm.relPath(dir, name)
+  if changed {
+    util.Log(0, "WARNING! %v has an mtime in the future: %v", p, mtime.Format(time.RFC3339))
+  }
+  skew := &fm.newskew
+  skew.Count++
+  if len(skew.Files) < maxSkewedListed { skew.Files = append(skew.Files, SkewedFile{p, mtime}) }
+  if mtime.After(skew.Latest) { skew.Latest = mtime }
+}
+
+// Writes the files with future mtimes found by the last scan to w. For the status page.
+func (fm *FileManager) WriteClockSkew(w io.Writer) {
+  skew := &fm.current().skew
+  if skew.Count == 0 {
+    fmt.Fprintf(w, "none\n")
+    return
+  }
+  fmt.Fprintf(w, "%v files have an mtime in the future (up to %v). Their Last-Modified is sent as the current time. Fix the clock of the machine that wrote them and touch them.\n", skew.Count, skew.Latest.Format(time.RFC3339))
+  for _, f := range skew.Files {
+    fmt.Fprintf(w, "%v %v\n", f.ModTime.Format(time.RFC3339), f.Path)
+  }
+  if skew.Count > len(skew.Files) { fmt.Fprintf(w, "...\n") }
+}
+
+// Registers the metric garcon_future_mtime_files with the number of files with future mtimes.
+func (fm *FileManager) RegisterClockSkewMetrics() {
+  status.NewGauge("garcon_future_mtime_files", "Number of files whose mtime was in the future when they were scanned.", func() int64 { return int64(fm.current().skew.Count) })
+}
@@ -0,0 +1,168 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "os"
+         "fmt"
+         "path"
+         "bufio"
+         "strings"
+         "strconv"
+         "encoding/xml"
+         
+         "github.com/mbenkmann/golib/util"
+       )
+
+/*
+  Name of the file that provides descriptions for the entries of the
+  directory it is in. Each line has the form
+  
+    name   description
+  
+  where name is separated from the description by whitespace. If name
+  contains whitespace, it has to be written in double quotes (Go syntax).
+  Empty lines and lines starting with "#" are ignored.
+*/
+const indexMeta = ".index.meta"
+
+/*
+  Returns the directory on disk that contains the entries of files or
+  "" if it can not be determined (e.g. because all files are in memory).
+*/
+func dirPath(files map[string]*File) string {
+  for _, x := range files {
+    if dir, ok := x.Data.(string); ok { return dir }
+  }
+  return ""
+}
+
+/*
+  Returns the os.FileInfo of the .index.meta file of the directory
+  described by info or nil if it has none.
+*/
+func (info *indexInfo) metaInfo() os.FileInfo {
+  if info.dir == "" { return nil }
+  fi, err := os.Stat(path.Join(info.dir, indexMeta))
+  if err != nil { return nil }
+  return fi
+}
+
+/*
+  Returns the descriptions of the entries of the directory described by info,
+  keyed by name. Descriptions from .index.meta take precedence. Files ending in
+  .html, .htm or .xhtml without such a description are described by their <title>.
+  The result is computed on first use and then stored in info.
+*/
+func (info *indexInfo) fileDescriptions() map[string]string {
+  if info.descriptions != nil { return info.descriptions }
+  
+  info.descriptions = map[string]string{}
+  if info.dir != "" {
+    err := readIndexMeta(path.Join(info.dir, indexMeta), info.descriptions)
+    if err != nil && !os.IsNotExist(err) {
+      util.Log(0, "ERROR! %v", err)
+    }
+  }
+  
+  for name, x := range info.files {
+    if _, ok := info.descriptions[name]; ok || x.Info.IsDir() || notListed[name] { continue }
+    // An alias (e.g. manual.pdf for manual.pdf.gz) is described like its file.
+    if x.Encoding != "" {
+      if desc, ok := info.descriptions[x.Info.Name()]; ok {
+        info.descriptions[name] = desc
+        continue
+      }
+    }
+    switch strings.ToLower(path.Ext(name)) {
+      case ".html", ".htm", ".xhtml":
+        if title := htmlTitle(x); title != "" {
+          info.descriptions[name] = title
+        }
+    }
+  }
+  
+  return info.descriptions
+}
+
+// Parses the .index.meta file fpath and adds its descriptions to desc.
+func readIndexMeta(fpath string, desc map[string]string) error {
+  f, err := os.Open(fpath)
+  if err != nil { return err }
+  defer f.Close()
+  
+  scanner := bufio.NewScanner(f)
+  lineno := 0
+  for scanner.Scan() {
+    lineno++
+    line := strings.TrimSpace(scanner.Text())
+    if line == "" || line[0] == '#' { continue }
+    
+    var name, rest string
+    if line[0] == '"' {
+      i := 1
+      for ; i < len(line) && line[i] != '"'; i++ {
+        if line[i] == '\\' { i++ }
+      }
+      if i >= len(line) {
+        return fmt.Errorf("%v:%v: Unterminated quoted name", fpath, lineno)
+      }
+      name, err = strconv.Unquote(line[:i+1])
+      if err != nil { return fmt.Errorf("%v:%v: %v", fpath, lineno, err) }
+      rest = line[i+1:]
+    } else {
+      fields := strings.SplitN(line, " ", 2)
+      if tab := strings.SplitN(line, "\t", 2); len(tab[0]) < len(fields[0]) {
+        fields = tab
+      }
+      name = fields[0]
+      if len(fields) > 1 { rest = fields[1] }
+    }
+    desc[name] = strings.TrimSpace(rest)
+  }
+  return scanner.Err()
+}
+
+// Returns the contents of the <title> of HTML file x or "" if it has none.
+func htmlTitle(x *File) string {
+  r, _, err := x.GetStream(false)
+  if err != nil { return "" }
+  defer r.Close()
+  
+  dec := xml.NewDecoder(r)
+  dec.Strict = false
+  dec.AutoClose = xml.HTMLAutoClose
+  dec.Entity = xml.HTMLEntity
+  
+  in_title := false
+  title := ""
+  for {
+    tok, err := dec.Token()
+    if err != nil { return "" }
+    switch t := tok.(type) {
+      case xml.StartElement:
+        switch strings.ToLower(t.Name.Local) {
+          case "body":  return ""
+          case "title": in_title = true
+        }
+      case xml.EndElement:
+        if strings.ToLower(t.Name.Local) == "title" {
+          return strings.Join(strings.Fields(title), " ")
+        }
+      case xml.CharData:
+        if in_title { title += string(t) }
+    }
+  }
+}
@@ -0,0 +1,125 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "io"
+         "fmt"
+         "hash"
+         "time"
+         "bytes"
+         "strings"
+         "net/http"
+         "crypto/md5"
+         "crypto/sha256"
+         "crypto/sha512"
+         "encoding/base64"
+         
+         "../problem"
+       )
+
+// The algorithms of Repr-Digest and Content-Digest (RFC 9530) that uploads may use.
+var digestAlgorithms = map[string]func() hash.Hash{
+  "sha-256": sha256.New,
+  "sha-512": sha512.New,
+}
+
+// A digest of an upload sent by the client, which is computed while the data is received.
+type uploadDigest struct {
+  // The header and algorithm, e.g. "Repr-Digest sha-256".
+  name string
+  want []byte
+  hash hash.Hash
+}
+
+/*
+  Returns the digests of the upload r from the headers Content-MD5 (RFC 1864),
+  Repr-Digest and Content-Digest (RFC 9530, e.g. "sha-256=:base64:").
+  Algorithms other than sha-256 and sha-512 are ignored. Returns an error if
+  a header is malformed.
+*/
+func uploadDigests(r *http.Request) ([]*uploadDigest, error) {
+  digests := []*uploadDigest{}
+  if md := r.Header.Get("Content-MD5"); md != "" {
+    want, err := base64.StdEncoding.DecodeString(strings.TrimSpace(md))
+    if err != nil || len(want) != md5.Size { return nil, fmt.Errorf("Malformed Content-MD5: %v", md) }
+    digests = append(digests, &uploadDigest{name:"Content-MD5", want:want, hash:md5.New()})
+  }
+  for _, header := range []string{"Repr-Digest", "Content-Digest"} {
+    for _, value := range r.Header.Values(header) {
+      for _, member := range strings.Split(value, ",") {
+        // Parameters of the member are not used by RFC 9530.
+        member = strings.TrimSpace(strings.SplitN(member, ";", 2)[0])
+        kv := strings.SplitN(member, "=", 2)
+        if len(kv) != 2 || len(kv[1]) < 2 || kv[1][0] != ':' || kv[1][len(kv[1])-1] != ':' {
+          return nil, fmt.Errorf("Malformed %v: %v", header, value)
+        }
+        algorithm := strings.ToLower(kv[0])
+        newHash, ok := digestAlgorithms[algorithm]
+        if !ok { continue }
+        want, err := base64.StdEncoding.DecodeString(kv[1][1:len(kv[1])-1])
+        if err != nil { return nil, fmt.Errorf("Malformed %v: %v", header, value) }
+        digests = append(digests, &uploadDigest{name:header + " " + algorithm, want:want, hash:newHash()})
+      }
+    }
+  }
+  return digests, nil
+}
+
+// Returns data wrapped so that reading it computes digests.
+func digestReader(data io.Reader, digests []*uploadDigest) io.Reader {
+  if len(digests) == 0 { return data }
+  hashes := []io.Writer{}
+  for _, d := range digests { hashes = append(hashes, d.hash) }
+  return io.TeeReader(data, io.MultiWriter(hashes...))
+}
+
+// Returns an error if the data read through digestReader() does not match one of digests.
+func verifyDigests(digests []*uploadDigest) error {
+  for _, d := range digests {
+    if got := d.hash.Sum(nil); !bytes.Equal(got, d.want) {
+      return fmt.Errorf("%v mismatch: The data has %v", d.name, base64.StdEncoding.EncodeToString(got))
+    }
+  }
+  return nil
+}
+
+/*
+  Stages the data of the upload r in dir like stageUpload() and verifies it
+  against the digests sent by the client (see uploadDigests()), so that
+  corrupted data never becomes visible. If the headers are malformed, the
+  data does not match or staging fails, sends the error response and
+  returns nil.
+*/
+func stageVerified(w http.ResponseWriter, r *http.Request, dir string, data io.Reader, size int64, mtime time.Time) *stagedUpload {
+  digests, err := uploadDigests(r)
+  if err != nil {
+    problem.Log(r, http.StatusBadRequest, problem.BadRequest, "%v", err)
+    problem.Write(w, r, http.StatusBadRequest, problem.BadRequest, err.Error())
+    return nil
+  }
+  u, err := stageUpload(dir, digestReader(data, digests), size, mtime)
+  if err != nil {
+    uploadFailed(w, r, err)
+    return nil
+  }
+  if err = verifyDigests(digests); err != nil {
+    u.discard()
+    problem.Log(r, http.StatusUnprocessableEntity, problem.DigestMismatch, "%v", err)
+    problem.Write(w, r, http.StatusUnprocessableEntity, problem.DigestMismatch, err.Error())
+    return nil
+  }
+  return u
+}
@@ -0,0 +1,237 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "fmt"
+         "hash"
+         "path"
+         "time"
+         "bytes"
+         "strconv"
+         "strings"
+         "net/http"
+         "hash/fnv"
+         "crypto/hmac"
+         "crypto/rand"
+         "crypto/sha256"
+         "encoding/binary"
+         "encoding/base64"
+         "html/template"
+         
+         "../status"
+         "../embedded"
+         "../problem"
+         "../accesslog"
+       )
+
+/*
+  The URL path to which the form for unlocking a directory protected with
+  the password directive is posted.
+*/
+const UnlockPath = "/.garcon/unlock"
+
+// How long a directory stays unlocked for a browser after entering the password.
+var UnlockLifetime = 24*time.Hour
+
+// The number of PBKDF2 iterations used by HashDirPassword().
+const dirPasswordIterations = 100000
+
+// Signs the unlock cookies. Generated at startup, so a restart locks all directories again.
+var unlockKey = func() []byte {
+  key := make([]byte, 32)
+  if _, err := rand.Read(key); err != nil { panic(err) }
+  return key
+}()
+
+var (
+  unlockOK = status.NewCounter(`garcon_dir_unlocks_total{result="ok"}`, "Attempts to unlock a password protected directory.")
+  unlockFailed = status.NewCounter(`garcon_dir_unlocks_total{result="failed"}`, "Attempts to unlock a password protected directory.")
+)
+
+/*
+  Returns the value for the password directive that protects a directory
+  with password, in the form pbkdf2-sha256$iterations$salt$hash.
+*/
+func HashDirPassword(password string) string {
+  salt := make([]byte, 16)
+  if _, err := rand.Read(salt); err != nil { panic(err) }
+  key := pbkdf2(sha256.New, []byte(password), salt, dirPasswordIterations, sha256.Size)
+  return fmt.Sprintf("pbkdf2-sha256$%v$%v$%v", dirPasswordIterations, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// Splits the value of a password directive into its parts.
+func parseDirPassword(hashed string) (iterations int, salt []byte, key []byte, err error) {
+  parts := strings.Split(hashed, "$")
+  if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+    return 0, nil, nil, fmt.Errorf("password must be pbkdf2-sha256$iterations$salt$hash (see --password-hash)")
+  }
+  iterations, err = strconv.Atoi(parts[1])
+  if err == nil && (iterations < 1 || iterations > 10000000) { err = fmt.Errorf("Illegal number of iterations: %v", parts[1]) }
+  if err == nil { salt, err = base64.RawStdEncoding.DecodeString(parts[2]) }
+  if err == nil { key, err = base64.RawStdEncoding.DecodeString(parts[3]) }
+  return iterations, salt, key, err
+}
+
+// Returns true if password matches the value of a password directive.
+func checkDirPassword(hashed, password string) bool {
+  iterations, salt, key, err := parseDirPassword(hashed)
+  if err != nil || len(key) == 0 { return false }
+  return hmac.Equal(key, pbkdf2(sha256.New, []byte(password), salt, iterations, len(key)))
+}
+
+// PBKDF2 (RFC 8018) with the HMAC of h as pseudorandom function.
+func pbkdf2(h func() hash.Hash, password, salt []byte, iterations, keylen int) []byte {
+  prf := hmac.New(h, password)
+  size := prf.Size()
+  var dk []byte
+  u := make([]byte, size)
+  var index [4]byte
+  for block := uint32(1); len(dk) < keylen; block++ {
+    prf.Reset()
+    prf.Write(salt)
+    binary.BigEndian.PutUint32(index[:], block)
+    prf.Write(index[:])
+    dk = prf.Sum(dk)
+    t := dk[len(dk)-size:]
+    copy(u, t)
+    for n := 1; n < iterations; n++ {
+      prf.Reset()
+      prf.Write(u)
+      u = prf.Sum(u[:0])
+      for i := range u { t[i] ^= u[i] }
+    }
+  }
+  return dk[:keylen]
+}
+
+/*
+  Returns the URL path of the outermost password protected directory that
+  contains the URL path clean and that r has not unlocked, and the value of
+  its password directive, or "" and "" if r may access clean. The password
+  of every protected directory on the way is required, so that a directive
+  in a subdirectory can not replace the password of its parent. r may be
+  nil, in which case no directory is unlocked.
+*/
+func (fm *FileManager) lockedDir(r *http.Request, clean string) (dir string, hashed string) {
+  passwords := fm.current().indexes.passwords
+  for d := clean; ; d = path.Dir(d) {
+    if h := passwords[d]; h != "" && (r == nil || !unlocked(r, d, h)) { dir, hashed = d, h }
+    if d == "/" || d == "." { return dir, hashed }
+  }
+}
+
+// Returns the name of the cookie that unlocks the directory dir.
+func unlockCookie(dir string) string {
+  h := fnv.New32a()
+  h.Write([]byte(dir))
+  return fmt.Sprintf("garcon_unlock_%08x", h.Sum32())
+}
+
+// Returns the signature of the unlock cookie for dir with password directive hashed, valid until expires.
+func unlockSignature(dir, hashed string, expires int64) string {
+  mac := hmac.New(sha256.New, unlockKey)
+  fmt.Fprintf(mac, "%v\x00%v\x00%v", dir, hashed, expires)
+  return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Returns true if r carries a valid unlock cookie for dir with password directive hashed.
+func unlocked(r *http.Request, dir, hashed string) bool {
+  c, err := r.Cookie(unlockCookie(dir))
+  if err != nil { return false }
+  parts := strings.SplitN(c.Value, ".", 2)
+  if len(parts) != 2 { return false }
+  expires, err := strconv.ParseInt(parts[0], 10, 64)
+  if err != nil || time.Now().Unix() >= expires { return false }
+  return hmac.Equal([]byte(parts[1]), []byte(unlockSignature(dir, hashed, expires)))
+}
+
+/*
+  Answers r if it is for UnlockPath or for a password protected directory
+  that r has not unlocked and returns true in that case. Responses from
+  unlocked directories are marked private, so that shared caches do not
+  keep them.
+*/
+func (fm *FileManager) serveLocked(w http.ResponseWriter, r *http.Request) bool {
+  if r.URL.Path == UnlockPath {
+    fm.serveUnlock(w, r)
+    return true
+  }
+  if len(fm.current().indexes.passwords) == 0 { return false }
+  clean := path.Clean("/" + r.URL.Path)
+  dir, _ := fm.lockedDir(r, clean)
+  if dir == "" {
+    if protected, _ := fm.lockedDir(nil, clean); protected != "" { w.Header().Set("Cache-Control", "private") }
+    return false
+  }
+  accesslog.Log(r, 1, "%v %v %v (password of %v required)", http.StatusUnauthorized, r.Method, r.URL.Path, dir)
+  sendUnlockForm(w, r, dir, r.URL.RequestURI(), "")
+  return true
+}
+
+// Sends the form for entering the password of dir with status 401.
+func sendUnlockForm(w http.ResponseWriter, r *http.Request, dir, next, message string) {
+  var buf bytes.Buffer
+  fmt.Fprintf(&buf, "<h1>%v</h1>\n", template.HTMLEscapeString(dir))
+  if message != "" { fmt.Fprintf(&buf, "<p class=\"error\">%v</p>\n", template.HTMLEscapeString(message)) }
+  fmt.Fprintf(&buf, "<form method=\"post\" action=\"%v\">\n", UnlockPath)
+  fmt.Fprintf(&buf, "<input type=\"hidden\" name=\"dir\" value=\"%v\" />\n", template.HTMLEscapeString(dir))
+  fmt.Fprintf(&buf, "<input type=\"hidden\" name=\"next\" value=\"%v\" />\n", template.HTMLEscapeString(next))
+  fmt.Fprintf(&buf, "<label>Password<input type=\"password\" name=\"password\" autofocus=\"autofocus\" /></label>\n")
+  fmt.Fprintf(&buf, "<button type=\"submit\">Unlock</button>\n</form>")
+  page := fillPage(embedded.UnlockPage, dir, dir, buf.Bytes())
+  w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+  w.Header().Set("Cache-Control", "no-store")
+  w.WriteHeader(http.StatusUnauthorized)
+  if r.Method != "HEAD" { w.Write(page) }
+}
+
+/*
+  Checks the password posted by the unlock form and, if it is right, sets
+  the cookie that unlocks the directory and redirects back to the page
+  that asked for it.
+*/
+func (fm *FileManager) serveUnlock(w http.ResponseWriter, r *http.Request) {
+  if r.Method != "POST" {
+    w.Header().Set("Allow", "POST")
+    problem.Log(r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "")
+    problem.Write(w, r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "")
+    return
+  }
+  r.Body = http.MaxBytesReader(w, r.Body, 64*1024)
+  dir := path.Clean("/" + r.PostFormValue("dir"))
+  next := r.PostFormValue("next")
+  // Only redirect to pages within dir, never to another host.
+  if !strings.HasPrefix(next, strings.TrimSuffix(dir, "/") + "/") && next != dir || strings.HasPrefix(next, "//") || strings.Contains(next, "\\") { next = dir }
+  hashed := fm.current().indexes.passwords[dir]
+  if hashed == "" {
+    problem.Log(r, http.StatusBadRequest, problem.BadRequest, "%v is not protected", dir)
+    problem.Write(w, r, http.StatusBadRequest, problem.BadRequest, "Not a protected directory")
+    return
+  }
+  if !checkDirPassword(hashed, r.PostFormValue("password")) {
+    unlockFailed.Inc()
+    accesslog.Log(r, 0, "%v %v %v (wrong password for %v)", http.StatusUnauthorized, r.Method, r.URL.Path, dir)
+    // Slows down guessing.
+    time.Sleep(time.Second)
+    sendUnlockForm(w, r, dir, next, "Wrong password")
+    return
+  }
+  unlockOK.Inc()
+  expires := time.Now().Add(UnlockLifetime).Unix()
+  http.SetCookie(w, &http.Cookie{Name:unlockCookie(dir), Value:fmt.Sprintf("%v.%v", expires, unlockSignature(dir, hashed, expires)), Path:dir, MaxAge:int(UnlockLifetime/time.Second), HttpOnly:true, Secure:r.TLS != nil, SameSite:http.SameSiteLaxMode})
+  accesslog.Log(r, 1, "%v %v %v (unlocked %v)", http.StatusSeeOther, r.Method, r.URL.Path, dir)
+  http.Redirect(w, r, next, http.StatusSeeOther)
+}
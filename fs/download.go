@@ -0,0 +1,164 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "context"
+         "io"
+         "fmt"
+         "path"
+         "bytes"
+         "regexp"
+         "strings"
+         "net/url"
+         "net/http"
+         "crypto/sha256"
+         "html/template"
+         
+         "../http2"
+         "../embedded"
+         "../accesslog"
+       )
+
+// Extensions of detached signatures and checksum files that are linked
+// from a download page if they exist next to the file.
+var signatureExtensions = []string{".asc", ".sig", ".gpg", ".sha256", ".sha256sum", ".sha512"}
+
+/*
+  Requests for files whose path (starting with "/") matches pattern are
+  answered with an HTML landing page that shows the file's size and SHA-256
+  checksum, links to detached signatures (e.g. file.asc) next to it and
+  the file's URL on each mirror (see AddMirror()). The file itself is
+  available by appending "?raw=1" to the URL; Range requests are supported
+  for resuming interrupted downloads.
+  Call before ServeHTTP() is called for the first time.
+*/
+func (fm *FileManager) SetDownloadPages(pattern *regexp.Regexp) {
+  fm.download_pages = pattern
+}
+
+/*
+  Adds a mirror to be listed on download pages (see SetDownloadPages()).
+  The URL of a file on the mirror is base followed by the file's path.
+  Call before ServeHTTP() is called for the first time.
+*/
+func (fm *FileManager) AddMirror(base string) {
+  fm.mirrors = append(fm.mirrors, strings.TrimSuffix(base, "/"))
+}
+
+// Returns true if the request r for the file with path clean is to be
+// answered with a download page.
+func (fm *FileManager) wantsDownloadPage(r *http.Request, clean string) bool {
+  return fm.download_pages != nil && fm.download_pages.MatchString(clean) && r.URL.Query().Get("raw") != "1"
+}
+
+/*
+  Returns the hex-encoded SHA-256 of x's (decoded) contents. Checksums are
+  remembered by Id because computing them for large files is expensive.
+*/
+func (fm *FileManager) checksum(x *File) (string, error) {
+  fm.summutex.Lock()
+  sum, ok := fm.checksums[x.Id]
+  fm.summutex.Unlock()
+  if ok { return sum, nil }
+  
+  f, _, err := fm.open(context.Background(), x, false)
+  if err != nil { return "", err }
+  defer f.Close()
+  hash := sha256.New()
+  _, err = io.Copy(hash, f)
+  if err != nil { return "", err }
+  sum = fmt.Sprintf("%x", hash.Sum(nil))
+  
+  fm.summutex.Lock()
+  if fm.checksums == nil { fm.checksums = map[uint64]string{} }
+  fm.checksums[x.Id] = sum
+  fm.summutex.Unlock()
+  return sum, nil
+}
+
+// Forgets the checksums of files whose Id is not in ids.
+func (fm *FileManager) retainChecksums(ids map[uint64]bool) {
+  fm.summutex.Lock()
+  defer fm.summutex.Unlock()
+  for id := range fm.checksums {
+    if !ids[id] { delete(fm.checksums, id) }
+  }
+}
+
+// Answers r with the download page for x (whose path is clean).
+func (fm *FileManager) serveDownloadPage(w http.ResponseWriter, r *http.Request, x *File, clean string) {
+  sum, err := fm.checksum(x)
+  if err != nil {
+    fm.readFailed(w, r, "Checksum " + clean, err)
+    return
+  }
+  
+  name := path.Base(clean)
+  link := func(p string) string {
+    return template.HTMLEscapeString((&url.URL{Path:p}).String())
+  }
+  
+  var buf bytes.Buffer
+  fmt.Fprintf(&buf, "<h1>%v</h1>\n<table class=\"download\">\n", template.HTMLEscapeString(name))
+  fmt.Fprintf(&buf, "<tr><th>Size</th><td>%v</td></tr>\n", formatSize(x.Info.Size(), SIZE_HUMAN))
+  fmt.Fprintf(&buf, "<tr><th>Last modified</th><td>%v</td></tr>\n", x.Info.ModTime().UTC().Format("2006-01-02 15:04:05 MST"))
+  fmt.Fprintf(&buf, "<tr><th>SHA-256</th><td><code>%v</code></td></tr>\n", sum)
+  
+  var sigs []string
+  for _, ext := range signatureExtensions {
+    if _, _, ok := fm.lookup(clean + ext); ok {
+      sigs = append(sigs, fmt.Sprintf(`<a href="%v">%v</a>`, link(name + ext), template.HTMLEscapeString(name + ext)))
+    }
+  }
+  if len(sigs) > 0 {
+    fmt.Fprintf(&buf, "<tr><th>Signatures</th><td>%v</td></tr>\n", strings.Join(sigs, "<br />"))
+  }
+  
+  if results := readValidations(x); len(results) > 0 {
+    var checks []string
+    for _, res := range results {
+      status := `<span class="passed">passed</span>`
+      if !res.Passed { status = `<span class="failed">failed</span>` }
+      check := fmt.Sprintf("<code>%v</code>: %v (%v)", template.HTMLEscapeString(res.Command), status, res.Time.UTC().Format("2006-01-02 15:04:05 MST"))
+      if res.Output != "" { check += fmt.Sprintf("<pre>%v</pre>", template.HTMLEscapeString(res.Output)) }
+      checks = append(checks, check)
+    }
+    fmt.Fprintf(&buf, "<tr><th>Checks</th><td>%v</td></tr>\n", strings.Join(checks, "<br />"))
+  }
+  
+  if len(fm.mirrors) > 0 {
+    var mirrors []string
+    for _, base := range fm.mirrors {
+      u := base + (&url.URL{Path:clean}).String()
+      mirrors = append(mirrors, fmt.Sprintf(`<a href="%v">%v</a>`, template.HTMLEscapeString(u), template.HTMLEscapeString(u)))
+    }
+    fmt.Fprintf(&buf, "<tr><th>Mirrors</th><td>%v</td></tr>\n", strings.Join(mirrors, "<br />"))
+  }
+  fmt.Fprintf(&buf, "</table>\n")
+  
+  download := (&url.URL{Path:name, RawQuery:"raw=1"}).String()
+  fmt.Fprintf(&buf, "<a class=\"download\" href=\"%v\">Download</a>\n", template.HTMLEscapeString(download))
+  fmt.Fprintf(&buf, "<p>Interrupted downloads can be resumed (e.g. <code>wget -c</code> or <code>curl -C -</code>).\n")
+  fmt.Fprintf(&buf, "Verify the download with <code>sha256sum %v</code>.</p>\n", template.HTMLEscapeString(name))
+  
+  page := fillPage(embedded.DownloadPage, name, clean, buf.Bytes())
+  
+  etag := fmt.Sprintf("%v-dl", x.Id)
+  w.Header().Set("ETag", etag)
+  w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+  accesslog.Log(r, 0, "%v %v %v (ETag: %v, Content-Type: text/html; charset=UTF-8)", http.StatusOK, r.Method, r.URL.Path, etag)
+  http2.ServeContent(w, r, lastModified(r, x), int64(len(page)), bytes.NewReader(page))
+}
@@ -18,13 +18,36 @@ package fs
 import (
          "io"
          "os"
+         "sync"
          "time"
+         "fmt"
          "bytes"
          "regexp"
+         "sync/atomic"
          "compress/gzip"
+         "compress/bzip2"
          "github.com/mbenkmann/golib/util"
+         
+         "../linux"
+         "../xz"
+         "../zstd"
 )
 
+/*
+  Files on disk whose size is at least FadviseThreshold bytes are opened with
+  POSIX_FADV_SEQUENTIAL and their pages are dropped from the page cache with
+  POSIX_FADV_DONTNEED when the last stream of the file is closed. This prevents
+  a single large download (e.g. an ISO image) from evicting everything else
+  from the page cache. 0 disables the hints.
+*/
+var FadviseThreshold int64 = 256*1024*1024
+
+/*
+  If true and the binary has been built with "-tags iouring", files on disk
+  are read via io_uring (EXPERIMENTAL). See IOUringSupported.
+*/
+var UseIOUring = false
+
 
 
 
@@ -41,6 +64,60 @@ type Handling struct {
   // registered as an alias for the file that will be delivered with
   // Content-Encoding: gzip. Has no effect on directories.
   Gzip string
+  
+  // Like Gzip, but for files compressed with bzip2.
+  Bzip2 string
+  
+  // Like Gzip, but for files compressed with xz.
+  Xz string
+  
+  // If not "", files matching this rule share the download limits of the
+  // named rate class. See FileManager.SetRateClass().
+  // Unlike the other fields, RateClass is taken from the first matching rule
+  // that sets it, so rules that only assign a rate class can be put in front
+  // of the other rules without overriding them.
+  RateClass string
+}
+
+// Returns a map of the encodings ("gzip", "bzip2", "xz") for which h defines
+// an alias to the respective replacement patterns.
+func (h *Handling) aliases() map[string]string {
+  aliases := map[string]string{}
+  if h.Gzip != "" { aliases["gzip"] = h.Gzip }
+  if h.Bzip2 != "" { aliases["bzip2"] = h.Bzip2 }
+  if h.Xz != "" { aliases["xz"] = h.Xz }
+  return aliases
+}
+
+// Policies for resolving conflicts between a real file and an alias with the same name.
+const (
+  // The real file is served. The alias is ignored.
+  PREFER_FILE = iota
+  // The alias is served. The real file is not accessible.
+  PREFER_ALIAS
+  // Neither the real file nor the alias is served and an error is logged.
+  CONFLICT_ERROR
+  // Whichever of the two has the more recent mtime is served.
+  MTIME_NEWEST_WINS
+)
+
+// How to resolve conflicts between real files and aliases. See PREFER_FILE,...
+var AliasConflictPolicy = PREFER_FILE
+
+// If aliases with different encodings have the same name, the one
+// with the lowest number here wins.
+var encodingPreference = map[string]int{"gzip":0, "xz":1, "bzip2":2}
+
+// A conflict between a real file and an alias detected during a scan.
+type AliasConflict struct {
+  // The path (relative to the server root) of the real file and the alias.
+  Path string
+  
+  // The name of the compressed file the alias was derived from.
+  Original string
+  
+  // Describes how the conflict was resolved.
+  Resolution string
 }
 
 /*
@@ -54,6 +131,11 @@ type FileInfo struct {
   isDir bool        // abbreviation for Mode().IsDir()
 }
 
+// Returns a FileInfo for an in-memory file. Directories are not supported.
+func NewFileInfo(name string, size int64, mode os.FileMode, modTime time.Time) *FileInfo {
+  return &FileInfo{name, size, mode, modTime, false}
+}
+
 func (f *FileInfo) Name() string {
   return f.name
 }
@@ -85,17 +167,34 @@ type File struct {
   Id uint64
   
   // If Info.IsDir() this is a map of the contents of the directory.
-  // May include aliases generated through Handling.gzip.
+  // May include aliases generated through Handling.Gzip, Handling.Bzip2
+  // and Handling.Xz.
   Contents map[string]*File
   
-  // true iff this is an alias for a gzipped file that is to be served
-  // with Content-Encoding: gzip.
-  Gzip bool
+  // If not "", this is an alias for a compressed file that is to be served
+  // with Content-Encoding: Encoding to clients that accept it and decompressed
+  // on the fly for other clients. One of "gzip", "bzip2" and "xz".
+  Encoding string
+  
+  // The rate class from the Handling that applies to this file. "" means
+  // DefaultRateClass.
+  RateClass string
+  
+  // True if the file occupies fewer disk blocks than its size requires,
+  // i.e. it has holes (or is compressed by the filesystem). Info.Size()
+  // is the logical size. See CacheSparseFiles.
+  Sparse bool
+  
+  // Only for generated index pages: Data compressed with gzip once when the
+  // page is generated, for clients that accept Content-Encoding: gzip.
+  // nil if compression does not pay off.
+  Gzipped []byte
   
   // The meaning depends on the data type:
   //   string: The path of the filesystem directory containing the file.
   //           By appending "/" + Info.Name(), you get the path for os.Open().
   //   []byte: The raw data of this file.
+  //   *os.File: The file as it was when a suite snapshot was taken. See snapshot.go.
   Data interface{}
 }
 
@@ -105,6 +204,8 @@ func (f *File) String() string {
       return data+"/"+f.Info.Name()
     case []byte:
       return "(in-memory)"+f.Info.Name()
+    case *os.File:
+      return data.Name()
     default: return "???"
   }
 }
@@ -112,43 +213,147 @@ func (f *File) String() string {
 /*
   Returns the File's data.
   
-  keep_gzipped: if true and the file is gzipped, return it as is.
-                if false and the file is gzipped, return the decompressed data.
-                if the file is not gzipped, no effect.
+  keep_encoded: if true and the file has an Encoding, return it as is.
+                if false and the file has an Encoding, return the decompressed data.
+                if the file has no Encoding, no effect.
   
   Returns:
     stream: the data, this may or may not implement io.Seeker
-    is_gzipped: true if stream is gzipped. if keep_gzipped is false, this is always false.
+    is_encoded: true if stream is compressed with f.Encoding.
+                if keep_encoded is false, this is always false.
     err: if an error has occurred
   
   NOTE: If err!=nil, the caller must call stream.Close() when done.
 */
-func (f *File) GetStream(keep_gzipped bool) (stream io.ReadCloser, is_gzipped bool, err error) {
+func (f *File) GetStream(keep_encoded bool) (stream io.ReadCloser, is_encoded bool, err error) {
   switch data := f.Data.(type) {
     case string:
-      stream, err = os.Open(data+"/"+f.Info.Name())
+      var file *os.File
+      file, err = os.Open(data+"/"+f.Info.Name())
       if err != nil { return }
+      stream = file
+      if FadviseThreshold > 0 && f.Info.Size() >= FadviseThreshold {
+        err2 := linux.Fadvise(file.Fd(), 0, 0, linux.FADV_SEQUENTIAL)
+        if err2 != nil {
+          util.Log(1, "WARNING! %v: %v", f, err2)
+        }
+        stream = newFadvisedFile(file)
+      }
+      if u := uringWrap(file, stream); u != nil {
+        stream = u
+      }
       
     case []byte:
       stream = &BytesReadCloser{*bytes.NewReader(data)}
     
+    case *os.File:
+      stream = &pinnedReader{*io.NewSectionReader(data, 0, f.Info.Size())}
+    
     default: panic("Unexpected Data type")
   }
 
-  is_gzipped = f.Gzip
-  if keep_gzipped || !is_gzipped { return }
-  // If we get here, keep_gzipped == false, but is_gzipped == true, so we need a wrapper
-  is_gzipped = false
-  stream, err = NewGunzipper(stream)
+  return f.wrapStream(stream, keep_encoded)
+}
+
+/*
+  Takes a stream of f's raw data and wraps it as necessary to honor
+  keep_encoded as described for GetStream().
+*/
+func (f *File) wrapStream(raw io.ReadCloser, keep_encoded bool) (stream io.ReadCloser, is_encoded bool, err error) {
+  stream = raw
+  is_encoded = (f.Encoding != "")
+  if keep_encoded || !is_encoded { return }
+  // If we get here, keep_encoded == false, but is_encoded == true, so we need a wrapper
+  is_encoded = false
+  stream, err = NewDecompressor(f.Encoding, stream)
+  if err != nil { raw.Close() }
   return
 }
 
+// Wraps an *os.File opened with POSIX_FADV_SEQUENTIAL so that its pages
+// are dropped from the page cache on Close().
+type fadvisedFile struct {
+  *os.File
+  // Set by Close(), so that closing twice does not count twice.
+  closed bool
+}
+
+// The number of open fadvisedFiles per path. Protected by fadvisedMutex.
+var fadvisedOpen = map[string]int{}
+var fadvisedMutex sync.Mutex
+
+func newFadvisedFile(file *os.File) *fadvisedFile {
+  fadvisedMutex.Lock()
+  fadvisedOpen[file.Name()]++
+  fadvisedMutex.Unlock()
+  return &fadvisedFile{File:file}
+}
+
+/*
+  Drops the pages of the file from the page cache unless other streams
+  of the same file are still open, so that concurrent downloads of a large
+  file do not have to read it from disk again.
+*/
+func (f *fadvisedFile) Close() error {
+  if f.closed { return f.File.Close() }
+  f.closed = true
+  fadvisedMutex.Lock()
+  fadvisedOpen[f.Name()]--
+  last := fadvisedOpen[f.Name()] <= 0
+  if last { delete(fadvisedOpen, f.Name()) }
+  fadvisedMutex.Unlock()
+  if last {
+    err := linux.Fadvise(f.Fd(), 0, 0, linux.FADV_DONTNEED)
+    if err != nil {
+      util.Log(1, "WARNING! %v: %v", f.Name(), err)
+    }
+  }
+  return f.File.Close()
+}
+
 type BytesReadCloser struct {
   bytes.Reader
 }
 
 func (*BytesReadCloser) Close() error {return nil}
 
+/*
+  Takes a stream compressed with encoding ("gzip", "bzip2", "xz" or "zstd") and returns
+  a ReadCloser from which you can read the decompressed data. Like the stream
+  returned by NewGunzipper() this closes the original stream when Close()
+  is called on the decompressor.
+*/
+func NewDecompressor(encoding string, compressed io.Reader) (io.ReadCloser, error) {
+  switch encoding {
+    case "gzip":  return NewGunzipper(compressed)
+    case "bzip2": return &decompressor{bzip2.NewReader(compressed), compressed}, nil
+    case "xz":    x, err := xz.NewReader(compressed)
+                  if err != nil { return nil, err }
+                  return &decompressor{x, compressed}, nil
+    case "zstd":  z, err := zstd.NewReader(compressed)
+                  if err != nil { return nil, err }
+                  return &decompressor{z, compressed}, nil
+  }
+  return nil, fmt.Errorf("Unsupported encoding: %v", encoding)
+}
+
+// Reads decompressed data from decomp. Close() closes orig.
+type decompressor struct {
+  decomp io.Reader
+  orig io.Reader
+}
+
+func (d *decompressor) Read(p []byte) (n int, err error) {
+  return d.decomp.Read(p)
+}
+
+func (d *decompressor) Close() error {
+  if closer, can_be_closed := d.orig.(io.Closer); can_be_closed {
+    return closer.Close()
+  }
+  return nil
+}
+
 /*
   Takes a gzipped stream and returns a ReadCloser from which you can
   read the ungzipped data. Unlike the stream returned by gzip.NewReader()
@@ -183,13 +388,26 @@ func (gunz *Gunzipper) Close() error {
 
 
 /*
-  The <<10 for the init value of the counter makes sure that
-  numbers do not repeat even if the server is restarted. Even if a
+  The last number handed out by nextId(). The <<10 for the init value makes
+  sure that numbers do not repeat even if the server is restarted. Even if a
   repeat happened it would only be a problem if a number were repeated
   for a file that has changed and that has used the repeated number
   earlier and some browser still has it stored as ETag.
 */
-var nextid = util.Counter(uint64(time.Now().Unix()) << 10)
+var lastid = uint64(time.Now().Unix()) << 10
+
+// Returns a new unique number, e.g. for File.Id.
+func nextId() uint64 {
+  return atomic.AddUint64(&lastid, 1)
+}
+
+// Makes nextId() return only numbers greater than id from now on.
+func raiseIds(id uint64) {
+  for {
+    last := atomic.LoadUint64(&lastid)
+    if last >= id || atomic.CompareAndSwapUint64(&lastid, last, id) { return }
+  }
+}
 
 
 var empty = map[string]*File{}
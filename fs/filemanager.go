@@ -19,21 +19,33 @@ import (
          "io"
          "os"
          "fmt"
+         "bytes"
+         "context"
          "net/http"
          "path"
+         "sort"
+         "path/filepath"
          "sync"
+         "sync/atomic"
          "time"
+         "regexp"
+         "strconv"
          "strings"
          "syscall"
          "github.com/mbenkmann/golib/util"
          
+         "../rpm"
+         "../arch"
          "../linux"
          "../http2"
+         "../tracing"
+         "../problem"
+         "../accesslog"
 )
 
 /*
   Creates and returns a new FileManager. Does not return until the directory tree has been
-  scanned. From then on the directory tree will remain fixed unless you call AutoUpdate().
+  scanned (or loaded from StateFile). From then on the directory tree will remain fixed unless you call AutoUpdate().
   
     rootdir: The path of the root of the directory tree
     handling: Special rules for handling certain files
@@ -43,13 +55,37 @@ func NewFileManager(rootdir string, handling []Handling) (*FileManager, error) {
     Info: &FileInfo{"",0,os.ModeDir|0777,time.Now(),true},
     Id:0,
     Contents:map[string]*File{},
-    Gzip:false,
+    Encoding:"",
     Data:rootdir,
   }
-  fm := &FileManager{root:root, inotify:-1, handling:handling}
-  err := fm.scan(rootdir, map[string]*File{}, root.Contents)
-  if err != nil { return nil, err }
-  AddIndexes(root.Contents, "Home")
+  fm := &FileManager{rootdir:rootdir, scanroot:rootdir, inotify:-1, handling:handling, publishing:make(chan *publishRequest, 1), debounce:5*time.Second, retry:30*time.Second, watchStats:newWatchStats(rootdir), readonly:ReadOnlyImage, wake:make(chan bool, 1)}
+  var tree map[string]*File
+  var err error
+  if StateFile != "" {
+    tree, err = fm.loadState()
+    if err != nil {
+      util.Log(0, "ERROR! Loading %v: %v => Scanning", StateFile, err)
+      tree = nil
+    }
+  }
+  if tree != nil {
+    // Without inotify watches, AutoUpdate() starts with a rescan that
+    // checks the loaded tree against the filesystem.
+    root.Contents = tree
+  } else {
+    err = fm.scan(rootdir, map[string]*File{}, root.Contents)
+    if err != nil { return nil, err }
+  }
+  state := &treeState{root:root, conflicts:fm.newconflicts, skew:fm.newskew}
+  fm.newconflicts = nil
+  fm.newskew = clockSkew{}
+  fm.snapshotSuites(root.Contents)
+  state.indexes = addIndexes(root.Contents, "Home", nil)
+  fm.enforceMemoryBudget(root.Contents, state.indexes)
+  fm.state.Store(state)
+  fm.refreshed = time.Now().UnixNano()
+  fm.rootdev = deviceOf(rootdir)
+  if fm.readonly { fm.startReadOnlyImage() }
   return fm, nil
 }
 
@@ -60,15 +96,73 @@ func NewFileManager(rootdir string, handling []Handling) (*FileManager, error) {
 func (fm *FileManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
   var err error
   
+  if strings.HasPrefix(r.URL.Path, AssetsPath) {
+    serveAsset(w, r)
+    return
+  }
+  
+  if fm.serveLocked(w, r) { return }
+  
   switch r.Method {
     case "", "GET", "HEAD": // OK, we support these
-    default: w.Header().Set("Allow", "GET, HEAD")
-             util.Log(1, "%v %v %v", http.StatusMethodNotAllowed, r.Method, r.URL.Path)
-             http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+                            if fm.uploadsEnabled() && isMultipart(r) {
+                              fm.serveMultipart(w, r)
+                              return
+                            }
+    case "PUT": if fm.uploadsEnabled() {
+                  release, ok := fm.limitUpload(w, r)
+                  if !ok { return }
+                  defer release()
+                  q := r.URL.Query()
+                  if isMultipart(r) {
+                    fm.serveMultipart(w, r)
+                  } else if _, ok := q["mkdir"]; ok {
+                    fm.serveMkdir(w, r)
+                  } else if _, ok := q["unpack"]; ok {
+                    fm.serveUnpack(w, r)
+                  } else {
+                    fm.serveUpload(w, r)
+                  }
+                  return
+                }
+                fallthrough
+    case "MKCOL": if fm.uploadsEnabled() {
+                    release, ok := fm.limitUpload(w, r)
+                    if !ok { return }
+                    defer release()
+                    fm.serveMkdir(w, r)
+                    return
+                  }
+                  fallthrough
+    case "POST", "DELETE": if fm.uploadsEnabled() && isMultipart(r) {
+                             release, ok := fm.limitUpload(w, r)
+                             if !ok { return }
+                             defer release()
+                             fm.serveMultipart(w, r)
+                             return
+                           }
+                           fallthrough
+    default: allow := "GET, HEAD"
+             if fm.uploadsEnabled() { allow += ", PUT, MKCOL" }
+             w.Header().Set("Allow", allow)
+             problem.Log(r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "")
+             problem.Write(w, r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "")
              return
   }
 
+  if fm.oci_prefix != "" && (r.URL.Path == "/v2" || strings.HasPrefix(r.URL.Path, registryPath)) {
+    fm.serveRegistry(w, r)
+    return
+  }
+  
+  if fm.serveRedirect(w, r) { return }
+  
   clean := path.Clean(r.URL.Path)
+  
+  if p := fm.proxyFor(clean); p != nil {
+    if !fm.refreshProxied(w, r, p) { return }
+  }
+  
   // remove trailing slash
   if clean != "" && clean[len(clean)-1] == '/' { clean = clean[0:len(clean)-1] }
   // turn "", "." and "/" into "/index.html"
@@ -78,72 +172,177 @@ func (fm *FileManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
     util.Log(2, "Rewrite %v => %v", r.URL.Path, clean)
   }
   
-  what := strings.Split(clean,"/")
+  // Parsing the query allocates, and most requests have none.
+  if r.URL.RawQuery != "" {
+    if _, ok := r.URL.Query()["diff"]; ok && fm.serveSuiteDiff(w, r, clean) { return }
+  }
   
-  var x *File
-  ok := false
-  fm.mutex.RLock()
-  {
-    dir := fm.root.Contents
-    for _, name := range what {
-      if name == "" { continue }
-      if x, ok = dir[name]; !ok {
-        break
-      }
-      if x.Info.IsDir() {
-        dir = x.Contents
-      } else {
-        dir = empty
+  _, span := tracing.Start(r.Context(), "lookup")
+  requested := clean
+  x, clean, ok := fm.lookup(clean)
+  if span.Recording() {
+    span.SetAttr("garcon.path", clean)
+    span.SetAttr("garcon.found", ok)
+  }
+  span.End()
+  
+  if !ok {
+    for _, prefix := range fm.fallbacks {
+      if clean == prefix || strings.HasPrefix(clean, prefix + "/") {
+        if x, _, ok = fm.lookup(prefix + "/index.html"); ok {
+          util.Log(2, "Fallback %v => %v", r.URL.Path, prefix + "/index.html")
+          clean = prefix + "/index.html"
+          break
+        }
       }
     }
-    
-    if ok && x.Info.IsDir() {
-      util.Log(2, "Rewrite %v => %v", r.URL.Path, clean + "/index.html")
-      x, ok = dir["index.html"]
-    }
   }
-  fm.mutex.RUnlock()
   
   if !ok || x.Info.IsDir() {
-    util.Log(1, "%v %v %v", http.StatusNotFound, r.Method, r.URL.Path)
-    http.NotFound(w,r)
+    problem.Log(r, http.StatusNotFound, problem.NotFound, "")
+    problem.Write(w, r, http.StatusNotFound, problem.NotFound, "")
     return
   }
   
-  understands_gzip := false
-  for _, aes := range r.Header["Accept-Encoding"] {
-    for _, ae := range strings.Split(aes, ",") {
-      ae = strings.TrimSpace(ae)
-      understands_gzip = understands_gzip || (ae == "gzip")
-    }
+  // The fallback may lead to a path the access policy has not checked.
+  // The index.html of a requested directory is checked like the directory.
+  checked := clean
+  if clean == path.Join(requested, "index.html") { checked = requested }
+  if !fm.mayRead(r, checked) {
+    problem.Log(r, http.StatusNotFound, problem.NotFound, "%v not readable", checked)
+    problem.Write(w, r, http.StatusNotFound, problem.NotFound, "")
+    return
   }
-
-  var serve_content io.Reader
+  // Shared caches must not pass on what not everyone may read.
+  if Authorize != nil && !Authorize(nil, checked) { w.Header().Set("Cache-Control", "private") }
   
-  gzipped := false
+  x, group := fm.localize(x, w, r)
+  
+  if fm.markdown && strings.HasSuffix(clean, ".md") && r.URL.Query().Get("raw") != "1" && r.URL.Query().Get("view") != "source" {
+    fm.serveRendered(w, r, x, clean, "md", renderMarkdownPage)
+    return
+  }
+  
+  if fm.wantsDownloadPage(r, clean) {
+    fm.serveDownloadPage(w, r, x, clean)
+    return
+  }
+  
+  if fm.wantsSource(r, clean) {
+    fm.serveRendered(w, r, x, clean, "src", renderSourcePage)
+    return
+  }
   
-  if serve_content == nil {
-    var f io.ReadCloser
-    f, gzipped, err = x.GetStream(understands_gzip)
+  understands_encoding := x.Encoding != "" && acceptsEncoding(r, x.Encoding)
+  
+  // The response depends on Accept-Encoding and each variant needs its own ETag.
+  gzipped := false
+  if x.Gzipped != nil {
+    w.Header().Add("Vary", "Accept-Encoding")
+    gzipped = acceptsEncoding(r, "gzip")
+  }
+
+  bucket := fm.rateBucket(x)
+  if bucket != nil {
+    if !bucket.acquire() {
+      problem.Log(r, http.StatusServiceUnavailable, problem.Overloaded, "rate class %v: too many downloads", bucket.name)
+      w.Header().Set("Retry-After", "30")
+      problem.Write(w, r, http.StatusServiceUnavailable, problem.Overloaded, "Too many downloads. Try again later")
+      return
+    }
+    defer bucket.release()
+  }
+
+  var serve_content io.ReadCloser
+  encoded := false
+  if x.Info.Size() == 0 && x.Encoding == "" {
+    // Nothing to read or cache. ServeContent() sends Content-Length: 0
+    // and ignores Range.
+    serve_content = &BytesReadCloser{*bytes.NewReader(nil)}
+  } else if gzipped {
+    serve_content = &BytesReadCloser{*bytes.NewReader(x.Gzipped)}
+  } else {
+    serve_content, encoded, err = fm.open(r.Context(), x, understands_encoding)
     if err != nil {
-      util.Log(0, "ERROR! GetStream(): %v", err)
-      util.Log(0, "%v %v %v", http.StatusInternalServerError, r.Method, r.URL.Path)
-      http.Error(w, "internal server error", http.StatusInternalServerError)
+      fm.readFailed(w, r, "GetStream()", err)
       return
     }
-    defer f.Close()
-    
-    serve_content = f
   }
-    
+  defer serve_content.Close()
+  
+  if _, ranged := r.Header["Range"]; ranged { countRange(serve_content) }
+  
+  if bucket != nil {
+    serve_content = bucket.throttle(serve_content)
+  }
+  
   ce := ""
+  if encoded {
+    w.Header().Set("Content-Encoding", x.Encoding)
+    ce=", Content-Encoding: "+x.Encoding
+  }
+  etag := strconv.FormatUint(x.Id, 10)
   if gzipped {
     w.Header().Set("Content-Encoding", "gzip")
     ce=", Content-Encoding: gzip"
+    etag += "-gzip"
   }
   
-  w.Header().Set("ETag", fmt.Sprintf("%v", x.Id))
+  // Setting the canonical key directly avoids fmt and canonicalizing "ETag".
+  w.Header()["Etag"] = []string{etag}
   //w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%v",max_age))
+  // Files from password protected directories have Cache-Control: private.
+  if (fm.immutable != nil && fm.immutable.MatchString(clean)) || fm.immutableFile(x) {
+    switch w.Header().Get("Cache-Control") {
+      case "":        w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+      case "private": w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+    }
+  }
+  mime := mimeType(clean)
+  // The raw view of rendered Markdown should be readable in the browser.
+  if fm.markdown && strings.HasSuffix(clean, ".md") {
+    mime = "text/plain"
+  }
+  content_type := contentTypeHeader(mime)
+  mime = content_type[0]
+  w.Header()["Content-Type"] = content_type
+  
+  variant := ""
+  if group != "" {
+    variant = ", Variant: "+group
+  }
+  
+  accesslog.Log(r, 0, "%v %v %v (ETag: %v, Content-Type: %v%v%v)", http.StatusOK, r.Method, r.URL.Path, x.Id, mime, ce, variant)
+  // Reading the file (and decompressing it) happens while sending.
+  _, span = tracing.Start(r.Context(), "send")
+  if span.Recording() {
+    span.SetAttr("garcon.size", x.Info.Size())
+    span.SetAttr("garcon.decompress", x.Encoding != "" && !encoded)
+  }
+  http2.ServeContent(w,r,lastModified(r, x),-1,serve_content)
+  span.End()
+}
+
+/*
+  Returns true if the file or directory with URL path p (starting with "/") is
+  in a directory whose index directives request that it not be indexed
+  by search engines (robots="noindex"), that is password protected or that
+  not everyone may read (see Authorize).
+  Such paths must be excluded from sitemaps and search results.
+*/
+func (fm *FileManager) NoIndex(p string) bool {
+  noindex := fm.current().indexes.noindex
+  passwords := fm.current().indexes.passwords
+  p = path.Clean(p)
+  if Authorize != nil && !Authorize(nil, p) { return true }
+  for ; ; p = path.Dir(p) {
+    if noindex[p] || passwords[p] != "" { return true }
+    if p == "/" || p == "." { return false }
+  }
+}
+
+// Returns the MIME type for the file with path clean (without charset).
+func mimeType(clean string) string {
   mime := linux.Extension2MIME[path.Ext(clean)]
   if mime == "" { 
     // Special case for common tarball extensions
@@ -153,13 +352,167 @@ func (fm *FileManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
       mime = "application/octet-stream"
     }
   }
+  return mime
+}
+
+// Maps MIME types to the values of the Content-Type header for them.
+var contentTypeHeaders sync.Map
+
+/*
+  Returns the value of the Content-Type header for files of type mime,
+  with the charset for text types. The same slice is returned each time
+  so that serving a file does not allocate it. The caller must not modify it.
+*/
+func contentTypeHeader(mime string) []string {
+  if h, ok := contentTypeHeaders.Load(mime); ok { return h.([]string) }
+  value := mime
   if strings.HasPrefix(mime, "text/") {
-    mime += "; charset=UTF-8"
+    value += "; charset=UTF-8"
+  }
+  h, _ := contentTypeHeaders.LoadOrStore(mime, []string{value})
+  return h.([]string)
+}
+
+/*
+  Like x.GetStream() but takes the data from fm's cache if possible.
+  The cache access and the opening of the file are traced as part of the
+  request with the context ctx. While the root directory is unavailable,
+  files on disk are only taken from the cache.
+*/
+func (fm *FileManager) open(ctx context.Context, x *File, keep_encoded bool) (stream io.ReadCloser, is_encoded bool, err error) {
+  if _, ondisk := x.Data.(string); ondisk && fm.rootUnavailable() { return fm.openCached(x, keep_encoded) }
+  if fm.cache != nil {
+    _, span := tracing.Start(ctx, "cache")
+    stream, is_encoded, err = fm.cache.GetStream(x, keep_encoded)
+    if span.Recording() { span.SetAttr("garcon.cache.hit", stream != nil) }
+    span.SetError(err)
+    span.End()
+    if err != nil {
+      util.Log(0, "ERROR! Cache: %v", err)
+    } else if stream != nil {
+      return stream, is_encoded, nil
+    }
+  }
+  _, span := tracing.Start(ctx, "open")
+  if span.Recording() {
+    span.SetAttr("garcon.file", x.String())
+    if x.Encoding != "" { span.SetAttr("garcon.encoding", x.Encoding) }
+  }
+  stream, is_encoded, err = x.GetStream(keep_encoded)
+  span.SetError(err)
+  span.End()
+  return
+}
+
+// Returns true if r's Accept-Encoding header lists encoding.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+  for _, aes := range r.Header["Accept-Encoding"] {
+    for _, ae := range strings.Split(aes, ",") {
+      if strings.TrimSpace(ae) == encoding { return true }
+    }
+  }
+  return false
+}
+
+/*
+  If x is a generated index.html that is available in multiple languages,
+  returns the translation that best matches r's Accept-Language header.
+  If x has a CanaryIndex version, the client's group (see canaryGroup())
+  decides which version is returned and is returned as well, otherwise
+  the group is "". Otherwise returns x.
+*/
+func (fm *FileManager) localize(x *File, w http.ResponseWriter, r *http.Request) (*File, string) {
+  indexes := fm.current().indexes
+  variants := indexes.variants[x.Id]
+  canary := indexes.canary[x.Id]
+  group := ""
+  if canary != nil {
+    group = canaryGroup(w, r)
+    if group == groupCanary {
+      if len(canary) == 1 {
+        for _, index := range canary { return index, group }
+      }
+      variants = canary
+    }
+  }
+  if variants == nil { return x, group }
+  
+  w.Header().Add("Vary", "Accept-Language")
+  return variants[negotiateLanguage(r, variants)], group
+}
+
+/*
+  Returns the File for clean, which must be a cleaned path starting
+  with "/". If clean refers to a directory, its index.html is returned.
+  The path of the returned File is returned as resolved.
+*/
+func (fm *FileManager) lookup(clean string) (x *File, resolved string, ok bool) {
+  resolved = clean
+  
+  // Walks the path segments as substrings of clean, which, unlike
+  // splitting clean, does not allocate.
+  dir := fm.current().root.Contents
+  for rest := clean; rest != ""; {
+    name := rest
+    if i := strings.IndexByte(rest, '/'); i >= 0 {
+      name, rest = rest[0:i], rest[i+1:]
+    } else {
+      rest = ""
+    }
+    if name == "" { continue }
+    if x, ok = dir[name]; !ok {
+      break
+    }
+    if x.Info.IsDir() {
+      dir = x.Contents
+    } else {
+      dir = empty
+    }
   }
-  w.Header().Set("Content-Type", mime)
   
-  util.Log(0, "%v %v %v (ETag: %v, Content-Type: %v%v)", http.StatusOK, r.Method, r.URL.Path, x.Id, mime, ce)
-  http2.ServeContent(w,r,x.Info.ModTime(),-1,serve_content)
+  if ok && x.Info.IsDir() {
+    util.Log(2, "Rewrite %v => %v", clean, clean + "/index.html")
+    x, ok = dir["index.html"]
+    resolved = path.Join(clean, "index.html")
+  }
+  return
+}
+
+/*
+  For any request below prefix (e.g. "/app") for which no file exists, fm will
+  serve prefix's index.html with status 200 instead of a 404 error. This is
+  required by single page applications that do their own routing.
+  Call before ServeHTTP() is called for the first time.
+*/
+func (fm *FileManager) AddFallback(prefix string) {
+  prefix = path.Clean("/" + prefix)
+  if prefix == "/" { prefix = "" }
+  fm.fallbacks = append(fm.fallbacks, prefix)
+}
+
+/*
+  Files whose path (starting with "/") matches pattern are assumed to have
+  content-hashed names (e.g. app.3f2a9c1b.js) that change whenever the content
+  changes. They are served with "Cache-Control: public, max-age=31536000, immutable".
+  Because files are looked up by path only, cache-busting query strings
+  (e.g. app.js?v=123) never affect which file is served.
+  Call before ServeHTTP() is called for the first time.
+*/
+func (fm *FileManager) SetImmutable(pattern *regexp.Regexp) {
+  fm.immutable = pattern
+}
+
+/*
+  Sets how often the tree of fm is rescanned, e.g. rarely for a huge
+  mirror and aggressively for a small docs tree. After a rescan, the changes
+  reported during the following debounce (default 5s) are handled by one
+  rescan after it. After a failed rescan, the next one starts after retry
+  (default 30s). If poll > 0, the tree is also rescanned poll after the
+  last rescan if no changes have been reported, e.g. for NFS, where changes
+  made by other hosts are not reported. Call before AutoUpdate().
+*/
+func (fm *FileManager) SetScanIntervals(debounce, retry, poll time.Duration) {
+  fm.debounce, fm.retry, fm.poll = debounce, retry, poll
 }
 
 /*
@@ -167,138 +520,701 @@ func (fm *FileManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
   data if necessary. Never returns. Call in a goroutine.
 */
 func (fm *FileManager) AutoUpdate() {
-  var buf [1024]byte
   var err error
   
+  if fm.rpm_repos != nil || fm.arch_repos != nil || fm.pypi_repos != nil || fm.maven_repos != nil {
+    tree := fm.current().root.Contents
+    fm.updateRPMRepos(tree)
+    fm.updateArchRepos(tree)
+    fm.updatePyPIRepos(tree)
+    fm.updateMavenRepos(tree)
+  }
+  // Supervise() may call AutoUpdate() again after a crash.
+  fm.keyrings_watched.Do(func() { go fm.watchKeyrings() })
+  
+  // Without watches (after a failed rescan or after loading StateFile) the
+  // tree is rescanned right away, except for a read-only image.
+  trigger := "start"
+  failed := false
   for {
-    if fm.inotify >= 0 {
-      _, err = syscall.Read(fm.inotify, buf[:])
+    if fm.readonly && !failed {
+      atomic.StoreInt32(&fm.waiting, 1)
+      <-fm.wake
+      atomic.StoreInt32(&fm.waiting, 0)
+      trigger = "request"
+    } else if fm.inotify >= 0 {
+      atomic.StoreInt32(&fm.waiting, 1)
+      trigger, err = fm.waitForChanges()
+      atomic.StoreInt32(&fm.waiting, 0)
       if err != nil {
         util.Log(0, "ERROR! inotify read: %v", err)
       }
-      err = syscall.Close(fm.inotify)
-      fm.inotify = -1
+      err = fm.closeWatches()
       if err != nil {
         util.Log(0, "ERROR! inotify close: %v", err)
       }
     }
     newtree := map[string]*File{}
-    err = fm.scan(fm.root.Data.(string), fm.root.Contents, newtree)
-    if err != nil { 
+    fm.newconflicts = nil
+    fm.newskew = clockSkew{}
+    fm.scanroot = fm.root()
+    oldtree := fm.current().root.Contents
+    oldindexes := fm.current().indexes
+    var pub *publishRequest
+    select {
+      case pub = <-fm.publishing:
+        // Nothing of the old tree is taken over, because its Files
+        // refer to the old directory.
+        fm.scanroot = pub.dir
+        oldtree = map[string]*File{}
+        oldindexes = nil
+        atomic.StoreInt32(&fm.regenerate, 1)
+        trigger = "publish"
+      default:
+    }
+    fm.watchStats.rescans[trigger].Inc()
+    trigger = "retry"
+    err = fm.scan(fm.scanroot, oldtree, newtree)
+    // An unmounted filesystem leaves an empty mount point behind.
+    if err == nil && pub == nil && len(newtree) == 0 && len(oldtree) > 0 { err = fm.readRoot() }
+    failed = err != nil
+    if err != nil && pub != nil {
+      util.Log(0, "ERROR! Publishing %v: %v", pub.dir, err)
+      pub.done <- err
+      // The watches are on the new tree. Scan the old one again right away.
+      fm.closeWatches()
+    } else if err != nil && fm.checkRoot() {
+      // The old tree is served until the root directory is back. A failed
+      // filesystem may never trigger the watches, so poll.
+      util.Log(1, "Re-scan: %v", err)
+      fm.closeWatches()
+      time.Sleep(RootRetryInterval)
+    } else if err != nil { 
       util.Log(0, "ERROR! re-scan: %v", err)
-      time.Sleep(30*time.Second)
+      time.Sleep(fm.retry)
     } else {
-      AddIndexes(newtree, "Home")
-      fm.mutex.Lock()
-      fm.root.Contents = newtree
-      fm.mutex.Unlock()
-      time.Sleep(5*time.Second)
+      fm.snapshotSuites(newtree)
+      fm.forgetRepoStates()
+      fm.updateRPMRepos(newtree)
+      fm.updateArchRepos(newtree)
+      fm.updatePyPIRepos(newtree)
+      fm.updateMavenRepos(newtree)
+      indexes := addIndexes(newtree, "Home", oldindexes)
+      fm.enforceMemoryBudget(newtree, indexes)
+      newtree = fm.commitScan(newtree, indexes, fm.scanroot)
+      if err := fm.reloadRedirects(); err != nil {
+        util.Log(0, "ERROR! Redirects %v: %v => Keeping the previous ones", fm.redirectsFile, err)
+      }
+      atomic.StoreUint64(&fm.rootdev, deviceOf(fm.scanroot))
+      fm.rootAvailable()
+      fm.cleanSpillDir(newtree)
+      if pub != nil {
+        util.Log(0, "Published %v", pub.dir)
+        pub.done <- nil
+      }
+      
+      // Purge cache entries and checksums for files that have changed or
+      // disappeared so that they don't waste memory.
+      ids := map[uint64]bool{}
+      collectIds(newtree, ids)
+      for _, variants := range indexes.variants {
+        for _, index := range variants { ids[index.Id] = true }
+      }
+      for _, variants := range indexes.canary {
+        for _, index := range variants { ids[index.Id] = true }
+      }
+      if fm.cache != nil {
+        if removed := fm.cache.Retain(ids); removed > 0 {
+          util.Log(2, "Purged %v stale cache entries", removed)
+        }
+      }
+      fm.retainChecksums(ids)
+      
+      time.Sleep(fm.debounce)
+    }
+  }
+}
+
+// Makes the tree found by a rescan (with indexes) of the directory rootdir
+// the current one. Returns the tree with the republished files. Unlocks
+// fm.mutex even if republish() panics, so that Supervise() can restart
+// AutoUpdate().
+func (fm *FileManager) commitScan(newtree map[string]*File, indexes *indexCache, rootdir string) map[string]*File {
+  fm.mutex.Lock()
+  defer fm.mutex.Unlock()
+  if rootdir != fm.root() {
+    // The published files belong to the old tree.
+    fm.published = nil
+  }
+  newtree = fm.republish(newtree)
+  state := fm.current().with(newtree)
+  state.root.Data = rootdir
+  state.indexes = indexes
+  state.conflicts = fm.newconflicts
+  state.skew = fm.newskew
+  fm.state.Store(state)
+  atomic.StoreInt64(&fm.refreshed, time.Now().UnixNano())
+  return newtree
+}
+
+/*
+  Makes fm serve small files from cache c. Call before
+  ServeHTTP() is called for the first time.
+*/
+func (fm *FileManager) UseCache(c *Cache) {
+  fm.cache = c
+  if MemoryBudget > 0 {
+    m := fm.memoryStats()
+    c.Limit(MemoryBudget - m.InMemoryFiles - m.Indexes)
+  }
+}
+
+/*
+  Loads all files whose path (starting with "/") matches pattern and whose size
+  does not exceed the cache's file size limit into the cache. This is meant to
+  be called right after NewFileManager() so that frequently requested files like
+  repository metadata are served from memory right from the start.
+  Errors are logged and do not abort preloading.
+*/
+func (fm *FileManager) Preload(pattern *regexp.Regexp) {
+  if fm.cache == nil { return }
+  count, size := fm.preload(pattern, "", fm.current().root.Contents)
+  util.Log(1, "Preloaded %v files (%v bytes) into cache", count, size)
+}
+
+func (fm *FileManager) preload(pattern *regexp.Regexp, dirpath string, dir map[string]*File) (count int, size int64) {
+  for name, x := range dir {
+    p := dirpath + "/" + name
+    if x.Info.IsDir() {
+      c, sz := fm.preload(pattern, p, x.Contents)
+      count += c
+      size += sz
+      continue
+    }
+    
+    if !pattern.MatchString(p) { continue }
+    // aliases share their Id and data with the original file
+    if _, cached := fm.cache.Get(x.Id, RAW); cached { continue }
+    
+    data, err := fm.cache.Load(x)
+    if err != nil {
+      util.Log(0, "ERROR! Preload %v: %v", p, err)
+    } else if data != nil {
+      util.Log(2, "Preloaded: %v", p)
+      count++
+      size += int64(len(data))
+    }
+  }
+  return
+}
+
+/*
+  Returns a number that changes whenever the served tree changes, i.e.
+  after each scan and each committed Transaction. Responses that are
+  computed from the tree use it in their ETags (see generatedETag()).
+*/
+func (fm *FileManager) Generation() uint64 {
+  return fm.current().generation
+}
+
+/*
+  Sets the ETag of the response to r, which is computed from the tree (e.g.
+  a suite diff) and is identified by variant among the responses for the
+  same URL, to the current Generation(). If r's If-None-Match matches,
+  304 Not Modified is sent and true is returned, so that the response
+  need not be computed. Otherwise it must be sent with http2.ServeContent().
+  Call before the response is computed, so that changes of the tree while
+  it is computed do not get the new ETag. If Cache-Control is "private"
+  (because the response depends on the user), it stays private.
+*/
+func (fm *FileManager) generatedETag(w http.ResponseWriter, r *http.Request, variant string) bool {
+  w.Header().Set("ETag", fmt.Sprintf("\"g%v-%v\"", fm.Generation(), variant))
+  if w.Header().Get("Cache-Control") == "private" {
+    w.Header().Set("Cache-Control", "private, no-cache")
+  } else {
+    w.Header().Set("Cache-Control", "no-cache")
+  }
+  if _, done := http2.CheckPreconditions(w, r, time.Time{}); done {
+    accesslog.Log(r, 1, "%v %v %v (ETag: %v)", http.StatusNotModified, r.Method, r.URL.Path, w.Header().Get("ETag"))
+    return true
+  }
+  return false
+}
+
+// Writes the alias conflicts found by the last scan to w. For the status page.
+func (fm *FileManager) WriteConflicts(w io.Writer) {
+  conflicts := fm.current().conflicts
+  if len(conflicts) == 0 {
+    fmt.Fprintf(w, "none\n")
+  }
+  for _, c := range conflicts {
+    fmt.Fprintf(w, "%v <= %v: %v\n", c.Path, c.Original, c.Resolution)
+  }
+}
+
+/*
+  Writes the directories whose index.xhtml could not be used by the last
+  scan, so that they got the default index instead, to w. For the status page.
+*/
+func (fm *FileManager) WriteIndexErrors(w io.Writer) {
+  errs := fm.current().indexes.templateErrors
+  if len(errs) == 0 {
+    fmt.Fprintf(w, "none\n")
+  }
+  dirs := make([]string, 0, len(errs))
+  for dir := range errs { dirs = append(dirs, dir) }
+  sort.Strings(dirs)
+  for _, dir := range dirs {
+    fmt.Fprintf(w, "%v: %v\n", dir, errs[dir])
+  }
+}
+
+// Returns the first of fm's handling rules that matches name.
+func (fm *FileManager) handlingFor(name string) *Handling {
+  hand := 0
+  for hand < len(fm.handling) {
+    if fm.handling[hand].Match.MatchString(name) { break }
+    hand++
+  }
+  // NOTE: Because fm.handling has a catch-all, it is guaranteed that
+  // fm.handling[hand] is valid
+  return &fm.handling[hand]
+}
+
+// Adds the Ids of all files in the directory tree dir to ids.
+func collectIds(dir map[string]*File, ids map[uint64]bool) {
+  for _, x := range dir {
+    ids[x.Id] = true
+    if x.Info.IsDir() {
+      collectIds(x.Contents, ids)
     }
   }
 }
 
+/*
+  A state of the served tree. Once it has been stored in FileManager.state
+  neither it nor the tree are modified any more; changes create a new
+  treeState that shares the unchanged directories (see change.applyTo()).
+*/
+type treeState struct {
+  // The root directory. Its Contents is the tree.
+  root *File
+  
+  // Counts the changes of the tree (see Generation()).
+  generation uint64
+  
+  // The generated index.html files of the tree, re-used by the next scan
+  // for directories that have not changed.
+  indexes *indexCache
+  
+  // The alias conflicts found by the scan that produced the tree.
+  conflicts []AliasConflict
+  
+  // The files with future mtimes found by the scan that produced the tree.
+  skew clockSkew
+}
+
+// Returns a copy of s with the tree replaced by tree and the next generation.
+func (s *treeState) with(tree map[string]*File) *treeState {
+  root := *s.root
+  root.Contents = tree
+  next := *s
+  next.root = &root
+  next.generation++
+  return &next
+}
+
+// Returns the current state of the tree, which may be used without locking.
+func (fm *FileManager) current() *treeState {
+  return fm.state.Load().(*treeState)
+}
 
 // Handles a directory tree.
 type FileManager struct {
   // inotify file descriptor used to watch all directories for changes.
   inotify int
   
-  // The root directory.
-  root *File
+  // The path of the root directory passed to NewFileManager(). The tree
+  // that is served may be in another directory. See root().
+  rootdir string
+  
+  // The root directory of the scan in progress. Only accessed by the
+  // scanning goroutine.
+  scanroot string
+  
+  // Requests to serve another tree, for AutoUpdate(). See PublishTree().
+  publishing chan *publishRequest
   
-  // Whenever tree is accessed, this mutex is used to protect
-  // ServerHTTP() from AutoUpdate()
-  mutex sync.RWMutex
+  // The current *treeState. Requests use it without locking, so they
+  // never wait for rescans or Transactions. See current().
+  state atomic.Value
+  
+  // Serializes the changes of the tree (rescans and Transactions),
+  // which replace state. Protects published.
+  mutex sync.Mutex
   
   // The handling rules for file patterns.
   handling []Handling
+  
+  // If non-nil, small files are served from this cache.
+  cache *Cache
+  
+  // If non-nil, files whose path matches are served as immutable. See SetImmutable().
+  immutable *regexp.Regexp
+  
+  // Path prefixes (without trailing slash) below which unknown paths are answered
+  // with the prefix's index.html. See AddFallback().
+  fallbacks []string
+  
+  // The file of SetRedirects() as a path in the tree, or "".
+  redirectsFile string
+  
+  // The modification time and size of redirectsFile when it was last read.
+  redirectsStamp string
+  
+  // The *redirectMap read from redirectsFile.
+  redirects atomic.Value
+  
+  // 1 if the admin API has requested that the metadata of the
+  // repositories be regenerated (see forgetRepoStates()). Atomic.
+  regenerate int32
+  
+  // The alias conflicts found by the scan in progress.
+  newconflicts []AliasConflict
+  
+  // The files with future mtimes found by the scan in progress.
+  newskew clockSkew
+  
+  // Protects memstats and spilled.
+  memmutex sync.Mutex
+  
+  // Memory accounting information. See MemoryStats().
+  memstats MemoryStats
+  
+  // Maps directories below SpillDir to the number of bytes spilled there.
+  spilled map[string]int64
+  
+  // If true, .md files are rendered as HTML. See RenderMarkdown().
+  markdown bool
+  
+  // If true, ?view=source shows highlighted source. See SourceView().
+  source_view bool
+  
+  // Path prefixes (without trailing slash) below which the source view is
+  // the default. See AddSourcePrefix().
+  source_prefixes []string
+  
+  // Files whose path matches get a download page. See SetDownloadPages().
+  download_pages *regexp.Regexp
+  
+  // Base URLs of mirrors listed on download pages. See AddMirror().
+  mirrors []string
+  
+  // Protects checksums.
+  summutex sync.Mutex
+  
+  // Maps File.Id to the SHA-256 of the file's contents. See checksum().
+  checksums map[uint64]string
+  
+  // Maps rate class names to their limits. See SetRateClass().
+  rate_classes map[string]*rateBucket
+  
+  // The limits for uploads. nil if unlimited. See SetUploadLimits().
+  upload_limits *uploadLimiter
+  
+  // The metadata snapshots of the Debian suites in the tree by the URL path
+  // of the suite directory. Only accessed by the scanning goroutine.
+  // See snapshotSuites().
+  suites map[string]suiteSnapshot
+  
+  // The in-memory files published by Transactions by their paths.
+  // Protected by mutex.
+  published map[string]*File
+  
+  // Path prefixes (without trailing slash) below which files may be
+  // uploaded. See AddUploadPrefix().
+  upload_prefixes []string
+  
+  // Directories with a writable home directory for each user. See AddHome().
+  homes []homeArea
+  
+  // Serializes replacing uploaded files. See serveUpload().
+  uploadmutex sync.Mutex
+  
+  // The directories whose repodata is generated. See AddRPMRepo().
+  rpm_repos []*rpmRepo
+  
+  // The headers of the packages in rpm_repos by File.Id.
+  // Only accessed by the scanning goroutine.
+  rpm_headers map[uint64]*rpm.Package
+  
+  // The directories whose pacman databases are generated. See AddArchRepo().
+  arch_repos []*archRepo
+  
+  // The packages in arch_repos by File.Id (without Filename and Signature).
+  // Only accessed by the scanning goroutine.
+  arch_packages map[uint64]*arch.Entry
+  
+  // The directories whose simple/ index is generated. See AddPyPIRepo().
+  pypi_repos []*pypiRepo
+  
+  // The core metadata of the wheels in pypi_repos by File.Id (nil if a
+  // wheel has none). Only accessed by the scanning goroutine.
+  pypi_metadata map[uint64][]byte
+  
+  // The directories in Maven repository layout. See AddMavenRepo().
+  maven_repos []*mavenRepo
+  
+  // The checksums of the files in maven_repos by File.Id and type.
+  // Only accessed by the scanning goroutine.
+  maven_sums map[uint64]map[string]string
+  
+  // If not "", the image layouts below this path are served under /v2/.
+  // See SetOCIRegistry().
+  oci_prefix string
+  
+  // The path prefixes that mirror an upstream server. See AddProxy().
+  proxies []*proxyPrefix
+  
+  // The commands that check uploaded files. See AddValidator().
+  validators []Validator
+  
+  // True if the admin API is served. See EnableAdminAPI().
+  admin_api bool
+  
+  // Starts watchKeyrings() only once even if AutoUpdate() is restarted.
+  keyrings_watched sync.Once
+  
+  // See SetScanIntervals().
+  debounce, retry, poll time.Duration
+  
+  // The metrics of the inotify watches and rescans.
+  watchStats *watchStats
+  
+  // True if the root directory is a read-only image. See ReadOnlyImage.
+  readonly bool
+  
+  // Wakes up AutoUpdate() for a rescan of a read-only image.
+  wake chan bool
+  
+  // The UnixNano time of the last successful scan. Atomic.
+  refreshed int64
+  
+  // 1 while AutoUpdate() waits for inotify events, i.e. the tree is up to date. Atomic.
+  waiting int32
+  
+  // 1 while Supervise() waits before restarting AutoUpdate(). Atomic.
+  crashed int32
+  
+  // 1 while the root directory can not be read. See checkRoot(). Atomic.
+  unavailable int32
+  
+  // The device of the root directory at the last successful scan. Atomic.
+  rootdev uint64
+}
+
+/*
+  Adds ali to cur under the name alias unless this conflicts with an existing
+  entry. Conflicts with other aliases are resolved by preferring the encoding
+  listed first in encodingPreference. Conflicts with real files are resolved
+  according to AliasConflictPolicy and recorded for the status page.
+*/
+func (fm *FileManager) addAlias(dir string, cur map[string]*File, alias string, ali *File) {
+  existing, conflict := cur[alias]
+  if !conflict {
+    util.Log(2, "%v alias %v => %v", ali.Encoding, alias, ali.Info.Name())
+    cur[alias] = ali
+    return
+  }
+  
+  if existing == nil { return } // blocked by an earlier conflict under the "error" policy
+  
+  if existing.Encoding != "" {
+    if encodingPreference[ali.Encoding] < encodingPreference[existing.Encoding] {
+      util.Log(2, "%v alias %v => %v replaces %v alias", ali.Encoding, alias, ali.Info.Name(), existing.Encoding)
+      cur[alias] = ali
+    } else {
+      util.Log(2, "%v alias %v => %v conflicts with %v alias => SKIPPED", ali.Encoding, alias, ali.Info.Name(), existing.Encoding)
+    }
+    return
+  }
+  
+  policy := AliasConflictPolicy
+  if existing.Info.IsDir() { policy = PREFER_FILE } // never hide a directory
+  
+  c := AliasConflict{Path:fm.relPath(dir, alias), Original:ali.Info.Name()}
+  switch policy {
+    case PREFER_ALIAS: cur[alias] = ali
+                       c.Resolution = "alias served"
+    case MTIME_NEWEST_WINS:
+                       if ali.Info.ModTime().After(existing.Info.ModTime()) {
+                         cur[alias] = ali
+                         c.Resolution = "alias served (newer)"
+                       } else {
+                         c.Resolution = "file served (newer)"
+                       }
+    case CONFLICT_ERROR:
+                       // Keep the name in cur so that further aliases with the same name are blocked, too.
+                       cur[alias] = nil
+                       c.Resolution = "neither served"
+    default:           c.Resolution = "file served"
+  }
+  
+  if policy == CONFLICT_ERROR {
+    util.Log(0, "ERROR! %v alias %v => %v conflicts with real file => NOT SERVED", ali.Encoding, c.Path, ali.Info.Name())
+  } else {
+    util.Log(1, "%v alias %v => %v conflicts with real file => %v", ali.Encoding, c.Path, ali.Info.Name(), c.Resolution)
+  }
+  fm.newconflicts = append(fm.newconflicts, c)
+}
+
+// Returns the path (starting with "/") relative to the server root of
+// the entry name in the filesystem directory dir.
+func (fm *FileManager) relPath(dir string, name string) string {
+  rel := strings.TrimPrefix(path.Join(dir, name), fm.scanroot)
+  if !strings.HasPrefix(rel, "/") { rel = "/" + rel }
+  return rel
+}
+
+// Returns true if the file fi occupies fewer 512 byte blocks than its size requires.
+func isSparse(fi os.FileInfo) bool {
+  st, ok := fi.Sys().(*syscall.Stat_t)
+  return ok && fi.Mode().IsRegular() && st.Blocks*512 < fi.Size()
 }
 
+/*
+  Returns the FileInfo of the target of the symlink fi in the directory dir,
+  so that symlinked files and directories are served and listed under the
+  symlink's name like the targets. Returns nil if the target does not exist
+  or is a directory that contains dir (e.g. "." or ".."), because scanning
+  it would never end.
+*/
+func symlinkTarget(dir string, fi os.FileInfo) os.FileInfo {
+  p := path.Join(dir, fi.Name())
+  target, err := os.Stat(p)
+  if err != nil {
+    util.Log(1, "WARNING! Ignoring symlink %v: %v", p, err)
+    return nil
+  }
+  if !target.IsDir() { return target }
+  real, err := filepath.EvalSymlinks(p)
+  if err != nil {
+    util.Log(1, "WARNING! Ignoring symlink %v: %v", p, err)
+    return nil
+  }
+  // dir may itself have been reached through symlinks, so every directory
+  // on the way is checked.
+  for d := dir; ; d = path.Dir(d) {
+    if r, err := filepath.EvalSymlinks(d); err == nil && r == real {
+      util.Log(0, "WARNING! Ignoring symlink %v: It points to %v, which contains it", p, d)
+      return nil
+    }
+    if d == "/" || d == "." { break }
+  }
+  return target
+}
+
+// The number of directory entries that scan() reads at a time, so that
+// huge directories do not need the os.FileInfos of all entries at once.
+const readdirBatch = 4096
+
 /*
   Scan directory dir and add entries to cur. If an entry with the same
   name exists in old, its Id will be reused if the file has not changed.
+  Unchanged files are taken over from old as they are, which is possible
+  because a published tree is never modified (see treeState), so that
+  rescans of huge directories do not allocate all entries anew.
 */
 func (fm *FileManager) scan(dir string, old, cur map[string]*File) error {
-  var err error
   // We need to set up inotify before Readdir(), or we might miss some
   // entries added just between Readdir() and inotify.
-  if fm.inotify < 0 {
-    fm.inotify, err = syscall.InotifyInit()
+  var err error
+  if !fm.readonly {
+    err = fm.addWatch(dir)
     if err != nil { return err }
   }
   
-  _, err = syscall.InotifyAddWatch(fm.inotify, dir, syscall.IN_CLOSE_WRITE|syscall.IN_CREATE|syscall.IN_DELETE|syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF|syscall.IN_MOVED_FROM|syscall.IN_MOVED_TO|syscall.IN_ONESHOT)
-  if err != nil { return err }
-  
   util.Log(2, "Scanning: %v", dir)
   d, err := os.Open(dir)
   if err != nil { return err }
-  fis, err := d.Readdir(-1)
-  d.Close()
-  if err != nil { return err }
+  defer d.Close()
   
   dirs := []string{}
   aliases1 := []string{}
   aliases2 := []*File{}
   
-  for _, fi := range fis {
-    name := fi.Name()
-    
-    hand := 0
-    for hand < len(fm.handling) {
-      if fm.handling[hand].Match.MatchString(name) { break }
-      hand++
-    }
-    // NOTE: Because fm.handling has a catch-all, it is guaranteed that
-    // fm.handling[hand] is valid
-    
-    n := &File{Info:fi, Data:dir}
-    
-    unchanged := false
-    if o, ok := old[name]; ok && o.Info.ModTime().Equal(fi.ModTime()) && o.Info.IsDir() == n.Info.IsDir() {
-      n.Id = o.Id
-      unchanged = true
-    } else {
-      n.Id = <-nextid
-    }
-    
-    // We check for and store aliases before checking for hidden,
-    // because in the future we may use the alias mechanism combined with
-    // hide to get the alias and hide the original from the index
-    if !n.Info.IsDir() && fm.handling[hand].Gzip != "" {
-      alias := fm.handling[hand].Match.ReplaceAllString(name, fm.handling[hand].Gzip)
-      aliases1 = append(aliases1, alias)
-      ali_n := *n
-      ali_n.Gzip = true
-      aliases2 = append(aliases2, &ali_n)
-    }
-    
-    if fm.handling[hand].Hide { 
-      util.Log(2, "Hidden: %v", name)
-      continue
-    }
-    
-    if unchanged {
-      util.Log(2, "Unchanged: %v", name)
-    } else {
-      util.Log(2, "New/Changed: %v", name)
-    }
-    
-    cur[name] = n
+  for {
+    fis, err := d.Readdir(readdirBatch)
+    if err == io.EOF { break }
+    if err != nil { return err }
     
-    if n.Info.IsDir() {
-      dirs = append(dirs, name)
-      n.Contents = map[string]*File{}
+    for _, fi := range fis {
+      name := fi.Name()
+      
+      if fi.Mode() & os.ModeSymlink != 0 {
+        fi = symlinkTarget(dir, fi)
+        if fi == nil { continue }
+      }
+      
+      hand := fm.handlingFor(name)
+      
+      var n *File
+      o, known := old[name]
+      unchanged := known && o.Info.ModTime().Equal(fi.ModTime()) && o.Info.IsDir() == fi.IsDir()
+      if unchanged && !fi.IsDir() && o.Encoding == "" && o.Data == dir && o.Info.Size() == fi.Size() && o.Info.Mode() == fi.Mode() {
+        n = o
+      } else {
+        // Only the fields of FileInfo are kept, not the whole stat result.
+        n = &File{Info:&FileInfo{name, fi.Size(), fi.Mode(), fi.ModTime(), fi.IsDir()}, Data:dir, RateClass:fm.rateClassFor(name), Sparse:isSparse(fi)}
+        if unchanged {
+          n.Id = o.Id
+        } else {
+          n.Id = nextId()
+        }
+      }
+      
+      // We check for and store aliases before checking for hidden,
+      // so that a rule with Hide and e.g. Gzip serves and lists only the
+      // alias, e.g. manual.pdf for manual.pdf.gz.
+      // An empty file is not valid compressed data, so it gets no aliases.
+      if !n.Info.IsDir() && n.Info.Size() > 0 {
+        for encoding, replacement := range hand.aliases() {
+          alias := hand.Match.ReplaceAllString(name, replacement)
+          aliases1 = append(aliases1, alias)
+          ali_n := *n
+          ali_n.Encoding = encoding
+          aliases2 = append(aliases2, &ali_n)
+        }
+      }
+      
+      if hand.Hide { 
+        util.Log(2, "Hidden: %v", name)
+        continue
+      }
+      
+      if unchanged {
+        util.Log(2, "Unchanged: %v", name)
+      } else {
+        util.Log(2, "New/Changed: %v", name)
+      }
+      fm.checkClockSkew(dir, name, fi.ModTime(), !unchanged)
+      
+      cur[name] = n
+      
+      if n.Info.IsDir() {
+        dirs = append(dirs, name)
+        n.Contents = map[string]*File{}
+      }
     }
   }
   
   for i := range aliases1 {
-    if _, conflict := cur[aliases1[i]]; conflict {
-      util.Log(2, "Gzip alias %v => %v conflicts with real file or other alias => SKIPPED", aliases1[i], aliases2[i].Info.Name())
-    } else {
-      util.Log(2, "Gzip alias %v => %v", aliases1[i], aliases2[i].Info.Name())
-      cur[aliases1[i]] = aliases2[i]
-    }
+    fm.addAlias(dir, cur, aliases1[i], aliases2[i])
+  }
+  
+  // Remove the placeholders for names blocked by addAlias()
+  for name, x := range cur {
+    if x == nil { delete(cur, name) }
   }
   
   util.Log(2, "Subdirectories to scan: %v", dirs)
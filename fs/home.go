@@ -0,0 +1,172 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "io"
+         "os"
+         "fmt"
+         "path"
+         "errors"
+         "strings"
+         "net/http"
+         "io/ioutil"
+         
+         "../auth"
+         "../notify"
+       )
+
+// A directory below which each logged in user has a writable home directory.
+type homeArea struct {
+  // URL path of the directory (without trailing slash).
+  prefix string
+  
+  // Maximum number of bytes of the files in each home directory. 0 means unlimited.
+  quota int64
+}
+
+// Returned if an upload would exceed the quota of the user's home directory.
+var errQuotaExceeded = errors.New("Quota exceeded")
+
+/*
+  Allows each logged in user (see auth.UserFrom()) to upload files below
+  prefix/<user name>/, which is created on the first upload. The files in
+  each of these directories may have at most quota bytes (0 means unlimited).
+  Uploads that would exceed it are rejected with 507 Insufficient Storage.
+  Which users may read or write which home directories is up to the
+  auth.Policy; this only makes the directories writable.
+  Call before ServeHTTP() is called for the first time.
+*/
+func (fm *FileManager) AddHome(prefix string, quota int64) {
+  fm.homes = append(fm.homes, homeArea{prefix:strings.TrimSuffix(path.Clean(prefix), "/"), quota:quota})
+}
+
+// Returns true if fm accepts any uploads at all.
+func (fm *FileManager) uploadsEnabled() bool {
+  return fm.upload_prefixes != nil || fm.homes != nil || fm.maven_repos != nil
+}
+
+/*
+  If clean is in the home directory of r's user, returns the URL path of
+  the home directory, its quota and true.
+*/
+func (fm *FileManager) homeFor(r *http.Request, clean string) (string, int64, bool) {
+  u := auth.UserFrom(r)
+  if u == nil || u.Name == "" || strings.HasPrefix(u.Name, ".") || strings.ContainsAny(u.Name, "/\\\x00") || fm.handlingFor(u.Name).Hide {
+    return "", 0, false
+  }
+  for _, h := range fm.homes {
+    home := h.prefix + "/" + u.Name
+    if clean == home || strings.HasPrefix(clean, home + "/") { return home, h.quota, true }
+  }
+  return "", 0, false
+}
+
+// Creates the home directory of r's user if clean is in it and it does not exist yet.
+func (fm *FileManager) ensureHome(r *http.Request, clean string) error {
+  home, _, ok := fm.homeFor(r, clean)
+  if !ok { return nil }
+  fm.uploadmutex.Lock()
+  defer fm.uploadmutex.Unlock()
+  err := fm.makeDir(home)
+  if os.IsExist(err) { return nil }
+  return err
+}
+
+/*
+  Returns errQuotaExceeded if adding add bytes to the home directory that
+  contains clean would exceed its quota.
+*/
+func (fm *FileManager) checkQuota(r *http.Request, clean string, add int64) error {
+  home, quota, ok := fm.homeFor(r, clean)
+  if !ok || quota <= 0 { return nil }
+  if used := diskUsage(path.Join(fm.root(), home)); used + add > quota {
+    quotaExceeded(home, used, quota, add, clean)
+    return errQuotaExceeded
+  }
+  return nil
+}
+
+/*
+  Returns data limited to the bytes that are left of the quota of the home
+  directory that contains clean plus free (e.g. the size of a file that the
+  upload replaces), so that an upload without Content-Length can not fill
+  the disk before its size is checked. Reading more returns errQuotaExceeded.
+  Returns data itself if clean has no quota.
+*/
+func (fm *FileManager) quotaLimited(r *http.Request, clean string, free int64, data io.Reader) io.Reader {
+  left, exceeded, ok := fm.quotaLeft(r, clean)
+  if !ok { return data }
+  return &quotaReader{data:data, left:left + free, err:errQuotaExceeded, exceeded:exceeded}
+}
+
+/*
+  Returns the number of bytes that are left of the quota of the home
+  directory that contains clean (negative if it has been exceeded), a
+  function that sends the notification that an upload of add bytes to
+  clean has been refused, and true. Returns false if clean has no quota.
+*/
+func (fm *FileManager) quotaLeft(r *http.Request, clean string) (int64, func(add int64), bool) {
+  home, quota, ok := fm.homeFor(r, clean)
+  if !ok || quota <= 0 { return 0, nil, false }
+  used := diskUsage(path.Join(fm.root(), home))
+  return quota - used, func(add int64) { quotaExceeded(home, used, quota, add, clean) }, true
+}
+
+// Sends the notification that an upload of add bytes to clean would exceed the quota of home.
+func quotaExceeded(home string, used, quota, add int64, clean string) {
+  notify.Send(notify.QuotaExceeded, home, fmt.Sprintf("Quota of %v exceeded", home), fmt.Sprintf("%v has used %v of its quota of %v bytes and an upload of %v bytes to %v has been refused.", home, used, quota, add, clean))
+}
+
+// Reads data until more than left bytes have been read and then returns err.
+type quotaReader struct {
+  data io.Reader
+  left int64
+  read int64
+  err error
+  // If not nil, called with the number of bytes read when left is exceeded.
+  exceeded func(read int64)
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+  n, err := q.data.Read(p)
+  q.read += int64(n)
+  if q.read > q.left {
+    if q.exceeded != nil { q.exceeded(q.read) }
+    return 0, q.err
+  }
+  return n, err
+}
+
+/*
+  Returns the total size of the files below directory dir on disk, not
+  counting temporary files of uploads in progress. The parts of multipart
+  uploads are counted, because they stay until the upload is completed or
+  has expired.
+*/
+func diskUsage(dir string) int64 {
+  fis, err := ioutil.ReadDir(dir)
+  if err != nil { return 0 }
+  total := int64(0)
+  for _, fi := range fis {
+    if strings.HasPrefix(fi.Name(), ".upload-") || strings.HasPrefix(fi.Name(), ".unpack-") { continue }
+    if fi.IsDir() {
+      total += diskUsage(path.Join(dir, fi.Name()))
+    } else if fi.Mode().IsRegular() {
+      total += fi.Size()
+    }
+  }
+  return total
+}
@@ -0,0 +1,87 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "time"
+         "syscall"
+         
+         "github.com/mbenkmann/golib/util"
+       )
+
+// Filesystem types (f_type of statfs()) of read-only images.
+var imageTypes = map[int64]string{
+  0x73717368: "squashfs",
+  0xE0F5E1E2: "erofs",
+  0x9660: "iso9660",
+}
+
+// The ST_RDONLY flag of statfs().
+const stRdonly = 1
+
+/*
+  If true, the root directory is a read-only image (e.g. a mounted squashfs
+  or erofs) whose contents never change: No inotify watches are set up and
+  the tree is only rescanned when requested (e.g. by the admin API, a
+  scheduled job or a signing key change). The SHA-256 checksums of all files
+  are computed in the background and the files on disk are served with
+  "Cache-Control: public, max-age=31536000, immutable", so a file must never
+  be replaced by another one under the same path. Set before NewFileManager().
+*/
+var ReadOnlyImage bool
+
+// Checks that the root directory of fm is a read-only image and starts computing the checksums.
+func (fm *FileManager) startReadOnlyImage() {
+  var st syscall.Statfs_t
+  if err := syscall.Statfs(fm.root(), &st); err != nil {
+    util.Log(0, "WARNING! %v: %v", fm.root(), err)
+  } else if st.Flags & stRdonly == 0 {
+    util.Log(0, "WARNING! %v is not mounted read-only. Changes will not be noticed", fm.root())
+  } else if typ, ok := imageTypes[int64(st.Type)]; ok {
+    util.Log(1, "Serving %v image %v", typ, fm.root())
+  }
+  go fm.precomputeChecksums()
+}
+
+// Returns true if the contents of x never change (see ReadOnlyImage).
+func (fm *FileManager) immutableFile(x *File) bool {
+  if !fm.readonly { return false }
+  _, ondisk := x.Data.(string)
+  return ondisk
+}
+
+// Computes the checksums of all files of the tree (see checksum()).
+func (fm *FileManager) precomputeChecksums() {
+  start := time.Now()
+  files := 0
+  var bytes int64
+  var walk func(dir map[string]*File)
+  walk = func(dir map[string]*File) {
+    for _, x := range dir {
+      if x.Info.IsDir() {
+        walk(x.Contents)
+      } else if fm.immutableFile(x) {
+        if _, err := fm.checksum(x); err != nil {
+          util.Log(0, "ERROR! Checksum %v: %v", x, err)
+          continue
+        }
+        files++
+        bytes += x.Info.Size()
+      }
+    }
+  }
+  walk(fm.current().root.Contents)
+  util.Log(1, "Computed the checksums of %v files (%v bytes) in %v", files, bytes, time.Since(start).Round(time.Millisecond))
+}
@@ -16,11 +16,25 @@ GNU General Public License for more details.
 package fs
 
 import (
+         "io"
          "os"
+         "fmt"
+         "sort"
          "time"
+         "bytes"
+         "path"
+         "regexp"
+         "strings"
+         "net/url"
+         "hash/fnv"
+         "compress/gzip"
+         "io/ioutil"
+         "encoding/xml"
+         "html/template"
          
          "github.com/mbenkmann/golib/util"
          
+         "../linux"
          "../embedded"
        )
 
@@ -28,7 +42,7 @@ var defaultIndex = &File{
     Info: &FileInfo{"index.xhtml",int64(len(embedded.DefaultIndex)),os.ModeDir|0777,time.Now(),false},
     Id:0,
     Contents:nil,
-    Gzip:false,
+    Encoding:"",
     Data:embedded.DefaultIndex,
 }
 
@@ -43,13 +57,405 @@ var defaultIndex = &File{
   directory tree this defaults to the directory name.
 */
 func AddIndexes(root map[string]*File, title string) {
+  addIndexes(root, title, nil)
+}
+
+// The generated index.html files of a directory tree.
+type indexCache struct {
+  // Maps the hash of all inputs that went into generating an index.html
+  // (see indexKey()) to the result.
+  pages map[uint64]*File
+  
+  // Maps the Id of each index.html in the directory tree to its
+  // translations, keyed by language (see indexLanguages()).
+  variants map[uint64]map[string]*File
+  
+  // Maps the Id of each index.html in the directory tree that has a
+  // CanaryIndex version to its translations, keyed by language.
+  canary map[uint64]map[string]*File
+  
+  // URL paths of the directories whose robots directive contains
+  // noindex or none. See FileManager.NoIndex().
+  noindex map[string]bool
+  
+  // Maps the URL paths of the directories that have a password directive
+  // to its value. Subdirectories that inherit the password are not included.
+  passwords map[string]string
+  
+  // Maps the hash of the inputs of each index.html whose index.xhtml could
+  // not be used (see indexKey()) to the error, so that the default index
+  // that replaces it is not generated again as long as nothing changes.
+  failed map[uint64]string
+  
+  // Maps the URL paths of the directories whose index.xhtml could not be
+  // used to the error. See FileManager.WriteIndexErrors().
+  templateErrors map[string]string
+}
+
+// Returns the set of all index pages in c.
+func (c *indexCache) pageSet() map[*File]bool {
+  pages := map[*File]bool{}
+  for _, index := range c.pages { pages[index] = true }
+  return pages
+}
+
+// Replaces the index pages in c that are keys of replacements by their values.
+// c must not be the indexCache of the currently served tree.
+func (c *indexCache) replace(replacements map[*File]*File) {
+  for key, index := range c.pages {
+    if n, ok := replacements[index]; ok { c.pages[key] = n }
+  }
+  for _, variants := range []map[uint64]map[string]*File{c.variants, c.canary} {
+    for _, langs := range variants {
+      for lang, index := range langs {
+        if n, ok := replacements[index]; ok { langs[lang] = n }
+      }
+    }
+  }
+}
+
+/*
+  index.xhtml files larger than this are not used as templates, so that a
+  broken or malicious file cannot make each rescan generate huge pages.
+*/
+const maxIndexTemplate = 1 << 20
+
+/*
+  Like AddIndexes() but takes index.html files from cache if their inputs
+  have not changed. Returns a new indexCache that contains all the index.html
+  files used for root, so that entries for directories that have changed or
+  disappeared do not accumulate. cache may be nil.
+*/
+func addIndexes(root map[string]*File, title string, cache *indexCache) *indexCache {
   tree := buildMetaIndex(root,title)
-  generateIndexes(tree)
+  return generateIndexes(tree, cache)
 }
 
 // Walks through the meta-index tree (as built by buildMetaIndex())
 // and adds index.html files to all directories where necessary.
-func generateIndexes(tree [][]indexInfo) {
+// See addIndexes() for the meaning of cache and the return value.
+func generateIndexes(tree [][]indexInfo, cache *indexCache) *indexCache {
+  if cache == nil { cache = &indexCache{} }
+  newcache := &indexCache{pages:map[uint64]*File{}, variants:map[uint64]map[string]*File{}, canary:map[uint64]map[string]*File{}, noindex:map[string]bool{}, passwords:map[string]string{}, failed:map[uint64]string{}, templateErrors:map[string]string{}}
+  generated := 0
+  langs := indexLanguages()
+  for level := range tree {
+    for i := 1; i < len(tree[level])-1; i++ {
+      info := &tree[level][i]
+      if strings.Contains(info.robots, "noindex") || strings.Contains(info.robots, "none") {
+        newcache.noindex[info.path] = true
+      }
+      if info.password != "" && (level == 0 || info.password != tree[level-1][info.parent].password) {
+        newcache.passwords[info.path] = info.password
+      }
+      if info.template_err != nil {
+        newcache.templateErrors[info.path] = fmt.Sprintf("%v: %v", info.template_err_file, info.template_err)
+      }
+      if info.index_verbatim { continue }
+      
+      var parent *indexInfo
+      if level > 0 { parent = &tree[level-1][info.parent] }
+      
+      variants, n := generateVariants(info, parent, langs, cache, newcache)
+      generated += n
+      
+      if index := variants[langs[0]]; index != nil {
+        info.files["index.html"] = index
+        if len(variants) > 1 {
+          newcache.variants[index.Id] = variants
+        }
+        if info.indexfile == defaultIndex && canaryIndex() != nil {
+          canary := *info
+          canary.indexfile = canaryIndex()
+          canaryVariants, n := generateVariants(&canary, parent, langs, cache, newcache)
+          generated += n
+          if len(canaryVariants) == len(langs) {
+            newcache.canary[index.Id] = canaryVariants
+          }
+        }
+      }
+    }
+  }
+  util.Log(2, "Generated %v index pages (%v unchanged)", generated, len(newcache.pages)-generated)
+  return newcache
+}
+
+/*
+  Returns the index.html of the directory described by info in each of
+  the languages langs, taken from cache or generated, and the number of
+  generated ones. All of them are added to newcache. If one of them cannot
+  be generated, the languages after it are missing. If the index.xhtml of
+  the directory fails, the default index is used instead.
+*/
+func generateVariants(info *indexInfo, parent *indexInfo, langs []string, cache *indexCache, newcache *indexCache) (map[string]*File, int) {
+  generated := 0
+  variants := map[string]*File{}
+  for _, lang := range langs {
+    key := indexKey(info, parent, lang)
+    index, ok := cache.pages[key]
+    if failed, ok := cache.failed[key]; ok {
+      newcache.failed[key] = failed
+      newcache.templateErrors[info.path] = failed
+    }
+    if !ok {
+      var err error
+      index, err = generateIndex(info, parent, lang)
+      if err != nil && info.indexfile != defaultIndex && info.indexfile != canaryIndex() {
+        util.Log(0, "ERROR! Generating index of %v from %v: %v => Using the default index", info.path, info.indexfile, err)
+        failed := fmt.Sprintf("%v: %v", info.indexfile, err)
+        newcache.failed[key] = failed
+        newcache.templateErrors[info.path] = failed
+        fallback := *info
+        fallback.indexfile = defaultIndex
+        index, err = generateIndex(&fallback, parent, lang)
+      }
+      if err != nil {
+        util.Log(0, "ERROR! Generating index from %v: %v", info.indexfile, err)
+        break
+      }
+      generated++
+    }
+    newcache.pages[key] = index
+    variants[lang] = index
+  }
+  return variants, generated
+}
+
+/*
+  Returns a hash of everything generateIndex() uses to produce the index.html
+  for info in language lang, i.e. the directory's entry list (names, sizes,
+  modification times) as well as the title, description, size format,
+  robots, indexfile and .index.meta.
+*/
+func indexKey(info *indexInfo, parent *indexInfo, lang string) uint64 {
+  hash := fnv.New64a()
+  fmt.Fprintf(hash, "%v\x00%q\x00%q\x00%v\x00%q\x00%v\x00%v\x00", lang, info.title, info.description, info.size_format, info.robots, parent != nil, info.modtime.UnixNano())
+  if info.indexfile == defaultIndex {
+    fmt.Fprintf(hash, "default\x00")
+  } else if info.indexfile == canaryIndex() {
+    fmt.Fprintf(hash, "canary\x00")
+  } else {
+    fmt.Fprintf(hash, "%q\x00%v\x00%v\x00", info.indexfile.Info.Name(), info.indexfile.Info.Size(), info.indexfile.Info.ModTime().UnixNano())
+  }
+  if meta := info.metaInfo(); meta != nil {
+    fmt.Fprintf(hash, "%v\x00%v\x00%v\x00", indexMeta, meta.Size(), meta.ModTime().UnixNano())
+  }
+  
+  names := make([]string, 0, len(info.files))
+  for name := range info.files {
+    if name != "index.html" { names = append(names, name) }
+  }
+  sort.Strings(names)
+  for _, name := range names {
+    x := info.files[name]
+    fmt.Fprintf(hash, "%q\x00%v\x00%v\x00%v\x00", name, x.Info.IsDir(), x.Info.Size(), x.Info.ModTime().UnixNano())
+  }
+  return hash.Sum64()
+}
+
+// Matches the end of the <head> section where the robots <meta> tag is inserted.
+var headEnd = regexp.MustCompile(`(?i)</head\s*>`)
+
+// Matches the processing instructions <?garçon name?> that are replaced
+// by generated content as well as directives <?garçon key="value"?> which
+// are removed.
+var garconPI = regexp.MustCompile(`<\?garçon\s+([a-z-]+)([^?]*)\?>`)
+
+/*
+  Generates the index.html in language lang for the directory described by info
+  whose parent directory is described by parent (nil for the root directory).
+  
+  The Id of the returned File is a hash of its contents and its modification
+  time is the most recent modification time of the directory's entries and the
+  indexfile, so that ETag and Last-Modified remain stable across rescans as long
+  as the directory doesn't change.
+*/
+func generateIndex(info *indexInfo, parent *indexInfo, lang string) (*File, error) {
+  r, _, err := info.indexfile.GetStream(false)
+  if err != nil { return nil, err }
+  tmpl, err := ioutil.ReadAll(r)
+  r.Close()
+  if err != nil { return nil, err }
+  
+  var failed error
+  data := garconPI.ReplaceAllFunc(tmpl, func(pi []byte) []byte {
+    var buf bytes.Buffer
+    m := garconPI.FindSubmatch(pi)
+    if len(bytes.TrimSpace(m[2])) != 0 { return nil } // directive
+    name := string(m[1])
+    switch name {
+      case "title":       fmt.Fprintf(&buf, "<title>%v</title>", template.HTMLEscapeString(info.title))
+      case "description": if info.description != "" {
+                            fmt.Fprintf(&buf, `<meta name="description" content="%v" />`, template.HTMLEscapeString(info.description))
+                          }
+      case "heading":     fmt.Fprintf(&buf, "<h1>%v</h1>", template.HTMLEscapeString(info.title))
+                          if info.description != "" {
+                            fmt.Fprintf(&buf, "\n<p>%v</p>", template.HTMLEscapeString(info.description))
+                          }
+      case "index":       if err := writeListing(&buf, info, parent, lang); err != nil { failed = err }
+      default:            return pi // leave unknown processing instructions alone
+    }
+    return buf.Bytes()
+  })
+  if failed != nil { return nil, failed }
+  
+  if info.robots != "" {
+    meta := fmt.Sprintf(`<meta name="robots" content="%v" />`+"\n", info.robots)
+    if i := headEnd.FindIndex(data); i != nil {
+      data = append(data[:i[0]:i[0]], append([]byte(meta), data[i[0]:]...)...)
+    }
+  }
+  
+  modtime := time.Time{}
+  if info.indexfile != defaultIndex && info.indexfile != canaryIndex() {
+    modtime = info.indexfile.Info.ModTime()
+  }
+  if info.modtime.After(modtime) {
+    modtime = info.modtime
+  }
+  for _, x := range info.files {
+    if x.Info.ModTime().After(modtime) {
+      modtime = x.Info.ModTime()
+    }
+  }
+  
+  hash := fnv.New64a()
+  hash.Write(data)
+  
+  return &File{
+    Info: &FileInfo{"index.html",int64(len(data)),0444,modtime,false},
+    Id:hash.Sum64(),
+    Contents:nil,
+    Encoding:"",
+    Gzipped:gzipIndex(data),
+    Data:data,
+  }, nil
+}
+
+// Returns data compressed with gzip for File.Gzipped, or nil if that does not make it smaller.
+func gzipIndex(data []byte) []byte {
+  var buf bytes.Buffer
+  z, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+  z.Write(data)
+  z.Close()
+  if buf.Len() >= len(data) { return nil }
+  return buf.Bytes()
+}
+
+// Returns size formatted for a generated index according to format
+// (SIZE_HUMAN or SIZE_EXACT).
+func formatSize(size int64, format int) string {
+  exact := fmt.Sprintf("%v", size)
+  if format == SIZE_EXACT { return exact }
+  
+  units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+  f := float64(size)
+  u := 0
+  for f >= 1024 && u < len(units)-1 {
+    f /= 1024
+    u++
+  }
+  human := fmt.Sprintf("%v %v", size, units[0])
+  if u > 0 {
+    human = fmt.Sprintf("%.1f %v", f, units[u])
+  }
+  return fmt.Sprintf(`<span title="%v bytes">%v</span>`, exact, human)
+}
+
+// Returns the name of the symbol from embedded.IndexIcons that represents
+// the directory entry x called name.
+func icon(name string, x *File) string {
+  if x.Info.IsDir() { return "dir" }
+  
+  ext := strings.ToLower(path.Ext(name))
+  switch ext {
+    case ".gz", ".xz", ".bz2", ".zst", ".lz", ".lzma": return "archive"
+  }
+  mime := linux.Extension2MIME[ext]
+  switch {
+    case mime == "":                              return "file"
+    case mime == "application/pdf":               return "pdf"
+    case strings.Contains(mime, "debian-package"),
+         strings.Contains(mime, "rpm"):           return "package"
+    case strings.Contains(mime, "zip"),
+         strings.Contains(mime, "compressed"),
+         strings.Contains(mime, "tar"),
+         strings.Contains(mime, "iso9660"):       return "archive"
+    case strings.HasPrefix(mime, "text/"):        return "text"
+    case strings.HasPrefix(mime, "image/"):       return "image"
+    case strings.HasPrefix(mime, "audio/"):       return "audio"
+    case strings.HasPrefix(mime, "video/"):       return "video"
+  }
+  return "file"
+}
+
+// Returns the HTML for displaying the icon called name from embedded.IndexIcons.
+func iconHTML(name string) string {
+  return fmt.Sprintf(`<svg width="16" height="16" aria-hidden="true"><use href="#icon-%v"/></svg>`, name)
+}
+
+// Files that control index generation and are therefore not listed.
+var notListed = map[string]bool{"index.html":true, "index.xhtml":true, "index.css":true}
+
+// Writes the table of directory entries of the directory described by info
+// to w, with headings in language lang.
+func writeListing(w io.Writer, info *indexInfo, parent *indexInfo, lang string) error {
+  names := make([]string, 0, len(info.files))
+  for name := range info.files {
+    if !notListed[name] && listable(info.path, path.Join(info.path, name)) { names = append(names, name) }
+  }
+  // Directories first, then files. Both sorted by name.
+  sort.Slice(names, func(i, j int) bool {
+    di, dj := info.files[names[i]].Info.IsDir(), info.files[names[j]].Info.IsDir()
+    if di != dj { return di }
+    return names[i] < names[j]
+  })
+  
+  // The description column is only included if there are descriptions.
+  descriptions := info.fileDescriptions()
+  desc_head := ""
+  desc_empty := ""
+  for _, name := range names {
+    if descriptions[name] != "" {
+      desc_head = "<th>" + template.HTMLEscapeString(translate(lang, "Description")) + "</th>"
+      desc_empty = "<td></td>"
+      break
+    }
+  }
+  
+  w.Write(embedded.IndexIcons)
+  fmt.Fprintf(w, "<table class=\"index\">\n<thead><tr><th class=\"icon\"></th><th>%v</th><th>%v</th><th>%v</th>%v</tr></thead>\n<tbody>\n",
+              template.HTMLEscapeString(translate(lang, "Name")),
+              template.HTMLEscapeString(translate(lang, "Size")),
+              template.HTMLEscapeString(translate(lang, "Last modified")),
+              desc_head)
+  if parent != nil {
+    fmt.Fprintf(w, "<tr class=\"parent\"><td class=\"icon\">%v</td><td><a href=\"../\">%v</a></td><td></td><td></td>%v</tr>\n",
+                iconHTML("parent"),
+                template.HTMLEscapeString(translate(lang, "Parent directory")),
+                desc_empty)
+  }
+  for _, name := range names {
+    x := info.files[name]
+    href := (&url.URL{Path:name}).String()
+    if strings.Contains(name, ":") { href = "./" + href } // don't mistake name for a URL scheme
+    size := formatSize(x.Info.Size(), info.size_format)
+    class := "file"
+    if x.Info.IsDir() {
+      href += "/"
+      size = "-"
+      class = "dir"
+    }
+    desc := desc_empty
+    if desc_head != "" && descriptions[name] != "" {
+      desc = "<td class=\"description\">" + template.HTMLEscapeString(descriptions[name]) + "</td>"
+    }
+    fmt.Fprintf(w, "<tr class=\"%v\"><td class=\"icon\">%v</td><td><a href=\"%v\">%v</a></td><td>%v</td><td>%v</td>%v</tr>\n",
+                class, iconHTML(icon(name, x)), template.HTMLEscapeString(href), template.HTMLEscapeString(name), size,
+                x.Info.ModTime().UTC().Format("2006-01-02 15:04"), desc)
+  }
+  fmt.Fprintf(w, "</tbody>\n</table>")
+  return nil
 }
 
 // Takes the directory tree starting at root and builds a tree of indexInfo
@@ -61,6 +467,8 @@ func buildMetaIndex(root map[string]*File, title string) [][]indexInfo {
   tree[0] = make([]indexInfo,3) // 3 because we have a dummy entry before and after root
   tree[0][1].files = root
   tree[0][1].title = title
+  tree[0][1].dir = dirPath(root)
+  tree[0][1].path = "/"
   level := 0
   for len(tree[level]) > 2 { // We stop when a level consists only of the 2 dummy entries every level has
     level++
@@ -76,6 +484,9 @@ func buildMetaIndex(root map[string]*File, title string) [][]indexInfo {
       if level > 1 {
         parent.navbar_root = tree[level-2][parent.parent].navbar_root - 1
         parent.navbar_type = tree[level-2][parent.parent].navbar_type
+        parent.size_format = tree[level-2][parent.parent].size_format
+        parent.robots = tree[level-2][parent.parent].robots
+        parent.password = tree[level-2][parent.parent].password
       }
       
       // default value for indexfile. Will be overridden if something better is found.
@@ -86,13 +497,13 @@ func buildMetaIndex(root map[string]*File, title string) [][]indexInfo {
       
       for name, x := range parent.files {
         if x.Info.IsDir() {
-          tree[level] = append(tree[level], indexInfo{parent:i, files:x.Contents, title:name})
+          tree[level] = append(tree[level], indexInfo{parent:i, files:x.Contents, title:name, modtime:x.Info.ModTime(), dir:dirPath(x.Contents), path:path.Join(parent.path, name)})
         }
         
         switch name {
           case "index.css":   err := getDirectivesFromStyles(x, parent)
                               if err != nil {
-                                util.Log(0, "ERROR! %v: %v", parent.indexfile, err)
+                                util.Log(0, "ERROR! %v: %v", x, err)
                               }
           case "index.html":  if indexfile_prio < 2 {
                                 indexfile_prio = 2
@@ -123,12 +534,22 @@ func buildMetaIndex(root map[string]*File, title string) [][]indexInfo {
       }
       
       // Parse directives from indexfile if it is something other than DefaultIndex.
-      if indexfile_prio > 0 {
+      // An index.xhtml that cannot be used is replaced by the default index.
+      if indexfile_prio == 1 && parent.indexfile.Info.Size() > maxIndexTemplate {
+        parent.template_err = fmt.Errorf("Larger than %v bytes", maxIndexTemplate)
+      } else if indexfile_prio > 0 {
         err := getDirectivesFromXHTMLHeader(parent.indexfile, parent)
-        if err != nil {
+        if err != nil && indexfile_prio == 1 {
+          parent.template_err = err
+        } else if err != nil {
           util.Log(0, "ERROR! %v: %v", parent.indexfile, err)
         }
       }
+      if parent.template_err != nil {
+        util.Log(0, "ERROR! %v: %v => Using the default index for %v", parent.indexfile, parent.template_err, parent.path)
+        parent.template_err_file = parent.indexfile.String()
+        parent.indexfile = defaultIndex
+      }
       
       // If we haven't actually added any children, reset first_child to 0
       if len(tree[level]) == parent.first_child {
@@ -146,6 +567,11 @@ const AUTO = 0
 const NAVBAR_SHALLOW = 1
 const NAVBAR_DEEP = 2
 
+// Sizes are displayed in B, KiB, MiB,... with the exact byte count as tooltip.
+const SIZE_HUMAN = 0
+// Sizes are displayed as exact byte counts.
+const SIZE_EXACT = 1
+
 // Stores information used to create a single index.html.
 type indexInfo struct {
   // indexInfos are linked together to form a tree stored in a [][]indexInfo
@@ -171,6 +597,11 @@ type indexInfo struct {
   // an xhtml file that may contain processing instructions
   // for garçon to handle in order to produce the index.html file.
   index_verbatim bool
+  
+  // If not nil, the index.xhtml template_err_file could not be used because
+  // of template_err and indexfile is the default index instead.
+  template_err error
+  template_err_file string
 
   // If non-nil, this is a picture that somehow represents this directory.
   indexpic *File
@@ -186,12 +617,38 @@ type indexInfo struct {
   // (if index_verbatim==false).
   navbar_type int
   
+  // SIZE_HUMAN or SIZE_EXACT. How file sizes are displayed in the generated
+  // index. Set with the directive size-format and inherited by subdirectories.
+  size_format int
+  
+  // Content of the robots <meta> tag for the generated index, e.g. "noindex, nofollow".
+  // "" if there should be none. Set with the directive robots and inherited by subdirectories.
+  robots string
+  
+  // The hashed password required for everything in this directory
+  // (see HashDirPassword()). "" if there is none. Set with the directive
+  // password and inherited by subdirectories.
+  password string
+  
   // The description of this directory (if provided by indexfile).
   description string
   
   // The title of this directory, either provided by indexfile or taken
   // from the name of the directory.
   title string
+  
+  // The modification time of the directory itself. Zero if unknown.
+  modtime time.Time
+  
+  // The directory on disk. "" if unknown.
+  dir string
+  
+  // The URL path of the directory, e.g. "/" or "/foo/bar".
+  path string
+  
+  // Maps names of entries to their descriptions. nil until computed
+  // by fileDescriptions().
+  descriptions map[string]string
 }
 
 /*
@@ -205,12 +662,33 @@ type indexInfo struct {
 func getDirectivesFromStyles(x *File, info *indexInfo) error {
   r,_,err := x.GetStream(false)
   if err != nil { return err }
+  css, err := ioutil.ReadAll(r)
+  r.Close()
+  if err != nil { return err }
   
-  if r == nil { panic("foo") }
+  css = cssComment.ReplaceAll(css, nil)
+  for _, block := range garconStyles.FindAllSubmatch(css, -1) {
+    for _, decl := range strings.Split(string(block[1]), ";") {
+      if strings.TrimSpace(decl) == "" { continue }
+      kv := strings.SplitN(decl, ":", 2)
+      if len(kv) != 2 {
+        return fmt.Errorf("Syntax error in config[id=\"garçon\"]: %v", strings.TrimSpace(decl))
+      }
+      value := strings.Trim(strings.TrimSpace(kv[1]), `"'`)
+      if err := info.setDirective(strings.TrimSpace(kv[0]), value); err != nil {
+        return err
+      }
+    }
+  }
   
   return nil
 }
 
+var cssComment = regexp.MustCompile(`(?s)/\*.*?\*/`)
+
+// Matches a config[id="garçon"]{...} rule and captures the declarations.
+var garconStyles = regexp.MustCompile(`config\[id=["']?garçon["']?\]\s*\{([^}]*)\}`)
+
 /*
   Parses the <head> part of (X)HTML file x and extracts Garçon directives
   from it that concern index generation and stores them in info.
@@ -218,6 +696,11 @@ func getDirectivesFromStyles(x *File, info *indexInfo) error {
   plain HTML files, too, because any XML-invalidities will not surface
   until after the end of the <head> section.
   
+  The following is recognized:
+    <title>...</title>                      sets the title
+    <meta name="description" content="..."> sets the description
+    <?garçon key="value" ...?>              sets the directive key to value
+  
   NOTE: This function will actually parse until it sees <body>. The
   existence of an actual <head> tag is not required, nor is the
   existence of <html>.
@@ -227,9 +710,93 @@ func getDirectivesFromStyles(x *File, info *indexInfo) error {
 func getDirectivesFromXHTMLHeader(x *File, info *indexInfo) error {
   r,_,err := x.GetStream(false)
   if err != nil { return err }
+  defer r.Close()
   
-  if r == nil { panic("foo") }
+  dec := xml.NewDecoder(r)
+  dec.Strict = false
+  dec.AutoClose = xml.HTMLAutoClose
+  dec.Entity = xml.HTMLEntity
+  
+  in_title := false
+  title := ""
+  for {
+    tok, err := dec.Token()
+    if err != nil { break }
+    switch t := tok.(type) {
+      case xml.StartElement:
+        switch strings.ToLower(t.Name.Local) {
+          case "body":  return nil
+          case "title": in_title = true
+          case "meta":  if strings.ToLower(attr(t, "name")) == "description" {
+                          info.description = attr(t, "content")
+                        }
+        }
+      case xml.EndElement:
+        if strings.ToLower(t.Name.Local) == "title" {
+          in_title = false
+          if t := strings.TrimSpace(title); t != "" { info.title = t }
+        }
+      case xml.CharData:
+        if in_title { title += string(t) }
+      case xml.ProcInst:
+        if t.Target == "garçon" {
+          for key, value := range parseDirectives(string(t.Inst)) {
+            if err := info.setDirective(key, value); err != nil {
+              return err
+            }
+          }
+        }
+    }
+  }
   
   return nil
 }
 
+// Returns the value of the attribute named name (case-insensitive) of el or "".
+func attr(el xml.StartElement, name string) string {
+  for _, a := range el.Attr {
+    if strings.ToLower(a.Name.Local) == name { return a.Value }
+  }
+  return ""
+}
+
+var directiveRegexp = regexp.MustCompile(`([a-z-]+)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+
+// Parses key="value" pairs from the contents of a processing instruction.
+// A processing instruction without any pairs (e.g. <?garçon title?>)
+// marks the place where generated content is to be inserted and yields no directives.
+func parseDirectives(inst string) map[string]string {
+  directives := map[string]string{}
+  for _, m := range directiveRegexp.FindAllStringSubmatch(inst, -1) {
+    directives[m[1]] = m[2] + m[3]
+  }
+  return directives
+}
+
+// Applies the directive key="value" to info.
+func (info *indexInfo) setDirective(key, value string) error {
+  switch key {
+    case "title":       info.title = value
+    case "description": info.description = value
+    case "robots":      robots := []string{}
+                        for _, r := range strings.Split(value, ",") {
+                          r = strings.ToLower(strings.TrimSpace(r))
+                          switch r {
+                            case "": continue
+                            case "index", "follow", "noindex", "nofollow", "all", "none":
+                            default: return fmt.Errorf("Unknown robots value: %v", r)
+                          }
+                          robots = append(robots, r)
+                        }
+                        info.robots = strings.Join(robots, ", ")
+    case "password":    if _, _, _, err := parseDirPassword(value); err != nil { return err }
+                        info.password = value
+    case "size-format": switch value {
+                          case "human": info.size_format = SIZE_HUMAN
+                          case "exact": info.size_format = SIZE_EXACT
+                          default:      return fmt.Errorf("Unknown size-format: %v", value)
+                        }
+    default:            return fmt.Errorf("Unknown directive: %v", key)
+  }
+  return nil
+}
@@ -0,0 +1,162 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "os"
+         "bytes"
+         "regexp"
+         "strings"
+         "testing"
+         "io/ioutil"
+         "compress/gzip"
+         "net/http/httptest"
+         
+         "github.com/mbenkmann/golib/util"
+       )
+
+/*
+  Creates a tree in a temporary directory with
+    manual.pdf.gz           served and listed only as manual.pdf (Hide)
+    real/a.txt
+    real/doc.pdf.gz         served and listed only as doc.pdf
+    real/sub/up -> ..       a loop
+    linked -> real          a symlinked directory
+    loop -> .               a loop
+    dangling -> nowhere     a dangling symlink
+  and returns a FileManager for it and the directory.
+*/
+func aliasTree(t *testing.T) (*FileManager, string) {
+  util.LogLevel = -1
+  dir, err := ioutil.TempDir("", "garcon-index-test")
+  if err != nil { t.Fatal(err) }
+  t.Cleanup(func() { os.RemoveAll(dir) })
+  
+  gz := func(s string) []byte {
+    var buf bytes.Buffer
+    w := gzip.NewWriter(&buf)
+    w.Write([]byte(s))
+    w.Close()
+    return buf.Bytes()
+  }
+  files := map[string][]byte{
+    "manual.pdf.gz": gz("manual"),
+    "real/a.txt": []byte("hello"),
+    "real/doc.pdf.gz": gz("doc"),
+  }
+  if err = os.MkdirAll(dir + "/real/sub", 0755); err != nil { t.Fatal(err) }
+  for name, data := range files {
+    if err = ioutil.WriteFile(dir + "/" + name, data, 0644); err != nil { t.Fatal(err) }
+  }
+  links := map[string]string{
+    "real/sub/up": "..",
+    "linked": "real",
+    "loop": ".",
+    "dangling": "nowhere",
+  }
+  for name, target := range links {
+    if err = os.Symlink(target, dir + "/" + name); err != nil { t.Fatal(err) }
+  }
+  
+  hand := []Handling{
+    {Match:regexp.MustCompile(`^\.`), Hide:true},
+    {Match:regexp.MustCompile(`\.pdf\.gz$`), Gzip:`.pdf`, Hide:true},
+    {Match:regexp.MustCompile(``)},
+  }
+  fm, err := NewFileManager(dir, hand)
+  if err != nil { t.Fatal(err) }
+  return fm, dir
+}
+
+// Sends a GET request for p to fm and returns the status and body.
+func get(fm *FileManager, p string) (int, string) {
+  w := httptest.NewRecorder()
+  r := httptest.NewRequest("GET", p, nil)
+  fm.ServeHTTP(w, r)
+  return w.Code, w.Body.String()
+}
+
+// Returns the index page of directory p (with trailing slash).
+func index(t *testing.T, fm *FileManager, p string) string {
+  status, body := get(fm, p)
+  if status != 200 { t.Fatalf("GET %v: %v", p, status) }
+  return body
+}
+
+func TestIndexAliasHide(t *testing.T) {
+  fm, _ := aliasTree(t)
+  idx := index(t, fm, "/")
+  if !strings.Contains(idx, `<a href="manual.pdf">manual.pdf</a>`) {
+    t.Errorf("Alias manual.pdf not listed and linked:\n%v", idx)
+  }
+  if strings.Contains(idx, "manual.pdf.gz") {
+    t.Errorf("Hidden original manual.pdf.gz listed:\n%v", idx)
+  }
+  if status, body := get(fm, "/manual.pdf"); status != 200 || body != "manual" {
+    t.Errorf("GET /manual.pdf: %v %q", status, body)
+  }
+  if status, _ := get(fm, "/manual.pdf.gz"); status != 404 {
+    t.Errorf("GET /manual.pdf.gz: %v, expected 404", status)
+  }
+}
+
+func TestIndexSymlinkedDirectory(t *testing.T) {
+  fm, _ := aliasTree(t)
+  idx := index(t, fm, "/")
+  if !strings.Contains(idx, `<a href="linked/">linked</a>`) {
+    t.Errorf("Symlinked directory not listed as directory:\n%v", idx)
+  }
+  
+  idx = index(t, fm, "/linked/")
+  for _, name := range []string{"a.txt", "doc.pdf", "sub/"} {
+    if !strings.Contains(idx, `<a href="` + name + `">`) {
+      t.Errorf("%v not listed in symlinked directory:\n%v", name, idx)
+    }
+  }
+  if strings.Contains(idx, "doc.pdf.gz") {
+    t.Errorf("Hidden original doc.pdf.gz listed in symlinked directory:\n%v", idx)
+  }
+  if status, body := get(fm, "/linked/a.txt"); status != 200 || body != "hello" {
+    t.Errorf("GET /linked/a.txt: %v %q", status, body)
+  }
+  if status, body := get(fm, "/linked/doc.pdf"); status != 200 || body != "doc" {
+    t.Errorf("GET /linked/doc.pdf: %v %q", status, body)
+  }
+}
+
+func TestIndexSymlinkLoop(t *testing.T) {
+  fm, _ := aliasTree(t)
+  if idx := index(t, fm, "/"); strings.Contains(idx, `href="loop`) {
+    t.Errorf("Symlink to the directory that contains it listed:\n%v", idx)
+  }
+  if idx := index(t, fm, "/real/sub/"); strings.Contains(idx, `href="up`) {
+    t.Errorf("Symlink to parent directory listed:\n%v", idx)
+  }
+  for _, p := range []string{"/loop/", "/real/sub/up/", "/linked/sub/up/"} {
+    if status, _ := get(fm, p); status != 404 {
+      t.Errorf("GET %v: %v, expected 404", p, status)
+    }
+  }
+}
+
+func TestIndexDanglingSymlink(t *testing.T) {
+  fm, _ := aliasTree(t)
+  if idx := index(t, fm, "/"); strings.Contains(idx, "dangling") {
+    t.Errorf("Dangling symlink listed:\n%v", idx)
+  }
+  if status, _ := get(fm, "/dangling"); status != 404 {
+    t.Errorf("GET /dangling: %v, expected 404", status)
+  }
+}
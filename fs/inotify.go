@@ -0,0 +1,122 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "fmt"
+         "time"
+         "unsafe"
+         "syscall"
+         "sync/atomic"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../linux"
+         "../status"
+       )
+
+// What can trigger a rescan of the tree, for garcon_rescans_total.
+var rescanTriggers = []string{"start", "inotify", "poll", "request", "retry", "publish"}
+
+// The metrics of the inotify watches and the rescans of a tree.
+type watchStats struct {
+  events *status.Counter
+  overflows *status.Counter
+  rescans map[string]*status.Counter
+  // The number of watches added to the current inotify instance. Atomic.
+  watches int64
+}
+
+// Creates the metrics of the watches of the tree rootdir.
+func newWatchStats(rootdir string) *watchStats {
+  w := &watchStats{rescans:map[string]*status.Counter{}}
+  w.events = status.NewCounter(fmt.Sprintf(`garcon_inotify_events_total{root=%q}`, rootdir), "inotify events read for the tree.")
+  w.overflows = status.NewCounter(fmt.Sprintf(`garcon_inotify_overflows_total{root=%q}`, rootdir), "inotify event queue overflows (IN_Q_OVERFLOW) of the tree.")
+  for _, trigger := range rescanTriggers {
+    w.rescans[trigger] = status.NewCounter(fmt.Sprintf(`garcon_rescans_total{root=%q,trigger=%q}`, rootdir, trigger), "Rescans of the tree by what triggered them.")
+  }
+  status.NewGauge(fmt.Sprintf(`garcon_inotify_watches{root=%q}`, rootdir), "inotify watches on the directories of the tree.", func() int64 {
+    return atomic.LoadInt64(&w.watches)
+  })
+  return w
+}
+
+// Adds the inotify watch for the directory dir, creating the inotify instance if necessary.
+func (fm *FileManager) addWatch(dir string) error {
+  var err error
+  if fm.inotify < 0 {
+    fm.inotify, err = syscall.InotifyInit()
+    if err != nil { return err }
+  }
+  _, err = syscall.InotifyAddWatch(fm.inotify, dir, syscall.IN_CLOSE_WRITE|syscall.IN_CREATE|syscall.IN_DELETE|syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF|syscall.IN_MOVED_FROM|syscall.IN_MOVED_TO|syscall.IN_ONESHOT)
+  if err == syscall.ENOSPC {
+    return fmt.Errorf("%v: Too many inotify watches. Raise fs.inotify.max_user_watches (e.g. sysctl fs.inotify.max_user_watches=1048576)", dir)
+  }
+  if err != nil { return err }
+  atomic.AddInt64(&fm.watchStats.watches, 1)
+  return nil
+}
+
+// Closes the inotify instance, which removes all watches.
+func (fm *FileManager) closeWatches() error {
+  if fm.inotify < 0 { return nil }
+  err := syscall.Close(fm.inotify)
+  fm.inotify = -1
+  atomic.StoreInt64(&fm.watchStats.watches, 0)
+  return err
+}
+
+/*
+  Waits until the inotify watches report a change or, if a poll interval
+  is set (see SetScanIntervals()), until it has passed since the last
+  rescan. Returns what triggered the rescan, "inotify" or "poll". All
+  events that are queued are read, so that an overflow of the queue is
+  noticed.
+*/
+func (fm *FileManager) waitForChanges() (string, error) {
+  if fm.poll > 0 {
+    timeout := time.Until(time.Unix(0, atomic.LoadInt64(&fm.refreshed)).Add(fm.poll))
+    if timeout < 0 { timeout = 0 }
+    ready, err := linux.WaitReadable(fm.inotify, timeout)
+    if err != nil { return "inotify", err }
+    if !ready {
+      util.Log(2, "Polling %v", fm.root())
+      return "poll", nil
+    }
+  }
+  var buf [4096]byte
+  for {
+    n, err := syscall.Read(fm.inotify, buf[:])
+    if err != nil { return "inotify", err }
+    fm.countEvents(buf[:n])
+    ready, err := linux.WaitReadable(fm.inotify, 0)
+    if err != nil || !ready { return "inotify", err }
+  }
+}
+
+// Counts the inotify events in buf and warns if the queue has overflowed.
+func (fm *FileManager) countEvents(buf []byte) {
+  for len(buf) >= syscall.SizeofInotifyEvent {
+    ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[0]))
+    fm.watchStats.events.Inc()
+    if ev.Mask & syscall.IN_Q_OVERFLOW != 0 {
+      fm.watchStats.overflows.Inc()
+      util.Log(0, "WARNING! inotify event queue for %v overflowed => Full rescan. If this happens often, raise fs.inotify.max_queued_events (e.g. sysctl fs.inotify.max_queued_events=65536)", fm.root())
+    }
+    next := syscall.SizeofInotifyEvent + int(ev.Len)
+    if next > len(buf) { break }
+    buf = buf[next:]
+  }
+}
@@ -0,0 +1,90 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "sort"
+         "strings"
+         "strconv"
+         "net/http"
+         
+         "../embedded"
+       )
+
+// If non-empty, generated index pages are always in this language.
+// Otherwise the language is chosen from the client's Accept-Language
+// header. Must be one of Languages().
+var IndexLanguage = ""
+
+// The language of generated index pages if the client accepts none
+// of the available languages.
+const defaultLanguage = "en"
+
+// Returns the languages for which generated index pages are available.
+func Languages() []string {
+  langs := []string{defaultLanguage}
+  for lang := range embedded.Messages {
+    langs = append(langs, lang)
+  }
+  sort.Strings(langs[1:])
+  return langs
+}
+
+// Returns the languages in which index pages need to be generated.
+// The first language is the one used in the directory tree.
+func indexLanguages() []string {
+  if IndexLanguage != "" { return []string{IndexLanguage} }
+  return Languages()
+}
+
+// Returns the translation of the English string s into lang.
+// If there is none, s is returned.
+func translate(lang, s string) string {
+  if t, ok := embedded.Messages[lang][s]; ok { return t }
+  return s
+}
+
+/*
+  Returns the element of available that best matches the Accept-Language
+  header of r. If the client does not accept any of them, defaultLanguage
+  is returned. Language ranges with a subtag (e.g. "de-AT") match
+  their primary language (e.g. "de").
+*/
+func negotiateLanguage(r *http.Request, available map[string]*File) string {
+  best := defaultLanguage
+  bestq := 0.0
+  for _, als := range r.Header["Accept-Language"] {
+    for _, al := range strings.Split(als, ",") {
+      parts := strings.Split(al, ";")
+      lang := strings.ToLower(strings.TrimSpace(parts[0]))
+      q := 1.0
+      for _, param := range parts[1:] {
+        param = strings.TrimSpace(param)
+        if strings.HasPrefix(param, "q=") {
+          var err error
+          if q, err = strconv.ParseFloat(param[2:], 64); err != nil { q = 0 }
+        }
+      }
+      if q <= bestq { continue }
+      if lang == "*" { lang = defaultLanguage }
+      if _, ok := available[lang]; !ok {
+        lang = strings.SplitN(lang, "-", 2)[0]
+        if _, ok = available[lang]; !ok { continue }
+      }
+      best, bestq = lang, q
+    }
+  }
+  return best
+}
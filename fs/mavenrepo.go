@@ -0,0 +1,263 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "io"
+         "fmt"
+         "hash"
+         "path"
+         "sort"
+         "time"
+         "bytes"
+         "strings"
+         "crypto/md5"
+         "crypto/sha1"
+         "crypto/sha256"
+         "crypto/sha512"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../maven"
+       )
+
+/*
+  A directory in Maven repository layout, e.g.
+    org/example/foo/1.0/foo-1.0.jar
+  to which mvn deploy and Gradle's maven-publish can upload with PUT
+  requests (missing directories are created) and which Maven and Gradle
+  can use as repository. Whenever the scan finds that files have been
+  added, replaced or removed, the maven-metadata.xml of each artifact
+  (and of each SNAPSHOT version with timestamped files) is regenerated
+  from the version directories and the checksum files (.md5, .sha1,
+  .sha256 and .sha512) of all files are written where they are missing
+  or wrong.
+*/
+type mavenRepo struct {
+  // URL path of the directory (without trailing slash).
+  prefix string
+  
+  // Describes the files the current metadata has been generated from.
+  state string
+}
+
+/*
+  Makes the directory prefix a Maven repository (see mavenRepo). Uploads
+  below prefix are allowed like for AddUploadPrefix(). The metadata is
+  generated by AutoUpdate(), starting right away.
+  Call before AutoUpdate() and before ServeHTTP() is called for the first time.
+*/
+func (fm *FileManager) AddMavenRepo(prefix string) {
+  fm.maven_repos = append(fm.maven_repos, &mavenRepo{prefix:strings.TrimSuffix(path.Clean(prefix), "/")})
+}
+
+// Returns the Maven repository that contains the path clean or nil.
+func (fm *FileManager) mavenRepoFor(clean string) *mavenRepo {
+  for _, repo := range fm.maven_repos {
+    if strings.HasPrefix(clean, repo.prefix + "/") { return repo }
+  }
+  return nil
+}
+
+/*
+  Creates the missing directories for an upload to the path clean if it is
+  in a Maven repository, because mvn and Gradle do not create them first.
+*/
+func (fm *FileManager) ensureMavenDirs(clean string) error {
+  repo := fm.mavenRepoFor(clean)
+  if repo == nil { return nil }
+  fm.uploadmutex.Lock()
+  defer fm.uploadmutex.Unlock()
+  return fm.makeParents(repo.prefix, clean)
+}
+
+/*
+  Regenerates the metadata and checksums of every Maven repository in tree
+  whose files have changed since its last update. The new files are picked
+  up by the next scan.
+  Must only be called by the goroutine that scans the directory tree.
+*/
+func (fm *FileManager) updateMavenRepos(tree map[string]*File) {
+  sums := map[uint64]map[string]string{}
+  for _, repo := range fm.maven_repos {
+    dir := fileAt(tree, strings.TrimPrefix(repo.prefix, "/"))
+    if dir == nil || !dir.Info.IsDir() {
+      if repo.state != "-" { util.Log(0, "WARNING! Maven repository %v: No such directory", repo.prefix) }
+      repo.state = "-"
+      continue
+    }
+    
+    files := map[string]*File{}
+    collectMavenFiles("", dir.Contents, files)
+    names := []string{}
+    for name := range files { names = append(names, name) }
+    sort.Strings(names)
+    var state bytes.Buffer
+    for _, name := range names { fmt.Fprintf(&state, "%v %v\n", name, files[name].Id) }
+    if state.String() == repo.state {
+      for _, x := range files {
+        if s := fm.maven_sums[x.Id]; s != nil { sums[x.Id] = s }
+      }
+      continue
+    }
+    
+    root := path.Join(fm.scanroot, repo.prefix)
+    written := 0
+    err := writeMavenMetadata(root, "", dir, &written)
+    for _, name := range names {
+      if err != nil { break }
+      x := files[name]
+      s := fm.maven_sums[x.Id]
+      if s == nil {
+        stream, _, err := x.GetStream(true)
+        if err != nil {
+          util.Log(0, "WARNING! Maven repository %v: %v: %v", repo.prefix, name, err)
+          continue
+        }
+        s, err = mavenChecksums(stream)
+        stream.Close()
+        if err != nil {
+          util.Log(0, "WARNING! Maven repository %v: %v: %v", repo.prefix, name, err)
+          continue
+        }
+      }
+      sums[x.Id] = s
+      parent := dir
+      if p := path.Dir(name); p != "." { parent = fileAt(dir.Contents, p) }
+      err = writeMavenChecksums(root, name, s, parent, &written)
+    }
+    if err != nil {
+      util.Log(0, "ERROR! Maven repository %v: %v", repo.prefix, err)
+      continue
+    }
+    if written > 0 { util.Log(1, "Maven repository %v: %v metadata and checksum files written", repo.prefix, written) }
+    repo.state = state.String()
+  }
+  // Forget the checksums of files that are gone.
+  fm.maven_sums = sums
+}
+
+// Adds the files (other than checksums) below dir, whose path relative to
+// the repository is dirpath, to files by their relative paths.
+func collectMavenFiles(dirpath string, dir map[string]*File, files map[string]*File) {
+  for name, x := range dir {
+    if x.Info.IsDir() {
+      collectMavenFiles(dirpath + name + "/", x.Contents, files)
+    } else if !maven.IsChecksum(name) && name != "index.html" && x.Encoding == "" {
+      files[dirpath + name] = x
+    }
+  }
+}
+
+/*
+  Writes the maven-metadata.xml files below dir, whose path relative to the
+  repository is rel and whose path on disk is root/rel, that differ from what
+  is there. A directory is an artifact if it has version subdirectories with
+  files named <artifact>-<version>... Increments *written for each file.
+*/
+func writeMavenMetadata(root, rel string, dir *File, written *int) error {
+  artifact := path.Base(rel)
+  versions := []string{}
+  var lastUpdated time.Time
+  for name, x := range dir.Contents {
+    if !x.Info.IsDir() { continue }
+    if rel != "" && strings.Contains(rel, "/") && isMavenVersion(artifact, name, x) {
+      versions = append(versions, name)
+      // The mtimes of the generated files are ignored, so that the metadata
+      // does not change just because it has been written.
+      files := []string{}
+      var updated time.Time
+      for f, y := range x.Contents {
+        if y.Info.IsDir() || f == "maven-metadata.xml" || maven.IsChecksum(f) { continue }
+        files = append(files, f)
+        if y.Info.ModTime().After(updated) { updated = y.Info.ModTime() }
+      }
+      if updated.After(lastUpdated) { lastUpdated = updated }
+      if strings.HasSuffix(name, "-SNAPSHOT") {
+        var buf bytes.Buffer
+        ok, err := maven.WriteSnapshotMetadata(&buf, mavenGroupId(rel), artifact, name, files, updated)
+        if err == nil && ok { err = writeIfChanged(path.Join(root, rel, name), x.Contents["maven-metadata.xml"], buf.Bytes(), written) }
+        if err != nil { return err }
+      }
+      continue
+    }
+    err := writeMavenMetadata(root, path.Join(rel, name), x, written)
+    if err != nil { return err }
+  }
+  if len(versions) == 0 { return nil }
+  
+  var buf bytes.Buffer
+  err := maven.WriteArtifactMetadata(&buf, mavenGroupId(rel), artifact, versions, lastUpdated)
+  if err != nil { return err }
+  return writeIfChanged(path.Join(root, rel), dir.Contents["maven-metadata.xml"], buf.Bytes(), written)
+}
+
+// Returns true if the directory x called version contains files of the version of artifact.
+func isMavenVersion(artifact, version string, x *File) bool {
+  prefix := artifact + "-" + strings.TrimSuffix(version, "-SNAPSHOT")
+  for name, y := range x.Contents {
+    if !y.Info.IsDir() && strings.HasPrefix(name, prefix) { return true }
+  }
+  return false
+}
+
+// Returns the groupId of the artifact directory rel, e.g. "org.example" for "org/example/foo".
+func mavenGroupId(rel string) string {
+  return strings.Replace(path.Dir(rel), "/", ".", -1)
+}
+
+// Writes maven-metadata.xml with data to dir unless old (the current file or nil) has that content.
+func writeIfChanged(dir string, old *File, data []byte, written *int) error {
+  if old != nil {
+    content, err := readAll(old)
+    if err == nil && bytes.Equal(content, data) { return nil }
+  }
+  *written++
+  return writeFileAtomic(dir, "maven-metadata.xml", data)
+}
+
+// Returns the checksums of the data in r by type (see maven.ChecksumTypes).
+func mavenChecksums(r io.Reader) (map[string]string, error) {
+  hashes := []hash.Hash{md5.New(), sha1.New(), sha256.New(), sha512.New()}
+  writers := []io.Writer{}
+  for _, h := range hashes { writers = append(writers, h) }
+  _, err := io.Copy(io.MultiWriter(writers...), r)
+  if err != nil { return nil, err }
+  sums := map[string]string{}
+  for i, typ := range maven.ChecksumTypes { sums[typ] = fmt.Sprintf("%x", hashes[i].Sum(nil)) }
+  return sums, nil
+}
+
+/*
+  Writes the checksum files for the file name (relative to the repository
+  root on disk) whose checksums are sums, unless the directory dir already
+  contains them with the right checksums. Increments *written for each file.
+*/
+func writeMavenChecksums(root, name string, sums map[string]string, dir *File, written *int) error {
+  for _, typ := range maven.ChecksumTypes {
+    sumfile := path.Base(name) + "." + typ
+    if dir != nil {
+      if x := dir.Contents[sumfile]; x != nil {
+        content, err := readAll(x)
+        fields := strings.Fields(string(content))
+        if err == nil && len(fields) > 0 && strings.ToLower(fields[0]) == sums[typ] { continue }
+      }
+    }
+    *written++
+    err := writeFileAtomic(path.Join(root, path.Dir(name)), sumfile, []byte(sums[typ]))
+    if err != nil { return err }
+  }
+  return nil
+}
@@ -0,0 +1,345 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+
+package fs
+
+import (
+         "io"
+         "os"
+         "fmt"
+         "sort"
+         "path"
+         "unsafe"
+         "runtime"
+         "io/ioutil"
+         "sync/atomic"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../status"
+       )
+
+/*
+  The maximum number of bytes of file data (in-memory files such as generated
+  indexes plus the cache) to keep in memory. 0 means unlimited.
+  When the budget is exceeded, the cache is shrunk first. If in-memory files
+  alone exceed the budget, they are spilled to SpillDir. Without SpillDir
+  the budget can not be enforced and exceeding it only logs a warning,
+  so set both.
+*/
+var MemoryBudget int64 = 0
+
+/*
+  If not "", in-memory files that don't fit into MemoryBudget are written to
+  files below this directory and served from there. The directory must be
+  writable and is interpreted after chroot.
+*/
+var SpillDir = ""
+
+// Estimated memory used by each entry of the tree in addition to its name:
+// the File, its FileInfo and the slot in the directory's map.
+const treeEntryOverhead = int64(unsafe.Sizeof(File{}) + unsafe.Sizeof(FileInfo{})) + 40
+
+// Estimated memory used by the map of each directory of the tree.
+const treeDirOverhead = 48
+
+// Memory used by the different parts of garçon.
+type MemoryStats struct {
+  // Number of entries (files, directories and aliases) in the tree.
+  TreeEntries int
+  
+  // Estimated bytes used by the metadata of the tree's entries.
+  TreeMetadata int64
+  
+  // Bytes held by []byte-backed Files in the tree other than
+  // generated index pages.
+  InMemoryFiles int64
+  
+  // Bytes held by generated index pages (raw and gzipped) including
+  // translations and CanaryIndex versions.
+  Indexes int64
+  
+  // Number of generated index pages.
+  IndexPages int
+  
+  // Bytes of in-memory files that have been spilled to SpillDir.
+  Spilled int64
+  
+  // Bytes held by the cache.
+  Cache int64
+  
+  // Number of entries in the cache.
+  CacheEntries int
+  
+  // Bytes of the buffers used by uploads in progress.
+  UploadBuffers int64
+  
+  // Bytes of allocated heap objects as reported by the Go runtime.
+  // This includes all of the above except Spilled.
+  GoHeap int64
+  
+  // Bytes obtained from the operating system by the Go runtime.
+  GoSys int64
+  
+  // Copy of MemoryBudget.
+  Budget int64
+}
+
+func (m MemoryStats) String() string {
+  return fmt.Sprintf("tree: %v (%v entries), in-memory files: %v, indexes: %v (%v pages), spilled: %v, cache: %v (%v entries), uploads: %v, heap: %v, sys: %v, budget: %v", m.TreeMetadata, m.TreeEntries, m.InMemoryFiles, m.Indexes, m.IndexPages, m.Spilled, m.Cache, m.CacheEntries, m.UploadBuffers, m.GoHeap, m.GoSys, m.Budget)
+}
+
+// Returns the current memory accounting information for fm.
+func (fm *FileManager) MemoryStats() MemoryStats {
+  stats := fm.memoryStats()
+  var ms runtime.MemStats
+  runtime.ReadMemStats(&ms)
+  stats.GoHeap = int64(ms.HeapAlloc)
+  stats.GoSys = int64(ms.Sys)
+  return stats
+}
+
+// Like MemoryStats() but without the (comparatively expensive) Go runtime statistics.
+func (fm *FileManager) memoryStats() MemoryStats {
+  fm.memmutex.Lock()
+  stats := fm.memstats
+  fm.memmutex.Unlock()
+  if fm.cache != nil {
+    stats.CacheEntries, stats.Cache = fm.cache.Stats()
+  }
+  stats.UploadBuffers = atomic.LoadInt64(&uploadBuffersInUse)
+  stats.Budget = MemoryBudget
+  return stats
+}
+
+// Writes the memory accounting information as a status page section to w.
+func (fm *FileManager) WriteMemory(w io.Writer) {
+  m := fm.MemoryStats()
+  fmt.Fprintf(w, "Tree metadata: %v bytes (%v entries, estimated)\n", m.TreeMetadata, m.TreeEntries)
+  fmt.Fprintf(w, "In-memory files: %v bytes\n", m.InMemoryFiles)
+  fmt.Fprintf(w, "Generated indexes: %v bytes (%v pages)\n", m.Indexes, m.IndexPages)
+  fmt.Fprintf(w, "Spilled to disk: %v bytes\n", m.Spilled)
+  fmt.Fprintf(w, "Cache: %v bytes (%v entries)\n", m.Cache, m.CacheEntries)
+  fmt.Fprintf(w, "Upload buffers: %v bytes\n", m.UploadBuffers)
+  fmt.Fprintf(w, "Go heap: %v bytes\n", m.GoHeap)
+  fmt.Fprintf(w, "Go sys: %v bytes\n", m.GoSys)
+  if m.Budget > 0 {
+    fmt.Fprintf(w, "Budget: %v bytes (%v used by in-memory files, indexes and cache)\n", m.Budget, m.InMemoryFiles+m.Indexes+m.Cache)
+  } else {
+    fmt.Fprintf(w, "Budget: unlimited\n")
+  }
+}
+
+/*
+  Registers gauges for the memory accounting information of fm, so that they
+  are exported via status.MetricsHandler.
+*/
+func (fm *FileManager) RegisterMemoryMetrics() {
+  help := "Bytes of memory used by garçon, by area."
+  areas := []struct{ name string; value func(m MemoryStats) int64 }{
+    {"tree", func(m MemoryStats) int64 { return m.TreeMetadata }},
+    {"files", func(m MemoryStats) int64 { return m.InMemoryFiles }},
+    {"indexes", func(m MemoryStats) int64 { return m.Indexes }},
+    {"cache", func(m MemoryStats) int64 { return m.Cache }},
+    {"uploads", func(m MemoryStats) int64 { return m.UploadBuffers }},
+  }
+  for _, area := range areas {
+    value := area.value
+    status.NewGauge(fmt.Sprintf(`garcon_memory_bytes{area="%v"}`, area.name), help, func() int64 { return value(fm.memoryStats()) })
+  }
+  status.NewGauge("garcon_memory_budget_bytes", "The memory budget for in-memory files, indexes and cache (0 = unlimited).", func() int64 { return MemoryBudget })
+  status.NewGauge("garcon_spilled_bytes", "Bytes of in-memory files spilled to disk.", func() int64 { return fm.memoryStats().Spilled })
+  status.NewGauge("garcon_tree_entries", "Number of entries in the directory tree.", func() int64 { return int64(fm.memoryStats().TreeEntries) })
+  status.NewGauge("garcon_cache_entries", "Number of entries in the cache.", func() int64 { return int64(fm.memoryStats().CacheEntries) })
+  status.NewGauge("garcon_go_heap_bytes", "Bytes of allocated heap objects.", func() int64 { return fm.MemoryStats().GoHeap })
+  status.NewGauge("garcon_go_sys_bytes", "Bytes obtained from the operating system by the Go runtime.", func() int64 { return fm.MemoryStats().GoSys })
+}
+
+/*
+  Accounts for the metadata and in-memory files in tree and the index pages
+  in indexes (which are about to become fm's current state) and enforces
+  MemoryBudget.
+*/
+func (fm *FileManager) enforceMemoryBudget(tree map[string]*File, indexes *indexCache) {
+  pages := indexes.pageSet()
+  
+  inmem := []*File{}
+  collectInMemory(tree, &inmem)
+  intree := map[*File]bool{}
+  var size int64
+  for _, f := range inmem {
+    intree[f] = true
+    size += int64(len(f.Data.([]byte)) + len(f.Gzipped))
+  }
+  // Only files in the tree are spilled (because cleanSpillDir() only keeps
+  // those), but translations and CanaryIndex versions count against the budget.
+  for index := range pages {
+    if data, ok := index.Data.([]byte); ok && !intree[index] { size += int64(len(data) + len(index.Gzipped)) }
+  }
+  
+  if MemoryBudget > 0 && size > MemoryBudget {
+    if SpillDir == "" {
+      util.Log(0, "WARNING! In-memory files and indexes use %v bytes which exceeds the memory budget of %v bytes", size, MemoryBudget)
+    } else {
+      // Spill the largest files first to minimize the number of files on disk.
+      sort.Slice(inmem, func(i, j int) bool { return len(inmem[i].Data.([]byte)) > len(inmem[j].Data.([]byte)) })
+      // Files reused from the served tree (e.g. unchanged index pages) may
+      // be read by requests right now, so they are replaced by spilled copies.
+      spilled := map[*File]*File{}
+      for i, f := range inmem {
+        if size <= MemoryBudget { break }
+        n := int64(len(f.Data.([]byte)))
+        s, err := fm.spill(f)
+        if err != nil {
+          util.Log(0, "ERROR! Spilling %v: %v", f, err)
+          continue
+        }
+        spilled[f] = s
+        inmem[i] = s
+        size -= n
+      }
+      if len(spilled) > 0 {
+        replaceFiles(tree, spilled)
+        indexes.replace(spilled)
+        pages = indexes.pageSet()
+      }
+    }
+  }
+  
+  var files, indexsize int64
+  for _, f := range inmem {
+    if data, ok := f.Data.([]byte); ok && !pages[f] { files += int64(len(data)) }
+  }
+  for index := range pages {
+    indexsize += int64(len(index.Gzipped)) // not spilled
+    if data, ok := index.Data.([]byte); ok { indexsize += int64(len(data)) }
+  }
+  entries, meta := treeMetadata(tree)
+  
+  fm.memmutex.Lock()
+  fm.memstats.TreeEntries = entries
+  fm.memstats.TreeMetadata = meta
+  fm.memstats.InMemoryFiles = files
+  fm.memstats.Indexes = indexsize
+  fm.memstats.IndexPages = len(pages)
+  fm.memmutex.Unlock()
+  
+  if fm.cache != nil && MemoryBudget > 0 {
+    fm.cache.Limit(MemoryBudget - size)
+  }
+  
+  util.Log(2, "Memory: %v", fm.memoryStats())
+}
+
+// Returns the number of entries in the directory tree dir and the
+// estimated number of bytes used by their metadata.
+func treeMetadata(dir map[string]*File) (entries int, size int64) {
+  size = treeDirOverhead
+  for name, x := range dir {
+    entries++
+    size += treeEntryOverhead + int64(len(name))
+    if x.Info.IsDir() {
+      n, s := treeMetadata(x.Contents)
+      entries += n
+      size += s
+    }
+  }
+  return entries, size
+}
+
+// Appends all []byte-backed Files in the directory tree dir to inmem.
+// The embedded defaults are not included because they are part of the binary.
+func collectInMemory(dir map[string]*File, inmem *[]*File) {
+  for _, x := range dir {
+    if x.Info.IsDir() {
+      collectInMemory(x.Contents, inmem)
+    } else if _, ok := x.Data.([]byte); ok && x != defaultIndex {
+      *inmem = append(*inmem, x)
+    }
+  }
+}
+
+/*
+  Writes the data of in-memory file f to SpillDir/<f.Id>/<name> and returns
+  a copy of f that refers to that file. f itself is not changed, because it
+  may be part of the currently served tree.
+*/
+func (fm *FileManager) spill(f *File) (*File, error) {
+  data := f.Data.([]byte)
+  dir := path.Join(SpillDir, fmt.Sprintf("%v", f.Id))
+  err := os.MkdirAll(dir, 0700)
+  if err != nil { return nil, err }
+  err = ioutil.WriteFile(path.Join(dir, f.Info.Name()), data, 0600)
+  if err != nil { return nil, err }
+  util.Log(2, "Spilled %v bytes to %v/%v", len(data), dir, f.Info.Name())
+  n := *f
+  n.Data = dir
+  fm.memmutex.Lock()
+  fm.memstats.Spilled += int64(len(data))
+  if fm.spilled == nil { fm.spilled = map[string]int64{} }
+  fm.spilled[dir] = int64(len(data))
+  fm.memmutex.Unlock()
+  return &n, nil
+}
+
+/*
+  Replaces the Files in the directory tree dir that are keys of replacements
+  by their values. dir must not be part of the currently served tree.
+*/
+func replaceFiles(dir map[string]*File, replacements map[*File]*File) {
+  for name, x := range dir {
+    if n, ok := replacements[x]; ok {
+      dir[name] = n
+    } else if x.Info.IsDir() {
+      replaceFiles(x.Contents, replacements)
+    }
+  }
+}
+
+/*
+  Removes spilled files that are no longer referenced by tree.
+  Call this after tree has replaced the previously served tree.
+  
+  NOTE: A request that is currently being served from a spilled file
+  will not be affected because the file has already been opened.
+*/
+func (fm *FileManager) cleanSpillDir(tree map[string]*File) {
+  if SpillDir == "" { return }
+  referenced := map[string]bool{}
+  collectSpilled(tree, referenced)
+  fm.memmutex.Lock()
+  defer fm.memmutex.Unlock()
+  for dir, size := range fm.spilled {
+    if !referenced[dir] {
+      err := os.RemoveAll(dir)
+      if err != nil {
+        util.Log(0, "ERROR! %v", err)
+      }
+      delete(fm.spilled, dir)
+      fm.memstats.Spilled -= size
+    }
+  }
+}
+
+// Adds the directories of all spilled files in tree dir to spilled.
+func collectSpilled(dir map[string]*File, spilled map[string]bool) {
+  for _, x := range dir {
+    if x.Info.IsDir() {
+      collectSpilled(x.Contents, spilled)
+    } else if d, ok := x.Data.(string); ok && SpillDir != "" && path.Dir(d) == path.Clean(SpillDir) {
+      spilled[d] = true
+    }
+  }
+}
@@ -0,0 +1,245 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "io"
+         "fmt"
+         "path"
+         "sort"
+         "time"
+         "strings"
+         "net/http"
+         "io/ioutil"
+         "sync/atomic"
+         "encoding/json"
+         
+         "../status"
+         "../notify"
+         "../problem"
+         "../accesslog"
+       )
+
+// The URL path of the JSON document for mirror directors. See ServeMirrorStatus().
+const MirrorStatusPath = "/mirror-status.json"
+
+// The health of a proxy prefix, as served by ServeMirrorStatus().
+type mirrorHealth struct {
+  Prefix string `json:"prefix"`
+  Upstream string `json:"upstream"`
+  // False if the last attempt to reach upstream failed or a cached
+  // Release file has expired.
+  Healthy bool `json:"healthy"`
+  // The last time upstream answered. nil if it has not been asked yet.
+  LastSync *time.Time `json:"last_sync,omitempty"`
+  LastError string `json:"last_error,omitempty"`
+  LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+  Errors uint64 `json:"errors"`
+  // The bytes of the files being fetched that have not been received yet.
+  PendingBytes int64 `json:"pending_bytes"`
+  // The cached Release files of the suites of an apt proxy.
+  Suites []releaseValidity `json:"suites,omitempty"`
+}
+
+// The Date and Valid-Until of the cached Release file of a suite.
+type releaseValidity struct {
+  Suite string `json:"suite"`
+  Date *time.Time `json:"date,omitempty"`
+  // nil if the Release file does not expire.
+  ValidUntil *time.Time `json:"valid_until,omitempty"`
+  Expired bool `json:"expired"`
+}
+
+// Registers the metrics of the health of p.
+func (p *proxyPrefix) registerHealthMetrics(fm *FileManager) {
+  p.errors = status.NewCounter(`garcon_proxy_upstream_errors_total{prefix="`+p.prefix+`"}`, "Failed attempts to fetch or store a file from upstream of a proxy prefix.")
+  status.NewGauge(`garcon_proxy_last_sync_timestamp_seconds{prefix="`+p.prefix+`"}`, "Unix time when upstream of a proxy prefix last answered.", func() int64 {
+    return atomic.LoadInt64(&p.synced)/int64(time.Second)
+  })
+  status.NewGauge(`garcon_proxy_pending_bytes{prefix="`+p.prefix+`"}`, "Bytes of the files being fetched from upstream of a proxy prefix that have not been received yet.", func() int64 {
+    return atomic.LoadInt64(&p.pending)
+  })
+  if p.debian {
+    status.NewGauge(`garcon_proxy_releases_expired{prefix="`+p.prefix+`"}`, "Cached Release files of an apt proxy whose Valid-Until has passed.", func() int64 {
+      n := int64(0)
+      for _, r := range fm.releaseValidity(p) {
+        if r.Expired { n++ }
+      }
+      return n
+    })
+  }
+}
+
+// Records that upstream of p has answered.
+func (p *proxyPrefix) upstreamOK() {
+  atomic.StoreInt64(&p.synced, time.Now().UnixNano())
+}
+
+// Records that fetching or storing a file from upstream of p failed with err.
+func (p *proxyPrefix) upstreamFailed(err error) {
+  p.errors.Inc()
+  p.mutex.Lock()
+  p.lastError = err.Error()
+  p.lastErrorTime = time.Now()
+  p.mutex.Unlock()
+  notify.Send(notify.MirrorFailed, p.prefix, fmt.Sprintf("Mirror %v failed", p.prefix), fmt.Sprintf("Fetching from %v failed: %v", p.upstream.URL, err))
+}
+
+// Counts the bytes of a body from upstream that have not been read yet as pending.
+type pendingReader struct {
+  io.Reader
+  pending *int64
+  // The bytes that are still counted as pending.
+  left int64
+}
+
+// Wraps body, which has length bytes (-1 if unknown), and counts them as pending for p.
+func (p *proxyPrefix) countPending(body io.Reader, length int64) *pendingReader {
+  if length < 0 { length = 0 }
+  atomic.AddInt64(&p.pending, length)
+  return &pendingReader{body, &p.pending, length}
+}
+
+func (r *pendingReader) Read(b []byte) (int, error) {
+  n, err := r.Reader.Read(b)
+  if m := int64(n); m > 0 && r.left > 0 {
+    if m > r.left { m = r.left }
+    r.left -= m
+    atomic.AddInt64(r.pending, -m)
+  }
+  return n, err
+}
+
+// Stops counting the rest of the body as pending. Call when done reading.
+func (r *pendingReader) done() {
+  atomic.AddInt64(r.pending, -r.left)
+  r.left = 0
+}
+
+// Parses a date of a Release file, e.g. "Sat, 10 Jun 2023 09:22:15 UTC".
+func parseReleaseDate(s string) *time.Time {
+  for _, layout := range []string{time.RFC1123, time.RFC1123Z, "Mon, 2 Jan 2006 15:04:05 MST", "Mon, 2 Jan 2006 15:04:05 -0700"} {
+    if t, err := time.Parse(layout, s); err == nil { return &t }
+  }
+  return nil
+}
+
+// Returns the Date and Valid-Until of the Release files of the suites cached by the apt proxy p.
+func (fm *FileManager) releaseValidity(p *proxyPrefix) []releaseValidity {
+  if !p.debian { return nil }
+  dists := path.Join(fm.root(), p.prefix, "dists")
+  fis, err := ioutil.ReadDir(dists)
+  if err != nil { return nil }
+  var result []releaseValidity
+  now := time.Now()
+  for _, fi := range fis {
+    if !fi.IsDir() || strings.HasPrefix(fi.Name(), ".") { continue }
+    var release []byte
+    if data, err := ioutil.ReadFile(path.Join(dists, fi.Name(), "InRelease")); err == nil {
+      release, _ = clearsignedText(data)
+    }
+    if release == nil {
+      release, err = ioutil.ReadFile(path.Join(dists, fi.Name(), "Release"))
+      if err != nil { continue }
+    }
+    v := releaseValidity{Suite:fi.Name()}
+    if f := releaseField(release, "Date"); f != nil { v.Date = parseReleaseDate(strings.Join(f, " ")) }
+    if f := releaseField(release, "Valid-Until"); f != nil { v.ValidUntil = parseReleaseDate(strings.Join(f, " ")) }
+    v.Expired = v.ValidUntil != nil && now.After(*v.ValidUntil)
+    result = append(result, v)
+  }
+  sort.Slice(result, func(i, j int) bool { return result[i].Suite < result[j].Suite })
+  return result
+}
+
+// Returns the health of all proxy prefixes.
+func (fm *FileManager) mirrorHealth() []*mirrorHealth {
+  result := []*mirrorHealth{}
+  for _, p := range fm.proxies {
+    h := &mirrorHealth{Prefix:p.prefix, Upstream:p.upstream.URL.String(), Errors:p.errors.Value(), PendingBytes:atomic.LoadInt64(&p.pending)}
+    if synced := atomic.LoadInt64(&p.synced); synced != 0 {
+      t := time.Unix(0, synced)
+      h.LastSync = &t
+    }
+    p.mutex.Lock()
+    h.LastError = p.lastError
+    if !p.lastErrorTime.IsZero() {
+      t := p.lastErrorTime
+      h.LastErrorTime = &t
+    }
+    p.mutex.Unlock()
+    h.Suites = fm.releaseValidity(p)
+    h.Healthy = h.LastErrorTime == nil || (h.LastSync != nil && h.LastSync.After(*h.LastErrorTime))
+    for _, s := range h.Suites {
+      if s.Expired { h.Healthy = false }
+    }
+    result = append(result, h)
+  }
+  return result
+}
+
+// Writes the health of each proxy prefix to w. For the status page.
+func (fm *FileManager) WriteMirrorHealth(w io.Writer) {
+  for _, h := range fm.mirrorHealth() {
+    health := "healthy"
+    if !h.Healthy { health = "UNHEALTHY" }
+    synced := "never"
+    if h.LastSync != nil { synced = h.LastSync.Format(time.RFC3339) }
+    fmt.Fprintf(w, "%v: %v, last sync %v, %v errors, %v bytes pending\n", h.Prefix, health, synced, h.Errors, h.PendingBytes)
+    if h.LastErrorTime != nil { fmt.Fprintf(w, "  last error %v: %v\n", h.LastErrorTime.Format(time.RFC3339), h.LastError) }
+    for _, s := range h.Suites {
+      valid := "no Valid-Until"
+      if s.ValidUntil != nil { valid = "valid until " + s.ValidUntil.Format(time.RFC3339) }
+      if s.Expired { valid += " (EXPIRED)" }
+      date := "?"
+      if s.Date != nil { date = s.Date.Format(time.RFC3339) }
+      fmt.Fprintf(w, "  %v: Release of %v, %v\n", s.Suite, date, valid)
+    }
+  }
+}
+
+/*
+  Serves the health of the proxy prefixes (see AddProxy() and AddAptProxy())
+  as JSON for mirror directors and monitoring:
+    {"generated":"2016-06-01T12:00:00Z","mirrors":[{"prefix":"/debian",
+     "upstream":"http://deb.debian.org/debian","healthy":true,
+     "last_sync":"...","errors":0,"pending_bytes":0,
+     "suites":[{"suite":"stable","date":"...","valid_until":"...","expired":false}]}]}
+  A mirror is not healthy if its last attempt to reach upstream failed or
+  one of its cached Release files has expired. If no mirror is healthy,
+  the status is 503, so that simple HTTP checks notice it.
+*/
+func (fm *FileManager) ServeMirrorStatus(w http.ResponseWriter, r *http.Request) {
+  if r.Method != "GET" && r.Method != "HEAD" {
+    w.Header().Set("Allow", "GET, HEAD")
+    problem.Log(r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "")
+    problem.Write(w, r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "")
+    return
+  }
+  mirrors := fm.mirrorHealth()
+  code := http.StatusOK
+  if len(mirrors) > 0 {
+    code = http.StatusServiceUnavailable
+    for _, m := range mirrors {
+      if m.Healthy { code = http.StatusOK }
+    }
+  }
+  data, _ := json.Marshal(map[string]interface{}{"generated":time.Now().UTC(), "mirrors":mirrors})
+  w.Header().Set("Content-Type", "application/json")
+  w.Header().Set("Cache-Control", "no-store")
+  accesslog.Log(r, 1, "%v %v %v", code, r.Method, r.URL.Path)
+  w.WriteHeader(code)
+  if r.Method != "HEAD" { w.Write(append(data, '\n')) }
+}
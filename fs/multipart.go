@@ -0,0 +1,323 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "io"
+         "os"
+         "fmt"
+         "path"
+         "sort"
+         "time"
+         "strconv"
+         "strings"
+         "net/http"
+         "io/ioutil"
+         "crypto/rand"
+         "encoding/hex"
+         "encoding/json"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../status"
+         "../problem"
+         "../accesslog"
+       )
+
+// The highest part number of a multipart upload.
+const MultipartMaxParts = 10000
+
+// Multipart uploads that have received no part for this long are deleted.
+var MultipartExpiry = 24*time.Hour
+
+// The prefix of the hidden directories next to the target file that hold
+// the parts of a multipart upload. The upload id is appended.
+const multipartDirPrefix = ".multipart-"
+
+var (
+  multipartsStarted = status.NewCounter(`garcon_multipart_uploads_total{result="started"}`, "Multipart uploads by what happened to them.")
+  multipartsCompleted = status.NewCounter(`garcon_multipart_uploads_total{result="completed"}`, "Multipart uploads by what happened to them.")
+  multipartsAborted = status.NewCounter(`garcon_multipart_uploads_total{result="aborted"}`, "Multipart uploads by what happened to them.")
+  multipartsExpired = status.NewCounter(`garcon_multipart_uploads_total{result="expired"}`, "Multipart uploads by what happened to them.")
+)
+
+// A part of a multipart upload as listed by GET ?uploadId=id.
+type multipartPart struct {
+  Number int `json:"partNumber"`
+  Size int64 `json:"size"`
+  Modified time.Time `json:"modified"`
+}
+
+// The answer to starting a multipart upload and to listing its parts.
+type multipartUpload struct {
+  Id string `json:"uploadId"`
+  Path string `json:"path"`
+  Parts []*multipartPart `json:"parts"`
+}
+
+// Returns true if r is a request of the multipart upload API. See serveMultipart().
+func isMultipart(r *http.Request) bool {
+  q := r.URL.Query()
+  _, start := q["uploads"]
+  _, upload := q["uploadId"]
+  return start || upload
+}
+
+/*
+  Answers the requests of the multipart upload API, which is modelled on
+  the one of S3. It allows uploading a large file in parts that can be sent
+  in parallel and retried individually, e.g. by CI runners with unreliable
+  connections:
+    POST /dir/file?uploads                   starts the upload (201 with {"uploadId":...})
+    PUT  /dir/file?uploadId=id&partNumber=n  uploads part n (1 to MultipartMaxParts)
+    GET  /dir/file?uploadId=id               lists the parts received so far
+    POST /dir/file?uploadId=id               joins the parts 1 to n into the file
+    DELETE /dir/file?uploadId=id             aborts the upload
+  An upload of a part replaces an earlier upload of the same part. The parts
+  are stored in a hidden directory next to the file, so that joining them
+  does not copy the data to another file system. The request that joins the
+  parts is treated like a PUT of the whole file, i.e. its MtimeHeader,
+  If-Match, If-None-Match, Content-MD5 and Repr-Digest apply to the file and
+  the validators are run. If joining fails, the parts are kept, so that the
+  client may try again. Uploads that receive no part for MultipartExpiry are
+  deleted when the next upload to the same directory is started.
+*/
+func (fm *FileManager) serveMultipart(w http.ResponseWriter, r *http.Request) {
+  clean := path.Clean(r.URL.Path)
+  name := path.Base(clean)
+  
+  if !fm.uploadAllowed(r, clean) || fm.handlingFor(name).Hide {
+    problem.Log(r, http.StatusForbidden, problem.UploadForbidden, "")
+    problem.Write(w, r, http.StatusForbidden, problem.UploadForbidden, "Upload not allowed")
+    return
+  }
+  
+  q := r.URL.Query()
+  if _, ok := q["uploads"]; ok {
+    if r.Method != "POST" {
+      w.Header().Set("Allow", "POST")
+      problem.Log(r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "")
+      problem.Write(w, r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "Multipart uploads are started with POST")
+      return
+    }
+    fm.startMultipart(w, r, clean)
+    return
+  }
+  
+  mdir, ok := fm.multipartDir(w, r, clean)
+  if !ok { return }
+  switch r.Method {
+    case "PUT": fm.servePart(w, r, clean, mdir)
+    case "", "GET", "HEAD":
+      parts, err := multipartParts(mdir)
+      if err != nil {
+        uploadFailed(w, r, err)
+        return
+      }
+      accesslog.Log(r, 1, "%v %v %v (%v parts)", http.StatusOK, r.Method, r.URL.Path, len(parts))
+      sendMultipartJSON(w, r, http.StatusOK, &multipartUpload{Id:q.Get("uploadId"), Path:clean, Parts:parts})
+    case "POST": fm.completeMultipart(w, r, clean, mdir)
+    case "DELETE":
+      if err := os.RemoveAll(mdir); err != nil {
+        uploadFailed(w, r, err)
+        return
+      }
+      multipartsAborted.Inc()
+      accesslog.Log(r, 0, "%v %v %v (upload %v aborted)", http.StatusNoContent, r.Method, r.URL.Path, q.Get("uploadId"))
+      w.WriteHeader(http.StatusNoContent)
+    default:
+      w.Header().Set("Allow", "GET, HEAD, PUT, POST, DELETE")
+      problem.Log(r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "")
+      problem.Write(w, r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "")
+  }
+}
+
+// Starts a multipart upload to the URL path clean.
+func (fm *FileManager) startMultipart(w http.ResponseWriter, r *http.Request, clean string) {
+  if err := fm.ensureHome(r, clean); err != nil {
+    uploadFailed(w, r, err)
+    return
+  }
+  
+  dir := path.Join(fm.root(), path.Dir(clean))
+  fi, err := os.Stat(dir)
+  existing, err2 := os.Stat(path.Join(dir, path.Base(clean)))
+  if err != nil || !fi.IsDir() || (err2 == nil && existing.IsDir()) {
+    problem.Log(r, http.StatusConflict, problem.Conflict, "")
+    problem.Write(w, r, http.StatusConflict, problem.Conflict, "No such directory or target is a directory")
+    return
+  }
+  
+  expireMultiparts(dir)
+  
+  id := make([]byte, 16)
+  if _, err = rand.Read(id); err != nil { panic(err) }
+  upload := &multipartUpload{Id:hex.EncodeToString(id), Path:clean, Parts:[]*multipartPart{}}
+  mdir := path.Join(dir, multipartDirPrefix + upload.Id)
+  err = os.Mkdir(mdir, 0700)
+  if err == nil { err = ioutil.WriteFile(path.Join(mdir, "name"), []byte(path.Base(clean)), 0600) }
+  if err != nil {
+    os.RemoveAll(mdir)
+    uploadFailed(w, r, err)
+    return
+  }
+  
+  multipartsStarted.Inc()
+  accesslog.Log(r, 0, "%v %v %v (upload %v started)", http.StatusCreated, r.Method, r.URL.Path, upload.Id)
+  sendMultipartJSON(w, r, http.StatusCreated, upload)
+}
+
+/*
+  Returns the directory that holds the parts of the multipart upload whose
+  id is in the query of r. If there is no such upload to the URL path clean,
+  sends 404 and returns false.
+*/
+func (fm *FileManager) multipartDir(w http.ResponseWriter, r *http.Request, clean string) (string, bool) {
+  id := r.URL.Query().Get("uploadId")
+  if _, err := hex.DecodeString(id); err == nil && id != "" {
+    mdir := path.Join(fm.root(), path.Dir(clean), multipartDirPrefix + id)
+    name, err := ioutil.ReadFile(path.Join(mdir, "name"))
+    fi, err2 := os.Stat(mdir)
+    if err == nil && err2 == nil && string(name) == path.Base(clean) && time.Since(fi.ModTime()) < MultipartExpiry {
+      return mdir, true
+    }
+  }
+  problem.Log(r, http.StatusNotFound, problem.NotFound, "no upload %v", id)
+  problem.Write(w, r, http.StatusNotFound, problem.NotFound, "No such upload")
+  return "", false
+}
+
+// Stores the part of the multipart upload r to clean in mdir.
+func (fm *FileManager) servePart(w http.ResponseWriter, r *http.Request, clean, mdir string) {
+  n, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+  if err != nil || n < 1 || n > MultipartMaxParts {
+    detail := fmt.Sprintf("partNumber must be from 1 to %v", MultipartMaxParts)
+    problem.Log(r, http.StatusBadRequest, problem.BadRequest, "%v", detail)
+    problem.Write(w, r, http.StatusBadRequest, problem.BadRequest, detail)
+    return
+  }
+  
+  // The other parts already count against the quota (see diskUsage()).
+  replaced := int64(0)
+  if fi, err := os.Stat(path.Join(mdir, strconv.Itoa(n))); err == nil { replaced = fi.Size() }
+  if r.ContentLength > 0 {
+    if err = fm.checkQuota(r, clean, r.ContentLength - replaced); err != nil {
+      uploadFailed(w, r, err)
+      return
+    }
+  }
+  
+  u := stageVerified(w, r, mdir, fm.quotaLimited(r, clean, replaced, r.Body), r.ContentLength, time.Now())
+  if u == nil { return }
+  defer u.discard()
+  fi, err := u.install(strconv.Itoa(n))
+  if err != nil {
+    uploadFailed(w, r, err)
+    return
+  }
+  accesslog.Log(r, 1, "%v %v %v (part %v, %v bytes)", http.StatusCreated, r.Method, r.URL.Path, n, fi.Size())
+  w.WriteHeader(http.StatusCreated)
+}
+
+// Joins the parts of the multipart upload r to clean in mdir into the file.
+func (fm *FileManager) completeMultipart(w http.ResponseWriter, r *http.Request, clean, mdir string) {
+  mtime, err := uploadMtime(r)
+  if err != nil {
+    problem.Log(r, http.StatusBadRequest, problem.BadRequest, "%v", err)
+    problem.Write(w, r, http.StatusBadRequest, problem.BadRequest, err.Error())
+    return
+  }
+  
+  parts, err := multipartParts(mdir)
+  if err != nil {
+    uploadFailed(w, r, err)
+    return
+  }
+  for i, part := range parts {
+    if part.Number != i + 1 {
+      detail := fmt.Sprintf("Part %v is missing", i + 1)
+      problem.Log(r, http.StatusBadRequest, problem.BadRequest, "%v", detail)
+      problem.Write(w, r, http.StatusBadRequest, problem.BadRequest, detail)
+      return
+    }
+  }
+  if len(parts) == 0 {
+    problem.Log(r, http.StatusBadRequest, problem.BadRequest, "no parts")
+    problem.Write(w, r, http.StatusBadRequest, problem.BadRequest, "No parts have been uploaded")
+    return
+  }
+  
+  if !fm.uploadPreconditions(w, r, clean) { return }
+  
+  size := int64(0)
+  readers := []io.Reader{}
+  for _, part := range parts {
+    f, err := os.Open(path.Join(mdir, strconv.Itoa(part.Number)))
+    if err != nil {
+      uploadFailed(w, r, err)
+      return
+    }
+    defer f.Close()
+    readers = append(readers, f)
+    size += part.Size
+  }
+  
+  u := stageVerified(w, r, path.Dir(mdir), io.MultiReader(readers...), size, mtime)
+  if u == nil { return }
+  defer u.discard()
+  // The parts are removed once the file is in place.
+  u.freed = size
+  if fm.installUpload(w, r, u, clean) {
+    multipartsCompleted.Inc()
+    if err = os.RemoveAll(mdir); err != nil { util.Log(0, "ERROR! Removing parts of %v: %v", clean, err) }
+  }
+}
+
+// Returns the parts in mdir ordered by number.
+func multipartParts(mdir string) ([]*multipartPart, error) {
+  fis, err := ioutil.ReadDir(mdir)
+  if err != nil { return nil, err }
+  parts := []*multipartPart{}
+  for _, fi := range fis {
+    n, err := strconv.Atoi(fi.Name())
+    if err != nil || !fi.Mode().IsRegular() { continue }
+    parts = append(parts, &multipartPart{Number:n, Size:fi.Size(), Modified:fi.ModTime()})
+  }
+  sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+  return parts, nil
+}
+
+// Deletes the multipart uploads in dir that have received no part for MultipartExpiry.
+func expireMultiparts(dir string) {
+  fis, err := ioutil.ReadDir(dir)
+  if err != nil { return }
+  for _, fi := range fis {
+    if !fi.IsDir() || !strings.HasPrefix(fi.Name(), multipartDirPrefix) || time.Since(fi.ModTime()) < MultipartExpiry { continue }
+    if err = os.RemoveAll(path.Join(dir, fi.Name())); err != nil {
+      util.Log(0, "ERROR! Removing expired multipart upload: %v", err)
+      continue
+    }
+    multipartsExpired.Inc()
+    util.Log(1, "Deleted expired multipart upload %v", path.Join(dir, fi.Name()))
+  }
+}
+
+// Sends v as JSON with status.
+func sendMultipartJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+  data, _ := json.Marshal(v)
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(status)
+  if r.Method != "HEAD" { w.Write(append(data, '\n')) }
+}
@@ -0,0 +1,289 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "context"
+         "io"
+         "fmt"
+         "path"
+         "sort"
+         "time"
+         "bytes"
+         "regexp"
+         "strings"
+         "net/http"
+         "io/ioutil"
+         "encoding/json"
+         
+         "../http2"
+         "../accesslog"
+       )
+
+// The URL path below which the registry API is served.
+const registryPath = "/v2/"
+
+// Media types of manifests.
+const (
+  ociManifest = "application/vnd.oci.image.manifest.v1+json"
+  ociIndex = "application/vnd.oci.image.index.v1+json"
+)
+
+// The annotation of a manifest in index.json that contains its tag.
+const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+// Repository names and digests as allowed by the distribution spec.
+var repositoryName = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*(/[a-z0-9]+([._-][a-z0-9]+)*)*$`)
+var blobDigest = regexp.MustCompile(`^(sha256|sha512):([a-f0-9]+)$`)
+
+// A descriptor in index.json of an OCI image layout.
+type ociDescriptor struct {
+  MediaType string `json:"mediaType"`
+  Digest string `json:"digest"`
+  Size int64 `json:"size"`
+  Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+/*
+  Serves the OCI image layouts (directories with oci-layout, index.json and
+  blobs/, e.g. created with "skopeo copy docker://alpine oci:dir:latest")
+  below prefix as read-only registry, so that
+    docker pull example.com/foo/bar:latest
+  pulls the image in the directory prefix/foo/bar. Tags are taken from the
+  org.opencontainers.image.ref.name annotations in index.json.
+  Call before ServeHTTP() is called for the first time.
+*/
+func (fm *FileManager) SetOCIRegistry(prefix string) {
+  fm.oci_prefix = path.Clean("/" + prefix)
+}
+
+// Answers requests for the registry API (GET and HEAD below /v2/).
+func (fm *FileManager) serveRegistry(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+  p := strings.TrimPrefix(r.URL.Path, registryPath)
+  switch {
+    case r.URL.Path == "/v2" || p == "":
+      // Clients check that this answers 200 before anything else.
+      w.Header().Set("Content-Type", "application/json")
+      accesslog.Log(r, 1, "%v %v %v", http.StatusOK, r.Method, r.URL.Path)
+      io.WriteString(w, "{}")
+    case p == "_catalog":
+      // Only lists the repositories r may read.
+      if Authorize != nil { w.Header().Set("Cache-Control", "private") }
+      if fm.generatedETag(w, r, "catalog") { return }
+      fm.serveRegistryJSON(w, r, map[string][]string{"repositories":fm.ociRepositories(r)})
+    case strings.HasSuffix(p, "/tags/list"):
+      name := strings.TrimSuffix(p, "/tags/list")
+      index, ok := fm.ociIndex(w, r, name)
+      if !ok || fm.generatedETag(w, r, "tags") { return }
+      tags := []string{}
+      for _, m := range index {
+        if tag := ociTag(m); tag != "" { tags = append(tags, tag) }
+      }
+      sort.Strings(tags)
+      fm.serveRegistryJSON(w, r, map[string]interface{}{"name":name, "tags":tags})
+    case strings.Contains(p, "/manifests/"):
+      i := strings.LastIndex(p, "/manifests/")
+      fm.serveManifest(w, r, p[0:i], p[i+len("/manifests/"):])
+    case strings.Contains(p, "/blobs/"):
+      i := strings.LastIndex(p, "/blobs/")
+      name, digest := p[0:i], p[i+len("/blobs/"):]
+      if _, ok := fm.ociIndex(w, r, name); !ok { return }
+      fm.serveBlob(w, r, name, digest, "application/octet-stream", "BLOB_UNKNOWN", true)
+    default:
+      registryError(w, r, http.StatusNotFound, "NAME_UNKNOWN", "unknown registry endpoint")
+  }
+}
+
+// Sends v as JSON, with the ETag set by generatedETag().
+func (fm *FileManager) serveRegistryJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+  data, err := json.Marshal(v)
+  if err != nil {
+    registryError(w, r, http.StatusInternalServerError, "UNKNOWN", err.Error())
+    return
+  }
+  w.Header().Set("Content-Type", "application/json")
+  accesslog.Log(r, 1, "%v %v %v", http.StatusOK, r.Method, r.URL.Path)
+  http2.ServeContent(w, r, time.Time{}, int64(len(data)), bytes.NewReader(data))
+}
+
+/*
+  Sends an error response in the format of the distribution spec, e.g.
+    {"errors":[{"code":"MANIFEST_UNKNOWN","message":"..."}]}
+*/
+func registryError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+  w.Header().Del("ETag")
+  accesslog.Log(r, 1, "%v %v %v (%v)", status, r.Method, r.URL.Path, message)
+  data, _ := json.Marshal(map[string]interface{}{"errors":[]map[string]string{{"code":code, "message":message}}})
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(status)
+  w.Write(data)
+}
+
+// Returns the names of the repositories, i.e. the image layouts below the
+// registry prefix, that r may read.
+func (fm *FileManager) ociRepositories(r *http.Request) []string {
+  all := []string{}
+  dir := fm.current().root
+  if fm.oci_prefix != "/" { dir = fileAt(dir.Contents, strings.TrimPrefix(fm.oci_prefix, "/")) }
+  if dir != nil { collectOCILayouts("", dir.Contents, &all) }
+  repos := []string{}
+  for _, name := range all {
+    if fm.mayRead(r, path.Join(fm.oci_prefix, name)) { repos = append(repos, name) }
+  }
+  sort.Strings(repos)
+  return repos
+}
+
+// Appends the paths (relative to the registry prefix) of the image layouts below dir to repos.
+func collectOCILayouts(dirpath string, dir map[string]*File, repos *[]string) {
+  if _, ok := dir["oci-layout"]; ok && dirpath != "" {
+    *repos = append(*repos, strings.TrimSuffix(dirpath, "/"))
+    return
+  }
+  for name, x := range dir {
+    if x.Info.IsDir() && repositoryName.MatchString(name) { collectOCILayouts(dirpath + name + "/", x.Contents, repos) }
+  }
+}
+
+/*
+  Returns the manifests listed in index.json of the repository name. If
+  there is no such repository or r may not read it, an error is sent and
+  false is returned. As the registry API paths are not below the registry
+  prefix, the access policy cannot check them, so this does.
+*/
+func (fm *FileManager) ociIndex(w http.ResponseWriter, r *http.Request, name string) ([]ociDescriptor, bool) {
+  if !repositoryName.MatchString(name) {
+    registryError(w, r, http.StatusBadRequest, "NAME_INVALID", "invalid repository name")
+    return nil, false
+  }
+  if !fm.mayRead(r, path.Join(fm.oci_prefix, name)) {
+    registryError(w, r, http.StatusNotFound, "NAME_UNKNOWN", "repository not found")
+    return nil, false
+  }
+  if Authorize != nil && !Authorize(nil, path.Join(fm.oci_prefix, name)) { w.Header().Set("Cache-Control", "private") }
+  x, resolved, ok := fm.lookup(path.Join(fm.oci_prefix, name, "index.json"))
+  if !ok || x.Info.IsDir() || !strings.HasSuffix(resolved, "/index.json") {
+    registryError(w, r, http.StatusNotFound, "NAME_UNKNOWN", "repository not found")
+    return nil, false
+  }
+  stream, _, err := fm.open(r.Context(), x, false)
+  var data []byte
+  if err == nil {
+    data, err = ioutil.ReadAll(stream)
+    stream.Close()
+  }
+  var index struct{ Manifests []ociDescriptor `json:"manifests"` }
+  if err == nil { err = json.Unmarshal(data, &index) }
+  if err != nil {
+    registryError(w, r, http.StatusInternalServerError, "UNKNOWN", fmt.Sprintf("index.json: %v", err))
+    return nil, false
+  }
+  return index.Manifests, true
+}
+
+// Returns the tag of the manifest m (without the "registry/name:" part some tools add) or "".
+func ociTag(m ociDescriptor) string {
+  tag := m.Annotations[refNameAnnotation]
+  if i := strings.LastIndexAny(tag, ":/"); i >= 0 { tag = tag[i+1:] }
+  return tag
+}
+
+// Serves the manifest reference (a tag or digest) of the repository name.
+func (fm *FileManager) serveManifest(w http.ResponseWriter, r *http.Request, name, reference string) {
+  index, ok := fm.ociIndex(w, r, name)
+  if !ok { return }
+  var desc *ociDescriptor
+  for i := range index {
+    if index[i].Digest == reference || ociTag(index[i]) == reference {
+      desc = &index[i]
+      break
+    }
+  }
+  if desc == nil && !blobDigest.MatchString(reference) {
+    registryError(w, r, http.StatusNotFound, "MANIFEST_UNKNOWN", "unknown tag")
+    return
+  }
+  
+  digest := reference
+  mediaType := ""
+  if desc != nil {
+    digest = desc.Digest
+    mediaType = desc.MediaType
+  }
+  if mediaType == "" {
+    // A manifest that is not listed in index.json, e.g. one of the
+    // platforms of a multi-platform image. It says what it is.
+    mediaType = fm.manifestMediaType(name, digest)
+  }
+  // A tag can be moved to another manifest, a digest cannot.
+  fm.serveBlob(w, r, name, digest, mediaType, "MANIFEST_UNKNOWN", reference == digest)
+}
+
+// Returns the media type of the manifest blob digest from its mediaType field.
+func (fm *FileManager) manifestMediaType(name, digest string) string {
+  m := blobDigest.FindStringSubmatch(digest)
+  if m == nil { return ociManifest }
+  x, _, ok := fm.lookup(path.Join(fm.oci_prefix, name, "blobs", m[1], m[2]))
+  if !ok || x.Info.IsDir() { return ociManifest }
+  stream, _, err := fm.open(context.Background(), x, false)
+  if err != nil { return ociManifest }
+  defer stream.Close()
+  var manifest struct{
+    MediaType string `json:"mediaType"`
+    Manifests []interface{} `json:"manifests"`
+  }
+  if json.NewDecoder(io.LimitReader(stream, 4 << 20)).Decode(&manifest) != nil { return ociManifest }
+  if manifest.MediaType != "" { return manifest.MediaType }
+  if manifest.Manifests != nil { return ociIndex }
+  return ociManifest
+}
+
+/*
+  Serves the blob digest of the repository name with the Content-Type mediaType.
+  If it does not exist, the error code unknown is sent. If immutable is true,
+  clients may cache the response forever.
+*/
+func (fm *FileManager) serveBlob(w http.ResponseWriter, r *http.Request, name, digest, mediaType, unknown string, immutable bool) {
+  m := blobDigest.FindStringSubmatch(digest)
+  if m == nil {
+    registryError(w, r, http.StatusBadRequest, "DIGEST_INVALID", "invalid digest")
+    return
+  }
+  x, _, ok := fm.lookup(path.Join(fm.oci_prefix, name, "blobs", m[1], m[2]))
+  if !ok || x.Info.IsDir() {
+    registryError(w, r, http.StatusNotFound, unknown, "blob not found")
+    return
+  }
+  stream, _, err := fm.open(r.Context(), x, false)
+  if err != nil {
+    registryError(w, r, http.StatusInternalServerError, "UNKNOWN", err.Error())
+    return
+  }
+  defer stream.Close()
+  
+  w.Header().Set("Docker-Content-Digest", digest)
+  w.Header().Set("ETag", `"` + digest + `"`)
+  if immutable {
+    if w.Header().Get("Cache-Control") == "private" {
+      w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+    } else {
+      w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+    }
+  }
+  w.Header().Set("Content-Type", mediaType)
+  accesslog.Log(r, 0, "%v %v %v (%v, Content-Type: %v)", http.StatusOK, r.Method, r.URL.Path, digest, mediaType)
+  http2.ServeContent(w, r, lastModified(r, x), x.Info.Size(), stream)
+}
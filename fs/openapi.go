@@ -0,0 +1,269 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "fmt"
+         "time"
+         "bytes"
+         "reflect"
+         "strings"
+         "net/http"
+         "crypto/sha256"
+         "encoding/json"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../auth"
+         "../http2"
+         "../problem"
+         "../accesslog"
+       )
+
+// The URL path at which the OpenAPI document is served (see ServeOpenAPI()).
+const OpenAPIPath = "/.garcon/openapi.json"
+
+// An operation of the admin API, for ServeAdmin() and the OpenAPI document.
+type adminOp struct {
+  name string
+  // "GET" or "POST".
+  method string
+  summary string
+  params []apiParam
+  // A value of the type of the answer.
+  result interface{}
+}
+
+// A query parameter of an API operation.
+type apiParam struct {
+  name string
+  description string
+  required bool
+}
+
+// The operations of the admin API. See ServeAdmin().
+var adminOps = []adminOp{
+  {"stats", "GET", "Statistics of the tree or the part below path", []apiParam{{"path", "Only count the tree below this path, e.g. /debian", false}}, treeStats{}},
+  {"rescan", "POST", "Scan the tree again", []apiParam{{"wait", "If not empty, answer when the new tree is served (202 if that takes too long)", false}}, map[string]uint64{}},
+  {"regenerate", "POST", "Regenerate and sign anew the metadata of all RPM, Arch, PyPI and Maven repositories with the next scan", nil, map[string]string{}},
+  {"snapshot", "POST", "Copy the metadata of a Debian suite to a new suite next to it", []apiParam{{"suite", "The suite, e.g. /debian/dists/stable", true}, {"name", "The new suite's name. Default is the suite's name with the current time", false}}, suiteCopy{}},
+  {"promote", "POST", "Replace the metadata of a Debian suite with a copy of another", []apiParam{{"from", "The suite to copy, e.g. /debian/dists/testing", true}, {"to", "The suite to replace, e.g. /debian/dists/stable", true}}, suiteCopy{}},
+  {"purge", "POST", "Drop the files below path from the cache and the files fetched from upstream", []apiParam{{"path", "e.g. /mirror/debian/dists", true}}, purgeResult{}},
+  {"remove", "POST", "Move a file to the trash (or delete it if there is no trash)", []apiParam{{"path", "e.g. /incoming/foo.deb", true}}, removeResult{}},
+  {"trash", "GET", "List the removed files that can still be restored", nil, trashList{}},
+  {"restore", "POST", "Move a removed file back to where it was", []apiParam{{"id", "The file's id from trash", true}}, trashEntry{}},
+  {"verify", "GET", "Check the metadata of Debian suites against their Release files", []apiParam{{"suite", "The suite to check. Default is all suites", false}}, verifyResult{}},
+  {"diff", "GET", "List the files added, removed and changed since the state file was saved", []apiParam{{"state", "The name of a copy of the state file in its directory. Default is the state file", false}}, TreeDiff{}},
+  {"publish", "POST", "Serve another directory prepared in the publish directory instead of the current tree", []apiParam{{"name", "The directory in the publish directory, e.g. 2016-06-01", true}}, publishResult{}},
+}
+
+// Returns the adminOp called name or nil if there is none.
+func adminOpNamed(name string) *adminOp {
+  for i := range adminOps {
+    if adminOps[i].name == name { return &adminOps[i] }
+  }
+  return nil
+}
+
+/*
+  Answers with an OpenAPI 3.0 document that describes the HTTP APIs that fm
+  serves with its current configuration: downloads, directory listings and
+  suite diffs, uploads (if enabled), the registry (if enabled) and the admin
+  API (if enabled), so that integrators can generate clients from it.
+*/
+func (fm *FileManager) ServeOpenAPI(w http.ResponseWriter, r *http.Request) {
+  if r.Method != "GET" && r.Method != "HEAD" {
+    w.Header().Set("Allow", "GET, HEAD")
+    problem.Log(r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "")
+    problem.Write(w, r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "")
+    return
+  }
+  data, err := json.MarshalIndent(fm.openAPI(), "", "  ")
+  if err != nil {
+    util.Log(0, "ERROR! OpenAPI document: %v", err)
+    problem.Log(r, http.StatusInternalServerError, problem.Internal, "")
+    problem.Write(w, r, http.StatusInternalServerError, problem.Internal, "")
+    return
+  }
+  w.Header().Set("Content-Type", "application/json")
+  w.Header().Set("Cache-Control", "no-cache")
+  w.Header().Set("ETag", fmt.Sprintf("\"%x\"", sha256.Sum224(data)))
+  accesslog.Log(r, 1, "%v %v %v", http.StatusOK, r.Method, r.URL.Path)
+  http2.ServeContent(w, r, time.Time{}, int64(len(data)), bytes.NewReader(data))
+}
+
+// A JSON object of the OpenAPI document.
+type object map[string]interface{}
+
+// Returns the OpenAPI document for fm's configuration.
+func (fm *FileManager) openAPI() object {
+  paths := object{}
+  pathParam := object{"name":"path", "in":"path", "required":true, "schema":object{"type":"string"},
+                      "description":"The path of the file or directory. May contain slashes."}
+  
+  get := object{
+    "summary": "Download a file or list a directory",
+    "description": "Directories are listed as HTML pages. For a Debian suite (a directory with Release or InRelease), diff compares its packages with those of another suite.",
+    "parameters": []object{pathParam,
+      queryParam(apiParam{"diff", "The other suite for a suite diff, e.g. /debian/dists/testing", false}),
+      queryParam(apiParam{"format", "\"json\" for a suite diff as JSON instead of HTML", false}),
+      queryParam(apiParam{"raw", "\"1\" for the file itself instead of a rendered page (e.g. of a Markdown file)", false})},
+    "responses": object{
+      "200": object{"description":"The file, directory listing or suite diff"},
+      "304": object{"description":"Not modified (If-None-Match or If-Modified-Since)"},
+      "404": object{"description":"Not found"},
+    },
+  }
+  file := object{"get":get}
+  
+  if fm.uploadsEnabled() {
+    prefixes := append([]string{}, fm.upload_prefixes...)
+    for _, h := range fm.homes { prefixes = append(prefixes, h.prefix + "/{user}") }
+    for _, repo := range fm.maven_repos { prefixes = append(prefixes, repo.prefix) }
+    file["put"] = object{
+      "summary": "Upload a file, create a directory or unpack an archive",
+      "description": "Allowed below " + strings.Join(prefixes, ", ") + ". The directory must exist. An existing file is replaced. Directories can also be created with MKCOL.",
+      "parameters": []object{pathParam,
+        queryParam(apiParam{"mkdir", "If present, create the directory path (the body is ignored)", false}),
+        queryParam(apiParam{"unpack", "If present, unpack the archive in the body (tar, tar.gz, tar.xz, zip) into the directory path", false}),
+        queryParam(apiParam{"uploadId", "Upload the body as a part of this multipart upload (see POST) instead of the whole file", false}),
+        queryParam(apiParam{"partNumber", fmt.Sprintf("The number of the part (1 to %v) with uploadId", MultipartMaxParts), false}),
+        object{"name":MtimeHeader, "in":"header", "schema":object{"type":"string"}, "description":"The file's mtime in seconds since the epoch, e.g. 1466073600.25"},
+        object{"name":"If-Match", "in":"header", "schema":object{"type":"string"}, "description":"Only replace the file if its ETag matches"},
+        object{"name":"If-None-Match", "in":"header", "schema":object{"type":"string"}, "description":"\"*\" to only upload if the file does not exist"},
+        object{"name":"Content-MD5", "in":"header", "schema":object{"type":"string"}, "description":"The base64 encoded MD5 digest of the body. The upload is rejected if the body does not match"},
+        object{"name":"Repr-Digest", "in":"header", "schema":object{"type":"string"}, "description":"The SHA-256 or SHA-512 digest of the body (RFC 9530), e.g. sha-256=:base64:. The upload is rejected if the body does not match. Content-Digest is checked the same way"}},
+      "requestBody": object{"content":object{"application/octet-stream":object{"schema":object{"type":"string", "format":"binary"}}}},
+      "responses": object{
+        "201": object{"description":"Created"},
+        "204": object{"description":"Replaced"},
+        "403": object{"description":"Upload not allowed here"},
+        "409": object{"description":"No such directory or the target is a directory"},
+        "412": object{"description":"Precondition failed"},
+        "422": object{"description":"Rejected by an upload validator or the body does not match Content-MD5 or Repr-Digest", "content":object{"text/plain":object{"schema":object{"type":"string"}}}},
+        "429": object{"description":"Too many uploads of the user running"},
+        "503": object{"description":"Too many uploads running"},
+        "507": object{"description":"Quota exceeded or disk full"},
+      },
+    }
+    uploadId := queryParam(apiParam{"uploadId", "The id of a multipart upload", false})
+    get["parameters"] = append(get["parameters"].([]object), queryParam(apiParam{"uploadId", "List the parts of this multipart upload instead", false}))
+    file["post"] = object{
+      "summary": "Start or complete a multipart upload",
+      "description": "With uploads, starts uploading the file in parts (see PUT with uploadId and partNumber), which may be sent in parallel. With uploadId, joins the parts 1 to n into the file like a PUT of the whole file, so the headers of PUT apply. Multipart uploads that receive no part for " + MultipartExpiry.String() + " are deleted.",
+      "parameters": []object{pathParam,
+        queryParam(apiParam{"uploads", "If present, start a multipart upload", false}),
+        uploadId},
+      "responses": object{
+        "201": jsonResponse("Started (with uploads) or created", multipartUpload{}),
+        "204": object{"description":"Replaced"},
+        "400": object{"description":"A part is missing"},
+        "404": object{"description":"No such upload"},
+        "412": object{"description":"Precondition failed"},
+        "422": object{"description":"Rejected by an upload validator or the file does not match Content-MD5 or Repr-Digest"},
+      },
+    }
+    file["delete"] = object{
+      "summary": "Abort a multipart upload",
+      "parameters": []object{pathParam, uploadId},
+      "responses": object{
+        "204": object{"description":"Aborted"},
+        "404": object{"description":"No such upload"},
+      },
+    }
+  }
+  paths["/{path}"] = file
+  
+  if fm.oci_prefix != "" {
+    paths[registryPath + "_catalog"] = object{"get":object{
+      "summary": "List the repositories of the registry",
+      "responses": object{"200":jsonResponse("OK", struct{ Repositories []string `json:"repositories"` }{})},
+    }}
+    paths[registryPath + "{name}/tags/list"] = object{"get":object{
+      "summary": "List the tags of a repository of the registry",
+      "parameters": []object{{"name":"name", "in":"path", "required":true, "schema":object{"type":"string"}, "description":"The repository. May contain slashes."}},
+      "responses": object{"200":jsonResponse("OK", struct{ Name string `json:"name"`; Tags []string `json:"tags"` }{})},
+    }}
+  }
+  
+  if fm.admin_api {
+    for _, op := range adminOps {
+      params := []object{}
+      for _, p := range op.params { params = append(params, queryParam(p)) }
+      paths[AdminPath + op.name] = object{strings.ToLower(op.method):object{
+        "summary": op.summary,
+        "tags": []string{"admin"},
+        "security": []object{{"bearer":[]string{}}, {"session":[]string{}}},
+        "parameters": params,
+        "responses": object{
+          "2XX": jsonResponse("OK", op.result),
+          "default": object{"description":"Error", "content":object{"application/problem+json":object{"schema":schemaOf(reflect.TypeOf(problem.Problem{}))}}},
+        },
+      }}
+    }
+  }
+  
+  return object{
+    "openapi": "3.0.3",
+    "info": object{"title":"Garçon", "version":"1"},
+    "paths": paths,
+    "components": object{"securitySchemes":object{
+      "bearer": object{"type":"http", "scheme":"bearer", "description":"An API token from --token-file"},
+      "session": object{"type":"apiKey", "in":"header", "name":auth.CSRFHeader, "description":"The csrf_token of the session of a logged in user (see " + auth.AuthPath + "session), whose browser sends the session cookie"},
+    }},
+  }
+}
+
+// Returns the OpenAPI description of the query parameter p.
+func queryParam(p apiParam) object {
+  return object{"name":p.name, "in":"query", "required":p.required, "schema":object{"type":"string"}, "description":p.description}
+}
+
+// Returns the OpenAPI description of a JSON response with v's type.
+func jsonResponse(description string, v interface{}) object {
+  return object{"description":description, "content":object{"application/json":object{"schema":schemaOf(reflect.TypeOf(v))}}}
+}
+
+// Returns the JSON Schema of the JSON encoding of values of type t.
+func schemaOf(t reflect.Type) object {
+  if t == reflect.TypeOf(time.Time{}) { return object{"type":"string", "format":"date-time"} }
+  switch t.Kind() {
+    case reflect.Ptr:
+      return schemaOf(t.Elem())
+    case reflect.Bool:
+      return object{"type":"boolean"}
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+         reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+      return object{"type":"integer"}
+    case reflect.Float32, reflect.Float64:
+      return object{"type":"number"}
+    case reflect.Slice, reflect.Array:
+      return object{"type":"array", "items":schemaOf(t.Elem())}
+    case reflect.Map:
+      return object{"type":"object", "additionalProperties":schemaOf(t.Elem())}
+    case reflect.Struct:
+      props := object{}
+      for i := 0; i < t.NumField(); i++ {
+        f := t.Field(i)
+        if f.PkgPath != "" { continue } // unexported
+        name := strings.Split(f.Tag.Get("json"), ",")[0]
+        if name == "-" { continue }
+        if name == "" { name = f.Name }
+        props[name] = schemaOf(f.Type)
+      }
+      return object{"type":"object", "properties":props}
+  }
+  return object{"type":"string"}
+}
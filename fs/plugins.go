@@ -0,0 +1,166 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "fmt"
+         "path"
+         "sort"
+         "strings"
+         "net/http"
+         
+         "../problem"
+       )
+
+/*
+  A handler plugin, which serves a URL subtree in its own way instead of
+  the FileManager's usual way. prefix is the subtree (e.g. "/incoming")
+  and arg the argument of the plugin (see ParseMount()). The plugin is
+  prepared before chroot, so files and host names must be read right away.
+  The returned function creates the handler once the FileManager exists.
+*/
+type Plugin func(prefix, arg string) (func(fm *FileManager) http.Handler, error)
+
+// The plugins compiled into the binary, by name.
+var plugins = map[string]Plugin{
+  "listing-only": listingOnly,
+  "upload-only": uploadOnly,
+  "proxy": proxyPlugin,
+  "redirect-map": redirectMapPlugin,
+}
+
+// Returns the names of the handler plugins in alphabetical order.
+func Plugins() []string {
+  names := []string{}
+  for name := range plugins { names = append(names, name) }
+  sort.Strings(names)
+  return names
+}
+
+// A URL subtree served by a handler plugin. See ParseMount().
+type Mount struct {
+  // The subtree, e.g. "/incoming". Without trailing slash.
+  Prefix string
+  
+  // The name of the plugin, e.g. "upload-only".
+  Plugin string
+  
+  handler func(fm *FileManager) http.Handler
+}
+
+/*
+  Parses "/prefix=plugin[:arg]" and prepares the plugin for the subtree
+  below prefix. The plugins are
+    listing-only        Directory listings only. Requests for files are refused.
+    upload-only         Uploads (PUT, MKCOL, multipart uploads) only. Nothing
+                        can be downloaded.
+    proxy:URL           Like AddProxy() with the upstream URL.
+    redirect-map:FILE   Redirects the paths listed in FILE (see
+                        readRedirectMap()). Everything else is served as usual.
+  Call before chroot.
+*/
+func ParseMount(spec string) (*Mount, error) {
+  pa := strings.SplitN(spec, "=", 2)
+  if len(pa) != 2 || !strings.HasPrefix(pa[0], "/") { return nil, fmt.Errorf("Expected /prefix=plugin[:arg], got %v", spec) }
+  m := &Mount{Prefix:strings.TrimSuffix(path.Clean(pa[0]), "/")}
+  if m.Prefix == "" { return nil, fmt.Errorf("%v: The prefix must not be /", spec) }
+  arg := ""
+  m.Plugin = pa[1]
+  if i := strings.Index(pa[1], ":"); i >= 0 { m.Plugin, arg = pa[1][0:i], pa[1][i+1:] }
+  plugin, ok := plugins[m.Plugin]
+  if !ok { return nil, fmt.Errorf("Unknown plugin %v (known: %v)", m.Plugin, strings.Join(Plugins(), ", ")) }
+  var err error
+  m.handler, err = plugin(m.Prefix, arg)
+  if err != nil { return nil, fmt.Errorf("%v: %v", m.Plugin, err) }
+  return m, nil
+}
+
+/*
+  Returns the handler for the requests below m.Prefix, to be registered
+  for the pattern m.Prefix + "/". Call before ServeHTTP() is called for
+  the first time.
+*/
+func (m *Mount) Handler(fm *FileManager) http.Handler {
+  return m.handler(fm)
+}
+
+// Returns an error if a plugin that takes no argument has been given the argument arg.
+func noArg(arg string) error {
+  if arg != "" { return fmt.Errorf("Takes no argument") }
+  return nil
+}
+
+// Refuses the request r with a 405 error whose Allow header lists allow.
+func refuseMethod(w http.ResponseWriter, r *http.Request, allow string, detail string) {
+  w.Header().Set("Allow", allow)
+  problem.Log(r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "")
+  problem.Write(w, r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, detail)
+}
+
+func listingOnly(prefix, arg string) (func(fm *FileManager) http.Handler, error) {
+  if err := noArg(arg); err != nil { return nil, err }
+  return func(fm *FileManager) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      if r.Method != "GET" && r.Method != "HEAD" {
+        refuseMethod(w, r, "GET, HEAD", "Only directory listings are served here")
+        return
+      }
+      // lookup() resolves directories to their index.html. Requests for
+      // files that do not exist get their 404 from ServeHTTP().
+      if _, resolved, ok := fm.lookup(path.Clean(r.URL.Path)); ok && path.Base(resolved) != "index.html" {
+        problem.Log(r, http.StatusForbidden, problem.Forbidden, "%v serves only directory listings", prefix)
+        problem.Write(w, r, http.StatusForbidden, problem.Forbidden, "Only directory listings are served here")
+        return
+      }
+      fm.ServeHTTP(w, r)
+    })
+  }, nil
+}
+
+func uploadOnly(prefix, arg string) (func(fm *FileManager) http.Handler, error) {
+  if err := noArg(arg); err != nil { return nil, err }
+  return func(fm *FileManager) http.Handler {
+    fm.AddUploadPrefix(prefix)
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      if r.Method != "PUT" && r.Method != "MKCOL" && !isMultipart(r) {
+        refuseMethod(w, r, "PUT, MKCOL", "Only uploads are accepted here")
+        return
+      }
+      fm.ServeHTTP(w, r)
+    })
+  }, nil
+}
+
+func proxyPlugin(prefix, arg string) (func(fm *FileManager) http.Handler, error) {
+  if arg == "" { return nil, fmt.Errorf("Upstream URL missing") }
+  upstream, err := NewUpstream(arg)
+  if err != nil { return nil, err }
+  return func(fm *FileManager) http.Handler {
+    fm.AddProxy(prefix, upstream)
+    return fm
+  }, nil
+}
+
+func redirectMapPlugin(prefix, arg string) (func(fm *FileManager) http.Handler, error) {
+  if arg == "" { return nil, fmt.Errorf("File missing") }
+  redirects, err := readRedirectMap(arg, prefix)
+  if err != nil { return nil, err }
+  return func(fm *FileManager) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      if redirects.serve(w, r) { return }
+      fm.ServeHTTP(w, r)
+    })
+  }, nil
+}
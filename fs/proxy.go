@@ -0,0 +1,562 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "io"
+         "os"
+         "fmt"
+         "net"
+         "path"
+         "sync"
+         "time"
+         "context"
+         "strconv"
+         "strings"
+         "net/url"
+         "net/http"
+         "io/ioutil"
+         "crypto/x509"
+         "encoding/json"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../status"
+         "../tracing"
+         "../problem"
+         "../accesslog"
+       )
+
+// Heuristic freshness of files without explicit expiration time is 10% of
+// the time since their Last-Modified, but at most this long.
+const maxHeuristicFreshness = 24*time.Hour
+
+// The outcomes of requests below a proxy prefix that are counted.
+// See WriteProxyStats().
+var proxyResults = []string{"hit", "revalidated", "stale", "fetched", "passed", "excluded", "error", "other"}
+
+/*
+  An HTTP(S) server whose files are mirrored below a path prefix.
+  See NewUpstream() and AddProxy().
+*/
+type Upstream struct {
+  // The base URL. Paths below the proxy prefix are appended to its path.
+  URL *url.URL
+  
+  client *http.Client
+}
+
+/*
+  Prepares fetching files from the base URL rawurl. The host name is
+  resolved right away and the addresses are reused for all requests,
+  because the DNS configuration is not available after chroot. The
+  system's trusted certificates are loaded for the same reason.
+  Call before chroot.
+*/
+func NewUpstream(rawurl string) (*Upstream, error) {
+  u, err := url.Parse(rawurl)
+  if err != nil { return nil, err }
+  if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+    return nil, fmt.Errorf("Expected http:// or https:// URL, got %v", rawurl)
+  }
+  u.RawQuery = ""
+  u.Fragment = ""
+  
+  addrs, err := net.LookupHost(u.Hostname())
+  if err != nil { return nil, err }
+  if u.Scheme == "https" {
+    _, err = x509.SystemCertPool()
+    if err != nil { return nil, err }
+  }
+  
+  dialer := &net.Dialer{Timeout:30*time.Second}
+  transport := &http.Transport{
+    Proxy: http.ProxyFromEnvironment,
+    DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+      host, port, err := net.SplitHostPort(addr)
+      if err != nil { return nil, err }
+      if host == u.Hostname() {
+        for _, ip := range addrs {
+          conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+          if err == nil { return conn, nil }
+        }
+      }
+      return dialer.DialContext(ctx, network, addr)
+    },
+    TLSHandshakeTimeout: 30*time.Second,
+    ResponseHeaderTimeout: 60*time.Second,
+    MaxIdleConnsPerHost: 8,
+  }
+  client := &http.Client{
+    Transport: transport,
+    // A redirect that only appends a slash means that the path is a
+    // directory upstream. It is passed on to the client, so that the
+    // directory listing is not stored in place of the directory.
+    CheckRedirect: func(req *http.Request, via []*http.Request) error {
+      if req.URL.Path == via[len(via)-1].URL.Path + "/" { return http.ErrUseLastResponse }
+      if len(via) >= 10 { return fmt.Errorf("stopped after 10 redirects") }
+      return nil
+    },
+  }
+  return &Upstream{URL:u, client:client}, nil
+}
+
+// Returns the URL of the file rel (relative to the proxy prefix) on up.
+func (up *Upstream) fileURL(rel string) string {
+  u := *up.URL
+  u.Path = strings.TrimSuffix(u.Path, "/") + "/" + rel
+  u.RawPath = ""
+  return u.String()
+}
+
+/*
+  A path prefix whose files are fetched from an Upstream when they are
+  requested, stored below the prefix on disk and served from there until
+  they expire. Expired files are revalidated with If-None-Match and
+  If-Modified-Since. Their ETag, Last-Modified and expiration time are
+  stored in the hidden file .<name>.proxy next to each file.
+*/
+type proxyPrefix struct {
+  // URL path of the directory (without trailing slash).
+  prefix string
+  
+  upstream *Upstream
+  
+  // If true, upstream is a Debian mirror. See AddAptProxy().
+  debian bool
+  
+  // The parts of the Debian mirror that are fetched. nil if all.
+  // See SelectApt().
+  selection *AptSelection
+  
+  // The number of requests by outcome (see proxyResults) and the number
+  // of bytes fetched from upstream.
+  requests map[string]*status.Counter
+  fetched *status.Counter
+  
+  // Failed attempts to fetch or store a file from upstream. See mirrorhealth.go.
+  errors *status.Counter
+  
+  // When upstream last answered (UnixNano) and the bytes of the files
+  // being fetched that have not been received yet. Accessed atomically.
+  synced int64
+  pending int64
+  
+  // Protects fetching, lastError and lastErrorTime.
+  mutex sync.Mutex
+  
+  // The last failure recorded by upstreamFailed() and when it happened.
+  lastError string
+  lastErrorTime time.Time
+  
+  // The paths (relative to prefix) that are being fetched. The channel is
+  // closed when the fetch is done.
+  fetching map[string]chan struct{}
+}
+
+// The information about a cached file stored in its .<name>.proxy file.
+type proxyMeta struct {
+  URL string `json:"url"`
+  ETag string `json:"etag,omitempty"`
+  LastModified string `json:"last_modified,omitempty"`
+  
+  // The file is served without asking upstream until this time.
+  Expires time.Time `json:"expires"`
+}
+
+/*
+  Makes the directory prefix a caching mirror of upstream: GET and HEAD
+  requests for files below prefix that are not on disk yet or whose copy
+  has expired are answered with the file from upstream, which is stored on
+  disk (creating directories as needed). How long a copy is fresh is taken
+  from the upstream's Cache-Control (max-age, s-maxage, no-cache) or Expires
+  headers. Responses with Cache-Control no-store or private are passed
+  through without being stored. If upstream cannot be reached or fails, an
+  expired copy is served. Files below prefix that do not have a .proxy file
+  (i.e. that have been put there by other means) are served as they are.
+  Directory listings show the files that have been cached so far.
+  Call before ServeHTTP() is called for the first time.
+*/
+func (fm *FileManager) AddProxy(prefix string, upstream *Upstream) {
+  fm.addProxy(prefix, upstream, false)
+}
+
+/*
+  Like AddProxy(), but for a Debian mirror (e.g. http://deb.debian.org/debian),
+  which replaces apt-cacher-ng: The repository metadata (everything in dists/
+  except by-hash/) is revalidated with upstream on every request, so that apt
+  sees updates right away. Files in pool/ and by-hash/ never change, so they
+  are served from the cache forever without asking upstream. The
+  Cache-Control headers of upstream are ignored for both.
+  Call before ServeHTTP() is called for the first time.
+*/
+func (fm *FileManager) AddAptProxy(prefix string, upstream *Upstream) {
+  fm.addProxy(prefix, upstream, true)
+}
+
+func (fm *FileManager) addProxy(prefix string, upstream *Upstream, debian bool) {
+  p := &proxyPrefix{prefix:strings.TrimSuffix(path.Clean(prefix), "/"), upstream:upstream, debian:debian, fetching:map[string]chan struct{}{}}
+  p.requests = map[string]*status.Counter{}
+  for _, result := range proxyResults {
+    p.requests[result] = status.NewCounter(`garcon_proxy_requests_total{prefix="`+p.prefix+`",result="`+result+`"}`, "Requests for files below a proxy prefix by whether they were answered from the cache.")
+  }
+  p.fetched = status.NewCounter(`garcon_proxy_fetched_bytes_total{prefix="`+p.prefix+`"}`, "Bytes stored in the cache of a proxy prefix.")
+  p.registerHealthMetrics(fm)
+  fm.proxies = append(fm.proxies, p)
+}
+
+// Returns the proxy prefix that contains the path clean or nil.
+func (fm *FileManager) proxyFor(clean string) *proxyPrefix {
+  for _, p := range fm.proxies {
+    if strings.HasPrefix(clean, p.prefix + "/") { return p }
+  }
+  return nil
+}
+
+// Waits until no other request fetches rel and marks it as being fetched.
+// Returns the function that ends the fetch.
+func (p *proxyPrefix) lock(rel string) func() {
+  for {
+    p.mutex.Lock()
+    done, busy := p.fetching[rel]
+    if !busy {
+      done = make(chan struct{})
+      p.fetching[rel] = done
+      p.mutex.Unlock()
+      return func() {
+        p.mutex.Lock()
+        delete(p.fetching, rel)
+        p.mutex.Unlock()
+        close(done)
+      }
+    }
+    p.mutex.Unlock()
+    <-done
+  }
+}
+
+/*
+  Makes sure that the file requested by r, which is below the proxy prefix p,
+  is on disk and fresh, if upstream has it. Returns true if the request is
+  to be answered from the tree as usual and false if a response has been sent.
+*/
+func (fm *FileManager) refreshProxied(w http.ResponseWriter, r *http.Request, p *proxyPrefix) bool {
+  clean := path.Clean(r.URL.Path)
+  // Directories are listed with the files that have been cached.
+  if strings.HasSuffix(r.URL.Path, "/") { return true }
+  rel := strings.TrimPrefix(clean, p.prefix + "/")
+  for _, part := range strings.Split(rel, "/") {
+    if fm.handlingFor(part).Hide { return true }
+  }
+  
+  if p.selection != nil && !p.selection.allows(rel) {
+    p.requests["excluded"].Inc()
+    problem.Log(r, http.StatusNotFound, problem.NotFound, "not selected for mirroring")
+    problem.Write(w, r, http.StatusNotFound, problem.NotFound, "")
+    return false
+  }
+  
+  local := path.Join(fm.root(), clean)
+  dir, name := path.Dir(local), path.Base(local)
+  metafile := path.Join(dir, "." + name + ".proxy")
+  
+  unlock := p.lock(rel)
+  defer unlock()
+  
+  fi, err := os.Stat(local)
+  if err == nil && fi.IsDir() { return true }
+  var meta *proxyMeta
+  if err == nil {
+    meta = readProxyMeta(metafile)
+    if meta == nil { return true } // not from upstream
+    if time.Now().Before(meta.Expires) {
+      p.requests["hit"].Inc()
+      return true
+    }
+  }
+  
+  u := p.upstream.fileURL(rel)
+  req, err := http.NewRequest("GET", u, nil)
+  if err != nil {
+    util.Log(0, "ERROR! Proxy %v: %v", p.prefix, err)
+    p.requests["error"].Inc()
+    problem.Log(r, http.StatusBadGateway, problem.BadGateway, "")
+    problem.Write(w, r, http.StatusBadGateway, problem.BadGateway, "")
+    return false
+  }
+  req.Header.Set("User-Agent", "Garçon")
+  // Otherwise the transport would decompress gzip responses and the stored
+  // file would not match upstream's ETag.
+  req.Header.Set("Accept-Encoding", "identity")
+  if meta != nil {
+    if meta.ETag != "" { req.Header.Set("If-None-Match", meta.ETag) }
+    if meta.LastModified != "" { req.Header.Set("If-Modified-Since", meta.LastModified) }
+  }
+  
+  _, span := tracing.StartKind(r.Context(), "upstream", tracing.KindClient)
+  span.SetAttr("url.full", u)
+  if span != nil { req.Header.Set(tracing.TraceparentHeader, span.Traceparent()) }
+  resp, err := p.upstream.client.Do(req)
+  if err == nil && resp.StatusCode >= 500 {
+    resp.Body.Close()
+    err = fmt.Errorf("%v", resp.Status)
+  }
+  if err == nil { span.SetAttr("http.response.status_code", resp.StatusCode) }
+  span.SetError(err)
+  // The span includes storing the body, which is read from upstream.
+  defer span.End()
+  if err != nil {
+    p.upstreamFailed(err)
+    if meta != nil {
+      util.Log(0, "WARNING! Proxy %v: %v: %v (serving expired copy)", p.prefix, u, err)
+      p.requests["stale"].Inc()
+      return true
+    }
+    util.Log(0, "WARNING! Proxy %v: %v: %v", p.prefix, u, err)
+    p.requests["error"].Inc()
+    problem.Log(r, http.StatusBadGateway, problem.BadGateway, "")
+    problem.Write(w, r, http.StatusBadGateway, problem.BadGateway, "")
+    return false
+  }
+  defer resp.Body.Close()
+  p.upstreamOK()
+  
+  now := time.Now()
+  switch {
+    case resp.StatusCode == http.StatusNotModified && meta != nil:
+      expires, _ := p.expiry(rel, resp.Header, now)
+      meta.Expires = expires
+      if etag := resp.Header.Get("ETag"); etag != "" { meta.ETag = etag }
+      if lm := resp.Header.Get("Last-Modified"); lm != "" { meta.LastModified = lm }
+      err = writeProxyMeta(dir, metafile, meta)
+      if err != nil { util.Log(0, "ERROR! Proxy %v: %v", p.prefix, err) }
+      util.Log(2, "Proxy %v: %v not modified", p.prefix, u)
+      p.requests["revalidated"].Inc()
+      return true
+    
+    case resp.StatusCode == http.StatusOK:
+      expires, store := p.expiry(rel, resp.Header, now)
+      if !store {
+        util.Log(1, "Proxy %v: Passing %v through (not cacheable)", p.prefix, u)
+        p.requests["passed"].Inc()
+        proxyPassThrough(w, r, resp)
+        return false
+      }
+      meta = &proxyMeta{URL:u, ETag:resp.Header.Get("ETag"), LastModified:resp.Header.Get("Last-Modified"), Expires:expires}
+      err = fm.storeProxied(p, clean, resp, meta)
+      if err != nil {
+        p.upstreamFailed(err)
+        util.Log(0, "ERROR! Proxy %v: %v: %v", p.prefix, u, err)
+        p.requests["error"].Inc()
+        problem.Log(r, http.StatusBadGateway, problem.BadGateway, "")
+        problem.Write(w, r, http.StatusBadGateway, problem.BadGateway, "")
+        return false
+      }
+      p.requests["fetched"].Inc()
+      return true
+    
+    case resp.StatusCode >= 300 && resp.StatusCode < 400 && resp.StatusCode != http.StatusNotModified:
+      // See the CheckRedirect function in NewUpstream(). The directory is
+      // created, so that the client gets a listing instead of 404.
+      fm.uploadmutex.Lock()
+      err = fm.makeParents(p.prefix, clean + "/index.html")
+      fm.uploadmutex.Unlock()
+      if err != nil { util.Log(0, "ERROR! Proxy %v: %v", p.prefix, err) }
+      accesslog.Log(r, 1, "%v %v %v (directory upstream)", http.StatusMovedPermanently, r.Method, r.URL.Path)
+      p.requests["other"].Inc()
+      http.Redirect(w, r, r.URL.Path + "/", http.StatusMovedPermanently)
+      return false
+  }
+  
+  if (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone) && meta != nil {
+    fm.removeProxied(p, clean, metafile)
+  }
+  problem.Log(r, resp.StatusCode, problem.Upstream, "upstream")
+  p.requests["other"].Inc()
+  problem.Write(w, r, resp.StatusCode, problem.Upstream, "")
+  return false
+}
+
+/*
+  Writes the body of resp to the file clean below the proxy prefix p and
+  its .proxy file with meta and publishes the file.
+*/
+func (fm *FileManager) storeProxied(p *proxyPrefix, clean string, resp *http.Response, meta *proxyMeta) error {
+  mtime := time.Now()
+  if t, err := http.ParseTime(meta.LastModified); err == nil { mtime = t }
+  
+  dir := path.Join(fm.root(), path.Dir(clean))
+  name := path.Base(clean)
+  fm.uploadmutex.Lock()
+  err := fm.makeParents(p.prefix, clean)
+  fm.uploadmutex.Unlock()
+  if err != nil { return err }
+  
+  body := p.countPending(resp.Body, resp.ContentLength)
+  u, err := stageUpload(dir, body, resp.ContentLength, mtime)
+  body.done()
+  if err != nil { return err }
+  defer u.discard()
+  
+  fm.uploadmutex.Lock()
+  defer fm.uploadmutex.Unlock()
+  fi, err := u.install(name)
+  if err != nil { return err }
+  err = writeProxyMeta(dir, path.Join(dir, "." + name + ".proxy"), meta)
+  if err != nil { return err }
+  
+  // Make the file visible right away instead of after the next rescan.
+  x := &File{Info:fi, Data:dir, RateClass:fm.rateClassFor(name)}
+  t := fm.Begin()
+  t.Put(clean, x)
+  if err = t.Commit(); err != nil {
+    util.Log(0, "ERROR! Publishing %v: %v", clean, err)
+  }
+  util.Log(1, "Proxy %v: Stored %v (%v bytes, expires %v)", p.prefix, meta.URL, fi.Size(), meta.Expires.Format(time.RFC3339))
+  p.fetched.Add(uint64(fi.Size()))
+  return nil
+}
+
+// Removes the file clean below the proxy prefix p, which upstream no longer has.
+func (fm *FileManager) removeProxied(p *proxyPrefix, clean, metafile string) {
+  fm.uploadmutex.Lock()
+  defer fm.uploadmutex.Unlock()
+  err := os.Remove(path.Join(fm.root(), clean))
+  if err == nil || os.IsNotExist(err) { err = os.Remove(metafile) }
+  if err != nil && !os.IsNotExist(err) {
+    util.Log(0, "WARNING! Proxy %v: %v", p.prefix, err)
+    return
+  }
+  t := fm.Begin()
+  t.Remove(clean)
+  if err = t.Commit(); err != nil {
+    util.Log(0, "ERROR! Publishing removal of %v: %v", clean, err)
+  }
+  util.Log(1, "Proxy %v: Removed %v (gone upstream)", p.prefix, clean)
+}
+
+// Sends the response resp from upstream to w without storing it.
+func proxyPassThrough(w http.ResponseWriter, r *http.Request, resp *http.Response) {
+  for _, h := range []string{"Content-Type", "Content-Length", "Last-Modified", "ETag", "Cache-Control", "Expires"} {
+    if v := resp.Header.Get(h); v != "" { w.Header().Set(h, v) }
+  }
+  accesslog.Log(r, 1, "%v %v %v (upstream)", resp.StatusCode, r.Method, r.URL.Path)
+  w.WriteHeader(resp.StatusCode)
+  if r.Method != "HEAD" { io.Copy(w, resp.Body) }
+}
+
+/*
+  Returns the time until which the file rel (relative to the prefix), whose
+  response from upstream had the header h, received at now, may be served
+  without revalidation, and false if it must not be stored at all.
+*/
+func (p *proxyPrefix) expiry(rel string, h http.Header, now time.Time) (time.Time, bool) {
+  if p.debian {
+    parts := strings.Split(rel, "/")
+    for i, part := range parts {
+      switch {
+        case part == "pool", part == "by-hash":
+          return now.AddDate(100, 0, 0), true
+        case part == "dists" && i < len(parts)-1 && !strings.Contains(rel, "/by-hash/"):
+          return now, true
+      }
+    }
+  }
+  return proxyExpiry(h, now)
+}
+
+/*
+  Returns the time until which a response with the header h, received at now,
+  may be served without revalidation, and false if it must not be stored at
+  all (Cache-Control no-store or private). Freshness is determined like for
+  a shared cache (RFC 9111): s-maxage, max-age, Expires and a heuristic based
+  on Last-Modified. no-cache means that it must be revalidated every time.
+*/
+func proxyExpiry(h http.Header, now time.Time) (time.Time, bool) {
+  directives := map[string]string{}
+  for _, cc := range h.Values("Cache-Control") {
+    for _, d := range strings.Split(cc, ",") {
+      kv := strings.SplitN(strings.TrimSpace(d), "=", 2)
+      key := strings.ToLower(kv[0])
+      directives[key] = ""
+      if len(kv) == 2 { directives[key] = strings.Trim(kv[1], `"`) }
+    }
+  }
+  if _, ok := directives["no-store"]; ok { return now, false }
+  if _, ok := directives["private"]; ok { return now, false }
+  if _, ok := directives["no-cache"]; ok { return now, true }
+  
+  age := time.Duration(0)
+  if secs, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil && secs > 0 { age = time.Duration(secs)*time.Second }
+  for _, key := range []string{"s-maxage", "max-age"} {
+    if v, ok := directives[key]; ok {
+      secs, err := strconv.ParseInt(v, 10, 64)
+      if err != nil || secs < 0 { secs = 0 }
+      return now.Add(time.Duration(secs)*time.Second - age), true
+    }
+  }
+  
+  date, err := http.ParseTime(h.Get("Date"))
+  if err != nil { date = now }
+  if v := h.Get("Expires"); v != "" {
+    expires, err := http.ParseTime(v)
+    if err != nil { return now, true } // e.g. "0", which means already expired
+    return now.Add(expires.Sub(date) - age), true
+  }
+  if lm, err := http.ParseTime(h.Get("Last-Modified")); err == nil && lm.Before(date) {
+    fresh := date.Sub(lm) / 10
+    if fresh > maxHeuristicFreshness { fresh = maxHeuristicFreshness }
+    return now.Add(fresh - age), true
+  }
+  return now, true
+}
+
+// Returns the contents of the .proxy file metafile or nil if it does not exist.
+// If it is broken, the file is treated as expired.
+func readProxyMeta(metafile string) *proxyMeta {
+  data, err := ioutil.ReadFile(metafile)
+  if err != nil { return nil }
+  meta := &proxyMeta{}
+  if json.Unmarshal(data, meta) != nil { return &proxyMeta{} }
+  return meta
+}
+
+// Writes meta to the .proxy file metafile in dir.
+func writeProxyMeta(dir, metafile string, meta *proxyMeta) error {
+  data, err := json.Marshal(meta)
+  if err != nil { return err }
+  return writeFileAtomic(dir, path.Base(metafile), data)
+}
+
+/*
+  Writes the number of requests below each proxy prefix, how many of them
+  have been answered from the cache and how many bytes have been fetched
+  from upstream to w.
+*/
+func (fm *FileManager) WriteProxyStats(w io.Writer) {
+  for _, p := range fm.proxies {
+    total := uint64(0)
+    counts := []string{}
+    for _, result := range proxyResults {
+      n := p.requests[result].Value()
+      total += n
+      counts = append(counts, fmt.Sprintf("%v %v", result, n))
+    }
+    cached := p.requests["hit"].Value() + p.requests["revalidated"].Value() + p.requests["stale"].Value()
+    rate := 0.0
+    if total > 0 { rate = 100*float64(cached)/float64(total) }
+    fmt.Fprintf(w, "%v (%v): %v requests, %.1f%% from cache (%v), %v bytes fetched\n", p.prefix, p.upstream.URL, total, rate, strings.Join(counts, ", "), p.fetched.Value())
+  }
+}
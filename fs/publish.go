@@ -0,0 +1,109 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "os"
+         "fmt"
+         "path"
+         "time"
+         "strings"
+         "net/http"
+         
+         "../notify"
+       )
+
+/*
+  If not "", the admin API's publish makes the FileManager serve one of
+  the directories in PublishDir instead of the tree it serves now (see
+  PublishTree()). The directory is interpreted after chroot, so with a
+  chroot it must be inside the root directory. A name starting with "."
+  keeps it from being served as part of the original tree.
+*/
+var PublishDir = ""
+
+// A request to serve another tree, handled by AutoUpdate().
+type publishRequest struct {
+  dir string
+  // Receives the result when dir is served or could not be scanned.
+  done chan error
+}
+
+// Returns the directory of the tree that is served now.
+func (fm *FileManager) root() string {
+  return fm.current().root.Data.(string)
+}
+
+/*
+  Makes fm serve the directory tree dir (e.g. a newly prepared release
+  /data/releases/2016-06-01) instead of the current one, for blue/green
+  deployments of static sites. dir is scanned completely before fm
+  switches to it all at once, so that every request is answered either
+  from the old tree or from the new one. The old tree is left untouched
+  on disk, so that downloads that have started continue, and switching
+  back is just another PublishTree(). Uploads, generated repository
+  metadata, etc. go to the new tree. Files published with Transactions
+  are dropped. The switch is not saved, i.e. after a restart the directory
+  passed to NewFileManager() is served again.
+  AutoUpdate() must be running. Like the admin API's rescan, this requires
+  that a file can be created in the directory of the current tree. Returns
+  when dir is served or its scan has failed.
+*/
+func (fm *FileManager) PublishTree(dir string) error {
+  dir = path.Clean(dir)
+  fi, err := os.Stat(dir)
+  if err != nil { return err }
+  if !fi.IsDir() { return fmt.Errorf("%v is not a directory", dir) }
+  
+  req := &publishRequest{dir:dir, done:make(chan error, 1)}
+  fm.publishing <- req
+  for {
+    // The request for a rescan is missed if AutoUpdate() is just setting up
+    // the watches, so it is repeated until AutoUpdate() has picked up req.
+    fm.requestScan()
+    select {
+      case err = <-req.done: if err == nil {
+                               notify.Send(notify.RepoPublished, dir, fmt.Sprintf("Published %v", dir), fmt.Sprintf("%v is served now instead of the previous tree.", dir))
+                             }
+                             return err
+      case <-time.After(5*time.Second):
+    }
+  }
+}
+
+// The answer to "publish".
+type publishResult struct {
+  // The directory that was served before and the one that is served now.
+  Previous string `json:"previous"`
+  Dir string `json:"dir"`
+  Generation uint64 `json:"generation"`
+}
+
+// Publishes the directory name in PublishDir for the admin API.
+func (fm *FileManager) publish(name string) (*publishResult, error) {
+  if PublishDir == "" { return nil, &adminErr{http.StatusNotFound, "Publishing is not enabled"} }
+  if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+    return nil, fmt.Errorf("Illegal name: %v", name)
+  }
+  dir := path.Join(PublishDir, name)
+  if _, err := os.Stat(dir); os.IsNotExist(err) {
+    return nil, &adminErr{http.StatusNotFound, fmt.Sprintf("No such directory: %v", dir)}
+  }
+  res := &publishResult{Previous:fm.root(), Dir:dir}
+  err := fm.PublishTree(dir)
+  if err != nil { return nil, err }
+  res.Generation = fm.Generation()
+  return res, nil
+}
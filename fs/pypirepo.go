@@ -0,0 +1,221 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "io"
+         "os"
+         "fmt"
+         "path"
+         "sort"
+         "bytes"
+         "strings"
+         "io/ioutil"
+         "crypto/sha256"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../pypi"
+       )
+
+/*
+  A directory whose simple/ index (PEP 503) is generated from the wheels
+  and sdists in it and its subdirectories, so that pip can install from it
+  with
+    pip install --index-url https://example.com/python/simple/ foo
+  For every wheel the core metadata is extracted to <wheel>.metadata
+  (PEP 658), so that pip can resolve dependencies without downloading
+  the wheels. Whenever the scan finds that distributions have been added,
+  replaced or removed, the pages are rewritten.
+*/
+type pypiRepo struct {
+  // URL path of the directory (without trailing slash).
+  prefix string
+  
+  // Describes the distributions the current pages have been generated from.
+  state string
+}
+
+/*
+  Makes the directory prefix a Python package index (see pypiRepo). The
+  pages are generated by AutoUpdate(), starting right away.
+  Call before AutoUpdate().
+*/
+func (fm *FileManager) AddPyPIRepo(prefix string) {
+  fm.pypi_repos = append(fm.pypi_repos, &pypiRepo{prefix:strings.TrimSuffix(path.Clean(prefix), "/")})
+}
+
+/*
+  Rewrites the simple/ pages of every Python package index in tree whose
+  distributions have changed since its last update. The new files are
+  picked up by the next scan.
+  Must only be called by the goroutine that scans the directory tree.
+*/
+func (fm *FileManager) updatePyPIRepos(tree map[string]*File) {
+  metadata := map[uint64][]byte{}
+  for _, repo := range fm.pypi_repos {
+    dir := fileAt(tree, strings.TrimPrefix(repo.prefix, "/"))
+    if dir == nil || !dir.Info.IsDir() {
+      if repo.state != "-" { util.Log(0, "WARNING! Python package index %v: No such directory", repo.prefix) }
+      repo.state = "-"
+      continue
+    }
+    
+    dists := map[string]*File{}
+    metafiles := map[string]bool{}
+    collectDists("", dir.Contents, dists, metafiles)
+    names := []string{}
+    for name := range dists { names = append(names, name) }
+    sort.Strings(names)
+    var state bytes.Buffer
+    for _, name := range names { fmt.Fprintf(&state, "%v %v\n", name, dists[name].Id) }
+    if state.String() == repo.state {
+      for _, x := range dists {
+        if m, ok := fm.pypi_metadata[x.Id]; ok { metadata[x.Id] = m }
+      }
+      continue
+    }
+    
+    projects := map[string][]pypi.Link{}
+    for _, name := range names {
+      x := dists[name]
+      sum, err := fm.checksum(x)
+      if err != nil {
+        util.Log(0, "WARNING! Python package index %v: Skipping %v: %v", repo.prefix, name, err)
+        continue
+      }
+      link := pypi.Link{Filename:path.Base(name), Path:repo.prefix + "/" + name, SHA256:sum}
+      
+      if strings.HasSuffix(name, ".whl") {
+        m, cached := fm.pypi_metadata[x.Id]
+        if !cached {
+          m, err = readWheelMetadata(x)
+          if err != nil { util.Log(0, "WARNING! Python package index %v: %v: %v", repo.prefix, name, err) }
+        }
+        metadata[x.Id] = m
+        if m != nil {
+          link.RequiresPython = pypi.RequiresPython(m)
+          link.MetadataSHA256 = fmt.Sprintf("%x", sha256.Sum256(m))
+          if !cached || !metafiles[name + ".metadata"] {
+            err = writeFileAtomic(path.Join(fm.scanroot, repo.prefix, path.Dir(name)), path.Base(name) + ".metadata", m)
+            if err != nil {
+              util.Log(0, "ERROR! Python package index %v: %v", repo.prefix, err)
+              link.MetadataSHA256 = ""
+            }
+          }
+        }
+        delete(metafiles, name + ".metadata")
+      }
+      
+      project := pypi.Normalize(pypi.Project(link.Filename))
+      projects[project] = append(projects[project], link)
+    }
+    
+    // Remove the metadata of wheels that are gone.
+    for name := range metafiles {
+      if _, ok := dists[strings.TrimSuffix(name, ".metadata")]; ok { continue }
+      err := os.Remove(path.Join(fm.scanroot, repo.prefix, name))
+      if err != nil { util.Log(0, "WARNING! %v", err) }
+    }
+    
+    err := fm.writeSimpleIndex(repo, projects)
+    if err != nil {
+      util.Log(0, "ERROR! Python package index %v: %v", repo.prefix, err)
+      continue
+    }
+    util.Log(1, "Python package index %v: Pages for %v projects written", repo.prefix, len(projects))
+    repo.state = state.String()
+  }
+  // Forget the metadata of wheels that are gone.
+  fm.pypi_metadata = metadata
+}
+
+/*
+  Adds the wheels and sdists below dir, whose path relative to the index
+  is dirpath, to dists by their relative paths and the relative paths of
+  <wheel>.metadata files to metafiles.
+*/
+func collectDists(dirpath string, dir map[string]*File, dists map[string]*File, metafiles map[string]bool) {
+  for name, x := range dir {
+    if dirpath == "" && name == "simple" { continue }
+    if x.Info.IsDir() {
+      collectDists(dirpath + name + "/", x.Contents, dists, metafiles)
+    } else if strings.HasSuffix(name, ".whl.metadata") {
+      metafiles[dirpath + name] = true
+    } else if pypi.Project(name) != "" && x.Encoding == "" {
+      dists[dirpath + name] = x
+    }
+  }
+}
+
+// Returns the core metadata of the wheel x.
+func readWheelMetadata(x *File) ([]byte, error) {
+  stream, _, err := x.GetStream(true)
+  if err != nil { return nil, err }
+  defer stream.Close()
+  r, ok := stream.(io.ReaderAt)
+  if !ok {
+    data, err := ioutil.ReadAll(stream)
+    if err != nil { return nil, err }
+    r = bytes.NewReader(data)
+  }
+  return pypi.WheelMetadata(r, x.Info.Size())
+}
+
+/*
+  Writes simple/index.html and simple/<project>/index.html for projects to
+  the directory of repo on disk and removes the pages of projects that are gone.
+*/
+func (fm *FileManager) writeSimpleIndex(repo *pypiRepo, projects map[string][]pypi.Link) error {
+  simple := path.Join(fm.scanroot, repo.prefix, "simple")
+  err := createDir(simple)
+  if err != nil { return err }
+  pages := map[string]string{}
+  for project, links := range projects {
+    dir := path.Join(simple, project)
+    err = createDir(dir)
+    if err != nil { return err }
+    var page bytes.Buffer
+    err = pypi.WriteProject(&page, project, links)
+    if err == nil { err = writeFileAtomic(dir, "index.html", page.Bytes()) }
+    if err != nil { return err }
+    pages[project] = repo.prefix + "/simple/" + project + "/"
+  }
+  
+  var page bytes.Buffer
+  err = pypi.WriteRoot(&page, pages)
+  if err == nil { err = writeFileAtomic(simple, "index.html", page.Bytes()) }
+  if err != nil { return err }
+  
+  fis, err := ioutil.ReadDir(simple)
+  if err != nil { return err }
+  for _, fi := range fis {
+    if _, ok := projects[fi.Name()]; ok || !fi.IsDir() { continue }
+    // Only the generated page is removed, so that a directory with other files remains.
+    err = os.Remove(path.Join(simple, fi.Name(), "index.html"))
+    if err == nil || os.IsNotExist(err) { err = os.Remove(path.Join(simple, fi.Name())) }
+    if err != nil { util.Log(0, "WARNING! %v", err) }
+  }
+  return nil
+}
+
+// Creates dir (but not its parent) on disk if it does not exist yet.
+// Unlike fm.makeDir() the directory is not published until the next scan.
+func createDir(dir string) error {
+  err := os.Mkdir(dir, 0777 &^ UploadUmask)
+  if err == nil { err = applyOwnership(dir, true) }
+  if err != nil && !os.IsExist(err) { return err }
+  return nil
+}
@@ -0,0 +1,163 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "io"
+         "sync"
+         "time"
+         
+         "../status"
+       )
+
+// The rate class of files that have not been assigned one via Handling.RateClass.
+const DefaultRateClass = "default"
+
+/*
+  Limits shared by all downloads of files in the same rate class
+  (see Handling.RateClass).
+*/
+type RateClass struct {
+  // The maximum number of bytes per second sent for all downloads of the
+  // class together. 0 means unlimited.
+  Bandwidth int64
+  
+  // The maximum number of downloads of the class that may run at the same
+  // time. Further requests are answered with 503 Service Unavailable.
+  // 0 means unlimited.
+  Concurrency int
+}
+
+// The state of a RateClass shared by all downloads in the class.
+type rateBucket struct {
+  RateClass
+  
+  // The name of the class.
+  name string
+  
+  // Has capacity Concurrency. A download holds a slot while it runs.
+  // nil if Concurrency is unlimited.
+  slots chan bool
+  
+  // Protects next.
+  mutex sync.Mutex
+  
+  // The time at which all data read so far will have been sent at Bandwidth.
+  next time.Time
+  
+  rejected *status.Counter
+  sent *status.Counter
+}
+
+/*
+  Defines the limits for the rate class name. Files whose Handling.RateClass
+  is name share these limits. Files without a rate class belong to
+  DefaultRateClass. Downloads of files whose class has not been defined
+  are not limited.
+  Call before ServeHTTP() is called for the first time.
+*/
+func (fm *FileManager) SetRateClass(name string, limits RateClass) {
+  b := &rateBucket{RateClass:limits, name:name}
+  if limits.Concurrency > 0 {
+    b.slots = make(chan bool, limits.Concurrency)
+  }
+  b.rejected = status.NewCounter(`garcon_rate_class_rejected_total{class="`+name+`"}`, "Downloads rejected because the rate class's concurrency limit was reached.")
+  b.sent = status.NewCounter(`garcon_rate_class_bytes_total{class="`+name+`"}`, "Bytes read for downloads in the rate class.")
+  if fm.rate_classes == nil { fm.rate_classes = map[string]*rateBucket{} }
+  fm.rate_classes[name] = b
+}
+
+// Returns the rate class for files called name according to the Handling rules.
+func (fm *FileManager) rateClassFor(name string) string {
+  for i := range fm.handling {
+    if fm.handling[i].RateClass != "" && fm.handling[i].Match.MatchString(name) {
+      return fm.handling[i].RateClass
+    }
+  }
+  return ""
+}
+
+// Returns the bucket for x's rate class or nil if the class is not limited.
+func (fm *FileManager) rateBucket(x *File) *rateBucket {
+  name := x.RateClass
+  if name == "" { name = DefaultRateClass }
+  return fm.rate_classes[name]
+}
+
+// Takes a concurrency slot. Returns false if none is available.
+// If true is returned, release() must be called when the download is done.
+func (b *rateBucket) acquire() bool {
+  if b.slots == nil { return true }
+  select {
+    case b.slots <- true: return true
+    default: b.rejected.Inc()
+             return false
+  }
+}
+
+func (b *rateBucket) release() {
+  if b.slots != nil { <-b.slots }
+}
+
+// Accounts for n bytes and returns how long to wait before they may be sent.
+func (b *rateBucket) delay(n int) time.Duration {
+  b.sent.Add(uint64(n))
+  if b.Bandwidth <= 0 { return 0 }
+  b.mutex.Lock()
+  defer b.mutex.Unlock()
+  now := time.Now()
+  if b.next.Before(now) { b.next = now }
+  b.next = b.next.Add(time.Duration(int64(n) * int64(time.Second) / b.Bandwidth))
+  return b.next.Sub(now)
+}
+
+/*
+  Returns a stream that reads from stream at the bucket's bandwidth.
+  If stream implements io.Seeker, so does the result.
+*/
+func (b *rateBucket) throttle(stream io.ReadCloser) io.ReadCloser {
+  t := &throttledReader{stream, b}
+  if _, ok := stream.(io.Seeker); ok {
+    return &throttledReadSeeker{t}
+  }
+  return t
+}
+
+type throttledReader struct {
+  io.ReadCloser
+  bucket *rateBucket
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+  // Read in chunks of at most 1/8s worth of data so that the
+  // output is smooth even at low bandwidths.
+  if max := t.bucket.Bandwidth/8; max > 0 && int64(len(p)) > max {
+    if max < 512 { max = 512 }
+    if int64(len(p)) > max { p = p[:max] }
+  }
+  n, err := t.ReadCloser.Read(p)
+  if n > 0 {
+    time.Sleep(t.bucket.delay(n))
+  }
+  return n, err
+}
+
+type throttledReadSeeker struct {
+  *throttledReader
+}
+
+func (t *throttledReadSeeker) Seek(offset int64, whence int) (int64, error) {
+  return t.ReadCloser.(io.Seeker).Seek(offset, whence)
+}
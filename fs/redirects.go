@@ -0,0 +1,168 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "os"
+         "fmt"
+         "path"
+         "sort"
+         "bufio"
+         "strconv"
+         "strings"
+         "net/http"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../status"
+         "../accesslog"
+       )
+
+// The status codes a redirect map may use.
+var redirectCodes = map[int]bool{
+  http.StatusMovedPermanently: true,
+  http.StatusFound: true,
+  http.StatusSeeOther: true,
+  http.StatusTemporaryRedirect: true,
+  http.StatusPermanentRedirect: true,
+}
+
+var redirectsServed = status.NewCounter("garcon_redirects_total", "Requests answered with a redirect from a redirect map.")
+
+// Where a path or subtree has moved.
+type redirect struct {
+  // The old path. Ends with "/" for a subtree.
+  old string
+  // The new path or URL.
+  target string
+  code int
+}
+
+// Paths that have moved, with the paths or URLs they have moved to.
+type redirectMap struct {
+  // The redirects of single paths by old path.
+  paths map[string]*redirect
+  // The redirects of subtrees, longest old path first.
+  subtrees []*redirect
+}
+
+/*
+  Reads the redirects from file, which has a line "old new [code]" for
+  each moved path. old is the path (e.g. /pub/foo.tar.gz), which must be
+  below prefix. new is the path or URL (e.g. https://example.com/foo.tar.gz)
+  the client is sent to. If old ends with "/", the whole subtree has moved
+  and the rest of the path is appended to new (which should end with "/",
+  too). code is 301 (the default), 302, 303, 307 or 308. The query of the
+  request is passed on unless new has one. Empty lines and lines starting
+  with "#" are ignored.
+*/
+func readRedirectMap(file string, prefix string) (*redirectMap, error) {
+  f, err := os.Open(file)
+  if err != nil { return nil, err }
+  defer f.Close()
+  m := &redirectMap{paths:map[string]*redirect{}}
+  scanner := bufio.NewScanner(f)
+  for n := 1; scanner.Scan(); n++ {
+    line := strings.TrimSpace(scanner.Text())
+    if line == "" || line[0] == '#' { continue }
+    fields := strings.Fields(line)
+    if len(fields) < 2 || len(fields) > 3 { return nil, fmt.Errorf("%v:%v: Expected \"old new [code]\"", file, n) }
+    rd := &redirect{old:path.Clean(fields[0]), target:fields[1], code:http.StatusMovedPermanently}
+    if len(fields) == 3 {
+      rd.code, err = strconv.Atoi(fields[2])
+      if err != nil || !redirectCodes[rd.code] { return nil, fmt.Errorf("%v:%v: Illegal status code %v", file, n, fields[2]) }
+    }
+    subtree := strings.HasSuffix(fields[0], "/")
+    if subtree && rd.old != "/" { rd.old += "/" }
+    if !strings.HasPrefix(rd.old, prefix + "/") { return nil, fmt.Errorf("%v:%v: %v is not below %v/", file, n, fields[0], prefix) }
+    if subtree {
+      m.subtrees = append(m.subtrees, rd)
+    } else {
+      m.paths[rd.old] = rd
+    }
+  }
+  if err := scanner.Err(); err != nil { return nil, err }
+  sort.SliceStable(m.subtrees, func(i, j int) bool { return len(m.subtrees[i].old) > len(m.subtrees[j].old) })
+  return m, nil
+}
+
+// Returns the number of redirects in m.
+func (m *redirectMap) Len() int {
+  return len(m.paths) + len(m.subtrees)
+}
+
+// If the path of r has moved, redirects the client and returns true.
+func (m *redirectMap) serve(w http.ResponseWriter, r *http.Request) bool {
+  clean := path.Clean(r.URL.Path)
+  rd, ok := m.paths[clean]
+  target := ""
+  if ok {
+    target = rd.target
+  } else {
+    for _, rd = range m.subtrees {
+      if clean + "/" == rd.old {
+        target = rd.target
+      } else if strings.HasPrefix(clean, rd.old) {
+        target = rd.target + clean[len(rd.old):]
+      } else {
+        continue
+      }
+      ok = true
+      break
+    }
+  }
+  if !ok { return false }
+  if r.URL.RawQuery != "" && !strings.Contains(target, "?") { target += "?" + r.URL.RawQuery }
+  redirectsServed.Inc()
+  accesslog.Log(r, 1, "%v %v %v (moved to %v)", rd.code, r.Method, r.URL.Path, target)
+  http.Redirect(w, r, target, rd.code)
+  return true
+}
+
+/*
+  Makes fm redirect the paths listed in file (see readRedirectMap()) before
+  it looks them up in the directory tree. file is a path in the tree
+  (e.g. "/.redirects"), whose name should be hidden so that it is not served
+  itself. When a rescan finds that file has changed, it is read again. If it
+  has errors, the previous redirects remain in effect.
+  Call before ServeHTTP() is called for the first time.
+*/
+func (fm *FileManager) SetRedirects(file string) error {
+  fm.redirectsFile = path.Join("/", file)
+  return fm.reloadRedirects()
+}
+
+// Reads fm.redirectsFile again if it has changed since the last attempt.
+func (fm *FileManager) reloadRedirects() error {
+  if fm.redirectsFile == "" { return nil }
+  file := path.Join(fm.root(), fm.redirectsFile)
+  stamp := "missing"
+  fi, err := os.Stat(file)
+  if err == nil { stamp = fmt.Sprintf("%v %v", fi.ModTime().UnixNano(), fi.Size()) }
+  if stamp == fm.redirectsStamp { return nil }
+  fm.redirectsStamp = stamp
+  if err != nil { return err }
+  m, err := readRedirectMap(file, "")
+  if err != nil { return err }
+  fm.redirects.Store(m)
+  util.Log(1, "Read %v redirects from %v", m.Len(), fm.redirectsFile)
+  return nil
+}
+
+// If the path of r is listed in the file of SetRedirects(), redirects the client and returns true.
+func (fm *FileManager) serveRedirect(w http.ResponseWriter, r *http.Request) bool {
+  m, _ := fm.redirects.Load().(*redirectMap)
+  return m != nil && m.serve(w, r)
+}
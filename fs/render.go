@@ -0,0 +1,131 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "fmt"
+         "path"
+         "bytes"
+         "strings"
+         "net/url"
+         "net/http"
+         "io/ioutil"
+         "html/template"
+         
+         "../http2"
+         "../embedded"
+         "../markdown"
+         "../highlight"
+         "../accesslog"
+       )
+
+/*
+  If enable is true, requests for .md files are answered with the file
+  rendered as HTML. The unrendered file is available by appending "?raw=1"
+  to the URL (and is then served as text/plain).
+  Call before ServeHTTP() is called for the first time.
+*/
+func (fm *FileManager) RenderMarkdown(enable bool) {
+  fm.markdown = enable
+}
+
+/*
+  If enable is true, text files (and source files in languages known to
+  package highlight) requested with "?view=source" are answered with a
+  syntax-highlighted HTML view with line numbers.
+  Call before ServeHTTP() is called for the first time.
+*/
+func (fm *FileManager) SourceView(enable bool) {
+  fm.source_view = enable
+}
+
+/*
+  Text and source files below prefix (e.g. "/code") are shown in the
+  highlighted source view (see SourceView()) even without "?view=source".
+  The unrendered file is available by appending "?raw=1" to the URL.
+  Implies SourceView(true). Call before ServeHTTP() is called for the first time.
+*/
+func (fm *FileManager) AddSourcePrefix(prefix string) {
+  prefix = path.Clean("/" + prefix)
+  if prefix == "/" { prefix = "" }
+  fm.source_prefixes = append(fm.source_prefixes, prefix)
+  fm.source_view = true
+}
+
+// Returns true if the request r for the file with path clean is to be
+// answered with the highlighted source view.
+func (fm *FileManager) wantsSource(r *http.Request, clean string) bool {
+  if !fm.source_view { return false }
+  if !highlight.Supports(clean) && !strings.HasPrefix(mimeType(clean), "text/") { return false }
+  query := r.URL.Query()
+  if query.Get("view") == "source" { return true }
+  if query.Get("raw") == "1" { return false }
+  for _, prefix := range fm.source_prefixes {
+    if strings.HasPrefix(clean, prefix + "/") { return true }
+  }
+  return false
+}
+
+/*
+  Answers r with an HTML page produced by render from the contents of x
+  (whose path is clean). variant is appended to the ETag to distinguish
+  the page from x itself.
+*/
+func (fm *FileManager) serveRendered(w http.ResponseWriter, r *http.Request, x *File, clean string, variant string, render func(src []byte, clean string) []byte) {
+  f, _, err := fm.open(r.Context(), x, false)
+  if err == nil {
+    var src []byte
+    src, err = ioutil.ReadAll(f)
+    f.Close()
+    if err == nil {
+      page := render(src, clean)
+      
+      etag := fmt.Sprintf("%v-%v", x.Id, variant)
+      w.Header().Set("ETag", etag)
+      w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+      accesslog.Log(r, 0, "%v %v %v (ETag: %v, Content-Type: text/html; charset=UTF-8)", http.StatusOK, r.Method, r.URL.Path, etag)
+      http2.ServeContent(w, r, lastModified(r, x), int64(len(page)), bytes.NewReader(page))
+      return
+    }
+  }
+  
+  fm.readFailed(w, r, "Rendering " + clean, err)
+}
+
+// Returns the HTML page for Markdown document src whose path is clean.
+func renderMarkdownPage(src []byte, clean string) []byte {
+  content, title := markdown.ToHTML(src)
+  if title == "" { title = path.Base(clean) }
+  return fillPage(embedded.MarkdownPage, title, clean, content)
+}
+
+// Returns the HTML page with the highlighted source file src whose path is clean.
+func renderSourcePage(src []byte, clean string) []byte {
+  return fillPage(embedded.SourcePage, path.Base(clean), clean, highlight.ToHTML(src, clean))
+}
+
+// Replaces the processing instructions title, raw and content in page.
+func fillPage(page []byte, title, clean string, content []byte) []byte {
+  raw := (&url.URL{Path:path.Base(clean), RawQuery:"raw=1"}).String()
+  
+  return garconPI.ReplaceAllFunc(page, func(pi []byte) []byte {
+    switch string(garconPI.FindSubmatch(pi)[1]) {
+      case "title":   return []byte("<title>" + template.HTMLEscapeString(title) + "</title>")
+      case "raw":     return []byte(template.HTMLEscapeString(raw))
+      case "content": return content
+    }
+    return pi
+  })
+}
@@ -0,0 +1,147 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "io"
+         "os"
+         "fmt"
+         "time"
+         "bytes"
+         "errors"
+         "syscall"
+         "net/http"
+         "sync/atomic"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../problem"
+       )
+
+/*
+  While the root directory can not be read (e.g. an NFS server is down or
+  the disk has failed), it is checked this often and the last tree is
+  served from memory: directory listings, generated files and files in the
+  cache. All other requests are answered with 503.
+*/
+var RootRetryInterval = 10*time.Second
+
+// Returned by open() instead of reading a file from disk while the root directory is unavailable.
+var errRootUnavailable = errors.New("Root directory unavailable")
+
+// Returns the device of the filesystem that contains dir, 0 if unknown.
+func deviceOf(dir string) uint64 {
+  fi, err := os.Stat(dir)
+  if err != nil { return 0 }
+  if st, ok := fi.Sys().(*syscall.Stat_t); ok { return uint64(st.Dev) }
+  return 0
+}
+
+/*
+  Returns an error if the root directory can not be read or looks like an
+  unmounted mount point, i.e. is empty and on another filesystem than when
+  it was last scanned.
+*/
+func (fm *FileManager) readRoot() error {
+  root := fm.root()
+  d, err := os.Open(root)
+  if err != nil { return err }
+  defer d.Close()
+  _, err = d.Readdirnames(1)
+  if err == io.EOF {
+    if dev := atomic.LoadUint64(&fm.rootdev); dev != 0 && deviceOf(root) != dev {
+      return fmt.Errorf("%v is empty and on another filesystem than before. Unmounted?", root)
+    }
+    return nil
+  }
+  return err
+}
+
+// Returns true while the root directory is unavailable.
+func (fm *FileManager) rootUnavailable() bool {
+  return atomic.LoadInt32(&fm.unavailable) != 0
+}
+
+/*
+  Called when reading below the root directory has failed. Returns true if
+  the root directory is unavailable. If it has just become unavailable,
+  logs an error, calls the alert webhook and starts checking every
+  RootRetryInterval whether it is back.
+*/
+func (fm *FileManager) checkRoot() bool {
+  if fm.rootUnavailable() { return true }
+  err := fm.readRoot()
+  if err == nil { return false }
+  if !atomic.CompareAndSwapInt32(&fm.unavailable, 0, 1) { return true }
+  util.Log(0, "ERROR! %v is unavailable: %v => Serving from memory only", fm.rootdir, err)
+  go fm.sendAlert(&alert{Root:fm.rootdir, Healthy:false, Message:fmt.Sprintf("Root directory unavailable: %v", err), Refreshed:fm.lastRefresh().Unix()})
+  go fm.awaitRoot()
+  return true
+}
+
+// Marks the root directory as available again after checkRoot() has found it unavailable.
+func (fm *FileManager) rootAvailable() {
+  if !atomic.CompareAndSwapInt32(&fm.unavailable, 1, 0) { return }
+  util.Log(0, "%v is available again", fm.rootdir)
+  go fm.sendAlert(&alert{Root:fm.rootdir, Healthy:true, Message:"Root directory available again", Refreshed:fm.lastRefresh().Unix()})
+}
+
+/*
+  Checks every RootRetryInterval whether the root directory can be read
+  again and, when it can, serves from it again and makes AutoUpdate()
+  rescan it in case it is waiting for inotify events that a failed
+  filesystem never sends.
+*/
+func (fm *FileManager) awaitRoot() {
+  for fm.rootUnavailable() {
+    time.Sleep(RootRetryInterval)
+    if fm.readRoot() == nil {
+      fm.rootAvailable()
+      if atomic.LoadInt32(&fm.waiting) != 0 { fm.requestScan() }
+      return
+    }
+  }
+}
+
+/*
+  Like open() but takes the data of x only from the cache, without reading
+  from disk. Returns errRootUnavailable if it is not cached.
+*/
+func (fm *FileManager) openCached(x *File, keep_encoded bool) (io.ReadCloser, bool, error) {
+  if fm.cache != nil {
+    if x.Encoding != "" && !keep_encoded {
+      if data, ok := fm.cache.Get(x.Id, DECOMPRESSED); ok { return &BytesReadCloser{*bytes.NewReader(data)}, false, nil }
+    }
+    if data, ok := fm.cache.Get(x.Id, RAW); ok { return x.wrapStream(&BytesReadCloser{*bytes.NewReader(data)}, keep_encoded) }
+  }
+  return nil, false, errRootUnavailable
+}
+
+/*
+  Answers r after reading a file failed with err: With 503 and Retry-After
+  if the root directory is unavailable, otherwise with 500. what describes
+  the operation for the log.
+*/
+func (fm *FileManager) readFailed(w http.ResponseWriter, r *http.Request, what string, err error) {
+  if err == errRootUnavailable || fm.checkRoot() {
+    problem.Log(r, http.StatusServiceUnavailable, problem.StorageUnavailable, "%v", err)
+    w.Header().Set("Retry-After", fmt.Sprintf("%v", int(RootRetryInterval/time.Second) + 1))
+    problem.Write(w, r, http.StatusServiceUnavailable, problem.StorageUnavailable, "The file is temporarily unavailable. Try again later")
+    return
+  }
+  util.Log(0, "ERROR! %v: %v", what, err)
+  problem.Log(r, http.StatusInternalServerError, problem.Internal, "")
+  problem.Write(w, r, http.StatusInternalServerError, problem.Internal, "")
+}
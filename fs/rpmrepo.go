@@ -0,0 +1,253 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "io"
+         "os"
+         "fmt"
+         "path"
+         "sort"
+         "time"
+         "bytes"
+         "regexp"
+         "strings"
+         "io/ioutil"
+         "crypto/sha256"
+         "compress/gzip"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../rpm"
+         "../pgp"
+       )
+
+/*
+  A directory whose repodata/ is generated from the .rpm files in it and its
+  subdirectories, so that yum and dnf can use it as repository, e.g.
+    [garcon]
+    baseurl=https://example.com/rpms/
+  Whenever the scan finds that .rpm files have been added, replaced or
+  removed, new metadata files are written to repodata/ under names that
+  contain their checksums and then repomd.xml (and its signature) is
+  replaced. The metadata files of the previous repomd.xml are kept for
+  clients that are still reading it. Older ones are removed.
+*/
+type rpmRepo struct {
+  // URL path of the directory (without trailing slash).
+  prefix string
+  
+  // The keys that sign repodata/repomd.xml (repomd.xml.asc). Their
+  // public keys are in repodata/repomd.xml.key.
+  keys *pgp.Keyring
+  
+  // Describes the packages the current repodata has been generated from.
+  state string
+}
+
+// Matches the hrefs in repomd.xml.
+var repomdHref = regexp.MustCompile(`<location href="repodata/([^"/]+)"`)
+
+/*
+  Makes the directory prefix an RPM repository (see rpmRepo). repomd.xml
+  is signed with the keys of keys that sign at the time (which may be none
+  or nil). The repodata is generated by AutoUpdate(), starting right away.
+  Call before AutoUpdate().
+*/
+func (fm *FileManager) AddRPMRepo(prefix string, keys *pgp.Keyring) {
+  fm.rpm_repos = append(fm.rpm_repos, &rpmRepo{prefix:strings.TrimSuffix(path.Clean(prefix), "/"), keys:keys})
+}
+
+/*
+  Regenerates the repodata of every RPM repository in tree whose packages
+  have changed since its last update. The new files are picked up by the
+  next scan.
+  Must only be called by the goroutine that scans the directory tree.
+*/
+func (fm *FileManager) updateRPMRepos(tree map[string]*File) {
+  headers := map[uint64]*rpm.Package{}
+  for _, repo := range fm.rpm_repos {
+    dir := fileAt(tree, strings.TrimPrefix(repo.prefix, "/"))
+    if dir == nil || !dir.Info.IsDir() {
+      if repo.state != "-" { util.Log(0, "WARNING! RPM repository %v: No such directory", repo.prefix) }
+      repo.state = "-"
+      continue
+    }
+    
+    packages := map[string]*File{}
+    collectRPMs("", dir.Contents, packages)
+    names := []string{}
+    for name := range packages { names = append(names, name) }
+    sort.Strings(names)
+    var state bytes.Buffer
+    state.WriteString(signingState(repo.keys, time.Now()))
+    for _, name := range names { fmt.Fprintf(&state, "%v %v\n", name, packages[name].Id) }
+    if state.String() == repo.state {
+      for _, x := range packages {
+        if p := fm.rpm_headers[x.Id]; p != nil { headers[x.Id] = p }
+      }
+      continue
+    }
+    
+    entries := []rpm.Entry{}
+    for _, name := range names {
+      x := packages[name]
+      p := fm.rpm_headers[x.Id]
+      if p == nil {
+        var err error
+        p, err = readRPM(x)
+        if err != nil {
+          util.Log(0, "WARNING! RPM repository %v: Skipping %v: %v", repo.prefix, name, err)
+          continue
+        }
+      }
+      headers[x.Id] = p
+      sum, err := fm.checksum(x)
+      if err != nil {
+        util.Log(0, "WARNING! RPM repository %v: Skipping %v: %v", repo.prefix, name, err)
+        continue
+      }
+      entries = append(entries, rpm.Entry{Package:p, Location:name, Checksum:sum, Size:x.Info.Size(), Time:x.Info.ModTime().Unix()})
+    }
+    
+    err := fm.writeRepodata(repo, entries)
+    if err != nil {
+      util.Log(0, "ERROR! RPM repository %v: %v", repo.prefix, err)
+      continue
+    }
+    util.Log(1, "RPM repository %v: Metadata for %v packages written", repo.prefix, len(entries))
+    repo.state = state.String()
+  }
+  // Forget the headers of packages that are gone.
+  fm.rpm_headers = headers
+}
+
+// Adds the .rpm Files below dir, whose path relative to the repository
+// is dirpath, to packages by their relative paths.
+func collectRPMs(dirpath string, dir map[string]*File, packages map[string]*File) {
+  for name, x := range dir {
+    if dirpath == "" && name == "repodata" { continue }
+    if x.Info.IsDir() {
+      collectRPMs(dirpath + name + "/", x.Contents, packages)
+    } else if strings.HasSuffix(name, ".rpm") && x.Encoding == "" {
+      packages[dirpath + name] = x
+    }
+  }
+}
+
+// Reads the header of the package x.
+func readRPM(x *File) (*rpm.Package, error) {
+  stream, _, err := x.GetStream(true)
+  if err != nil { return nil, err }
+  defer stream.Close()
+  return rpm.Read(stream)
+}
+
+/*
+  Writes the metadata for entries to the repodata directory of repo on disk.
+  repomd.xml is replaced last, so that it only refers to complete files.
+*/
+func (fm *FileManager) writeRepodata(repo *rpmRepo, entries []rpm.Entry) error {
+  dir := path.Join(fm.scanroot, repo.prefix, "repodata")
+  err := os.Mkdir(dir, 0777 &^ UploadUmask)
+  if err == nil { err = applyOwnership(dir, true) }
+  if err != nil && !os.IsExist(err) { return err }
+  
+  // Keep the files of the previous repomd.xml.
+  keep := map[string]bool{"repomd.xml":true, "repomd.xml.asc":true, "repomd.xml.key":true}
+  if old, err := ioutil.ReadFile(path.Join(dir, "repomd.xml")); err == nil {
+    for _, m := range repomdHref.FindAllSubmatch(old, -1) { keep[string(m[1])] = true }
+  }
+  
+  now := time.Now()
+  files := []rpm.Metadata{}
+  for _, typ := range []string{"primary", "filelists"} {
+    write := rpm.WritePrimary
+    if typ == "filelists" { write = rpm.WriteFilelists }
+    m, err := writeMetadata(dir, typ, func(w io.Writer) error { return write(w, entries) })
+    if err != nil { return err }
+    m.Timestamp = now.Unix()
+    files = append(files, *m)
+    keep[path.Base(m.Location)] = true
+  }
+  
+  var repomd bytes.Buffer
+  err = rpm.WriteRepomd(&repomd, now.Unix(), files)
+  if err != nil { return err }
+  sig, err := repo.keys.Sign(repomd.Bytes(), now)
+  if err != nil { return err }
+  // The new key must be available before anything is signed with it.
+  err = writeKeyring(dir, "repomd.xml.key", repo.keys, now)
+  if err == nil { err = writeFileAtomic(dir, "repomd.xml", repomd.Bytes()) }
+  if err == nil {
+    if sig != nil {
+      err = writeFileAtomic(dir, "repomd.xml.asc", pgp.Armor(sig, "PGP SIGNATURE"))
+    } else {
+      // Remove the signature from when a key was signing, which no longer matches.
+      err = os.Remove(path.Join(dir, "repomd.xml.asc"))
+      if os.IsNotExist(err) { err = nil }
+    }
+  }
+  if err != nil { return err }
+  
+  fis, err := ioutil.ReadDir(dir)
+  if err != nil { return err }
+  for _, fi := range fis {
+    if !keep[fi.Name()] && !fi.IsDir() && !strings.HasPrefix(fi.Name(), ".") {
+      err = os.Remove(path.Join(dir, fi.Name()))
+      if err != nil { util.Log(0, "WARNING! %v", err) }
+    }
+  }
+  return nil
+}
+
+/*
+  Writes the gzipped data produced by write to dir as <checksum>-<typ>.xml.gz
+  and returns its description for repomd.xml (without Timestamp).
+*/
+func writeMetadata(dir, typ string, write func(w io.Writer) error) (*rpm.Metadata, error) {
+  var gz bytes.Buffer
+  open := sha256.New()
+  zip := gzip.NewWriter(&gz)
+  counter := &countingWriter{}
+  err := write(io.MultiWriter(zip, open, counter))
+  if err == nil { err = zip.Close() }
+  if err != nil { return nil, err }
+  
+  m := &rpm.Metadata{Type:typ, OpenChecksum:fmt.Sprintf("%x", open.Sum(nil)), OpenSize:counter.n, Size:int64(gz.Len())}
+  m.Checksum = fmt.Sprintf("%x", sha256.Sum256(gz.Bytes()))
+  name := m.Checksum + "-" + typ + ".xml.gz"
+  m.Location = "repodata/" + name
+  return m, writeFileAtomic(dir, name, gz.Bytes())
+}
+
+// Counts the bytes written to it.
+type countingWriter struct {
+  n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+  c.n += int64(len(p))
+  return len(p), nil
+}
+
+// Writes data to a hidden temporary file in dir and renames it to name.
+func writeFileAtomic(dir, name string, data []byte) error {
+  u, err := stageUpload(dir, bytes.NewReader(data), int64(len(data)), time.Now())
+  if err != nil { return err }
+  defer u.discard()
+  _, err = u.install(name)
+  return err
+}
@@ -0,0 +1,112 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "os"
+         "fmt"
+         "path"
+         "time"
+         "bytes"
+         "io/ioutil"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../pgp"
+       )
+
+/*
+  Returns a description of which keys of keys sign and which are published
+  at the time now. It is part of the state of a repository, so that its
+  metadata is signed anew when a key's window starts or ends.
+*/
+func signingState(keys *pgp.Keyring, now time.Time) string {
+  var state bytes.Buffer
+  state.WriteString("signed by")
+  for _, k := range keys.Signers(now) { fmt.Fprintf(&state, " %v", k) }
+  state.WriteString(", published")
+  for _, k := range keys.Published(now) { fmt.Fprintf(&state, " %v", k) }
+  state.WriteString("\n")
+  return state.String()
+}
+
+/*
+  Writes the public keys of keys that are published at the time now to the
+  file name in dir, so that clients can fetch the new key before it is
+  needed. The file is removed if there are none.
+*/
+func writeKeyring(dir, name string, keys *pgp.Keyring, now time.Time) error {
+  export := keys.Export(now)
+  if export == nil {
+    err := os.Remove(path.Join(dir, name))
+    if err != nil && !os.IsNotExist(err) { return err }
+    return nil
+  }
+  return writeFileAtomic(dir, name, export)
+}
+
+/*
+  Makes the scan goroutine rescan the tree whenever a signing key of a
+  repository starts or stops signing, so that the metadata is signed
+  anew even if no package changes. Runs forever.
+*/
+func (fm *FileManager) watchKeyrings() {
+  for {
+    now := time.Now()
+    var next time.Time
+    for _, keys := range fm.keyrings() {
+      t := keys.NextChange(now)
+      if !t.IsZero() && (next.IsZero() || t.Before(next)) { next = t }
+    }
+    if next.IsZero() { return }
+    time.Sleep(next.Sub(now))
+    util.Log(1, "Signing keys changed at %v", next.Format(time.RFC3339))
+    fm.requestScan()
+  }
+}
+
+// Returns the keyrings of all repositories that are signed.
+func (fm *FileManager) keyrings() []*pgp.Keyring {
+  var keyrings []*pgp.Keyring
+  for _, repo := range fm.rpm_repos {
+    if repo.keys.Len() > 0 { keyrings = append(keyrings, repo.keys) }
+  }
+  for _, repo := range fm.arch_repos {
+    if repo.keys.Len() > 0 { keyrings = append(keyrings, repo.keys) }
+  }
+  return keyrings
+}
+
+/*
+  Makes the goroutine in AutoUpdate() rescan the tree by creating and
+  removing a hidden file in the root directory, which it watches. A
+  read-only image is not watched, so AutoUpdate() is woken up directly.
+*/
+func (fm *FileManager) requestScan() {
+  if fm.readonly {
+    select {
+      case fm.wake <- true:
+      default: // a rescan is pending already
+    }
+    return
+  }
+  f, err := ioutil.TempFile(fm.root(), ".rescan-")
+  if err != nil {
+    util.Log(0, "ERROR! Requesting rescan: %v", err)
+    return
+  }
+  f.Close()
+  os.Remove(f.Name())
+}
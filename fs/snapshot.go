@@ -0,0 +1,283 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "io"
+         "os"
+         "fmt"
+         "bytes"
+         "strconv"
+         "strings"
+         "io/ioutil"
+         
+         "github.com/mbenkmann/golib/util"
+       )
+
+/*
+  Tools that maintain Debian repositories (reprepro, aptly, dak,...) rewrite
+  a suite's metadata (Packages, Sources, Contents,... and the Release,
+  InRelease and Release.gpg files that list their checksums) one file at
+  a time. A client that fetches the metadata while this is in progress gets
+  files that do not match the checksums in Release and apt fails with
+  "Hash Sum mismatch".
+  
+  To prevent this, the metadata of each suite (a directory that contains
+  Release or InRelease) is served from a snapshot that is only replaced when
+  the new metadata is complete and signed. The Files of a snapshot refer to
+  open *os.Files, so the snapshot remains available after the files on disk
+  have been replaced. This requires that the files are replaced by renaming
+  new files over them (as all common tools do) rather than rewriting them
+  in place.
+*/
+
+// Maps paths relative to a suite directory to the Files of its metadata.
+// The Data of these Files is the *os.File opened when the snapshot was taken.
+type suiteSnapshot map[string]*File
+
+// A checksummed file listed in a Release file.
+type releaseEntry struct {
+  name string
+  size int64
+  // "" if Release only has MD5Sum or SHA1 checksums.
+  sha256 string
+}
+
+// Returns true if the directory dir contains the Release file of a suite.
+func isSuite(dir map[string]*File) bool {
+  for _, name := range []string{"Release", "InRelease"} {
+    if x, ok := dir[name]; ok && !x.Info.IsDir() { return true }
+  }
+  return false
+}
+
+/*
+  Puts the metadata files of all suites in the directory tree dir, whose
+  URL path is dirpath, into the tree as snapshots (see above). If a suite's
+  metadata is consistent, a new snapshot is taken. Otherwise the previous
+  snapshot is put into the tree in place of the new files.
+  Must only be called by the goroutine that scans the directory tree.
+*/
+func (fm *FileManager) snapshotSuites(dir map[string]*File) {
+  suites := map[string]suiteSnapshot{}
+  fm.snapshotSuitesBelow("", dir, suites)
+  // Previous snapshots that are no longer referenced are closed by
+  // the garbage collector once the requests using them are done.
+  fm.suites = suites
+}
+
+func (fm *FileManager) snapshotSuitesBelow(dirpath string, dir map[string]*File, suites map[string]suiteSnapshot) {
+  if isSuite(dir) {
+    snap := suiteSnapshot{}
+    pins := map[string]*os.File{}
+    err := fm.takeSnapshot(dir, snap, pins)
+    if err != nil {
+      for _, f := range pins { f.Close() }
+      old := fm.suites[dirpath]
+      if old == nil {
+        util.Log(0, "WARNING! Suite %v: %v", dirpath, err)
+        snap = nil
+      } else {
+        util.Log(1, "Suite %v: %v. Serving previous metadata until the update is complete.", dirpath, err)
+        snap = old
+      }
+    } else {
+      util.Log(2, "Suite %v: Snapshot of %v files", dirpath, len(snap))
+    }
+    
+    if snap != nil {
+      suites[dirpath] = snap
+      for rel, x := range snap { replaceFile(dir, rel, x) }
+    }
+  }
+  
+  for name, x := range dir {
+    if x.Info.IsDir() {
+      fm.snapshotSuitesBelow(dirpath+"/"+name, x.Contents, suites)
+    }
+  }
+}
+
+// Returns the File at path rel (relative to dir) or nil if there is none.
+func fileAt(dir map[string]*File, rel string) *File {
+  parts := strings.Split(rel, "/")
+  for i, part := range parts {
+    x, ok := dir[part]
+    if !ok { return nil }
+    if i == len(parts)-1 { return x }
+    if !x.Info.IsDir() { return nil }
+    dir = x.Contents
+  }
+  return nil
+}
+
+// Puts x into the tree dir at path rel, if the directory for it exists.
+func replaceFile(dir map[string]*File, rel string, x *File) {
+  parts := strings.Split(rel, "/")
+  for _, part := range parts[:len(parts)-1] {
+    d, ok := dir[part]
+    if !ok || !d.Info.IsDir() { return }
+    dir = d.Contents
+  }
+  dir[parts[len(parts)-1]] = x
+}
+
+/*
+  Pins the Release files of the suite directory dir and all files listed
+  in them and stores them in snap. Returns an error if the metadata is not
+  consistent, i.e. if InRelease does not match Release, Release.gpg is older
+  than Release or a listed file does not match its size or SHA-256.
+  Files listed in Release that do not exist are ignored, because Release
+  usually lists uncompressed variants that are not on disk.
+  pins maps the paths on disk to the *os.Files opened so far.
+*/
+func (fm *FileManager) takeSnapshot(dir map[string]*File, snap suiteSnapshot, pins map[string]*os.File) error {
+  pin := func(rel string) (*File, error) {
+    x := fileAt(dir, rel)
+    if x == nil || x.Info.IsDir() { return nil, nil }
+    ondisk, ok := x.Data.(string)
+    if !ok { return x, nil }
+    key := x.String()
+    f, ok := pins[key]
+    if !ok {
+      var err error
+      f, err = os.Open(ondisk + "/" + x.Info.Name())
+      if err != nil { return nil, err }
+      pins[key] = f
+      fi, err := f.Stat()
+      if err != nil { return nil, err }
+      if fi.Size() != x.Info.Size() || !fi.ModTime().Equal(x.Info.ModTime()) {
+        return nil, fmt.Errorf("%v has changed since the scan", rel)
+      }
+    }
+    p := *x
+    p.Data = f
+    snap[rel] = &p
+    return &p, nil
+  }
+  
+  var release []byte
+  rel, err := pin("Release")
+  if err != nil { return err }
+  if rel != nil {
+    release, err = readFile(rel)
+    if err != nil { return err }
+  }
+  
+  inrel, err := pin("InRelease")
+  if err != nil { return err }
+  if inrel != nil {
+    data, err := readFile(inrel)
+    if err != nil { return err }
+    body, err := clearsignedText(data)
+    if err != nil { return fmt.Errorf("InRelease: %v", err) }
+    if release == nil {
+      release = body
+    } else if !bytes.Equal(bytes.TrimSpace(body), bytes.TrimSpace(release)) {
+      return fmt.Errorf("InRelease does not match Release")
+    }
+  }
+  
+  gpg, err := pin("Release.gpg")
+  if err != nil { return err }
+  if gpg != nil && rel != nil && gpg.Info.ModTime().Before(rel.Info.ModTime()) {
+    return fmt.Errorf("Release.gpg is older than Release")
+  }
+  
+  for _, e := range releaseEntries(release) {
+    x, err := pin(e.name)
+    if err != nil { return err }
+    // Compressed aliases are checked via the file they are derived from.
+    if x == nil || x.Encoding != "" { continue }
+    if x.Info.Size() != e.size {
+      return fmt.Errorf("%v has size %v but Release says %v", e.name, x.Info.Size(), e.size)
+    }
+    if e.sha256 != "" {
+      sum, err := fm.checksum(x)
+      if err != nil { return err }
+      if sum != e.sha256 {
+        return fmt.Errorf("SHA-256 of %v does not match Release", e.name)
+      }
+    }
+  }
+  
+  return nil
+}
+
+// Returns the contents of the pinned file x.
+func readFile(x *File) ([]byte, error) {
+  stream, _, err := x.GetStream(true)
+  if err != nil { return nil, err }
+  defer stream.Close()
+  return ioutil.ReadAll(stream)
+}
+
+/*
+  Returns the signed text of the OpenPGP clearsigned message data
+  (e.g. an InRelease file).
+*/
+func clearsignedText(data []byte) ([]byte, error) {
+  lines := strings.SplitAfter(string(data), "\n")
+  i := 0
+  for i < len(lines) && strings.TrimSpace(lines[i]) != "-----BEGIN PGP SIGNED MESSAGE-----" { i++ }
+  if i == len(lines) { return nil, fmt.Errorf("Not a clearsigned message") }
+  // Skip the armor headers (e.g. "Hash: SHA256") up to the empty line
+  for i < len(lines) && strings.TrimSpace(lines[i]) != "" { i++ }
+  i++
+  
+  var text bytes.Buffer
+  for ; i < len(lines); i++ {
+    if strings.TrimSpace(lines[i]) == "-----BEGIN PGP SIGNATURE-----" {
+      return text.Bytes(), nil
+    }
+    text.WriteString(strings.TrimPrefix(lines[i], "- "))
+  }
+  return nil, fmt.Errorf("Signature missing")
+}
+
+// Parses the MD5Sum, SHA1 and SHA256 fields of the Release file data.
+func releaseEntries(data []byte) []releaseEntry {
+  var entries []releaseEntry
+  index := map[string]int{}
+  field := ""
+  for _, line := range strings.Split(string(data), "\n") {
+    if line == "" { continue }
+    if line[0] != ' ' && line[0] != '\t' {
+      field = strings.TrimSpace(strings.SplitN(line, ":", 2)[0])
+      continue
+    }
+    if field != "MD5Sum" && field != "SHA1" && field != "SHA256" { continue }
+    f := strings.Fields(line)
+    if len(f) != 3 { continue }
+    size, err := strconv.ParseInt(f[1], 10, 64)
+    if err != nil { continue }
+    k, ok := index[f[2]]
+    if !ok {
+      k = len(entries)
+      index[f[2]] = k
+      entries = append(entries, releaseEntry{name:f[2], size:size})
+    }
+    if field == "SHA256" { entries[k].sha256 = strings.ToLower(f[0]) }
+  }
+  return entries
+}
+
+// The stream returned by GetStream() for a File of a snapshot.
+// The *os.File is shared by all requests, so Close() does nothing.
+type pinnedReader struct {
+  io.SectionReader
+}
+
+func (*pinnedReader) Close() error { return nil }
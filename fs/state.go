@@ -0,0 +1,233 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "os"
+         "fmt"
+         "path"
+         "time"
+         "bufio"
+         "errors"
+         "strings"
+         "encoding/gob"
+         "compress/gzip"
+         
+         "github.com/mbenkmann/golib/util"
+       )
+
+/*
+  If not "", SaveState() writes the directory tree to this file and
+  NewFileManager() loads the tree from it instead of scanning the whole
+  directory tree before it returns. The loaded tree is checked against the
+  filesystem by the first rescan of AutoUpdate(), which takes over all
+  unchanged entries, so that a restart of a huge mirror can serve right away.
+  The file is interpreted after chroot.
+*/
+var StateFile = ""
+
+// Identifies the format of the state file. Change it whenever stateHeader
+// or stateEntry change.
+const stateVersion = 2
+
+// The beginning of the state file.
+type stateHeader struct {
+  Version int
+  
+  // The root directory and the Handling rules of the FileManager that
+  // saved the tree. If they don't match, the state file is not used.
+  Root string
+  Handling string
+  
+  // The number of entries in the root directory.
+  Entries int
+}
+
+/*
+  A directory entry in the state file. The entries are stored depth first,
+  i.e. each directory is followed by its Entries entries.
+*/
+type stateEntry struct {
+  // The name of the entry in its directory.
+  Name string
+  
+  // The name of the file in the filesystem if different from Name (aliases).
+  Original string
+  
+  Size int64
+  Mode os.FileMode
+  ModTime int64 // UnixNano
+  Id uint64
+  Encoding string
+  Sparse bool
+  
+  // The number of entries if this is a directory.
+  Entries int
+}
+
+var errBadState = errors.New("Corrupt state file")
+
+// Returns a description of the rules that determine which entries scan()
+// puts into the tree.
+func (fm *FileManager) handlingFingerprint() string {
+  var b strings.Builder
+  for i := range fm.handling {
+    h := &fm.handling[i]
+    fmt.Fprintf(&b, "%q %v %q %q %q\n", h.Match.String(), h.Hide, h.Gzip, h.Bzip2, h.Xz)
+  }
+  fmt.Fprintf(&b, "%v\n", AliasConflictPolicy)
+  return b.String()
+}
+
+/*
+  Returns the entries of dir (the filesystem directory dirpath) that come
+  from the filesystem, i.e. without generated and published files.
+*/
+func stateEntries(dirpath string, dir map[string]*File) map[string]*File {
+  entries := map[string]*File{}
+  for name, x := range dir {
+    if x == nil { continue }
+    if d, ok := x.Data.(string); ok && d == dirpath {
+      entries[name] = x
+    }
+  }
+  return entries
+}
+
+/*
+  Writes the directory tree currently served by fm to StateFile. The file is
+  replaced atomically, so that a crash while saving leaves the old one intact.
+*/
+func (fm *FileManager) SaveState() error {
+  if StateFile == "" { return nil }
+  start := time.Now()
+  tmp := StateFile + ".tmp"
+  f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+  if err != nil { return err }
+  defer os.Remove(tmp)
+  defer f.Close()
+  
+  buf := bufio.NewWriter(f)
+  z, _ := gzip.NewWriterLevel(buf, gzip.BestSpeed)
+  enc := gob.NewEncoder(z)
+  
+  root := stateEntries(fm.root(), fm.current().root.Contents)
+  err = enc.Encode(&stateHeader{Version:stateVersion, Root:fm.root(), Handling:fm.handlingFingerprint(), Entries:len(root)})
+  if err != nil { return err }
+  count, err := saveDir(enc, fm.root(), root)
+  if err != nil { return err }
+  
+  err = z.Close()
+  if err != nil { return err }
+  err = buf.Flush()
+  if err != nil { return err }
+  err = f.Sync()
+  if err != nil { return err }
+  err = os.Rename(tmp, StateFile)
+  if err != nil { return err }
+  util.Log(1, "Saved %v entries to %v in %v", count, StateFile, time.Since(start))
+  return nil
+}
+
+// Writes the entries of the filesystem directory dirpath to enc. Returns the
+// number of entries written including those in subdirectories.
+func saveDir(enc *gob.Encoder, dirpath string, entries map[string]*File) (int, error) {
+  count := 0
+  for name, x := range entries {
+    e := stateEntry{Name:name, Size:x.Info.Size(), Mode:x.Info.Mode(), ModTime:x.Info.ModTime().UnixNano(), Id:x.Id, Encoding:x.Encoding, Sparse:x.Sparse}
+    if x.Info.Name() != name { e.Original = x.Info.Name() }
+    var sub map[string]*File
+    if x.Info.IsDir() {
+      sub = stateEntries(path.Join(dirpath, name), x.Contents)
+      e.Entries = len(sub)
+    }
+    err := enc.Encode(&e)
+    if err != nil { return count, err }
+    count++
+    if sub != nil {
+      n, err := saveDir(enc, path.Join(dirpath, name), sub)
+      count += n
+      if err != nil { return count, err }
+    }
+  }
+  return count, nil
+}
+
+/*
+  Returns the directory tree stored in StateFile or nil if the file does not
+  exist or has been saved by a FileManager with a different configuration.
+*/
+func (fm *FileManager) loadState() (map[string]*File, error) {
+  start := time.Now()
+  f, err := os.Open(StateFile)
+  if os.IsNotExist(err) {
+    util.Log(1, "No state file %v => Scanning", StateFile)
+    return nil, nil
+  }
+  if err != nil { return nil, err }
+  defer f.Close()
+  z, err := gzip.NewReader(bufio.NewReader(f))
+  if err != nil { return nil, err }
+  dec := gob.NewDecoder(z)
+  
+  var header stateHeader
+  err = dec.Decode(&header)
+  if err != nil { return nil, err }
+  if header.Version != stateVersion || header.Root != fm.rootdir || header.Handling != fm.handlingFingerprint() {
+    util.Log(1, "State file %v does not match the configuration => Scanning", StateFile)
+    return nil, nil
+  }
+  
+  var maxid uint64
+  tree := map[string]*File{}
+  count, err := fm.loadDir(dec, fm.rootdir, header.Entries, tree, &maxid)
+  if err != nil { return nil, err }
+  
+  // Ids from the previous run must not be handed out again because the
+  // cache and the checksums are keyed by Id.
+  raiseIds(maxid)
+  
+  util.Log(1, "Loaded %v entries from %v in %v", count, StateFile, time.Since(start))
+  return tree, nil
+}
+
+// Reads n entries of the filesystem directory dirpath from dec into dir.
+// Returns the number of entries read including those in subdirectories.
+func (fm *FileManager) loadDir(dec *gob.Decoder, dirpath string, n int, dir map[string]*File, maxid *uint64) (int, error) {
+  count := 0
+  for ; n > 0; n-- {
+    var e stateEntry
+    err := dec.Decode(&e)
+    if err != nil { return count, err }
+    count++
+    if e.Name == "" || e.Name == "." || e.Name == ".." || strings.Contains(e.Name, "/") || e.Original == "." || e.Original == ".." || strings.Contains(e.Original, "/") || e.Entries < 0 {
+      return count, errBadState
+    }
+    name := e.Name
+    if e.Original != "" { name = e.Original }
+    x := &File{Info:&FileInfo{name, e.Size, e.Mode, time.Unix(0, e.ModTime), e.Mode.IsDir()}, Id:e.Id, Encoding:e.Encoding, Data:dirpath, RateClass:fm.rateClassFor(name), Sparse:e.Sparse}
+    if e.Id > *maxid { *maxid = e.Id }
+    dir[e.Name] = x
+    if x.Info.IsDir() {
+      x.Contents = map[string]*File{}
+      n, err := fm.loadDir(dec, path.Join(dirpath, e.Name), e.Entries, x.Contents, maxid)
+      count += n
+      if err != nil { return count, err }
+    } else if e.Entries != 0 {
+      return count, errBadState
+    }
+  }
+  return count, nil
+}
@@ -0,0 +1,172 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "context"
+         "io"
+         "fmt"
+         "path"
+         "bytes"
+         "time"
+         "strings"
+         "net/http"
+         "crypto/sha256"
+         "encoding/json"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../http2"
+         "../debian"
+         "../problem"
+         "../accesslog"
+       )
+
+// The variants of an index file that are tried, with their encodings.
+var indexVariants = []struct{ ext, encoding string }{{"", ""}, {".xz", "xz"}, {".gz", "gzip"}, {".bz2", "bzip2"}, {".zst", "zstd"}}
+
+/*
+  Answers requests for a suite directory with "?diff=<other suite>", e.g.
+    /debian/dists/testing/?diff=stable
+  with the packages that are added, removed, upgraded or downgraded in the
+  requested suite compared to the other one, i.e. what promoting testing
+  to stable would change. The other suite is a URL path or a path relative
+  to the parent of the requested suite, which the client must be allowed
+  to read (see Authorize). With "&format=json" or an Accept
+  header that prefers application/json, the result is JSON. The packages
+  are taken from the same snapshot of the metadata that is served to apt.
+  The ETag changes whenever the tree changes, so that clients can poll
+  with If-None-Match.
+  Returns false if clean is not a suite, so that it is served as usual.
+*/
+func (fm *FileManager) serveSuiteDiff(w http.ResponseWriter, r *http.Request, clean string) bool {
+  if _, err := fm.suiteRelease(clean); err != nil { return false }
+  asJSON := r.URL.Query().Get("format") == "json" || strings.HasPrefix(r.Header.Get("Accept"), "application/json")
+  w.Header().Set("Vary", "Accept")
+  format := "html"
+  if asJSON { format = "json" }
+  other := r.URL.Query().Get("diff")
+  if !strings.HasPrefix(other, "/") { other = path.Join(path.Dir(clean), other) }
+  other = path.Clean(other)
+  // The access policy has only checked the requested suite.
+  if !fm.mayRead(r, other) {
+    problem.Log(r, http.StatusNotFound, problem.NotFound, "%v not readable", other)
+    problem.Write(w, r, http.StatusNotFound, problem.NotFound, fmt.Sprintf("%v is not a suite", other))
+    return true
+  }
+  if Authorize != nil && (!Authorize(nil, clean) || !Authorize(nil, other)) { w.Header().Set("Cache-Control", "private") }
+  query := sha256.Sum256([]byte(r.URL.RawQuery))
+  if fm.generatedETag(w, r, fmt.Sprintf("diff-%x-%v", query[0:8], format)) { return true }
+  
+  old, err := fm.suitePackages(other)
+  var pkgs []debian.Package
+  if err == nil { pkgs, err = fm.suitePackages(clean) }
+  if err != nil {
+    w.Header().Del("ETag")
+    problem.Log(r, http.StatusNotFound, problem.NotFound, "%v", err)
+    problem.Write(w, r, http.StatusNotFound, problem.NotFound, err.Error())
+    return true
+  }
+  d := debian.DiffPackages(other, old, clean, pkgs)
+  
+  var buf bytes.Buffer
+  if asJSON {
+    w.Header().Set("Content-Type", "application/json")
+    err = json.NewEncoder(&buf).Encode(d)
+  } else {
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    err = d.WriteHTML(&buf)
+  }
+  if err != nil {
+    w.Header().Del("ETag")
+    util.Log(0, "ERROR! Diff %v: %v", r.URL, err)
+    problem.Log(r, http.StatusInternalServerError, problem.Internal, "")
+    problem.Write(w, r, http.StatusInternalServerError, problem.Internal, "")
+    return true
+  }
+  accesslog.Log(r, 1, "%v %v %v (%v added, %v removed, %v upgraded, %v downgraded)", http.StatusOK, r.Method, r.URL.Path, len(d.Added), len(d.Removed), len(d.Upgraded), len(d.Downgraded))
+  http2.ServeContent(w, r, time.Time{}, int64(buf.Len()), bytes.NewReader(buf.Bytes()))
+  return true
+}
+
+// Returns the contents of the Release file (or the text of InRelease) of
+// the suite at the URL path suite.
+func (fm *FileManager) suiteRelease(suite string) ([]byte, error) {
+  if data, err := fm.readServed(suite + "/Release"); err == nil { return data, nil }
+  data, err := fm.readServed(suite + "/InRelease")
+  if err != nil { return nil, fmt.Errorf("%v is not a suite", suite) }
+  return clearsignedText(data)
+}
+
+/*
+  Returns the contents of the file that is served at clean (decompressed if
+  it is an alias for a compressed file) or an error if there is none.
+*/
+func (fm *FileManager) readServed(clean string) ([]byte, error) {
+  stream, err := fm.openServed(clean, "")
+  if err != nil { return nil, err }
+  defer stream.Close()
+  var buf bytes.Buffer
+  _, err = io.Copy(&buf, stream)
+  return buf.Bytes(), err
+}
+
+// Returns the stream of the file served at clean, decompressed with
+// encoding if it is not "".
+func (fm *FileManager) openServed(clean, encoding string) (io.ReadCloser, error) {
+  x, resolved, ok := fm.lookup(clean)
+  if !ok || resolved != clean || x.Info.IsDir() { return nil, fmt.Errorf("%v: not found", clean) }
+  stream, _, err := fm.open(context.Background(), x, false)
+  if err != nil || encoding == "" { return stream, err }
+  dec, err := NewDecompressor(encoding, stream)
+  if err != nil {
+    stream.Close()
+    return nil, err
+  }
+  return dec, nil
+}
+
+/*
+  Returns the binary and source packages of the suite at the URL path suite
+  from the Packages and Sources files listed in its Release file.
+*/
+func (fm *FileManager) suitePackages(suite string) ([]debian.Package, error) {
+  release, err := fm.suiteRelease(suite)
+  if err != nil { return nil, err }
+  indexes := map[string]bool{}
+  for _, e := range releaseEntries(release) {
+    name := e.name
+    for _, v := range indexVariants { name = strings.TrimSuffix(name, v.ext) }
+    base := path.Base(name)
+    if (base == "Packages" || base == "Sources") && !strings.Contains(name, "/by-hash/") { indexes[name] = true }
+  }
+  
+  var pkgs []debian.Package
+  for index := range indexes {
+    component := strings.SplitN(index, "/", 2)[0]
+    var stream io.ReadCloser
+    for _, v := range indexVariants {
+      stream, err = fm.openServed(suite + "/" + index + v.ext, v.encoding)
+      if err == nil { break }
+    }
+    // Release usually lists variants that are not on disk.
+    if stream == nil { continue }
+    p, err := debian.ReadPackages(stream, component, path.Base(index) == "Sources")
+    stream.Close()
+    if err != nil { return nil, fmt.Errorf("%v/%v: %v", suite, index, err) }
+    pkgs = append(pkgs, p...)
+  }
+  return pkgs, nil
+}
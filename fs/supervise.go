@@ -0,0 +1,206 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "fmt"
+         "net"
+         "time"
+         "bytes"
+         "context"
+         "net/url"
+         "net/http"
+         "crypto/x509"
+         "sync/atomic"
+         "encoding/json"
+         "runtime/debug"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../notify"
+         "../status"
+       )
+
+/*
+  If a tree has not been brought up to date with the filesystem for longer
+  than this, Supervise() logs an error and calls the alert webhook (see
+  SetAlertWebhook()). A tree whose watcher is waiting for inotify events
+  counts as up to date. 0 disables the check.
+*/
+var RefreshDeadline time.Duration
+
+// The longest time Supervise() waits before restarting AutoUpdate() after a panic.
+const maxRestartBackoff = 5*time.Minute
+
+// If AutoUpdate() ran for at least this long before a panic, it is restarted
+// after a second again.
+const restartBackoffReset = 10*time.Minute
+
+// The webhook that alerts are POSTed to. nil if none. See SetAlertWebhook().
+var alertHook *webhook
+
+type webhook struct {
+  endpoint string
+  client *http.Client
+}
+
+// The JSON object POSTed to the alert webhook.
+type alert struct {
+  Root string `json:"root"`
+  Healthy bool `json:"healthy"`
+  Message string `json:"message"`
+  // Unix time of the last refresh of the tree.
+  Refreshed int64 `json:"refreshed"`
+}
+
+/*
+  Makes Supervise() POST a JSON object {"root":...,"healthy":false,
+  "message":...,"refreshed":...} to endpoint when a tree misses the
+  RefreshDeadline, its watcher crashes or its root directory becomes
+  unavailable (see RootRetryInterval), and the same with "healthy":true
+  when it has recovered. The host name is resolved right away, so that this
+  can be called before chroot.
+*/
+func SetAlertWebhook(endpoint string) error {
+  u, err := url.Parse(endpoint)
+  if err != nil { return err }
+  if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+    return fmt.Errorf("Expected http:// or https:// URL, got %v", endpoint)
+  }
+  addrs, err := net.LookupHost(u.Hostname())
+  if err != nil { return err }
+  if u.Scheme == "https" {
+    _, err = x509.SystemCertPool()
+    if err != nil { return err }
+  }
+  dialer := &net.Dialer{Timeout:10*time.Second}
+  client := &http.Client{
+    Timeout: 30*time.Second,
+    Transport: &http.Transport{
+      DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+        host, port, err := net.SplitHostPort(addr)
+        if err != nil { return nil, err }
+        if host == u.Hostname() {
+          for _, ip := range addrs {
+            conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+            if err == nil { return conn, nil }
+          }
+        }
+        return dialer.DialContext(ctx, network, addr)
+      },
+    },
+  }
+  alertHook = &webhook{endpoint:u.String(), client:client}
+  return nil
+}
+
+// POSTs a to the alert webhook if there is one and sends it as a notification. Errors are logged.
+func (fm *FileManager) sendAlert(a *alert) {
+  notify.Send(notify.Alert, fmt.Sprintf("%v %v", a.Root, a.Healthy), fmt.Sprintf("%v: %v", a.Root, a.Message), fmt.Sprintf("%v\n\nLast refreshed: %v", a.Message, time.Unix(a.Refreshed, 0).Format(time.RFC3339)))
+  if alertHook == nil { return }
+  data, _ := json.Marshal(a)
+  resp, err := alertHook.client.Post(alertHook.endpoint, "application/json", bytes.NewReader(data))
+  if err == nil {
+    resp.Body.Close()
+    if resp.StatusCode/100 != 2 { err = fmt.Errorf("%v", resp.Status) }
+  }
+  if err != nil { util.Log(0, "ERROR! Alert webhook %v: %v", alertHook.endpoint, err) }
+}
+
+// Returns the time when the tree of fm was last known to be up to date.
+func (fm *FileManager) lastRefresh() time.Time {
+  if atomic.LoadInt32(&fm.waiting) != 0 { return time.Now() }
+  return time.Unix(0, atomic.LoadInt64(&fm.refreshed))
+}
+
+// Returns true if the watcher of fm is running and the tree has not missed the RefreshDeadline.
+func (fm *FileManager) watcherHealthy() bool {
+  if atomic.LoadInt32(&fm.crashed) != 0 { return false }
+  return RefreshDeadline <= 0 || time.Since(fm.lastRefresh()) <= RefreshDeadline
+}
+
+/*
+  Runs AutoUpdate() and restarts it after a panic, waiting a second after
+  the first one and twice as long after each one that follows quickly, up
+  to maxRestartBackoff. Alerts when the tree misses the RefreshDeadline.
+  Never returns. Call in a goroutine instead of AutoUpdate().
+*/
+func (fm *FileManager) Supervise() {
+  restarts := status.NewCounter(fmt.Sprintf(`garcon_watcher_restarts_total{root=%q}`, fm.rootdir), "Restarts of the watcher of a tree after a crash.")
+  status.NewGauge(fmt.Sprintf(`garcon_watcher_healthy{root=%q}`, fm.rootdir), "1 if the watcher of the tree runs and the tree has been refreshed within the deadline.", func() int64 {
+    if fm.watcherHealthy() { return 1 }
+    return 0
+  })
+  status.NewGauge(fmt.Sprintf(`garcon_root_available{root=%q}`, fm.rootdir), "0 while the root directory of the tree can not be read and only files in memory are served.", func() int64 {
+    if fm.rootUnavailable() { return 0 }
+    return 1
+  })
+  status.NewGauge(fmt.Sprintf(`garcon_tree_refresh_age_seconds{root=%q}`, fm.rootdir), "Seconds since the tree was last known to be up to date.", func() int64 {
+    return int64(time.Since(fm.lastRefresh())/time.Second)
+  })
+  go fm.checkRefreshDeadline()
+  
+  backoff := time.Second
+  for {
+    start := time.Now()
+    crash := fm.runAutoUpdate()
+    restarts.Inc()
+    if time.Since(start) >= restartBackoffReset { backoff = time.Second }
+    atomic.StoreInt32(&fm.crashed, 1)
+    atomic.StoreInt32(&fm.waiting, 0)
+    util.Log(0, "ERROR! Watcher of %v crashed: %v => Restarting in %v", fm.rootdir, crash, backoff)
+    fm.sendAlert(&alert{Root:fm.rootdir, Healthy:false, Message:fmt.Sprintf("Watcher crashed: %v", crash), Refreshed:fm.lastRefresh().Unix()})
+    time.Sleep(backoff)
+    atomic.StoreInt32(&fm.crashed, 0)
+    backoff *= 2
+    if backoff > maxRestartBackoff { backoff = maxRestartBackoff }
+  }
+}
+
+// Calls AutoUpdate() and returns what it panicked with.
+func (fm *FileManager) runAutoUpdate() (crash interface{}) {
+  defer func() {
+    crash = recover()
+    if crash != nil { util.Log(0, "ERROR! %v\n%s", crash, debug.Stack()) }
+  }()
+  fm.AutoUpdate()
+  return nil
+}
+
+/*
+  Logs an error and calls the alert webhook whenever the tree of fm misses
+  the RefreshDeadline and logs (and calls the webhook again) when it has
+  been refreshed after that. Never returns.
+*/
+func (fm *FileManager) checkRefreshDeadline() {
+  if RefreshDeadline <= 0 { return }
+  interval := RefreshDeadline/4
+  if interval > time.Minute { interval = time.Minute }
+  late := false
+  for {
+    time.Sleep(interval)
+    refreshed := fm.lastRefresh()
+    age := time.Since(refreshed)
+    if age > RefreshDeadline && !late {
+      late = true
+      util.Log(0, "ERROR! %v has not been refreshed for %v (deadline: %v)", fm.rootdir, age.Round(time.Second), RefreshDeadline)
+      fm.sendAlert(&alert{Root:fm.rootdir, Healthy:false, Message:fmt.Sprintf("Not refreshed for %v", age.Round(time.Second)), Refreshed:refreshed.Unix()})
+    } else if age <= RefreshDeadline && late {
+      late = false
+      util.Log(0, "%v has been refreshed again", fm.rootdir)
+      fm.sendAlert(&alert{Root:fm.rootdir, Healthy:true, Message:"Refreshed again", Refreshed:refreshed.Unix()})
+    }
+  }
+}
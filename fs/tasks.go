@@ -0,0 +1,128 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "fmt"
+         "path"
+         "time"
+         "strings"
+         "net/http"
+         "sync/atomic"
+         
+         "github.com/mbenkmann/golib/util"
+       )
+
+// Makes the tree be scanned again soon, like the admin API's rescan.
+func (fm *FileManager) Rescan() {
+  fm.requestScan()
+}
+
+/*
+  Makes the next scan regenerate (and sign anew) the metadata of all RPM,
+  Arch, PyPI and Maven repositories, even if nothing has changed, e.g.
+  before the signatures expire.
+*/
+func (fm *FileManager) Regenerate() {
+  atomic.StoreInt32(&fm.regenerate, 1)
+  fm.requestScan()
+}
+
+/*
+  Copies the metadata of the Debian suite (e.g. /debian/dists/stable), as
+  served, to a new suite name next to it. If name is "", the suite's name
+  with the current time (UTC) appended is used.
+*/
+func (fm *FileManager) snapshotSuite(suite, name string) (*suiteCopy, error) {
+  suite = path.Clean("/" + suite)
+  if name == "" { name = path.Base(suite) + "-" + time.Now().UTC().Format("20060102T150405Z") }
+  if strings.Contains(name, "/") || fm.handlingFor(name).Hide || name == ".." {
+    return nil, fmt.Errorf("Illegal name: %v", name)
+  }
+  return fm.copySuite(suite, path.Join(path.Dir(suite), name), false)
+}
+
+/*
+  Like the admin API's snapshot with the default name, e.g. to keep the
+  state of a suite every night. Returns the URL path of the new suite.
+*/
+func (fm *FileManager) SnapshotSuite(suite string) (string, error) {
+  c, err := fm.snapshotSuite(suite, "")
+  if err != nil { return "", err }
+  util.Log(1, "Snapshot of %v: %v (%v files)", c.From, c.To, c.Copied)
+  return c.To, nil
+}
+
+// Discards the responses to the requests made by SyncProxy().
+type discardResponse struct {
+  header http.Header
+  status int
+}
+
+func (d *discardResponse) Header() http.Header { return d.header }
+
+func (d *discardResponse) Write(b []byte) (int, error) {
+  if d.status == 0 { d.status = http.StatusOK }
+  return len(b), nil
+}
+
+func (d *discardResponse) WriteHeader(status int) { d.status = status }
+
+// Appends the URL paths of the files below the directory with URL path dir to paths.
+func collectFiles(dir string, contents map[string]*File, paths *[]string) {
+  for name, x := range contents {
+    if x.Info.IsDir() {
+      collectFiles(path.Join(dir, name), x.Contents, paths)
+    } else {
+      *paths = append(*paths, path.Join(dir, name))
+    }
+  }
+}
+
+/*
+  Revalidates the expired files cached below the proxy prefix (see AddProxy()
+  and AddAptProxy()) with upstream like requests for them would, so that
+  e.g. the metadata of an apt proxy is kept fresh even when no clients ask.
+  Returns an error if upstream could not be reached for some files.
+*/
+func (fm *FileManager) SyncProxy(prefix string) error {
+  prefix = strings.TrimSuffix(path.Clean(prefix), "/")
+  var p *proxyPrefix
+  for _, q := range fm.proxies {
+    if q.prefix == prefix { p = q }
+  }
+  if p == nil { return fmt.Errorf("%v is not a proxy prefix", prefix) }
+  
+  var paths []string
+  if dir := fileAt(fm.current().root.Contents, strings.TrimPrefix(prefix, "/")); dir != nil && dir.Info.IsDir() {
+    collectFiles(prefix, dir.Contents, &paths)
+  }
+  refreshed := 0
+  errors := p.errors.Value()
+  now := time.Now()
+  for _, clean := range paths {
+    local := path.Join(fm.root(), clean)
+    meta := readProxyMeta(path.Join(path.Dir(local), "." + path.Base(local) + ".proxy"))
+    if meta == nil || now.Before(meta.Expires) { continue }
+    r, err := http.NewRequest("GET", clean, nil)
+    if err != nil { continue }
+    fm.refreshProxied(&discardResponse{header:http.Header{}}, r, p)
+    refreshed++
+  }
+  failed := p.errors.Value() - errors
+  util.Log(1, "Proxy %v: Revalidated %v of %v cached files", prefix, refreshed, len(paths))
+  if failed > 0 { return fmt.Errorf("%v of %v expired files could not be revalidated", failed, refreshed) }
+  return nil
+}
@@ -0,0 +1,211 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "fmt"
+         "path"
+         "sort"
+         "strings"
+         
+         "github.com/mbenkmann/golib/util"
+       )
+
+/*
+  A set of changes to the served directory tree that become visible
+  together when Commit() is called. Clients never see a state in which only
+  some of the changes have been made, e.g. a new Packages file without the
+  matching Release file.
+  
+  Files whose Data is []byte (i.e. files that exist only in memory) remain
+  in the tree across rescans until they are removed by another Transaction.
+  All other changes only last until the next rescan, which reflects the
+  state on disk. So files on disk should be written to disk first and then
+  published with a Transaction to make them visible without waiting for
+  the rescan. Generated index pages are updated by the next rescan, too.
+  
+  A Transaction is not safe for concurrent use by multiple goroutines.
+*/
+type Transaction struct {
+  fm *FileManager
+  changes []change
+}
+
+// A single change of a Transaction.
+type change struct {
+  // The path (starting with "/") that is changed.
+  path string
+  
+  // The new File for path. nil if path is to be removed.
+  x *File
+  
+  // If not "", the File at path is an alias with this Encoding for
+  // the File at path original.
+  encoding string
+  original string
+}
+
+// Starts a new Transaction on fm's directory tree.
+func (fm *FileManager) Begin() *Transaction {
+  return &Transaction{fm:fm}
+}
+
+/*
+  Stages x to be served at path p (starting with "/"), replacing the file
+  that is there. The directory containing p must exist.
+  If x.Id is 0, a new Id is assigned.
+*/
+func (t *Transaction) Put(p string, x *File) {
+  if x.Id == 0 { x.Id = nextId() }
+  t.changes = append(t.changes, change{path:path.Clean(p), x:x})
+}
+
+// Stages the removal of the file or directory at path p (starting with "/").
+func (t *Transaction) Remove(p string) {
+  t.changes = append(t.changes, change{path:path.Clean(p)})
+}
+
+/*
+  Stages an alias at path p for the compressed file at path original that is
+  served with Content-Encoding: encoding ("gzip", "bzip2" or "xz") to clients
+  that accept it and decompressed for others. original may have been staged
+  by the same Transaction.
+*/
+func (t *Transaction) Alias(p string, original string, encoding string) {
+  t.changes = append(t.changes, change{path:path.Clean(p), encoding:encoding, original:path.Clean(original)})
+}
+
+/*
+  Makes all staged changes visible at once. If one of them can not be made
+  (e.g. because the directory for a file does not exist), none of them are
+  made and an error is returned.
+*/
+func (t *Transaction) Commit() error {
+  fm := t.fm
+  fm.mutex.Lock()
+  defer fm.mutex.Unlock()
+  
+  state := fm.current()
+  tree := state.root.Contents
+  var err error
+  for i := range t.changes {
+    tree, err = t.changes[i].applyTo(tree)
+    if err != nil { return err }
+  }
+  fm.state.Store(state.with(tree))
+  
+  for _, c := range t.changes {
+    fm.unpublish(c.path)
+    if c.x == nil { continue }
+    if _, inmem := c.x.Data.([]byte); inmem && !c.x.Info.IsDir() {
+      if fm.published == nil { fm.published = map[string]*File{} }
+      fm.published[c.path] = c.x
+    }
+  }
+  
+  util.Log(1, "Committed %v changes", len(t.changes))
+  return nil
+}
+
+// Forgets the in-memory files published at p or below p.
+// Must be called with fm.mutex locked.
+func (fm *FileManager) unpublish(p string) {
+  for q := range fm.published {
+    if q == p || strings.HasPrefix(q, p + "/") { delete(fm.published, q) }
+  }
+}
+
+/*
+  Puts the in-memory files published by Transactions into tree, which
+  has been created by a rescan, and returns the resulting tree.
+  Files whose directory no longer exists are dropped.
+  Must be called with fm.mutex locked.
+*/
+func (fm *FileManager) republish(tree map[string]*File) map[string]*File {
+  paths := []string{}
+  for p := range fm.published { paths = append(paths, p) }
+  sort.Strings(paths)
+  for _, p := range paths {
+    newtree, err := (&change{path:p, x:fm.published[p]}).applyTo(tree)
+    if err != nil {
+      util.Log(0, "ERROR! Dropping published file: %v", err)
+      delete(fm.published, p)
+      continue
+    }
+    tree = newtree
+  }
+  return tree
+}
+
+/*
+  Returns a copy of tree with c applied. Only the directories along c.path
+  are copied, so that tree itself (which may be served at the same time)
+  is not modified.
+*/
+func (c *change) applyTo(tree map[string]*File) (map[string]*File, error) {
+  x := c.x
+  if c.encoding != "" {
+    orig := fileAt(tree, strings.TrimPrefix(c.original, "/"))
+    if orig == nil || orig.Info.IsDir() {
+      return nil, fmt.Errorf("%v: No such file", c.original)
+    }
+    alias := *orig
+    alias.Encoding = c.encoding
+    x = &alias
+    c.x = x
+  }
+  
+  parts := strings.Split(strings.TrimPrefix(c.path, "/"), "/")
+  if parts[0] == "" || parts[0] == "." {
+    return nil, fmt.Errorf("%v: Can not replace the root directory", c.path)
+  }
+  return replaced(tree, parts, x, c.path)
+}
+
+// Returns a copy of dir in which the entry at path parts is x (removed if x is nil).
+// p is the complete path for error messages.
+func replaced(dir map[string]*File, parts []string, x *File, p string) (map[string]*File, error) {
+  name := parts[0]
+  cur, exists := dir[name]
+  var entry *File
+  
+  if len(parts) == 1 {
+    if x == nil && !exists {
+      return nil, fmt.Errorf("%v: No such file or directory", p)
+    }
+    if x != nil && exists && cur.Info.IsDir() != x.Info.IsDir() {
+      return nil, fmt.Errorf("%v: Can not replace directory with file or vice versa", p)
+    }
+    entry = x
+  } else {
+    if !exists || !cur.Info.IsDir() {
+      return nil, fmt.Errorf("%v: No such directory", path.Join(strings.TrimSuffix(p, strings.Join(parts, "/")), name))
+    }
+    contents, err := replaced(cur.Contents, parts[1:], x, p)
+    if err != nil { return nil, err }
+    d := *cur
+    d.Contents = contents
+    entry = &d
+  }
+  
+  c := make(map[string]*File, len(dir)+1)
+  for k, v := range dir { c[k] = v }
+  if entry == nil {
+    delete(c, name)
+  } else {
+    c[name] = entry
+  }
+  return c, nil
+}
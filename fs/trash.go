@@ -0,0 +1,189 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "os"
+         "fmt"
+         "path"
+         "sort"
+         "time"
+         "errors"
+         "strings"
+         "syscall"
+         "strconv"
+         "net/http"
+         "io/ioutil"
+         "encoding/json"
+         
+         "github.com/mbenkmann/golib/util"
+       )
+
+/*
+  How long files deleted with the admin API's remove are kept in TrashDir,
+  from where they can be restored, before they are deleted for good.
+  0 means that remove deletes files right away.
+*/
+var TrashRetention = 7*24*time.Hour
+
+/*
+  The directory below the server root that holds the removed files. Each
+  file is stored as <id> next to <id>.json with its trashEntry. The name
+  must be hidden by the Handling rules, so that the trash is not served.
+*/
+const TrashDir = ".trash"
+
+// A file in the trash.
+type trashEntry struct {
+  Id uint64 `json:"id"`
+  // The URL path the file had.
+  Path string `json:"path"`
+  Size int64 `json:"size"`
+  Deleted time.Time `json:"deleted"`
+}
+
+// The answer to "trash".
+type trashList struct {
+  Retention string `json:"retention"`
+  // Newest first.
+  Files []*trashEntry `json:"files"`
+}
+
+/*
+  Moves the file name in the filesystem directory dir, which is served as
+  the URL path clean, to the trash. The caller must hold uploadmutex.
+*/
+func (fm *FileManager) moveToTrash(dir, name, clean string, size int64) error {
+  if !fm.handlingFor(TrashDir).Hide {
+    return &adminErr{http.StatusInternalServerError, TrashDir + " is not hidden. Not moving " + clean + " to the trash"}
+  }
+  trash := path.Join(fm.root(), TrashDir)
+  err := os.MkdirAll(trash, 0700)
+  if err != nil { return err }
+  e := &trashEntry{Id:nextId(), Path:clean, Size:size, Deleted:time.Now().UTC()}
+  data, _ := json.Marshal(e)
+  meta := path.Join(trash, fmt.Sprintf("%v.json", e.Id))
+  err = ioutil.WriteFile(meta, data, 0600)
+  if err != nil { return err }
+  err = os.Rename(path.Join(dir, name), path.Join(trash, fmt.Sprintf("%v", e.Id)))
+  if err != nil {
+    os.Remove(meta)
+    if errors.Is(err, syscall.EXDEV) {
+      return &adminErr{http.StatusConflict, clean + " is not on the same filesystem as /" + TrashDir}
+    }
+    return err
+  }
+  util.Log(1, "Moved %v to the trash as %v", clean, e.Id)
+  return nil
+}
+
+// Returns the files in the trash that r may read, newest first.
+func (fm *FileManager) listTrash(r *http.Request) (*trashList, error) {
+  fm.ExpireTrash()
+  list := &trashList{Retention:TrashRetention.String(), Files:[]*trashEntry{}}
+  trash := path.Join(fm.root(), TrashDir)
+  fis, err := ioutil.ReadDir(trash)
+  if os.IsNotExist(err) { return list, nil }
+  if err != nil { return nil, err }
+  for _, fi := range fis {
+    if !strings.HasSuffix(fi.Name(), ".json") { continue }
+    e, err := readTrashEntry(path.Join(trash, fi.Name()))
+    if err != nil {
+      util.Log(0, "ERROR! %v", err)
+      continue
+    }
+    if !fm.mayRead(r, e.Path) { continue }
+    list.Files = append(list.Files, e)
+  }
+  sort.Slice(list.Files, func(i, j int) bool { return list.Files[i].Deleted.After(list.Files[j].Deleted) })
+  return list, nil
+}
+
+// Reads the trashEntry from the file meta.
+func readTrashEntry(meta string) (*trashEntry, error) {
+  data, err := ioutil.ReadFile(meta)
+  if err != nil { return nil, err }
+  e := &trashEntry{}
+  err = json.Unmarshal(data, e)
+  if err != nil { return nil, fmt.Errorf("%v: %v", meta, err) }
+  if e.Path != path.Clean("/" + e.Path) || e.Path == "/" { return nil, fmt.Errorf("%v: Illegal path %v", meta, e.Path) }
+  return e, nil
+}
+
+/*
+  Moves the file with the Id id from the trash back to its original path,
+  unless a file with that name has appeared in the meantime. r must be
+  allowed to read and modify the original path.
+*/
+func (fm *FileManager) restore(r *http.Request, idstr string) (*trashEntry, error) {
+  id, err := strconv.ParseUint(idstr, 10, 64)
+  if err != nil { return nil, fmt.Errorf("Illegal id: %v", idstr) }
+  
+  fm.uploadmutex.Lock()
+  defer fm.uploadmutex.Unlock()
+  trash := path.Join(fm.root(), TrashDir)
+  meta := path.Join(trash, fmt.Sprintf("%v.json", id))
+  e, err := readTrashEntry(meta)
+  if os.IsNotExist(err) { return nil, &adminErr{http.StatusNotFound, idstr + ": Not in the trash"} }
+  if err != nil { return nil, err }
+  // Like listTrash(), which does not list it.
+  if !fm.mayRead(r, e.Path) { return nil, &adminErr{http.StatusNotFound, idstr + ": Not in the trash"} }
+  if !fm.mayWrite(r, e.Path) { return nil, &adminErr{http.StatusForbidden, e.Path + ": Permission denied"} }
+  for _, part := range strings.Split(e.Path, "/") {
+    if part != "" && fm.handlingFor(part).Hide { return nil, fmt.Errorf("Illegal path: %v", e.Path) }
+  }
+  
+  // Link() instead of Rename(), because it does not replace an existing file.
+  target := path.Join(fm.root(), e.Path)
+  err = os.Link(path.Join(trash, fmt.Sprintf("%v", id)), target)
+  if os.IsExist(err) { return nil, &adminErr{http.StatusConflict, e.Path + " exists"} }
+  if os.IsNotExist(err) { return nil, &adminErr{http.StatusConflict, path.Dir(e.Path) + ": No such directory"} }
+  if err != nil { return nil, err }
+  os.Remove(path.Join(trash, fmt.Sprintf("%v", id)))
+  os.Remove(meta)
+  util.Log(1, "Restored %v from the trash", e.Path)
+  return e, nil
+}
+
+// Deletes the files that have been in the trash for longer than TrashRetention.
+func (fm *FileManager) ExpireTrash() {
+  fm.uploadmutex.Lock()
+  defer fm.uploadmutex.Unlock()
+  trash := path.Join(fm.root(), TrashDir)
+  fis, err := ioutil.ReadDir(trash)
+  if err != nil { return }
+  cutoff := time.Now().Add(-TrashRetention)
+  for _, fi := range fis {
+    if !strings.HasSuffix(fi.Name(), ".json") { continue }
+    meta := path.Join(trash, fi.Name())
+    e, err := readTrashEntry(meta)
+    if err != nil || e.Deleted.After(cutoff) { continue }
+    err = os.Remove(strings.TrimSuffix(meta, ".json"))
+    if err != nil && !os.IsNotExist(err) {
+      util.Log(0, "ERROR! Expiring trash: %v", err)
+      continue
+    }
+    os.Remove(meta)
+    util.Log(1, "Deleted %v (removed %v) from the trash", e.Path, e.Deleted.Format(time.RFC3339))
+  }
+}
+
+// Calls ExpireTrash() every hour. Never returns.
+func (fm *FileManager) expireTrashPeriodically() {
+  for {
+    fm.ExpireTrash()
+    time.Sleep(time.Hour)
+  }
+}
@@ -0,0 +1,183 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "io"
+         "os"
+         "fmt"
+         "path"
+         "sort"
+         "time"
+         "bufio"
+         "strings"
+         "net/http"
+         "encoding/gob"
+         "compress/gzip"
+       )
+
+// A file that differs between a state file and the tree. See DiffState().
+type TreeDiffEntry struct {
+  Path string `json:"path"`
+  
+  // The current size and mtime, or for removed files the ones in the state file.
+  Size int64 `json:"size"`
+  ModTime time.Time `json:"mtime"`
+  
+  // Only for changed files: the size and mtime in the state file.
+  OldSize *int64 `json:"old_size,omitempty"`
+  OldModTime *time.Time `json:"old_mtime,omitempty"`
+}
+
+// The result of DiffState().
+type TreeDiff struct {
+  // The state file and when it was saved.
+  State string `json:"state"`
+  Saved time.Time `json:"saved"`
+  
+  Added []TreeDiffEntry `json:"added"`
+  Removed []TreeDiffEntry `json:"removed"`
+  Changed []TreeDiffEntry `json:"changed"`
+  
+  // How much the total size of the files has changed.
+  Bytes int64 `json:"bytes"`
+}
+
+/*
+  Reads the state file (see SaveState()) and returns its files (not the
+  directories) by URL path. The file must have been saved with the same
+  handling of files as fm's, because otherwise files that are hidden or
+  aliased differently would show up as changes. It may have been saved
+  for a different root directory, e.g. by a Garçon running in a chroot.
+*/
+func (fm *FileManager) readStateFiles(file string) (map[string]*stateEntry, error) {
+  f, err := os.Open(file)
+  if err != nil { return nil, err }
+  defer f.Close()
+  z, err := gzip.NewReader(bufio.NewReader(f))
+  if err != nil { return nil, err }
+  dec := gob.NewDecoder(z)
+  
+  var header stateHeader
+  err = dec.Decode(&header)
+  if err != nil { return nil, err }
+  if header.Version != stateVersion {
+    return nil, fmt.Errorf("%v has version %v instead of %v", file, header.Version, stateVersion)
+  }
+  if header.Handling != fm.handlingFingerprint() {
+    return nil, fmt.Errorf("%v has been saved with a different handling of files", file)
+  }
+  files := map[string]*stateEntry{}
+  return files, readStateDir(dec, "/", header.Entries, files)
+}
+
+// Reads n entries of the directory with URL path dir from dec and adds the files to files.
+func readStateDir(dec *gob.Decoder, dir string, n int, files map[string]*stateEntry) error {
+  for ; n > 0; n-- {
+    e := &stateEntry{}
+    err := dec.Decode(e)
+    if err != nil { return err }
+    if e.Name == "" || e.Name == "." || e.Name == ".." || strings.Contains(e.Name, "/") || e.Entries < 0 {
+      return errBadState
+    }
+    p := path.Join(dir, e.Name)
+    if e.Mode.IsDir() {
+      err = readStateDir(dec, p, e.Entries, files)
+      if err != nil { return err }
+    } else {
+      files[p] = e
+    }
+  }
+  return nil
+}
+
+// Adds the files from the filesystem below the directory with URL path dir to files.
+func collectStateFiles(dirpath, dir string, contents map[string]*File, files map[string]*File) {
+  for name, x := range stateEntries(dirpath, contents) {
+    p := path.Join(dir, name)
+    if x.Info.IsDir() {
+      collectStateFiles(path.Join(dirpath, name), p, x.Contents, files)
+    } else {
+      files[p] = x
+    }
+  }
+}
+
+/*
+  Compares the tree currently served by fm with the state file (see
+  SaveState()), e.g. a copy of StateFile made the evening before, and
+  returns the files that have been added, removed or changed (size or
+  mtime) since it was saved. Like the state file, only files from the
+  filesystem are compared, not generated ones. Files that r may not read
+  (see Authorize) are left out. r may be nil.
+*/
+func (fm *FileManager) DiffState(r *http.Request, file string) (*TreeDiff, error) {
+  fi, err := os.Stat(file)
+  if err != nil { return nil, err }
+  old, err := fm.readStateFiles(file)
+  if err != nil { return nil, err }
+  cur := map[string]*File{}
+  collectStateFiles(fm.root(), "/", fm.current().root.Contents, cur)
+  
+  d := &TreeDiff{State:file, Saved:fi.ModTime(), Added:[]TreeDiffEntry{}, Removed:[]TreeDiffEntry{}, Changed:[]TreeDiffEntry{}}
+  for p, x := range cur {
+    if !fm.mayRead(r, p) { continue }
+    e := TreeDiffEntry{Path:p, Size:x.Info.Size(), ModTime:x.Info.ModTime()}
+    o := old[p]
+    switch {
+      case o == nil:
+        d.Added = append(d.Added, e)
+        d.Bytes += e.Size
+      case o.Size != e.Size || o.ModTime != e.ModTime.UnixNano():
+        size, mtime := o.Size, time.Unix(0, o.ModTime)
+        e.OldSize, e.OldModTime = &size, &mtime
+        d.Changed = append(d.Changed, e)
+        d.Bytes += e.Size - size
+    }
+  }
+  for p, o := range old {
+    if cur[p] != nil || !fm.mayRead(r, p) { continue }
+    d.Removed = append(d.Removed, TreeDiffEntry{Path:p, Size:o.Size, ModTime:time.Unix(0, o.ModTime)})
+    d.Bytes -= o.Size
+  }
+  for _, l := range [][]TreeDiffEntry{d.Added, d.Removed, d.Changed} {
+    sort.Slice(l, func(i, j int) bool { return l[i].Path < l[j].Path })
+  }
+  return d, nil
+}
+
+// Writes d as text, one file per line, with "+" for added, "-" for removed and "~" for changed files.
+func (d *TreeDiff) Write(w io.Writer) {
+  for _, e := range d.Added { fmt.Fprintf(w, "+ %v (%v bytes)\n", e.Path, e.Size) }
+  for _, e := range d.Removed { fmt.Fprintf(w, "- %v (%v bytes)\n", e.Path, e.Size) }
+  for _, e := range d.Changed { fmt.Fprintf(w, "~ %v (%v -> %v bytes)\n", e.Path, *e.OldSize, e.Size) }
+  fmt.Fprintf(w, "Since %v: %v added, %v removed, %v changed, %+d bytes\n", d.Saved.Format(time.RFC3339), len(d.Added), len(d.Removed), len(d.Changed), d.Bytes)
+}
+
+/*
+  Returns the diff of the admin API: The tree compared with StateFile or,
+  if name is not "", with the file name next to it.
+*/
+func (fm *FileManager) diffStateNamed(r *http.Request, name string) (*TreeDiff, error) {
+  if StateFile == "" { return nil, &adminErr{http.StatusNotFound, "No state file"} }
+  file := StateFile
+  if name != "" {
+    if strings.Contains(name, "/") || name == "." || name == ".." { return nil, fmt.Errorf("Illegal name: %v", name) }
+    file = path.Join(path.Dir(StateFile), name)
+  }
+  d, err := fm.DiffState(r, file)
+  if os.IsNotExist(err) { return nil, &adminErr{http.StatusNotFound, err.Error()} }
+  return d, err
+}
@@ -0,0 +1,442 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "io"
+         "os"
+         "fmt"
+         "math"
+         "path"
+         "time"
+         "bytes"
+         "errors"
+         "strings"
+         "net/http"
+         "io/ioutil"
+         "archive/tar"
+         "archive/zip"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../problem"
+         "../accesslog"
+       )
+
+// Returned by walkArchive() for entries whose names point outside of the
+// target directory.
+var errUnsafePath = errors.New("Archive contains unsafe path")
+
+// Returned by walkArchive() if the data is neither a zip nor a (compressed) tar archive.
+var errUnknownArchive = errors.New("Not a zip or tar archive")
+
+// Returned if the files unpacked from an archive exceed UnpackLimit.
+var errUnpackLimit = errors.New("Unpacked files too large")
+
+/*
+  The maximum total size of the files unpacked from an archive that is not
+  uploaded into a home directory with a quota (those are limited by the
+  quota). 0 means unlimited.
+*/
+var UnpackLimit int64 = 16 << 30
+
+// Changes owner and permissions of the file or directory p according to
+// UploadUid, UploadGid and UploadUmask.
+func applyOwnership(p string, isdir bool) error {
+  mode := 0666 &^ UploadUmask
+  if isdir { mode = os.ModeDir | 0777 &^ UploadUmask }
+  err := os.Chmod(p, mode)
+  if err != nil { return err }
+  if UploadUid >= 0 || UploadGid >= 0 {
+    return os.Lchown(p, UploadUid, UploadGid)
+  }
+  return nil
+}
+
+/*
+  Answers MKCOL requests and PUT requests with "?mkdir" by creating the
+  directory. Its parent directory must exist.
+*/
+func (fm *FileManager) serveMkdir(w http.ResponseWriter, r *http.Request) {
+  clean := path.Clean(r.URL.Path)
+  name := path.Base(clean)
+  
+  if !fm.uploadAllowed(r, clean) || fm.handlingFor(name).Hide {
+    problem.Log(r, http.StatusForbidden, problem.UploadForbidden, "")
+    problem.Write(w, r, http.StatusForbidden, problem.UploadForbidden, "Upload not allowed")
+    return
+  }
+  
+  err := fm.ensureHome(r, path.Dir(clean))
+  if err == nil {
+    fm.uploadmutex.Lock()
+    err = fm.makeDir(clean)
+    fm.uploadmutex.Unlock()
+  }
+  if os.IsExist(err) {
+    problem.Log(r, http.StatusMethodNotAllowed, problem.AlreadyExists, "")
+    problem.Write(w, r, http.StatusMethodNotAllowed, problem.AlreadyExists, "Already exists")
+    return
+  }
+  if os.IsNotExist(err) {
+    problem.Log(r, http.StatusConflict, problem.Conflict, "no parent directory")
+    problem.Write(w, r, http.StatusConflict, problem.Conflict, "Parent directory does not exist")
+    return
+  }
+  if err != nil {
+    uploadFailed(w, r, err)
+    return
+  }
+  
+  accesslog.Log(r, 0, "%v %v %v", http.StatusCreated, r.Method, r.URL.Path)
+  w.WriteHeader(http.StatusCreated)
+}
+
+/*
+  Creates the directory at URL path clean with the permissions and owner
+  for uploads and publishes it. Must be called with uploadmutex locked.
+*/
+func (fm *FileManager) makeDir(clean string) error {
+  parent := path.Join(fm.root(), path.Dir(clean))
+  target := path.Join(parent, path.Base(clean))
+  err := os.Mkdir(target, 0700)
+  if err != nil { return err }
+  err = applyOwnership(target, true)
+  if err != nil { return err }
+  fi, err := os.Stat(target)
+  if err != nil { return err }
+  
+  t := fm.Begin()
+  t.Put(clean, &File{Info:fi, Data:parent, Contents:map[string]*File{}})
+  if err = t.Commit(); err != nil {
+    util.Log(0, "ERROR! Publishing directory: %v", err)
+  }
+  return nil
+}
+
+/*
+  Creates the missing directories between the directory base (a URL path)
+  and the file clean below it and publishes them. Stops at the first hidden
+  directory without an error and leaves it to the caller to reject the
+  request. The caller must hold uploadmutex.
+*/
+func (fm *FileManager) makeParents(base, clean string) error {
+  dir := base
+  for _, part := range strings.Split(strings.TrimPrefix(path.Dir(clean), base), "/") {
+    if part == "" { continue }
+    if fm.handlingFor(part).Hide { return nil }
+    dir += "/" + part
+    err := fm.makeDir(dir)
+    if err != nil && !os.IsExist(err) { return err }
+  }
+  return nil
+}
+
+/*
+  Answers PUT requests with "?unpack". The request body is a zip or tar
+  archive (optionally compressed with gzip, bzip2 or xz) that is unpacked
+  into the directory of the request's path, which is created if necessary.
+  Existing files are replaced. Entries that are neither regular files nor
+  directories (e.g. symlinks) are skipped. If an entry's name would place
+  it outside of the target directory, nothing is unpacked.
+  
+  The archive is unpacked into a hidden directory first. If the target
+  directory does not exist yet, that directory is renamed, so the new tree
+  appears on disk all at once. Otherwise its contents are moved into the
+  target directory. Either way, the new files are published in a single
+  Transaction.
+*/
+func (fm *FileManager) serveUnpack(w http.ResponseWriter, r *http.Request) {
+  clean := path.Clean(r.URL.Path)
+  name := path.Base(clean)
+  
+  if !fm.uploadAllowed(r, clean + "/") || fm.handlingFor(name).Hide {
+    problem.Log(r, http.StatusForbidden, problem.UploadForbidden, "")
+    problem.Write(w, r, http.StatusForbidden, problem.UploadForbidden, "Upload not allowed")
+    return
+  }
+  
+  if err := fm.ensureHome(r, clean); err != nil {
+    uploadFailed(w, r, err)
+    return
+  }
+  
+  parent := path.Join(fm.root(), path.Dir(clean))
+  target := path.Join(parent, name)
+  fi, err := os.Stat(parent)
+  existing, err2 := os.Stat(target)
+  if err != nil || !fi.IsDir() || (err2 == nil && !existing.IsDir()) {
+    problem.Log(r, http.StatusConflict, problem.Conflict, "")
+    problem.Write(w, r, http.StatusConflict, problem.Conflict, "No parent directory or target is a file")
+    return
+  }
+  
+  // A small archive can unpack to huge files (a "zip bomb"), so the files
+  // are counted against the quota or UnpackLimit while they are written
+  // instead of after the disk may already be full. The archive itself may
+  // not exceed the limit either.
+  limit, limitErr, notifyQuota := UnpackLimit, errUnpackLimit, func(int64) {}
+  if limit <= 0 { limit = math.MaxInt64 }
+  if left, exceeded, ok := fm.quotaLeft(r, clean); ok && left < limit {
+    limit, limitErr, notifyQuota = left, errQuotaExceeded, exceeded
+  }
+  
+  if r.ContentLength > limit {
+    notifyQuota(r.ContentLength)
+    uploadFailed(w, r, limitErr)
+    return
+  }
+  
+  u := stageVerified(w, r, parent, &quotaReader{data:r.Body, left:limit, err:limitErr, exceeded:notifyQuota}, r.ContentLength, time.Now())
+  if u == nil { return }
+  defer u.discard()
+  
+  stage := path.Join(parent, fmt.Sprintf(".unpack-%v", nextId()))
+  err = os.Mkdir(stage, 0700)
+  if err != nil {
+    uploadFailed(w, r, err)
+    return
+  }
+  defer os.RemoveAll(stage)
+  
+  unpacked := int64(0)
+  
+  count := 0
+  err = walkArchive(u.tmp, func(name string, isdir bool, mtime time.Time, data io.Reader) error {
+    p := path.Join(stage, name)
+    if isdir { return os.MkdirAll(p, 0700) }
+    err := os.MkdirAll(path.Dir(p), 0700)
+    if err != nil { return err }
+    f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+    if err != nil { return err }
+    n, err := copyUpload(f, &quotaReader{data:data, left:limit - unpacked, err:limitErr, exceeded:func(read int64) { notifyQuota(unpacked + read) }})
+    unpacked += n
+    if err2 := f.Close(); err == nil { err = err2 }
+    if err != nil { return err }
+    count++
+    return os.Chtimes(p, time.Now(), mtime)
+  })
+  if err == nil { err = forAll(stage, applyOwnership) }
+  if err == nil { err = applyOwnership(stage, true) }
+  if err == nil { err = fm.checkQuota(r, clean, diskUsage(stage)) }
+  if err == errUnsafePath || err == errUnknownArchive || errors.Is(err, zip.ErrFormat) || errors.Is(err, tar.ErrHeader) {
+    problem.Log(r, http.StatusBadRequest, problem.InvalidArchive, "%v", err)
+    problem.Write(w, r, http.StatusBadRequest, problem.InvalidArchive, err.Error())
+    return
+  }
+  if err != nil {
+    uploadFailed(w, r, err)
+    return
+  }
+  
+  fm.uploadmutex.Lock()
+  defer fm.uploadmutex.Unlock()
+  
+  t := fm.Begin()
+  if _, err2 = os.Stat(target); os.IsNotExist(err2) {
+    err = os.Rename(stage, target)
+    if err == nil {
+      fi, err = os.Stat(target)
+      if x := fm.loadTree(parent, fi); x != nil { t.Put(clean, x) }
+    }
+  } else {
+    err = mergeConflict(stage, target)
+    if err != nil {
+      problem.Log(r, http.StatusConflict, problem.Conflict, "%v", err)
+      problem.Write(w, r, http.StatusConflict, problem.Conflict, err.Error())
+      return
+    }
+    err = fm.merge(stage, target, clean, t)
+  }
+  if err != nil {
+    uploadFailed(w, r, err)
+    return
+  }
+  if err = t.Commit(); err != nil {
+    util.Log(0, "ERROR! Publishing unpacked archive: %v", err)
+  }
+  
+  accesslog.Log(r, 0, "%v %v %v (%v files unpacked)", http.StatusCreated, r.Method, r.URL.Path, count)
+  w.WriteHeader(http.StatusCreated)
+  fmt.Fprintf(w, "%v files unpacked\n", count)
+}
+
+/*
+  Calls fn for each regular file and directory in the zip or tar archive f.
+  For directories data is nil. name is the entry's cleaned relative path.
+  Other entry types are skipped. Before fn is called for any entry, all
+  names are checked and errUnsafePath is returned if one of them is absolute
+  or refers to a parent directory.
+*/
+func walkArchive(f *os.File, fn func(name string, isdir bool, mtime time.Time, data io.Reader) error) error {
+  fi, err := f.Stat()
+  if err != nil { return err }
+  size := fi.Size()
+  
+  magic := make([]byte, 512)
+  n, _ := f.ReadAt(magic, 0)
+  magic = magic[:n]
+  
+  if bytes.HasPrefix(magic, []byte("PK\x03\x04")) || bytes.HasPrefix(magic, []byte("PK\x05\x06")) {
+    z, err := zip.NewReader(f, size)
+    if err != nil { return err }
+    for _, e := range z.File {
+      if _, err := safeName(e.Name); err != nil { return err }
+    }
+    for _, e := range z.File {
+      name, _ := safeName(e.Name)
+      mode := e.Mode()
+      if mode.IsDir() {
+        err = fn(name, true, e.Modified, nil)
+      } else if mode.IsRegular() {
+        var rc io.ReadCloser
+        rc, err = e.Open()
+        if err != nil { return err }
+        err = fn(name, false, e.Modified, rc)
+        rc.Close()
+      } else {
+        util.Log(1, "Skipping archive entry %v (%v)", e.Name, mode)
+      }
+      if err != nil { return err }
+    }
+    return nil
+  }
+  
+  encoding := ""
+  switch {
+    case bytes.HasPrefix(magic, []byte("\x1f\x8b")): encoding = "gzip"
+    case bytes.HasPrefix(magic, []byte("BZh")): encoding = "bzip2"
+    case bytes.HasPrefix(magic, []byte("\xfd7zXZ\x00")): encoding = "xz"
+    case len(magic) > 262 && string(magic[257:262]) == "ustar":
+    default: return errUnknownArchive
+  }
+  
+  // A tar archive can only be read sequentially, so it is read twice:
+  // first to check the names, then to unpack it.
+  for pass := 0; pass < 2; pass++ {
+    var stream io.Reader = io.NewSectionReader(f, 0, size)
+    if encoding != "" {
+      decomp, err := NewDecompressor(encoding, stream)
+      if err != nil { return err }
+      defer decomp.Close()
+      stream = decomp
+    }
+    t := tar.NewReader(stream)
+    for {
+      hdr, err := t.Next()
+      if err == io.EOF { break }
+      if err != nil { return err }
+      name, err := safeName(hdr.Name)
+      if err != nil { return err }
+      if pass == 0 { continue }
+      switch hdr.Typeflag {
+        case tar.TypeDir: err = fn(name, true, hdr.ModTime, nil)
+        case tar.TypeReg, tar.TypeRegA: err = fn(name, false, hdr.ModTime, t)
+        default: util.Log(1, "Skipping archive entry %v (type %c)", hdr.Name, hdr.Typeflag)
+      }
+      if err != nil { return err }
+    }
+  }
+  return nil
+}
+
+// Returns the cleaned relative path for the archive entry name or
+// errUnsafePath if it is absolute or points outside of the directory
+// the archive is unpacked into.
+func safeName(name string) (string, error) {
+  name = strings.Replace(name, "\\", "/", -1)
+  clean := path.Clean(name)
+  if path.IsAbs(name) || clean == ".." || strings.HasPrefix(clean, "../") || strings.Contains(name, "\x00") {
+    return "", errUnsafePath
+  }
+  return clean, nil
+}
+
+// Calls fn for all files and directories below directory dir (not dir itself).
+func forAll(dir string, fn func(p string, isdir bool) error) error {
+  fis, err := ioutil.ReadDir(dir)
+  if err != nil { return err }
+  for _, fi := range fis {
+    p := path.Join(dir, fi.Name())
+    err = fn(p, fi.IsDir())
+    if err == nil && fi.IsDir() { err = forAll(p, fn) }
+    if err != nil { return err }
+  }
+  return nil
+}
+
+// Returns an error if merging directory src into dst would replace a
+// directory with a file or vice versa.
+func mergeConflict(src, dst string) error {
+  fis, err := ioutil.ReadDir(src)
+  if err != nil { return err }
+  for _, fi := range fis {
+    d, err := os.Stat(path.Join(dst, fi.Name()))
+    if err != nil { continue }
+    if d.IsDir() != fi.IsDir() {
+      return fmt.Errorf("%v: Can not replace directory with file or vice versa", path.Join(dst, fi.Name()))
+    }
+    if d.IsDir() {
+      err = mergeConflict(path.Join(src, fi.Name()), path.Join(dst, fi.Name()))
+      if err != nil { return err }
+    }
+  }
+  return nil
+}
+
+/*
+  Moves the contents of directory src into directory dst (whose URL path is p),
+  replacing existing files, and stages the new files in t.
+*/
+func (fm *FileManager) merge(src, dst, p string, t *Transaction) error {
+  fis, err := ioutil.ReadDir(src)
+  if err != nil { return err }
+  for _, fi := range fis {
+    name := fi.Name()
+    if d, err := os.Stat(path.Join(dst, name)); err == nil && d.IsDir() {
+      err = fm.merge(path.Join(src, name), path.Join(dst, name), path.Join(p, name), t)
+      if err != nil { return err }
+      continue
+    }
+    err = os.Rename(path.Join(src, name), path.Join(dst, name))
+    if err != nil { return err }
+    fi, err = os.Stat(path.Join(dst, name))
+    if err != nil { return err }
+    if x := fm.loadTree(dst, fi); x != nil { t.Put(path.Join(p, name), x) }
+  }
+  return nil
+}
+
+/*
+  Returns a File for fi, which is in the directory dir on disk, including the
+  Contents if it is a directory. Names hidden by the handling rules are left
+  out; nil is returned if fi itself is hidden. Aliases are added by the next rescan.
+*/
+func (fm *FileManager) loadTree(dir string, fi os.FileInfo) *File {
+  if fm.handlingFor(fi.Name()).Hide { return nil }
+  x := &File{Info:fi, Id:nextId(), Data:dir, RateClass:fm.rateClassFor(fi.Name())}
+  if !fi.IsDir() { return x }
+  x.Contents = map[string]*File{}
+  sub := path.Join(dir, fi.Name())
+  fis, err := ioutil.ReadDir(sub)
+  if err != nil {
+    util.Log(0, "ERROR! %v", err)
+    return x
+  }
+  for _, cfi := range fis {
+    if c := fm.loadTree(sub, cfi); c != nil { x.Contents[cfi.Name()] = c }
+  }
+  return x
+}
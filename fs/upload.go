@@ -0,0 +1,425 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "io"
+         "os"
+         "fmt"
+         "path"
+         "errors"
+         "syscall"
+         "time"
+         "strconv"
+         "strings"
+         "net/http"
+         "sync"
+         "io/ioutil"
+         "sync/atomic"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../linux"
+         "../http2"
+         "../notify"
+         "../problem"
+         "../accesslog"
+       )
+
+// The extensions of package files. Uploads of them are notified as notify.PackageAccepted.
+var packageExtensions = []string{".deb", ".udeb", ".ddeb", ".rpm", ".whl", ".jar", ".pkg.tar.zst", ".pkg.tar.xz", ".pkg.tar.gz", ".pkg.tar.bz2"}
+
+// If >= 0, uploaded files are chown()ed to this UID.
+var UploadUid = -1
+
+// If >= 0, uploaded files are chown()ed to this GID.
+var UploadGid = -1
+
+// The permissions of uploaded files are 0666 (directories 0777) without the
+// bits set in UploadUmask.
+var UploadUmask os.FileMode = 022
+
+// The request header with which a client sets the mtime of an uploaded
+// file in seconds since the epoch, e.g. "X-Garcon-Mtime: 1466073600.25".
+const MtimeHeader = "X-Garcon-Mtime"
+
+/*
+  Allows uploading files below prefix (e.g. "/incoming") with PUT requests.
+  The directory for the file must exist. An existing file is replaced.
+  The uploaded file's mtime is taken from the MtimeHeader or, if that is
+  missing, the Last-Modified header of the request. Without either it is
+  the time of the upload. See also UploadUid, UploadGid and UploadUmask.
+  Directories are created with MKCOL requests or PUT requests with the query
+  "?mkdir". A PUT request with the query "?unpack" unpacks an archive into
+  the directory (see serveUnpack()).
+  Call before ServeHTTP() is called for the first time.
+*/
+func (fm *FileManager) AddUploadPrefix(prefix string) {
+  fm.upload_prefixes = append(fm.upload_prefixes, strings.TrimSuffix(path.Clean(prefix), "/"))
+}
+
+// Returns true if the upload r to path clean is allowed.
+func (fm *FileManager) uploadAllowed(r *http.Request, clean string) bool {
+  for _, prefix := range fm.upload_prefixes {
+    if strings.HasPrefix(clean, prefix + "/") { return true }
+  }
+  if fm.mavenRepoFor(clean) != nil { return true }
+  _, _, home := fm.homeFor(r, clean)
+  return home
+}
+
+// Answers the PUT request r.
+func (fm *FileManager) serveUpload(w http.ResponseWriter, r *http.Request) {
+  clean := path.Clean(r.URL.Path)
+  name := path.Base(clean)
+  
+  if !fm.uploadAllowed(r, clean) || fm.handlingFor(name).Hide {
+    problem.Log(r, http.StatusForbidden, problem.UploadForbidden, "")
+    problem.Write(w, r, http.StatusForbidden, problem.UploadForbidden, "Upload not allowed")
+    return
+  }
+  
+  mtime, err := uploadMtime(r)
+  if err != nil {
+    problem.Log(r, http.StatusBadRequest, problem.BadRequest, "%v", err)
+    problem.Write(w, r, http.StatusBadRequest, problem.BadRequest, err.Error())
+    return
+  }
+  
+  if err = fm.ensureHome(r, clean); err == nil { err = fm.ensureMavenDirs(clean) }
+  if err != nil {
+    uploadFailed(w, r, err)
+    return
+  }
+  
+  dir := path.Join(fm.root(), path.Dir(clean))
+  target := path.Join(dir, name)
+  fi, err := os.Stat(dir)
+  existing, err2 := os.Stat(target)
+  if err != nil || !fi.IsDir() || (err2 == nil && existing.IsDir()) {
+    problem.Log(r, http.StatusConflict, problem.Conflict, "")
+    problem.Write(w, r, http.StatusConflict, problem.Conflict, "No such directory or target is a directory")
+    return
+  }
+  
+  // Check If-Match and If-None-Match before receiving the data, so that
+  // the client does not send it for nothing. installUpload() checks again.
+  if !fm.uploadPreconditions(w, r, clean) { return }
+  
+  replaced := int64(0)
+  if err2 == nil { replaced = existing.Size() }
+  if r.ContentLength > 0 {
+    if err = fm.checkQuota(r, clean, r.ContentLength - replaced); err != nil {
+      uploadFailed(w, r, err)
+      return
+    }
+  }
+  
+  u := stageVerified(w, r, dir, fm.quotaLimited(r, clean, replaced, r.Body), r.ContentLength, mtime)
+  if u == nil { return }
+  defer u.discard()
+  fm.installUpload(w, r, u, clean)
+}
+
+/*
+  Runs the validators on the upload u staged in the directory of the URL
+  path clean and, if they accept it, puts it in place, publishes it and
+  sends the response to r. Returns true if the file has been installed.
+*/
+func (fm *FileManager) installUpload(w http.ResponseWriter, r *http.Request, u *stagedUpload, clean string) bool {
+  dir, name := u.dir, path.Base(clean)
+  target := path.Join(dir, name)
+  results, accept := fm.validateUpload(r, u, name, clean)
+  if !accept {
+    uploadRejected(w, r, results)
+    return false
+  }
+  
+  // Check the preconditions again, because another upload may have replaced
+  // the file in the meantime. uploadmutex makes check and replacement atomic.
+  fm.uploadmutex.Lock()
+  defer fm.uploadmutex.Unlock()
+  if !fm.uploadPreconditions(w, r, clean) { return false }
+  
+  // Check the quota with the actual size, which may differ from
+  // Content-Length (e.g. for chunked uploads).
+  existing, err2 := os.Stat(target)
+  replaced := int64(0)
+  if err2 == nil { replaced = existing.Size() }
+  fi, err := u.tmp.Stat()
+  if err == nil { err = fm.checkQuota(r, clean, fi.Size() - replaced - u.freed) }
+  if err == nil { fi, err = u.install(name) }
+  if err != nil {
+    uploadFailed(w, r, err)
+    return false
+  }
+  if err = writeValidations(dir, name, results); err != nil {
+    util.Log(0, "ERROR! Validation results of %v: %v", clean, err)
+  }
+  
+  // Make the file visible right away instead of after the next rescan.
+  x := &File{Info:fi, Data:dir, RateClass:fm.rateClassFor(name)}
+  t := fm.Begin()
+  t.Put(clean, x)
+  if err = t.Commit(); err != nil {
+    util.Log(0, "ERROR! Publishing upload: %v", err)
+  }
+  
+  for _, ext := range packageExtensions {
+    if strings.HasSuffix(name, ext) {
+      msg := fmt.Sprintf("%v (%v bytes) has been uploaded by %v.", clean, fi.Size(), uploader(r))
+      for _, res := range results {
+        result := "Passed"
+        if !res.Passed { result = "Failed (warning only)" }
+        msg += fmt.Sprintf("\n%v: %v", result, res.Command)
+      }
+      notify.Send(notify.PackageAccepted, clean, fmt.Sprintf("Package %v accepted", name), msg)
+      break
+    }
+  }
+  
+  status := http.StatusCreated
+  if err2 == nil { status = http.StatusNoContent }
+  accesslog.Log(r, 0, "%v %v %v (%v bytes, mtime %v, ETag: %v)", status, r.Method, r.URL.Path, fi.Size(), fi.ModTime(), x.Id)
+  w.Header().Set("ETag", fmt.Sprintf("%v", x.Id))
+  w.WriteHeader(status)
+  return true
+}
+
+// Sends the error response for the upload r that failed with err.
+func uploadFailed(w http.ResponseWriter, r *http.Request, err error) {
+  status, code := http.StatusInternalServerError, problem.UploadFailed
+  switch {
+    case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT), err == errQuotaExceeded: status, code = http.StatusInsufficientStorage, problem.InsufficientStorage
+    case errors.Is(err, syscall.EFBIG), err == errUnpackLimit: status, code = http.StatusRequestEntityTooLarge, problem.TooLarge
+    case err == errIncompleteUpload, err == io.ErrUnexpectedEOF: status = http.StatusBadRequest
+    default: util.Log(0, "ERROR! Upload %v: %v", r.URL.Path, err)
+  }
+  if status == http.StatusInsufficientStorage && err != errQuotaExceeded {
+    // checkQuota() has already sent the notification for errQuotaExceeded.
+    notify.Send(notify.QuotaExceeded, path.Dir(r.URL.Path), fmt.Sprintf("No space for uploads to %v", path.Dir(r.URL.Path)), fmt.Sprintf("The upload of %v has failed: %v", r.URL.Path, err))
+  }
+  problem.Log(r, status, code, "%v", err)
+  problem.Write(w, r, status, code, "")
+}
+
+/*
+  Evaluates the If-Match and If-None-Match headers of the upload r for
+  the file currently served at clean. E.g. "If-None-Match: *" makes sure
+  that no existing file is replaced and "If-Match: <ETag>" that only the
+  version with that ETag is replaced. If a precondition fails, 412 is sent
+  and false is returned.
+*/
+func (fm *FileManager) uploadPreconditions(w http.ResponseWriter, r *http.Request, clean string) bool {
+  modtime := time.Time{}
+  x, resolved, ok := fm.lookup(clean)
+  if ok && resolved == clean {
+    w.Header().Set("ETag", fmt.Sprintf("%v", x.Id))
+    modtime = x.Info.ModTime()
+  }
+  _, done := http2.CheckPreconditions(w, r, modtime)
+  if done {
+    accesslog.Log(r, 1, "%v %v %v (ETag: %v)", http.StatusPreconditionFailed, r.Method, r.URL.Path, w.Header().Get("ETag"))
+    return false
+  }
+  w.Header().Del("ETag")
+  w.Header().Del("Last-Modified")
+  return true
+}
+
+// Returned by stageUpload() if data is shorter than the declared size.
+var errIncompleteUpload = errors.New("Upload incomplete")
+
+// 0 => not yet known, 1 => uploads use O_TMPFILE, 2 => they use named temporary files.
+// See stageUpload().
+var useTmpfile int32
+
+// An upload whose data has been written to a temporary file that has not
+// been put in place yet.
+type stagedUpload struct {
+  dir string
+  tmp *os.File
+  // The name of the temporary file if it has one.
+  tmpname string
+  // A hidden directory that is removed by discard() or "".
+  tmpdir string
+  // The bytes that are deleted once the upload is installed, e.g. the
+  // parts of a multipart upload. See installUpload().
+  freed int64
+}
+
+/*
+  Writes data to a temporary file in dir and syncs it to disk. Applies
+  mtime, UploadUmask, UploadUid and UploadGid. If size >= 0, it is the
+  expected size of data and the disk space for it is allocated before
+  data is read. The caller must call discard() on the result when done.
+  
+  If possible the temporary file is created with O_TMPFILE, so it has no
+  name until install() is called. This way aborted uploads leave nothing
+  behind and the upload does not cause rescans while it is in progress.
+  Otherwise (e.g. if the file system does not support O_TMPFILE or Garçon
+  lacks the capabilities to link the file in a chroot) a hidden temporary
+  file is used.
+*/
+func stageUpload(dir string, data io.Reader, size int64, mtime time.Time) (*stagedUpload, error) {
+  mode := 0666 &^ UploadUmask
+  
+  var err error
+  u := &stagedUpload{dir:dir}
+  if atomic.LoadInt32(&useTmpfile) == 0 {
+    if linux.TmpfileLinkable(dir) {
+      atomic.StoreInt32(&useTmpfile, 1)
+    } else {
+      util.Log(1, "O_TMPFILE not usable in %v. Uploads use named temporary files.", dir)
+      atomic.StoreInt32(&useTmpfile, 2)
+    }
+  }
+  if atomic.LoadInt32(&useTmpfile) == 1 {
+    u.tmp, err = linux.OpenTmpfile(dir, uint32(mode))
+    if err != nil { util.Log(1, "WARNING! %v", err) }
+  }
+  
+  if u.tmp == nil {
+    // The leading "." hides the temporary file from the served tree.
+    u.tmp, err = ioutil.TempFile(dir, ".upload-")
+    if err != nil { return nil, err }
+    u.tmpname = u.tmp.Name()
+  }
+  
+  err = u.write(data, size, mode, mtime)
+  if err != nil {
+    u.discard()
+    return nil, err
+  }
+  return u, nil
+}
+
+func (u *stagedUpload) write(data io.Reader, size int64, mode os.FileMode, mtime time.Time) error {
+  if size > 0 {
+    err := linux.Fallocate(u.tmp, size)
+    if err != nil && !errors.Is(err, syscall.EOPNOTSUPP) { return err }
+  }
+  
+  n, err := copyUpload(u.tmp, data)
+  if err != nil { return err }
+  if size >= 0 && n != size { return errIncompleteUpload }
+  err = u.tmp.Chmod(mode)
+  if err != nil { return err }
+  if UploadUid >= 0 || UploadGid >= 0 {
+    err = u.tmp.Chown(UploadUid, UploadGid)
+    if err != nil { return err }
+  }
+  err = linux.Futimens(u.tmp, time.Now(), mtime)
+  if err != nil { return err }
+  return u.tmp.Sync()
+}
+
+// The size of the buffers used to copy uploaded data to disk.
+const uploadBufferSize = 64*1024
+
+var uploadBuffers = sync.Pool{New: func() interface{} { return make([]byte, uploadBufferSize) }}
+
+// Bytes of upload buffers currently in use. Atomic. See MemoryStats.
+var uploadBuffersInUse int64
+
+// Like io.Copy() but uses a buffer from uploadBuffers, so that the memory
+// used by uploads in progress is bounded and accounted.
+func copyUpload(dst io.Writer, src io.Reader) (int64, error) {
+  buf := uploadBuffers.Get().([]byte)
+  atomic.AddInt64(&uploadBuffersInUse, uploadBufferSize)
+  defer func() {
+    atomic.AddInt64(&uploadBuffersInUse, -uploadBufferSize)
+    uploadBuffers.Put(buf)
+  }()
+  // Hide dst's ReadFrom() so that io.CopyBuffer() actually uses buf.
+  return io.CopyBuffer(struct{ io.Writer }{dst}, src, buf)
+}
+
+// Gives the staged file the name name in its directory, replacing an
+// existing file. Returns the os.FileInfo of the new file.
+func (u *stagedUpload) install(name string) (os.FileInfo, error) {
+  if u.tmpname == "" {
+    // linkat() can not replace an existing file, so link to a hidden
+    // name and rename that.
+    linkname := fmt.Sprintf("%v/.upload-%v", u.dir, nextId())
+    err := linux.Linkat(u.tmp, linkname)
+    if err != nil { return nil, err }
+    u.tmpname = linkname
+  }
+  target := path.Join(u.dir, name)
+  err := os.Rename(u.tmpname, target)
+  if err != nil { return nil, err }
+  u.tmpname = ""
+  return os.Stat(target)
+}
+
+// Gives the staged file the temporary name p (in the same file system).
+func (u *stagedUpload) rename(p string) error {
+  var err error
+  if u.tmpname == "" {
+    err = linux.Linkat(u.tmp, p)
+  } else {
+    err = os.Rename(u.tmpname, p)
+  }
+  if err == nil { u.tmpname = p }
+  return err
+}
+
+// Closes the temporary file and removes it if it has not been installed.
+func (u *stagedUpload) discard() {
+  u.tmp.Close()
+  if u.tmpname != "" { os.Remove(u.tmpname) }
+  u.tmpname = ""
+  if u.tmpdir != "" { os.RemoveAll(u.tmpdir) }
+  u.tmpdir = ""
+}
+
+/*
+  Writes the free and total space of the file systems of the upload
+  directories to w.
+*/
+func (fm *FileManager) WriteDiskSpace(w io.Writer) {
+  prefixes := append([]string{}, fm.upload_prefixes...)
+  for _, h := range fm.homes { prefixes = append(prefixes, h.prefix) }
+  for _, prefix := range prefixes {
+    free, total, err := linux.DiskSpace(path.Join(fm.root(), prefix))
+    if err != nil {
+      fmt.Fprintf(w, "%v: %v\n", prefix, err)
+    } else {
+      fmt.Fprintf(w, "%v: %v bytes free of %v\n", prefix, free, total)
+    }
+  }
+}
+
+// Returns the mtime requested for the upload r. See AddUploadPrefix().
+func uploadMtime(r *http.Request) (time.Time, error) {
+  if s := r.Header.Get(MtimeHeader); s != "" {
+    parts := strings.SplitN(s, ".", 2)
+    secs, err := strconv.ParseInt(parts[0], 10, 64)
+    nsecs := int64(0)
+    if err == nil && len(parts) == 2 {
+      frac := (parts[1] + "000000000")[:9]
+      nsecs, err = strconv.ParseInt(frac, 10, 64)
+    }
+    if err != nil { return time.Time{}, fmt.Errorf("Illegal %v: %v", MtimeHeader, s) }
+    return time.Unix(secs, nsecs), nil
+  }
+  if s := r.Header.Get("Last-Modified"); s != "" {
+    t, err := http.ParseTime(s)
+    if err != nil { return time.Time{}, fmt.Errorf("Illegal Last-Modified: %v", s) }
+    return t, nil
+  }
+  return time.Now(), nil
+}
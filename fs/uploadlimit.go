@@ -0,0 +1,135 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "net"
+         "sync"
+         "net/http"
+         
+         "../auth"
+         "../status"
+         "../problem"
+       )
+
+var (
+  uploadsRejectedTotal = status.NewCounter(`garcon_upload_rejected_total{reason="total"}`, "Uploads rejected because too many uploads (in total or of the user) were running.")
+  uploadsRejectedUser = status.NewCounter(`garcon_upload_rejected_total{reason="user"}`, "Uploads rejected because too many uploads (in total or of the user) were running.")
+  uploadBytes = status.NewCounter(`garcon_upload_bytes_total`, "Bytes read from the bodies of uploads.")
+)
+
+// The limits for uploads set by SetUploadLimits().
+type uploadLimiter struct {
+  perUser RateClass
+  
+  // Has capacity for the total number of uploads that may run at the same
+  // time. An upload holds a slot while it runs. nil if unlimited.
+  slots chan bool
+  
+  // Protects buckets.
+  mutex sync.Mutex
+  
+  // The buckets of the users who have uploads running, keyed by the user
+  // name or, for anonymous uploads, by "@" and the client address.
+  buckets map[string]*uploadBucket
+}
+
+// The state of the per-user limits shared by all uploads of a user.
+type uploadBucket struct {
+  *rateBucket
+  
+  // The number of uploads of the user that hold the bucket. The bucket is
+  // removed when this drops to 0, so that the map does not grow forever.
+  users int
+}
+
+/*
+  Limits uploads (PUT and MKCOL requests), so that a misbehaving client
+  cannot starve downloads: All uploads of the same user (or, for anonymous
+  uploads, the same client address) together may read at most
+  perUser.Bandwidth bytes per second from the request bodies and at most
+  perUser.Concurrency of them may run at the same time. Further uploads
+  of the user are answered with 429 Too Many Requests. At most total uploads
+  of all users may run at the same time. Further ones are answered with
+  503 Service Unavailable. 0 means unlimited.
+  Call before ServeHTTP() is called for the first time.
+*/
+func (fm *FileManager) SetUploadLimits(perUser RateClass, total int) {
+  l := &uploadLimiter{perUser:perUser, buckets:map[string]*uploadBucket{}}
+  if total > 0 { l.slots = make(chan bool, total) }
+  fm.upload_limits = l
+}
+
+// Returns the key of the user who made r in uploadLimiter.buckets.
+func uploader(r *http.Request) string {
+  if u := auth.UserFrom(r); u != nil { return u.Name }
+  client, _, err := net.SplitHostPort(r.RemoteAddr)
+  if err != nil { client = r.RemoteAddr }
+  return "@" + client
+}
+
+/*
+  Checks the upload r against the limits set by SetUploadLimits() and makes
+  its body be read at the user's bandwidth. If the upload may not run now,
+  an error is sent and false is returned. Otherwise the returned function
+  must be called when the upload is done.
+*/
+func (fm *FileManager) limitUpload(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+  l := fm.upload_limits
+  if l == nil { return func(){}, true }
+  
+  if l.slots != nil {
+    select {
+      case l.slots <- true:
+      default: uploadsRejectedTotal.Inc()
+               problem.Log(r, http.StatusServiceUnavailable, problem.Overloaded, "too many uploads")
+               w.Header().Set("Retry-After", "30")
+               problem.Write(w, r, http.StatusServiceUnavailable, problem.Overloaded, "Too many uploads. Try again later")
+               return nil, false
+    }
+  }
+  
+  key := uploader(r)
+  l.mutex.Lock()
+  b := l.buckets[key]
+  if b == nil {
+    b = &uploadBucket{rateBucket:&rateBucket{RateClass:l.perUser, name:key, rejected:uploadsRejectedUser, sent:uploadBytes}}
+    if l.perUser.Concurrency > 0 { b.slots = make(chan bool, l.perUser.Concurrency) }
+    l.buckets[key] = b
+  }
+  b.users++
+  l.mutex.Unlock()
+  
+  done := func() {
+    l.mutex.Lock()
+    b.users--
+    if b.users == 0 { delete(l.buckets, key) }
+    l.mutex.Unlock()
+    if l.slots != nil { <-l.slots }
+  }
+  
+  if !b.acquire() {
+    done()
+    problem.Log(r, http.StatusTooManyRequests, problem.RateLimited, "%v: too many uploads", key)
+    w.Header().Set("Retry-After", "30")
+    problem.Write(w, r, http.StatusTooManyRequests, problem.RateLimited, "Too many uploads. Try again later")
+    return nil, false
+  }
+  r.Body = b.throttle(r.Body)
+  return func() {
+    b.release()
+    done()
+  }, true
+}
@@ -0,0 +1,298 @@
+//go:build iouring
+// +build iouring
+
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+/*
+  EXPERIMENTAL: An io_uring based read path. All reads from files on disk
+  are submitted to a single shared ring and a dedicated goroutine reaps the
+  completions. Under high concurrency this batches many reads into few
+  io_uring_enter() calls.
+  
+  Only compiled with "go build -tags iouring". Only used if UseIOUring is true.
+*/
+
+package fs
+
+import (
+         "io"
+         "os"
+         "sync"
+         "time"
+         "errors"
+         "unsafe"
+         "runtime"
+         "syscall"
+         "sync/atomic"
+         
+         "github.com/mbenkmann/golib/util"
+       )
+
+// True if this binary was built with io_uring support.
+const IOUringSupported = true
+
+const (
+  sys_IO_URING_SETUP = 425
+  sys_IO_URING_ENTER = 426
+  
+  ioring_OFF_SQ_RING = 0
+  ioring_OFF_CQ_RING = 0x8000000
+  ioring_OFF_SQES    = 0x10000000
+  
+  ioring_ENTER_GETEVENTS = 1
+  
+  ioring_OP_READ = 22
+  
+  // Number of submission queue entries. The completion queue
+  // is twice as large, so it can never overflow because we never
+  // have more than uringEntries reads in flight.
+  uringEntries = 256
+)
+
+type sqringOffsets struct {
+  head, tail, ring_mask, ring_entries, flags, dropped, array, resv1 uint32
+  user_addr uint64
+}
+
+type cqringOffsets struct {
+  head, tail, ring_mask, ring_entries, overflow, cqes, flags, resv1 uint32
+  user_addr uint64
+}
+
+type uringParams struct {
+  sq_entries, cq_entries, flags, sq_thread_cpu, sq_thread_idle, features, wq_fd uint32
+  resv [3]uint32
+  sq_off sqringOffsets
+  cq_off cqringOffsets
+}
+
+type uringSQE struct {
+  opcode uint8
+  flags uint8
+  ioprio uint16
+  fd int32
+  off uint64
+  addr uint64
+  len uint32
+  rw_flags uint32
+  user_data uint64
+  pad [3]uint64
+}
+
+type uringCQE struct {
+  user_data uint64
+  res int32
+  flags uint32
+}
+
+type uring struct {
+  fd int
+  
+  sqhead, sqtail, sqmask *uint32
+  sqarray unsafe.Pointer
+  sqes unsafe.Pointer
+  
+  cqhead, cqtail, cqmask *uint32
+  cqes unsafe.Pointer
+  
+  // Protects submission and pending.
+  mutex sync.Mutex
+  
+  // Maps user_data of submitted reads to the channel that receives the result.
+  pending map[uint64]chan int32
+  
+  // Next user_data to use.
+  next uint64
+  
+  // Limits the number of reads in flight to uringEntries.
+  slots chan bool
+}
+
+// The shared ring. nil if not (yet) set up or if setup failed.
+var ring *uring
+var ringOnce sync.Once
+
+func getRing() *uring {
+  ringOnce.Do(func() {
+    var err error
+    ring, err = newUring()
+    if err != nil {
+      util.Log(0, "ERROR! io_uring setup failed => using standard read path: %v", err)
+      ring = nil
+    }
+  })
+  return ring
+}
+
+func newUring() (*uring, error) {
+  var params uringParams
+  fd, _, errno := syscall.Syscall(sys_IO_URING_SETUP, uringEntries, uintptr(unsafe.Pointer(&params)), 0)
+  if errno != 0 { return nil, errno }
+  
+  r := &uring{fd:int(fd), pending:map[uint64]chan int32{}, slots:make(chan bool, uringEntries)}
+  
+  sqsize := int(params.sq_off.array + params.sq_entries*4)
+  sq, err := syscall.Mmap(r.fd, ioring_OFF_SQ_RING, sqsize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+  if err != nil { syscall.Close(r.fd); return nil, err }
+  
+  cqsize := int(params.cq_off.cqes + params.cq_entries*uint32(unsafe.Sizeof(uringCQE{})))
+  cq, err := syscall.Mmap(r.fd, ioring_OFF_CQ_RING, cqsize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+  if err != nil { syscall.Close(r.fd); return nil, err }
+  
+  sqes, err := syscall.Mmap(r.fd, ioring_OFF_SQES, int(params.sq_entries)*int(unsafe.Sizeof(uringSQE{})), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+  if err != nil { syscall.Close(r.fd); return nil, err }
+  
+  r.sqhead = (*uint32)(unsafe.Pointer(&sq[params.sq_off.head]))
+  r.sqtail = (*uint32)(unsafe.Pointer(&sq[params.sq_off.tail]))
+  r.sqmask = (*uint32)(unsafe.Pointer(&sq[params.sq_off.ring_mask]))
+  r.sqarray = unsafe.Pointer(&sq[params.sq_off.array])
+  r.sqes = unsafe.Pointer(&sqes[0])
+  r.cqhead = (*uint32)(unsafe.Pointer(&cq[params.cq_off.head]))
+  r.cqtail = (*uint32)(unsafe.Pointer(&cq[params.cq_off.tail]))
+  r.cqmask = (*uint32)(unsafe.Pointer(&cq[params.cq_off.ring_mask]))
+  r.cqes = unsafe.Pointer(&cq[params.cq_off.cqes])
+  
+  go r.reap()
+  util.Log(1, "io_uring read path enabled")
+  return r, nil
+}
+
+func (r *uring) enter(to_submit, min_complete, flags uintptr) error {
+  for {
+    _, _, errno := syscall.Syscall6(sys_IO_URING_ENTER, uintptr(r.fd), to_submit, min_complete, flags, 0, 0)
+    if errno == syscall.EINTR { continue }
+    if errno != 0 { return errno }
+    return nil
+  }
+}
+
+// Reads len(p) bytes at offset off from fd via the ring. Returns the
+// number of bytes read or a negative errno.
+func (r *uring) pread(fd uintptr, p []byte, off int64) int32 {
+  r.slots <- true
+  defer func() { <-r.slots }()
+  
+  result := make(chan int32, 1)
+  
+  r.mutex.Lock()
+  r.next++
+  id := r.next
+  r.pending[id] = result
+  tail := atomic.LoadUint32(r.sqtail)
+  idx := tail & *r.sqmask
+  sqe := (*uringSQE)(unsafe.Pointer(uintptr(r.sqes) + uintptr(idx)*unsafe.Sizeof(uringSQE{})))
+  *sqe = uringSQE{opcode:ioring_OP_READ, fd:int32(fd), off:uint64(off), addr:uint64(uintptr(unsafe.Pointer(&p[0]))), len:uint32(len(p)), user_data:id}
+  *(*uint32)(unsafe.Pointer(uintptr(r.sqarray) + uintptr(idx)*4)) = idx
+  atomic.StoreUint32(r.sqtail, tail+1)
+  err := r.enter(1, 0, 0)
+  if err != nil && atomic.LoadUint32(r.sqhead) == tail {
+    // The kernel has not taken the entry, so it is withdrawn. Otherwise the
+    // next submission would make the kernel write to p after this has
+    // returned. If the kernel has taken it, its completion is awaited.
+    atomic.StoreUint32(r.sqtail, tail)
+    delete(r.pending, id)
+    r.mutex.Unlock()
+    return -int32(err.(syscall.Errno))
+  }
+  r.mutex.Unlock()
+  
+  res := <-result
+  // p must not be collected before the kernel is done with it.
+  runtime.KeepAlive(p)
+  return res
+}
+
+/*
+  Waits for completions and passes the results to the waiting pread() calls.
+  Never returns. The reads in flight can not be failed if waiting fails,
+  because the kernel may still write to their buffers, so it backs off
+  until waiting works again.
+*/
+func (r *uring) reap() {
+  backoff := time.Duration(0)
+  for {
+    err := r.enter(0, 1, ioring_ENTER_GETEVENTS)
+    if err != nil {
+      if backoff == 0 {
+        util.Log(0, "ERROR! io_uring_enter: %v", err)
+        backoff = time.Millisecond
+      } else if backoff < time.Second {
+        backoff *= 2
+      }
+    } else if backoff != 0 {
+      util.Log(1, "io_uring_enter works again")
+      backoff = 0
+    }
+    head := atomic.LoadUint32(r.cqhead)
+    tail := atomic.LoadUint32(r.cqtail)
+    r.mutex.Lock()
+    for ; head != tail; head++ {
+      cqe := (*uringCQE)(unsafe.Pointer(uintptr(r.cqes) + uintptr(head & *r.cqmask)*unsafe.Sizeof(uringCQE{})))
+      if ch, ok := r.pending[cqe.user_data]; ok {
+        delete(r.pending, cqe.user_data)
+        ch <- cqe.res
+      }
+    }
+    atomic.StoreUint32(r.cqhead, head)
+    r.mutex.Unlock()
+    if backoff != 0 { time.Sleep(backoff) }
+  }
+}
+
+// A file that is read via the io_uring.
+type uringFile struct {
+  file *os.File
+  closer io.Closer
+  offset int64
+}
+
+func (f *uringFile) Read(p []byte) (int, error) {
+  if len(p) == 0 { return 0, nil }
+  res := ring.pread(f.file.Fd(), p, f.offset)
+  // The finalizer of f.file must not close the fd while the read is in flight.
+  runtime.KeepAlive(f.file)
+  if res < 0 { return 0, &os.PathError{Op:"read", Path:f.file.Name(), Err:syscall.Errno(-res)} }
+  if res == 0 { return 0, io.EOF }
+  f.offset += int64(res)
+  return int(res), nil
+}
+
+func (f *uringFile) Seek(offset int64, whence int) (int64, error) {
+  switch whence {
+    case io.SeekStart:
+    case io.SeekCurrent: offset += f.offset
+    case io.SeekEnd: fi, err := f.file.Stat()
+                     if err != nil { return f.offset, err }
+                     offset += fi.Size()
+    default: return f.offset, errors.New("invalid whence")
+  }
+  if offset < 0 { return f.offset, errors.New("negative position") }
+  f.offset = offset
+  return offset, nil
+}
+
+func (f *uringFile) Close() error {
+  return f.closer.Close()
+}
+
+/*
+  If UseIOUring is true and the ring could be set up, returns a
+  stream that reads file via io_uring and whose Close() calls closer.Close().
+  Otherwise returns nil.
+*/
+func uringWrap(file *os.File, closer io.Closer) io.ReadCloser {
+  if !UseIOUring || getRing() == nil { return nil }
+  return &uringFile{file:file, closer:closer}
+}
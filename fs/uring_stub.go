@@ -0,0 +1,31 @@
+//go:build !iouring
+// +build !iouring
+
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "io"
+         "os"
+       )
+
+// True if this binary was built with io_uring support.
+const IOUringSupported = false
+
+// Always returns nil because this binary has been built without io_uring support.
+func uringWrap(file *os.File, closer io.Closer) io.ReadCloser {
+  return nil
+}
@@ -0,0 +1,193 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package fs
+
+import (
+         "os"
+         "fmt"
+         "path"
+         "time"
+         "bytes"
+         "regexp"
+         "strings"
+         "os/exec"
+         "context"
+         "net/http"
+         "io/ioutil"
+         "encoding/json"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../auth"
+         "../notify"
+         "../accesslog"
+       )
+
+// Validators that take longer than this are killed and count as failed.
+var ValidatorTimeout = 5*time.Minute
+
+// At most this much of a validator's output is kept.
+const maxValidatorOutput = 64*1024
+
+/*
+  A command that checks uploaded files before they are put in place,
+  e.g. lintian for Debian packages. See AddValidator().
+*/
+type Validator struct {
+  // The names of the files that are checked.
+  Match *regexp.Regexp
+  
+  // The program and its arguments. The path of the file is appended.
+  Command []string
+  
+  // If true, uploads that fail the check are rejected. Otherwise the
+  // failure is only recorded.
+  Reject bool
+}
+
+// The result of a Validator for an upload, kept in the hidden file
+// .<name>.checks next to the file and shown on its download page.
+type validation struct {
+  Command string `json:"command"`
+  Passed bool `json:"passed"`
+  Output string `json:"output,omitempty"`
+  Time time.Time `json:"time"`
+}
+
+/*
+  Runs v's command on each uploaded file whose name matches v.Match after it
+  has been received and before it replaces an existing file. The command
+  gets the path of the file (with the name of the upload, in a hidden
+  directory next to its destination) as last argument. Exit status 0 means
+  that the file has passed. Depending on v.Reject, a failed upload is
+  rejected with 422 and the command's output or accepted with the failure
+  recorded. Either way the result is logged. The results of all validators
+  are shown on the file's download page (see SetDownloadPages()).
+  If Garçon runs in a chroot, the command must be available inside it.
+  Call before ServeHTTP() is called for the first time.
+*/
+func (fm *FileManager) AddValidator(v Validator) {
+  fm.validators = append(fm.validators, v)
+}
+
+/*
+  Runs the validators for the staged upload u of the file name to the path
+  clean. Returns their results and false if the upload is to be rejected.
+*/
+func (fm *FileManager) validateUpload(r *http.Request, u *stagedUpload, name, clean string) ([]validation, bool) {
+  var results []validation
+  p := ""
+  accept := true
+  for _, v := range fm.validators {
+    if !v.Match.MatchString(name) { continue }
+    if p == "" {
+      // The validators get the file under its own name, because e.g.
+      // lintian relies on the extension.
+      dir, err := ioutil.TempDir(u.dir, ".validate-")
+      if err == nil {
+        u.tmpdir = dir
+        err = u.rename(path.Join(dir, name))
+      }
+      if err != nil {
+        util.Log(0, "ERROR! Validating %v: %v", clean, err)
+        results = append(results, validation{Command:strings.Join(v.Command, " "), Output:err.Error(), Time:time.Now()})
+        if v.Reject { accept = false }
+        break
+      }
+      p = u.tmpname
+    }
+    
+    res := runValidator(v, p)
+    results = append(results, res)
+    who := "anonymous"
+    if user := auth.UserFrom(r); user != nil { who = user.Name }
+    if res.Passed {
+      util.Log(0, "Validator %v: %v uploaded by %v passed", res.Command, clean, who)
+    } else {
+      action := "accepted anyway"
+      if v.Reject {
+        action = "rejected"
+        accept = false
+      }
+      util.Log(0, "WARNING! Validator %v: %v uploaded by %v failed (%v): %v", res.Command, clean, who, action, strings.TrimSpace(res.Output))
+    }
+  }
+  return results, accept
+}
+
+// Runs v's command on the file p.
+func runValidator(v Validator, p string) validation {
+  res := validation{Command:strings.Join(v.Command, " "), Time:time.Now()}
+  ctx, cancel := context.WithTimeout(context.Background(), ValidatorTimeout)
+  defer cancel()
+  cmd := exec.CommandContext(ctx, v.Command[0], append(v.Command[1:], p)...)
+  cmd.Dir = path.Dir(p)
+  out, err := cmd.CombinedOutput()
+  if len(out) > maxValidatorOutput { out = append(out[0:maxValidatorOutput], "\n[...]"...) }
+  res.Output = string(out)
+  if ctx.Err() != nil {
+    err = fmt.Errorf("timed out after %v", ValidatorTimeout)
+  }
+  if err != nil {
+    if _, exited := err.(*exec.ExitError); !exited || ctx.Err() != nil {
+      if res.Output != "" && !strings.HasSuffix(res.Output, "\n") { res.Output += "\n" }
+      res.Output += err.Error()
+    }
+    return res
+  }
+  res.Passed = true
+  return res
+}
+
+/*
+  Writes the validation results for the file name in dir or removes the old
+  ones if there are none. The caller must hold uploadmutex.
+*/
+func writeValidations(dir, name string, results []validation) error {
+  checks := "." + name + ".checks"
+  if len(results) == 0 {
+    err := os.Remove(path.Join(dir, checks))
+    if err != nil && !os.IsNotExist(err) { return err }
+    return nil
+  }
+  data, err := json.Marshal(results)
+  if err != nil { return err }
+  return writeFileAtomic(dir, checks, data)
+}
+
+// Returns the validation results of the file x or nil if there are none.
+func readValidations(x *File) []validation {
+  dir, ok := x.Data.(string)
+  if !ok { return nil }
+  data, err := ioutil.ReadFile(path.Join(dir, "." + x.Info.Name() + ".checks"))
+  if err != nil { return nil }
+  var results []validation
+  if json.Unmarshal(data, &results) != nil { return nil }
+  return results
+}
+
+// Answers the upload r, which validators have rejected.
+func uploadRejected(w http.ResponseWriter, r *http.Request, results []validation) {
+  var msg bytes.Buffer
+  for _, res := range results {
+    if res.Passed { continue }
+    fmt.Fprintf(&msg, "%v failed:\n%v\n", res.Command, strings.TrimRight(res.Output, "\n"))
+  }
+  accesslog.Log(r, 1, "%v %v %v (rejected by validator)", http.StatusUnprocessableEntity, r.Method, r.URL.Path)
+  notify.Send(notify.PackageRejected, r.URL.Path, fmt.Sprintf("Upload of %v rejected", r.URL.Path), fmt.Sprintf("Uploaded by %v\n\n%v", uploader(r), msg.String()))
+  w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+  w.WriteHeader(http.StatusUnprocessableEntity)
+  w.Write(msg.Bytes())
+}
@@ -0,0 +1,170 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package geoip
+
+import (
+         "fmt"
+         "net"
+         "sync"
+         "time"
+         "net/http"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../status"
+         "../privacy"
+         "../problem"
+         "../accesslog"
+       )
+
+// What the databases know about a client address.
+type Info struct {
+  // ISO 3166-1 country code, e.g. "DE". "" if unknown.
+  Country string
+  
+  // Autonomous system number. 0 if unknown.
+  ASN uint64
+}
+
+func (info Info) String() string {
+  country := info.Country
+  if country == "" { country = "--" }
+  if info.ASN == 0 { return country }
+  return fmt.Sprintf("%v AS%v", country, info.ASN)
+}
+
+/*
+  Tags requests with the client's country and AS and blocks or rate-limits
+  write requests (i.e. uploads; anything but GET, HEAD and OPTIONS) from
+  configured countries and ASes.
+*/
+type GeoIP struct {
+  // Typically a country database and an ASN database.
+  DBs []*DB
+  
+  // Keys are country codes (e.g. "CN") and AS numbers (e.g. "AS4134").
+  // Write requests from matching clients are rejected with 403.
+  Block map[string]bool
+  
+  // Keys as for Block. Each client address with a matching country or AS
+  // may make at most this many write requests per minute. Excess requests
+  // are rejected with 429.
+  Limit map[string]int
+  
+  // Protects window and counts.
+  mutex sync.Mutex
+  
+  // Start of the current rate limiting window.
+  window time.Time
+  
+  // Number of write requests per client address in the current window.
+  counts map[string]int
+}
+
+var (
+  geoBlocked = status.NewCounter(`garcon_geoip_rejected_requests_total{reason="blocked"}`, "Write requests rejected because of the client's country or AS.")
+  geoLimited = status.NewCounter(`garcon_geoip_rejected_requests_total{reason="rate-limit"}`, "Write requests rejected because of the client's country or AS.")
+)
+
+// Returns what g's databases know about ip.
+func (g *GeoIP) Info(ip net.IP) Info {
+  var info Info
+  for _, db := range g.DBs {
+    v, err := db.Lookup(ip)
+    if err != nil {
+      util.Log(0, "ERROR! GeoIP lookup %v: %v", ip, err)
+      continue
+    }
+    m, _ := v.(map[string]interface{})
+    if m == nil { continue }
+    if info.Country == "" {
+      for _, key := range []string{"country", "registered_country"} {
+        if c, ok := m[key].(map[string]interface{}); ok {
+          if code, ok := c["iso_code"].(string); ok {
+            info.Country = code
+            break
+          }
+        }
+      }
+    }
+    if info.ASN == 0 {
+      info.ASN = toUint(m["autonomous_system_number"])
+    }
+  }
+  return info
+}
+
+// Returns the keys of Block and Limit that apply to info.
+func lookupKeys(info Info) []string {
+  keys := []string{}
+  if info.Country != "" { keys = append(keys, info.Country) }
+  if info.ASN != 0 { keys = append(keys, fmt.Sprintf("AS%v", info.ASN)) }
+  return keys
+}
+
+/*
+  Counts a write request from client with info and returns true if this
+  exceeds the rate limit.
+*/
+func (g *GeoIP) limited(client string, info Info) bool {
+  limit := 0
+  for _, key := range lookupKeys(info) {
+    if l, ok := g.Limit[key]; ok && (limit == 0 || l < limit) { limit = l }
+  }
+  if limit == 0 { return false }
+  
+  g.mutex.Lock()
+  defer g.mutex.Unlock()
+  now := time.Now()
+  if now.Sub(g.window) >= time.Minute || g.counts == nil {
+    g.window = now
+    g.counts = map[string]int{}
+  }
+  g.counts[client]++
+  return g.counts[client] > limit
+}
+
+// Returns a handler that logs each request's client with country and AS,
+// applies g's Block and Limit rules and passes the request on to h.
+func (g *GeoIP) Wrap(h http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    client, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil { client = r.RemoteAddr }
+    info := g.Info(net.ParseIP(client))
+    accesslog.Log(r, 1, "Client %v [%v] %v %v", privacy.IP(client), info, r.Method, r.RequestURI)
+    
+    switch r.Method {
+      case "", "GET", "HEAD", "OPTIONS": // not affected by Block and Limit
+      default:
+        for _, key := range lookupKeys(info) {
+          if g.Block[key] {
+            geoBlocked.Inc()
+            problem.Log(r, http.StatusForbidden, problem.GeoBlocked, "%v", key)
+            problem.Write(w, r, http.StatusForbidden, problem.GeoBlocked, "Write requests from your country or network are not allowed")
+            return
+          }
+        }
+        if g.limited(client, info) {
+          geoLimited.Inc()
+          problem.Log(r, http.StatusTooManyRequests, problem.RateLimited, "rate limit for %v", info)
+          w.Header().Set("Retry-After", "60")
+          problem.Write(w, r, http.StatusTooManyRequests, problem.RateLimited, "Too many requests from your network. Try again later")
+          return
+        }
+    }
+    
+    h.ServeHTTP(w, r)
+  })
+}
@@ -0,0 +1,267 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+/*
+  Reads MaxMind DB (.mmdb) files such as GeoLite2-Country and GeoLite2-ASN,
+  and uses them to tag and filter requests by the client's country and
+  autonomous system.
+*/
+package geoip
+
+import (
+         "fmt"
+         "net"
+         "math"
+         "bytes"
+         "encoding/binary"
+       )
+
+// Marks the start of the metadata section at the end of the file.
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// A MaxMind DB held in memory.
+type DB struct {
+  data []byte
+
+  // The search tree.
+  tree []byte
+
+  // The data section.
+  section []byte
+
+  node_count uint
+  record_size uint
+  ip_version uint
+
+  // The node at which IPv4 lookups start in an IPv6 tree.
+  ipv4_start uint
+
+  // The metadata's database_type, e.g. "GeoLite2-Country".
+  Type string
+}
+
+/*
+  Parses data, the complete contents of an .mmdb file. The returned DB
+  refers to data, so it must not be modified afterwards.
+*/
+func Open(data []byte) (*DB, error) {
+  i := bytes.LastIndex(data, metadataMarker)
+  if i < 0 { return nil, fmt.Errorf("Not a MaxMind DB: metadata not found") }
+
+  meta := &decoder{data[i+len(metadataMarker):]}
+  m, _, err := meta.decode(0)
+  if err != nil { return nil, fmt.Errorf("MaxMind DB metadata: %v", err) }
+  metadata, ok := m.(map[string]interface{})
+  if !ok { return nil, fmt.Errorf("MaxMind DB metadata is not a map") }
+
+  db := &DB{data:data}
+  db.node_count = uint(toUint(metadata["node_count"]))
+  db.record_size = uint(toUint(metadata["record_size"]))
+  db.ip_version = uint(toUint(metadata["ip_version"]))
+  db.Type, _ = metadata["database_type"].(string)
+
+  switch db.record_size {
+    case 24, 28, 32:
+    default: return nil, fmt.Errorf("MaxMind DB: unsupported record size %v", db.record_size)
+  }
+  if db.ip_version != 4 && db.ip_version != 6 {
+    return nil, fmt.Errorf("MaxMind DB: unsupported IP version %v", db.ip_version)
+  }
+
+  tree_size := db.node_count * db.record_size / 4
+  if tree_size + 16 > uint(i) {
+    return nil, fmt.Errorf("MaxMind DB: search tree exceeds file size")
+  }
+  db.tree = data[:tree_size]
+  db.section = data[tree_size+16:i]
+
+  if db.ip_version == 6 {
+    node := uint(0)
+    for k := 0; k < 96 && node < db.node_count; k++ {
+      node = db.record(node, 0)
+    }
+    db.ipv4_start = node
+  }
+
+  return db, nil
+}
+
+// Returns the left (bit == 0) or right (bit == 1) record of node.
+func (db *DB) record(node uint, bit uint) uint {
+  switch db.record_size {
+    case 24:
+      b := db.tree[node*6 + bit*3:]
+      return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+    case 28:
+      b := db.tree[node*7:]
+      if bit == 0 {
+        return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+      }
+      return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+    default:
+      return uint(binary.BigEndian.Uint32(db.tree[node*8 + bit*4:]))
+  }
+}
+
+/*
+  Returns the data stored for ip, usually a map[string]interface{}.
+  Returns nil, nil if the database has no entry for ip.
+*/
+func (db *DB) Lookup(ip net.IP) (interface{}, error) {
+  node := uint(0)
+  bits := []byte(ip.To16())
+  if ip4 := ip.To4(); ip4 != nil {
+    bits = []byte(ip4)
+    if db.ip_version == 6 { node = db.ipv4_start }
+  } else if db.ip_version == 4 {
+    return nil, nil
+  }
+
+  for k := 0; k < len(bits)*8 && node < db.node_count; k++ {
+    node = db.record(node, uint(bits[k/8] >> (7 - uint(k%8))) & 1)
+  }
+
+  if node == db.node_count { return nil, nil }
+  if node < db.node_count { return nil, fmt.Errorf("MaxMind DB: search tree too deep") }
+  offset := node - db.node_count - 16
+  if offset >= uint(len(db.section)) {
+    return nil, fmt.Errorf("MaxMind DB: invalid data pointer")
+  }
+
+  dec := &decoder{db.section}
+  value, _, err := dec.decode(offset)
+  return value, err
+}
+
+func toUint(v interface{}) uint64 {
+  switch v := v.(type) {
+    case uint64: return v
+    case int64:  return uint64(v)
+  }
+  return 0
+}
+
+// Decodes values in the MaxMind DB data section format.
+type decoder struct {
+  buf []byte
+}
+
+var errTruncated = fmt.Errorf("MaxMind DB: truncated data")
+
+// Returns the size-byte big endian unsigned integer at buf[offset:].
+func (d *decoder) uint(offset, size uint) (uint64, error) {
+  if offset+size > uint(len(d.buf)) { return 0, errTruncated }
+  var u uint64
+  for _, b := range d.buf[offset:offset+size] {
+    u = u<<8 | uint64(b)
+  }
+  return u, nil
+}
+
+/*
+  Decodes the value at offset and returns it together with the offset
+  of the next value. Maps are decoded as map[string]interface{}, arrays
+  as []interface{}, all unsigned integers as uint64, int32 as int64
+  and floats as float64.
+*/
+func (d *decoder) decode(offset uint) (interface{}, uint, error) {
+  if offset >= uint(len(d.buf)) { return nil, 0, errTruncated }
+  ctrl := d.buf[offset]
+  offset++
+  typ := uint(ctrl >> 5)
+
+  if typ == 1 { // pointer
+    ss := uint(ctrl>>3) & 3
+    vvv := uint64(ctrl & 7)
+    p, err := d.uint(offset, ss+1)
+    if err != nil { return nil, 0, err }
+    switch ss {
+      case 0: p = vvv<<8 | p
+      case 1: p = (vvv<<16 | p) + 2048
+      case 2: p = (vvv<<24 | p) + 526336
+    }
+    value, _, err := d.decode(uint(p))
+    return value, offset + ss + 1, err
+  }
+
+  if typ == 0 { // extended type
+    if offset >= uint(len(d.buf)) { return nil, 0, errTruncated }
+    typ = 7 + uint(d.buf[offset])
+    offset++
+  }
+
+  size := uint(ctrl & 0x1f)
+  if size >= 29 {
+    n := size - 28
+    extra, err := d.uint(offset, n)
+    if err != nil { return nil, 0, err }
+    offset += n
+    switch n {
+      case 1: size = 29 + uint(extra)
+      case 2: size = 285 + uint(extra)
+      case 3: size = 65821 + uint(extra)
+    }
+  }
+
+  switch typ {
+    case 2: // UTF-8 string
+      if offset+size > uint(len(d.buf)) { return nil, 0, errTruncated }
+      return string(d.buf[offset:offset+size]), offset+size, nil
+    case 3: // double
+      u, err := d.uint(offset, 8)
+      return math.Float64frombits(u), offset+8, err
+    case 4: // bytes
+      if offset+size > uint(len(d.buf)) { return nil, 0, errTruncated }
+      return d.buf[offset:offset+size], offset+size, nil
+    case 5, 6, 9: // uint16, uint32, uint64
+      u, err := d.uint(offset, size)
+      return u, offset+size, err
+    case 10: // uint128; only the lower 64 bits are kept
+      if size > 8 { offset, size = offset+size-8, 8 }
+      u, err := d.uint(offset, size)
+      return u, offset+size, err
+    case 8: // int32
+      u, err := d.uint(offset, size)
+      return int64(int32(uint32(u))), offset+size, err
+    case 14: // boolean
+      return size != 0, offset, nil
+    case 15: // float
+      u, err := d.uint(offset, 4)
+      return float64(math.Float32frombits(uint32(u))), offset+4, err
+    case 7: // map
+      m := make(map[string]interface{}, size)
+      for k := uint(0); k < size; k++ {
+        key, next, err := d.decode(offset)
+        if err != nil { return nil, 0, err }
+        value, next, err := d.decode(next)
+        if err != nil { return nil, 0, err }
+        s, ok := key.(string)
+        if !ok { return nil, 0, fmt.Errorf("MaxMind DB: map key is not a string") }
+        m[s] = value
+        offset = next
+      }
+      return m, offset, nil
+    case 11: // array
+      a := make([]interface{}, 0, size)
+      for k := uint(0); k < size; k++ {
+        value, next, err := d.decode(offset)
+        if err != nil { return nil, 0, err }
+        a = append(a, value)
+        offset = next
+      }
+      return a, offset, nil
+  }
+
+  return nil, 0, fmt.Errorf("MaxMind DB: unsupported data type %v", typ)
+}
@@ -0,0 +1,276 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+/*
+  Renders source code as HTML with line numbers and syntax highlighting.
+  The highlighting is purely lexical (comments, strings, numbers, keywords,
+  tags and diff lines) and is selected by the file name's extension.
+  Tokens are marked up as <span class="...">, with the classes
+  "comment", "string", "number", "keyword", "tag", "ins", "del", "hunk" and "meta".
+*/
+package highlight
+
+import (
+         "bytes"
+         "path"
+         "strconv"
+         "strings"
+         "html/template"
+       )
+
+// Describes the lexical structure of a language.
+type language struct {
+  // Sequences that start a comment that extends to the end of the line.
+  line_comments []string
+  // Pairs of sequences that start and end a comment.
+  block_comments [][2]string
+  // Characters that delimit strings. Strings end at the end of the line
+  // unless the delimiter is also in multiline_strings.
+  quotes string
+  multiline_strings string
+  // Identifiers to be marked as keywords.
+  keywords map[string]bool
+  // If true, <...> is marked as a tag.
+  tags bool
+  // If true, the input is a unified diff and is highlighted line by line.
+  diff bool
+}
+
+func words(s string) map[string]bool {
+  m := map[string]bool{}
+  for _, w := range strings.Fields(s) { m[w] = true }
+  return m
+}
+
+var clike = [][2]string{{"/*", "*/"}}
+
+var (
+  goLang = &language{line_comments:[]string{"//"}, block_comments:clike, quotes:"\"'`", multiline_strings:"`",
+    keywords:words("break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var nil true false iota")}
+  cLang = &language{line_comments:[]string{"//"}, block_comments:clike, quotes:"\"'",
+    keywords:words("auto break case char const continue default do double else enum extern float for goto if inline int long register restrict return short signed sizeof static struct switch typedef union unsigned void volatile while bool true false NULL class namespace template typename public private protected virtual new delete this using try catch throw operator nullptr #include #define #ifdef #ifndef #endif #if #else #elif #pragma")}
+  javaLang = &language{line_comments:[]string{"//"}, block_comments:clike, quotes:"\"'",
+    keywords:words("abstract boolean break byte case catch char class const continue default do double else enum extends final finally float for if implements import instanceof int interface long native new package private protected public return short static super switch synchronized this throw throws try void volatile while true false null")}
+  jsLang = &language{line_comments:[]string{"//"}, block_comments:clike, quotes:"\"'`", multiline_strings:"`",
+    keywords:words("async await break case catch class const continue debugger default delete do else export extends finally for function if import in instanceof let new of return super switch this throw try typeof var void while yield true false null undefined interface type enum implements")}
+  rustLang = &language{line_comments:[]string{"//"}, block_comments:clike, quotes:"\"",
+    keywords:words("as break const continue crate else enum extern false fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait true type unsafe use where while async await dyn")}
+  shLang = &language{line_comments:[]string{"#"}, quotes:"\"'", multiline_strings:"\"'",
+    keywords:words("if then else elif fi case esac for while until do done in function return exit local export readonly set unset shift break continue")}
+  pyLang = &language{line_comments:[]string{"#"}, quotes:"\"'",
+    keywords:words("and as assert async await break class continue def del elif else except finally for from global if import in is lambda nonlocal not or pass raise return try while with yield None True False self")}
+  perlLang = &language{line_comments:[]string{"#"}, quotes:"\"'",
+    keywords:words("my our local sub if elsif else unless while until for foreach do last next redo return use require package no and or not eq ne lt gt le ge")}
+  rubyLang = &language{line_comments:[]string{"#"}, quotes:"\"'",
+    keywords:words("alias and begin break case class def defined? do else elsif end ensure false for if in module next nil not or redo rescue retry return self super then true undef unless until when while yield require")}
+  cssLang = &language{block_comments:clike, quotes:"\"'"}
+  htmlLang = &language{block_comments:[][2]string{{"<!--", "-->"}}, tags:true}
+  confLang = &language{line_comments:[]string{"#"}, quotes:"\"'"}
+  makeLang = &language{line_comments:[]string{"#"},
+    keywords:words("ifeq ifneq ifdef ifndef else endif include define endef export override")}
+  sqlLang = &language{line_comments:[]string{"--"}, block_comments:clike, quotes:"'\"",
+    keywords:words("select from where insert into values update set delete create table drop alter index primary key foreign references join left right inner outer on group by order having limit and or not null as distinct union SELECT FROM WHERE INSERT INTO VALUES UPDATE SET DELETE CREATE TABLE DROP ALTER INDEX PRIMARY KEY FOREIGN REFERENCES JOIN LEFT RIGHT INNER OUTER ON GROUP BY ORDER HAVING LIMIT AND OR NOT NULL AS DISTINCT UNION")}
+  diffLang = &language{diff:true}
+  plainLang = &language{}
+)
+
+// Maps file name extensions (and some complete file names) to languages.
+var languages = map[string]*language{
+  ".go":goLang,
+  ".c":cLang, ".h":cLang, ".cc":cLang, ".cpp":cLang, ".cxx":cLang, ".hpp":cLang, ".hh":cLang,
+  ".java":javaLang, ".cs":javaLang, ".kt":javaLang, ".scala":javaLang,
+  ".js":jsLang, ".mjs":jsLang, ".ts":jsLang, ".json":jsLang,
+  ".rs":rustLang,
+  ".sh":shLang, ".bash":shLang, ".zsh":shLang,
+  ".py":pyLang,
+  ".pl":perlLang, ".pm":perlLang,
+  ".rb":rubyLang,
+  ".css":cssLang,
+  ".html":htmlLang, ".htm":htmlLang, ".xhtml":htmlLang, ".xml":htmlLang, ".svg":htmlLang,
+  ".conf":confLang, ".cfg":confLang, ".ini":confLang, ".yaml":confLang, ".yml":confLang, ".toml":confLang,
+  ".mk":makeLang, "Makefile":makeLang, "makefile":makeLang, "GNUmakefile":makeLang,
+  ".sql":sqlLang,
+  ".diff":diffLang, ".patch":diffLang, ".debdiff":diffLang,
+}
+
+// Returns true if name's extension (or name itself) identifies a language
+// that is highlighted.
+func Supports(name string) bool {
+  return lookup(name) != plainLang
+}
+
+func lookup(name string) *language {
+  base := path.Base(name)
+  if lang, ok := languages[base]; ok { return lang }
+  if lang, ok := languages[strings.ToLower(path.Ext(base))]; ok { return lang }
+  return plainLang
+}
+
+type token struct {
+  class string // "" for plain text
+  text string
+}
+
+/*
+  Returns src (a file called name) as HTML table with one row per line.
+  The first column contains the line number with an anchor "L<number>",
+  the second column the highlighted source line.
+*/
+func ToHTML(src []byte, name string) []byte {
+  text := strings.Replace(string(src), "\r\n", "\n", -1)
+  text = strings.TrimSuffix(text, "\n")
+  toks := lookup(name).tokenize(text)
+
+  var out bytes.Buffer
+  out.WriteString("<table class=\"source\">\n")
+  lineno := 1
+  startLine := func() {
+    out.WriteString("<tr id=\"L")
+    out.WriteString(strconv.Itoa(lineno))
+    out.WriteString("\"><td class=\"ln\"><a href=\"#L")
+    out.WriteString(strconv.Itoa(lineno))
+    out.WriteString("\">")
+    out.WriteString(strconv.Itoa(lineno))
+    out.WriteString("</a></td><td class=\"code\">")
+  }
+  startLine()
+  for _, tok := range toks {
+    parts := strings.Split(tok.text, "\n")
+    for k, part := range parts {
+      if k > 0 {
+        out.WriteString("</td></tr>\n")
+        lineno++
+        startLine()
+      }
+      if part == "" { continue }
+      if tok.class != "" {
+        out.WriteString("<span class=\"" + tok.class + "\">")
+      }
+      out.WriteString(template.HTMLEscapeString(part))
+      if tok.class != "" {
+        out.WriteString("</span>")
+      }
+    }
+  }
+  out.WriteString("</td></tr>\n</table>\n")
+  return out.Bytes()
+}
+
+func isIdent(c byte) bool {
+  return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c >= 0x80
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// Splits text into tokens according to lang.
+func (lang *language) tokenize(text string) []token {
+  var toks []token
+  emit := func(class, s string) {
+    if s == "" { return }
+    if n := len(toks); n > 0 && toks[n-1].class == class {
+      toks[n-1].text += s
+    } else {
+      toks = append(toks, token{class, s})
+    }
+  }
+
+  if lang.diff {
+    for _, line := range strings.SplitAfter(text, "\n") {
+      class := ""
+      switch {
+        case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"),
+             strings.HasPrefix(line, "diff "), strings.HasPrefix(line, "index "): class = "meta"
+        case strings.HasPrefix(line, "@@"): class = "hunk"
+        case strings.HasPrefix(line, "+"):  class = "ins"
+        case strings.HasPrefix(line, "-"):  class = "del"
+      }
+      body := strings.TrimSuffix(line, "\n")
+      emit(class, body)
+      if len(body) < len(line) { emit("", "\n") }
+    }
+    return toks
+  }
+
+  i := 0
+  outer:
+  for i < len(text) {
+    for _, bc := range lang.block_comments {
+      if strings.HasPrefix(text[i:], bc[0]) {
+        end := strings.Index(text[i+len(bc[0]):], bc[1])
+        if end < 0 { end = len(text) } else { end += i + len(bc[0]) + len(bc[1]) }
+        emit("comment", text[i:end])
+        i = end
+        continue outer
+      }
+    }
+
+    for _, lc := range lang.line_comments {
+      // "#" only starts a comment at the beginning of a word (e.g. not in $#)
+      if strings.HasPrefix(text[i:], lc) && (lc != "#" || i == 0 || text[i-1] == ' ' || text[i-1] == '\t' || text[i-1] == '\n') {
+        end := strings.IndexByte(text[i:], '\n')
+        if end < 0 { end = len(text) } else { end += i }
+        emit("comment", text[i:end])
+        i = end
+        continue outer
+      }
+    }
+
+    c := text[i]
+
+    if strings.IndexByte(lang.quotes, c) >= 0 {
+      multiline := strings.IndexByte(lang.multiline_strings, c) >= 0
+      k := i + 1
+      for k < len(text) && text[k] != c && (multiline || text[k] != '\n') {
+        if text[k] == '\\' && c != '`' { k++ }
+        k++
+      }
+      if k < len(text) && text[k] == c { k++ }
+      if k > len(text) { k = len(text) }
+      emit("string", text[i:k])
+      i = k
+      continue
+    }
+
+    if lang.tags && c == '<' {
+      end := strings.IndexByte(text[i:], '>')
+      if end >= 0 {
+        emit("tag", text[i:i+end+1])
+        i += end + 1
+        continue
+      }
+    }
+
+    if isDigit(c) {
+      k := i
+      for k < len(text) && (isIdent(text[k]) || text[k] == '.') { k++ }
+      emit("number", text[i:k])
+      i = k
+      continue
+    }
+
+    if isIdent(c) || (c == '#' && lang.keywords["#include"]) {
+      k := i + 1
+      for k < len(text) && isIdent(text[k]) { k++ }
+      if k < len(text) && text[k] == '?' && lang.keywords[text[i:k+1]] { k++ }
+      word := text[i:k]
+      if lang.keywords[word] { emit("keyword", word) } else { emit("", word) }
+      i = k
+      continue
+    }
+
+    emit("", text[i:i+1])
+    i++
+  }
+  return toks
+}
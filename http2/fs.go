@@ -14,12 +14,36 @@ import (
 	"mime/multipart"
 	"net/textproto"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
 
+// MaxRanges is the largest number of ranges (after merging adjacent and
+// overlapping ones) a request may ask for. Requests with more are answered
+// with the whole content, because many tiny ranges cost much more to serve
+// than the data they return.
+var MaxRanges = 16
+
+// maxRangeSpecs is the largest number of comma-separated specs a Range
+// header may contain before it is parsed at all. Headers with more are
+// ignored and the whole content is sent, like with more than MaxRanges
+// ranges, so that parsing and sorting the specs costs little.
+const maxRangeSpecs = 256
+
+// MultipartWriteTimeout is how long writing each chunk of a
+// multipart/byteranges response to the client may take. A client that
+// reads more slowly is disconnected, so that it can not keep the content
+// and the goroutine that produces the parts busy indefinitely.
+var MultipartWriteTimeout = 30 * time.Second
+
+// multipartChunk is the size of the chunks in which a multipart/byteranges
+// response is written. It bounds the data in flight between the goroutine
+// that produces the parts and the client.
+const multipartChunk = 32 * 1024
+
 // ServeContent replies to the request using the content in the
 // provided Reader.  The main benefit of ServeContent over io.Copy
 // is that it handles Range requests properly, sets the MIME type, and
@@ -43,10 +67,16 @@ import (
 // not be supported.
 //
 // If size >= 0 and content does not support io.Seeker, range requests
-// will still be supported as long as they don't request overlapping
-// ranges. In this case dummy reads will be used to
-// skip parts that are not transmitted. If an overlapping range is requested
-// the range request will be ignored and the whole data will be sent.
+// will still be supported. In this case dummy reads will be used to
+// skip parts that are not transmitted.
+//
+// If content implements io.ReaderAt (like the streams of fs.Cache), each
+// range is read with ReadAt, so that the ranges are served straight from
+// the content without moving its position.
+//
+// Adjacent and overlapping ranges are merged and the parts are sent in
+// ascending order. If more than MaxRanges ranges remain, the range request
+// is ignored and the whole data is sent.
 //
 // If the caller has set w's ETag header, ServeContent uses it to
 // handle requests using If-Range and If-None-Match.
@@ -55,10 +85,7 @@ import (
 func ServeContent(w http.ResponseWriter, r *http.Request, modtime time.Time, size int64, content io.Reader) {
 	var err error
 	
-	if checkLastModified(w, r, modtime) {
-		return
-	}
-	rangeReq, done := checkETag(w, r, modtime)
+	rangeReq, done := CheckPreconditions(w, r, modtime)
 	if done {
 		return
 	}
@@ -72,6 +99,7 @@ func ServeContent(w http.ResponseWriter, r *http.Request, modtime time.Time, siz
 	}
 
 	seeker, can_seek := content.(io.Seeker)
+	readerAt, can_read_at := content.(io.ReaderAt)
 	if can_seek {
 		// seek to end to determine size
 		size, err = seeker.Seek(0, os.SEEK_END)
@@ -88,12 +116,27 @@ func ServeContent(w http.ResponseWriter, r *http.Request, modtime time.Time, siz
 	// handle Content-Range header.
 	sendSize := size
 	var sendContent io.Reader = content
+	is_multipart := false
+	if size == 0 {
+		// No range of an empty file is satisfiable. Send it
+		// whole instead of a 416 or a 206 with a bogus range.
+		rangeReq = ""
+	}
+	if strings.Count(rangeReq, ",") >= maxRangeSpecs {
+		rangeReq = ""
+	}
 	if size >= 0 {
-		ranges, err := parseRange(rangeReq, size, can_seek, !can_seek)
+		// Sorted and merged, the ranges never overlap, so they can be
+		// served from content that can not seek, too.
+		ranges, err := parseRange(rangeReq, size, true, true)
 		if err != nil {
 			http.Error(w, "416 Requested Range Not Satisfiable", http.StatusRequestedRangeNotSatisfiable)
 			return
 		}
+		ranges = coalesceRanges(ranges)
+		if len(ranges) > MaxRanges {
+			ranges = nil
+		}
 		if sumRangesSize(ranges) > size {
 			// The total number of bytes in all the ranges
 			// is larger than the size of the file by
@@ -115,7 +158,9 @@ func ServeContent(w http.ResponseWriter, r *http.Request, modtime time.Time, siz
 			// A response to a request for a single range MUST NOT
 			// be sent using the multipart/byteranges media type."
 			ra := ranges[0]
-			if can_seek {
+			if can_read_at {
+				sendContent = io.NewSectionReader(readerAt, ra.start, ra.length)
+			} else if can_seek {
 			  _, err = seeker.Seek(ra.start, os.SEEK_SET)
 			} else {
 			  err = skip(content, ra.start)
@@ -136,15 +181,24 @@ func ServeContent(w http.ResponseWriter, r *http.Request, modtime time.Time, siz
 			w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
 			sendContent = pr
 			defer pr.Close() // cause writing goroutine to fail and exit if CopyN doesn't finish.
+			is_multipart = true
+			ctx := r.Context()
 			go func() {
 				var offset int64 = 0
 				for _, ra := range ranges {
+					if err := ctx.Err(); err != nil {
+						pw.CloseWithError(err)
+						return
+					}
 					part, err := mw.CreatePart(ra.mimeHeader(ctype, size))
 					if err != nil {
 						pw.CloseWithError(err)
 						return
 					}
-					if can_seek {
+					var src io.Reader = content
+					if can_read_at {
+						src = io.NewSectionReader(readerAt, ra.start, ra.length)
+					} else if can_seek {
 						_, err = seeker.Seek(ra.start, os.SEEK_SET)
 					} else {
 						// parseRange() guarantees that ranges
@@ -155,7 +209,7 @@ func ServeContent(w http.ResponseWriter, r *http.Request, modtime time.Time, siz
 						pw.CloseWithError(err)
 						return
 					}
-					if _, err := io.CopyN(part, content, ra.length); err != nil {
+					if _, err := io.CopyN(part, src, ra.length); err != nil {
 						pw.CloseWithError(err)
 						return
 					}
@@ -166,14 +220,17 @@ func ServeContent(w http.ResponseWriter, r *http.Request, modtime time.Time, siz
 			}()
 		}
 
-		w.Header().Set("Accept-Ranges", "bytes")
+		// Shared, so that each response does not allocate the slice.
+		w.Header()["Accept-Ranges"] = acceptRangesBytes
 		w.Header().Set("Content-Length", strconv.FormatInt(sendSize, 10))
 	}
 
 	w.WriteHeader(code)
 
 	if r.Method != "HEAD" {
-		if sendSize >= 0 {
+		if is_multipart {
+			copyMultipart(w, r, sendContent, sendSize)
+		} else if sendSize >= 0 {
 			io.CopyN(w, sendContent, sendSize)
 		} else {
 			io.Copy(w, sendContent)
@@ -181,6 +238,38 @@ func ServeContent(w http.ResponseWriter, r *http.Request, modtime time.Time, siz
 	}
 }
 
+// copyMultipart copies size bytes of a multipart/byteranges body from
+// body to w in chunks of multipartChunk bytes, each of which must be
+// written within MultipartWriteTimeout. It stops when the request is
+// canceled, e.g. because the client has gone away.
+func copyMultipart(w http.ResponseWriter, r *http.Request, body io.Reader, size int64) {
+	ctx := r.Context()
+	rc := http.NewResponseController(w)
+	// If w does not support deadlines, only the cancellation applies.
+	defer rc.SetWriteDeadline(time.Time{})
+	buf := make([]byte, multipartChunk)
+	for size > 0 {
+		if ctx.Err() != nil {
+			return
+		}
+		n := int64(len(buf))
+		if n > size {
+			n = size
+		}
+		nr, err := io.ReadFull(body, buf[:n])
+		if nr > 0 {
+			rc.SetWriteDeadline(time.Now().Add(MultipartWriteTimeout))
+			if _, werr := w.Write(buf[:nr]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+		size -= int64(nr)
+	}
+}
+
 // Reads and discards howmany bytes from r.
 func skip(r io.Reader, howmany int64) error {
   var buf [32768]byte
@@ -200,10 +289,91 @@ func skip(r io.Reader, howmany int64) error {
 
 var unixEpochTime = time.Unix(0, 0)
 
+var acceptRangesBytes = []string{"bytes"}
+
+// isZeroTime reports whether t is obviously unspecified (either zero or Unix()=0).
+func isZeroTime(t time.Time) bool {
+	return t.IsZero() || t.Equal(unixEpochTime)
+}
+
+// CheckPreconditions evaluates the conditional request headers of r
+// in the order prescribed by RFC 7232, section 6:
+// If-Match, If-Unmodified-Since, If-None-Match, If-Modified-Since and
+// finally If-Range.
+//
+// The ETag (if any) must have been set in w's headers before calling
+// this function. modtime is the modification time of the resource
+// or the zero time if unknown. If modtime is known, the Last-Modified
+// header will be set.
+//
+// If a precondition fails, the appropriate response (304 Not Modified
+// for GET and HEAD, 412 Precondition Failed otherwise) is written and
+// done is true. Otherwise rangeReq is the effective "Range" header to use.
+//
+// This function can be used for any method, including PUT and DELETE.
+func CheckPreconditions(w http.ResponseWriter, r *http.Request, modtime time.Time) (rangeReq string, done bool) {
+	etag := w.Header().Get("Etag")
+	getOrHead := r.Method == "GET" || r.Method == "HEAD" || r.Method == ""
+
+	if !isZeroTime(modtime) {
+		w.Header().Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	}
+
+	// Step 1 and 2
+	if im := r.Header.Get("If-Match"); im != "" {
+		if !etagListMatches(im, etag, true) {
+			writePreconditionFailed(w)
+			return "", true
+		}
+	} else if ius := r.Header.Get("If-Unmodified-Since"); ius != "" && !isZeroTime(modtime) {
+		// The Date-Modified header truncates sub-second precision, so
+		// use mtime < t+1s instead of mtime <= t to check for unmodified.
+		if t, err := http.ParseTime(ius); err == nil && !modtime.Before(t.Add(1*time.Second)) {
+			writePreconditionFailed(w)
+			return "", true
+		}
+	}
+
+	// Step 3 and 4
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etagListMatches(inm, etag, false) {
+			if getOrHead {
+				writeNotModified(w)
+			} else {
+				writePreconditionFailed(w)
+			}
+			return "", true
+		}
+	} else if getOrHead && checkLastModified(w, r, modtime) {
+		return "", true
+	}
+
+	// Step 5
+	rangeReq = ""
+	if getOrHead {
+		rangeReq = checkIfRange(w, r, modtime)
+	}
+	return rangeReq, false
+}
+
+func writeNotModified(w http.ResponseWriter) {
+	h := w.Header()
+	delete(h, "Content-Type")
+	delete(h, "Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+}
+
+func writePreconditionFailed(w http.ResponseWriter) {
+	h := w.Header()
+	delete(h, "Content-Type")
+	delete(h, "Content-Length")
+	http.Error(w, "412 Precondition Failed", http.StatusPreconditionFailed)
+}
+
 // modtime is the modification time of the resource to be served, or IsZero().
 // return value is whether this request is now complete.
 func checkLastModified(w http.ResponseWriter, r *http.Request, modtime time.Time) bool {
-	if modtime.IsZero() || modtime.Equal(unixEpochTime) {
+	if isZeroTime(modtime) {
 		// If the file doesn't have a modtime (IsZero), or the modtime
 		// is obviously garbage (Unix time == 0), then ignore modtimes
 		// and don't process the If-Modified-Since header.
@@ -212,26 +382,26 @@ func checkLastModified(w http.ResponseWriter, r *http.Request, modtime time.Time
 
 	// The Date-Modified header truncates sub-second precision, so
 	// use mtime < t+1s instead of mtime <= t to check for unmodified.
-	if t, err := time.Parse(http.TimeFormat, r.Header.Get("If-Modified-Since")); err == nil && modtime.Before(t.Add(1*time.Second)) {
-		h := w.Header()
-		delete(h, "Content-Type")
-		delete(h, "Content-Length")
-		w.WriteHeader(http.StatusNotModified)
+	// Parsing a missing header would allocate an error for nothing.
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" {
+		return false
+	}
+	if t, err := time.Parse(http.TimeFormat, ims); err == nil && modtime.Before(t.Add(1*time.Second)) {
+		writeNotModified(w)
 		return true
 	}
-	w.Header().Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
 	return false
 }
 
-// checkETag implements If-None-Match and If-Range checks.
+// checkIfRange implements the If-Range check.
 //
 // The ETag or modtime must have been previously set in the
 // ResponseWriter's headers.  The modtime is only compared at second
 // granularity and may be the zero value to mean unknown.
 //
-// The return value is the effective request "Range" header to use and
-// whether this request is now considered done.
-func checkETag(w http.ResponseWriter, r *http.Request, modtime time.Time) (rangeReq string, done bool) {
+// The return value is the effective request "Range" header to use.
+func checkIfRange(w http.ResponseWriter, r *http.Request, modtime time.Time) (rangeReq string) {
 	etag := w.Header().Get("Etag")
 	rangeReq = r.Header.Get("Range")
 
@@ -239,9 +409,8 @@ func checkETag(w http.ResponseWriter, r *http.Request, modtime time.Time) (range
 	// the client was expecting.
 	// "If-Range: version" means "ignore the Range: header unless version matches the
 	// current file."
-	// We only support ETag versions.
 	// The caller must have set the ETag on the response already.
-	if ir := r.Header.Get("If-Range"); ir != "" && ir != etag {
+	if ir := r.Header.Get("If-Range"); ir != "" && !etagMatches(ir, etag, true) {
 		// The If-Range value is typically the ETag value, but it may also be
 		// the modtime date. See golang.org/issue/8367.
 		timeMatches := false
@@ -254,34 +423,41 @@ func checkETag(w http.ResponseWriter, r *http.Request, modtime time.Time) (range
 			rangeReq = ""
 		}
 	}
+	return rangeReq
+}
 
-	if inm := r.Header.Get("If-None-Match"); inm != "" {
-		// Must know ETag.
-		if etag == "" {
-			return rangeReq, false
-		}
-
-		// TODO(bradfitz): non-GET/HEAD requests require more work:
-		// sending a different status code on matches, and
-		// also can't use weak cache validators (those with a "W/
-		// prefix).  But most users of ServeContent will be using
-		// it on GET or HEAD, so only support those for now.
-		if r.Method != "GET" && r.Method != "HEAD" {
-			return rangeReq, false
+// etagListMatches reports whether the comma-separated list of entity tags
+// from an If-Match or If-None-Match header contains etag or "*".
+// "*" only matches if etag != "", i.e. if the resource exists.
+// If strong is true, the strong comparison function of RFC 7232 is used,
+// otherwise the weak one.
+func etagListMatches(list string, etag string, strong bool) bool {
+	if etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || etagMatches(candidate, etag, strong) {
+			return true
 		}
+	}
+	return false
+}
 
-		// TODO(bradfitz): deal with comma-separated or multiple-valued
-		// list of If-None-match values.  For now just handle the common
-		// case of a single item.
-		if inm == etag || inm == "*" {
-			h := w.Header()
-			delete(h, "Content-Type")
-			delete(h, "Content-Length")
-			w.WriteHeader(http.StatusNotModified)
-			return "", true
-		}
+// etagMatches compares the entity tags a and b. Surrounding quotes are
+// ignored, so that unquoted entity tags work, too.
+// If strong is true, weak entity tags (W/ prefix) never match.
+func etagMatches(a, b string, strong bool) bool {
+	if a == "" || b == "" {
+		return false
 	}
-	return rangeReq, false
+	aWeak, bWeak := strings.HasPrefix(a, "W/"), strings.HasPrefix(b, "W/")
+	if strong && (aWeak || bWeak) {
+		return false
+	}
+	a = strings.Trim(strings.TrimPrefix(a, "W/"), `"`)
+	b = strings.Trim(strings.TrimPrefix(b, "W/"), `"`)
+	return a == b
 }
 
 
@@ -364,17 +540,8 @@ func parseRange(s string, size int64, overlap_allowed bool, sorted bool) ([]http
 	}
 	
 	// sort ranges by ascending start
-	// insertion sort
 	if sorted || !overlap_allowed {
-		for x := 1; x < len(ranges); x++ {
-			child_to_find_place_for := ranges[x]
-			y := x
-			for y > 0 && ranges[y-1].start > child_to_find_place_for.start {
-				ranges[y] = ranges[y-1]
-				y--
-			}
-			ranges[y] = child_to_find_place_for
-		}
+		sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
 	}
 	
 	if !overlap_allowed {
@@ -388,6 +555,26 @@ func parseRange(s string, size int64, overlap_allowed bool, sorted bool) ([]http
 	return ranges, nil
 }
 
+// coalesceRanges merges adjacent and overlapping ranges of ranges, which
+// must be sorted by ascending start.
+func coalesceRanges(ranges []httpRange) []httpRange {
+	if len(ranges) < 2 {
+		return ranges
+	}
+	merged := ranges[:1]
+	for _, ra := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if ra.start <= last.start+last.length {
+			if end := ra.start + ra.length; end > last.start+last.length {
+				last.length = end - last.start
+			}
+			continue
+		}
+		merged = append(merged, ra)
+	}
+	return merged
+}
+
 // countingWriter counts how many bytes have been written to it.
 type countingWriter int64
 
@@ -0,0 +1,41 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package linux
+
+import (
+         "os"
+         "syscall"
+       )
+
+/*
+  Allocates disk space for the first length bytes of f (fallocate(2)),
+  so that writing them can not fail with ENOSPC. The file size is changed
+  accordingly. Returns syscall.EOPNOTSUPP if the file system does not
+  support this.
+*/
+func Fallocate(f *os.File, length int64) error {
+  err := syscall.Fallocate(int(f.Fd()), 0, 0, length)
+  if err != nil { return &os.PathError{Op:"fallocate", Path:f.Name(), Err:err} }
+  return nil
+}
+
+// Returns the bytes available to unprivileged users and the total size
+// of the file system containing path.
+func DiskSpace(path string) (free uint64, total uint64, err error) {
+  var st syscall.Statfs_t
+  err = syscall.Statfs(path, &st)
+  if err != nil { return 0, 0, &os.PathError{Op:"statfs", Path:path, Err:err} }
+  return st.Bavail * uint64(st.Bsize), st.Blocks * uint64(st.Bsize), nil
+}
@@ -0,0 +1,36 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+
+package linux
+
+/*
+#include <fcntl.h>
+*/
+import "C"
+import "fmt"
+import "syscall"
+
+const FADV_NORMAL = C.POSIX_FADV_NORMAL
+const FADV_SEQUENTIAL = C.POSIX_FADV_SEQUENTIAL
+const FADV_DONTNEED = C.POSIX_FADV_DONTNEED
+
+// Calls posix_fadvise(fd, offset, length, advice). A length of 0 means
+// "until the end of the file".
+func Fadvise(fd uintptr, offset int64, length int64, advice int) error {
+  res := C.posix_fadvise(C.int(fd), C.off_t(offset), C.off_t(length), C.int(advice))
+  if res == 0 { return nil }
+  // posix_fadvise() does not set errno. It returns the error number.
+  return fmt.Errorf("posix_fadvise(%v): %v", fd, syscall.Errno(res))
+}
@@ -0,0 +1,98 @@
+//go:build pam
+// +build pam
+
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package linux
+
+/*
+#cgo LDFLAGS: -lpam
+#include <stdlib.h>
+#include <string.h>
+#include <security/pam_appl.h>
+
+struct credentials {
+  const char* user;
+  const char* password;
+};
+
+// Answers PAM's prompts with the user name and password from appdata.
+static int conversation(int n, const struct pam_message** msg, struct pam_response** resp, void* appdata) {
+  struct credentials* cred = appdata;
+  struct pam_response* r = calloc(n, sizeof(struct pam_response));
+  if (r == NULL) return PAM_BUF_ERR;
+  int i;
+  for (i = 0; i < n; i++) {
+    switch (msg[i]->msg_style) {
+      case PAM_PROMPT_ECHO_OFF: r[i].resp = strdup(cred->password); break;
+      case PAM_PROMPT_ECHO_ON:  r[i].resp = strdup(cred->user); break;
+      case PAM_ERROR_MSG:
+      case PAM_TEXT_INFO: break;
+      default:
+        for (; i >= 0; i--) free(r[i].resp);
+        free(r);
+        return PAM_CONV_ERR;
+    }
+  }
+  *resp = r;
+  return PAM_SUCCESS;
+}
+
+static int authenticate(const char* service, struct credentials* cred, const char** errmsg) {
+  struct pam_conv conv = { conversation, cred };
+  pam_handle_t* pamh = NULL;
+  int ret = pam_start(service, cred->user, &conv, &pamh);
+  if (ret == PAM_SUCCESS) ret = pam_authenticate(pamh, PAM_SILENT|PAM_DISALLOW_NULL_AUTHTOK);
+  if (ret == PAM_SUCCESS) ret = pam_acct_mgmt(pamh, PAM_SILENT|PAM_DISALLOW_NULL_AUTHTOK);
+  *errmsg = pam_strerror(pamh, ret);
+  if (pamh != NULL) pam_end(pamh, ret);
+  return ret;
+}
+*/
+import "C"
+import (
+         "fmt"
+         "unsafe"
+       )
+
+// True if this binary was built with PAM support.
+const PAMSupported = true
+
+/*
+  Checks user and password with the PAM service (e.g. "login"), including
+  whether the account is valid (pam_authenticate(3) and pam_acct_mgmt(3)).
+  Returns nil if the login is permitted.
+  Checking passwords of other users usually requires root privileges.
+*/
+func PAMAuthenticate(service, user, password string) error {
+  cservice := C.CString(service)
+  defer C.free(unsafe.Pointer(cservice))
+  cred := (*C.struct_credentials)(C.malloc(C.sizeof_struct_credentials))
+  defer C.free(unsafe.Pointer(cred))
+  cred.user = C.CString(user)
+  defer C.free(unsafe.Pointer(cred.user))
+  cred.password = C.CString(password)
+  defer func() {
+    C.memset(unsafe.Pointer(cred.password), 0, C.size_t(len(password)))
+    C.free(unsafe.Pointer(cred.password))
+  }()
+  
+  var errmsg *C.char
+  ret := C.authenticate(cservice, cred, &errmsg)
+  if ret != C.PAM_SUCCESS {
+    return fmt.Errorf("PAM %v: %v", service, C.GoString(errmsg))
+  }
+  return nil
+}
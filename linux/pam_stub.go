@@ -0,0 +1,28 @@
+//go:build !pam
+// +build !pam
+
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package linux
+
+import "fmt"
+
+// True if this binary was built with PAM support.
+const PAMSupported = false
+
+// Always fails because this binary has been built without PAM support.
+func PAMAuthenticate(service, user, password string) error {
+  return fmt.Errorf("This binary has been built without PAM support")
+}
@@ -0,0 +1,36 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package linux
+
+/*
+#include <poll.h>
+*/
+import "C"
+import "time"
+import "syscall"
+
+// Waits until fd is readable or timeout has passed and returns true in
+// the former case. A timeout < 0 waits forever.
+func WaitReadable(fd int, timeout time.Duration) (bool, error) {
+  ms := -1
+  if timeout >= 0 { ms = int((timeout + time.Millisecond - 1)/time.Millisecond) }
+  pfd := C.struct_pollfd{fd:C.int(fd), events:C.POLLIN}
+  n, err := C.poll(&pfd, 1, C.int(ms))
+  if n < 0 {
+    if err == syscall.EINTR { return false, nil }
+    return false, err
+  }
+  return n > 0, nil
+}
@@ -0,0 +1,91 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package linux
+
+/*
+#define _GNU_SOURCE
+#include <fcntl.h>
+#include <sys/stat.h>
+*/
+import "C"
+import (
+         "os"
+         "fmt"
+         "time"
+         "unsafe"
+         "syscall"
+       )
+
+/*
+  Creates an unnamed temporary file in directory dir with permissions
+  mode (open(2) with O_TMPFILE). The file only appears in dir when it is
+  given a name with Linkat(). If it is closed before that, it is gone.
+  Returns an error if the kernel or the file system does not support O_TMPFILE.
+*/
+func OpenTmpfile(dir string, mode uint32) (*os.File, error) {
+  fd, err := syscall.Open(dir, C.O_TMPFILE|syscall.O_RDWR|syscall.O_CLOEXEC, mode)
+  if err != nil { return nil, &os.PathError{Op:"open(O_TMPFILE)", Path:dir, Err:err} }
+  return os.NewFile(uintptr(fd), dir+"/(O_TMPFILE)"), nil
+}
+
+/*
+  Gives the file f created by OpenTmpfile() the name newpath, which must
+  not exist. Uses linkat(2) with AT_EMPTY_PATH, which requires
+  CAP_DAC_READ_SEARCH, or, if that fails, /proc/self/fd, which is usually
+  not available in a chroot.
+*/
+func Linkat(f *os.File, newpath string) error {
+  err := linkat(int(f.Fd()), "", C.AT_FDCWD, newpath, C.AT_EMPTY_PATH)
+  if err == nil { return nil }
+  err2 := linkat(C.AT_FDCWD, fmt.Sprintf("/proc/self/fd/%d", f.Fd()), C.AT_FDCWD, newpath, C.AT_SYMLINK_FOLLOW)
+  if err2 == nil { return nil }
+  return fmt.Errorf("linkat(%v): %v (via /proc: %v)", newpath, err, err2)
+}
+
+func linkat(olddirfd int, oldpath string, newdirfd int, newpath string, flags int) error {
+  p1, err := syscall.BytePtrFromString(oldpath)
+  if err != nil { return err }
+  p2, err := syscall.BytePtrFromString(newpath)
+  if err != nil { return err }
+  _, _, errno := syscall.Syscall6(syscall.SYS_LINKAT, uintptr(olddirfd), uintptr(unsafe.Pointer(p1)), uintptr(newdirfd), uintptr(unsafe.Pointer(p2)), uintptr(flags), 0)
+  if errno != 0 { return errno }
+  return nil
+}
+
+/*
+  Returns true if files created with OpenTmpfile() in dir can be given a
+  name with Linkat(). This depends on the file system as well as on the
+  process's capabilities and whether /proc is available.
+*/
+func TmpfileLinkable(dir string) bool {
+  f, err := OpenTmpfile(dir, 0600)
+  if err != nil { return false }
+  defer f.Close()
+  probe := fmt.Sprintf("%v/.tmpfile-probe-%v", dir, os.Getpid())
+  if Linkat(f, probe) != nil { return false }
+  os.Remove(probe)
+  return true
+}
+
+// Sets the access and modification times of the open file f (futimens(3)).
+// Unlike os.Chtimes() this works for files without a name.
+func Futimens(f *os.File, atime, mtime time.Time) error {
+  var ts [2]C.struct_timespec
+  ts[0].tv_sec, ts[0].tv_nsec = C.time_t(atime.Unix()), C.long(atime.Nanosecond())
+  ts[1].tv_sec, ts[1].tv_nsec = C.time_t(mtime.Unix()), C.long(mtime.Nanosecond())
+  res, err := C.futimens(C.int(f.Fd()), &ts[0])
+  if res != 0 { return &os.PathError{Op:"futimens", Path:f.Name(), Err:err} }
+  return nil
+}
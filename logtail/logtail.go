@@ -0,0 +1,197 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+/*
+  Keeps the last lines of the log in memory and serves them to logged in
+  users at Path, optionally following new lines as server-sent events,
+  so that operators can debug without shell access to the (chrooted) host.
+*/
+package logtail
+
+import (
+         "io"
+         "fmt"
+         "sync"
+         "time"
+         "regexp"
+         "strconv"
+         "strings"
+         "net/http"
+         
+         "../auth"
+         "../problem"
+         "../accesslog"
+       )
+
+// Where Handler is served.
+const Path = "/.garcon/logs"
+
+// The number of lines sent if the request does not ask for a number.
+const DefaultLines = 100
+
+// How often a comment is sent to followers while nothing is logged, so that proxies do not drop the connection.
+var KeepAlive = 15 * time.Second
+
+// The lines kept in memory. A ring buffer.
+type buffer struct {
+  mutex sync.Mutex
+  lines []string
+  // The number of lines written so far. lines[total % len(lines)] is the next to be replaced.
+  total uint64
+  // The start of a line whose end has not been written yet.
+  partial string
+  // Closed (and replaced) when lines are added.
+  changed chan bool
+}
+
+var buf *buffer
+
+/*
+  Makes the last n lines of the log available to Handler. Returns the
+  writer to pass to util.LoggerAdd(). Call only once.
+*/
+func Start(n int) io.Writer {
+  buf = &buffer{lines:make([]string, n), changed:make(chan bool)}
+  return buf
+}
+
+func (b *buffer) Write(p []byte) (int, error) {
+  b.mutex.Lock()
+  defer b.mutex.Unlock()
+  lines := strings.Split(b.partial + string(p), "\n")
+  b.partial = lines[len(lines)-1]
+  for _, line := range lines[:len(lines)-1] {
+    b.lines[b.total % uint64(len(b.lines))] = strings.TrimRight(line, "\r")
+    b.total++
+  }
+  if len(lines) > 1 {
+    close(b.changed)
+    b.changed = make(chan bool)
+  }
+  return len(p), nil
+}
+
+/*
+  Returns the lines after the first since lines, at most n of them (the
+  latest ones), the number of lines written so far and a channel that is
+  closed when more lines are written.
+*/
+func (b *buffer) since(since uint64, n int) ([]string, uint64, chan bool) {
+  b.mutex.Lock()
+  defer b.mutex.Unlock()
+  if n > len(b.lines) { n = len(b.lines) }
+  if b.total - since > uint64(n) { since = b.total - uint64(n) }
+  lines := make([]string, 0, b.total - since)
+  for i := since; i < b.total; i++ {
+    lines = append(lines, b.lines[i % uint64(len(b.lines))])
+  }
+  return lines, b.total, b.changed
+}
+
+// The lines selected by the type parameter of a request.
+var types = map[string]*regexp.Regexp{
+  "": nil,
+  "all": nil,
+  // Errors and warnings.
+  "error": regexp.MustCompile(`(ERROR|WARNING)!`),
+  // The lines logged for requests, e.g. "200 GET /foo (...)".
+  "access": regexp.MustCompile(`^(?:\S+ )*?[1-5][0-9][0-9] [A-Z]+ /`),
+}
+
+// Returns the lines that match filter (all if filter is nil).
+func matching(lines []string, filter *regexp.Regexp) []string {
+  if filter == nil { return lines }
+  result := lines[:0:0]
+  for _, line := range lines {
+    if filter.MatchString(line) { result = append(result, line) }
+  }
+  return result
+}
+
+/*
+  Serves the last lines of the log (see Start()) as text/plain to logged in
+  users. The access policy must cover Path. The parameters are
+    lines=N  The number of lines (default DefaultLines). They are taken from
+             the lines kept in memory before the type filter is applied.
+    type=T   "error" for errors and warnings, "access" for the lines logged
+             for requests or "all" (the default).
+    follow=1 Sends the lines as server-sent events (text/event-stream), one
+             event per line, followed by the new lines as they are logged.
+*/
+var Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Cache-Control", "no-store")
+  if auth.UserFrom(r) == nil {
+    problem.Log(r, http.StatusUnauthorized, problem.LoginRequired, "")
+    problem.Write(w, r, http.StatusUnauthorized, problem.LoginRequired, "Login required")
+    return
+  }
+  if buf == nil {
+    problem.Log(r, http.StatusNotFound, problem.NotFound, "")
+    problem.Write(w, r, http.StatusNotFound, problem.NotFound, "")
+    return
+  }
+  q := r.URL.Query()
+  n := DefaultLines
+  if l := q.Get("lines"); l != "" {
+    var err error
+    n, err = strconv.Atoi(l)
+    if err != nil || n < 0 {
+      problem.Log(r, http.StatusBadRequest, problem.BadRequest, "lines=%v", l)
+      problem.Write(w, r, http.StatusBadRequest, problem.BadRequest, "lines must be a number")
+      return
+    }
+  }
+  filter, ok := types[q.Get("type")]
+  if !ok {
+    problem.Log(r, http.StatusBadRequest, problem.BadRequest, "type=%v", q.Get("type"))
+    problem.Write(w, r, http.StatusBadRequest, problem.BadRequest, "type must be all, error or access")
+    return
+  }
+  
+  lines, total, changed := buf.since(0, n)
+  lines = matching(lines, filter)
+  if q.Get("follow") != "1" {
+    w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+    for _, line := range lines { fmt.Fprintln(w, line) }
+    return
+  }
+  
+  flusher, ok := w.(http.Flusher)
+  if !ok {
+    problem.Log(r, http.StatusInternalServerError, problem.Internal, "ResponseWriter does not support flushing")
+    problem.Write(w, r, http.StatusInternalServerError, problem.Internal, "Streaming is not supported")
+    return
+  }
+  w.Header().Set("Content-Type", "text/event-stream; charset=UTF-8")
+  w.Header().Set("X-Accel-Buffering", "no")
+  accesslog.Log(r, 1, "%v %v %v (following the log)", http.StatusOK, r.Method, r.URL.Path)
+  for {
+    for _, line := range lines {
+      _, err := fmt.Fprintf(w, "data: %v\n\n", line)
+      if err != nil { return }
+    }
+    flusher.Flush()
+    select {
+      case <-r.Context().Done():
+        return
+      case <-time.After(KeepAlive):
+        _, err := fmt.Fprintf(w, ": keep-alive\n\n")
+        if err != nil { return }
+        lines = nil
+      case <-changed:
+        lines, total, changed = buf.since(total, len(buf.lines))
+        lines = matching(lines, filter)
+    }
+  }
+})
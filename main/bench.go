@@ -0,0 +1,381 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package main
+
+import (
+         "io"
+         "os"
+         "fmt"
+         "net"
+         "sort"
+         "sync"
+         "time"
+         "bytes"
+         "strconv"
+         "runtime"
+         "net/http"
+         "io/ioutil"
+         "math/rand"
+         "path/filepath"
+         "compress/gzip"
+         "github.com/mbenkmann/golib/argv"
+         "github.com/mbenkmann/golib/util"
+         
+         "../fs"
+       )
+
+const (
+  BENCH_UNKNOWN = iota
+  BENCH_HELP
+  BENCH_DURATION
+  BENCH_CONCURRENCY
+  BENCH_WORKLOAD
+  BENCH_DIR
+  BENCH_IO_URING
+)
+
+var benchUsage = argv.Usage{
+{ BENCH_UNKNOWN, 1, "", "", argv.ArgUnknown, `NAME
+    garçon bench - measure the performance of serving files
+
+SYNOPSIS
+    garçon bench [--duration=seconds] [--concurrency=N] [--workload=name...]
+                 [--io-uring]
+    
+    Creates a synthetic directory tree, serves it with the default handling
+    rules on a random port of 127.0.0.1 and runs each workload against it
+    with N clients that send requests as fast as they can. For each workload
+    prints requests per second, throughput, median and 99th percentile
+    latency and memory allocations per request (of client and server
+    together, so only comparable between runs on the same Go version).
+    Exits with code 1 if a request fails.
+    
+    With --io-uring each workload runs twice, first with the standard read
+    path and then reading the files via io_uring (see "garçon --io-uring"),
+    so that the two can be compared.
+
+WORKLOADS
+    metadata    small files (Release, Packages, ...) and generated index pages
+    range       1 MiB ranges at random offsets of a 64 MiB file
+    gzip        gzip aliases (e.g. foo.txt for foo.txt.gz) with
+                Accept-Encoding: gzip, i.e. sent as they are
+    gunzip      gzip aliases without Accept-Encoding, i.e. decompressed
+
+OPTIONS
+`},
+{ BENCH_HELP,1,"","help",argv.ArgNone, "    --help \tPrint usage and exit.\n" },
+{ BENCH_DURATION,1,"","duration",argv.ArgRequired, "    --duration=seconds \tHow long each workload runs. Default is 5.\n" },
+{ BENCH_CONCURRENCY,1,"","concurrency",argv.ArgRequired, "    --concurrency=N \tThe number of clients sending requests at the same time. Default is 8.\n" },
+{ BENCH_WORKLOAD,1,"","workload",argv.ArgRequired, "    --workload=name \tRun only this workload. Can be used multiple times. Default is all.\n" },
+{ BENCH_DIR,1,"","dir",argv.ArgRequired, "    --dir=dir \tCreate the tree in dir (which must not exist) and keep it, instead of a temporary directory that is removed afterwards.\n" },
+{ BENCH_IO_URING,1,"","io-uring",argv.ArgNone, "    --io-uring \tRun each workload with the standard read path and with io_uring. Only available if Garçon has been built with \"-tags iouring\".\n" },
+}
+
+// A kind of requests to measure.
+type workload struct {
+  name string
+  // Returns the next request to send. Called concurrently.
+  request func(base string, rnd *rand.Rand) *http.Request
+}
+
+// The paths of the synthetic tree used by the workloads.
+var benchMetadata, benchGzip []string
+
+// The size of the file for the range workload.
+const benchBigSize = 64 << 20
+
+const benchBig = "/pool/big.bin"
+
+var workloads = []workload{
+  {"metadata", func(base string, rnd *rand.Rand) *http.Request {
+    return benchRequest(base + benchMetadata[rnd.Intn(len(benchMetadata))])
+  }},
+  {"range", func(base string, rnd *rand.Rand) *http.Request {
+    req := benchRequest(base + benchBig)
+    start := rnd.Int63n(benchBigSize - (1 << 20))
+    req.Header.Set("Range", fmt.Sprintf("bytes=%v-%v", start, start + (1 << 20) - 1))
+    return req
+  }},
+  {"gzip", func(base string, rnd *rand.Rand) *http.Request {
+    req := benchRequest(base + benchGzip[rnd.Intn(len(benchGzip))])
+    req.Header.Set("Accept-Encoding", "gzip")
+    return req
+  }},
+  {"gunzip", func(base string, rnd *rand.Rand) *http.Request {
+    return benchRequest(base + benchGzip[rnd.Intn(len(benchGzip))])
+  }},
+}
+
+func benchRequest(u string) *http.Request {
+  req, _ := http.NewRequest("GET", u, nil)
+  return req
+}
+
+// The results of running a workload.
+type benchResult struct {
+  requests int
+  errors int
+  bytes int64
+  elapsed time.Duration
+  latencies []time.Duration
+  mallocs uint64
+}
+
+/*
+  Runs "garçon bench" with the arguments args (without "bench") and
+  returns the exit code.
+*/
+func bench(args []string) int {
+  options, _, err, _ := argv.Parse(args, benchUsage, "gnu -perl --abb")
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "garçon bench: %v\n", err)
+    return 1
+  }
+  
+  if options[BENCH_HELP].Count() > 0 {
+    fmt.Fprintf(os.Stdout, "%v\n", benchUsage)
+    return 0
+  }
+  
+  duration := 5*time.Second
+  if options[BENCH_DURATION].Count() > 0 {
+    secs, err := strconv.ParseFloat(options[BENCH_DURATION].Last().Arg, 64)
+    if err != nil || secs <= 0 {
+      fmt.Fprintf(os.Stderr, "garçon bench: --duration: Expected positive number of seconds\n")
+      return 1
+    }
+    duration = time.Duration(secs*float64(time.Second))
+  }
+  
+  concurrency := 8
+  if options[BENCH_CONCURRENCY].Count() > 0 {
+    concurrency, err = strconv.Atoi(options[BENCH_CONCURRENCY].Last().Arg)
+    if err != nil || concurrency < 1 {
+      fmt.Fprintf(os.Stderr, "garçon bench: --concurrency: Expected positive number\n")
+      return 1
+    }
+  }
+  
+  selected := workloads
+  if options[BENCH_WORKLOAD].Count() > 0 {
+    selected = nil
+    for _, name := range allArgs(options[BENCH_WORKLOAD]) {
+      found := false
+      for _, w := range workloads {
+        if w.name == name {
+          selected = append(selected, w)
+          found = true
+        }
+      }
+      if !found {
+        fmt.Fprintf(os.Stderr, "garçon bench: Unknown workload: %v\n", name)
+        return 1
+      }
+    }
+  }
+  
+  // The read paths to compare. "" is the standard one.
+  paths := []string{""}
+  if options[BENCH_IO_URING].Count() > 0 {
+    if !fs.IOUringSupported {
+      fmt.Fprintf(os.Stderr, "garçon bench: --io-uring: This binary has been built without io_uring support\n")
+      return 1
+    }
+    paths = append(paths, "io_uring")
+  }
+  
+  dir := ""
+  if options[BENCH_DIR].Count() > 0 {
+    dir = options[BENCH_DIR].Last().Arg
+    err = os.Mkdir(dir, 0755)
+  } else {
+    dir, err = ioutil.TempDir("", "garcon-bench")
+    if err == nil { defer os.RemoveAll(dir) }
+  }
+  if err == nil { err = benchTree(dir) }
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "garçon bench: %v\n", err)
+    return 1
+  }
+  
+  // Logging each request would measure the logger.
+  util.LogLevel = -1
+  fm, err := fs.NewFileManager(dir, DefaultHandling)
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "garçon bench: %v\n", err)
+    return 1
+  }
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "garçon bench: %v\n", err)
+    return 1
+  }
+  defer listener.Close()
+  go http.Serve(listener, fm)
+  base := "http://" + listener.Addr().String()
+  
+  client := &http.Client{Transport:&http.Transport{MaxIdleConnsPerHost:concurrency, DisableCompression:true}}
+  
+  fmt.Fprintf(os.Stdout, "%-10v %-8v %10v %10v %10v %10v %12v %8v\n", "workload", "read", "req/s", "MiB/s", "p50", "p99", "allocs/req", "errors")
+  failed := false
+  for _, w := range selected {
+    for _, p := range paths {
+      // Files are opened per request, so this takes effect with the next one.
+      fs.UseIOUring = p == "io_uring"
+      if p == "" { p = "standard" }
+      res := runWorkload(w, client, base, concurrency, duration)
+      sort.Slice(res.latencies, func(i, j int) bool { return res.latencies[i] < res.latencies[j] })
+      secs := res.elapsed.Seconds()
+      allocs := uint64(0)
+      if res.requests > 0 { allocs = res.mallocs / uint64(res.requests) }
+      fmt.Fprintf(os.Stdout, "%-10v %-8v %10.0f %10.1f %10v %10v %12v %8v\n", w.name, p, float64(res.requests)/secs, float64(res.bytes)/secs/(1 << 20), percentile(res.latencies, 50), percentile(res.latencies, 99), allocs, res.errors)
+      failed = failed || res.errors > 0
+    }
+  }
+  fs.UseIOUring = false
+  if failed { return 1 }
+  return 0
+}
+
+/*
+  Sends the requests of w to the server at base with concurrency clients
+  until duration has passed.
+*/
+func runWorkload(w workload, client *http.Client, base string, concurrency int, duration time.Duration) *benchResult {
+  res := &benchResult{}
+  var mutex sync.Mutex
+  var wg sync.WaitGroup
+  
+  // A short warm-up fills the caches, so that all workloads start alike.
+  warmup := benchWorker(w, client, base, rand.New(rand.NewSource(0)), time.Now().Add(duration/10))
+  res.errors += warmup.errors
+  
+  runtime.GC()
+  var before, after runtime.MemStats
+  runtime.ReadMemStats(&before)
+  start := time.Now()
+  end := start.Add(duration)
+  for i := 0; i < concurrency; i++ {
+    wg.Add(1)
+    go func(seed int64) {
+      defer wg.Done()
+      r := benchWorker(w, client, base, rand.New(rand.NewSource(seed)), end)
+      mutex.Lock()
+      res.requests += r.requests
+      res.errors += r.errors
+      res.bytes += r.bytes
+      res.latencies = append(res.latencies, r.latencies...)
+      mutex.Unlock()
+    }(int64(i + 1))
+  }
+  wg.Wait()
+  res.elapsed = time.Since(start)
+  runtime.ReadMemStats(&after)
+  res.mallocs = after.Mallocs - before.Mallocs
+  return res
+}
+
+// Sends the requests of w one after the other until end.
+func benchWorker(w workload, client *http.Client, base string, rnd *rand.Rand, end time.Time) *benchResult {
+  res := &benchResult{}
+  for time.Now().Before(end) {
+    req := w.request(base, rnd)
+    start := time.Now()
+    resp, err := client.Do(req)
+    var n int64
+    if err == nil {
+      n, err = io.Copy(ioutil.Discard, resp.Body)
+      resp.Body.Close()
+      if err == nil && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+        err = fmt.Errorf("%v %v", resp.Status, req.URL.Path)
+      }
+    }
+    res.latencies = append(res.latencies, time.Since(start))
+    res.requests++
+    res.bytes += n
+    if err != nil {
+      if res.errors == 0 { fmt.Fprintf(os.Stderr, "garçon bench %v: %v\n", w.name, err) }
+      res.errors++
+    }
+  }
+  return res
+}
+
+// Returns the p-th percentile of sorted.
+func percentile(sorted []time.Duration, p int) time.Duration {
+  if len(sorted) == 0 { return 0 }
+  i := (len(sorted)*p + 99)/100 - 1
+  if i < 0 { i = 0 }
+  return sorted[i].Round(time.Microsecond)
+}
+
+/*
+  Creates the synthetic tree for the workloads in dir and sets benchMetadata
+  and benchGzip. The contents are pseudo-random but the same for each run.
+*/
+func benchTree(dir string) error {
+  rnd := rand.New(rand.NewSource(1))
+  benchMetadata = nil
+  benchGzip = nil
+  
+  // A Debian-like repository with many small metadata files.
+  for _, suite := range []string{"stable", "testing", "unstable"} {
+    for _, comp := range []string{"main", "contrib", "non-free"} {
+      for _, arch := range []string{"amd64", "arm64", "i386", "all"} {
+        sub := filepath.Join("dists", suite, comp, "binary-" + arch)
+        for _, name := range []string{"Packages", "Release"} {
+          size := 512 + rnd.Intn(8192)
+          if err := writeBenchFile(dir, filepath.Join(sub, name), benchText(rnd, size)); err != nil { return err }
+          benchMetadata = append(benchMetadata, "/" + filepath.ToSlash(filepath.Join(sub, name)))
+        }
+        benchMetadata = append(benchMetadata, "/" + filepath.ToSlash(sub) + "/")
+      }
+    }
+    benchMetadata = append(benchMetadata, "/dists/" + suite + "/")
+  }
+  
+  big := make([]byte, benchBigSize)
+  rnd.Read(big)
+  if err := writeBenchFile(dir, benchBig[1:], big); err != nil { return err }
+  
+  for i := 0; i < 50; i++ {
+    var buf bytes.Buffer
+    gz := gzip.NewWriter(&buf)
+    gz.Write(benchText(rnd, 64 << 10 + rnd.Intn(64 << 10)))
+    gz.Close()
+    name := fmt.Sprintf("doc/file%02d.txt", i)
+    if err := writeBenchFile(dir, name + ".gz", buf.Bytes()); err != nil { return err }
+    benchGzip = append(benchGzip, "/" + name)
+  }
+  return nil
+}
+
+// Returns size bytes of compressible text.
+func benchText(rnd *rand.Rand, size int) []byte {
+  words := []string{"Package:", "Version:", "Depends:", "libc6", "amd64", "Filename:", "pool/main/", "SHA256:", "Description:", "garcon", "\n"}
+  var buf bytes.Buffer
+  for buf.Len() < size {
+    buf.WriteString(words[rnd.Intn(len(words))])
+    buf.WriteByte(' ')
+  }
+  return buf.Bytes()[0:size]
+}
+
+// Writes data to the file name (slash-separated, relative to dir).
+func writeBenchFile(dir, name string, data []byte) error {
+  p := filepath.Join(dir, filepath.FromSlash(name))
+  if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil { return err }
+  return ioutil.WriteFile(p, data, 0644)
+}
@@ -17,18 +17,36 @@ package main
 
 import (
          "os"
+         "path"
+         "io/ioutil"
          "fmt"
          "net"
          "net/http"
          "time"
          "regexp"
          "strconv"
+         "strings"
          "syscall"
+         "os/signal"
          "github.com/mbenkmann/golib/argv"
          "github.com/mbenkmann/golib/util"
          
          "../linux"
          "../fs"
+         "../status"
+         "../schedule"
+         "../filter"
+         "../geoip"
+         "../auth"
+         "../pgp"
+         "../tracing"
+         "../logtail"
+         "../privacy"
+         "../accesslog"
+         "../notify"
+         "../tlscert"
+         "../shadow"
+         "../http2"
 )
 
 const QUICKSTART = `Quickstart instructions:
@@ -57,6 +75,109 @@ const (
   CHROOT
   HTTP
   VERBOSE
+  FADVISE
+  CACHE_SIZE
+  CACHE_MAX_FILE
+  PRELOAD
+  MEMORY_BUDGET
+  SPILL_DIR
+  IO_URING
+  ALIAS_CONFLICT
+  STATUS
+  SPA_FALLBACK
+  IMMUTABLE
+  INDEX_LANGUAGE
+  MARKDOWN
+  SOURCE_VIEW
+  SOURCE_PREFIX
+  DOWNLOAD_PAGE
+  MIRROR
+  BLOCK_USER_AGENT
+  BLOCK_PATH
+  MAX_URL_LENGTH
+  BLOCK_TRAVERSAL
+  GEOIP_DB
+  GEOIP_BLOCK
+  GEOIP_LIMIT
+  RATE_CLASS
+  RATE_CLASS_MATCH
+  UPLOAD
+  UPLOAD_UID
+  UPLOAD_GID
+  UPLOAD_UMASK
+  AUTH_GRANT
+  OIDC_ISSUER
+  OIDC_CLIENT_ID
+  OIDC_CLIENT_SECRET_FILE
+  OIDC_REDIRECT_URL
+  OIDC_SCOPES
+  OIDC_USERNAME_CLAIM
+  OIDC_GROUPS_CLAIM
+  PAM_SERVICE
+  SESSION_LIFETIME
+  SESSION_KEY_FILE
+  USER_HOME
+  TOTP_FILE
+  TOTP_NEW
+  RPM_REPO
+  RPM_SIGNING_KEY
+  ARCH_REPO
+  ARCH_SIGNING_KEY
+  PYPI_REPO
+  MAVEN_REPO
+  OCI_REGISTRY
+  PROXY
+  APT_PROXY
+  UPLOAD_VALIDATOR
+  TOKEN_FILE
+  TOKEN_NEW
+  ADMIN_API
+  OTLP_ENDPOINT
+  TRACE_SAMPLE
+  ANONYMIZE_IP
+  SCRUB_USER_AGENT
+  SHADOW_URL
+  SHADOW_SAMPLE
+  CANARY_INDEX
+  STATE_FILE
+  TRASH_RETENTION
+  URL_SIGNING_KEY_FILE
+  URL_TOKEN_STORE
+  PASSWORD_HASH
+  ASSETS_DIR
+  REFRESH_DEADLINE
+  ALERT_WEBHOOK
+  CACHE_SKIP_SPARSE
+  MAX_RANGES
+  UPLOAD_LIMIT
+  MAX_UPLOADS
+  APT_SELECT
+  APT_ESTIMATE
+  MIRROR_STATUS
+  TREE_DIFF
+  PUBLISH_DIR
+  SCHEDULE
+  RESPONSE_LIMIT
+  LOG_TAIL
+  SCAN_INTERVALS
+  READ_ONLY_IMAGE
+  HANDLER
+  REDIRECTS
+  LOG_EXCLUDE
+  LOG_SAMPLE
+  HTTPS
+  TLS_CERT
+  FORCE
+  MULTIPART_EXPIRY
+  SMTP_SERVER
+  SMTP_AUTH_FILE
+  NOTIFY
+  NOTIFY_FROM
+  NOTIFY_TEMPLATES
+  NOTIFY_SLACK
+  NOTIFY_MATRIX
+  MATRIX_TOKEN_FILE
+  UNPACK_LIMIT
 )
 
 const DISABLED = 0
@@ -68,6 +189,10 @@ var usage = argv.Usage{
 
 SYNOPSIS
     garçon [OPTIONS] --directory=serverroot
+    garçon remote --server=URL [--token=token] command [args]
+    garçon bench [--duration=seconds] [--concurrency=N] [--workload=name...]
+    garçon import-reprepro --directory=serverroot basedir[:/prefix]...
+    garçon import-aptly --directory=serverroot rootdir[:/prefix]...
 
 OPTIONS
     Long options can be written as "-directory foo", "-directory=foo",
@@ -78,10 +203,113 @@ OPTIONS
 { HELP,1,  "","help",     argv.ArgNone,       "    --help \tPrint usage and exit.\n" },
 { ROOT,1, "d","directory",argv.ArgRequired,   "    -d dir, --directory=dir \tRoot of the directory tree to serve. Garçon will chroot into this directory by default.\n" },
 { HTTP,1, "","http-port" ,argv.ArgInt,        "    --http-port=number \tPort to listen on for HTTP connections. Default is 80.\n" },
+{ HTTPS,1, "","https-port",argv.ArgInt,       "    --https-port=number \tPort to listen on for HTTPS connections. Default is 443 if --tls-certificate is given.\n" },
+{ TLS_CERT,1,"","tls-certificate",argv.ArgRequired, "    --tls-certificate=cert.pem[:key.pem] \tServe HTTPS (see --https-port) with the certificate from cert.pem (followed by the intermediate certificates) and the private key from key.pem (or cert.pem if not given). Can be used multiple times for several host names; the client's server name (SNI) selects the certificate. The files are read before chroot, so Garçon must be restarted to pick up a renewed certificate. The expiry is exported in the metrics (garcon_tls_certificate_expiry_timestamp_seconds) and shown on the --enable-status page, and a warning is logged every 12 hours within 14 days of the expiry. Garçon refuses to start with an expired certificate unless --force is given.\n" },
+{ FORCE,1, "","force",argv.ArgNone,          "    --force \tStart even if a --tls-certificate has expired.\n" },
 { UID,1,  "u","uid",      argv.ArgRequired,   "    -u uid, --uid=uid \tUID the Garçon process should run as. Defaults to the owner of the server root set with --directory.\n" },
 { GID,1,  "g","gid",      argv.ArgRequired,   "    -g gid, --gid=gid \tGID the Garçon process should run as. Defaults to the group of the server root set with --directory.\n" },
 { CHROOT,ENABLED,  "" ,"enable-chroot", argv.ArgNone,   "    --enable-chroot \tMakes Garçon chroot into the server root set with --directory. This is the default, but this switch can be used to undo the effect of a --disable-chroot earlier on the command line.\n" },
 { CHROOT,DISABLED,  "","disable-chroot",argv.ArgNone,   "    --disable-chroot \tDisables the default behaviour of chrooting into the server root set with --directory. This will allow symlinks to point outside of the server root. This is a security risk.\n" },
+{ FADVISE,1,"","fadvise-threshold",argv.ArgInt, "    --fadvise-threshold=bytes \tFiles of at least this size are read with POSIX_FADV_SEQUENTIAL and dropped from the page cache when no download of them is running any more, so that large downloads do not evict everything else. 0 disables this. Default is 268435456 (256 MiB).\n" },
+{ CACHE_SIZE,1,"","cache-size",argv.ArgInt, "    --cache-size=bytes \tMaximum number of bytes of file data to keep in memory. 0 disables the cache. Default is 33554432 (32 MiB).\n" },
+{ CACHE_MAX_FILE,1,"","cache-max-file",argv.ArgInt, "    --cache-max-file=bytes \tFiles larger than this are never cached. Default is 1048576 (1 MiB).\n" },
+{ CACHE_SKIP_SPARSE,1,"","cache-skip-sparse",argv.ArgNone, "    --cache-skip-sparse \tNever load sparse files (files with holes, which occupy fewer disk blocks than their size, or files compressed by the filesystem) into the cache. They are still served with their full size.\n" },
+{ PRELOAD,1,"","preload",argv.ArgRequired, "    --preload=regex \tRight after the initial scan, load all files whose path (starting with \"/\") matches regex and which are not larger than --cache-max-file into the cache. E.g. --preload=^/dists/ makes sure the first apt-get update after a restart is served from memory.\n" },
+{ MEMORY_BUDGET,1,"","memory-budget",argv.ArgInt, "    --memory-budget=bytes \tMaximum number of bytes of file data (generated files and cache) to keep in memory. If exceeded, the cache is shrunk and, if that is not enough, generated files are spilled to --spill-dir, which is therefore required. 0 means unlimited, which is the default.\n" },
+{ SPILL_DIR,1,"","spill-dir",argv.ArgRequired, "    --spill-dir=dir \tDirectory (after chroot) to which generated files are written if they exceed --memory-budget. Required by --memory-budget.\n" },
+{ IO_URING,1,"","io-uring",argv.ArgNone, "    --io-uring \tEXPERIMENTAL: Read files via io_uring. Only available if Garçon has been built with \"-tags iouring\". \"garçon bench --io-uring\" compares it with the standard read path.\n" },
+{ ALIAS_CONFLICT,1,"","alias-conflict",argv.ArgRequired, "    --alias-conflict=policy \tWhat to do if a real file has the same name as an alias for a compressed file (e.g. foo.html and foo.html.gz). \"prefer-file\" (the default) serves the real file, \"prefer-alias\" serves the alias, \"mtime-newest-wins\" serves whichever is newer and \"error\" serves neither and logs an error. Conflicts are listed on the status page.\n" },
+{ STATUS,1,"","enable-status",argv.ArgNone, "    --enable-status \tServe a plain text status page at /.garcon/status and metrics in Prometheus format at /.garcon/metrics. Requests are counted by the family and version of the client (apt, pacman, pip, browsers, curl, download managers,...) and the TLS version, to help decide when old clients and old TLS versions need no longer be supported.\n" },
+{ SPA_FALLBACK,1,"","spa-fallback",argv.ArgRequired, "    --spa-fallback=/prefix \tRequests below /prefix for files that do not exist are answered with /prefix/index.html and status 200 instead of a 404 error. This is what single page applications with client-side routing need. Can be used multiple times. Paths outside of the given prefixes keep the strict 404 behaviour.\n" },
+{ IMMUTABLE,1,"","immutable",argv.ArgRequired, "    --immutable=regex \tFiles whose path (starting with \"/\") matches regex have content-hashed names and are served with \"Cache-Control: public, max-age=31536000, immutable\". E.g. --immutable='\\.[0-9a-f]{8,}\\.(js|css|png)$'\n" },
+{ INDEX_LANGUAGE,1,"","index-language",argv.ArgRequired, "    --index-language=lang \tUse language lang (one of "+strings.Join(fs.Languages(), ", ")+") for generated index pages. If not set, the language is chosen based on the client's Accept-Language header.\n" },
+{ MARKDOWN,1,"","render-markdown",argv.ArgNone, "    --render-markdown \tServe .md files rendered as HTML. The unrendered file is available by appending ?raw=1 to the URL.\n" },
+{ SOURCE_VIEW,1,"","source-view",argv.ArgNone, "    --source-view \tAppending ?view=source to the URL of a text or source file shows it as syntax-highlighted HTML with line numbers.\n" },
+{ SOURCE_PREFIX,1,"","source-view-prefix",argv.ArgRequired, "    --source-view-prefix=/prefix \tText and source files below /prefix are shown as with ?view=source by default. Append ?raw=1 to the URL to get the unrendered file. Implies --source-view. Can be used multiple times.\n" },
+{ DOWNLOAD_PAGE,1,"","download-page",argv.ArgRequired, "    --download-page=regex \tRequests for files whose path (starting with \"/\") matches regex are answered with a landing page that shows size, SHA-256, links to signatures (e.g. file.asc) and mirror URLs. The file itself is available by appending ?raw=1 to the URL. E.g. --download-page='\\.iso$'\n" },
+{ MIRROR,1,"","mirror",argv.ArgRequired, "    --mirror=URL \tBase URL of a mirror to list on download pages (see --download-page). Can be used multiple times.\n" },
+{ BLOCK_USER_AGENT,1,"","block-user-agent",argv.ArgRequired, "    --block-user-agent=regex \tRequests whose User-Agent matches regex are rejected with 403 Forbidden. Can be used multiple times.\n" },
+{ BLOCK_PATH,1,"","block-path",argv.ArgRequired, "    --block-path=regex \tRequests whose path matches regex are rejected with 403 Forbidden, e.g. --block-path='^/(wp-admin|wp-login\\.php|phpmyadmin)'. Can be used multiple times.\n" },
+{ MAX_URL_LENGTH,1,"","max-url-length",argv.ArgInt, "    --max-url-length=n \tRequests with URLs longer than n bytes are rejected with 414 URI Too Long.\n" },
+{ BLOCK_TRAVERSAL,1,"","block-encoded-traversal",argv.ArgNone, "    --block-encoded-traversal \tRequests whose URL contains \"..\" segments or percent-encoded traversal sequences (%2e%2e, %2f, %5c, %00, double encoding) are rejected with 400 Bad Request.\n" },
+{ GEOIP_DB,1,"","geoip-db",argv.ArgRequired, "    --geoip-db=file \tMaxMind DB file (e.g. GeoLite2-Country.mmdb or GeoLite2-ASN.mmdb) used to log each request's client with country and AS and to apply --geoip-block and --geoip-rate-limit. The file is read before chroot. Can be used multiple times.\n" },
+{ GEOIP_BLOCK,1,"","geoip-block",argv.ArgRequired, "    --geoip-block=list \tComma-separated list of country codes and AS numbers (e.g. CN,AS4134) whose clients may not make write requests (uploads). Can be used multiple times.\n" },
+{ GEOIP_LIMIT,1,"","geoip-rate-limit",argv.ArgRequired, "    --geoip-rate-limit=key:n \tEach client address from country or AS key (e.g. RU or AS12389) may make at most n write requests (uploads) per minute. Can be used multiple times.\n" },
+{ RATE_CLASS,1,"","rate-class",argv.ArgRequired, "    --rate-class=name:bandwidth[:concurrency] \tAll downloads of files in rate class name together are limited to bandwidth bytes per second (0 means unlimited) and at most concurrency of them may run at the same time. Further requests get 503 Service Unavailable. Files not assigned to a class with --rate-class-match are in the class \"default\". Can be used multiple times.\n" },
+{ RATE_CLASS_MATCH,1,"","rate-class-match",argv.ArgRequired, "    --rate-class-match=name:regex \tFiles whose name matches regex are in rate class name. The first matching rule wins. E.g. --rate-class=iso:10000000:4 --rate-class-match='iso:\\.iso$' makes all ISO downloads share 10 MB/s and 4 connections while metadata is served without limits. Can be used multiple times.\n" },
+{ UPLOAD,1,"","upload",argv.ArgRequired, "    --upload=/prefix \tAllow uploading files below /prefix with PUT requests. The directory must exist. Existing files are replaced. \"If-None-Match: *\" prevents replacing an existing file and \"If-Match: ETag\" only replaces that version of the file. If the disk is full, the upload is rejected with 507 Insufficient Storage. The file's mtime can be set with the request header \""+fs.MtimeHeader+": seconds since epoch\" or \"Last-Modified: HTTP date\". Directories are created with MKCOL or \"PUT /prefix/dir?mkdir\". \"PUT /prefix/dir?unpack\" unpacks the zip or (compressed) tar archive in the request body into dir. Large files can be uploaded in parts that are sent in parallel and retried individually: \"POST /prefix/file?uploads\" answers {\"uploadId\":\"id\"}, \"PUT /prefix/file?uploadId=id&partNumber=n\" uploads part n (1 to "+fmt.Sprint(fs.MultipartMaxParts)+"), \"GET /prefix/file?uploadId=id\" lists the parts received, \"POST /prefix/file?uploadId=id\" joins the parts into the file (like a PUT of the whole file) and \"DELETE /prefix/file?uploadId=id\" aborts the upload. Can be used multiple times.\n" },
+{ UPLOAD_UID,1,"","upload-uid",argv.ArgRequired, "    --upload-uid=uid \tChange the owner of uploaded files to uid. Requires that Garçon runs with CAP_CHOWN.\n" },
+{ UPLOAD_GID,1,"","upload-gid",argv.ArgRequired, "    --upload-gid=gid \tChange the group of uploaded files to gid. Without CAP_CHOWN this must be one of the groups of the process's UID.\n" },
+{ UPLOAD_UMASK,1,"","upload-umask",argv.ArgRequired, "    --upload-umask=octal \tPermissions of uploaded files are 0666 (directories 0777) minus the bits in this mask. Default is 022.\n" },
+{ UPLOAD_LIMIT,1,"","upload-limit",argv.ArgRequired, "    --upload-limit=bandwidth[:concurrency] \tAll uploads (PUT and MKCOL requests) of the same user (or, for anonymous uploads, the same client address) together may read at most bandwidth bytes per second from the request bodies (0 means unlimited) and at most concurrency of them may run at the same time. Further uploads of the user get 429 Too Many Requests. This way a misbehaving CI job cannot use up the bandwidth needed for downloads.\n" },
+{ MULTIPART_EXPIRY,1,"","multipart-expiry",argv.ArgRequired, "    --multipart-expiry=duration \tDelete the parts of multipart uploads (see --upload) that have received no part for duration (default "+fs.MultipartExpiry.String()+"). They are deleted when the next multipart upload to the same directory starts.\n" },
+{ UNPACK_LIMIT,1,"","unpack-limit",argv.ArgInt, "    --unpack-limit=bytes \tMaximum total size of the files unpacked from an archive uploaded with \"PUT /prefix/dir?unpack\" (see --upload). Unpacking stops as soon as it is exceeded and the upload is rejected with 413 Request Entity Too Large, so that a small archive that unpacks to huge files cannot fill the disk. Archives unpacked into a --user-home with a quota are limited by the quota instead if that is smaller. 0 means unlimited. Default is "+fmt.Sprint(fs.UnpackLimit)+".\n" },
+{ MAX_UPLOADS,1,"","max-uploads",argv.ArgInt, "    --max-uploads=n \tAt most n uploads of all users together may run at the same time. Further uploads get 503 Service Unavailable.\n" },
+{ AUTH_GRANT,1,"","auth-grant",argv.ArgRequired, "    --auth-grant=/prefix:perm:who \tOnly logged in users selected by who may access paths below /prefix. perm is \"r\" (GET and HEAD), \"w\" (uploads) or \"rw\". who is \"*\" (all logged in users), \"user:name\", \"group:name\" or \"claim=value\" (users whose login has that claim, e.g. email=alice@example.com). A path is accessible if any grant for it allows the access. Paths not covered by any grant need no login. E.g. --auth-grant=/internal:r:group:staff --auth-grant=/internal/incoming:rw:group:release-managers. Use /.garcon as prefix to protect the status page. Can be used multiple times.\n" },
+{ OIDC_ISSUER,1,"","oidc-issuer",argv.ArgRequired, "    --oidc-issuer=URL \tLog in users via this OpenID Connect provider (e.g. https://sso.example.com/realms/main). Browsers that request a protected page without being logged in are sent to the provider's login page. Requires --oidc-client-id, --oidc-client-secret-file and --oidc-redirect-url. The provider is contacted before chroot.\n" },
+{ OIDC_CLIENT_ID,1,"","oidc-client-id",argv.ArgRequired, "    --oidc-client-id=id \tThe client ID under which Garçon is registered with the --oidc-issuer.\n" },
+{ OIDC_CLIENT_SECRET_FILE,1,"","oidc-client-secret-file",argv.ArgRequired, "    --oidc-client-secret-file=file \tFile (read before chroot) that contains the client secret for --oidc-client-id.\n" },
+{ OIDC_REDIRECT_URL,1,"","oidc-redirect-url",argv.ArgRequired, "    --oidc-redirect-url=URL \tThe redirect URL registered with the --oidc-issuer. Its path must be "+auth.AuthPath+"callback, e.g. https://files.example.com"+auth.AuthPath+"callback. Logging out is done via "+auth.AuthPath+"logout.\n" },
+{ OIDC_SCOPES,1,"","oidc-scopes",argv.ArgRequired, "    --oidc-scopes=list \tComma-separated scopes to request in addition to \"openid\". Default is \"profile,email,groups\".\n" },
+{ OIDC_USERNAME_CLAIM,1,"","oidc-username-claim",argv.ArgRequired, "    --oidc-username-claim=claim \tThe ID token claim that contains the user name for user:name in --auth-grant. Default is \"preferred_username\". If a token lacks it, \"sub\" is used.\n" },
+{ OIDC_GROUPS_CLAIM,1,"","oidc-groups-claim",argv.ArgRequired, "    --oidc-groups-claim=claim \tThe ID token claim that lists the groups for group:name in --auth-grant. Default is \"groups\".\n" },
+{ PAM_SERVICE,1,"","pam-service",argv.ArgRequired, "    --pam-service=service \tUsers can log in with HTTP Basic authentication using their accounts on the host, which are checked by the PAM service (e.g. \"login\" or a dedicated /etc/pam.d/garcon). A user's groups are those of the host account. Passwords are checked by helper processes (a few at a time) that are started by a supervisor process, which is started before chroot and keeps the privileges Garçon was started with (usually root, which is needed to check other users' passwords). A helper that crashes or does not answer within 30 seconds is replaced. After 5 failed logins of a user or 20 from a client address within 15 minutes, further attempts are rejected until the 15 minutes have passed. Basic authentication sends the password with each request, so only use this with HTTPS. Only available if Garçon has been built with \"-tags pam\".\n" },
+{ SESSION_LIFETIME,1,"","session-lifetime",argv.ArgRequired, "    --session-lifetime=duration \tHow long a login via --oidc-issuer lasts, e.g. 30m or 12h. Default is 8h.\n" },
+{ SESSION_KEY_FILE,1,"","session-key-file",argv.ArgRequired, "    --session-key-file=file \tFile (read before chroot) with at least 32 random bytes that sign the session cookies. Without it, a new key is generated at each start, which logs out all users. Write requests of logged in users must carry the CSRF token from "+auth.AuthPath+"session in the "+auth.CSRFHeader+" header and are rejected if the browser reports that they come from another site.\n" },
+{ USER_HOME,1,"","user-home",argv.ArgRequired, "    --user-home=/prefix[:quota] \tEach logged in user (see --oidc-issuer and --pam-service) may upload files below /prefix/<user name>/, which is created on the first upload, and only that user may access it (--auth-grant can give others access, e.g. --auth-grant=/prefix:r:group:admins). If quota is given, the files in each user's directory, including the parts of unfinished multipart uploads, may have at most quota bytes. Uploads that would exceed it are rejected with 507 Insufficient Storage. The rest of the tree stays read-only for the users unless --upload allows more. Can be used multiple times.\n" },
+{ TOTP_FILE,1,"","totp-file",argv.ArgRequired, "    --totp-file=file \tFile (read before chroot) with the secrets of users who need a second factor (a code from an authenticator app) for write requests, such as uploads, deletions and repository operations. After logging in, these users confirm a code at "+auth.AuthPath+"totp, which lasts for 15 minutes. Each user also has recovery codes for when the authenticator app is lost. Each recovery code works once, but is usable again after a restart unless its line in the file is updated. Wrong codes are rate-limited per user. See --totp-new.\n" },
+{ TOTP_NEW,1,"","totp-new",argv.ArgRequired, "    --totp-new=user \tPrint a new line for --totp-file with a secret and recovery codes for user, the otpauth:// URI to enter into the authenticator app and the recovery codes to give to the user, then exit.\n" },
+{ RPM_REPO,1,"","rpm-repo",argv.ArgRequired, "    --rpm-repo=/prefix \tMaintain repodata/ (primary.xml.gz, filelists.xml.gz and repomd.xml) in the directory /prefix for the .rpm files in it and its subdirectories, so that yum and dnf can use /prefix as baseurl. The metadata is regenerated whenever packages are added (e.g. uploaded with --upload), replaced or removed. Can be used multiple times.\n" },
+{ RPM_SIGNING_KEY,1,"","rpm-signing-key",argv.ArgRequired, "    --rpm-signing-key=key[:from[:until]] \tSign repodata/repomd.xml of each --rpm-repo (repomd.xml.asc, for repo_gpgcheck=1) with an OpenPGP key. RSA and Ed25519 keys are supported. key is one of: A file (read before chroot) with a secret key without passphrase exported with \"gpg --export-secret-keys --armor KEYID\". \"gpg:KEYID\" to sign with \"gpg --detach-sign\", so that the secret key stays with gpg-agent or on a smartcard. \"exec:pubfile:command\" to sign with command (e.g. pkcs11-tool for a PKCS#11 token), which gets the DigestInfo (RSA) or SHA-256 hash (Ed25519) to sign on stdin and writes the raw signature to stdout. \"remote:pubfile:URL\" to POST the same data to a signing service, which answers with the raw signature. pubfile is the public key exported with \"gpg --export --armor KEYID\". gpg and command must be available after chroot. If the dates from and/or until (YYYY-MM-DD, UTC) are given, the key only signs from the start of the day from until the start of the day until. Can be used multiple times to rotate keys: All keys whose window includes the current time sign, and the public keys of all keys that have not reached their until date are served as repodata/repomd.xml.key for gpgkey=. Add the new key with a from date in the future so that clients can import it before it is used, and give the old key an until date after that.\n" },
+{ ARCH_REPO,1,"","arch-repo",argv.ArgRequired, "    --arch-repo=/prefix:name \tMaintain the pacman databases name.db and name.files (and the .tar.gz files they are copies of) in the directory /prefix for the Arch Linux packages (*.pkg.tar.zst, .xz, .gz) in it, so that pacman can use /prefix as Server of the repository [name]. If :name is omitted, the last component of /prefix is used. A package signature file.pkg.tar.zst.sig is included in the databases. They are regenerated whenever packages are added (e.g. uploaded with --upload), replaced or removed. Can be used multiple times.\n" },
+{ ARCH_SIGNING_KEY,1,"","arch-signing-key",argv.ArgRequired, "    --arch-signing-key=key[:from[:until]] \tSign the databases of each --arch-repo (name.db.sig and name.files.sig) with an OpenPGP key. The public keys are served as name.key. See --rpm-signing-key for the kinds of keys and key rotation.\n" },
+{ PYPI_REPO,1,"","pypi-repo",argv.ArgRequired, "    --pypi-repo=/prefix \tMaintain the PEP 503 index /prefix/simple/ for the Python wheels and sdists in the directory /prefix and its subdirectories, so that pip can use it with --index-url https://host/prefix/simple/. The core metadata of each wheel is extracted to file.whl.metadata (PEP 658). The index is regenerated whenever distributions are added (e.g. uploaded with --upload), replaced or removed. Can be used multiple times.\n" },
+{ MAVEN_REPO,1,"","maven-repo",argv.ArgRequired, "    --maven-repo=/prefix \tThe directory /prefix is a Maven repository (groupId/artifactId/version/...) that mvn deploy and Gradle can upload to with PUT requests like with --upload, except that missing directories are created. Use --auth-grant to restrict who may deploy. The maven-metadata.xml of each artifact (and of each SNAPSHOT version) and the .md5, .sha1, .sha256 and .sha512 files are regenerated whenever files are added, replaced or removed. Can be used multiple times.\n" },
+{ OCI_REGISTRY,1,"","oci-registry",argv.ArgRequired, "    --oci-registry=/prefix \tServe the OCI image layouts (directories with oci-layout, index.json and blobs/, e.g. created with \"skopeo copy docker://alpine oci:dir/alpine:latest\") below /prefix read-only under /v2/, so that \"docker pull host/alpine:latest\" and podman pull the image in /prefix/alpine. Tags are taken from the org.opencontainers.image.ref.name annotations in index.json.\n" },
+{ PROXY,1,"","proxy",argv.ArgRequired, "    --proxy=/prefix=URL \tMirror the HTTP(S) server URL below /prefix: Files that are requested for the first time are fetched from URL + the path below /prefix, stored in the directory /prefix and served from there until they expire according to the server's Cache-Control or Expires headers. Expired files are revalidated with If-None-Match/If-Modified-Since. The freshness information is kept in a hidden file .<name>.proxy next to each file. Responses with Cache-Control no-store or private are passed through without storing them. If the server is unreachable, expired files are served. The host name of URL is resolved before chroot. Can be used multiple times.\n" },
+{ APT_PROXY,1,"","apt-proxy",argv.ArgRequired, "    --apt-proxy=/prefix=URL \tLike --proxy, but for a Debian or Ubuntu mirror (e.g. http://deb.debian.org/debian), so that apt clients can use http://host/prefix as their mirror instead of an apt-cacher-ng: The metadata in dists/ is revalidated with the mirror on every request, while the files in pool/ and by-hash/ never change and are served from the cache forever. The mirror's Cache-Control headers are ignored for these. The hit rates are shown on the --status page. Can be used multiple times.\n" },
+{ APT_SELECT,1,"","apt-proxy-select",argv.ArgRequired, "    --apt-proxy-select=/prefix=suites:components:architectures[:source] \tOnly mirror the given parts of the --apt-proxy at /prefix, so that small hosts keep only what they need. Each of suites, components and architectures is a comma-separated list or * for all, e.g. --apt-proxy-select=/debian=bookworm,bookworm-updates:main:amd64. Packages for the architecture \"all\" are always included, source packages only with :source. Requests for other files get 404 without asking the mirror. Can be used once per --apt-proxy.\n" },
+{ APT_ESTIMATE,1,"","apt-proxy-estimate",argv.ArgNone, "    --apt-proxy-estimate \tFor each --apt-proxy-select, read the Release files and package indexes of the selected suites from the mirror, print how many files (and bytes) the selection would store if apt clients requested all of it, then exit.\n" },
+{ MIRROR_STATUS,1,"","mirror-status",argv.ArgNone, "    --mirror-status \tServe the health of each --proxy and --apt-proxy (when the mirror last answered, the last error, the number of errors, the bytes still being fetched and, for --apt-proxy, whether the cached Release files have passed their Valid-Until) as JSON at "+fs.MirrorStatusPath+" for mirror directors and monitoring. The status is 503 if no mirror is healthy. The same information is shown on the --status page and as metrics.\n" },
+{ UPLOAD_VALIDATOR,1,"","upload-validator",argv.ArgRequired, "    --upload-validator=policy:regex:command \tRun command (e.g. \"lintian --fail-on=error\") with the path of each uploaded file whose name matches regex appended, before the file is put in place. If the command exits with a status other than 0 and policy is \"reject\", the upload is rejected with 422 and the command's output. With \"warn\" the failure is only recorded. Results are logged together with the uploading user and shown on the file's --download-page. If Garçon runs in a chroot, the command must be available inside it. Validators are killed after 5 minutes. Can be used multiple times.\n" },
+{ TOKEN_FILE,1,"","token-file",argv.ArgRequired, "    --token-file=file \tFile (read before chroot) with API tokens for scripts, which send them in the header \"Authorization: Bearer <token>\". A token authenticates as the user and groups given in its line, so --auth-grant applies as for logged in users. Requests with a token need no second factor (--totp-file). See --token-new.\n" },
+{ TOKEN_NEW,1,"","token-new",argv.ArgRequired, "    --token-new=user[:group,...] \tPrint a new line for --token-file for user (with the given groups) and the token to give to the user, then exit. The file only contains a hash of the token.\n" },
+{ ADMIN_API,1,"","enable-admin-api",argv.ArgNone, "    --enable-admin-api \tServe the admin API at "+fs.AdminPath+" (JSON): GET stats[?path=/prefix] for tree statistics, POST rescan[?wait=1], POST regenerate to regenerate and re-sign the metadata of all repositories, POST snapshot?suite=/debian/dists/stable[&name=...] to copy a Debian suite's metadata to a new suite, POST promote?from=/debian/dists/testing&to=/debian/dists/stable to replace a suite's metadata with another's, and POST purge?path=/prefix to drop files from the cache and proxied copies, POST remove?path=/file to move a file to the trash (see --trash-retention), GET trash to list the files in the trash, POST restore?id=... to move a file from the trash back GET verify[?suite=...] to check suites against their Release files GET diff[?state=...] to list the files changed since the --state-file (or a copy of it next to it) was saved and POST publish?name=... (see --publish-dir). "+fs.AdminPath+" itself is a page for trying out the APIs described in "+fs.OpenAPIPath+", which is always served. Requires an --auth-grant that covers "+strings.TrimSuffix(fs.AdminPath, "/")+", e.g. --auth-grant="+strings.TrimSuffix(fs.AdminPath, "/")+":rw:group:release-managers together with --token-file.\n" },
+{ OTLP_ENDPOINT,1,"","otlp-endpoint",argv.ArgRequired, "    --otlp-endpoint=URL \tSend OpenTelemetry traces of the requests to the collector at URL via OTLP/HTTP (JSON), e.g. http://localhost:4318/v1/traces. Each request has spans for the tree lookup, the cache access, opening the file, sending it (which includes reading and decompressing it) and fetching from a --proxy upstream. Requests with a W3C traceparent header become part of the caller's trace (and are only traced if the caller's span is sampled). The host name is resolved before chroot.\n" },
+{ TRACE_SAMPLE,1,"","trace-sample",argv.ArgRequired, "    --trace-sample=fraction \tTrace only this fraction (0 to 1) of the requests without traceparent header. Default is 1.\n" },
+{ ANONYMIZE_IP,1,"","anonymize-ip",argv.ArgRequired, "    --anonymize-ip=truncate|hash \tLog client IP addresses (see --geoip-db) and export them in traces (see --otlp-endpoint) anonymized: \"truncate\" keeps only the network (/24 for IPv4, /48 for IPv6), \"hash\" replaces the address with a hash whose random key changes daily and is never stored, so a client can be followed for at most a day. Blocking and rate limits still use the full address.\n" },
+{ SCRUB_USER_AGENT,1,"","scrub-user-agent",argv.ArgNone, "    --scrub-user-agent \tLog User-Agent headers and export them in traces without the details of the client's system in parentheses and with only major versions, e.g. \"Mozilla/5 AppleWebKit/537 Chrome/120 Safari/537\".\n" },
+{ SHADOW_URL,1,"","shadow-url",argv.ArgRequired, "    --shadow-url=URL \tAfter answering a GET or HEAD request without credentials (Authorization header or cookies), replay it in the background against the server at URL (e.g. a staging instance with a new configuration), with URL's path prepended to the request's. The responses are discarded and only compared with the real ones by status code and size. Mismatches are logged and all results are counted in the metrics (garcon_shadow_requests_total). Requests are dropped if the replays cannot keep up. The host name is resolved before chroot.\n" },
+{ SHADOW_SAMPLE,1,"","shadow-sample",argv.ArgRequired, "    --shadow-sample=fraction \tReplay only this fraction (0 to 1) of the requests against --shadow-url. Default is 1.\n" },
+{ CANARY_INDEX,1,"","canary-index",argv.ArgRequired, "    --canary-index=file:percent \tServe generated index pages made from the template file (read before chroot, with the same <?garçon ...?> processing instructions as index.xhtml) instead of the built-in one to percent percent of the clients, to try out a new look on some users first. Directories with their own index.xhtml are not affected. A cookie keeps each client in its group for 30 days and the group (canary or control) is logged with each index page served.\n" },
+{ STATE_FILE,1,"","state-file",argv.ArgRequired, "    --state-file=file \tWhen Garçon is terminated with SIGTERM or SIGINT, save the scanned directory tree (names, sizes, mtimes, ETags, aliases) to file (after chroot), and at the next start load it from there instead of scanning the whole tree before serving. The loaded tree is checked against the filesystem by a rescan in the background, so changes made while Garçon was not running may take a while to become visible. The file is not used if --directory or the handling of files (e.g. aliases) has changed. Its directory must be writable after dropping privileges. Choose a name starting with \".\" so that it is not served.\n" },
+{ TREE_DIFF,1,"","tree-diff",argv.ArgRequired, "    --tree-diff=file \tScan --directory, compare it with file, a copy of the --state-file (e.g. made by a cron job every night), print the files that have been added, removed or changed since it was saved with their sizes, then exit. A relative file name is relative to --directory. Pass the same options that affect the handling of files (e.g. --rate-class-match) as to the Garçon that saved the file. The admin API's diff does the same for a copy next to the --state-file.\n" },
+{ PUBLISH_DIR,1,"","publish-dir",argv.ArgRequired, "    --publish-dir=dir \tEnable the admin API's POST publish?name=..., which makes Garçon serve the directory name in dir instead of the current tree (blue/green publishing): The new tree is scanned completely, then served all at once. The old tree stays on disk, so downloads in progress complete, and publishing it again switches back. dir is interpreted after chroot, so by default it must be inside --directory, e.g. --publish-dir=.releases, which is hidden. After a restart, --directory is served again. Requires --enable-admin-api.\n" },
+{ SCHEDULE,1,"","schedule",argv.ArgRequired, "    --schedule='when task [argument]' \tRun task regularly inside Garçon, so that no cron job (inside or outside the chroot) is needed. when is a cron expression with the 5 fields minute, hour, day of month, month and day of week (e.g. \"30 3 * * *\" for 3:30 every night, in local time), \"@every duration\" (e.g. \"@every 6h\") or one of @hourly, @daily, @weekly, @monthly and @yearly. task is one of: \"rescan\". \"regenerate\" the metadata of all --rpm-repo, --arch-repo, --pypi-repo and --maven-repo and sign it anew, e.g. before the signatures expire. \"snapshot /path/dists/suite\" to copy the suite like the admin API's snapshot. \"expire-trash\" to delete the files in the trash that are older than --trash-retention. \"sync /prefix\" to revalidate the expired files cached by the --proxy or --apt-proxy for /prefix with upstream. \"stats file\" to write the metrics (e.g. the cache statistics) in Prometheus format to file (after chroot). \"save-state\" to save the --state-file, so that it is recent even if Garçon is not terminated cleanly. Can be used multiple times. A job does not start again while it is still running. The jobs are shown on the --enable-status page with their last and next runs.\n" },
+{ RESPONSE_LIMIT,1,"","response-limit",argv.ArgRequired, "    --response-limit=duration:bytes:regex \tAbort the responses to requests whose path matches regex when they take longer than duration (e.g. 30s) or their body gets larger than bytes. 0 means unlimited. If nothing has been sent yet, the client gets 503 Service Unavailable (duration) or 500 Internal Server Error (bytes), otherwise the connection is closed. Each abort is logged and counted. Meant for generated responses, e.g. --response-limit='10s:50000000:/$' for directory listings, to protect the server from pathological outputs. Responses that match are not sent with sendfile(). The first matching rule applies. Can be used multiple times.\n" },
+{ LOG_TAIL,1,"","log-tail",argv.ArgInt, "    --log-tail=lines \tKeep the last lines lines of the log in memory and serve them at "+logtail.Path+"[?lines=N][&type=error|access][&follow=1], so that operators can debug without shell access to the (chrooted) host. type=error selects errors and warnings, type=access the lines logged for requests. With follow=1, the lines are sent as server-sent events (text/event-stream), followed by new lines as they are logged. Requires an --auth-grant that covers "+logtail.Path+", e.g. --auth-grant="+logtail.Path+":r:group:operators.\n" },
+{ SCAN_INTERVALS,1,"","scan-intervals",argv.ArgRequired, "    --scan-intervals=debounce:retry[:poll] \tHow often the tree is rescanned. Changes reported by inotify during debounce (default 5s) after a rescan are handled by one rescan after it. A failed rescan is retried after retry (default 30s). With poll, the tree is also rescanned when poll has passed since the last rescan without changes being reported, e.g. for NFS, where inotify does not see changes made by other hosts. E.g. --scan-intervals=10m:30m:24h for a huge mirror that is updated by rsync, --scan-intervals=1s:5s for a small docs tree.\n" },
+{ READ_ONLY_IMAGE,1,"","read-only-image",argv.ArgNone, "    --read-only-image \tThe --directory is a mounted read-only image (e.g. squashfs or erofs) whose contents never change, e.g. immutable release artifacts. It is scanned without inotify watches and only rescanned when requested (e.g. by the admin API or --schedule). The SHA-256 checksums of all files are computed in the background and files are served with \"Cache-Control: public, max-age=31536000, immutable\", so a file must never be replaced by another one under the same path.\n" },
+{ HANDLER,1,"","handler",argv.ArgRequired, "    --handler=/prefix=plugin[:argument] \tServe the URL subtree below /prefix with one of the handler plugins built into Garçon instead of the usual way, so that one instance can combine different behaviors by path. \"listing-only\" serves the directory listings but none of the files. \"upload-only\" accepts uploads (PUT and MKCOL like --upload) but serves nothing. \"proxy:URL\" is like --proxy=/prefix=URL. \"redirect-map:file\" redirects the paths below /prefix listed in file (read once, before chroot; see --redirects for the format) and serves all other paths as usual. The access policy (--auth-grant) applies as usual. Can be used multiple times with different prefixes.\n" },
+{ REDIRECTS,1,"","redirects",argv.ArgRequired, "    --redirects=file \tBefore looking up a requested path in the directory tree, check whether it is listed in file, a path below --directory (e.g. /.redirects, hidden so that it is not served itself), and if so redirect the client. This keeps published links working after the site has been restructured. file has a line \"/old/path new [code]\" for each moved path, where new is a path or URL and code one of 301 (the default), 302, 303, 307 and 308. If /old/path ends with \"/\", the whole directory has moved and the rest of the requested path is appended to new. The query of the request is passed on unless new has one. Empty lines and lines starting with # are ignored. file is read again after a rescan when it has changed. If it has errors, they are logged and the previous redirects remain in effect. Redirects are counted in garcon_redirects_total.\n" },
+{ LOG_EXCLUDE,1,"","log-exclude",argv.ArgRequired, "    --log-exclude=[host]/prefix \tDo not log the requests whose path starts with /prefix, e.g. --log-exclude=/.garcon/metrics for metrics scrapes or --log-exclude=/healthz for the health checks of a load balancer. If host is given, only requests for that host name (Host header) are affected, e.g. --log-exclude=mirror.example.com/. Server errors are logged nonetheless. Can be used multiple times. The rule with the longest prefix applies, and one with a host wins over one without. The requests left out are counted in garcon_access_log_suppressed_total.\n" },
+{ LOG_SAMPLE,1,"","log-sample",argv.ArgRequired, "    --log-sample=[host]/prefix:N \tLike --log-exclude but log 1 in N of the requests, e.g. --log-sample=/pool/:100 on a busy mirror.\n" },
+{ TRASH_RETENTION,1,"","trash-retention",argv.ArgRequired, "    --trash-retention=duration \tKeep files removed with the admin API in the hidden directory /"+fs.TrashDir+" for duration (e.g. 72h, default "+fs.TrashRetention.String()+"), during which they can be restored, before deleting them for good. 0 deletes them right away. Files on another filesystem than the server root can not be moved to the trash.\n" },
+{ URL_SIGNING_KEY_FILE,1,"","url-signing-key-file",argv.ArgRequired, "    --url-signing-key-file=file \tFile (read before chroot) with at least 32 random bytes that sign temporary download links. A logged in user (or a script with an API token) gets a link for a file the user may read with POST "+auth.AuthPath+"sign?path=/file[&lifetime=24h] (at most "+auth.SignedURLMaxLifetime.String()+"). Until it expires, anyone with the link can download the file without logging in. Links are bound to the path and can not be extended. Changing the key invalidates all links. Requires --auth-grant. See also garçon remote sign.\n" },
+{ URL_TOKEN_STORE,1,"","url-token-store",argv.ArgRequired, "    --url-token-store=file \tAllow single-use links (POST "+auth.AuthPath+"sign?path=/file&once=1), which can be used for one download (GET) only, e.g. to hand out licensed binaries or pre-release packages to specific recipients (add &for=recipient to log who uses the link). The used links are recorded in file, which is opened before chroot and keeps them used across restarts until they expire. Requires --url-signing-key-file.\n" },
+{ PASSWORD_HASH,1,"","password-hash",argv.ArgNone, "    --password-hash \tRead a password from stdin and print the directive <?garçon password=\"...\"?> with its hash for the index.xhtml (or index.html) of a directory, then exit. Everything below that directory can then only be accessed after entering the password in a form served in its place (for "+fs.UnlockLifetime.String()+" or until Garçon is restarted). In index.css use config[id=garçon] { password: \"...\" }. Protected directories are excluded from sitemaps and search.\n" },
+{ ASSETS_DIR,1,"","assets-dir",argv.ArgRequired, "    --assets-dir=dir \tReplace the built-in templates and icons with the files of the same name in dir (read before chroot), so that the generated pages can be rebranded: index.xhtml (generated index pages, see also --canary-index), icons.svg (the SVG sprite with the index icons), download.xhtml, markdown.xhtml, source.xhtml and unlock.xhtml (the pages for downloads, rendered Markdown, highlighted source and the password form of protected directories, which must contain <?garçon content?>). All other files in dir, such as stylesheets and logos used by the templates, are served as "+fs.AssetsPath+"name.\n" },
+{ REFRESH_DEADLINE,1,"","refresh-deadline",argv.ArgRequired, "    --refresh-deadline=duration \tLog an error (and call --alert-webhook) when the served tree has not been brought up to date with the filesystem for longer than duration (e.g. 15m), e.g. because rescans fail or hang. While Garçon waits for changes reported by inotify the tree counts as up to date. The watcher that rescans the tree is restarted if it crashes. With --status, the metrics garcon_watcher_healthy, garcon_tree_refresh_age_seconds and garcon_watcher_restarts_total report its state.\n" },
+{ ALERT_WEBHOOK,1,"","alert-webhook",argv.ArgRequired, "    --alert-webhook=URL \tPOST a JSON object {\"root\":...,\"healthy\":false,\"message\":...,\"refreshed\":...} to URL when the watcher crashes, the tree misses the --refresh-deadline or the root directory can not be read (e.g. unmounted NFS, disk failure), and the same with \"healthy\":true when it has recovered. While the root directory can not be read, directory listings and cached files are still served and other files are answered with 503. The host name is resolved before chroot.\n" },
+{ SMTP_SERVER,1,"","smtp-server",argv.ArgRequired, "    --smtp-server=host[:port] \tSend the email notifications selected with --notify via this SMTP server (default port 25; port 465 uses TLS, other ports STARTTLS if the server offers it). The host name is resolved before chroot.\n" },
+{ SMTP_AUTH_FILE,1,"","smtp-auth-file",argv.ArgRequired, "    --smtp-auth-file=file \tFile (read before chroot) whose first line is \"user:password\" for logging in to the --smtp-server. The password is only sent over TLS (or to localhost).\n" },
+{ NOTIFY,1,"","notify",argv.ArgRequired, "    --notify=event[,event...]:address[,address...] \tSend an email to the addresses via the --smtp-server when one of the events happens: \""+strings.Join(notify.Events, "\", \"")+"\" or \"all\". "+notify.PackageAccepted+": a package (.deb, .rpm, .whl, .jar, .pkg.tar.*) has been uploaded and has passed the --upload-validator checks. "+notify.PackageRejected+": an --upload-validator (e.g. a signature check of an incoming package) has rejected an upload. "+notify.RepoPublished+": another tree has been published (see --publish-dir) or a Debian suite has been promoted or snapshotted. "+notify.MirrorFailed+": fetching from the upstream of a --proxy or --apt-proxy has failed. "+notify.CertificateExpiry+": a --tls-certificate expires within 14 days or has expired. "+notify.QuotaExceeded+": an upload has exceeded the quota of a --home or the disk is full. "+notify.Alert+": the events of the --alert-webhook. Notifications about the same thing (e.g. the same mirror) are sent at most once per "+notify.Interval.String()+". See also --notify-slack and --notify-matrix. Can be used multiple times.\n" },
+{ NOTIFY_SLACK,1,"","notify-slack",argv.ArgRequired, "    --notify-slack=event[,event...]:URL \tPost a message to the Slack channel of the incoming webhook URL (https://hooks.slack.com/services/...) when one of the events (see --notify) happens. The host name is resolved before chroot. Can be used multiple times.\n" },
+{ NOTIFY_MATRIX,1,"","notify-matrix",argv.ArgRequired, "    --notify-matrix=event[,event...]:https://homeserver/!roomid:server \tPost a notice to the Matrix room with the internal id !roomid:server (see the room's advanced settings) on homeserver when one of the events (see --notify) happens. The account of the --matrix-token-file must have joined the room. The host name is resolved before chroot. Can be used multiple times.\n" },
+{ MATRIX_TOKEN_FILE,1,"","matrix-token-file",argv.ArgRequired, "    --matrix-token-file=file \tFile (read before chroot) with the access token of the Matrix account that posts the --notify-matrix messages.\n" },
+{ NOTIFY_FROM,1,"","notify-from",argv.ArgRequired, "    --notify-from=address \tThe sender of --notify emails (default garcon@ followed by the host name).\n" },
+{ NOTIFY_TEMPLATES,1,"","notify-templates",argv.ArgRequired, "    --notify-templates=dir \tDirectory (read before chroot) with templates event.tmpl (Go text/template) for the --notify emails of event, e.g. "+notify.PackageRejected+".tmpl. A template produces header lines (at least \"Subject: ...\"), an empty line and the body. It can use {{.Event}}, {{.Key}} (what the notification is about, e.g. a path), {{.Subject}}, {{.Message}}, {{.Host}} and {{.Time}}. Events without a template use the built-in one.\n" },
+{ MAX_RANGES,1,"","max-ranges",argv.ArgInt, "    --max-ranges=n \tThe largest number of ranges a Range request may ask for (default "+strconv.Itoa(http2.MaxRanges)+"). Adjacent and overlapping ranges are merged first. Requests with more ranges get the whole file, so that many tiny ranges can not make Garçon do much more work than the data they return is worth.\n" },
 { VERBOSE,1,"v","verbose",argv.ArgNone,       "    -v, --verbose \tIncrease verbosity of log output. More -v switches mean more verbosity.\n" },
 { 0, 0, "", "",argv.ArgUnknown, "\f" },
 { UNKNOWN, 1, "", "",     argv.ArgUnknown, `CONTENT-ENCODING: GZIP
@@ -105,7 +333,13 @@ To reduce bandwidth usage and improve page load times, files in text-based forma
 The following command will compress all files with supported extensions. Files with no extension need to be compressed separately.
 
     gzip *.html *.htm *.css *.js *.xml *.xhtml *.txt *.svg *.json *.ps *.pdf
-` },
+
+CONTENT-ENCODING: BZIP2 AND XZ
+
+Files with no other dots in their name that are compressed with bzip2 or xz (e.g. Debian metadata like Packages.xz) work like gzipped files. They are also served under their name without the .bz2 or .xz extension. Clients that list "bzip2" or "xz" in their Accept-Encoding header get the compressed data, all other clients get the data decompressed on the fly. This way only one compressed form of each file needs to be kept on disk.
+
+`+"    .bz2 (no other dots in file name) \t=> no extension\n"+
+  "    .xz (no other dots in file name) \t=> no extension\n" },
 
 { UNKNOWN, 1, "", "",     argv.ArgUnknown, `COPYRIGHT
     Copyright (c) 2016 Matthias S. Benkmann
@@ -125,6 +359,99 @@ func check(what string, err error) {
 }
 
 
+// Saves the tree of fm to --state-file and exits when Garçon is terminated
+// with SIGTERM or SIGINT.
+func saveStateOnExit(fm *fs.FileManager) {
+  sig := make(chan os.Signal, 1)
+  signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+  s := <-sig
+  util.Log(1, "Received %v => Saving state", s)
+  err := fm.SaveState()
+  if err != nil {
+    util.Log(0, "ERROR! Saving state to %v: %v", fs.StateFile, err)
+    os.Exit(1)
+  }
+  os.Exit(0)
+}
+
+// Returns the arguments of all occurrences of opt in the order they were given.
+func allArgs(opt *argv.Option) []string {
+  args := []string{}
+  if opt.Count() == 0 { return args }
+  for o := opt.First(); o != nil; o = o.Next() {
+    args = append(args, o.Arg)
+  }
+  return args
+}
+
+// Returns the upstreams of all occurrences of the option name (opt), whose
+// arguments are /prefix=URL, by prefix.
+func upstreams(name string, opt *argv.Option) map[string]*fs.Upstream {
+  result := map[string]*fs.Upstream{}
+  for _, p := range allArgs(opt) {
+    pu := strings.SplitN(p, "=", 2)
+    if len(pu) != 2 || !strings.HasPrefix(pu[0], "/") {
+      check(name,fmt.Errorf("Expected /prefix=URL, got %v", p))
+    }
+    up, err := fs.NewUpstream(pu[1])
+    check(name,err)
+    result[pu[0]] = up
+  }
+  return result
+}
+
+// Matches the argument "key[:from[:until]]" of --rpm-signing-key and --arch-signing-key.
+var signingKeyArg = regexp.MustCompile(`^(.+?)(?::(\d{4}-\d\d-\d\d)?(?::(\d{4}-\d\d-\d\d)?)?)?$`)
+
+/*
+  Reads the keys of the signing key option opt, whose name is name. Returns
+  nil if there are none.
+*/
+func signingKeys(name string, opt *argv.Option) *pgp.Keyring {
+  var keys *pgp.Keyring
+  for _, arg := range allArgs(opt) {
+    m := signingKeyArg.FindStringSubmatch(arg)
+    var window [2]time.Time
+    for i, date := range m[2:4] {
+      if date == "" { continue }
+      var err error
+      window[i], err = time.Parse("2006-01-02", date)
+      check(name,err)
+    }
+    if !window[1].IsZero() && !window[0].Before(window[1]) {
+      check(name,fmt.Errorf("%v: Start date must be before end date", arg))
+    }
+    var key *pgp.Key
+    var err error
+    spec := strings.SplitN(m[1], ":", 3)
+    switch {
+      case spec[0] == "gpg" && len(spec) >= 2:
+        key, err = pgp.NewGPGKey(strings.Join(spec[1:], ":"))
+      case (spec[0] == "exec" || spec[0] == "remote") && len(spec) == 3:
+        var f *os.File
+        f, err = os.Open(spec[1])
+        check(name,err)
+        if spec[0] == "exec" {
+          key, err = pgp.NewCommandKey(f, strings.Fields(spec[2]))
+        } else {
+          key, err = pgp.NewRemoteKey(f, spec[2])
+        }
+        f.Close()
+      default:
+        var f *os.File
+        f, err = os.Open(m[1])
+        check(name,err)
+        key, err = pgp.ReadKey(f)
+        f.Close()
+    }
+    check(name,err)
+    if keys == nil { keys = &pgp.Keyring{} }
+    keys.Add(key, window[0], window[1])
+    util.Log(1, "%v: %v from %v until %v", name, key, m[2], m[3])
+  }
+  return keys
+}
+
 // Default rules for handling files.
 var DefaultHandling = []fs.Handling{
   {Match:regexp.MustCompile(`^\.`),          Hide:true},
@@ -144,6 +471,8 @@ var DefaultHandling = []fs.Handling{
   {Match:regexp.MustCompile(`\.htm\.gz$`),   Gzip:`.htm`},
   {Match:regexp.MustCompile(`\.html\.gz$`),  Gzip:`.html`},
   {Match:regexp.MustCompile(`^([^.]+)\.gz$`),Gzip:`$1`},
+  {Match:regexp.MustCompile(`^([^.]+)\.bz2$`),Bzip2:`$1`},
+  {Match:regexp.MustCompile(`^([^.]+)\.xz$`),Xz:`$1`},
   
   
   {Match:regexp.MustCompile(``)}, // catch-all; required to guarantee that a rule matches.
@@ -151,6 +480,8 @@ var DefaultHandling = []fs.Handling{
   
 
 func main() {
+  auth.PAMHelperMain()
+  
   util.LogLevel = 1
   
   argv.LastColumnMinPercent = 100 // Force last column on its own line
@@ -165,6 +496,10 @@ func main() {
     os.Exit(0)
   }
 
+  if os.Args[1] == "remote" { os.Exit(remote(os.Args[2:])) }
+  if os.Args[1] == "bench" { os.Exit(bench(os.Args[2:])) }
+  if os.Args[1] == "import-reprepro" || os.Args[1] == "import-aptly" { os.Exit(importRepos(os.Args[1], os.Args[2:])) }
+  
   options, _, err, _ := argv.Parse(os.Args[1:], usage, "gnu -perl --abb")
   check("parse command line",err)
 
@@ -174,7 +509,36 @@ func main() {
     fmt.Fprintf(os.Stdout, "%v\n", usage)
     os.Exit(0)
   }
-
+  
+  if options[TOTP_NEW].Count() > 0 {
+    line, uri, codes := auth.NewTOTPSecret(options[TOTP_NEW].Last().Arg, "Garçon")
+    fmt.Fprintf(os.Stdout, "Line for --totp-file:\n%v\n\nURI for the authenticator app:\n%v\n\nRecovery codes:\n%v\n", line, uri, strings.Join(codes, "\n"))
+    os.Exit(0)
+  }
+  
+  if options[TOKEN_NEW].Count() > 0 {
+    user, groups := options[TOKEN_NEW].Last().Arg, []string{}
+    if i := strings.Index(user, ":"); i >= 0 {
+      groups = strings.Split(user[i+1:], ",")
+      user = user[0:i]
+    }
+    line, token := auth.NewToken(user, groups)
+    fmt.Fprintf(os.Stdout, "Line for --token-file:\n%v\n\nToken:\n%v\n", line, token)
+    os.Exit(0)
+  }
+  
+  if options[PASSWORD_HASH].Is(ENABLED) {
+    data, err := ioutil.ReadAll(os.Stdin)
+    check("--password-hash", err)
+    password := strings.TrimRight(strings.SplitN(string(data), "\n", 2)[0], "\r")
+    if password == "" {
+      fmt.Fprintf(os.Stderr, "--password-hash: No password on stdin\n")
+      os.Exit(1)
+    }
+    fmt.Fprintf(os.Stdout, "<?garçon password=\"%v\"?>\n", fs.HashDirPassword(password))
+    os.Exit(0)
+  }
+  
   if options[ROOT].Count() == 0 {
     fmt.Fprintf(os.Stderr, "You need to specify the server root --directory\n")
     os.Exit(1)
@@ -205,6 +569,24 @@ func main() {
     check("getgid",err)
   }
   
+  if options[UPLOAD_UID].Count() > 0 {
+    fs.UploadUid, err = linux.Getuid(options[UPLOAD_UID].Last().Arg)
+    check("--upload-uid",err)
+  }
+  
+  if options[UPLOAD_GID].Count() > 0 {
+    fs.UploadGid, err = linux.Getgid(options[UPLOAD_GID].Last().Arg)
+    check("--upload-gid",err)
+  }
+  
+  if options[UPLOAD_UMASK].Count() > 0 {
+    umask, err := strconv.ParseUint(options[UPLOAD_UMASK].Last().Arg, 8, 32)
+    if err != nil || umask > 0777 {
+      check("--upload-umask",fmt.Errorf("Illegal umask: %v", options[UPLOAD_UMASK].Last().Arg))
+    }
+    fs.UploadUmask = os.FileMode(umask)
+  }
+  
   http_port := "80"
   if options[HTTP].Count() > 0 {
     http_port = options[HTTP].Last().Arg
@@ -213,15 +595,534 @@ func main() {
     }
   }
   
+  if options[FADVISE].Count() > 0 {
+    if options[FADVISE].Last().Value.(int) < 0 {
+      check("--fadvise-threshold",fmt.Errorf("Illegal threshold: %v", options[FADVISE].Last().Arg))
+    }
+    fs.FadviseThreshold = int64(options[FADVISE].Last().Value.(int))
+  }
+  
+  cache_size := int64(32*1024*1024)
+  if options[CACHE_SIZE].Count() > 0 {
+    cache_size = int64(options[CACHE_SIZE].Last().Value.(int))
+  }
+  
+  cache_max_file := int64(1024*1024)
+  if options[CACHE_MAX_FILE].Count() > 0 {
+    cache_max_file = int64(options[CACHE_MAX_FILE].Last().Value.(int))
+  }
+  
+  fs.CacheSparseFiles = options[CACHE_SKIP_SPARSE].Count() == 0
+  
+  if options[MAX_RANGES].Count() > 0 {
+    http2.MaxRanges = options[MAX_RANGES].Last().Value.(int)
+    if http2.MaxRanges < 1 { check("--max-ranges", fmt.Errorf("Expected a positive number")) }
+  }
+  
+  if options[MEMORY_BUDGET].Count() > 0 {
+    fs.MemoryBudget = int64(options[MEMORY_BUDGET].Last().Value.(int))
+    // Without somewhere to spill to, the budget could not be enforced.
+    if fs.MemoryBudget > 0 && options[SPILL_DIR].Count() == 0 { check("--memory-budget",fmt.Errorf("Requires --spill-dir")) }
+  }
+  
+  if options[SPILL_DIR].Count() > 0 {
+    fs.SpillDir = options[SPILL_DIR].Last().Arg
+  }
+  
+  if options[STATE_FILE].Count() > 0 {
+    fs.StateFile = options[STATE_FILE].Last().Arg
+  }
+  
+  if options[PUBLISH_DIR].Count() > 0 {
+    if options[ADMIN_API].Count() == 0 { check("--publish-dir",fmt.Errorf("Requires --enable-admin-api")) }
+    fs.PublishDir = options[PUBLISH_DIR].Last().Arg
+  }
+  
+  if options[IO_URING].Count() > 0 {
+    if !fs.IOUringSupported {
+      check("--io-uring",fmt.Errorf("This binary has been built without io_uring support"))
+    }
+    fs.UseIOUring = true
+  }
+  
+  if options[ALIAS_CONFLICT].Count() > 0 {
+    switch options[ALIAS_CONFLICT].Last().Arg {
+      case "prefer-file":       fs.AliasConflictPolicy = fs.PREFER_FILE
+      case "prefer-alias":      fs.AliasConflictPolicy = fs.PREFER_ALIAS
+      case "error":             fs.AliasConflictPolicy = fs.CONFLICT_ERROR
+      case "mtime-newest-wins": fs.AliasConflictPolicy = fs.MTIME_NEWEST_WINS
+      default: check("--alias-conflict",fmt.Errorf("Unknown policy: %v", options[ALIAS_CONFLICT].Last().Arg))
+    }
+  }
+  
+  if options[INDEX_LANGUAGE].Count() > 0 {
+    lang := options[INDEX_LANGUAGE].Last().Arg
+    known := false
+    for _, l := range fs.Languages() { known = known || (l == lang) }
+    if !known {
+      check("--index-language",fmt.Errorf("Unsupported language: %v", lang))
+    }
+    fs.IndexLanguage = lang
+  }
+  
+  if options[CANARY_INDEX].Count() > 0 {
+    arg := options[CANARY_INDEX].Last().Arg
+    i := strings.LastIndex(arg, ":")
+    if i < 0 { check("--canary-index",fmt.Errorf("Expected file:percent, got %v", arg)) }
+    fs.CanaryPercent, err = strconv.ParseFloat(arg[i+1:], 64)
+    if err == nil && (fs.CanaryPercent < 0 || fs.CanaryPercent > 100) { err = fmt.Errorf("Expected percentage between 0 and 100") }
+    check("--canary-index",err)
+    fs.CanaryIndex, err = ioutil.ReadFile(arg[0:i])
+    check("--canary-index",err)
+  }
+  
+  if options[ASSETS_DIR].Count() > 0 {
+    check("--assets-dir", fs.LoadAssets(options[ASSETS_DIR].Last().Arg))
+  }
+  
+  var immutable *regexp.Regexp
+  if options[IMMUTABLE].Count() > 0 {
+    immutable, err = regexp.Compile(options[IMMUTABLE].Last().Arg)
+    check("--immutable",err)
+  }
+  
+  var rules filter.Rules
+  for _, ua := range allArgs(options[BLOCK_USER_AGENT]) {
+    re, err := regexp.Compile(ua)
+    check("--block-user-agent",err)
+    rules.UserAgents = append(rules.UserAgents, re)
+  }
+  for _, p := range allArgs(options[BLOCK_PATH]) {
+    re, err := regexp.Compile(p)
+    check("--block-path",err)
+    rules.Paths = append(rules.Paths, re)
+  }
+  if options[MAX_URL_LENGTH].Count() > 0 {
+    rules.MaxURLLength = options[MAX_URL_LENGTH].Last().Value.(int)
+  }
+  rules.BlockEncodedTraversal = options[BLOCK_TRAVERSAL].Count() > 0
+  for _, rl := range allArgs(options[RESPONSE_LIMIT]) {
+    fields := strings.SplitN(rl, ":", 3)
+    var limit filter.ResponseLimit
+    err = nil
+    if len(fields) == 3 { limit.Deadline, err = time.ParseDuration(fields[0]) }
+    if len(fields) == 3 && err == nil { limit.MaxBytes, err = strconv.ParseInt(fields[1], 10, 64) }
+    if len(fields) != 3 || err != nil || limit.Deadline < 0 || limit.MaxBytes < 0 {
+      check("--response-limit",fmt.Errorf("Expected duration:bytes:regex, got %v", rl))
+    }
+    limit.Path, err = regexp.Compile(fields[2])
+    check("--response-limit",err)
+    rules.Limits = append(rules.Limits, limit)
+  }
+  
+  var geo *geoip.GeoIP
+  for _, dbfile := range allArgs(options[GEOIP_DB]) {
+    data, err := ioutil.ReadFile(dbfile)
+    check("--geoip-db",err)
+    db, err := geoip.Open(data)
+    check("--geoip-db",err)
+    util.Log(1, "GeoIP database %v: %v", dbfile, db.Type)
+    if geo == nil { geo = &geoip.GeoIP{Block:map[string]bool{}, Limit:map[string]int{}} }
+    geo.DBs = append(geo.DBs, db)
+  }
+  for _, list := range allArgs(options[GEOIP_BLOCK]) {
+    if geo == nil { check("--geoip-block",fmt.Errorf("Requires --geoip-db")) }
+    for _, key := range strings.Split(list, ",") {
+      if key = strings.ToUpper(strings.TrimSpace(key)); key != "" { geo.Block[key] = true }
+    }
+  }
+  for _, limit := range allArgs(options[GEOIP_LIMIT]) {
+    if geo == nil { check("--geoip-rate-limit",fmt.Errorf("Requires --geoip-db")) }
+    kn := strings.SplitN(limit, ":", 2)
+    n := 0
+    if len(kn) == 2 { n, err = strconv.Atoi(kn[1]) }
+    if len(kn) != 2 || err != nil || n <= 0 {
+      check("--geoip-rate-limit",fmt.Errorf("Expected key:n with n > 0, got %v", limit))
+    }
+    geo.Limit[strings.ToUpper(strings.TrimSpace(kn[0]))] = n
+  }
+  
+  rate_classes := map[string]fs.RateClass{}
+  for _, rc := range allArgs(options[RATE_CLASS]) {
+    fields := strings.Split(rc, ":")
+    var limits fs.RateClass
+    err = nil
+    if len(fields) >= 2 { limits.Bandwidth, err = strconv.ParseInt(fields[1], 10, 64) }
+    if len(fields) == 3 && err == nil { limits.Concurrency, err = strconv.Atoi(fields[2]) }
+    if len(fields) < 2 || len(fields) > 3 || fields[0] == "" || err != nil || limits.Bandwidth < 0 || limits.Concurrency < 0 {
+      check("--rate-class",fmt.Errorf("Expected name:bandwidth[:concurrency], got %v", rc))
+    }
+    rate_classes[fields[0]] = limits
+  }
+  
+  var upload_limit fs.RateClass
+  if options[UPLOAD_LIMIT].Count() > 0 {
+    ul := options[UPLOAD_LIMIT].Last().Arg
+    fields := strings.Split(ul, ":")
+    err = nil
+    upload_limit.Bandwidth, err = strconv.ParseInt(fields[0], 10, 64)
+    if len(fields) == 2 && err == nil { upload_limit.Concurrency, err = strconv.Atoi(fields[1]) }
+    if len(fields) > 2 || err != nil || upload_limit.Bandwidth < 0 || upload_limit.Concurrency < 0 {
+      check("--upload-limit",fmt.Errorf("Expected bandwidth[:concurrency], got %v", ul))
+    }
+  }
+  
+  max_uploads := 0
+  if options[MAX_UPLOADS].Count() > 0 {
+    max_uploads = options[MAX_UPLOADS].Last().Value.(int)
+    if max_uploads < 0 { check("--max-uploads",fmt.Errorf("Must not be negative")) }
+  }
+  
+  // The rate class rules are inserted before the catch-all, so that they do not
+  // shadow the hide and alias rules (see fs.Handling.RateClass).
+  handling := DefaultHandling
+  if options[RATE_CLASS_MATCH].Count() > 0 {
+    handling = append([]fs.Handling{}, DefaultHandling[:len(DefaultHandling)-1]...)
+    for _, m := range allArgs(options[RATE_CLASS_MATCH]) {
+      nr := strings.SplitN(m, ":", 2)
+      if len(nr) != 2 || nr[0] == "" {
+        check("--rate-class-match",fmt.Errorf("Expected name:regex, got %v", m))
+      }
+      if _, ok := rate_classes[nr[0]]; !ok {
+        check("--rate-class-match",fmt.Errorf("Unknown rate class: %v", nr[0]))
+      }
+      re, err := regexp.Compile(nr[1])
+      check("--rate-class-match",err)
+      handling = append(handling, fs.Handling{Match:re, RateClass:nr[0]})
+    }
+    handling = append(handling, DefaultHandling[len(DefaultHandling)-1])
+  }
+  
+  if options[TREE_DIFF].Count() > 0 {
+    fs.StateFile = "" // compare with the filesystem, not with a loaded tree
+    fm, err := fs.NewFileManager(wd, handling)
+    check("scan files",err)
+    d, err := fm.DiffState(nil, options[TREE_DIFF].Last().Arg)
+    check("--tree-diff",err)
+    d.Write(os.Stdout)
+    os.Exit(0)
+  }
+  
+  policy := auth.NewPolicy()
+  for _, g := range allArgs(options[AUTH_GRANT]) {
+    grant, err := auth.ParseGrant(g)
+    check("--auth-grant",err)
+    policy.Grants = append(policy.Grants, grant)
+  }
+  
+  if options[OIDC_ISSUER].Count() > 0 {
+    if options[OIDC_CLIENT_ID].Count() == 0 || options[OIDC_CLIENT_SECRET_FILE].Count() == 0 || options[OIDC_REDIRECT_URL].Count() == 0 {
+      check("--oidc-issuer",fmt.Errorf("Requires --oidc-client-id, --oidc-client-secret-file and --oidc-redirect-url"))
+    }
+    secret, err := ioutil.ReadFile(options[OIDC_CLIENT_SECRET_FILE].Last().Arg)
+    check("--oidc-client-secret-file",err)
+    redirect := options[OIDC_REDIRECT_URL].Last().Arg
+    if !strings.HasSuffix(redirect, auth.AuthPath+"callback") {
+      check("--oidc-redirect-url",fmt.Errorf("Path must be %vcallback", auth.AuthPath))
+    }
+    oidc, err := auth.Discover(options[OIDC_ISSUER].Last().Arg, options[OIDC_CLIENT_ID].Last().Arg, strings.TrimSpace(string(secret)))
+    check("--oidc-issuer",err)
+    oidc.RedirectURL = redirect
+    oidc.Scopes = []string{"profile", "email", "groups"}
+    if options[OIDC_SCOPES].Count() > 0 {
+      oidc.Scopes = nil
+      for _, scope := range strings.Split(options[OIDC_SCOPES].Last().Arg, ",") {
+        if scope = strings.TrimSpace(scope); scope != "" { oidc.Scopes = append(oidc.Scopes, scope) }
+      }
+    }
+    if options[OIDC_USERNAME_CLAIM].Count() > 0 {
+      oidc.UsernameClaim = options[OIDC_USERNAME_CLAIM].Last().Arg
+    }
+    if options[OIDC_GROUPS_CLAIM].Count() > 0 {
+      oidc.GroupsClaim = options[OIDC_GROUPS_CLAIM].Last().Arg
+    }
+    policy.OIDC = oidc
+  }
+  
+  if options[SESSION_LIFETIME].Count() > 0 {
+    auth.SessionLifetime, err = time.ParseDuration(options[SESSION_LIFETIME].Last().Arg)
+    if err == nil && auth.SessionLifetime <= 0 { err = fmt.Errorf("Must be positive") }
+    check("--session-lifetime",err)
+  }
+  
+  if options[SESSION_KEY_FILE].Count() > 0 {
+    key, err := ioutil.ReadFile(options[SESSION_KEY_FILE].Last().Arg)
+    check("--session-key-file",err)
+    check("--session-key-file",policy.SetSessionKey(key))
+  }
+  
+  if options[PAM_SERVICE].Count() > 0 {
+    policy.PAM, err = auth.StartPAM(options[PAM_SERVICE].Last().Arg)
+    check("--pam-service",err)
+  }
+  
+  if options[TOTP_FILE].Count() > 0 {
+    f, err := os.Open(options[TOTP_FILE].Last().Arg)
+    check("--totp-file",err)
+    policy.TOTP, err = auth.ReadTOTP(f)
+    f.Close()
+    check("--totp-file",err)
+  }
+  
+  if options[TOKEN_FILE].Count() > 0 {
+    f, err := os.Open(options[TOKEN_FILE].Last().Arg)
+    check("--token-file",err)
+    policy.Tokens, err = auth.ReadTokens(f)
+    f.Close()
+    check("--token-file",err)
+  }
+  
+  if options[URL_SIGNING_KEY_FILE].Count() > 0 {
+    key, err := ioutil.ReadFile(options[URL_SIGNING_KEY_FILE].Last().Arg)
+    check("--url-signing-key-file",err)
+    policy.URLs, err = auth.NewURLSigner(key)
+    check("--url-signing-key-file",err)
+    if !policy.Active() { check("--url-signing-key-file",fmt.Errorf("Requires --auth-grant")) }
+  }
+  
+  if options[URL_TOKEN_STORE].Count() > 0 {
+    if policy.URLs == nil { check("--url-token-store",fmt.Errorf("Requires --url-signing-key-file")) }
+    f, err := os.OpenFile(options[URL_TOKEN_STORE].Last().Arg, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+    check("--url-token-store",err)
+    check("--url-token-store",policy.URLs.SetTokenStore(f))
+  }
+  
+  if options[MULTIPART_EXPIRY].Count() > 0 {
+    fs.MultipartExpiry, err = time.ParseDuration(options[MULTIPART_EXPIRY].Last().Arg)
+    if err == nil && fs.MultipartExpiry <= 0 { err = fmt.Errorf("Must be positive") }
+    check("--multipart-expiry",err)
+  }
+  
+  if options[UNPACK_LIMIT].Count() > 0 {
+    fs.UnpackLimit = int64(options[UNPACK_LIMIT].Last().Value.(int))
+    if fs.UnpackLimit < 0 { check("--unpack-limit", fmt.Errorf("Must not be negative")) }
+  }
+  
+  if options[TRASH_RETENTION].Count() > 0 {
+    fs.TrashRetention, err = time.ParseDuration(options[TRASH_RETENTION].Last().Arg)
+    if err == nil && fs.TrashRetention < 0 { err = fmt.Errorf("Must not be negative") }
+    check("--trash-retention",err)
+  }
+  
+  if options[ADMIN_API].Count() > 0 {
+    if _, protected := policy.Allowed(nil, strings.TrimSuffix(fs.AdminPath, "/"), auth.WRITE); !protected {
+      check("--enable-admin-api",fmt.Errorf("Requires an --auth-grant that covers %v", strings.TrimSuffix(fs.AdminPath, "/")))
+    }
+  }
+  
+  if options[LOG_TAIL].Count() > 0 {
+    lines := options[LOG_TAIL].Last().Value.(int)
+    if lines < 1 { check("--log-tail",fmt.Errorf("Expected a positive number")) }
+    if _, protected := policy.Allowed(nil, logtail.Path, auth.READ); !protected {
+      check("--log-tail",fmt.Errorf("Requires an --auth-grant that covers %v", logtail.Path))
+    }
+    util.LoggerAdd(logtail.Start(lines))
+  }
+  
+  if options[ANONYMIZE_IP].Count() > 0 {
+    switch options[ANONYMIZE_IP].Last().Arg {
+      case "truncate": privacy.IPMode = privacy.IPTruncate
+      case "hash": privacy.IPMode = privacy.IPHash
+      default: check("--anonymize-ip",fmt.Errorf("Expected truncate or hash, got %v", options[ANONYMIZE_IP].Last().Arg))
+    }
+  }
+  privacy.ScrubUserAgent = options[SCRUB_USER_AGENT].Count() > 0
+  
+  for _, spec := range allArgs(options[LOG_EXCLUDE]) {
+    rule, err := accesslog.ParseRule(spec, false)
+    check("--log-exclude",err)
+    accesslog.Rules = append(accesslog.Rules, rule)
+  }
+  for _, spec := range allArgs(options[LOG_SAMPLE]) {
+    rule, err := accesslog.ParseRule(spec, true)
+    check("--log-sample",err)
+    accesslog.Rules = append(accesslog.Rules, rule)
+  }
+  
+  if options[TRACE_SAMPLE].Count() > 0 {
+    tracing.SampleRatio, err = strconv.ParseFloat(options[TRACE_SAMPLE].Last().Arg, 64)
+    if err == nil && (tracing.SampleRatio < 0 || tracing.SampleRatio > 1) { err = fmt.Errorf("Expected fraction between 0 and 1") }
+    check("--trace-sample",err)
+  }
+  
+  if options[REFRESH_DEADLINE].Count() > 0 {
+    fs.RefreshDeadline, err = time.ParseDuration(options[REFRESH_DEADLINE].Last().Arg)
+    if err == nil && fs.RefreshDeadline <= 0 { err = fmt.Errorf("Expected a positive duration") }
+    check("--refresh-deadline",err)
+  }
+  
+  fs.ReadOnlyImage = options[READ_ONLY_IMAGE].Count() > 0
+  
+  var scan_intervals []time.Duration
+  if options[SCAN_INTERVALS].Count() > 0 {
+    fields := strings.Split(options[SCAN_INTERVALS].Last().Arg, ":")
+    if len(fields) < 2 || len(fields) > 3 { err = fmt.Errorf("Expected debounce:retry[:poll]") }
+    scan_intervals = make([]time.Duration, 3)
+    for i := 0; err == nil && i < len(fields); i++ {
+      scan_intervals[i], err = time.ParseDuration(fields[i])
+      if err == nil && scan_intervals[i] < 0 { err = fmt.Errorf("Negative duration: %v", fields[i]) }
+    }
+    if err == nil && scan_intervals[1] == 0 { err = fmt.Errorf("retry must be positive") }
+    check("--scan-intervals",err)
+  }
+  
+  if options[ALERT_WEBHOOK].Count() > 0 {
+    check("--alert-webhook", fs.SetAlertWebhook(options[ALERT_WEBHOOK].Last().Arg))
+  }
+  
+  if options[NOTIFY].Count() > 0 {
+    if options[SMTP_SERVER].Count() == 0 { check("--notify", fmt.Errorf("Requires --smtp-server")) }
+    authfile, from := "", ""
+    if options[SMTP_AUTH_FILE].Count() > 0 { authfile = options[SMTP_AUTH_FILE].Last().Arg }
+    if options[NOTIFY_FROM].Count() > 0 { from = options[NOTIFY_FROM].Last().Arg }
+    check("--smtp-server", notify.SetServer(options[SMTP_SERVER].Last().Arg, authfile, from))
+    for _, spec := range allArgs(options[NOTIFY]) {
+      check("--notify", notify.AddRecipients(spec))
+    }
+    if options[NOTIFY_TEMPLATES].Count() > 0 {
+      check("--notify-templates", notify.SetTemplates(options[NOTIFY_TEMPLATES].Last().Arg))
+    }
+  }
+  
+  for _, spec := range allArgs(options[NOTIFY_SLACK]) {
+    check("--notify-slack", notify.AddSlack(spec))
+  }
+  
+  if options[NOTIFY_MATRIX].Count() > 0 {
+    tokenfile := ""
+    if options[MATRIX_TOKEN_FILE].Count() > 0 { tokenfile = options[MATRIX_TOKEN_FILE].Last().Arg }
+    if tokenfile == "" { check("--notify-matrix", fmt.Errorf("Requires --matrix-token-file")) }
+    for _, spec := range allArgs(options[NOTIFY_MATRIX]) {
+      check("--notify-matrix", notify.AddMatrix(spec, tokenfile))
+    }
+  }
+  
+  if options[OTLP_ENDPOINT].Count() > 0 {
+    err = tracing.Enable(options[OTLP_ENDPOINT].Last().Arg, "garcon")
+    check("--otlp-endpoint",err)
+  }
+  
+  var shad *shadow.Shadow
+  if options[SHADOW_URL].Count() > 0 {
+    ratio := 1.0
+    if options[SHADOW_SAMPLE].Count() > 0 {
+      ratio, err = strconv.ParseFloat(options[SHADOW_SAMPLE].Last().Arg, 64)
+      if err == nil && (ratio < 0 || ratio > 1) { err = fmt.Errorf("Expected fraction between 0 and 1") }
+      check("--shadow-sample",err)
+    }
+    shad, err = shadow.New(options[SHADOW_URL].Last().Arg, ratio)
+    check("--shadow-url",err)
+  }
+  
+  rpm_keys := signingKeys("--rpm-signing-key", options[RPM_SIGNING_KEY])
+  arch_keys := signingKeys("--arch-signing-key", options[ARCH_SIGNING_KEY])
+  
+  var validators []fs.Validator
+  for _, v := range allArgs(options[UPLOAD_VALIDATOR]) {
+    prc := strings.SplitN(v, ":", 3)
+    if len(prc) != 3 || (prc[0] != "reject" && prc[0] != "warn") || len(strings.Fields(prc[2])) == 0 {
+      check("--upload-validator",fmt.Errorf("Expected reject|warn:regex:command, got %v", v))
+    }
+    match, err := regexp.Compile(prc[1])
+    check("--upload-validator",err)
+    validators = append(validators, fs.Validator{Match:match, Command:strings.Fields(prc[2]), Reject:prc[0] == "reject"})
+  }
+  
+  proxies := upstreams("--proxy", options[PROXY])
+  
+  mounts := []*fs.Mount{}
+  for _, spec := range allArgs(options[HANDLER]) {
+    m, err := fs.ParseMount(spec)
+    check("--handler",err)
+    for _, other := range mounts {
+      if other.Prefix == m.Prefix { check("--handler",fmt.Errorf("%v is used twice", m.Prefix)) }
+    }
+    mounts = append(mounts, m)
+  }
+  apt_proxies := upstreams("--apt-proxy", options[APT_PROXY])
+  
+  apt_selections := map[string]fs.AptSelection{}
+  for _, s := range allArgs(options[APT_SELECT]) {
+    ps := strings.SplitN(s, "=", 2)
+    if len(ps) != 2 { check("--apt-proxy-select",fmt.Errorf("Expected /prefix=suites:components:architectures[:source], got %v", s)) }
+    if _, ok := apt_proxies[ps[0]]; !ok { check("--apt-proxy-select",fmt.Errorf("No --apt-proxy for %v", ps[0])) }
+    sel, err := fs.ParseAptSelection(ps[1])
+    check("--apt-proxy-select",err)
+    apt_selections[ps[0]] = sel
+  }
+  
+  if options[APT_ESTIMATE].Is(ENABLED) {
+    if len(apt_selections) == 0 { check("--apt-proxy-estimate",fmt.Errorf("Requires --apt-proxy-select")) }
+    for prefix, sel := range apt_selections {
+      est, err := fs.EstimateApt(apt_proxies[prefix], sel)
+      check("--apt-proxy-estimate",err)
+      fmt.Fprintf(os.Stdout, "%v: %v files with %v bytes in pool/, %v bytes of metadata\n", prefix, est.Files, est.Bytes, est.Metadata)
+    }
+    os.Exit(0)
+  }
+  
+  homes := map[string]int64{}
+  for _, h := range allArgs(options[USER_HOME]) {
+    if policy.OIDC == nil && policy.PAM == nil {
+      check("--user-home",fmt.Errorf("Requires --oidc-issuer or --pam-service"))
+    }
+    pq := strings.SplitN(h, ":", 2)
+    quota := int64(0)
+    if len(pq) == 2 { quota, err = strconv.ParseInt(pq[1], 10, 64) }
+    if !strings.HasPrefix(pq[0], "/") || err != nil || quota < 0 {
+      check("--user-home",fmt.Errorf("Expected /prefix[:quota], got %v", h))
+    }
+    homes[pq[0]] = quota
+    grant, err := auth.ParseGrant(strings.TrimSuffix(pq[0], "/") + "/{user}:rw:*")
+    check("--user-home",err)
+    policy.Grants = append(policy.Grants, grant)
+  }
+  
+  var download_pages *regexp.Regexp
+  if options[DOWNLOAD_PAGE].Count() > 0 {
+    download_pages, err = regexp.Compile(options[DOWNLOAD_PAGE].Last().Arg)
+    check("--download-page",err)
+  }
+  
+  var preload *regexp.Regexp
+  if options[PRELOAD].Count() > 0 {
+    preload, err = regexp.Compile(options[PRELOAD].Last().Arg)
+    check("--preload",err)
+  }
+  
+  var certs []*tlscert.Certificate
+  for _, spec := range allArgs(options[TLS_CERT]) {
+    c, err := tlscert.Load(spec)
+    check("--tls-certificate",err)
+    if c.Expired() && options[FORCE].Count() == 0 {
+      check("--tls-certificate",fmt.Errorf("%v expired on %v. Use --force to start anyway", c, c.NotAfter.Format(time.RFC3339)))
+    }
+    certs = append(certs, c)
+  }
+  
+  https_port := "443"
+  if options[HTTPS].Count() > 0 {
+    if len(certs) == 0 { check("--https-port",fmt.Errorf("Requires --tls-certificate")) }
+    https_port = options[HTTPS].Last().Arg
+    if options[HTTPS].Last().Value.(int) <= 0 || options[HTTPS].Last().Value.(int) > 65535 {
+      check("--https-port",fmt.Errorf("Illegal HTTPS port: %v", https_port))
+    }
+  }
+  
   util.Log(1, "Server root: %v", wd)
   util.Log(1, "Process UID: %v", uid)
   util.Log(1, "Process GID: %v", gid)
   util.Log(1, "HTTP   port: %v", http_port)
+  if len(certs) > 0 { util.Log(1, "HTTPS  port: %v", https_port) }
   
   // Create listeners before dropping privileges
   var https_listener net.Listener
   http_listener, err := net.Listen("tcp", ":"+http_port)
   check("listen",err)
+  if len(certs) > 0 {
+    https_listener, err = net.Listen("tcp", ":"+https_port)
+    check("listen",err)
+  }
   
   if !options[CHROOT].Is(DISABLED) {
     util.Log(1, "Chrooting into %v", wd)
@@ -246,20 +1147,208 @@ func main() {
   server := &http.Server{
               Handler: nil, // => DefaultServeMux
             }
+  
+  if len(certs) > 0 {
+    server.TLSConfig = tlscert.Config(certs)
+    tlscert.Watch(certs)
+  }
 
   wd, err = os.Getwd() // if we have chrooted, wd is now "/"
   
                                                   
-  fm,err := fs.NewFileManager(wd, DefaultHandling)
+  if policy.Active() {
+    fs.Authorize = policy.MayRead
+    fs.AuthorizeWrite = policy.MayWrite
+  }
+  fm,err := fs.NewFileManager(wd, handling)
   check("scan files",err)
   
-  go fm.AutoUpdate()
+  if cache_size > 0 {
+    fm.UseCache(fs.NewCache(cache_size, cache_max_file))
+    if preload != nil {
+      fm.Preload(preload)
+    }
+  }
+  
+  if options[REDIRECTS].Count() > 0 {
+    check("--redirects",fm.SetRedirects(options[REDIRECTS].Last().Arg))
+  }
+  
+  if immutable != nil {
+    fm.SetImmutable(immutable)
+  }
+  
+  for _, prefix := range allArgs(options[SPA_FALLBACK]) {
+    fm.AddFallback(prefix)
+  }
+  
+  if download_pages != nil {
+    fm.SetDownloadPages(download_pages)
+  }
+  for _, base := range allArgs(options[MIRROR]) {
+    fm.AddMirror(base)
+  }
+  
+  fm.RenderMarkdown(options[MARKDOWN].Count() > 0)
+  fm.SourceView(options[SOURCE_VIEW].Count() > 0)
+  for _, prefix := range allArgs(options[SOURCE_PREFIX]) {
+    fm.AddSourcePrefix(prefix)
+  }
+  
+  for _, prefix := range allArgs(options[UPLOAD]) {
+    fm.AddUploadPrefix(prefix)
+  }
+  
+  for prefix, quota := range homes {
+    fm.AddHome(prefix, quota)
+  }
+  
+  for _, prefix := range allArgs(options[RPM_REPO]) {
+    fm.AddRPMRepo(prefix, rpm_keys)
+  }
+  
+  for _, repo := range allArgs(options[ARCH_REPO]) {
+    prefix, name := repo, path.Base(repo)
+    if i := strings.LastIndex(repo, ":"); i >= 0 { prefix, name = repo[0:i], repo[i+1:] }
+    if name == "" || name == "/" || name == "." { check("--arch-repo",fmt.Errorf("Repository name missing: %v", repo)) }
+    fm.AddArchRepo(prefix, name, arch_keys)
+  }
+  
+  for _, prefix := range allArgs(options[PYPI_REPO]) {
+    fm.AddPyPIRepo(prefix)
+  }
+  
+  for _, prefix := range allArgs(options[MAVEN_REPO]) {
+    fm.AddMavenRepo(prefix)
+  }
+  
+  if options[OCI_REGISTRY].Count() > 0 {
+    fm.SetOCIRegistry(options[OCI_REGISTRY].Last().Arg)
+  }
+  
+  for prefix, upstream := range proxies {
+    fm.AddProxy(prefix, upstream)
+  }
+  
+  for prefix, upstream := range apt_proxies {
+    fm.AddAptProxy(prefix, upstream)
+  }
+  
+  for prefix, sel := range apt_selections {
+    check("--apt-proxy-select",fm.SelectApt(prefix, sel))
+  }
+  
+  for _, m := range mounts {
+    http.Handle(m.Prefix + "/", m.Handler(fm))
+  }
+  
+  for _, v := range validators {
+    fm.AddValidator(v)
+  }
+  
+  for name, limits := range rate_classes {
+    fm.SetRateClass(name, limits)
+  }
+  
+  if upload_limit.Bandwidth > 0 || upload_limit.Concurrency > 0 || max_uploads > 0 {
+    fm.SetUploadLimits(upload_limit, max_uploads)
+  }
+  
+  if scan_intervals != nil {
+    fm.SetScanIntervals(scan_intervals[0], scan_intervals[1], scan_intervals[2])
+  }
+  
+  go fm.Supervise()
+  
+  if options[SCHEDULE].Count() > 0 {
+    prefixes := map[string]bool{}
+    for prefix := range proxies { prefixes[prefix] = true }
+    for prefix := range apt_proxies { prefixes[prefix] = true }
+    for _, m := range mounts {
+      if m.Plugin == "proxy" { prefixes[m.Prefix] = true }
+    }
+    for _, arg := range allArgs(options[SCHEDULE]) {
+      job, err := scheduledJob(fm, arg, prefixes)
+      check("--schedule",err)
+      schedule.Start(job)
+    }
+  }
+  
+  if fs.StateFile != "" {
+    go saveStateOnExit(fm)
+  }
   
   http.Handle("/", fm)
+  
+  if options[STATUS].Count() > 0 {
+    status.Register("Alias conflicts", fm.WriteConflicts)
+    status.Register("Index templates", fm.WriteIndexErrors)
+    status.Register("Memory", fm.WriteMemory)
+    fm.RegisterMemoryMetrics()
+    status.Register("Clock skew", fm.WriteClockSkew)
+    fm.RegisterClockSkewMetrics()
+    if options[UPLOAD].Count() > 0 || options[USER_HOME].Count() > 0 {
+      status.Register("Disk space", fm.WriteDiskSpace)
+    }
+    if len(proxies) > 0 || len(apt_proxies) > 0 {
+      status.Register("Proxies", fm.WriteProxyStats)
+      status.Register("Mirror health", fm.WriteMirrorHealth)
+    }
+    if options[SCHEDULE].Count() > 0 {
+      status.Register("Schedule", schedule.WriteStatus)
+    }
+    if len(certs) > 0 {
+      status.Register("TLS certificates", tlscert.WriteStatus)
+    }
+    status.Register("Clients", status.WriteClients)
+    status.Register("Counters", status.WriteCounters)
+    http.Handle("/.garcon/status", status.Handler)
+    http.Handle("/.garcon/metrics", status.MetricsHandler)
+  }
+  
+  http.Handle(fs.OpenAPIPath, http.HandlerFunc(fm.ServeOpenAPI))
+  
+  if options[MIRROR_STATUS].Is(ENABLED) {
+    if len(proxies) == 0 && len(apt_proxies) == 0 { check("--mirror-status",fmt.Errorf("Requires --proxy or --apt-proxy")) }
+    http.Handle(fs.MirrorStatusPath, http.HandlerFunc(fm.ServeMirrorStatus))
+  }
+  
+  if options[LOG_TAIL].Count() > 0 {
+    http.Handle(logtail.Path, logtail.Handler)
+  }
+  
+  if options[ADMIN_API].Count() > 0 {
+    fm.EnableAdminAPI()
+    http.Handle(fs.AdminPath, http.HandlerFunc(fm.ServeAdmin))
+  }
+  
+  var handler http.Handler = http.DefaultServeMux
+  if policy.Active() || policy.OIDC != nil || policy.PAM != nil || policy.Tokens != nil {
+    handler = policy.Wrap(handler)
+  }
+  if options[STATUS].Count() > 0 {
+    handler = status.CountClients(handler)
+  }
+  if rules.Active() {
+    handler = rules.Wrap(handler)
+  }
+  if geo != nil {
+    handler = geo.Wrap(handler)
+  }
+  if shad != nil {
+    handler = shad.Wrap(handler)
+  }
+  if tracing.Enabled() {
+    handler = tracing.Wrap(handler)
+  }
+  if len(accesslog.Rules) > 0 {
+    handler = accesslog.Wrap(handler)
+  }
+  server.Handler = handler
 	
   if https_listener != nil {
     go func() {
-      e := server.Serve(https_listener)
+      e := server.ServeTLS(https_listener, "", "")
       check("serve https",e)
     }() 
   }
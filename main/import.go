@@ -0,0 +1,146 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package main
+
+import (
+         "os"
+         "fmt"
+         "path"
+         "strings"
+         "github.com/mbenkmann/golib/argv"
+         
+         "../debian"
+       )
+
+const (
+  IMPORT_UNKNOWN = iota
+  IMPORT_HELP
+  IMPORT_DIRECTORY
+)
+
+var importOptions = argv.Usage{
+{ IMPORT_HELP,1,"","help",argv.ArgNone, "    --help \tPrint usage and exit.\n" },
+{ IMPORT_DIRECTORY,1,"d","directory",argv.ArgRequired, "    -d dir, --directory=dir \tThe server root (the --directory of the Garçon that serves the repository) to import into.\n" },
+}
+
+var repreproUsage = append(argv.Usage{
+{ IMPORT_UNKNOWN, 1, "", "", argv.ArgUnknown, `NAME
+    garçon import-reprepro - copy a reprepro repository into the server root
+
+SYNOPSIS
+    garçon import-reprepro --directory=dir basedir[:/prefix]...
+    
+    Copies the published part of the reprepro repository with the base
+    directory basedir (the one with conf/distributions) into dir (or its
+    subdirectory /prefix), i.e. pool/ and dists/, from outdir if
+    conf/options sets one. Files are hard linked where possible and files
+    that are already there with the same size and mtime are skipped, so this
+    can be repeated to pick up changes. The Release files are written last,
+    so a running Garçon keeps serving the old metadata of a suite until the
+    new one is complete.
+
+WHAT IS CARRIED OVER
+    Everything below dists/ is copied as reprepro has published it: the
+    Packages, Sources and Contents indexes and Release, InRelease and
+    Release.gpg with the signatures made with the SignWith key. Garçon
+    serves them unchanged; it neither regenerates nor re-signs Debian
+    metadata. Symlinks like dists/stable are recreated.
+    
+    Not carried over are conf/ (distributions, updates, pulls, incoming,
+    options) and db/. The settings in them, e.g. Origin, Label, Components,
+    Architectures, SignWith and the update and pull rules, only take effect
+    when reprepro publishes. To change the repository later, keep running
+    reprepro on basedir and import again. The public key that signs the
+    Release files is not copied either; put it into the server root yourself
+    if clients should download it from there.
+
+OPTIONS
+`}}, importOptions...)
+
+var aptlyUsage = append(argv.Usage{
+{ IMPORT_UNKNOWN, 1, "", "", argv.ArgUnknown, `NAME
+    garçon import-aptly - copy what aptly has published into the server root
+
+SYNOPSIS
+    garçon import-aptly --directory=dir rootdir[:/prefix]...
+    
+    Like "garçon import-reprepro", but copies everything aptly has published,
+    i.e. the public/ directory of its rootDir with all publishing prefixes.
+    rootdir can also be the public/ directory itself.
+
+WHAT IS CARRIED OVER
+    The published dists/ and pool/ of each prefix, with the Release files as
+    aptly has signed them. Garçon serves them unchanged; it neither
+    regenerates nor re-signs Debian metadata.
+    
+    Not carried over are aptly's db/ (mirrors, local repositories, snapshots
+    and what is published from where) and aptly.conf (e.g. the signing
+    settings and FileSystemPublishEndpoints). Published snapshots are only
+    visible as the files they have produced. To change the repository later,
+    keep publishing with aptly and import again.
+
+OPTIONS
+`}}, importOptions...)
+
+/*
+  Runs "garçon import-reprepro" or "garçon import-aptly" (cmd) with the
+  arguments args (without cmd) and returns the exit code.
+*/
+func importRepos(cmd string, args []string) int {
+  usage := repreproUsage
+  if cmd == "import-aptly" { usage = aptlyUsage }
+  options, sources, err, _ := argv.Parse(args, usage, "gnu -perl --abb")
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "garçon %v: %v\n", cmd, err)
+    return 1
+  }
+  
+  if options[IMPORT_HELP].Count() > 0 || len(sources) == 0 {
+    fmt.Fprintf(os.Stdout, "%v\n", usage)
+    return 0
+  }
+  
+  if options[IMPORT_DIRECTORY].Count() == 0 {
+    fmt.Fprintf(os.Stderr, "garçon %v: You need to specify the --directory\n", cmd)
+    return 1
+  }
+  root := options[IMPORT_DIRECTORY].Last().Arg
+  
+  for _, imp := range sources {
+    src, dest := importArgs(root, imp)
+    var stats *debian.ImportStats
+    if cmd == "import-aptly" {
+      stats, err = debian.ImportAptly(src, dest)
+    } else {
+      stats, err = debian.ImportReprepro(src, dest)
+    }
+    if err != nil {
+      fmt.Fprintf(os.Stderr, "garçon %v: %v\n", cmd, err)
+      return 1
+    }
+    fmt.Fprintf(os.Stdout, "Imported %v into %v: %v\n", src, dest, stats)
+  }
+  return 0
+}
+
+// Splits the argument "dir[:/prefix]" of "garçon import-reprepro" or
+// "garçon import-aptly" into the source directory and the target directory
+// below root.
+func importArgs(root, arg string) (string, string) {
+  if i := strings.LastIndex(arg, ":/"); i > 0 {
+    return arg[0:i], path.Join(root, arg[i+1:])
+  }
+  return arg, root
+}
@@ -0,0 +1,100 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package main
+
+import (
+         "os"
+         "fmt"
+         "path"
+         "bytes"
+         "strings"
+         "io/ioutil"
+         
+         "../fs"
+         "../status"
+         "../schedule"
+       )
+
+/*
+  Parses the argument of --schedule, "spec task [argument]", where spec is
+  a cron expression (5 fields), "@every duration" or another shortcut like
+  "@daily", and returns the job that runs the task with fm. proxies are the
+  prefixes of --proxy and --apt-proxy, for checking the argument of sync.
+*/
+func scheduledJob(fm *fs.FileManager, arg string, proxies map[string]bool) (*schedule.Job, error) {
+  fields := strings.Fields(arg)
+  n := 5
+  if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+    n = 1
+    if fields[0] == "@every" { n = 2 }
+  }
+  if len(fields) <= n { return nil, fmt.Errorf("Expected \"schedule task [argument]\" instead of \"%v\"", arg) }
+  spec, err := schedule.Parse(strings.Join(fields[0:n], " "))
+  if err != nil { return nil, err }
+  
+  task, args := fields[n], fields[n+1:]
+  job := &schedule.Job{Name:strings.Join(fields[n:], " "), Spec:spec}
+  nargs := 0
+  switch task {
+    case "rescan":
+      job.Run = func() error { fm.Rescan(); return nil }
+    case "regenerate":
+      job.Run = func() error { fm.Regenerate(); return nil }
+    case "expire-trash":
+      job.Run = func() error { fm.ExpireTrash(); return nil }
+    case "save-state":
+      if fs.StateFile == "" { return nil, fmt.Errorf("save-state requires --state-file") }
+      job.Run = fm.SaveState
+    case "snapshot":
+      nargs = 1
+      if len(args) == 1 {
+        suite := args[0]
+        job.Run = func() error { _, err := fm.SnapshotSuite(suite); return err }
+      }
+    case "sync":
+      nargs = 1
+      if len(args) == 1 {
+        prefix := strings.TrimSuffix(path.Clean(args[0]), "/")
+        if !proxies[prefix] { return nil, fmt.Errorf("No --proxy or --apt-proxy for %v", prefix) }
+        job.Run = func() error { return fm.SyncProxy(prefix) }
+      }
+    case "stats":
+      nargs = 1
+      if len(args) == 1 {
+        file := args[0]
+        job.Run = func() error { return writeStats(file) }
+      }
+    default:
+      return nil, fmt.Errorf("Unknown task: %v", task)
+  }
+  if len(args) != nargs { return nil, fmt.Errorf("%v expects %v argument(s)", task, nargs) }
+  return job, nil
+}
+
+/*
+  Writes the metrics in Prometheus format to file, e.g. for node_exporter's
+  textfile collector or to keep the cache statistics over time. The file is
+  replaced atomically, so readers never see a partial file.
+*/
+func writeStats(file string) error {
+  var buf bytes.Buffer
+  status.WriteMetrics(&buf)
+  tmp := file + ".tmp"
+  err := ioutil.WriteFile(tmp, buf.Bytes(), 0644)
+  if err != nil { return err }
+  err = os.Rename(tmp, file)
+  if err != nil { os.Remove(tmp) }
+  return err
+}
@@ -0,0 +1,302 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package main
+
+import (
+         "io"
+         "os"
+         "fmt"
+         "path"
+         "time"
+         "strings"
+         "net/url"
+         "net/http"
+         "io/ioutil"
+         "crypto/sha256"
+         "encoding/json"
+         "encoding/base64"
+         "github.com/mbenkmann/golib/argv"
+         
+         "../fs"
+         "../auth"
+         "../problem"
+       )
+
+const (
+  REMOTE_UNKNOWN = iota
+  REMOTE_HELP
+  REMOTE_SERVER
+  REMOTE_TOKEN
+  REMOTE_ONCE
+  REMOTE_FOR
+)
+
+var remoteUsage = argv.Usage{
+{ REMOTE_UNKNOWN, 1, "", "", argv.ArgUnknown, `NAME
+    garçon remote - operate a Garçon server via its admin API
+
+SYNOPSIS
+    garçon remote --server=URL [--token=token] command [args]
+    
+    The server must run with --enable-admin-api and --token-file and grant
+    the token's user access to ` + strings.TrimSuffix(fs.AdminPath, "/") + ` and, for uploads,
+    to the upload directory. Exits with code 1 if the command fails.
+
+COMMANDS
+    upload file... /dir
+        Uploads the files into the directory /dir on the server, which must
+        be below an --upload-prefix or a --home. The files keep their mtime
+        and the server verifies their SHA-256.
+    rm /path...
+        Moves the files on the server to the trash.
+    trash
+        Lists the files in the trash with their ids.
+    restore id...
+        Moves the files with the ids from the trash back to where they were.
+    sign /path [lifetime]
+        Prints a link that allows downloading /path without logging in
+        until it expires after lifetime (default 24h). The server must run
+        with --url-signing-key-file. With --once the link works for one
+        download only (requires --url-token-store on the server).
+    snapshot /suite [name]
+        Copies the metadata of the Debian suite (e.g. /debian/dists/stable)
+        to a new suite next to it, called name or, by default, the suite's
+        name with the current time appended.
+    promote /from /to
+        Replaces the metadata of the suite /to with a copy of /from.
+    verify [/suite...]
+        Checks the metadata of the suites (default: all) against their
+        Release files.
+    publish name
+        Makes the server serve the directory name in its --publish-dir
+        instead of the current tree.
+
+OPTIONS
+`},
+{ REMOTE_HELP,1,"","help",argv.ArgNone, "    --help \tPrint usage and exit.\n" },
+{ REMOTE_SERVER,1,"","server",argv.ArgRequired, "    --server=URL \tThe Garçon server, e.g. https://repo.example.com\n" },
+{ REMOTE_TOKEN,1,"","token",argv.ArgRequired, "    --token=token \tThe API token (see --token-new). Defaults to the environment variable GARCON_TOKEN, which, unlike the command line, is not visible to other users of the machine.\n" },
+{ REMOTE_ONCE,1,"","once",argv.ArgNone, "    --once \tFor sign: The link can only be used for one download.\n" },
+{ REMOTE_FOR,1,"","for",argv.ArgRequired, "    --for=recipient \tFor sign: Whom the link is for. The server logs it when the link is used.\n" },
+}
+
+// A client for the admin API of the server at base.
+type remoteClient struct {
+  base string
+  token string
+  client *http.Client
+}
+
+/*
+  Runs "garçon remote" with the arguments args (without "remote") and
+  returns the exit code.
+*/
+func remote(args []string) int {
+  options, commands, err, _ := argv.Parse(args, remoteUsage, "gnu -perl --abb")
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "garçon remote: %v\n", err)
+    return 1
+  }
+  
+  if options[REMOTE_HELP].Count() > 0 || len(commands) == 0 {
+    fmt.Fprintf(os.Stdout, "%v\n", remoteUsage)
+    return 0
+  }
+  
+  if options[REMOTE_SERVER].Count() == 0 {
+    fmt.Fprintf(os.Stderr, "garçon remote: You need to specify the --server\n")
+    return 1
+  }
+  c := &remoteClient{base:strings.TrimSuffix(options[REMOTE_SERVER].Last().Arg, "/"), token:os.Getenv("GARCON_TOKEN"), client:&http.Client{}}
+  if options[REMOTE_TOKEN].Count() > 0 { c.token = options[REMOTE_TOKEN].Last().Arg }
+  
+  cmd, args := commands[0], commands[1:]
+  switch {
+    case cmd == "upload" && len(args) >= 2:
+      err = c.upload(args[0:len(args)-1], args[len(args)-1])
+    case cmd == "rm" && len(args) >= 1:
+      for _, p := range args {
+        if err = c.admin("POST", "remove", url.Values{"path":{p}}); err != nil { break }
+      }
+    case cmd == "trash" && len(args) == 0:
+      err = c.trash()
+    case cmd == "restore" && len(args) >= 1:
+      for _, id := range args {
+        if err = c.admin("POST", "restore", url.Values{"id":{id}}); err != nil { break }
+      }
+    case cmd == "sign" && (len(args) == 1 || len(args) == 2):
+      q := url.Values{"path":{args[0]}}
+      if len(args) == 2 { q.Set("lifetime", args[1]) }
+      if options[REMOTE_ONCE].Count() > 0 { q.Set("once", "1") }
+      if options[REMOTE_FOR].Count() > 0 { q.Set("for", options[REMOTE_FOR].Last().Arg) }
+      err = c.sign(q)
+    case cmd == "snapshot" && (len(args) == 1 || len(args) == 2):
+      q := url.Values{"suite":{args[0]}}
+      if len(args) == 2 { q.Set("name", args[1]) }
+      err = c.admin("POST", "snapshot", q)
+    case cmd == "promote" && len(args) == 2:
+      err = c.admin("POST", "promote", url.Values{"from":{args[0]}, "to":{args[1]}})
+    case cmd == "verify":
+      err = c.verify(args)
+    case cmd == "publish" && len(args) == 1:
+      err = c.admin("POST", "publish", url.Values{"name":{args[0]}})
+    default:
+      err = fmt.Errorf("Unknown command or wrong number of arguments. See garçon remote --help")
+  }
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "garçon remote %v: %v\n", cmd, err)
+    return 1
+  }
+  return 0
+}
+
+/*
+  Sends the request to the server with the token and returns the answer
+  if its status is 2xx. Otherwise returns an error with the status and the
+  server's error message.
+*/
+func (c *remoteClient) do(req *http.Request) ([]byte, error) {
+  if c.token != "" { req.Header.Set("Authorization", "Bearer " + c.token) }
+  resp, err := c.client.Do(req)
+  if err != nil { return nil, err }
+  defer resp.Body.Close()
+  body, err := ioutil.ReadAll(resp.Body)
+  if err != nil { return nil, err }
+  if resp.StatusCode < 200 || resp.StatusCode > 299 {
+    var e problem.Problem
+    msg := strings.TrimSpace(string(body))
+    if json.Unmarshal(body, &e) == nil && e.Detail != "" { msg = e.Code + ": " + e.Detail }
+    return nil, fmt.Errorf("%v %v", resp.Status, msg)
+  }
+  return body, nil
+}
+
+// Calls the operation op of the admin API with the query q and prints the answer.
+func (c *remoteClient) admin(method, op string, q url.Values) error {
+  body, err := c.call(method, op, q)
+  if err != nil { return err }
+  os.Stdout.Write(body)
+  return nil
+}
+
+// Calls the operation op of the admin API with the query q and returns the answer.
+func (c *remoteClient) call(method, op string, q url.Values) ([]byte, error) {
+  req, err := http.NewRequest(method, c.base + fs.AdminPath + op + "?" + q.Encode(), nil)
+  if err != nil { return nil, err }
+  return c.do(req)
+}
+
+// Uploads the local files into the directory dir on the server.
+func (c *remoteClient) upload(files []string, dir string) error {
+  for _, file := range files {
+    f, err := os.Open(file)
+    if err != nil { return err }
+    err = c.uploadFile(f, path.Join("/", dir, path.Base(file)))
+    f.Close()
+    if err != nil { return fmt.Errorf("%v: %v", file, err) }
+  }
+  return nil
+}
+
+// Uploads f to the URL path target.
+func (c *remoteClient) uploadFile(f *os.File, target string) error {
+  fi, err := f.Stat()
+  if err != nil { return err }
+  if fi.IsDir() { return fmt.Errorf("Is a directory") }
+  // The server refuses the upload if it arrives corrupted.
+  digest := sha256.New()
+  if _, err = io.Copy(digest, f); err != nil { return err }
+  if _, err = f.Seek(0, io.SeekStart); err != nil { return err }
+  u := url.URL{Path:target}
+  req, err := http.NewRequest("PUT", c.base + u.EscapedPath(), f)
+  if err != nil { return err }
+  req.ContentLength = fi.Size()
+  mtime := fi.ModTime()
+  req.Header.Set(fs.MtimeHeader, fmt.Sprintf("%d.%09d", mtime.Unix(), mtime.Nanosecond()))
+  req.Header.Set("Repr-Digest", "sha-256=:" + base64.StdEncoding.EncodeToString(digest.Sum(nil)) + ":")
+  start := time.Now()
+  _, err = c.do(req)
+  if err != nil { return err }
+  fmt.Fprintf(os.Stdout, "%v (%v bytes in %v)\n", target, fi.Size(), time.Since(start).Round(time.Millisecond))
+  return nil
+}
+
+// Requests a signed URL with the query q and prints it.
+func (c *remoteClient) sign(q url.Values) error {
+  req, err := http.NewRequest("POST", c.base + auth.AuthPath + "sign?" + q.Encode(), nil)
+  if err != nil { return err }
+  body, err := c.do(req)
+  if err != nil { return err }
+  var res struct {
+    URL string `json:"url"`
+    Expires int64 `json:"expires"`
+  }
+  if err = json.Unmarshal(body, &res); err != nil { return err }
+  fmt.Fprintf(os.Stdout, "%v%v\n(valid until %v)\n", c.base, res.URL, time.Unix(res.Expires, 0).Format("2006-01-02 15:04:05"))
+  return nil
+}
+
+// Lists the files in the trash.
+func (c *remoteClient) trash() error {
+  body, err := c.call("GET", "trash", url.Values{})
+  if err != nil { return err }
+  var res struct {
+    Files []struct {
+      Id uint64 `json:"id"`
+      Path string `json:"path"`
+      Size int64 `json:"size"`
+      Deleted time.Time `json:"deleted"`
+    } `json:"files"`
+  }
+  if err = json.Unmarshal(body, &res); err != nil { return err }
+  for _, f := range res.Files {
+    fmt.Fprintf(os.Stdout, "%v  %v  %v (%v bytes)\n", f.Id, f.Deleted.Local().Format("2006-01-02 15:04:05"), f.Path, f.Size)
+  }
+  return nil
+}
+
+// Verifies the suites (all if suites is empty) and prints the problems.
+func (c *remoteClient) verify(suites []string) error {
+  if len(suites) == 0 { suites = []string{""} }
+  failed := 0
+  for _, suite := range suites {
+    q := url.Values{}
+    if suite != "" { q.Set("suite", suite) }
+    body, err := c.call("GET", "verify", q)
+    if err != nil { return err }
+    var res struct {
+      Suites []struct {
+        Suite string `json:"suite"`
+        Signed bool `json:"signed"`
+        Checked int `json:"checked"`
+        Problems []string `json:"problems"`
+      } `json:"suites"`
+    }
+    if err = json.Unmarshal(body, &res); err != nil { return err }
+    for _, s := range res.Suites {
+      state := "OK"
+      if len(s.Problems) > 0 {
+        state = "FAILED"
+        failed++
+      }
+      signed := "signed"
+      if !s.Signed { signed = "unsigned" }
+      fmt.Fprintf(os.Stdout, "%v: %v (%v files checked, %v)\n", s.Suite, state, s.Checked, signed)
+      for _, p := range s.Problems { fmt.Fprintf(os.Stdout, "    %v\n", p) }
+    }
+  }
+  if failed > 0 { return fmt.Errorf("%v suites have problems", failed) }
+  return nil
+}
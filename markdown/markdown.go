@@ -0,0 +1,536 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+/*
+  Converts Markdown to HTML. The following is supported:
+  ATX and setext headings, paragraphs, hard line breaks, block quotes,
+  (nested) bullet and ordered lists, indented and fenced code blocks,
+  horizontal rules, pipe tables, emphasis, strong emphasis, code spans,
+  links, images and autolinks.
+
+  Raw HTML in the input is NOT passed through but escaped, so that
+  rendering untrusted documents is safe.
+*/
+package markdown
+
+import (
+         "bytes"
+         "regexp"
+         "strings"
+         "html/template"
+       )
+
+// Returns the HTML for the Markdown document src and the text of
+// its first heading ("" if it has none).
+func ToHTML(src []byte) (html []byte, title string) {
+  text := strings.Replace(string(src), "\r\n", "\n", -1)
+  text = strings.Replace(text, "\t", "    ", -1)
+  r := &renderer{}
+  r.blocks(strings.Split(text, "\n"), false)
+  return r.out.Bytes(), r.title
+}
+
+type renderer struct {
+  out bytes.Buffer
+  title string
+}
+
+var (
+  atxHeading   = regexp.MustCompile(`^ {0,3}(#{1,6})(?:\s+(.*?))?(?:\s+#+)?\s*$`)
+  setextH1     = regexp.MustCompile(`^ {0,3}=+\s*$`)
+  setextH2     = regexp.MustCompile(`^ {0,3}-+\s*$`)
+  hrule        = regexp.MustCompile(`^ {0,3}(?:(?:\*\s*){3,}|(?:-\s*){3,}|(?:_\s*){3,})$`)
+  fence        = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})\\s*([^`\\s]*)")
+  quote        = regexp.MustCompile(`^ {0,3}> ?`)
+  listItem     = regexp.MustCompile(`^( {0,3})([-*+]|\d{1,9}[.)])( +|$)`)
+  tableDivider = regexp.MustCompile(`^\s*\|?\s*:?-+:?\s*(\|\s*:?-+:?\s*)*\|?\s*$`)
+)
+
+func blank(line string) bool { return strings.TrimSpace(line) == "" }
+
+// Returns true if line begins a block other than a paragraph.
+func startsBlock(line string) bool {
+  return atxHeading.MatchString(line) || hrule.MatchString(line) || fence.MatchString(line) ||
+         quote.MatchString(line) || listItem.MatchString(line)
+}
+
+// Returns the number of leading spaces of line.
+func indentation(line string) int {
+  return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// Removes up to n leading spaces from line.
+func unindent(line string, n int) string {
+  i := 0
+  for i < n && i < len(line) && line[i] == ' ' { i++ }
+  return line[i:]
+}
+
+/*
+  Renders lines as a sequence of blocks. If tight is true, paragraphs are
+  written without <p> (as is done for the items of tight lists).
+*/
+func (r *renderer) blocks(lines []string, tight bool) {
+  for i := 0; i < len(lines); {
+    line := lines[i]
+
+    if blank(line) { i++; continue }
+
+    if m := fence.FindStringSubmatch(line); m != nil {
+      marker := m[1]
+      indent := indentation(line)
+      i++
+      var code []string
+      for ; i < len(lines); i++ {
+        if strings.HasPrefix(strings.TrimLeft(lines[i], " "), marker) && blank(strings.TrimLeft(strings.TrimLeft(lines[i], " "), marker[:1])) {
+          i++
+          break
+        }
+        code = append(code, unindent(lines[i], indent))
+      }
+      r.code(code, m[2])
+      continue
+    }
+
+    if indentation(line) >= 4 {
+      var code []string
+      for ; i < len(lines) && (blank(lines[i]) || indentation(lines[i]) >= 4); i++ {
+        code = append(code, unindent(lines[i], 4))
+      }
+      for len(code) > 0 && blank(code[len(code)-1]) { code = code[:len(code)-1] }
+      r.code(code, "")
+      continue
+    }
+
+    if m := atxHeading.FindStringSubmatch(line); m != nil {
+      r.heading(len(m[1]), m[2])
+      i++
+      continue
+    }
+
+    if hrule.MatchString(line) {
+      r.out.WriteString("<hr />\n")
+      i++
+      continue
+    }
+
+    if quote.MatchString(line) {
+      var quoted []string
+      for ; i < len(lines) && !blank(lines[i]); i++ {
+        quoted = append(quoted, quote.ReplaceAllString(lines[i], ""))
+      }
+      r.out.WriteString("<blockquote>\n")
+      r.blocks(quoted, false)
+      r.out.WriteString("</blockquote>\n")
+      continue
+    }
+
+    if listItem.MatchString(line) {
+      i = r.list(lines, i)
+      continue
+    }
+
+    if i+1 < len(lines) && strings.Contains(line, "|") && tableDivider.MatchString(lines[i+1]) && strings.Contains(lines[i+1], "-") {
+      i = r.table(lines, i)
+      continue
+    }
+
+    // paragraph, possibly turned into a setext heading
+    var para []string
+    for ; i < len(lines) && !blank(lines[i]); i++ {
+      if len(para) > 0 {
+        if setextH1.MatchString(lines[i]) { r.heading(1, strings.Join(para, "\n")); para = nil; i++; break }
+        if setextH2.MatchString(lines[i]) { r.heading(2, strings.Join(para, "\n")); para = nil; i++; break }
+        if startsBlock(lines[i]) { break }
+      }
+      para = append(para, strings.TrimLeft(lines[i], " "))
+    }
+    if para != nil {
+      if !tight { r.out.WriteString("<p>") }
+      r.inline(strings.Join(para, "\n"))
+      if !tight { r.out.WriteString("</p>") }
+      r.out.WriteString("\n")
+    }
+  }
+}
+
+func (r *renderer) heading(level int, text string) {
+  text = strings.TrimSpace(text)
+  if r.title == "" { r.title = plainText(text) }
+  r.out.WriteString("<h" + string('0'+rune(level)) + ">")
+  r.inline(text)
+  r.out.WriteString("</h" + string('0'+rune(level)) + ">\n")
+}
+
+func (r *renderer) code(lines []string, lang string) {
+  r.out.WriteString("<pre><code")
+  if lang != "" {
+    r.out.WriteString(` class="language-` + template.HTMLEscapeString(lang) + `"`)
+  }
+  r.out.WriteString(">")
+  for _, line := range lines {
+    r.out.WriteString(template.HTMLEscapeString(line))
+    r.out.WriteString("\n")
+  }
+  r.out.WriteString("</code></pre>\n")
+}
+
+// Renders the list that starts at lines[i] and returns the index of
+// the first line after the list.
+func (r *renderer) list(lines []string, i int) int {
+  m := listItem.FindStringSubmatch(lines[i])
+  ordered := m[2][0] >= '0' && m[2][0] <= '9'
+  delim := m[2][len(m[2])-1]
+  tag := "ul"
+  if ordered {
+    tag = "ol"
+    start := strings.TrimLeft(m[2][:len(m[2])-1], "0")
+    if start != "1" && start != "" {
+      r.out.WriteString(`<ol start="` + start + `">` + "\n")
+    } else {
+      r.out.WriteString("<ol>\n")
+    }
+  } else {
+    r.out.WriteString("<ul>\n")
+  }
+
+  var items [][]string
+  tight := true
+  for i < len(lines) {
+    m = listItem.FindStringSubmatch(lines[i])
+    if !sameList(m, ordered, delim) { break }
+    content_indent := len(m[0])
+    if blank(m[3]) { content_indent = len(m[1]) + len(m[2]) + 1 }
+    item := []string{lines[i][len(m[0]):]}
+    i++
+    for i < len(lines) {
+      if blank(lines[i]) {
+        // a blank line continues the item only if an indented line follows
+        j := i
+        for j < len(lines) && blank(lines[j]) { j++ }
+        if j < len(lines) && indentation(lines[j]) >= content_indent {
+          tight = false
+          for ; i < j; i++ { item = append(item, "") }
+          continue
+        }
+        break
+      }
+      if indentation(lines[i]) >= content_indent {
+        item = append(item, unindent(lines[i], content_indent))
+        i++
+        continue
+      }
+      if listItem.MatchString(lines[i]) || startsBlock(lines[i]) { break }
+      item = append(item, lines[i]) // lazy continuation
+      i++
+    }
+    items = append(items, item)
+
+    // skip blank lines between items
+    j := i
+    for j < len(lines) && blank(lines[j]) { j++ }
+    if j < len(lines) && sameList(listItem.FindStringSubmatch(lines[j]), ordered, delim) {
+      if j > i { tight = false } // blank line between items
+      i = j
+    } else {
+      break
+    }
+  }
+
+  for _, item := range items {
+    r.out.WriteString("<li>")
+    r.blocks(item, tight)
+    trimNewline(&r.out)
+    r.out.WriteString("</li>\n")
+  }
+  r.out.WriteString("</" + tag + ">\n")
+  return i
+}
+
+// Returns true if m (a match of listItem or nil) is an item of a list
+// of the given kind.
+func sameList(m []string, ordered bool, delim byte) bool {
+  return m != nil && (m[2][0] >= '0' && m[2][0] <= '9') == ordered && m[2][len(m[2])-1] == delim
+}
+
+func trimNewline(b *bytes.Buffer) {
+  if b.Len() > 0 && b.Bytes()[b.Len()-1] == '\n' { b.Truncate(b.Len()-1) }
+}
+
+// Splits a table row into its cells.
+func cells(line string) []string {
+  line = strings.TrimSpace(line)
+  line = strings.TrimPrefix(line, "|")
+  if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, `\|`) { line = line[:len(line)-1] }
+  var result []string
+  cell := ""
+  for k := 0; k < len(line); k++ {
+    switch {
+      case line[k] == '\\' && k+1 < len(line) && line[k+1] == '|': cell += "|"; k++
+      case line[k] == '|': result = append(result, strings.TrimSpace(cell)); cell = ""
+      default: cell += line[k:k+1]
+    }
+  }
+  return append(result, strings.TrimSpace(cell))
+}
+
+// Renders the table that starts at lines[i] and returns the index of
+// the first line after the table.
+func (r *renderer) table(lines []string, i int) int {
+  head := cells(lines[i])
+  var align []string
+  for _, d := range cells(lines[i+1]) {
+    switch {
+      case strings.HasPrefix(d, ":") && strings.HasSuffix(d, ":"): align = append(align, ` style="text-align:center"`)
+      case strings.HasSuffix(d, ":"): align = append(align, ` style="text-align:right"`)
+      case strings.HasPrefix(d, ":"): align = append(align, ` style="text-align:left"`)
+      default: align = append(align, "")
+    }
+  }
+  row := func(cols []string, tag string) {
+    r.out.WriteString("<tr>")
+    for k := range head {
+      a := ""
+      if k < len(align) { a = align[k] }
+      r.out.WriteString("<" + tag + a + ">")
+      if k < len(cols) { r.inline(cols[k]) }
+      r.out.WriteString("</" + tag + ">")
+    }
+    r.out.WriteString("</tr>\n")
+  }
+
+  r.out.WriteString("<table>\n<thead>\n")
+  row(head, "th")
+  r.out.WriteString("</thead>\n<tbody>\n")
+  for i += 2; i < len(lines) && !blank(lines[i]) && !startsBlock(lines[i]); i++ {
+    row(cells(lines[i]), "td")
+  }
+  r.out.WriteString("</tbody>\n</table>\n")
+  return i
+}
+
+// Characters that may be escaped with a backslash.
+const punctuation = "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+
+var autolink = regexp.MustCompile(`^<((?:https?|ftp)://[^\s<>]+|[^\s<>@]+@[^\s<>@]+\.[^\s<>@]+)>`)
+
+// Renders the inline elements of text.
+func (r *renderer) inline(text string) {
+  for i := 0; i < len(text); {
+    c := text[i]
+    switch {
+      case c == '\\' && i+1 < len(text) && strings.IndexByte(punctuation, text[i+1]) >= 0:
+        r.out.WriteString(template.HTMLEscapeString(text[i+1:i+2]))
+        i += 2
+        continue
+
+      case c == '\\' && i+1 < len(text) && text[i+1] == '\n':
+        r.out.WriteString("<br />\n")
+        i += 2
+        continue
+
+      case c == ' ' && strings.HasPrefix(text[i:], "  \n"):
+        r.out.WriteString("<br />\n")
+        i += 3
+        for i < len(text) && text[i] == ' ' { i++ }
+        continue
+
+      case c == '`':
+        n := 0
+        for i+n < len(text) && text[i+n] == '`' { n++ }
+        delim := text[i:i+n]
+        if end := findRun(text[i+n:], delim); end >= 0 {
+          code := strings.Replace(text[i+n:i+n+end], "\n", " ", -1)
+          if len(code) > 1 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.Trim(code, " ") != "" {
+            code = code[1:len(code)-1]
+          }
+          r.out.WriteString("<code>" + template.HTMLEscapeString(code) + "</code>")
+          i += n + end + n
+          continue
+        }
+        r.out.WriteString(delim)
+        i += n
+        continue
+
+      case c == '!' && i+1 < len(text) && text[i+1] == '[':
+        if label, dest, title, n := parseLink(text[i+1:]); n > 0 {
+          r.out.WriteString(`<img src="` + template.HTMLEscapeString(safeURL(dest)) + `" alt="` + template.HTMLEscapeString(plainText(label)) + `"`)
+          if title != "" { r.out.WriteString(` title="` + template.HTMLEscapeString(title) + `"`) }
+          r.out.WriteString(" />")
+          i += 1 + n
+          continue
+        }
+
+      case c == '[':
+        if label, dest, title, n := parseLink(text[i:]); n > 0 {
+          r.out.WriteString(`<a href="` + template.HTMLEscapeString(safeURL(dest)) + `"`)
+          if title != "" { r.out.WriteString(` title="` + template.HTMLEscapeString(title) + `"`) }
+          r.out.WriteString(">")
+          r.inline(label)
+          r.out.WriteString("</a>")
+          i += n
+          continue
+        }
+
+      case c == '<':
+        if m := autolink.FindStringSubmatch(text[i:]); m != nil {
+          href := m[1]
+          if !strings.Contains(href, "://") { href = "mailto:" + href }
+          r.out.WriteString(`<a href="` + template.HTMLEscapeString(href) + `">` + template.HTMLEscapeString(m[1]) + "</a>")
+          i += len(m[0])
+          continue
+        }
+
+      case c == '*' || c == '_':
+        n := 1
+        if i+1 < len(text) && text[i+1] == c { n = 2 }
+        if end := findEmphasisEnd(text, i, n); end > 0 {
+          tag := "em"
+          if n == 2 { tag = "strong" }
+          r.out.WriteString("<" + tag + ">")
+          r.inline(text[i+n:end])
+          r.out.WriteString("</" + tag + ">")
+          i = end + n
+          continue
+        }
+        r.out.WriteString(text[i:i+n])
+        i += n
+        continue
+    }
+
+    r.out.WriteString(template.HTMLEscapeString(text[i:i+1]))
+    i++
+  }
+}
+
+// Returns the position of the first run of backticks in s that is exactly delim
+// or -1 if there is none.
+func findRun(s, delim string) int {
+  for k := 0; k < len(s); {
+    if s[k] != '`' { k++; continue }
+    n := 0
+    for k+n < len(s) && s[k+n] == '`' { n++ }
+    if n == len(delim) { return k }
+    k += n
+  }
+  return -1
+}
+
+func isSpace(c byte) bool { return c == ' ' || c == '\n' }
+
+func isAlnum(c byte) bool {
+  return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c >= 0x80
+}
+
+/*
+  text[i:i+n] is a run of n '*' or '_'. If it opens an emphasis that is closed
+  later in text, the position of the closing run is returned. Otherwise -1.
+*/
+func findEmphasisEnd(text string, i, n int) int {
+  c := text[i]
+  delim := text[i:i+n]
+  if i+n >= len(text) || isSpace(text[i+n]) { return -1 }
+  if c == '_' && i > 0 && isAlnum(text[i-1]) { return -1 } // no intraword _
+
+  for k := i + n + 1; k+n <= len(text); k++ {
+    switch text[k] {
+      case '\\': k++; continue
+      case '`': // skip code spans
+        m := 0
+        for k+m < len(text) && text[k+m] == '`' { m++ }
+        if end := findRun(text[k+m:], text[k:k+m]); end >= 0 { k += m + end + m - 1 } else { k += m - 1 }
+        continue
+    }
+    if text[k:k+n] != delim || isSpace(text[k-1]) { continue }
+    if n == 1 && k+1 < len(text) && text[k+1] == c {
+      // part of a longer run; skip it (it may close a nested strong)
+      for k+1 < len(text) && text[k+1] == c { k++ }
+      continue
+    }
+    if c == '_' && k+n < len(text) && isAlnum(text[k+n]) { continue }
+    return k
+  }
+  return -1
+}
+
+/*
+  s starts with "[". If it is a link [label](dest "title"), its parts are
+  returned together with the length of the link in s. Otherwise n is 0.
+*/
+func parseLink(s string) (label, dest, title string, n int) {
+  depth := 0
+  end := -1
+  for k := 0; k < len(s) && end < 0; k++ {
+    switch s[k] {
+      case '\\': k++
+      case '[':  depth++
+      case ']':  depth--; if depth == 0 { end = k }
+      case '`':  m := 0
+                 for k+m < len(s) && s[k+m] == '`' { m++ }
+                 if e := findRun(s[k+m:], s[k:k+m]); e >= 0 { k += m + e + m - 1 } else { k += m - 1 }
+    }
+  }
+  if end < 0 || end+1 >= len(s) || s[end+1] != '(' { return }
+
+  label = s[1:end]
+  rest := s[end+2:]
+  k := 0
+  for k < len(rest) && isSpace(rest[k]) { k++ }
+  if k < len(rest) && rest[k] == '<' {
+    close := strings.IndexByte(rest[k:], '>')
+    if close < 0 { return }
+    dest = rest[k+1:k+close]
+    k += close + 1
+  } else {
+    start := k
+    parens := 0
+    for ; k < len(rest) && !isSpace(rest[k]); k++ {
+      if rest[k] == '\\' { k++; continue }
+      if rest[k] == '(' { parens++ }
+      if rest[k] == ')' { if parens == 0 { break }; parens-- }
+    }
+    dest = rest[start:k]
+  }
+  for k < len(rest) && isSpace(rest[k]) { k++ }
+  if k < len(rest) && (rest[k] == '"' || rest[k] == '\'') {
+    q := rest[k]
+    close := strings.IndexByte(rest[k+1:], q)
+    if close < 0 { return }
+    title = rest[k+1:k+1+close]
+    k += close + 2
+    for k < len(rest) && isSpace(rest[k]) { k++ }
+  }
+  if k >= len(rest) || rest[k] != ')' { return }
+
+  return label, dest, title, end + 2 + k + 1
+}
+
+// Returns u unless it uses a scheme that could execute code, in which case "#" is returned.
+func safeURL(u string) string {
+  scheme := strings.ToLower(strings.TrimSpace(u))
+  if i := strings.IndexByte(scheme, ':'); i >= 0 {
+    scheme = strings.Map(func(r rune) rune { if r <= ' ' { return -1 }; return r }, scheme[:i])
+    switch scheme {
+      case "javascript", "vbscript", "data": return "#"
+    }
+  }
+  return u
+}
+
+var markup = regexp.MustCompile("[*_`]|!?\\[|\\]\\([^)]*\\)")
+
+// Returns text with the most common inline markup removed.
+func plainText(text string) string {
+  return strings.Join(strings.Fields(markup.ReplaceAllString(text, "")), " ")
+}
@@ -0,0 +1,192 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+/*
+  Writes the maven-metadata.xml files of a Maven repository (layout
+  groupId/artifactId/version/artifactId-version[-classifier].extension)
+  that Maven and Gradle use to find the versions of an artifact.
+*/
+package maven
+
+import (
+         "io"
+         "fmt"
+         "sort"
+         "time"
+         "bufio"
+         "regexp"
+         "strings"
+         "strconv"
+         "encoding/xml"
+       )
+
+// The extensions of the checksum files next to each file in a repository.
+var ChecksumTypes = []string{"md5", "sha1", "sha256", "sha512"}
+
+// Returns true if name is the name of a checksum file.
+func IsChecksum(name string) bool {
+  for _, typ := range ChecksumTypes {
+    if strings.HasSuffix(name, "." + typ) { return true }
+  }
+  return false
+}
+
+// The format of timestamps in metadata.
+const timestampFormat = "20060102150405"
+
+// Returns s escaped for use in XML text.
+func esc(s string) string {
+  var b strings.Builder
+  xml.EscapeText(&b, []byte(s))
+  return b.String()
+}
+
+/*
+  Writes the maven-metadata.xml of the artifact groupId:artifactId (the
+  file in the artifactId directory) that lists versions. lastUpdated is
+  the time of the latest deployment.
+*/
+func WriteArtifactMetadata(out io.Writer, groupId, artifactId string, versions []string, lastUpdated time.Time) error {
+  versions = append([]string{}, versions...)
+  sort.Slice(versions, func(i, j int) bool { return CompareVersions(versions[i], versions[j]) < 0 })
+  release := ""
+  for _, v := range versions {
+    if !strings.HasSuffix(v, "-SNAPSHOT") { release = v }
+  }
+  
+  w := bufio.NewWriter(out)
+  w.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<metadata>\n")
+  fmt.Fprintf(w, "  <groupId>%v</groupId>\n  <artifactId>%v</artifactId>\n", esc(groupId), esc(artifactId))
+  w.WriteString("  <versioning>\n")
+  if len(versions) > 0 { fmt.Fprintf(w, "    <latest>%v</latest>\n", esc(versions[len(versions)-1])) }
+  if release != "" { fmt.Fprintf(w, "    <release>%v</release>\n", esc(release)) }
+  w.WriteString("    <versions>\n")
+  for _, v := range versions { fmt.Fprintf(w, "      <version>%v</version>\n", esc(v)) }
+  w.WriteString("    </versions>\n")
+  fmt.Fprintf(w, "    <lastUpdated>%v</lastUpdated>\n", lastUpdated.UTC().Format(timestampFormat))
+  w.WriteString("  </versioning>\n</metadata>\n")
+  return w.Flush()
+}
+
+// A deployed file of a SNAPSHOT version.
+type snapshotFile struct {
+  timestamp string
+  build int
+  classifier, extension string
+}
+
+/*
+  Writes the maven-metadata.xml of the SNAPSHOT version of groupId:artifactId
+  (the file in the version directory) that tells which of the files, e.g.
+  artifactId-1.0-20240101.120000-3.jar, are the latest build. files are the
+  names of the files in the version directory. Returns false if there are
+  no timestamped files, in which case nothing is written.
+*/
+func WriteSnapshotMetadata(out io.Writer, groupId, artifactId, version string, files []string, lastUpdated time.Time) (bool, error) {
+  base := strings.TrimSuffix(version, "-SNAPSHOT")
+  re := regexp.MustCompile(`^` + regexp.QuoteMeta(artifactId + "-" + base) + `-(\d{8}\.\d{6})-(\d+)(?:-([^.]+))?\.(.+)$`)
+  latest := map[string]snapshotFile{}
+  var newest *snapshotFile
+  for _, name := range files {
+    m := re.FindStringSubmatch(name)
+    if m == nil || IsChecksum(name) || strings.HasSuffix(name, ".asc") { continue }
+    build, _ := strconv.Atoi(m[2])
+    f := snapshotFile{timestamp:m[1], build:build, classifier:m[3], extension:m[4]}
+    key := f.classifier + "." + f.extension
+    if old, ok := latest[key]; !ok || old.build < f.build { latest[key] = f }
+    if newest == nil || newest.build < f.build { newest = &f }
+  }
+  if newest == nil { return false, nil }
+  
+  keys := []string{}
+  for key := range latest { keys = append(keys, key) }
+  sort.Strings(keys)
+  
+  updated := lastUpdated.UTC().Format(timestampFormat)
+  w := bufio.NewWriter(out)
+  w.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<metadata modelVersion=\"1.1.0\">\n")
+  fmt.Fprintf(w, "  <groupId>%v</groupId>\n  <artifactId>%v</artifactId>\n  <version>%v</version>\n", esc(groupId), esc(artifactId), esc(version))
+  w.WriteString("  <versioning>\n")
+  fmt.Fprintf(w, "    <snapshot>\n      <timestamp>%v</timestamp>\n      <buildNumber>%v</buildNumber>\n    </snapshot>\n", newest.timestamp, newest.build)
+  fmt.Fprintf(w, "    <lastUpdated>%v</lastUpdated>\n", updated)
+  w.WriteString("    <snapshotVersions>\n")
+  for _, key := range keys {
+    f := latest[key]
+    w.WriteString("      <snapshotVersion>\n")
+    if f.classifier != "" { fmt.Fprintf(w, "        <classifier>%v</classifier>\n", esc(f.classifier)) }
+    fmt.Fprintf(w, "        <extension>%v</extension>\n", esc(f.extension))
+    fmt.Fprintf(w, "        <value>%v-%v-%v</value>\n", esc(base), f.timestamp, f.build)
+    fmt.Fprintf(w, "        <updated>%v</updated>\n", updated)
+    w.WriteString("      </snapshotVersion>\n")
+  }
+  w.WriteString("    </snapshotVersions>\n  </versioning>\n</metadata>\n")
+  return true, w.Flush()
+}
+
+// Qualifiers in the order of the releases they stand for. "" is the release itself.
+var qualifiers = []string{"alpha", "beta", "milestone", "rc", "snapshot", "", "sp"}
+var qualifierAliases = map[string]string{"a":"alpha", "b":"beta", "m":"milestone", "cr":"rc", "ga":"", "final":"", "release":""}
+
+var versionToken = regexp.MustCompile(`[0-9]+|[^0-9.\-_]+`)
+
+/*
+  Compares the versions a and b like Maven (e.g. 1.0-alpha < 1.0-rc1 <
+  1.0-SNAPSHOT < 1.0 < 1.0-sp1 < 1.0.1 < 1.10) and returns -1, 0 or 1.
+  This is a simplification of Maven's ComparableVersion that gives the
+  same order for all common version schemes.
+*/
+func CompareVersions(a, b string) int {
+  ta := versionToken.FindAllString(strings.ToLower(a), -1)
+  tb := versionToken.FindAllString(strings.ToLower(b), -1)
+  for i := 0; i < len(ta) || i < len(tb); i++ {
+    x, y := "", ""
+    if i < len(ta) { x = ta[i] }
+    if i < len(tb) { y = tb[i] }
+    if c := compareTokens(x, y); c != 0 { return c }
+  }
+  return 0
+}
+
+// Compares two components of versions. "" is a missing component.
+func compareTokens(x, y string) int {
+  nx, errx := strconv.ParseUint(x, 10, 64)
+  ny, erry := strconv.ParseUint(y, 10, 64)
+  switch {
+    case errx == nil && erry == nil:
+      if nx < ny { return -1 }
+      if nx > ny { return 1 }
+      return 0
+    // A missing component is like 0 if the other one is a number: 1.0 == 1.0.0
+    case errx == nil && y == "": if nx == 0 { return 0 } else { return 1 }
+    case erry == nil && x == "": if ny == 0 { return 0 } else { return -1 }
+    // Numbers come after qualifiers: 1-rc < 1.1 and 1-sp < 1.1
+    case errx == nil: return 1
+    case erry == nil: return -1
+  }
+  if alias, ok := qualifierAliases[x]; ok { x = alias }
+  if alias, ok := qualifierAliases[y]; ok { y = alias }
+  rx, ry := qualifierRank(x), qualifierRank(y)
+  if rx < ry { return -1 }
+  if rx > ry { return 1 }
+  return strings.Compare(x, y)
+}
+
+// Returns the position of the qualifier q in the release order. Unknown
+// qualifiers come after all known ones.
+func qualifierRank(q string) int {
+  for i, known := range qualifiers {
+    if q == known { return i }
+  }
+  return len(qualifiers)
+}
@@ -0,0 +1,195 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package notify
+
+import (
+         "io"
+         "fmt"
+         "net"
+         "html"
+         "time"
+         "bytes"
+         "context"
+         "strings"
+         "net/url"
+         "net/http"
+         "io/ioutil"
+         "sync/atomic"
+         "crypto/x509"
+         "encoding/json"
+       )
+
+// Slack rejects the text of a section block if it is longer than 3000 characters.
+const slackMaxText = 2900
+
+// The connector that posts notifications to a Slack channel via an incoming webhook.
+type slackConnector struct {
+  endpoint *url.URL
+  client *http.Client
+}
+
+// The connector that posts notifications as m.notice messages to a Matrix room.
+type matrixConnector struct {
+  // The base URL of the homeserver.
+  server *url.URL
+  room string
+  token string
+  client *http.Client
+}
+
+// Makes the transaction ids of Matrix messages unique. Atomic.
+var matrixTxn int64
+
+/*
+  Returns a client for requests to the host of u whose name is resolved
+  right away, so that this can be called before chroot.
+*/
+func newClient(u *url.URL) (*http.Client, error) {
+  if u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+    return nil, fmt.Errorf("Expected http:// or https:// URL, got %v", u)
+  }
+  addrs, err := net.LookupHost(u.Hostname())
+  if err != nil { return nil, err }
+  if u.Scheme == "https" {
+    _, err = x509.SystemCertPool()
+    if err != nil { return nil, err }
+  }
+  dialer := &net.Dialer{Timeout:10*time.Second}
+  return &http.Client{
+    Timeout: 30*time.Second,
+    Transport: &http.Transport{
+      DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+        host, port, err := net.SplitHostPort(addr)
+        if err != nil { return nil, err }
+        if host == u.Hostname() {
+          for _, ip := range addrs {
+            conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+            if err == nil { return conn, nil }
+          }
+        }
+        return dialer.DialContext(ctx, network, addr)
+      },
+    },
+  }, nil
+}
+
+/*
+  Posts notifications of events to a Slack channel. spec is
+  "event[,event...]:URL", where URL is the channel's incoming webhook
+  (https://hooks.slack.com/services/...). Call before chroot.
+*/
+func AddSlack(spec string) error {
+  events, dest, err := parseRoute(spec)
+  if err != nil { return err }
+  u, err := url.Parse(dest)
+  if err != nil { return err }
+  client, err := newClient(u)
+  if err != nil { return err }
+  addRoute(events, &slackConnector{endpoint:u, client:client})
+  return nil
+}
+
+/*
+  Posts notifications of events to a Matrix room. spec is
+  "event[,event...]:https://homeserver/!roomid:server" with the room's
+  internal id (not an alias like #room:server). tokenfile contains the
+  access token of the account that posts, which must have joined the
+  room. Call before chroot.
+*/
+func AddMatrix(spec, tokenfile string) error {
+  events, dest, err := parseRoute(spec)
+  if err != nil { return err }
+  u, err := url.Parse(dest)
+  if err != nil { return err }
+  room := strings.TrimPrefix(u.Path, "/")
+  if !strings.HasPrefix(room, "!") || !strings.Contains(room, ":") {
+    return fmt.Errorf("Expected https://homeserver/!roomid:server, got %v", dest)
+  }
+  if tokenfile == "" { return fmt.Errorf("No access token") }
+  data, err := ioutil.ReadFile(tokenfile)
+  if err != nil { return err }
+  token := strings.TrimSpace(string(data))
+  if token == "" || strings.ContainsAny(token, " \n") { return fmt.Errorf("%v: Expected an access token", tokenfile) }
+  client, err := newClient(u)
+  if err != nil { return err }
+  server := &url.URL{Scheme:u.Scheme, Host:u.Host}
+  addRoute(events, &matrixConnector{server:server, room:room, token:token, client:client})
+  return nil
+}
+
+func (s *slackConnector) String() string {
+  // The path of the webhook is its secret.
+  return "Slack " + s.endpoint.Host
+}
+
+func (s *slackConnector) deliver(n *Notification) error {
+  escape := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace
+  text := func(t string) map[string]string { return map[string]string{"type":"mrkdwn", "text":t} }
+  blocks := []interface{}{
+    map[string]interface{}{"type":"section", "text":text("*" + escape(n.Subject) + "*")},
+  }
+  if n.Message != "" {
+    blocks = append(blocks, map[string]interface{}{"type":"section", "text":text("```" + escape(truncate(n.Message, slackMaxText)) + "```")})
+  }
+  blocks = append(blocks, map[string]interface{}{"type":"context", "elements":[]interface{}{text(escape(fmt.Sprintf("Garçon on %v · %v", n.Host, n.Event)))}})
+  data, _ := json.Marshal(map[string]interface{}{"text":n.Subject, "blocks":blocks})
+  req, err := http.NewRequest("POST", s.endpoint.String(), bytes.NewReader(data))
+  if err != nil { return err }
+  req.Header.Set("Content-Type", "application/json")
+  return do(s.client, req)
+}
+
+func (m *matrixConnector) String() string {
+  return fmt.Sprintf("Matrix %v on %v", m.room, m.server.Host)
+}
+
+func (m *matrixConnector) deliver(n *Notification) error {
+  body := n.Subject
+  formatted := "<strong>" + html.EscapeString(n.Subject) + "</strong>"
+  if n.Message != "" {
+    body += "\n\n" + n.Message
+    formatted += "<pre><code>" + html.EscapeString(n.Message) + "</code></pre>"
+  }
+  formatted += "<p><em>" + html.EscapeString(fmt.Sprintf("Garçon on %v · %v", n.Host, n.Event)) + "</em></p>"
+  data, _ := json.Marshal(map[string]string{"msgtype":"m.notice", "body":body, "format":"org.matrix.custom.html", "formatted_body":formatted})
+  txn := fmt.Sprintf("garcon.%v.%v", n.Time.UnixNano(), atomic.AddInt64(&matrixTxn, 1))
+  endpoint := m.server.String() + "/_matrix/client/v3/rooms/" + url.PathEscape(m.room) + "/send/m.room.message/" + txn
+  req, err := http.NewRequest("PUT", endpoint, bytes.NewReader(data))
+  if err != nil { return err }
+  req.Header.Set("Content-Type", "application/json")
+  req.Header.Set("Authorization", "Bearer " + m.token)
+  return do(m.client, req)
+}
+
+// Makes the request req with client and returns an error unless the answer is 2xx.
+func do(client *http.Client, req *http.Request) error {
+  resp, err := client.Do(req)
+  // Without the URL, which may contain a secret.
+  if e, ok := err.(*url.Error); ok { return e.Err }
+  if err != nil { return err }
+  defer resp.Body.Close()
+  if resp.StatusCode/100 != 2 {
+    msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 200))
+    return fmt.Errorf("%v: %v", resp.Status, strings.TrimSpace(string(msg)))
+  }
+  return nil
+}
+
+// Returns s shortened to at most max characters.
+func truncate(s string, max int) string {
+  r := []rune(s)
+  if len(r) <= max { return s }
+  return string(r[:max-1]) + "…"
+}
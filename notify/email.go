@@ -0,0 +1,229 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package notify
+
+import (
+         "os"
+         "fmt"
+         "net"
+         "mime"
+         "time"
+         "bytes"
+         "strings"
+         "unicode"
+         "net/smtp"
+         "io/ioutil"
+         "crypto/tls"
+         "crypto/x509"
+         "text/template"
+       )
+
+// The template of an email if there is none for its event in the
+// directory passed to SetTemplates(). The output consists of header lines
+// (at least Subject:), an empty line and the body. Its data is a Notification.
+const defaultTemplate = `Subject: [Garçon {{.Host}}] {{.Subject}}
+
+{{.Message}}
+
+--
+Garçon on {{.Host}}, {{.Time.Format "2006-01-02 15:04:05 MST"}}
+Event: {{.Event}}
+`
+
+var defaultTmpl = template.Must(template.New("default").Parse(defaultTemplate))
+
+// The SMTP server. nil until SetServer() is called.
+var mailer *smtpMailer
+
+type smtpMailer struct {
+  // The server's host name as given to SetServer(), for TLS and authentication.
+  host string
+  port string
+  // The addresses of host, resolved before chroot.
+  addrs []string
+  auth smtp.Auth
+  from string
+  // The templates by event. See SetTemplates().
+  templates map[string]*template.Template
+}
+
+// The connector that emails notifications to addresses.
+type emailConnector []string
+
+/*
+  Sends emails via the SMTP server "host[:port]" (default port 25; with
+  port 465 the connection uses TLS right away, otherwise STARTTLS if the
+  server offers it). If authfile is not "", its first line is
+  "user:password" for logging in to the server, which requires TLS unless
+  the server is localhost. from is the sender's address ("" for
+  garcon@hostname). The host name is resolved and authfile is read right
+  away, so that this can be called before chroot.
+*/
+func SetServer(server, authfile, from string) error {
+  host, port, err := net.SplitHostPort(server)
+  if err != nil { host, port = server, "25" }
+  if host == "" { return fmt.Errorf("Expected host[:port], got %v", server) }
+  addrs, err := net.LookupHost(host)
+  if err != nil { return err }
+  _, err = x509.SystemCertPool()
+  if err != nil { return err }
+  m := &smtpMailer{host:host, port:port, addrs:addrs, from:from, templates:map[string]*template.Template{}}
+  if authfile != "" {
+    data, err := ioutil.ReadFile(authfile)
+    if err != nil { return err }
+    userpass := strings.SplitN(strings.TrimSpace(strings.SplitN(string(data), "\n", 2)[0]), ":", 2)
+    if len(userpass) != 2 || userpass[0] == "" { return fmt.Errorf("%v: Expected user:password", authfile) }
+    m.auth = smtp.PlainAuth("", userpass[0], userpass[1], host)
+  }
+  if m.from == "" { m.from = "garcon@" + hostname() }
+  mailer = m
+  return nil
+}
+
+/*
+  Emails notifications of events to recipients. spec is
+  "event[,event...]:address[,address...]", where event is one of Events
+  or "all". Call after SetServer().
+*/
+func AddRecipients(spec string) error {
+  if mailer == nil { return fmt.Errorf("No SMTP server") }
+  events, to, err := parseRoute(spec)
+  if err != nil { return err }
+  addresses := emailConnector{}
+  for _, address := range strings.Split(to, ",") {
+    address = strings.TrimSpace(address)
+    if !strings.Contains(address, "@") { return fmt.Errorf("Not an email address: %v", address) }
+    addresses = append(addresses, address)
+  }
+  addRoute(events, addresses)
+  return nil
+}
+
+/*
+  Reads the templates <event>.tmpl from dir (Go text/template, see
+  defaultTemplate) that replace the default email template for their
+  events. Call after SetServer() and before chroot.
+*/
+func SetTemplates(dir string) error {
+  if mailer == nil { return fmt.Errorf("No SMTP server") }
+  found := false
+  for _, event := range Events {
+    file := dir + "/" + event + ".tmpl"
+    data, err := ioutil.ReadFile(file)
+    if os.IsNotExist(err) { continue }
+    if err != nil { return err }
+    t, err := template.New(event).Parse(string(data))
+    if err != nil { return err }
+    mailer.templates[event] = t
+    found = true
+  }
+  if !found { return fmt.Errorf("%v contains none of the templates %v.tmpl", dir, strings.Join(Events, ".tmpl, ")) }
+  return nil
+}
+
+func (to emailConnector) String() string {
+  return strings.Join(to, ", ")
+}
+
+func (to emailConnector) deliver(n *Notification) error {
+  msg, err := mailer.message(n, to)
+  if err != nil { return err }
+  return mailer.deliver(to, msg)
+}
+
+// Returns the email message for n to the addresses to.
+func (m *smtpMailer) message(n *Notification, to []string) ([]byte, error) {
+  t := m.templates[n.Event]
+  if t == nil { t = defaultTmpl }
+  // The single-line fields usually end up in headers. They may contain
+  // names chosen by clients (e.g. of uploads), which must not be able to
+  // add header lines or end the header.
+  data := *n
+  data.Event, data.Key, data.Subject, data.Host = oneLine(n.Event), oneLine(n.Key), oneLine(n.Subject), oneLine(n.Host)
+  var out bytes.Buffer
+  if err := t.Execute(&out, &data); err != nil { return nil, err }
+  text := strings.Replace(out.String(), "\r\n", "\n", -1)
+  head, body := text, ""
+  if i := strings.Index(text, "\n\n"); i >= 0 { head, body = text[0:i], text[i+2:] }
+  
+  var msg bytes.Buffer
+  header := func(name, value string) { fmt.Fprintf(&msg, "%v: %v\r\n", name, mime.QEncoding.Encode("utf-8", value)) }
+  header("From", m.from)
+  header("To", strings.Join(to, ", "))
+  header("Date", n.Time.Format(time.RFC1123Z))
+  for _, line := range strings.Split(head, "\n") {
+    kv := strings.SplitN(line, ":", 2)
+    if len(kv) != 2 || strings.IndexFunc(line, unicode.IsControl) >= 0 { return nil, fmt.Errorf("Template of %v: Illegal header line %q", n.Event, line) }
+    header(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+  }
+  msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+  // The writer of smtp.Client.Data() escapes lines starting with ".".
+  msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+  return msg.Bytes(), nil
+}
+
+// Delivers msg to the addresses to via the SMTP server.
+func (m *smtpMailer) deliver(to []string, msg []byte) error {
+  var conn net.Conn
+  var err error
+  dialer := &net.Dialer{Timeout:30*time.Second}
+  for _, addr := range m.addrs {
+    if m.port == "465" {
+      conn, err = tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(addr, m.port), &tls.Config{ServerName:m.host})
+    } else {
+      conn, err = dialer.Dial("tcp", net.JoinHostPort(addr, m.port))
+    }
+    if err == nil { break }
+  }
+  if err != nil { return err }
+  conn.SetDeadline(time.Now().Add(2*time.Minute))
+  c, err := smtp.NewClient(conn, m.host)
+  if err != nil {
+    conn.Close()
+    return err
+  }
+  defer c.Close()
+  if err = c.Hello(hostname()); err != nil { return err }
+  if ok, _ := c.Extension("STARTTLS"); ok && m.port != "465" {
+    if err = c.StartTLS(&tls.Config{ServerName:m.host}); err != nil { return err }
+  }
+  if m.auth != nil {
+    if err = c.Auth(m.auth); err != nil { return err }
+  }
+  if err = c.Mail(m.from); err != nil { return err }
+  for _, address := range to {
+    if err = c.Rcpt(address); err != nil { return err }
+  }
+  w, err := c.Data()
+  if err != nil { return err }
+  if _, err = w.Write(msg); err != nil { return err }
+  if err = w.Close(); err != nil { return err }
+  return c.Quit()
+}
+
+// Returns s with control characters (e.g. line breaks) replaced by spaces.
+func oneLine(s string) string {
+  return strings.Map(func(r rune) rune {
+    if unicode.IsControl(r) { return ' ' }
+    return r
+  }, s)
+}
+
+// Returns the host name of the machine or "localhost".
+func hostname() string {
+  host, err := os.Hostname()
+  if err != nil || host == "" { return "localhost" }
+  return host
+}
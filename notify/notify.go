@@ -0,0 +1,180 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+/*
+  Sends notifications about events that need an operator's attention
+  (e.g. rejected packages or expiring certificates) or that a team wants
+  to follow (e.g. published repositories) by email, to Slack channels and
+  to Matrix rooms.
+*/
+package notify
+
+import (
+         "fmt"
+         "sync"
+         "time"
+         "strings"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../status"
+       )
+
+// The events that notifications can be sent for.
+const (
+  // An uploaded package (e.g. a .deb or .rpm) has been put in place.
+  PackageAccepted = "package-accepted"
+  // An upload has been rejected by a validator, e.g. because its signature could not be verified.
+  PackageRejected = "package-rejected"
+  // Another tree or a copy of a Debian suite is being served.
+  RepoPublished = "repo-published"
+  // Fetching from the upstream server of a proxy (mirror) has failed.
+  MirrorFailed = "mirror-failed"
+  // A TLS certificate expires soon or has expired.
+  CertificateExpiry = "certificate-expiry"
+  // An upload has exceeded a quota or the disk is full.
+  QuotaExceeded = "quota-exceeded"
+  // The tree is not up to date or its root directory is unavailable (like the alert webhook).
+  Alert = "alert"
+)
+
+// All events, in the order in which they are documented.
+var Events = []string{PackageAccepted, PackageRejected, RepoPublished, MirrorFailed, CertificateExpiry, QuotaExceeded, Alert}
+
+// Notifications for the same event and key are sent at most once in this interval.
+var Interval = time.Hour
+
+// A notification as passed to the connectors and to email templates.
+type Notification struct {
+  Event string
+  // What the notification is about, e.g. the path of an upload.
+  Key string
+  Subject string
+  Message string
+  // The host name of the machine Garçon runs on.
+  Host string
+  Time time.Time
+}
+
+// Delivers notifications somewhere, e.g. to email addresses or a chat room.
+type connector interface {
+  deliver(n *Notification) error
+  // Describes where the notifications go for the log.
+  String() string
+}
+
+// The connectors by event. Only changed before Send() is first called.
+var routes = map[string][]connector{}
+
+// A notification waiting to be delivered by a connector.
+type delivery struct {
+  n *Notification
+  c connector
+}
+
+// The deliveries waiting to be made. Created by addRoute().
+var queue chan *delivery
+
+// Protects sent.
+var mutex sync.Mutex
+
+// When a notification was last sent for an event and key (separated by "\x00").
+var sent = map[string]time.Time{}
+
+var (
+  notificationsSent = status.NewCounter(`garcon_notifications_total{result="sent"}`, "Notifications (per email, Slack or Matrix destination) by whether they were sent, failed, were dropped because the queue was full or were suppressed as repeats.")
+  notificationsFailed = status.NewCounter(`garcon_notifications_total{result="failed"}`, "Notifications (per email, Slack or Matrix destination) by whether they were sent, failed, were dropped because the queue was full or were suppressed as repeats.")
+  notificationsDropped = status.NewCounter(`garcon_notifications_total{result="dropped"}`, "Notifications (per email, Slack or Matrix destination) by whether they were sent, failed, were dropped because the queue was full or were suppressed as repeats.")
+  notificationsSuppressed = status.NewCounter(`garcon_notifications_total{result="suppressed"}`, "Notifications (per email, Slack or Matrix destination) by whether they were sent, failed, were dropped because the queue was full or were suppressed as repeats.")
+)
+
+/*
+  Splits spec "event[,event...]:destination" at the first ":" and returns
+  the events (with "all" replaced by Events) and the destination.
+*/
+func parseRoute(spec string) ([]string, string, error) {
+  i := strings.Index(spec, ":")
+  if i < 0 || i == len(spec) - 1 { return nil, "", fmt.Errorf("Expected event[,event...]:destination, got %v", spec) }
+  events := []string{}
+  for _, event := range strings.Split(spec[0:i], ",") {
+    event = strings.TrimSpace(event)
+    if event == "all" {
+      events = append(events, Events...)
+      continue
+    }
+    known := false
+    for _, e := range Events { known = known || e == event }
+    if !known { return nil, "", fmt.Errorf("Unknown event %v. Expected one of %v or all", event, strings.Join(Events, ", ")) }
+    events = append(events, event)
+  }
+  return events, spec[i+1:], nil
+}
+
+// Makes Send() pass the notifications of events to c.
+func addRoute(events []string, c connector) {
+  for _, event := range events { routes[event] = append(routes[event], c) }
+  if queue == nil {
+    queue = make(chan *delivery, 100)
+    go deliverQueued()
+  }
+}
+
+// Returns true if notifications of event are sent.
+func Enabled(event string) bool {
+  return len(routes[event]) > 0
+}
+
+/*
+  Sends a notification of event about key (e.g. a path) with subject and
+  the body message to the destinations of event in the background, unless
+  one has been sent for the same event and key within the Interval.
+*/
+func Send(event, key, subject, message string) {
+  if !Enabled(event) { return }
+  now := time.Now()
+  mutex.Lock()
+  last, ok := sent[event + "\x00" + key]
+  if ok && now.Sub(last) < Interval {
+    mutex.Unlock()
+    notificationsSuppressed.Inc()
+    return
+  }
+  sent[event + "\x00" + key] = now
+  for k, t := range sent {
+    if now.Sub(t) >= Interval { delete(sent, k) }
+  }
+  mutex.Unlock()
+  
+  n := &Notification{Event:event, Key:key, Subject:subject, Message:message, Host:hostname(), Time:now}
+  for _, c := range routes[event] {
+    select {
+      case queue <- &delivery{n:n, c:c}:
+      default: notificationsDropped.Inc()
+               util.Log(0, "ERROR! Notification queue full. Dropped for %v: %v", c, n.Subject)
+    }
+  }
+}
+
+// Makes the deliveries from the queue. Never returns.
+func deliverQueued() {
+  for d := range queue {
+    if err := d.c.deliver(d.n); err != nil {
+      notificationsFailed.Inc()
+      util.Log(0, "ERROR! Sending notification \"%v\" to %v: %v", d.n.Subject, d.c, err)
+      continue
+    }
+    notificationsSent.Inc()
+    util.Log(1, "Notification \"%v\" sent to %v", d.n.Subject, d.c)
+  }
+}
@@ -0,0 +1,185 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package pgp
+
+import (
+         "io"
+         "fmt"
+         "net"
+         "time"
+         "bytes"
+         "crypto"
+         "context"
+         "os/exec"
+         "net/url"
+         "net/http"
+         "io/ioutil"
+         "crypto/rsa"
+         "crypto/x509"
+         "crypto/ed25519"
+       )
+
+// Signing backends that take longer than this fail.
+var BackendTimeout = 60*time.Second
+
+// The DER prefix of the DigestInfo of a SHA-256 hash (RFC 8017 9.2), which
+// RSA keys sign.
+var sha256DigestInfo = []byte{0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20}
+
+/*
+  Returns the key from the public key export public (see ReadPublicKey())
+  whose signatures are made by sign, which has the secret key. sign gets
+  what the key has to sign: For RSA keys the DER encoded DigestInfo of a
+  SHA-256 hash (like the PKCS#11 mechanism CKM_RSA_PKCS or "openssl pkeyutl
+  -sign" expect), for Ed25519 keys the SHA-256 hash itself (CKM_EDDSA).
+  It must return the raw signature (for Ed25519 R followed by S), which
+  is checked against the public key before it is used.
+*/
+func NewExternalKey(public io.Reader, sign func(tbs []byte) ([]byte, error)) (*Key, error) {
+  k, err := ReadPublicKey(public)
+  if err != nil { return nil, err }
+  k.raw = sign
+  return k, nil
+}
+
+/*
+  Returns the key from the public key export public, whose signatures are
+  made by running command, e.g. for a key on a PKCS#11 token
+    pkcs11-tool --module /usr/lib/opensc-pkcs11.so --id 01 --login --pin 123456 --sign --mechanism RSA-PKCS
+  The command gets what to sign (see NewExternalKey()) on stdin and must
+  write the raw signature to stdout. If it fails or takes longer than
+  BackendTimeout, its stderr is part of the error. If Garçon runs in a
+  chroot, the command must be available inside it.
+*/
+func NewCommandKey(public io.Reader, command []string) (*Key, error) {
+  if len(command) == 0 { return nil, fmt.Errorf("Signing command missing") }
+  return NewExternalKey(public, func(tbs []byte) ([]byte, error) {
+    return runBackend(command, bytes.NewReader(tbs))
+  })
+}
+
+/*
+  Returns the key from the public key export public, whose signatures are
+  made by a signing service at rawurl. Each signature is requested with a
+  POST of what to sign (see NewExternalKey()) as application/octet-stream
+  with the key's fingerprint in the header X-Garcon-Key-Fingerprint. The
+  service must answer with 200 and the raw signature. User and password
+  in rawurl are sent with basic authentication. The host name is resolved
+  right away and the system's trusted certificates are loaded, because
+  neither is available after chroot.
+  Call before chroot.
+*/
+func NewRemoteKey(public io.Reader, rawurl string) (*Key, error) {
+  u, err := url.Parse(rawurl)
+  if err != nil { return nil, err }
+  if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+    return nil, fmt.Errorf("Expected http:// or https:// URL, got %v", rawurl)
+  }
+  addrs, err := net.LookupHost(u.Hostname())
+  if err != nil { return nil, err }
+  if u.Scheme == "https" {
+    _, err = x509.SystemCertPool()
+    if err != nil { return nil, err }
+  }
+  dialer := &net.Dialer{Timeout:30*time.Second}
+  client := &http.Client{
+    Timeout: BackendTimeout,
+    Transport: &http.Transport{
+      Proxy: http.ProxyFromEnvironment,
+      DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+        host, port, err := net.SplitHostPort(addr)
+        if err != nil { return nil, err }
+        if host == u.Hostname() {
+          for _, ip := range addrs {
+            conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+            if err == nil { return conn, nil }
+          }
+        }
+        return dialer.DialContext(ctx, network, addr)
+      },
+    },
+  }
+  
+  var k *Key
+  k, err = NewExternalKey(public, func(tbs []byte) ([]byte, error) {
+    req, err := http.NewRequest("POST", u.String(), bytes.NewReader(tbs))
+    if err != nil { return nil, err }
+    req.Header.Set("Content-Type", "application/octet-stream")
+    req.Header.Set("X-Garcon-Key-Fingerprint", fmt.Sprintf("%X", k.Fingerprint))
+    resp, err := client.Do(req)
+    if err != nil { return nil, err }
+    defer resp.Body.Close()
+    sig, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+    if err != nil { return nil, err }
+    if resp.StatusCode != http.StatusOK {
+      return nil, fmt.Errorf("%v: %v %v", u.Host, resp.Status, string(bytes.TrimSpace(sig)))
+    }
+    return sig, nil
+  })
+  return k, err
+}
+
+/*
+  Returns the key keyid from the keyring of gpg, whose signatures are made
+  by "gpg --detach-sign", so that the secret key can stay with gpg-agent
+  (e.g. on a smartcard, or with a passphrase cached by the agent). The
+  public key is read from gpg right away. If Garçon runs in a chroot, gpg,
+  the keyring (GNUPGHOME) and the agent's socket must be available inside
+  it.
+*/
+func NewGPGKey(keyid string) (*Key, error) {
+  public, err := runBackend([]string{"gpg", "--batch", "--export", keyid}, nil)
+  if err != nil { return nil, err }
+  if len(public) == 0 { return nil, fmt.Errorf("gpg does not know key %v", keyid) }
+  k, err := ReadPublicKey(bytes.NewReader(public))
+  if err != nil { return nil, err }
+  // The "!" makes gpg use the primary key instead of a signing subkey.
+  signer := fmt.Sprintf("%X!", k.Fingerprint)
+  k.detach = func(data io.Reader) ([]byte, error) {
+    return runBackend([]string{"gpg", "--batch", "--no-tty", "--detach-sign", "--digest-algo", "SHA256", "--local-user", signer}, data)
+  }
+  return k, nil
+}
+
+// Runs command with stdin and returns its stdout.
+func runBackend(command []string, stdin io.Reader) ([]byte, error) {
+  ctx, cancel := context.WithTimeout(context.Background(), BackendTimeout)
+  defer cancel()
+  cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+  cmd.Stdin = stdin
+  var stdout, stderr bytes.Buffer
+  cmd.Stdout = &stdout
+  cmd.Stderr = &stderr
+  err := cmd.Run()
+  if ctx.Err() != nil { err = fmt.Errorf("timed out after %v", BackendTimeout) }
+  if err != nil { return nil, fmt.Errorf("%v: %v %v", command[0], err, string(bytes.TrimSpace(stderr.Bytes()))) }
+  return stdout.Bytes(), nil
+}
+
+// Has the backend of k sign digest and checks the signature.
+func (k *Key) signRaw(digest []byte) ([]byte, error) {
+  tbs := digest
+  if k.algo == algoRSA { tbs = append(append([]byte{}, sha256DigestInfo...), digest...) }
+  s, err := k.raw(tbs)
+  if err != nil { return nil, fmt.Errorf("Key %v: %v", k, err) }
+  switch k.algo {
+    case algoRSA:
+      err = rsa.VerifyPKCS1v15(&k.rsa.PublicKey, crypto.SHA256, digest, s)
+    case algoEdDSA:
+      if len(s) != ed25519.SignatureSize || !ed25519.Verify(k.edpub, digest, s) { err = fmt.Errorf("verification error") }
+  }
+  if err != nil { return nil, fmt.Errorf("Key %v: The backend's signature does not match the public key: %v", k, err) }
+  return s, nil
+}
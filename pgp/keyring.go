@@ -0,0 +1,117 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package pgp
+
+import (
+         "time"
+         "bytes"
+       )
+
+/*
+  The signing keys of a repository with the time windows in which they are
+  used, for rotating keys without breaking clients: The new key is added
+  with a start date in the future, so that clients can import it from the
+  published keyring (see Export()) while the old one still signs. From the
+  start date on, both keys sign, so that clients accept the metadata with
+  either key. When the old key's end date has passed, it no longer signs and
+  is no longer published.
+  A nil *Keyring has no keys.
+*/
+type Keyring struct {
+  entries []keyringEntry
+}
+
+type keyringEntry struct {
+  key *Key
+  // Zero if the window is open at this end.
+  from, until time.Time
+}
+
+/*
+  Adds k, which signs from the time from (inclusive) until the time until
+  (exclusive). A zero time leaves the window open at that end.
+*/
+func (kr *Keyring) Add(k *Key, from, until time.Time) {
+  kr.entries = append(kr.entries, keyringEntry{key:k, from:from, until:until})
+}
+
+// Returns the number of keys in kr.
+func (kr *Keyring) Len() int {
+  if kr == nil { return 0 }
+  return len(kr.entries)
+}
+
+// Returns the keys that sign at the time now.
+func (kr *Keyring) Signers(now time.Time) []*Key {
+  var keys []*Key
+  if kr == nil { return keys }
+  for _, e := range kr.entries {
+    if (e.from.IsZero() || !now.Before(e.from)) && (e.until.IsZero() || now.Before(e.until)) { keys = append(keys, e.key) }
+  }
+  return keys
+}
+
+// Returns the keys that have not expired at the time now, i.e. the ones
+// that sign now or will sign in the future.
+func (kr *Keyring) Published(now time.Time) []*Key {
+  var keys []*Key
+  if kr == nil { return keys }
+  for _, e := range kr.entries {
+    if e.until.IsZero() || now.Before(e.until) { keys = append(keys, e.key) }
+  }
+  return keys
+}
+
+/*
+  Returns the binary detached signatures of data by all keys that sign at
+  the time now, one Signature Packet per key, or nil if no key signs.
+  Clients such as apt and dnf accept the data if they know one of the keys.
+*/
+func (kr *Keyring) Sign(data []byte, now time.Time) ([]byte, error) {
+  var sigs []byte
+  for _, k := range kr.Signers(now) {
+    sig, err := k.Sign(bytes.NewReader(data))
+    if err != nil { return nil, err }
+    sigs = append(sigs, sig...)
+  }
+  return sigs, nil
+}
+
+/*
+  Returns the armored public keys of all keys that are published at the time
+  now (see Published()), which clients can import with e.g.
+  "rpm --import" or "pacman-key --add", or nil if there are none.
+*/
+func (kr *Keyring) Export(now time.Time) []byte {
+  var keys []byte
+  for _, k := range kr.Published(now) { keys = append(keys, k.Public()...) }
+  if keys == nil { return nil }
+  return Armor(keys, "PGP PUBLIC KEY BLOCK")
+}
+
+/*
+  Returns the first time after now at which a key starts or stops signing,
+  or the zero time if there is none.
+*/
+func (kr *Keyring) NextChange(now time.Time) time.Time {
+  var next time.Time
+  if kr == nil { return next }
+  for _, e := range kr.entries {
+    for _, t := range []time.Time{e.from, e.until} {
+      if t.After(now) && (next.IsZero() || t.Before(next)) { next = t }
+    }
+  }
+  return next
+}
@@ -0,0 +1,391 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+/*
+  Just enough OpenPGP (RFC 4880) to make detached signatures for repository
+  metadata with a key exported from gpg, or with a key whose secret part
+  is kept elsewhere (gpg-agent, a PKCS#11 token, a signing service; see
+  backends.go). There is no support for encryption, verification or
+  passphrase-protected key exports.
+*/
+package pgp
+
+import (
+         "io"
+         "fmt"
+         "time"
+         "bytes"
+         "crypto"
+         "strings"
+         "math/big"
+         "io/ioutil"
+         "crypto/rsa"
+         "crypto/rand"
+         "crypto/sha1"
+         "crypto/sha256"
+         "crypto/ed25519"
+         "encoding/binary"
+         "encoding/base64"
+       )
+
+// Public key algorithms (RFC 4880 9.1 and RFC 6637).
+const (
+  algoRSA = 1
+  algoEdDSA = 22
+)
+
+// OID of the curve of EdDSA keys.
+var ed25519OID = []byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0xda, 0x47, 0x0f, 0x01}
+
+/*
+  A secret key that makes signatures. Only RSA and Ed25519 keys (the
+  kinds gpg creates) are supported.
+*/
+type Key struct {
+  // The v4 fingerprint (20 bytes).
+  Fingerprint []byte
+  
+  algo byte
+  // The packets of the public key export (see Public()).
+  public []byte
+  rsa *rsa.PrivateKey
+  ed ed25519.PrivateKey
+  edpub ed25519.PublicKey
+  
+  // For keys whose secret part is elsewhere (see backends.go): raw makes
+  // the signature of a hash, detach a whole detached signature.
+  raw func(tbs []byte) ([]byte, error)
+  detach func(data io.Reader) ([]byte, error)
+}
+
+/*
+  Reads the primary key from a secret key export (armored or binary), as
+  created by
+    gpg --export-secret-keys --armor KEYID
+  The key must not be protected by a passphrase. Remove it before the export
+  with "gpg --passwd KEYID" or export from a copy of the keyring.
+*/
+func ReadKey(r io.Reader) (*Key, error) {
+  return readKey(r, true)
+}
+
+/*
+  Reads the primary key from a public key export (armored or binary), as
+  created by
+    gpg --export --armor KEYID
+  The resulting Key cannot sign. See backends.go for keys that can.
+*/
+func ReadPublicKey(r io.Reader) (*Key, error) {
+  return readKey(r, false)
+}
+
+// Reads the primary key from a secret or public key export.
+func readKey(r io.Reader, secret bool) (*Key, error) {
+  data, err := ioutil.ReadAll(r)
+  if err != nil { return nil, err }
+  if bytes.Contains(data, []byte("-----BEGIN PGP")) {
+    data, err = Dearmor(data)
+    if err != nil { return nil, err }
+  }
+  var k *Key
+  for len(data) > 0 {
+    tag, body, rest, err := nextPacket(data)
+    if err != nil { return nil, err }
+    data = rest
+    switch tag {
+      case 5, 6:
+        if k != nil { return k, nil }
+        switch {
+          case tag == 5 && secret: k, err = parseSecretKey(body)
+          case tag == 6 && secret: err = fmt.Errorf("Public key without secret key. Export it with \"gpg --export-secret-keys\".")
+          default: k, _, err = parsePublicKey(body)
+        }
+        if err != nil { return nil, err }
+      case 2, 13:
+        // The user IDs and their self-signatures, which gpg needs to import
+        // the public key.
+        if k != nil { k.public = append(k.public, packet(tag, body)...) }
+      case 7, 14:
+        // Subkeys are not needed for verifying signatures of the primary key.
+        if k != nil { return k, nil }
+    }
+  }
+  if k == nil && secret { return nil, fmt.Errorf("No secret key found") }
+  if k == nil { return nil, fmt.Errorf("No public key found") }
+  return k, nil
+}
+
+// Returns the key ID (the last 8 bytes of the fingerprint) in hex.
+func (k *Key) String() string {
+  return fmt.Sprintf("%X", k.Fingerprint[12:])
+}
+
+/*
+  Returns the public key in binary form as exported by "gpg --export KEYID",
+  with the user IDs and self-signatures that came with the secret key.
+  Use Armor() with "PGP PUBLIC KEY BLOCK" for the ASCII form.
+*/
+func (k *Key) Public() []byte {
+  return k.public
+}
+
+/*
+  Parses the public part at the start of the body of a Public-Key or
+  Secret-Key Packet (RFC 4880 5.5.2) and returns the key and the rest of
+  body.
+*/
+func parsePublicKey(body []byte) (*Key, []byte, error) {
+  if len(body) < 6 || body[0] != 4 { return nil, nil, fmt.Errorf("Only version 4 keys are supported") }
+  k := &Key{algo:body[5]}
+  p := body[6:]
+  var err error
+  var n, e, q []byte
+  switch k.algo {
+    case algoRSA:
+      n, p, err = readMPI(p)
+      if err == nil { e, p, err = readMPI(p) }
+    case algoEdDSA:
+      if len(p) < 1 || len(p) < 1+int(p[0]) || !bytes.Equal(p[1:1+p[0]], ed25519OID) {
+        return nil, nil, fmt.Errorf("Only the curve Ed25519 is supported")
+      }
+      q, p, err = readMPI(p[1+p[0]:])
+      if err == nil && (len(q) != 33 || q[0] != 0x40) { err = fmt.Errorf("Illegal Ed25519 public key") }
+    default:
+      return nil, nil, fmt.Errorf("Public key algorithm %v is not supported (only RSA and Ed25519)", k.algo)
+  }
+  if err != nil { return nil, nil, err }
+  switch k.algo {
+    case algoRSA: k.rsa = &rsa.PrivateKey{PublicKey:rsa.PublicKey{N:new(big.Int).SetBytes(n), E:int(new(big.Int).SetBytes(e).Int64())}}
+    case algoEdDSA: k.edpub = ed25519.PublicKey(q[1:])
+  }
+  
+  public := body[:len(body)-len(p)]
+  fp := sha1.New()
+  fp.Write([]byte{0x99, byte(len(public) >> 8), byte(len(public))})
+  fp.Write(public)
+  k.Fingerprint = fp.Sum(nil)
+  k.public = packet(6, public)
+  return k, p, nil
+}
+
+// Parses the body of a Secret-Key Packet (RFC 4880 5.5.3).
+func parseSecretKey(body []byte) (*Key, error) {
+  k, p, err := parsePublicKey(body)
+  if err != nil { return nil, err }
+  if len(p) < 1 { return nil, fmt.Errorf("Secret key missing") }
+  if p[0] != 0 { return nil, fmt.Errorf("Key %v is protected by a passphrase", k) }
+  p = p[1:]
+  
+  switch k.algo {
+    case algoRSA:
+      var d, pp, qq []byte
+      d, p, err = readMPI(p)
+      if err == nil { pp, p, err = readMPI(p) }
+      if err == nil { qq, p, err = readMPI(p) }
+      if err != nil { return nil, err }
+      k.rsa.D = new(big.Int).SetBytes(d)
+      k.rsa.Primes = []*big.Int{new(big.Int).SetBytes(pp), new(big.Int).SetBytes(qq)}
+      err = k.rsa.Validate()
+      if err != nil { return nil, err }
+      k.rsa.Precompute()
+    case algoEdDSA:
+      var seed []byte
+      seed, p, err = readMPI(p)
+      if err != nil { return nil, err }
+      if len(seed) > ed25519.SeedSize { return nil, fmt.Errorf("Illegal Ed25519 secret key") }
+      seed = append(make([]byte, ed25519.SeedSize-len(seed)), seed...)
+      k.ed = ed25519.NewKeyFromSeed(seed)
+      if !bytes.Equal(k.ed.Public().(ed25519.PublicKey), k.edpub) {
+        return nil, fmt.Errorf("Ed25519 secret key does not match public key")
+      }
+  }
+  return k, nil
+}
+
+// Returns the value of the multiprecision integer at the start of p and the rest of p.
+func readMPI(p []byte) ([]byte, []byte, error) {
+  if len(p) < 2 { return nil, nil, fmt.Errorf("Truncated key") }
+  n := (int(binary.BigEndian.Uint16(p)) + 7) / 8
+  if len(p) < 2+n { return nil, nil, fmt.Errorf("Truncated key") }
+  return p[2:2+n], p[2+n:], nil
+}
+
+// Encodes v as multiprecision integer.
+func mpi(v []byte) []byte {
+  v = bytes.TrimLeft(v, "\x00")
+  bits := new(big.Int).SetBytes(v).BitLen()
+  return append([]byte{byte(bits >> 8), byte(bits)}, v...)
+}
+
+/*
+  Splits the first packet off data. Returns its tag, its body and the
+  rest of data. Partial body lengths are not supported because keys
+  do not use them.
+*/
+func nextPacket(data []byte) (tag byte, body []byte, rest []byte, err error) {
+  if len(data) < 2 || data[0] & 0x80 == 0 { return 0, nil, nil, fmt.Errorf("Not an OpenPGP packet") }
+  length := 0
+  hdr := 0
+  if data[0] & 0x40 != 0 { // new format
+    tag = data[0] & 0x3f
+    switch l := int(data[1]); {
+      case l < 192: length, hdr = l, 2
+      case l < 224:
+        if len(data) < 3 { return 0, nil, nil, fmt.Errorf("Truncated packet") }
+        length, hdr = ((l - 192) << 8) + int(data[2]) + 192, 3
+      case l == 255:
+        if len(data) < 6 { return 0, nil, nil, fmt.Errorf("Truncated packet") }
+        length, hdr = int(binary.BigEndian.Uint32(data[2:])), 6
+      default: return 0, nil, nil, fmt.Errorf("Partial body lengths are not supported")
+    }
+  } else {
+    tag = (data[0] >> 2) & 0xf
+    switch data[0] & 3 {
+      case 0: length, hdr = int(data[1]), 2
+      case 1:
+        if len(data) < 3 { return 0, nil, nil, fmt.Errorf("Truncated packet") }
+        length, hdr = int(binary.BigEndian.Uint16(data[1:])), 3
+      case 2:
+        if len(data) < 5 { return 0, nil, nil, fmt.Errorf("Truncated packet") }
+        length, hdr = int(binary.BigEndian.Uint32(data[1:])), 5
+      default: length, hdr = len(data) - 1, 1
+    }
+  }
+  if length < 0 || len(data) - hdr < length { return 0, nil, nil, fmt.Errorf("Truncated packet") }
+  return tag, data[hdr:hdr+length], data[hdr+length:], nil
+}
+
+// Returns a new format packet with tag and body.
+func packet(tag byte, body []byte) []byte {
+  p := []byte{0xc0 | tag}
+  switch n := len(body); {
+    case n < 192: p = append(p, byte(n))
+    case n < 8384: p = append(p, byte((n - 192) >> 8 + 192), byte(n - 192))
+    default: p = append(p, 255, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n))
+  }
+  return append(p, body...)
+}
+
+/*
+  Returns a binary detached signature (a Signature Packet) of data by k,
+  as created by "gpg --detach-sign". Use Armor() for the ASCII form of
+  "gpg --detach-sign --armor".
+*/
+func (k *Key) Sign(data io.Reader) ([]byte, error) {
+  if k.detach != nil { return k.detach(data) }
+  hashed := []byte{5, 2, 0, 0, 0, 0} // signature creation time
+  binary.BigEndian.PutUint32(hashed[2:], uint32(time.Now().Unix()))
+  hashed = append(hashed, 22, 33, 4) // issuer fingerprint
+  hashed = append(hashed, k.Fingerprint...)
+  unhashed := append([]byte{9, 16}, k.Fingerprint[12:]...) // issuer key ID
+  
+  // version 4, binary document, algorithm, SHA-256
+  body := []byte{4, 0x00, k.algo, 8, byte(len(hashed) >> 8), byte(len(hashed))}
+  body = append(body, hashed...)
+  
+  h := sha256.New()
+  _, err := io.Copy(h, data)
+  if err != nil { return nil, err }
+  h.Write(body)
+  trailer := []byte{4, 0xff, 0, 0, 0, 0}
+  binary.BigEndian.PutUint32(trailer[2:], uint32(len(body)))
+  h.Write(trailer)
+  digest := h.Sum(nil)
+  
+  body = append(body, byte(len(unhashed) >> 8), byte(len(unhashed)))
+  body = append(body, unhashed...)
+  body = append(body, digest[:2]...)
+  
+  var s []byte
+  switch {
+    case k.raw != nil:
+      s, err = k.signRaw(digest)
+    case k.algo == algoRSA && k.rsa.D != nil:
+      s, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest)
+    case k.algo == algoEdDSA && k.ed != nil:
+      s = ed25519.Sign(k.ed, digest)
+    default:
+      err = fmt.Errorf("Key %v has no secret key", k)
+  }
+  if err != nil { return nil, err }
+  switch k.algo {
+    case algoRSA:
+      body = append(body, mpi(s)...)
+    case algoEdDSA:
+      body = append(body, mpi(s[:32])...)
+      body = append(body, mpi(s[32:])...)
+  }
+  return packet(2, body), nil
+}
+
+// Returns the CRC-24 of data as used by the ASCII armor.
+func crc24(data []byte) uint32 {
+  crc := uint32(0xb704ce)
+  for _, b := range data {
+    crc ^= uint32(b) << 16
+    for i := 0; i < 8; i++ {
+      crc <<= 1
+      if crc & 0x1000000 != 0 { crc ^= 0x1864cfb }
+    }
+  }
+  return crc & 0xffffff
+}
+
+/*
+  Returns data in ASCII armor (RFC 4880 6.2) with the type typ,
+  e.g. "PGP SIGNATURE".
+*/
+func Armor(data []byte, typ string) []byte {
+  var out bytes.Buffer
+  out.WriteString("-----BEGIN " + typ + "-----\n\n")
+  b64 := base64.StdEncoding.EncodeToString(data)
+  for len(b64) > 64 {
+    out.WriteString(b64[:64] + "\n")
+    b64 = b64[64:]
+  }
+  out.WriteString(b64 + "\n")
+  crc := crc24(data)
+  out.WriteString("=" + base64.StdEncoding.EncodeToString([]byte{byte(crc >> 16), byte(crc >> 8), byte(crc)}) + "\n")
+  out.WriteString("-----END " + typ + "-----\n")
+  return out.Bytes()
+}
+
+// Returns the data of the first ASCII armored block in data.
+func Dearmor(data []byte) ([]byte, error) {
+  lines := strings.Split(strings.Replace(string(data), "\r", "", -1), "\n")
+  i := 0
+  for i < len(lines) && !strings.HasPrefix(lines[i], "-----BEGIN PGP") { i++ }
+  // Skip the armor headers (e.g. "Version: ...") up to the empty line
+  for i < len(lines) && strings.TrimSpace(lines[i]) != "" { i++ }
+  var b64 strings.Builder
+  checksum := ""
+  for i++; i < len(lines); i++ {
+    line := strings.TrimSpace(lines[i])
+    if strings.HasPrefix(line, "-----END PGP") {
+      out, err := base64.StdEncoding.DecodeString(b64.String())
+      if err != nil { return nil, err }
+      crc := crc24(out)
+      if checksum != "" && checksum != base64.StdEncoding.EncodeToString([]byte{byte(crc >> 16), byte(crc >> 8), byte(crc)}) {
+        return nil, fmt.Errorf("Armor checksum mismatch")
+      }
+      return out, nil
+    }
+    if strings.HasPrefix(line, "=") {
+      checksum = line[1:]
+    } else {
+      b64.WriteString(line)
+    }
+  }
+  return nil, fmt.Errorf("No ASCII armored data found")
+}
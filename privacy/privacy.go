@@ -0,0 +1,113 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+/*
+  Anonymizes the personal data of clients (IP addresses and User-Agent
+  headers) before it is logged or exported in traces, so that public
+  download servers can keep useful logs without storing who downloaded
+  what. Rate limits and other decisions still use the real addresses.
+*/
+package privacy
+
+import (
+         "fmt"
+         "net"
+         "sync"
+         "time"
+         "regexp"
+         "strings"
+         "crypto/hmac"
+         "crypto/rand"
+         "crypto/sha256"
+       )
+
+// How client IP addresses are logged.
+const (
+  // The address as is.
+  IPFull = iota
+  // Only the network, i.e. the first IPv4Prefix or IPv6Prefix bits.
+  IPTruncate
+  // A keyed hash of the address. The key (salt) is random and replaced every
+  // SaltLifetime, so the same client can be followed within that time,
+  // e.g. to analyze a problem, but not beyond it. The salt is never stored.
+  IPHash
+)
+
+// How client IP addresses are logged (IPFull, IPTruncate or IPHash).
+var IPMode = IPFull
+
+// The number of bits of IPv4 and IPv6 addresses that IPTruncate keeps.
+var IPv4Prefix = 24
+var IPv6Prefix = 48
+
+// How long the same client has the same hash with IPHash.
+var SaltLifetime = 24*time.Hour
+
+/*
+  If true, User-Agent headers are logged without the comments in
+  parentheses or JSON (as sent by pip), which contain details of the
+  client's system, and with only the major versions, e.g.
+  "Debian APT-HTTP/1" instead of "Debian APT-HTTP/1.3 (2.6.1)".
+*/
+var ScrubUserAgent = false
+
+var saltMutex sync.Mutex
+var salt []byte
+var saltExpires time.Time
+
+/*
+  Returns the client address addr (an IP address, optionally with port as
+  in http.Request.RemoteAddr) as it may be logged according to IPMode.
+  The port is dropped unless IPMode is IPFull.
+*/
+func IP(addr string) string {
+  if IPMode == IPFull { return addr }
+  host, _, err := net.SplitHostPort(addr)
+  if err != nil { host = addr }
+  ip := net.ParseIP(host)
+  if ip == nil { return "-" }
+  if IPMode == IPHash { return hashIP(ip) }
+  if v4 := ip.To4(); v4 != nil { return v4.Mask(net.CIDRMask(IPv4Prefix, 32)).String() }
+  return ip.Mask(net.CIDRMask(IPv6Prefix, 128)).String()
+}
+
+// Returns the keyed hash of ip with the current salt.
+func hashIP(ip net.IP) string {
+  saltMutex.Lock()
+  if salt == nil || !time.Now().Before(saltExpires) {
+    salt = make([]byte, 32)
+    rand.Read(salt)
+    saltExpires = time.Now().Add(SaltLifetime)
+  }
+  mac := hmac.New(sha256.New, salt)
+  saltMutex.Unlock()
+  mac.Write(ip.To16())
+  return fmt.Sprintf("anon-%x", mac.Sum(nil)[0:8])
+}
+
+var uaComment = regexp.MustCompile(`\s*\([^()]*\)`)
+var uaVersion = regexp.MustCompile(`/(\d+)[^\s/]*`)
+
+// Returns the User-Agent header ua as it may be logged according to ScrubUserAgent.
+func UserAgent(ua string) string {
+  if !ScrubUserAgent { return ua }
+  if i := strings.Index(ua, "{"); i >= 0 { ua = ua[0:i] }
+  // Comments may be nested.
+  for {
+    scrubbed := uaComment.ReplaceAllString(ua, "")
+    if scrubbed == ua { break }
+    ua = scrubbed
+  }
+  return strings.TrimSpace(uaVersion.ReplaceAllString(ua, "/$1"))
+}
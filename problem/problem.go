@@ -0,0 +1,213 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+/*
+  The error responses of the server. Every error has a code from the list
+  below that is sent to the client, appears in the log line of the request
+  and is counted in garcon_errors_total{code}. Clients that accept JSON get
+  an application/problem+json body (RFC 9457), browsers an HTML page and
+  all others (e.g. apt, curl) the detail as plain text.
+*/
+package problem
+
+import (
+         "fmt"
+         "sync"
+         "strings"
+         "net/http"
+         "encoding/json"
+         "html/template"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../status"
+         "../accesslog"
+       )
+
+// The error codes.
+const (
+  // Generic errors whose status says it all.
+  BadRequest = "bad-request"
+  NotFound = "not-found"
+  MethodNotAllowed = "method-not-allowed"
+  Conflict = "conflict"
+  Internal = "internal-error"
+  
+  // Authentication and authorization.
+  LoginRequired = "login-required"
+  LoginFailed = "login-failed"
+  InvalidToken = "invalid-token"
+  InvalidSignature = "invalid-signature"
+  Forbidden = "forbidden"
+  CSRFRejected = "csrf-rejected"
+  SecondFactorRequired = "second-factor-required"
+  SecondFactorFailed = "second-factor-failed"
+  
+  // Requests refused before they are served.
+  Filtered = "filtered"
+  GeoBlocked = "geo-blocked"
+  RateLimited = "rate-limited"
+  Overloaded = "overloaded"
+  
+  // Uploads.
+  UploadForbidden = "upload-forbidden"
+  UploadFailed = "upload-failed"
+  InsufficientStorage = "insufficient-storage"
+  TooLarge = "too-large"
+  AlreadyExists = "already-exists"
+  InvalidArchive = "invalid-archive"
+  DigestMismatch = "digest-mismatch"
+  
+  // The files can not be read at the moment (e.g. their filesystem has failed).
+  StorageUnavailable = "storage-unavailable"
+  
+  // Proxies.
+  BadGateway = "bad-gateway"
+  Upstream = "upstream-error"
+  
+  // Responses aborted by a --response-limit.
+  ResponseLimit = "response-limit-exceeded"
+)
+
+// The codes of errors that have no more specific code, by status.
+var generic = map[int]string{
+  http.StatusBadRequest: BadRequest,
+  http.StatusUnauthorized: LoginRequired,
+  http.StatusForbidden: Forbidden,
+  http.StatusNotFound: NotFound,
+  http.StatusMethodNotAllowed: MethodNotAllowed,
+  http.StatusConflict: Conflict,
+  http.StatusRequestEntityTooLarge: TooLarge,
+  http.StatusTooManyRequests: RateLimited,
+  http.StatusBadGateway: BadGateway,
+  http.StatusServiceUnavailable: Overloaded,
+  http.StatusInsufficientStorage: InsufficientStorage,
+}
+
+// Returns the generic code for status, e.g. "not-found" for 404.
+func CodeFor(status int) string {
+  if code, ok := generic[status]; ok { return code }
+  if status >= 500 { return Internal }
+  return BadRequest
+}
+
+// The prefix of the type member of problem+json bodies. The code is appended.
+const TypePrefix = "urn:garcon:error:"
+
+/*
+  The body of an application/problem+json response. The members are those
+  of RFC 9457 plus code, which is the error code without TypePrefix.
+*/
+type Problem struct {
+  Type string `json:"type"`
+  Title string `json:"title"`
+  Status int `json:"status"`
+  Detail string `json:"detail,omitempty"`
+  Instance string `json:"instance,omitempty"`
+  Code string `json:"code"`
+}
+
+// Protects counters.
+var mutex sync.Mutex
+
+// The counters of garcon_errors_total by code.
+var counters = map[string]*status.Counter{}
+
+// Counts an error response with code.
+func count(code string) {
+  mutex.Lock()
+  c := counters[code]
+  if c == nil {
+    c = status.NewCounter(`garcon_errors_total{code="`+code+`"}`, "Error responses by error code.")
+    counters[code] = c
+  }
+  mutex.Unlock()
+  c.Inc()
+}
+
+/*
+  Logs the error response to r as "status method path (code: reason)",
+  where reason is format with args (which may say more than the detail
+  sent to the client). Server errors are logged at level 0, even for
+  requests that the accesslog rules leave out.
+*/
+func Log(r *http.Request, status int, code string, format string, args ...interface{}) {
+  line := fmt.Sprintf("%v %v %v (%v)", status, r.Method, r.URL.Path, code)
+  if format != "" { line = fmt.Sprintf("%v %v %v (%v: %v)", status, r.Method, r.URL.Path, code, fmt.Sprintf(format, args...)) }
+  if status >= 500 {
+    util.Log(0, "%v", line)
+  } else {
+    accesslog.Log(r, 1, "%v", line)
+  }
+}
+
+// Returns true if the Accept header of r lists JSON.
+func wantsJSON(r *http.Request) bool {
+  accept := r.Header.Get("Accept")
+  return strings.Contains(accept, "application/problem+json") || strings.Contains(accept, "application/json")
+}
+
+/*
+  Sends the error response with status and code to r. detail explains the
+  error to the user. If it is "", the status text is used. The format of the
+  body depends on the Accept header (see the package documentation).
+  Headers that have been set before (e.g. Allow, Retry-After) are kept.
+  Use Log() to log the error.
+*/
+func Write(w http.ResponseWriter, r *http.Request, status int, code string, detail string) {
+  if wantsJSON(r) {
+    WriteJSON(w, r, status, code, detail)
+    return
+  }
+  count(code)
+  if detail == "" { detail = http.StatusText(status) }
+  w.Header().Del("Content-Length")
+  w.Header().Set("X-Content-Type-Options", "nosniff")
+  if strings.Contains(r.Header.Get("Accept"), "text/html") {
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    w.WriteHeader(status)
+    page.Execute(w, map[string]interface{}{"Status":status, "Title":http.StatusText(status), "Detail":detail, "Code":code})
+    return
+  }
+  w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+  w.WriteHeader(status)
+  fmt.Fprintln(w, detail)
+}
+
+/*
+  Like Write() but always sends application/problem+json, for API endpoints
+  whose clients expect JSON even if they do not say so.
+*/
+func WriteJSON(w http.ResponseWriter, r *http.Request, status int, code string, detail string) {
+  count(code)
+  p := &Problem{Type:TypePrefix + code, Title:http.StatusText(status), Status:status, Detail:detail, Instance:r.URL.Path, Code:code}
+  data, _ := json.Marshal(p)
+  w.Header().Del("Content-Length")
+  w.Header().Set("X-Content-Type-Options", "nosniff")
+  w.Header().Set("Content-Type", "application/problem+json")
+  w.WriteHeader(status)
+  w.Write(append(data, '\n'))
+}
+
+// The error page for browsers.
+var page = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="UTF-8" /><title>{{.Status}} {{.Title}}</title></head>
+<body>
+<h1>{{.Status}} {{.Title}}</h1>
+<p>{{.Detail}}</p>
+<p><small>Error code: {{.Code}}</small></p>
+</body>
+</html>
+`))
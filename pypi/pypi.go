@@ -0,0 +1,166 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+/*
+  Writes the pages of the "simple" repository API (PEP 503) that pip uses
+  to find Python packages (wheels and sdists) and extracts the core
+  metadata of wheels (PEP 658).
+*/
+package pypi
+
+import (
+         "io"
+         "fmt"
+         "sort"
+         "bufio"
+         "regexp"
+         "errors"
+         "strings"
+         "net/url"
+         "io/ioutil"
+         "archive/zip"
+         "html/template"
+       )
+
+var errNoMetadata = errors.New("no .dist-info/METADATA in wheel")
+
+// Matches sdists and wheels. The first group is the project name.
+var wheelName = regexp.MustCompile(`^([^-]+)-[^-]+-.+\.whl$`)
+var sdistName = regexp.MustCompile(`^(.+)-[^-]+\.(tar\.gz|tar\.bz2|tar\.xz|zip)$`)
+
+var separators = regexp.MustCompile(`[-_.]+`)
+
+/*
+  Returns the project name of the distribution file name (a wheel or sdist)
+  or "" if name is not a distribution file.
+*/
+func Project(name string) string {
+  if m := wheelName.FindStringSubmatch(name); m != nil { return m[1] }
+  if m := sdistName.FindStringSubmatch(name); m != nil { return m[1] }
+  return ""
+}
+
+// Returns the normalized form of the project name, which is used in URLs.
+func Normalize(name string) string {
+  return strings.ToLower(separators.ReplaceAllString(name, "-"))
+}
+
+/*
+  Returns the METADATA file from the wheel r (of size bytes), which is
+  served as <wheel>.metadata.
+*/
+func WheelMetadata(r io.ReaderAt, size int64) ([]byte, error) {
+  z, err := zip.NewReader(r, size)
+  if err != nil { return nil, err }
+  for _, f := range z.File {
+    parts := strings.Split(f.Name, "/")
+    if len(parts) != 2 || !strings.HasSuffix(parts[0], ".dist-info") || parts[1] != "METADATA" { continue }
+    rc, err := f.Open()
+    if err != nil { return nil, err }
+    defer rc.Close()
+    return ioutil.ReadAll(rc)
+  }
+  return nil, errNoMetadata
+}
+
+// Returns the Requires-Python field of the core metadata or "".
+func RequiresPython(metadata []byte) string {
+  scanner := bufio.NewScanner(strings.NewReader(string(metadata)))
+  for scanner.Scan() {
+    line := scanner.Text()
+    if line == "" { break } // end of the headers, the description follows
+    if i := strings.Index(line, ":"); i > 0 && strings.EqualFold(line[0:i], "Requires-Python") {
+      return strings.TrimSpace(line[i+1:])
+    }
+  }
+  return ""
+}
+
+// A distribution file of a project.
+type Link struct {
+  // Name of the file, e.g. "foo-1.0-py3-none-any.whl".
+  Filename string
+  
+  // URL path of the file.
+  Path string
+  
+  // SHA-256 (hex) of the file.
+  SHA256 string
+  
+  // Requires-Python or "".
+  RequiresPython string
+  
+  // SHA-256 (hex) of <Path>.metadata or "" if there is none.
+  MetadataSHA256 string
+}
+
+// Returns the href of l with the hash fragment.
+func (l Link) Href() string {
+  return (&url.URL{Path:l.Path}).EscapedPath() + "#sha256=" + l.SHA256
+}
+
+var rootPage = template.Must(template.New("root").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <meta name="pypi:repository-version" content="1.0">
+    <title>Simple index</title>
+  </head>
+  <body>
+{{- range .}}
+    <a href="{{.Href}}">{{.Name}}</a><br>
+{{- end}}
+  </body>
+</html>
+`))
+
+var projectPage = template.Must(template.New("project").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <meta name="pypi:repository-version" content="1.0">
+    <title>Links for {{.Name}}</title>
+  </head>
+  <body>
+    <h1>Links for {{.Name}}</h1>
+{{- range .Links}}
+    <a href="{{.Href}}"
+       {{- with .RequiresPython}} data-requires-python="{{.}}"{{end}}
+       {{- with .MetadataSHA256}} data-dist-info-metadata="sha256={{.}}" data-core-metadata="sha256={{.}}"{{end}}>{{.Filename}}</a><br>
+{{- end}}
+  </body>
+</html>
+`))
+
+// A project listed on the root page.
+type rootEntry struct {
+  Name, Href string
+}
+
+/*
+  Writes the root page (<prefix>/simple/), which lists the projects.
+  projects maps the normalized names to the URL paths of their pages.
+*/
+func WriteRoot(w io.Writer, projects map[string]string) error {
+  entries := []rootEntry{}
+  for name, p := range projects { entries = append(entries, rootEntry{Name:name, Href:(&url.URL{Path:p}).EscapedPath()}) }
+  sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+  return rootPage.Execute(w, entries)
+}
+
+// Writes the page of the project name (normalized) with the files links.
+func WriteProject(w io.Writer, name string, links []Link) error {
+  sort.Slice(links, func(i, j int) bool { return links[i].Filename < links[j].Filename })
+  err := projectPage.Execute(w, struct{Name string; Links []Link}{name, links})
+  if err != nil { return fmt.Errorf("project %v: %v", name, err) }
+  return nil
+}
@@ -0,0 +1,185 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package rpm
+
+import (
+         "io"
+         "fmt"
+         "bufio"
+         "strings"
+         "encoding/xml"
+       )
+
+// A package in a repository.
+type Entry struct {
+  *Package
+  
+  // Path of the package file relative to the repository directory.
+  Location string
+  
+  // SHA-256 (hex) of the package file.
+  Checksum string
+  
+  // Size and mtime (seconds since epoch) of the package file.
+  Size int64
+  Time int64
+}
+
+// A metadata file listed in repomd.xml.
+type Metadata struct {
+  // "primary", "filelists",...
+  Type string
+  
+  // Path relative to the repository directory, e.g. "repodata/<checksum>-primary.xml.gz".
+  Location string
+  
+  // SHA-256 (hex) and size of the (compressed) file and of its uncompressed data.
+  Checksum, OpenChecksum string
+  Size, OpenSize int64
+  
+  // mtime (seconds since epoch).
+  Timestamp int64
+}
+
+// Returns s escaped for use in XML text and attribute values.
+func esc(s string) string {
+  var b strings.Builder
+  xml.EscapeText(&b, []byte(s))
+  return b.String()
+}
+
+// Returns the flags attribute value for f ("EQ", "LT", "GE",...).
+func flagsAttr(f uint32) string {
+  switch f & (SenseLess|SenseGreater|SenseEqual) {
+    case SenseLess: return "LT"
+    case SenseGreater: return "GT"
+    case SenseEqual: return "EQ"
+    case SenseLess|SenseEqual: return "LE"
+    case SenseGreater|SenseEqual: return "GE"
+  }
+  return ""
+}
+
+// Returns the attributes epoch, ver and rel.
+func versionAttrs(epoch, version, release string) string {
+  if epoch == "" { epoch = "0" }
+  return fmt.Sprintf(`epoch="%v" ver="%v" rel="%v"`, esc(epoch), esc(version), esc(release))
+}
+
+// Writes the <rpm:entry> elements for deps inside an element called kind.
+// requires is true for Requires, which leave out rpmlib() dependencies.
+func writeDeps(w *bufio.Writer, kind string, deps []Dependency, requires bool) {
+  if len(deps) == 0 { return }
+  fmt.Fprintf(w, "    <rpm:%v>\n", kind)
+  seen := map[Dependency]bool{}
+  for _, d := range deps {
+    if seen[d] || (requires && strings.HasPrefix(d.Name, "rpmlib(")) { continue }
+    seen[d] = true
+    fmt.Fprintf(w, `      <rpm:entry name="%v"`, esc(d.Name))
+    if flags := flagsAttr(d.Flags); flags != "" && d.Version != "" {
+      e, v, r := splitEVR(d.Version)
+      if e == "" { e = "0" }
+      fmt.Fprintf(w, ` flags="%v" epoch="%v" ver="%v"`, flags, esc(e), esc(v))
+      if r != "" { fmt.Fprintf(w, ` rel="%v"`, esc(r)) }
+    }
+    if requires && d.Flags & (SenseScriptPre|SenseScriptPost) != 0 { w.WriteString(` pre="1"`) }
+    w.WriteString("/>\n")
+  }
+  fmt.Fprintf(w, "    </rpm:%v>\n", kind)
+}
+
+// Returns true if the file path is listed in primary.xml rather than only
+// in filelists.xml. These are the files that packages typically depend on.
+func isPrimaryFile(path string) bool {
+  return strings.HasPrefix(path, "/etc/") || strings.Contains(path, "bin/") || path == "/usr/lib/sendmail"
+}
+
+// Writes the file entries for files.
+func writeFiles(w *bufio.Writer, indent string, files []PackageFile, primary bool) {
+  for _, f := range files {
+    if primary && !isPrimaryFile(f.Path) { continue }
+    typ := ""
+    if f.Dir { typ = ` type="dir"` } else if f.Ghost { typ = ` type="ghost"` }
+    fmt.Fprintf(w, "%v<file%v>%v</file>\n", indent, typ, esc(f.Path))
+  }
+}
+
+// Writes primary.xml for the packages entries.
+func WritePrimary(out io.Writer, entries []Entry) error {
+  w := bufio.NewWriter(out)
+  w.WriteString(xml.Header)
+  fmt.Fprintf(w, "<metadata xmlns=\"http://linux.duke.edu/metadata/common\" xmlns:rpm=\"http://linux.duke.edu/metadata/rpm\" packages=\"%v\">\n", len(entries))
+  for _, e := range entries {
+    p := e.Package
+    w.WriteString("<package type=\"rpm\">\n")
+    fmt.Fprintf(w, "  <name>%v</name>\n  <arch>%v</arch>\n", esc(p.Name), esc(p.Arch))
+    fmt.Fprintf(w, "  <version %v/>\n", versionAttrs(p.Epoch, p.Version, p.Release))
+    fmt.Fprintf(w, "  <checksum type=\"sha256\" pkgid=\"YES\">%v</checksum>\n", e.Checksum)
+    fmt.Fprintf(w, "  <summary>%v</summary>\n  <description>%v</description>\n", esc(p.Summary), esc(p.Description))
+    fmt.Fprintf(w, "  <packager>%v</packager>\n  <url>%v</url>\n", esc(p.Packager), esc(p.URL))
+    fmt.Fprintf(w, "  <time file=\"%v\" build=\"%v\"/>\n", e.Time, p.BuildTime)
+    fmt.Fprintf(w, "  <size package=\"%v\" installed=\"%v\" archive=\"%v\"/>\n", e.Size, p.InstalledSize, p.ArchiveSize)
+    fmt.Fprintf(w, "  <location href=\"%v\"/>\n", esc(e.Location))
+    w.WriteString("  <format>\n")
+    fmt.Fprintf(w, "    <rpm:license>%v</rpm:license>\n    <rpm:vendor>%v</rpm:vendor>\n", esc(p.License), esc(p.Vendor))
+    fmt.Fprintf(w, "    <rpm:group>%v</rpm:group>\n    <rpm:buildhost>%v</rpm:buildhost>\n", esc(p.Group), esc(p.BuildHost))
+    fmt.Fprintf(w, "    <rpm:sourcerpm>%v</rpm:sourcerpm>\n", esc(p.SourceRPM))
+    fmt.Fprintf(w, "    <rpm:header-range start=\"%v\" end=\"%v\"/>\n", p.HeaderStart, p.HeaderEnd)
+    writeDeps(w, "provides", p.Provides, false)
+    writeDeps(w, "requires", p.Requires, true)
+    writeDeps(w, "conflicts", p.Conflicts, false)
+    writeDeps(w, "obsoletes", p.Obsoletes, false)
+    writeFiles(w, "    ", p.Files, true)
+    w.WriteString("  </format>\n</package>\n")
+  }
+  w.WriteString("</metadata>\n")
+  return w.Flush()
+}
+
+// Writes filelists.xml for the packages entries.
+func WriteFilelists(out io.Writer, entries []Entry) error {
+  w := bufio.NewWriter(out)
+  w.WriteString(xml.Header)
+  fmt.Fprintf(w, "<filelists xmlns=\"http://linux.duke.edu/metadata/filelists\" packages=\"%v\">\n", len(entries))
+  for _, e := range entries {
+    p := e.Package
+    fmt.Fprintf(w, "<package pkgid=\"%v\" name=\"%v\" arch=\"%v\">\n", e.Checksum, esc(p.Name), esc(p.Arch))
+    fmt.Fprintf(w, "  <version %v/>\n", versionAttrs(p.Epoch, p.Version, p.Release))
+    writeFiles(w, "  ", p.Files, false)
+    w.WriteString("</package>\n")
+  }
+  w.WriteString("</filelists>\n")
+  return w.Flush()
+}
+
+// Writes repomd.xml, which lists the metadata files.
+// revision is usually the time of the update in seconds since epoch.
+func WriteRepomd(out io.Writer, revision int64, files []Metadata) error {
+  w := bufio.NewWriter(out)
+  w.WriteString(xml.Header)
+  w.WriteString("<repomd xmlns=\"http://linux.duke.edu/metadata/repo\" xmlns:rpm=\"http://linux.duke.edu/metadata/rpm\">\n")
+  fmt.Fprintf(w, "  <revision>%v</revision>\n", revision)
+  for _, m := range files {
+    fmt.Fprintf(w, "  <data type=\"%v\">\n", esc(m.Type))
+    fmt.Fprintf(w, "    <checksum type=\"sha256\">%v</checksum>\n", m.Checksum)
+    fmt.Fprintf(w, "    <open-checksum type=\"sha256\">%v</open-checksum>\n", m.OpenChecksum)
+    fmt.Fprintf(w, "    <location href=\"%v\"/>\n", esc(m.Location))
+    fmt.Fprintf(w, "    <timestamp>%v</timestamp>\n", m.Timestamp)
+    fmt.Fprintf(w, "    <size>%v</size>\n    <open-size>%v</open-size>\n", m.Size, m.OpenSize)
+    w.WriteString("  </data>\n")
+  }
+  w.WriteString("</repomd>\n")
+  return w.Flush()
+}
@@ -0,0 +1,338 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+/*
+  Reads the headers of RPM packages and writes the repodata/ metadata
+  (primary.xml, filelists.xml and repomd.xml) that yum and dnf use to
+  find packages in a repository.
+*/
+package rpm
+
+import (
+         "io"
+         "fmt"
+         "bytes"
+         "strings"
+         "encoding/binary"
+       )
+
+var leadMagic = []byte{0xed, 0xab, 0xee, 0xdb}
+var headerMagic = []byte{0x8e, 0xad, 0xe8, 0x01}
+
+// Header tags (see rpmtag.h).
+const (
+  tagName = 1000
+  tagVersion = 1001
+  tagRelease = 1002
+  tagEpoch = 1003
+  tagSummary = 1004
+  tagDescription = 1005
+  tagBuildTime = 1006
+  tagBuildHost = 1007
+  tagSize = 1009
+  tagVendor = 1011
+  tagLicense = 1014
+  tagPackager = 1015
+  tagGroup = 1016
+  tagURL = 1020
+  tagArch = 1022
+  tagOldFilenames = 1027
+  tagFileModes = 1030
+  tagFileFlags = 1037
+  tagSourceRPM = 1044
+  tagArchiveSize = 1046
+  tagProvideName = 1047
+  tagRequireFlags = 1048
+  tagRequireName = 1049
+  tagRequireVersion = 1050
+  tagConflictFlags = 1053
+  tagConflictName = 1054
+  tagConflictVersion = 1055
+  tagObsoleteName = 1090
+  tagProvideFlags = 1112
+  tagProvideVersion = 1113
+  tagObsoleteFlags = 1114
+  tagObsoleteVersion = 1115
+  tagDirIndexes = 1116
+  tagBaseNames = 1117
+  tagDirNames = 1118
+  tagLongSize = 5009
+  
+  // in the signature header
+  sigtagPayloadSize = 1007
+  sigtagLongArchiveSize = 271
+)
+
+// Data types of header entries.
+const (
+  typeInt8 = 2
+  typeInt16 = 3
+  typeInt32 = 4
+  typeInt64 = 5
+  typeString = 6
+  typeStringArray = 8
+  typeI18NString = 9
+)
+
+// Dependency flags.
+const (
+  SenseLess = 1 << 1
+  SenseGreater = 1 << 2
+  SenseEqual = 1 << 3
+  SenseScriptPre = 1 << 9
+  SenseScriptPost = 1 << 10
+)
+
+// Marks a file that is not in the payload but belongs to the package.
+const fileGhost = 1 << 6
+
+// The metadata of an RPM package.
+type Package struct {
+  Name, Arch, Epoch, Version, Release string
+  Summary, Description, Packager, URL string
+  License, Vendor, Group, BuildHost, SourceRPM string
+  BuildTime int64
+  
+  // Total size of the files when installed.
+  InstalledSize int64
+  
+  // Size of the uncompressed payload.
+  ArchiveSize int64
+  
+  // Byte offsets of the start and end of the (main) header in the file.
+  HeaderStart, HeaderEnd int64
+  
+  Provides, Requires, Conflicts, Obsoletes []Dependency
+  
+  Files []PackageFile
+}
+
+// An entry in a Provides, Requires,... list.
+type Dependency struct {
+  Name string
+  
+  // Combination of Sense... flags.
+  Flags uint32
+  
+  // "[epoch:]version[-release]" or "" if any version will do.
+  Version string
+}
+
+// A file or directory contained in a package.
+type PackageFile struct {
+  Path string
+  Dir bool
+  
+  // True if the file belongs to the package but is not installed by it
+  // (e.g. a log file).
+  Ghost bool
+}
+
+// A parsed header structure.
+type header struct {
+  entries map[int32]entry
+  store []byte
+}
+
+type entry struct {
+  typ, offset, count int32
+}
+
+/*
+  Reads the metadata of the RPM package from r, which is read up to
+  the end of the header. The payload is not read.
+*/
+func Read(r io.Reader) (*Package, error) {
+  lead := make([]byte, 96)
+  _, err := io.ReadFull(r, lead)
+  if err != nil || !bytes.Equal(lead[:4], leadMagic) { return nil, fmt.Errorf("Not an RPM package") }
+  
+  sig, sigsize, err := readHeader(r)
+  if err != nil { return nil, fmt.Errorf("Signature header: %v", err) }
+  // The header that follows is aligned to 8 bytes.
+  if pad := (8 - sigsize % 8) % 8; pad > 0 {
+    _, err = io.ReadFull(r, make([]byte, pad))
+    if err != nil { return nil, err }
+    sigsize += pad
+  }
+  
+  h, hsize, err := readHeader(r)
+  if err != nil { return nil, fmt.Errorf("Header: %v", err) }
+  
+  p := &Package{
+    Name:h.str(tagName),
+    Arch:h.str(tagArch),
+    Version:h.str(tagVersion),
+    Release:h.str(tagRelease),
+    Summary:h.str(tagSummary),
+    Description:h.str(tagDescription),
+    Packager:h.str(tagPackager),
+    URL:h.str(tagURL),
+    License:h.str(tagLicense),
+    Vendor:h.str(tagVendor),
+    Group:h.str(tagGroup),
+    BuildHost:h.str(tagBuildHost),
+    SourceRPM:h.str(tagSourceRPM),
+    BuildTime:h.num(tagBuildTime),
+    InstalledSize:h.num(tagLongSize),
+    ArchiveSize:sig.num(sigtagLongArchiveSize),
+    HeaderStart:int64(96 + sigsize),
+    HeaderEnd:int64(96 + sigsize + hsize),
+  }
+  if p.Name == "" || p.Version == "" { return nil, fmt.Errorf("Name or version missing") }
+  if _, ok := h.entries[tagEpoch]; ok { p.Epoch = fmt.Sprintf("%v", h.num(tagEpoch)) }
+  if p.InstalledSize == 0 { p.InstalledSize = h.num(tagSize) }
+  if p.ArchiveSize == 0 { p.ArchiveSize = sig.num(sigtagPayloadSize) }
+  if p.ArchiveSize == 0 { p.ArchiveSize = h.num(tagArchiveSize) }
+  // Only binary packages name the package they were built from.
+  if p.SourceRPM == "" { p.Arch = "src" }
+  
+  p.Provides = h.deps(tagProvideName, tagProvideFlags, tagProvideVersion)
+  p.Requires = h.deps(tagRequireName, tagRequireFlags, tagRequireVersion)
+  p.Conflicts = h.deps(tagConflictName, tagConflictFlags, tagConflictVersion)
+  p.Obsoletes = h.deps(tagObsoleteName, tagObsoleteFlags, tagObsoleteVersion)
+  
+  names := h.strs(tagOldFilenames)
+  if basenames := h.strs(tagBaseNames); len(basenames) > 0 {
+    dirnames := h.strs(tagDirNames)
+    dirindexes := h.nums(tagDirIndexes)
+    names = make([]string, len(basenames))
+    for i := range basenames {
+      if i >= len(dirindexes) || dirindexes[i] < 0 || dirindexes[i] >= int64(len(dirnames)) {
+        return nil, fmt.Errorf("Illegal file list")
+      }
+      names[i] = dirnames[dirindexes[i]] + basenames[i]
+    }
+  }
+  modes := h.nums(tagFileModes)
+  flags := h.nums(tagFileFlags)
+  for i, name := range names {
+    f := PackageFile{Path:name}
+    if i < len(modes) { f.Dir = modes[i] & 0170000 == 0040000 }
+    if i < len(flags) { f.Ghost = flags[i] & fileGhost != 0 }
+    p.Files = append(p.Files, f)
+  }
+  
+  return p, nil
+}
+
+// Reads a header structure from r and returns it and its size in bytes.
+func readHeader(r io.Reader) (*header, int, error) {
+  intro := make([]byte, 16)
+  _, err := io.ReadFull(r, intro)
+  if err != nil { return nil, 0, err }
+  if !bytes.Equal(intro[:4], headerMagic) { return nil, 0, fmt.Errorf("Bad magic") }
+  nindex := int(binary.BigEndian.Uint32(intro[8:]))
+  hsize := int(binary.BigEndian.Uint32(intro[12:]))
+  if nindex > 65536 || hsize > 64*1024*1024 { return nil, 0, fmt.Errorf("Header too large") }
+  
+  data := make([]byte, 16*nindex + hsize)
+  _, err = io.ReadFull(r, data)
+  if err != nil { return nil, 0, err }
+  h := &header{entries:map[int32]entry{}, store:data[16*nindex:]}
+  for i := 0; i < nindex; i++ {
+    e := data[16*i:]
+    tag := int32(binary.BigEndian.Uint32(e))
+    h.entries[tag] = entry{typ:int32(binary.BigEndian.Uint32(e[4:])), offset:int32(binary.BigEndian.Uint32(e[8:])), count:int32(binary.BigEndian.Uint32(e[12:]))}
+  }
+  return h, 16 + 16*nindex + hsize, nil
+}
+
+// Returns the strings of tag (a string, string array or I18N string).
+// For I18N strings, the first (i.e. the untranslated) string is returned.
+func (h *header) strs(tag int32) []string {
+  e, ok := h.entries[tag]
+  if !ok || e.offset < 0 || int(e.offset) >= len(h.store) { return nil }
+  switch e.typ {
+    case typeString, typeStringArray, typeI18NString:
+    default: return nil
+  }
+  count := int(e.count)
+  if e.typ == typeString { count = 1 }
+  if count > len(h.store) { return nil }
+  data := h.store[e.offset:]
+  s := make([]string, 0, count)
+  for i := 0; i < count; i++ {
+    end := bytes.IndexByte(data, 0)
+    if end < 0 { return nil }
+    s = append(s, string(data[:end]))
+    data = data[end+1:]
+  }
+  return s
+}
+
+// Returns the string of tag or "" if there is none.
+func (h *header) str(tag int32) string {
+  s := h.strs(tag)
+  if len(s) == 0 { return "" }
+  return s[0]
+}
+
+// Returns the integers of tag.
+func (h *header) nums(tag int32) []int64 {
+  e, ok := h.entries[tag]
+  if !ok || e.offset < 0 { return nil }
+  size := map[int32]int{typeInt8:1, typeInt16:2, typeInt32:4, typeInt64:8}[e.typ]
+  if size == 0 || e.count < 0 || int(e.offset) + size*int(e.count) > len(h.store) { return nil }
+  data := h.store[e.offset:]
+  n := make([]int64, e.count)
+  for i := range n {
+    switch size {
+      case 1: n[i] = int64(data[i])
+      case 2: n[i] = int64(binary.BigEndian.Uint16(data[2*i:]))
+      case 4: n[i] = int64(binary.BigEndian.Uint32(data[4*i:]))
+      case 8: n[i] = int64(binary.BigEndian.Uint64(data[8*i:]))
+    }
+  }
+  return n
+}
+
+// Returns the first integer of tag or 0 if there is none.
+func (h *header) num(tag int32) int64 {
+  n := h.nums(tag)
+  if len(n) == 0 { return 0 }
+  return n[0]
+}
+
+// Returns the dependencies from the parallel arrays with the tags names, flags and versions.
+func (h *header) deps(names, flags, versions int32) []Dependency {
+  n := h.strs(names)
+  f := h.nums(flags)
+  v := h.strs(versions)
+  d := []Dependency{}
+  for i := range n {
+    dep := Dependency{Name:n[i]}
+    if i < len(f) { dep.Flags = uint32(f[i]) }
+    if i < len(v) { dep.Version = v[i] }
+    d = append(d, dep)
+  }
+  return d
+}
+
+// Returns the filename of p as built by rpmbuild, e.g. "foo-1.0-1.x86_64.rpm".
+func (p *Package) String() string {
+  return fmt.Sprintf("%v-%v-%v.%v.rpm", p.Name, p.Version, p.Release, p.Arch)
+}
+
+// Splits "[epoch:]version[-release]" into its parts.
+func splitEVR(evr string) (epoch, version, release string) {
+  if i := strings.Index(evr, ":"); i >= 0 {
+    epoch, evr = evr[:i], evr[i+1:]
+  }
+  version = evr
+  if i := strings.LastIndex(evr, "-"); i >= 0 {
+    version, release = evr[:i], evr[i+1:]
+  }
+  return
+}
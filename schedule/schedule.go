@@ -0,0 +1,255 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+/*
+  Runs recurring jobs (re-signing metadata, snapshots, statistics dumps,...)
+  inside the server at times given in cron syntax, so that no cron is
+  needed inside or outside of the chroot.
+*/
+package schedule
+
+import (
+         "io"
+         "fmt"
+         "sync"
+         "time"
+         "strconv"
+         "strings"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../status"
+       )
+
+/*
+  When a job runs. Either a cron expression or a fixed interval.
+  See Parse().
+*/
+type Spec struct {
+  // The text the Spec was parsed from.
+  text string
+  
+  // If > 0, the job runs every interval, starting interval after Start().
+  every time.Duration
+  
+  // Bit i is set if the value i is allowed.
+  minute, hour, dom, month, dow uint64
+  
+  // True if the day of month or the day of week field is "*". Like with
+  // cron, if neither is, a day matches if either field matches.
+  domAny, dowAny bool
+}
+
+// The abbreviations for common schedules.
+var shortcuts = map[string]string{
+  "@yearly": "0 0 1 1 *",
+  "@annually": "0 0 1 1 *",
+  "@monthly": "0 0 1 * *",
+  "@weekly": "0 0 * * 0",
+  "@daily": "0 0 * * *",
+  "@midnight": "0 0 * * *",
+  "@hourly": "0 * * * *",
+}
+
+/*
+  Parses a schedule: A cron expression with the 5 fields minute (0-59),
+  hour (0-23), day of month (1-31), month (1-12) and day of week (0-7,
+  where 0 and 7 are Sunday), each "*", a number, a range "a-b" or a
+  comma-separated list of these, optionally with a step "/n", e.g.
+  "30 3 * * 1-5" or "0 8-18/2 * * *". Or one of @yearly, @monthly, @weekly,
+  @daily, @hourly or "@every <duration>", e.g. "@every 6h". Times are in
+  the server's local time zone.
+*/
+func Parse(s string) (*Spec, error) {
+  s = strings.TrimSpace(s)
+  spec := &Spec{text:s}
+  if strings.HasPrefix(s, "@every ") {
+    d, err := time.ParseDuration(strings.TrimSpace(s[len("@every "):]))
+    if err != nil { return nil, err }
+    if d < time.Minute { return nil, fmt.Errorf("%v: The interval must be at least 1m", s) }
+    spec.every = d
+    return spec, nil
+  }
+  if expr, ok := shortcuts[s]; ok { s = expr }
+  fields := strings.Fields(s)
+  if len(fields) != 5 { return nil, fmt.Errorf("%v: Expected 5 fields (minute hour day-of-month month day-of-week)", s) }
+  
+  var err error
+  bits := []*uint64{&spec.minute, &spec.hour, &spec.dom, &spec.month, &spec.dow}
+  limits := [][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+  for i, field := range fields {
+    *bits[i], err = parseField(field, limits[i][0], limits[i][1])
+    if err != nil { return nil, fmt.Errorf("%v: %v", spec.text, err) }
+  }
+  if spec.dow & (1 << 7) != 0 { spec.dow |= 1 } // 7 is Sunday, too
+  spec.domAny = fields[2] == "*"
+  spec.dowAny = fields[4] == "*"
+  return spec, nil
+}
+
+// Parses a field of a cron expression whose values range from min to max.
+func parseField(field string, min, max int) (uint64, error) {
+  var bits uint64
+  for _, item := range strings.Split(field, ",") {
+    step := 1
+    if i := strings.Index(item, "/"); i >= 0 {
+      n, err := strconv.Atoi(item[i+1:])
+      if err != nil || n < 1 { return 0, fmt.Errorf("Illegal step in %v", item) }
+      step = n
+      item = item[0:i]
+    }
+    from, to := min, max
+    if item != "*" {
+      ft := strings.SplitN(item, "-", 2)
+      var err error
+      from, err = strconv.Atoi(ft[0])
+      if err != nil { return 0, fmt.Errorf("Illegal value: %v", item) }
+      to = from
+      if len(ft) == 2 {
+        to, err = strconv.Atoi(ft[1])
+        if err != nil { return 0, fmt.Errorf("Illegal value: %v", item) }
+      } else if step > 1 {
+        to = max // "5/15" means "5-max/15"
+      }
+      if from < min || to > max || from > to { return 0, fmt.Errorf("%v is out of range %v-%v", item, min, max) }
+    }
+    for v := from; v <= to; v += step { bits |= 1 << uint(v) }
+  }
+  return bits, nil
+}
+
+// Returns true if the day of t matches spec.
+func (spec *Spec) dayMatches(t time.Time) bool {
+  dom := spec.dom & (1 << uint(t.Day())) != 0
+  dow := spec.dow & (1 << uint(t.Weekday())) != 0
+  if spec.domAny || spec.dowAny { return dom && dow }
+  return dom || dow
+}
+
+/*
+  Returns the first time after t at which the job runs. Returns the zero
+  time if there is none within the next 5 years (e.g. "0 0 31 2 *").
+*/
+func (spec *Spec) Next(t time.Time) time.Time {
+  if spec.every > 0 { return t.Add(spec.every) }
+  t = t.Truncate(time.Minute).Add(time.Minute)
+  limit := t.AddDate(5, 0, 0)
+  for t.Before(limit) {
+    switch {
+      case spec.month & (1 << uint(t.Month())) == 0:
+        t = time.Date(t.Year(), t.Month() + 1, 1, 0, 0, 0, 0, t.Location())
+      case !spec.dayMatches(t):
+        t = time.Date(t.Year(), t.Month(), t.Day() + 1, 0, 0, 0, 0, t.Location())
+      case spec.hour & (1 << uint(t.Hour())) == 0:
+        t = t.Truncate(time.Hour).Add(time.Hour)
+      case spec.minute & (1 << uint(t.Minute())) == 0:
+        t = t.Add(time.Minute)
+      default:
+        return t
+    }
+  }
+  return time.Time{}
+}
+
+func (spec *Spec) String() string { return spec.text }
+
+// A recurring job.
+type Job struct {
+  // Describes the job in logs, metrics and the status page, e.g. "regenerate".
+  Name string
+  
+  Spec *Spec
+  
+  // Does the work. Jobs run in their own goroutines. A job does not run
+  // again before its previous run has finished.
+  Run func() error
+  
+  // Protects the fields below.
+  mutex sync.Mutex
+  next, last time.Time
+  duration time.Duration
+  err error
+  
+  ok, failed *status.Counter
+}
+
+// Protects jobs.
+var mutex sync.Mutex
+
+// The jobs that have been started.
+var jobs []*Job
+
+/*
+  Runs job according to its Spec until the program ends. Runs that are
+  missed because a previous run took too long are skipped.
+*/
+func Start(job *Job) {
+  job.ok = status.NewCounter(fmt.Sprintf(`garcon_scheduled_runs_total{job=%q,result="ok"}`, job.Name), "Runs of scheduled jobs by result.")
+  job.failed = status.NewCounter(fmt.Sprintf(`garcon_scheduled_runs_total{job=%q,result="error"}`, job.Name), "Runs of scheduled jobs by result.")
+  job.next = job.Spec.Next(time.Now())
+  mutex.Lock()
+  jobs = append(jobs, job)
+  mutex.Unlock()
+  go job.loop()
+}
+
+func (job *Job) loop() {
+  for {
+    job.mutex.Lock()
+    next := job.next
+    job.mutex.Unlock()
+    if next.IsZero() {
+      util.Log(0, "WARNING! Job %v (%v) never runs", job.Name, job.Spec)
+      return
+    }
+    time.Sleep(time.Until(next))
+    
+    util.Log(1, "Running job %v", job.Name)
+    start := time.Now()
+    err := job.Run()
+    duration := time.Since(start)
+    if err != nil {
+      job.failed.Inc()
+      util.Log(0, "ERROR! Job %v: %v", job.Name, err)
+    } else {
+      job.ok.Inc()
+      util.Log(1, "Job %v done in %v", job.Name, duration.Round(time.Millisecond))
+    }
+    
+    job.mutex.Lock()
+    job.last, job.duration, job.err = start, duration, err
+    job.next = job.Spec.Next(time.Now())
+    job.mutex.Unlock()
+  }
+}
+
+// Writes the schedule, the last run and the next run of each job as a status page section to w.
+func WriteStatus(w io.Writer) {
+  mutex.Lock()
+  js := append([]*Job{}, jobs...)
+  mutex.Unlock()
+  for _, job := range js {
+    job.mutex.Lock()
+    last := "never"
+    if !job.last.IsZero() {
+      result := "OK"
+      if job.err != nil { result = job.err.Error() }
+      last = fmt.Sprintf("%v (%v, %v)", job.last.Format(time.RFC3339), job.duration.Round(time.Millisecond), result)
+    }
+    next := "never"
+    if !job.next.IsZero() { next = job.next.Format(time.RFC3339) }
+    fmt.Fprintf(w, "%v [%v]: last run %v, next run %v\n", job.Name, job.Spec, last, next)
+    job.mutex.Unlock()
+  }
+}
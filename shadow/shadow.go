@@ -0,0 +1,225 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+/*
+  Replays a sample of the incoming GET and HEAD requests against a second
+  server (e.g. a staging instance with a new configuration) to validate it
+  under real traffic. The replays happen in the background after the
+  client has been answered, their responses are discarded and only
+  compared with the real responses by status and size. The results are
+  counted (see status.WriteMetrics()) and mismatches are logged.
+*/
+package shadow
+
+import (
+         "io"
+         "fmt"
+         "net"
+         "time"
+         "context"
+         "strings"
+         "net/url"
+         "net/http"
+         "io/ioutil"
+         "math/rand"
+         "crypto/x509"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../status"
+       )
+
+// The number of replays that run at the same time.
+const workers = 4
+
+// The request headers that are replayed. Credentials are never replayed.
+var replayedHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language", "Range", "If-None-Match", "If-Modified-Since", "User-Agent"}
+
+var (
+  shadowMatch = status.NewCounter(`garcon_shadow_requests_total{result="match"}`, "Requests replayed against the --shadow-url.")
+  shadowMismatch = status.NewCounter(`garcon_shadow_requests_total{result="mismatch"}`, "Requests replayed against the --shadow-url.")
+  shadowError = status.NewCounter(`garcon_shadow_requests_total{result="error"}`, "Requests replayed against the --shadow-url.")
+  shadowDropped = status.NewCounter(`garcon_shadow_requests_total{result="dropped"}`, "Requests replayed against the --shadow-url.")
+)
+
+// A server against which requests are replayed. See New().
+type Shadow struct {
+  base *url.URL
+  // The fraction (0 to 1) of the requests that are replayed.
+  ratio float64
+  client *http.Client
+  queue chan *replay
+}
+
+// A request to replay with what the real server answered.
+type replay struct {
+  method string
+  uri string
+  header http.Header
+  status int
+  size int64
+}
+
+/*
+  Prepares replaying the fraction ratio (0 to 1) of the requests against
+  the server at the base URL rawurl, whose path is prepended to the
+  requests' paths. The host name is resolved right away and the system's
+  trusted certificates are loaded, because neither is available after
+  chroot.
+  Call before chroot.
+*/
+func New(rawurl string, ratio float64) (*Shadow, error) {
+  u, err := url.Parse(rawurl)
+  if err != nil { return nil, err }
+  if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+    return nil, fmt.Errorf("Expected http:// or https:// URL, got %v", rawurl)
+  }
+  u.Path = strings.TrimSuffix(u.Path, "/")
+  u.RawQuery = ""
+  u.Fragment = ""
+  addrs, err := net.LookupHost(u.Hostname())
+  if err != nil { return nil, err }
+  if u.Scheme == "https" {
+    _, err = x509.SystemCertPool()
+    if err != nil { return nil, err }
+  }
+  dialer := &net.Dialer{Timeout:30*time.Second}
+  client := &http.Client{
+    Timeout: 60*time.Second,
+    // Redirects are compared, not followed.
+    CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse },
+    Transport: &http.Transport{
+      // Compare the same bytes the client got.
+      DisableCompression: true,
+      DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+        host, port, err := net.SplitHostPort(addr)
+        if err != nil { return nil, err }
+        if host == u.Hostname() {
+          for _, ip := range addrs {
+            conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+            if err == nil { return conn, nil }
+          }
+        }
+        return dialer.DialContext(ctx, network, addr)
+      },
+    },
+  }
+  s := &Shadow{base:u, ratio:ratio, client:client, queue:make(chan *replay, 1024)}
+  for i := 0; i < workers; i++ { go s.run() }
+  return s, nil
+}
+
+/*
+  Returns a handler that passes all requests on to h and replays a sample
+  of the GET and HEAD requests without credentials (Authorization header
+  or cookies) against s after h has answered them.
+*/
+func (s *Shadow) Wrap(h http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if (r.Method != "GET" && r.Method != "HEAD") || r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" || rand.Float64() >= s.ratio {
+      h.ServeHTTP(w, r)
+      return
+    }
+    rec := &recorder{ResponseWriter:w, status:http.StatusOK}
+    var rw http.ResponseWriter = rec
+    // Keep sendfile() for files.
+    if _, ok := w.(io.ReaderFrom); ok { rw = &readFromRecorder{rec} }
+    h.ServeHTTP(rw, r)
+    
+    rep := &replay{method:r.Method, uri:r.URL.RequestURI(), header:http.Header{}, status:rec.status, size:rec.bytes}
+    for _, name := range replayedHeaders {
+      if v, ok := r.Header[name]; ok { rep.header[name] = v }
+    }
+    select {
+      case s.queue <- rep:
+      default: shadowDropped.Inc()
+    }
+  })
+}
+
+// Replays the queued requests. Runs forever.
+func (s *Shadow) run() {
+  for rep := range s.queue { s.replay(rep) }
+}
+
+// Replays rep and compares the response with the real one.
+func (s *Shadow) replay(rep *replay) {
+  req, err := http.NewRequest(rep.method, s.base.String() + rep.uri, nil)
+  if err == nil {
+    req.Header = rep.header
+    var resp *http.Response
+    resp, err = s.client.Do(req)
+    if err == nil {
+      defer resp.Body.Close()
+      var size int64
+      size, err = io.Copy(ioutil.Discard, resp.Body)
+      if err == nil {
+        if resp.StatusCode == rep.status && (rep.method == "HEAD" || size == rep.size) {
+          shadowMatch.Inc()
+          util.Log(2, "Shadow %v %v: %v, %v bytes", rep.method, rep.uri, resp.StatusCode, size)
+        } else {
+          shadowMismatch.Inc()
+          util.Log(1, "Shadow %v %v: %v, %v bytes instead of %v, %v bytes", rep.method, rep.uri, resp.StatusCode, size, rep.status, rep.size)
+        }
+        return
+      }
+    }
+  }
+  shadowError.Inc()
+  util.Log(1, "Shadow %v %v: %v", rep.method, rep.uri, err)
+}
+
+// Records the status and size of a response.
+type recorder struct {
+  http.ResponseWriter
+  status int
+  bytes int64
+  wroteHeader bool
+}
+
+func (r *recorder) WriteHeader(status int) {
+  if !r.wroteHeader {
+    r.status = status
+    r.wroteHeader = true
+  }
+  r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(data []byte) (int, error) {
+  r.wroteHeader = true
+  n, err := r.ResponseWriter.Write(data)
+  r.bytes += int64(n)
+  return n, err
+}
+
+func (r *recorder) Flush() {
+  if f, ok := r.ResponseWriter.(http.Flusher); ok { f.Flush() }
+}
+
+// Lets http.ResponseController reach the underlying ResponseWriter, e.g. for write deadlines.
+func (r *recorder) Unwrap() http.ResponseWriter {
+  return r.ResponseWriter
+}
+
+// A recorder for a ResponseWriter that implements io.ReaderFrom.
+type readFromRecorder struct {
+  *recorder
+}
+
+func (r *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+  r.wroteHeader = true
+  n, err := r.ResponseWriter.(io.ReaderFrom).ReadFrom(src)
+  r.bytes += n
+  return n, err
+}
@@ -0,0 +1,218 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package status
+
+import (
+         "io"
+         "fmt"
+         "sort"
+         "sync"
+         "regexp"
+         "strings"
+         "net/http"
+         "crypto/tls"
+       )
+
+// A family of clients recognized by its User-Agent header.
+type clientFamily struct {
+  name string
+  // Matches the User-Agent header. The first group is the version.
+  re *regexp.Regexp
+}
+
+/*
+  The recognized client families, tried in order. Browsers come last and
+  the ones that claim to be other browsers (Edge and Opera claim to be
+  Chrome, which claims to be Safari) before the ones they imitate.
+  The versions are cut to what is needed to decide about dropping support,
+  e.g. "2.6" for apt 2.6.1 and "120" for Chrome 120.0.6099.109.
+*/
+var clientFamilies = []clientFamily{
+  {"apt", regexp.MustCompile(`^Debian APT-(?:HTTP|CURL)/\S+ \((\d+\.\d+)`)},
+  {"pacman", regexp.MustCompile(`^pacman/(\d+\.\d+)`)},
+  {"dnf", regexp.MustCompile(`^libdnf(?:/(\d+\.\d+))?`)},
+  {"yum", regexp.MustCompile(`^urlgrabber/(\d+\.\d+)`)},
+  {"pip", regexp.MustCompile(`^pip/(\d+)`)},
+  {"maven", regexp.MustCompile(`^Apache-Maven/(\d+\.\d+)`)},
+  {"gradle", regexp.MustCompile(`^Gradle/(\d+)`)},
+  {"docker", regexp.MustCompile(`^docker/(\d+)`)},
+  {"podman", regexp.MustCompile(`^(?:containers|podman)/(\d+)`)},
+  {"curl", regexp.MustCompile(`^curl/(\d+\.\d+)`)},
+  {"wget", regexp.MustCompile(`^Wget/(\d+\.\d+)`)},
+  {"aria2", regexp.MustCompile(`^aria2/(\d+\.\d+)`)},
+  {"axel", regexp.MustCompile(`^Axel[ /](\d+\.\d+)`)},
+  {"download manager", regexp.MustCompile(`(?i)download ?manager|JDownloader|FlashGet|Download Master|^lftp/(\d+\.\d+)`)},
+  {"edge", regexp.MustCompile(`Edg(?:e|A|iOS)?/(\d+)`)},
+  {"opera", regexp.MustCompile(`OPR/(\d+)`)},
+  {"chrome", regexp.MustCompile(`(?:Chrome|CriOS)/(\d+)`)},
+  {"firefox", regexp.MustCompile(`(?:Firefox|FxiOS)/(\d+)`)},
+  {"safari", regexp.MustCompile(`Version/(\d+)\S* (?:Mobile/\S+ )?Safari/`)},
+  {"msie", regexp.MustCompile(`MSIE (\d+)|Trident/.*rv:(\d+)`)},
+}
+
+/*
+  The number of versions per family that are counted separately. Requests
+  of further versions are counted as version "other", so that clients
+  cannot create arbitrarily many metrics.
+*/
+const maxClientVersions = 16
+
+// The labels of a counter of garcon_client_requests_total.
+type clientKey struct {
+  family, version, tls string
+}
+
+var (
+  // Protects clientCounters and clientVersions.
+  clientMutex sync.Mutex
+  clientCounters = map[clientKey]*Counter{}
+  // The versions of each family that have their own counters.
+  clientVersions = map[string]map[string]bool{}
+)
+
+/*
+  Returns the family (e.g. "apt") and version (e.g. "2.6") of the client
+  with the User-Agent header ua. The version is "" if unknown. The family
+  is "none" for an empty header and "other" if it is not recognized.
+*/
+func ClientFamily(ua string) (family, version string) {
+  if strings.TrimSpace(ua) == "" { return "none", "" }
+  for _, f := range clientFamilies {
+    if m := f.re.FindStringSubmatch(ua); m != nil {
+      for _, v := range m[1:] {
+        if v != "" { return f.name, v }
+      }
+      return f.name, ""
+    }
+  }
+  return "other", ""
+}
+
+// Returns the TLS version of the connection of r, e.g. "1.2", or "none".
+func tlsVersion(r *http.Request) string {
+  if r.TLS == nil { return "none" }
+  switch r.TLS.Version {
+    case tls.VersionTLS10: return "1.0"
+    case tls.VersionTLS11: return "1.1"
+    case tls.VersionTLS12: return "1.2"
+    case tls.VersionTLS13: return "1.3"
+  }
+  return "other"
+}
+
+// Counts the request r by the family and version of its client and its TLS version.
+func countClient(r *http.Request) {
+  family, version := ClientFamily(r.Header.Get("User-Agent"))
+  key := clientKey{family, version, tlsVersion(r)}
+  clientMutex.Lock()
+  c := clientCounters[key]
+  if c == nil {
+    versions := clientVersions[family]
+    if versions == nil {
+      versions = map[string]bool{}
+      clientVersions[family] = versions
+    }
+    if !versions[version] && len(versions) >= maxClientVersions {
+      key.version = "other"
+      c = clientCounters[key]
+    } else {
+      versions[version] = true
+    }
+  }
+  if c == nil {
+    c = NewCounter(`garcon_client_requests_total{family="`+key.family+`",version="`+key.version+`",tls="`+key.tls+`"}`, "Requests by the family and version of the client (from the User-Agent header) and the TLS version.")
+    clientCounters[key] = c
+  }
+  clientMutex.Unlock()
+  c.Inc()
+}
+
+/*
+  Returns a handler that counts the requests by their clients (see
+  WriteClients()) and passes them on to h.
+*/
+func CountClients(h http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    countClient(r)
+    h.ServeHTTP(w, r)
+  })
+}
+
+/*
+  Writes the requests counted by CountClients() as a status page section
+  to w: For each client family, most requests first, the share of all
+  requests and the requests of each version by TLS version, so that one
+  can see how many clients would be affected by dropping support for
+  old clients or old TLS versions.
+*/
+func WriteClients(w io.Writer) {
+  type versionCount struct {
+    version string
+    total uint64
+    tls map[string]uint64
+  }
+  type familyCount struct {
+    name string
+    total uint64
+    versions map[string]*versionCount
+  }
+  
+  families := map[string]*familyCount{}
+  total := uint64(0)
+  clientMutex.Lock()
+  for key, c := range clientCounters {
+    n := c.Value()
+    f := families[key.family]
+    if f == nil {
+      f = &familyCount{name:key.family, versions:map[string]*versionCount{}}
+      families[key.family] = f
+    }
+    v := f.versions[key.version]
+    if v == nil {
+      v = &versionCount{version:key.version, tls:map[string]uint64{}}
+      f.versions[key.version] = v
+    }
+    v.tls[key.tls] += n
+    v.total += n
+    f.total += n
+    total += n
+  }
+  clientMutex.Unlock()
+  if total == 0 { return }
+  
+  var sorted []*familyCount
+  for _, f := range families { sorted = append(sorted, f) }
+  sort.Slice(sorted, func(i, j int) bool {
+    if sorted[i].total != sorted[j].total { return sorted[i].total > sorted[j].total }
+    return sorted[i].name < sorted[j].name
+  })
+  for _, f := range sorted {
+    fmt.Fprintf(w, "%v: %v requests (%.1f%%)\n", f.name, f.total, 100*float64(f.total)/float64(total))
+    var versions []*versionCount
+    for _, v := range f.versions { versions = append(versions, v) }
+    sort.Slice(versions, func(i, j int) bool { return versions[i].version < versions[j].version })
+    for _, v := range versions {
+      var tlses []string
+      for t, n := range v.tls {
+        if t == "none" { t = "plain" } else { t = "TLS " + t }
+        tlses = append(tlses, fmt.Sprintf("%v %v", t, n))
+      }
+      sort.Strings(tlses)
+      version := v.version
+      if version == "" { version = "unknown version" }
+      fmt.Fprintf(w, "  %v: %v (%v)\n", version, v.total, strings.Join(tlses, ", "))
+    }
+  }
+}
@@ -0,0 +1,140 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package status
+
+import (
+         "io"
+         "fmt"
+         "sort"
+         "strings"
+         "net/http"
+         "sync/atomic"
+       )
+
+// A monotonically increasing counter exported as metric.
+type Counter struct {
+  // Name including labels, e.g. `garcon_filtered_requests_total{rule="path"}`.
+  name string
+  help string
+  value uint64
+}
+
+var counters []*Counter
+
+/*
+  Creates and registers a new Counter. name is the metric name in Prometheus
+  syntax and may include labels, e.g. `garcon_requests_total{code="404"}`.
+  Counters with the same base name should have the same help text.
+*/
+func NewCounter(name, help string) *Counter {
+  c := &Counter{name:name, help:help}
+  mutex.Lock()
+  defer mutex.Unlock()
+  counters = append(counters, c)
+  return c
+}
+
+// Increments c by 1.
+func (c *Counter) Inc() { atomic.AddUint64(&c.value, 1) }
+
+// Increments c by n.
+func (c *Counter) Add(n uint64) { atomic.AddUint64(&c.value, n) }
+
+// Returns the current value of c.
+func (c *Counter) Value() uint64 { return atomic.LoadUint64(&c.value) }
+
+// Returns the metric name of c without labels.
+func (c *Counter) base() string {
+  return strings.SplitN(c.name, "{", 2)[0]
+}
+
+// Returns all registered counters sorted by name.
+func sortedCounters() []*Counter {
+  mutex.Lock()
+  cs := append([]*Counter{}, counters...)
+  mutex.Unlock()
+  sort.Slice(cs, func(i, j int) bool { return cs[i].name < cs[j].name })
+  return cs
+}
+
+// A metric whose value is determined when it is exported.
+type Gauge struct {
+  // Name including labels, e.g. `garcon_memory_bytes{area="cache"}`.
+  name string
+  help string
+  value func() int64
+}
+
+var gauges []*Gauge
+
+/*
+  Creates and registers a new Gauge whose value is obtained by calling
+  value whenever the metrics are exported. name is the metric name in
+  Prometheus syntax and may include labels. Gauges with the same base
+  name should have the same help text.
+*/
+func NewGauge(name, help string, value func() int64) *Gauge {
+  g := &Gauge{name:name, help:help, value:value}
+  mutex.Lock()
+  defer mutex.Unlock()
+  gauges = append(gauges, g)
+  return g
+}
+
+// Returns the current value of g.
+func (g *Gauge) Value() int64 { return g.value() }
+
+// Returns all registered gauges sorted by name.
+func sortedGauges() []*Gauge {
+  mutex.Lock()
+  gs := append([]*Gauge{}, gauges...)
+  mutex.Unlock()
+  sort.Slice(gs, func(i, j int) bool { return gs[i].name < gs[j].name })
+  return gs
+}
+
+// Writes all counters and gauges in the Prometheus text exposition format to w.
+func WriteMetrics(w io.Writer) {
+  last := ""
+  for _, c := range sortedCounters() {
+    if base := c.base(); base != last {
+      fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v counter\n", base, c.help, base)
+      last = base
+    }
+    fmt.Fprintf(w, "%v %v\n", c.name, c.Value())
+  }
+  last = ""
+  for _, g := range sortedGauges() {
+    if base := strings.SplitN(g.name, "{", 2)[0]; base != last {
+      fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v gauge\n", base, g.help, base)
+      last = base
+    }
+    fmt.Fprintf(w, "%v %v\n", g.name, g.Value())
+  }
+}
+
+// Writes all counters as a status page section to w.
+func WriteCounters(w io.Writer) {
+  for _, c := range sortedCounters() {
+    fmt.Fprintf(w, "%v: %v\n", c.name, c.Value())
+  }
+}
+
+// Serves the metrics in the Prometheus text exposition format.
+var MetricsHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=UTF-8")
+  w.Header().Set("Cache-Control", "no-cache")
+  WriteMetrics(w)
+})
@@ -0,0 +1,80 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+/*
+  The status page. Subsystems register sections that are written
+  one after the other as plain text when the page is requested.
+*/
+package status
+
+import (
+         "io"
+         "fmt"
+         "sync"
+         "time"
+         "bytes"
+         "net/http"
+         "crypto/sha256"
+         
+         "../http2"
+       )
+
+// A section of the status page.
+type section struct {
+  title string
+  write func(w io.Writer)
+}
+
+// Protects sections.
+var mutex sync.Mutex
+
+var sections []section
+
+/*
+  Adds a section with the given title to the status page. When the page
+  is requested, write will be called to produce the section's contents.
+*/
+func Register(title string, write func(w io.Writer)) {
+  mutex.Lock()
+  defer mutex.Unlock()
+  sections = append(sections, section{title, write})
+}
+
+// Writes the complete status page to w.
+func Write(w io.Writer) {
+  mutex.Lock()
+  secs := sections
+  mutex.Unlock()
+  for i, sec := range secs {
+    if i > 0 { fmt.Fprintln(w) }
+    fmt.Fprintf(w, "%v\n", sec.title)
+    for range sec.title { fmt.Fprint(w, "=") }
+    fmt.Fprintln(w)
+    sec.write(w)
+  }
+}
+
+/*
+  Serves the status page. Its ETag is derived from its contents, so that
+  clients that poll it with If-None-Match get 304 Not Modified while nothing
+  has changed.
+*/
+var Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  var page bytes.Buffer
+  Write(&page)
+  w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+  w.Header().Set("Cache-Control", "no-cache")
+  w.Header().Set("ETag", fmt.Sprintf("\"%x\"", sha256.Sum224(page.Bytes())))
+  http2.ServeContent(w, r, time.Time{}, int64(page.Len()), bytes.NewReader(page.Bytes()))
+})
@@ -0,0 +1,146 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+/*
+  Loads the certificates for HTTPS and keeps an eye on their expiry, so
+  that the operators notice an expiring certificate before the clients do.
+*/
+package tlscert
+
+import (
+         "io"
+         "fmt"
+         "sync"
+         "time"
+         "strings"
+         "crypto/tls"
+         "crypto/x509"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../notify"
+         "../status"
+       )
+
+// How long before a certificate expires warnings are logged.
+var WarnBefore = 14*24*time.Hour
+
+// How often the certificates are checked.
+var CheckInterval = 12*time.Hour
+
+// A certificate with its private key.
+type Certificate struct {
+  // The file the certificate has been read from.
+  File string
+  
+  // The common name of the certificate or its first DNS name.
+  Subject string
+  
+  // When the certificate or one of the intermediate certificates in
+  // its chain expires, whichever is first.
+  NotAfter time.Time
+  
+  pair tls.Certificate
+}
+
+/*
+  Reads the certificate from "cert.pem[:key.pem]". Without key.pem, the
+  private key must be in cert.pem, too. cert.pem may contain the chain of
+  intermediate certificates after the server's certificate.
+  Call before chroot.
+*/
+func Load(spec string) (*Certificate, error) {
+  certfile, keyfile := spec, spec
+  if i := strings.LastIndex(spec, ":"); i >= 0 { certfile, keyfile = spec[0:i], spec[i+1:] }
+  pair, err := tls.LoadX509KeyPair(certfile, keyfile)
+  if err != nil { return nil, err }
+  c := &Certificate{File:certfile, pair:pair}
+  for i, der := range pair.Certificate {
+    x, err := x509.ParseCertificate(der)
+    if err != nil { return nil, fmt.Errorf("%v: %v", certfile, err) }
+    if i == 0 {
+      c.Subject = x.Subject.CommonName
+      if c.Subject == "" && len(x.DNSNames) > 0 { c.Subject = x.DNSNames[0] }
+    }
+    if i == 0 || x.NotAfter.Before(c.NotAfter) { c.NotAfter = x.NotAfter }
+  }
+  return c, nil
+}
+
+// Returns true if c (or its chain) has expired.
+func (c *Certificate) Expired() bool {
+  return !time.Now().Before(c.NotAfter)
+}
+
+func (c *Certificate) String() string {
+  return fmt.Sprintf("%v (%v)", c.File, c.Subject)
+}
+
+// Returns the TLS configuration that serves certs. The client's server name (SNI) selects the certificate.
+func Config(certs []*Certificate) *tls.Config {
+  config := &tls.Config{MinVersion:tls.VersionTLS12}
+  for _, c := range certs { config.Certificates = append(config.Certificates, c.pair) }
+  return config
+}
+
+// Protects watched.
+var mutex sync.Mutex
+
+// The certificates passed to Watch().
+var watched []*Certificate
+
+/*
+  Exports the expiry of certs as metrics and logs a warning every
+  CheckInterval from WarnBefore their expiry (an error once they have
+  expired).
+*/
+func Watch(certs []*Certificate) {
+  for _, c := range certs {
+    notAfter := c.NotAfter.Unix()
+    status.NewGauge(fmt.Sprintf(`garcon_tls_certificate_expiry_timestamp_seconds{file=%q,subject=%q}`, c.File, c.Subject), "Unix time at which a TLS certificate (or its chain) expires.", func() int64 { return notAfter })
+  }
+  mutex.Lock()
+  watched = append(watched, certs...)
+  mutex.Unlock()
+  go func() {
+    for {
+      for _, c := range certs { c.check() }
+      time.Sleep(CheckInterval)
+    }
+  }()
+}
+
+// Logs a warning if c expires within WarnBefore.
+func (c *Certificate) check() {
+  left := time.Until(c.NotAfter)
+  switch {
+    case left <= 0:
+      util.Log(0, "ERROR! TLS certificate %v expired on %v", c, c.NotAfter.Format(time.RFC3339))
+      notify.Send(notify.CertificateExpiry, c.File, fmt.Sprintf("TLS certificate %v expired", c.Subject), fmt.Sprintf("The TLS certificate %v expired on %v.", c, c.NotAfter.Format(time.RFC3339)))
+    case left < WarnBefore:
+      util.Log(0, "WARNING! TLS certificate %v expires in %v on %v", c, left.Round(time.Hour), c.NotAfter.Format(time.RFC3339))
+      notify.Send(notify.CertificateExpiry, c.File, fmt.Sprintf("TLS certificate %v expires in %v", c.Subject, left.Round(time.Hour)), fmt.Sprintf("The TLS certificate %v expires on %v.", c, c.NotAfter.Format(time.RFC3339)))
+  }
+}
+
+// Writes the certificates passed to Watch() with their expiry as a status page section to w.
+func WriteStatus(w io.Writer) {
+  mutex.Lock()
+  defer mutex.Unlock()
+  for _, c := range watched {
+    state := fmt.Sprintf("expires in %v", time.Until(c.NotAfter).Round(time.Hour))
+    if c.Expired() { state = "EXPIRED" }
+    fmt.Fprintf(w, "%v: %v, %v\n", c, c.NotAfter.Format(time.RFC3339), state)
+  }
+}
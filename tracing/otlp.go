@@ -0,0 +1,192 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package tracing
+
+import (
+         "io"
+         "fmt"
+         "net"
+         "time"
+         "bytes"
+         "context"
+         "net/url"
+         "net/http"
+         "io/ioutil"
+         "crypto/x509"
+         "encoding/json"
+         
+         "github.com/mbenkmann/golib/util"
+         
+         "../status"
+       )
+
+// Spans are sent in batches of at most this many.
+const batchSize = 512
+
+// Ended Spans are sent at the latest after this long.
+var ExportInterval = 5*time.Second
+
+// The exporter set by Enable(). nil if tracing is disabled.
+var exporter *otlpExporter
+
+var spansExported = status.NewCounter("garcon_trace_spans_exported_total", "Spans sent to the OpenTelemetry collector.")
+var spansDropped = status.NewCounter("garcon_trace_spans_dropped_total", "Spans dropped because the collector could not keep up or failed.")
+
+// Sends Spans to an OpenTelemetry collector via OTLP/HTTP with JSON encoding.
+type otlpExporter struct {
+  endpoint string
+  service string
+  client *http.Client
+  queue chan *Span
+}
+
+/*
+  Enables tracing. The Spans are sent to the OpenTelemetry collector at
+  endpoint (e.g. "http://localhost:4318/v1/traces") via OTLP/HTTP as
+  belonging to the service called service. The host name is resolved
+  right away and the system's trusted certificates are loaded, because
+  neither is available after chroot.
+  Call before chroot and before the first request.
+*/
+func Enable(endpoint, service string) error {
+  u, err := url.Parse(endpoint)
+  if err != nil { return err }
+  if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+    return fmt.Errorf("Expected http:// or https:// URL, got %v", endpoint)
+  }
+  addrs, err := net.LookupHost(u.Hostname())
+  if err != nil { return err }
+  if u.Scheme == "https" {
+    _, err = x509.SystemCertPool()
+    if err != nil { return err }
+  }
+  dialer := &net.Dialer{Timeout:30*time.Second}
+  client := &http.Client{
+    Timeout: 30*time.Second,
+    Transport: &http.Transport{
+      DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+        host, port, err := net.SplitHostPort(addr)
+        if err != nil { return nil, err }
+        if host == u.Hostname() {
+          for _, ip := range addrs {
+            conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+            if err == nil { return conn, nil }
+          }
+        }
+        return dialer.DialContext(ctx, network, addr)
+      },
+    },
+  }
+  exporter = &otlpExporter{endpoint:u.String(), service:service, client:client, queue:make(chan *Span, 8*batchSize)}
+  go exporter.run()
+  return nil
+}
+
+// Returns true if Enable() has been called.
+func Enabled() bool {
+  return exporter != nil
+}
+
+// Queues the ended Span s for sending. Drops it if the queue is full.
+func export(s *Span) {
+  if exporter == nil { return }
+  select {
+    case exporter.queue <- s:
+    default: spansDropped.Inc()
+  }
+}
+
+// Sends the queued Spans in batches. Runs forever.
+func (e *otlpExporter) run() {
+  tick := time.NewTicker(ExportInterval)
+  var batch []*Span
+  for {
+    select {
+      case s := <-e.queue:
+        batch = append(batch, s)
+        if len(batch) < batchSize { continue }
+      case <-tick.C:
+        if len(batch) == 0 { continue }
+    }
+    if err := e.send(batch); err != nil {
+      util.Log(1, "WARNING! Exporting %v spans: %v", len(batch), err)
+      spansDropped.Add(uint64(len(batch)))
+    } else {
+      spansExported.Add(uint64(len(batch)))
+    }
+    batch = nil
+  }
+}
+
+// Sends batch to the collector.
+func (e *otlpExporter) send(batch []*Span) error {
+  data, err := json.Marshal(e.encode(batch))
+  if err != nil { return err }
+  req, err := http.NewRequest("POST", e.endpoint, bytes.NewReader(data))
+  if err != nil { return err }
+  req.Header.Set("Content-Type", "application/json")
+  resp, err := e.client.Do(req)
+  if err != nil { return err }
+  defer resp.Body.Close()
+  msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+  if resp.StatusCode != http.StatusOK {
+    return fmt.Errorf("%v %v", resp.Status, string(bytes.TrimSpace(msg)))
+  }
+  return nil
+}
+
+// A JSON object of the OTLP request.
+type object map[string]interface{}
+
+// Returns the ExportTraceServiceRequest (in its JSON mapping) for batch.
+func (e *otlpExporter) encode(batch []*Span) object {
+  spans := make([]object, 0, len(batch))
+  for _, s := range batch {
+    s.mutex.Lock()
+    span := object{
+      "traceId": fmt.Sprintf("%x", s.traceID),
+      "spanId": fmt.Sprintf("%x", s.spanID),
+      "name": s.name,
+      "kind": s.kind,
+      "startTimeUnixNano": fmt.Sprintf("%d", s.start.UnixNano()),
+      "endTimeUnixNano": fmt.Sprintf("%d", s.end.UnixNano()),
+      "attributes": encodeAttributes(s.attrs),
+    }
+    if !isZero(s.parentID[:]) { span["parentSpanId"] = fmt.Sprintf("%x", s.parentID) }
+    // STATUS_CODE_ERROR
+    if s.err != "" { span["status"] = object{"code":2, "message":s.err} }
+    s.mutex.Unlock()
+    spans = append(spans, span)
+  }
+  resource := object{"attributes":encodeAttributes([]attribute{{"service.name", e.service}})}
+  scope := object{"name":"garcon"}
+  return object{"resourceSpans":[]object{{"resource":resource, "scopeSpans":[]object{{"scope":scope, "spans":spans}}}}}
+}
+
+// Returns attrs as OTLP KeyValues.
+func encodeAttributes(attrs []attribute) []object {
+  kvs := make([]object, 0, len(attrs))
+  for _, a := range attrs {
+    var value object
+    switch v := a.value.(type) {
+      case int64: value = object{"intValue":fmt.Sprintf("%d", v)}
+      case float64: value = object{"doubleValue":v}
+      case bool: value = object{"boolValue":v}
+      default: value = object{"stringValue":fmt.Sprintf("%v", v)}
+    }
+    kvs = append(kvs, object{"key":a.key, "value":value})
+  }
+  return kvs
+}
@@ -0,0 +1,289 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+/*
+  Traces of the handling of HTTP requests in the OpenTelemetry format,
+  which are exported to a collector (see Enable()), so that operators can
+  see where slow requests spend their time.
+  A trace consists of Spans, one for the whole request (see Wrap()) and
+  nested ones for its steps (see Start()). If tracing is not enabled or the
+  request is not sampled, no Spans are created and all functions of this
+  package are cheap no-ops, so the code that creates Spans does not need
+  to check.
+*/
+package tracing
+
+import (
+         "io"
+         "fmt"
+         "sync"
+         "time"
+         "strings"
+         "context"
+         "net/http"
+         mrand "math/rand"
+         "crypto/rand"
+         "encoding/hex"
+         
+         "../privacy"
+       )
+
+/*
+  The fraction (0 to 1) of requests without a traceparent header that are
+  traced. Requests with a traceparent header are traced if the caller has
+  sampled its span.
+*/
+var SampleRatio = 1.0
+
+// The W3C Trace Context header with which a caller passes its span.
+const TraceparentHeader = "traceparent"
+
+// The kinds of Spans.
+const (
+  KindInternal = 1
+  KindServer = 2
+  KindClient = 3
+)
+
+/*
+  A timed step of the handling of a request. A nil *Span is a Span that is
+  not recorded; all methods can be called on it.
+*/
+type Span struct {
+  traceID [16]byte
+  spanID [8]byte
+  // Zero if the Span has no parent.
+  parentID [8]byte
+  name string
+  kind int
+  start, end time.Time
+  mutex sync.Mutex
+  attrs []attribute
+  // "" if the step succeeded.
+  err string
+}
+
+// A key-value pair describing a Span.
+type attribute struct {
+  key string
+  // string, int64, float64 or bool
+  value interface{}
+}
+
+type contextKey int
+
+const spanKey contextKey = 0
+
+// Returns the Span stored in ctx or nil if there is none.
+func FromContext(ctx context.Context) *Span {
+  s, _ := ctx.Value(spanKey).(*Span)
+  return s
+}
+
+/*
+  Starts a Span called name, a child of the Span in ctx, of kind
+  KindInternal and returns it and a context with it for the Spans of the
+  nested steps. If ctx has no Span, returns ctx and nil.
+  Call End() on the Span when the step is done.
+*/
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+  return StartKind(ctx, name, KindInternal)
+}
+
+// Like Start() but for Spans of the given kind (e.g. KindClient).
+func StartKind(ctx context.Context, name string, kind int) (context.Context, *Span) {
+  parent := FromContext(ctx)
+  if parent == nil { return ctx, nil }
+  s := &Span{traceID:parent.traceID, parentID:parent.spanID, name:name, kind:kind, start:time.Now()}
+  randomBytes(s.spanID[:])
+  return context.WithValue(ctx, spanKey, s), s
+}
+
+// Adds the attribute key with value (string, integer, float or bool) to s.
+func (s *Span) SetAttr(key string, value interface{}) {
+  if s == nil { return }
+  switch v := value.(type) {
+    case int: value = int64(v)
+    case int32: value = int64(v)
+    case uint64: value = int64(v)
+    case float32: value = float64(v)
+    case string, int64, float64, bool:
+    default: value = fmt.Sprintf("%v", v)
+  }
+  s.mutex.Lock()
+  s.attrs = append(s.attrs, attribute{key, value})
+  s.mutex.Unlock()
+}
+
+/*
+  Returns true if s is recorded, i.e. not nil. SetAttr() on a nil Span
+  does nothing, but passing the value still costs an allocation, so hot
+  code paths check Recording() first.
+*/
+func (s *Span) Recording() bool {
+  return s != nil
+}
+
+// Marks s as failed with err unless err is nil.
+func (s *Span) SetError(err error) {
+  if s == nil || err == nil { return }
+  s.mutex.Lock()
+  s.err = err.Error()
+  s.mutex.Unlock()
+}
+
+// Ends s and hands it to the exporter. Later calls do nothing.
+func (s *Span) End() {
+  if s == nil { return }
+  s.mutex.Lock()
+  ended := !s.end.IsZero()
+  if !ended { s.end = time.Now() }
+  s.mutex.Unlock()
+  if !ended { export(s) }
+}
+
+/*
+  Returns the traceparent header value that passes s to the server of an
+  outgoing request, so that its spans become part of the same trace.
+*/
+func (s *Span) Traceparent() string {
+  if s == nil { return "" }
+  return fmt.Sprintf("00-%x-%x-01", s.traceID, s.spanID)
+}
+
+/*
+  Returns a handler that traces each request to h with a Span of kind
+  KindServer, which is available to h via FromContext(r.Context()).
+  If the request has a traceparent header, the Span is part of the
+  caller's trace.
+*/
+func Wrap(h http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    s := serverSpan(r)
+    if s == nil {
+      h.ServeHTTP(w, r)
+      return
+    }
+    s.SetAttr("http.request.method", r.Method)
+    s.SetAttr("url.path", r.URL.Path)
+    if r.URL.RawQuery != "" { s.SetAttr("url.query", r.URL.RawQuery) }
+    s.SetAttr("user_agent.original", privacy.UserAgent(r.UserAgent()))
+    s.SetAttr("client.address", privacy.IP(r.RemoteAddr))
+    rec := &recorder{ResponseWriter:w, status:http.StatusOK}
+    var rw http.ResponseWriter = rec
+    // Keep sendfile() for files.
+    if _, ok := w.(io.ReaderFrom); ok { rw = &readFromRecorder{rec} }
+    defer func() {
+      s.SetAttr("http.response.status_code", rec.status)
+      s.SetAttr("http.response.body.size", rec.bytes)
+      if rec.status >= 500 { s.SetError(fmt.Errorf("%v %v", rec.status, http.StatusText(rec.status))) }
+      s.End()
+    }()
+    h.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), spanKey, s)))
+  })
+}
+
+/*
+  Returns the Span for the request r, with the caller's span from the
+  traceparent header as parent, or nil if r is not traced.
+*/
+func serverSpan(r *http.Request) *Span {
+  if !Enabled() { return nil }
+  s := &Span{name:r.Method, kind:KindServer, start:time.Now()}
+  if parent, sampled, ok := parseTraceparent(r.Header.Get(TraceparentHeader)); ok {
+    if !sampled { return nil }
+    copy(s.traceID[:], parent[0:16])
+    copy(s.parentID[:], parent[16:24])
+  } else {
+    if SampleRatio < 1 && mrand.Float64() >= SampleRatio { return nil }
+    randomBytes(s.traceID[:])
+  }
+  randomBytes(s.spanID[:])
+  return s
+}
+
+/*
+  Parses the traceparent header value h ("00-<trace id>-<span id>-<flags>")
+  and returns the trace id followed by the span id, and whether the caller
+  has sampled its span. Returns ok == false if h is missing or invalid.
+*/
+func parseTraceparent(h string) (ids []byte, sampled bool, ok bool) {
+  parts := strings.Split(strings.TrimSpace(h), "-")
+  if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+    return nil, false, false
+  }
+  // Version 00 has exactly 4 fields, later versions may add more.
+  if parts[0] == "00" && len(parts) != 4 { return nil, false, false }
+  ids, err := hex.DecodeString(parts[1] + parts[2])
+  if err != nil { return nil, false, false }
+  flags, err := hex.DecodeString(parts[3])
+  if err != nil || isZero(ids[0:16]) || isZero(ids[16:24]) { return nil, false, false }
+  return ids, flags[0] & 1 != 0, true
+}
+
+func isZero(b []byte) bool {
+  for _, c := range b {
+    if c != 0 { return false }
+  }
+  return true
+}
+
+// Fills b with random bytes.
+func randomBytes(b []byte) {
+  rand.Read(b)
+}
+
+// Records the status and size of a response.
+type recorder struct {
+  http.ResponseWriter
+  status int
+  bytes int64
+  wroteHeader bool
+}
+
+func (r *recorder) WriteHeader(status int) {
+  if !r.wroteHeader {
+    r.status = status
+    r.wroteHeader = true
+  }
+  r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(data []byte) (int, error) {
+  r.wroteHeader = true
+  n, err := r.ResponseWriter.Write(data)
+  r.bytes += int64(n)
+  return n, err
+}
+
+func (r *recorder) Flush() {
+  if f, ok := r.ResponseWriter.(http.Flusher); ok { f.Flush() }
+}
+
+// Lets http.ResponseController reach the underlying ResponseWriter, e.g. for write deadlines.
+func (r *recorder) Unwrap() http.ResponseWriter {
+  return r.ResponseWriter
+}
+
+// A recorder for a ResponseWriter that implements io.ReaderFrom.
+type readFromRecorder struct {
+  *recorder
+}
+
+func (r *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+  r.wroteHeader = true
+  n, err := r.ResponseWriter.(io.ReaderFrom).ReadFrom(src)
+  r.bytes += n
+  return n, err
+}
@@ -0,0 +1,433 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+
+package xz
+
+import (
+         "io"
+         "errors"
+       )
+
+var errCorrupt = errors.New("xz: corrupt LZMA2 data")
+
+const (
+  numStates = 12
+  maxPosStates = 1 << 4
+  numLenToPosStates = 4
+  endPosModelIndex = 14
+  numFullDistances = 1 << (endPosModelIndex >> 1)
+  numAlignBits = 4
+  matchMinLen = 2
+)
+
+// The range decoder. It works on the complete compressed data of one LZMA2 chunk.
+type rangeDecoder struct {
+  in []byte
+  pos int
+  rng uint32
+  code uint32
+}
+
+func (rc *rangeDecoder) init(in []byte) error {
+  if len(in) < 5 || in[0] != 0 { return errCorrupt }
+  rc.in = in
+  rc.pos = 5
+  rc.rng = 0xFFFFFFFF
+  rc.code = uint32(in[1])<<24 | uint32(in[2])<<16 | uint32(in[3])<<8 | uint32(in[4])
+  return nil
+}
+
+func (rc *rangeDecoder) normalize() {
+  if rc.rng < 1<<24 {
+    rc.rng <<= 8
+    var b byte
+    // Reading past the end can only happen with corrupt data. It is
+    // detected by the caller after the chunk has been decoded.
+    if rc.pos < len(rc.in) { b = rc.in[rc.pos] }
+    rc.pos++
+    rc.code = rc.code<<8 | uint32(b)
+  }
+}
+
+func (rc *rangeDecoder) bit(prob *uint16) uint32 {
+  rc.normalize()
+  bound := (rc.rng >> 11) * uint32(*prob)
+  if rc.code < bound {
+    rc.rng = bound
+    *prob += (2048 - *prob) >> 5
+    return 0
+  }
+  rc.rng -= bound
+  rc.code -= bound
+  *prob -= *prob >> 5
+  return 1
+}
+
+func (rc *rangeDecoder) bittree(probs []uint16, numbits uint) uint32 {
+  m := uint32(1)
+  for i := uint(0); i < numbits; i++ {
+    m = m<<1 | rc.bit(&probs[m])
+  }
+  return m - (1 << numbits)
+}
+
+func (rc *rangeDecoder) reverseBittree(probs []uint16, numbits uint) uint32 {
+  m := uint32(1)
+  sym := uint32(0)
+  for i := uint(0); i < numbits; i++ {
+    bit := rc.bit(&probs[m])
+    m = m<<1 | bit
+    sym |= bit << i
+  }
+  return sym
+}
+
+func (rc *rangeDecoder) direct(numbits uint) uint32 {
+  res := uint32(0)
+  for ; numbits > 0; numbits-- {
+    rc.normalize()
+    rc.rng >>= 1
+    bit := uint32(0)
+    if rc.code >= rc.rng {
+      rc.code -= rc.rng
+      bit = 1
+    }
+    res = res<<1 | bit
+  }
+  return res
+}
+
+type lenDecoder struct {
+  choice, choice2 uint16
+  low [maxPosStates][1 << 3]uint16
+  mid [maxPosStates][1 << 3]uint16
+  high [1 << 8]uint16
+}
+
+// Returns the match length minus matchMinLen.
+func (ld *lenDecoder) decode(rc *rangeDecoder, posState uint32) uint32 {
+  if rc.bit(&ld.choice) == 0 {
+    return rc.bittree(ld.low[posState][:], 3)
+  }
+  if rc.bit(&ld.choice2) == 0 {
+    return 8 + rc.bittree(ld.mid[posState][:], 3)
+  }
+  return 16 + rc.bittree(ld.high[:], 8)
+}
+
+// The sliding window.
+type dictionary struct {
+  buf []byte
+  // Position in buf where the next byte will be written.
+  pos int
+  // Number of valid bytes in buf. Never more than len(buf).
+  full int
+  // Number of bytes written since the last reset.
+  total uint32
+  // Output produced since the last call to take().
+  out []byte
+}
+
+func (d *dictionary) reset() {
+  d.pos = 0
+  d.full = 0
+  d.total = 0
+}
+
+func (d *dictionary) put(b byte) {
+  d.buf[d.pos] = b
+  d.pos++
+  if d.pos == len(d.buf) { d.pos = 0 }
+  if d.full < len(d.buf) { d.full++ }
+  d.total++
+  d.out = append(d.out, b)
+}
+
+// Returns the byte dist+1 bytes back.
+func (d *dictionary) get(dist uint32) byte {
+  i := d.pos - int(dist) - 1
+  if i < 0 { i += len(d.buf) }
+  return d.buf[i]
+}
+
+func (d *dictionary) copyMatch(dist uint32, length int) error {
+  if int(dist) >= d.full { return errCorrupt }
+  for ; length > 0; length-- {
+    d.put(d.get(dist))
+  }
+  return nil
+}
+
+// The state of the LZMA decoder that persists across LZMA2 chunks.
+type lzmaDecoder struct {
+  lc, lp, pb uint
+  state uint32
+  rep [4]uint32
+  
+  literal []uint16
+  isMatch [numStates][maxPosStates]uint16
+  isRep, isRepG0, isRepG1, isRepG2 [numStates]uint16
+  isRep0Long [numStates][maxPosStates]uint16
+  posSlot [numLenToPosStates][1 << 6]uint16
+  posDecoders [1 + numFullDistances - endPosModelIndex]uint16
+  align [1 << numAlignBits]uint16
+  lenDec, repLenDec lenDecoder
+}
+
+func (z *lzmaDecoder) setProps(props byte) error {
+  if props >= 9*5*5 { return errCorrupt }
+  z.lc = uint(props % 9)
+  props /= 9
+  z.lp = uint(props % 5)
+  z.pb = uint(props / 5)
+  if z.lc + z.lp > 4 { return errCorrupt }
+  z.literal = make([]uint16, 0x300 << (z.lc + z.lp))
+  return nil
+}
+
+func initProbs(probs []uint16) {
+  for i := range probs { probs[i] = 1024 }
+}
+
+func (z *lzmaDecoder) resetState() {
+  z.state = 0
+  z.rep = [4]uint32{}
+  initProbs(z.literal)
+  for i := range z.isMatch { initProbs(z.isMatch[i][:]) }
+  initProbs(z.isRep[:])
+  initProbs(z.isRepG0[:])
+  initProbs(z.isRepG1[:])
+  initProbs(z.isRepG2[:])
+  for i := range z.isRep0Long { initProbs(z.isRep0Long[i][:]) }
+  for i := range z.posSlot { initProbs(z.posSlot[i][:]) }
+  initProbs(z.posDecoders[:])
+  initProbs(z.align[:])
+  for _, ld := range []*lenDecoder{&z.lenDec, &z.repLenDec} {
+    ld.choice = 1024
+    ld.choice2 = 1024
+    for i := range ld.low { initProbs(ld.low[i][:]) }
+    for i := range ld.mid { initProbs(ld.mid[i][:]) }
+    initProbs(ld.high[:])
+  }
+}
+
+// Decodes the compressed data of one LZMA2 chunk that produces exactly size bytes.
+func (z *lzmaDecoder) decodeChunk(d *dictionary, in []byte, size int) error {
+  var rc rangeDecoder
+  if err := rc.init(in); err != nil { return err }
+  
+  pbMask := uint32(1)<<z.pb - 1
+  lpMask := uint32(1)<<z.lp - 1
+  // The total position only matters modulo 2^pb and 2^lp, so the number of bytes
+  // produced so far in the dictionary is sufficient.
+  end := len(d.out) + size
+  for len(d.out) < end {
+    // The position is only used modulo small powers of 2, so overflow does not matter.
+    pos := d.total
+    posState := pos & pbMask
+    
+    if rc.bit(&z.isMatch[z.state][posState]) == 0 {
+      prev := uint32(0)
+      if d.full > 0 { prev = uint32(d.get(0)) }
+      probs := z.literal[0x300 * (((pos & lpMask) << z.lc) + (prev >> (8 - z.lc))):]
+      sym := uint32(1)
+      if z.state >= 7 {
+        if d.full <= int(z.rep[0]) { return errCorrupt }
+        match := uint32(d.get(z.rep[0]))
+        for sym < 0x100 {
+          matchBit := (match >> 7) & 1
+          match <<= 1
+          bit := rc.bit(&probs[0x100 + matchBit<<8 + sym])
+          sym = sym<<1 | bit
+          if matchBit != bit { break }
+        }
+      }
+      for sym < 0x100 {
+        sym = sym<<1 | rc.bit(&probs[sym])
+      }
+      d.put(byte(sym))
+      switch {
+        case z.state < 4: z.state = 0
+        case z.state < 10: z.state -= 3
+        default: z.state -= 6
+      }
+      continue
+    }
+    
+    var length uint32
+    if rc.bit(&z.isRep[z.state]) == 0 {
+      z.rep[3], z.rep[2], z.rep[1] = z.rep[2], z.rep[1], z.rep[0]
+      length = z.lenDec.decode(&rc, posState)
+      if z.state < 7 { z.state = 7 } else { z.state = 10 }
+      z.rep[0] = z.decodeDistance(&rc, length)
+      if z.rep[0] == 0xFFFFFFFF { return errCorrupt } // end marker is not allowed in LZMA2
+    } else {
+      if rc.bit(&z.isRepG0[z.state]) == 0 {
+        if rc.bit(&z.isRep0Long[z.state][posState]) == 0 {
+          if z.state < 7 { z.state = 9 } else { z.state = 11 }
+          if err := d.copyMatch(z.rep[0], 1); err != nil { return err }
+          continue
+        }
+      } else {
+        var dist uint32
+        if rc.bit(&z.isRepG1[z.state]) == 0 {
+          dist = z.rep[1]
+        } else {
+          if rc.bit(&z.isRepG2[z.state]) == 0 {
+            dist = z.rep[2]
+          } else {
+            dist = z.rep[3]
+            z.rep[3] = z.rep[2]
+          }
+          z.rep[2] = z.rep[1]
+        }
+        z.rep[1] = z.rep[0]
+        z.rep[0] = dist
+      }
+      length = z.repLenDec.decode(&rc, posState)
+      if z.state < 7 { z.state = 8 } else { z.state = 11 }
+    }
+    
+    n := int(length) + matchMinLen
+    if len(d.out) + n > end { return errCorrupt }
+    if err := d.copyMatch(z.rep[0], n); err != nil { return err }
+  }
+  
+  rc.normalize()
+  if rc.pos != len(rc.in) || rc.code != 0 { return errCorrupt }
+  return nil
+}
+
+func (z *lzmaDecoder) decodeDistance(rc *rangeDecoder, length uint32) uint32 {
+  lenState := length
+  if lenState > numLenToPosStates - 1 { lenState = numLenToPosStates - 1 }
+  posSlot := rc.bittree(z.posSlot[lenState][:], 6)
+  if posSlot < 4 { return posSlot }
+  numDirectBits := uint(posSlot>>1) - 1
+  dist := (2 | (posSlot & 1)) << numDirectBits
+  if posSlot < endPosModelIndex {
+    return dist + rc.reverseBittree(z.posDecoders[dist - posSlot:], numDirectBits)
+  }
+  dist += rc.direct(numDirectBits - numAlignBits) << numAlignBits
+  return dist + rc.reverseBittree(z.align[:], numAlignBits)
+}
+
+/*
+  Decodes a raw LZMA2 stream (without any container). Read() returns io.EOF
+  after the LZMA2 end marker has been decoded. No data is read from the
+  underlying reader beyond the end marker.
+*/
+type lzma2Reader struct {
+  r io.Reader
+  z lzmaDecoder
+  d dictionary
+  // The decoded data not yet returned by Read().
+  pending []byte
+  // Set after the end marker has been read or an error has occurred.
+  err error
+  // true until the first chunk that resets the dictionary.
+  needDictReset bool
+  // true until the first chunk that sets the properties.
+  needProps bool
+  // Buffer for the compressed data of a chunk.
+  in []byte
+}
+
+// dictSize must be at least 4096.
+func newLZMA2Reader(r io.Reader, dictSize int) *lzma2Reader {
+  return &lzma2Reader{
+    r:r,
+    d:dictionary{buf:make([]byte, dictSize)},
+    needDictReset:true,
+    needProps:true,
+    in:make([]byte, 1<<16),
+  }
+}
+
+func (lr *lzma2Reader) Read(p []byte) (n int, err error) {
+  for len(lr.pending) == 0 {
+    if lr.err != nil { return 0, lr.err }
+    lr.err = lr.decodeChunk()
+  }
+  n = copy(p, lr.pending)
+  lr.pending = lr.pending[n:]
+  return n, nil
+}
+
+// Decodes the next chunk into lr.pending. Returns io.EOF after the end marker.
+func (lr *lzma2Reader) decodeChunk() error {
+  var hdr [6]byte
+  if _, err := io.ReadFull(lr.r, hdr[:1]); err != nil { return noEOF(err) }
+  control := hdr[0]
+  
+  if control == 0x00 { return io.EOF }
+  
+  lr.d.out = lr.d.out[:0]
+  
+  if control == 0x01 || control == 0x02 {
+    // uncompressed chunk
+    if _, err := io.ReadFull(lr.r, hdr[:2]); err != nil { return noEOF(err) }
+    size := int(hdr[0])<<8 | int(hdr[1]) + 1
+    if control == 0x01 {
+      lr.d.reset()
+      lr.needDictReset = false
+    } else if lr.needDictReset {
+      return errCorrupt
+    }
+    if _, err := io.ReadFull(lr.r, lr.in[:size]); err != nil { return noEOF(err) }
+    for _, b := range lr.in[:size] {
+      lr.d.put(b)
+    }
+    lr.pending = lr.d.out
+    return nil
+  }
+  
+  if control < 0x80 { return errCorrupt }
+  
+  if _, err := io.ReadFull(lr.r, hdr[:4]); err != nil { return noEOF(err) }
+  size := int(control & 0x1F)<<16 | int(hdr[0])<<8 | int(hdr[1]) + 1
+  packed := int(hdr[2])<<8 | int(hdr[3]) + 1
+  
+  reset := (control >> 5) & 3
+  if reset == 3 {
+    lr.d.reset()
+    lr.needDictReset = false
+  } else if lr.needDictReset {
+    return errCorrupt
+  }
+  
+  if reset >= 2 {
+    if _, err := io.ReadFull(lr.r, hdr[:1]); err != nil { return noEOF(err) }
+    if err := lr.z.setProps(hdr[0]); err != nil { return err }
+    lr.needProps = false
+  } else if lr.needProps {
+    return errCorrupt
+  }
+  
+  if reset >= 1 {
+    lr.z.resetState()
+  }
+  
+  if _, err := io.ReadFull(lr.r, lr.in[:packed]); err != nil { return noEOF(err) }
+  if err := lr.z.decodeChunk(&lr.d, lr.in[:packed], size); err != nil { return err }
+  lr.pending = lr.d.out
+  return nil
+}
+
+// Turns io.EOF into io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+  if err == io.EOF { return io.ErrUnexpectedEOF }
+  return err
+}
@@ -0,0 +1,297 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+/*
+  A decoder for the .xz file format. Only the LZMA2 filter is supported
+  (which is what xz uses unless told otherwise, e.g. for Debian metadata).
+  Concatenated streams and stream padding are supported.
+*/
+package xz
+
+import (
+         "io"
+         "hash"
+         "bytes"
+         "bufio"
+         "errors"
+         "hash/crc32"
+         "hash/crc64"
+         "crypto/sha256"
+         "encoding/binary"
+       )
+
+var errFormat = errors.New("xz: invalid format")
+var errUnsupported = errors.New("xz: unsupported filter or option")
+var errChecksum = errors.New("xz: checksum error")
+
+var headerMagic = []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}
+var footerMagic = []byte{'Y', 'Z'}
+
+// Dictionary sizes larger than this are rejected to protect against memory exhaustion.
+// This is enough for everything produced by xz -9.
+const MaxDictSize = 64 << 20
+
+const (
+  checkNone = 0x00
+  checkCRC32 = 0x01
+  checkCRC64 = 0x04
+  checkSHA256 = 0x0A
+)
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// Reads an .xz file.
+type Reader struct {
+  r *bufio.Reader
+  // The check type of the current stream.
+  check byte
+  // The decoder for the current block. nil if between blocks.
+  block io.Reader
+  // The checksum of the current block's uncompressed data.
+  hash hash.Hash
+  // Number of blocks in the current stream. Used to verify the index.
+  blocks int
+  err error
+}
+
+/*
+  Returns a Reader that decompresses the .xz data read from r.
+  An error is returned if r does not start with a valid stream header.
+*/
+func NewReader(r io.Reader) (*Reader, error) {
+  xr := &Reader{r:bufio.NewReader(r)}
+  if err := xr.readStreamHeader(); err != nil { return nil, err }
+  return xr, nil
+}
+
+func (xr *Reader) Read(p []byte) (n int, err error) {
+  for xr.err == nil {
+    if xr.block == nil {
+      xr.err = xr.nextBlock()
+      continue
+    }
+    n, err = xr.block.Read(p)
+    xr.hash.Write(p[:n])
+    if err == io.EOF {
+      xr.err = xr.finishBlock()
+      if n > 0 { return n, nil }
+      continue
+    }
+    if err != nil { xr.err = err }
+    if n > 0 || err != nil { return n, err }
+  }
+  return 0, xr.err
+}
+
+func (xr *Reader) readStreamHeader() error {
+  var hdr [12]byte
+  if _, err := io.ReadFull(xr.r, hdr[:]); err != nil { return noEOF(err) }
+  if !bytes.Equal(hdr[0:6], headerMagic) { return errFormat }
+  if crc32.ChecksumIEEE(hdr[6:8]) != binary.LittleEndian.Uint32(hdr[8:12]) { return errChecksum }
+  if hdr[6] != 0 || hdr[7] > 0x0F { return errUnsupported }
+  xr.check = hdr[7]
+  xr.blocks = 0
+  return nil
+}
+
+func (xr *Reader) newHash() hash.Hash {
+  switch xr.check {
+    case checkCRC32: return crc32.NewIEEE()
+    case checkCRC64: return crc64.New(crc64Table)
+    case checkSHA256: return sha256.New()
+  }
+  return nil
+}
+
+// Reads the next block header or, if there are no more blocks, the index
+// and the stream footer. Returns io.EOF at the end of the last stream.
+func (xr *Reader) nextBlock() error {
+  size, err := xr.r.ReadByte()
+  if err != nil { return noEOF(err) }
+  if size == 0 {
+    if err := xr.readIndexAndFooter(); err != nil { return err }
+    return xr.nextStream()
+  }
+  
+  hdr := make([]byte, (int(size)+1)*4)
+  hdr[0] = size
+  if _, err := io.ReadFull(xr.r, hdr[1:]); err != nil { return noEOF(err) }
+  n := len(hdr) - 4
+  if crc32.ChecksumIEEE(hdr[:n]) != binary.LittleEndian.Uint32(hdr[n:]) { return errChecksum }
+  
+  flags := hdr[1]
+  if flags & 0x3C != 0 { return errUnsupported }
+  buf := bytes.NewReader(hdr[2:n])
+  if flags & 0x40 != 0 { // compressed size present
+    if _, err := readVarint(buf); err != nil { return err }
+  }
+  if flags & 0x80 != 0 { // uncompressed size present
+    if _, err := readVarint(buf); err != nil { return err }
+  }
+  if flags & 0x03 != 0 { return errUnsupported } // only a single filter is supported
+  id, err := readVarint(buf)
+  if err != nil { return err }
+  propsize, err := readVarint(buf)
+  if err != nil { return err }
+  if id != 0x21 || propsize != 1 { return errUnsupported } // LZMA2
+  props, err := buf.ReadByte()
+  if err != nil { return errFormat }
+  if props > 40 { return errFormat }
+  dictSize := uint64(4096)
+  if props < 40 {
+    dictSize = uint64(2 | (props & 1)) << (props/2 + 11)
+  } else {
+    dictSize = 0xFFFFFFFF
+  }
+  if dictSize > MaxDictSize { return errUnsupported }
+  if dictSize < 4096 { dictSize = 4096 }
+  
+  xr.hash = xr.newHash()
+  if xr.hash == nil { xr.hash = nullHash{} }
+  xr.block = newLZMA2Reader(&countingReader{r:xr.r}, int(dictSize))
+  xr.blocks++
+  return nil
+}
+
+// Reads block padding and check after the current block's data.
+func (xr *Reader) finishBlock() error {
+  cr := xr.block.(*lzma2Reader).r.(*countingReader)
+  xr.block = nil
+  for ; cr.n % 4 != 0; cr.n++ {
+    b, err := xr.r.ReadByte()
+    if err != nil { return noEOF(err) }
+    if b != 0 { return errFormat }
+  }
+  
+  size := 0
+  switch {
+    case xr.check == checkNone: size = 0
+    case xr.check <= 0x03: size = 4
+    case xr.check <= 0x06: size = 8
+    case xr.check <= 0x09: size = 16
+    case xr.check <= 0x0C: size = 32
+    default: size = 64
+  }
+  check := make([]byte, size)
+  if _, err := io.ReadFull(xr.r, check); err != nil { return noEOF(err) }
+  if _, ok := xr.hash.(nullHash); ok { return nil } // unknown check types are skipped
+  sum := xr.hash.Sum(nil)
+  if xr.check != checkSHA256 {
+    // CRC32 and CRC64 are stored little endian
+    for i, j := 0, len(sum)-1; i < j; i, j = i+1, j-1 {
+      sum[i], sum[j] = sum[j], sum[i]
+    }
+  }
+  if !bytes.Equal(sum, check) { return errChecksum }
+  return nil
+}
+
+// Reads the index (after its indicator byte 0x00) and the stream footer.
+func (xr *Reader) readIndexAndFooter() error {
+  cr := &countingReader{r:xr.r, n:1}
+  h := crc32.NewIEEE()
+  h.Write([]byte{0})
+  tr := io.TeeReader(cr, h)
+  br := bufio.NewReaderSize(tr, 16) // only used as io.ByteReader
+  _ = br
+  bytereader := byteReader{tr}
+  records, err := readVarint(bytereader)
+  if err != nil { return err }
+  if records != uint64(xr.blocks) { return errFormat }
+  for i := uint64(0); i < 2*records; i++ {
+    if _, err := readVarint(bytereader); err != nil { return err }
+  }
+  for cr.n % 4 != 0 {
+    b, err := bytereader.ReadByte()
+    if err != nil { return err }
+    if b != 0 { return errFormat }
+  }
+  sum := h.Sum32()
+  var crc [4]byte
+  if _, err := io.ReadFull(xr.r, crc[:]); err != nil { return noEOF(err) }
+  if binary.LittleEndian.Uint32(crc[:]) != sum { return errChecksum }
+  
+  var footer [12]byte
+  if _, err := io.ReadFull(xr.r, footer[:]); err != nil { return noEOF(err) }
+  if !bytes.Equal(footer[10:12], footerMagic) { return errFormat }
+  if crc32.ChecksumIEEE(footer[4:10]) != binary.LittleEndian.Uint32(footer[0:4]) { return errChecksum }
+  if footer[8] != 0 || footer[9] != xr.check { return errFormat }
+  return nil
+}
+
+// Skips stream padding and reads the header of the next stream, if any.
+// Returns io.EOF if there is none.
+func (xr *Reader) nextStream() error {
+  padding := 0
+  for {
+    b, err := xr.r.Peek(1)
+    if err == io.EOF {
+      if padding % 4 != 0 { return errFormat }
+      return io.EOF
+    }
+    if err != nil { return err }
+    if b[0] != 0 { break }
+    xr.r.ReadByte()
+    padding++
+  }
+  if padding % 4 != 0 { return errFormat }
+  return xr.readStreamHeader()
+}
+
+// Reads a variable length integer as used in the xz format.
+func readVarint(r io.ByteReader) (uint64, error) {
+  var x uint64
+  for i := uint(0); i < 9; i++ {
+    b, err := r.ReadByte()
+    if err != nil { return 0, errFormat }
+    x |= uint64(b & 0x7F) << (7*i)
+    if b & 0x80 == 0 {
+      if b == 0 && i > 0 { return 0, errFormat }
+      return x, nil
+    }
+  }
+  return 0, errFormat
+}
+
+// Counts the bytes read through it.
+type countingReader struct {
+  r io.Reader
+  n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+  n, err := cr.r.Read(p)
+  cr.n += int64(n)
+  return n, err
+}
+
+// Turns an io.Reader into an io.ByteReader without any read-ahead.
+type byteReader struct {
+  r io.Reader
+}
+
+func (br byteReader) ReadByte() (byte, error) {
+  var b [1]byte
+  _, err := io.ReadFull(br.r, b[:])
+  return b[0], err
+}
+
+// Used for check types that this decoder does not know.
+type nullHash struct{}
+
+func (nullHash) Write(p []byte) (int, error) { return len(p), nil }
+func (nullHash) Sum(b []byte) []byte { return b }
+func (nullHash) Reset() {}
+func (nullHash) Size() int { return 0 }
+func (nullHash) BlockSize() int { return 1 }
@@ -0,0 +1,188 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package zstd
+
+// A decoding table for Finite State Entropy coded data.
+type fseTable struct {
+  // The accuracy log. The table has 1<<log entries.
+  log int
+  entries []fseEntry
+}
+
+type fseEntry struct {
+  symbol uint8
+  // Number of bits to read for the next state and the base to add them to.
+  bits uint8
+  base uint16
+}
+
+// Returns the state that follows state, reading its bits from br.
+func (t *fseTable) next(state int, br *backwardReader) int {
+  e := t.entries[state]
+  return int(e.base) + br.read(int(e.bits))
+}
+
+/*
+  Builds the decoding table for the normalized probabilities probs of
+  the symbols 0,1,... (-1 means "less than 1") with accuracy log.
+*/
+func buildFSE(probs []int, log int) (*fseTable, error) {
+  size := 1 << uint(log)
+  t := &fseTable{log:log, entries:make([]fseEntry, size)}
+  next := make([]int, len(probs))
+  high := size - 1
+  for s, p := range probs {
+    if p == -1 {
+      t.entries[high].symbol = uint8(s)
+      high--
+      next[s] = 1
+    } else {
+      next[s] = p
+    }
+  }
+  step := (size >> 1) + (size >> 3) + 3
+  pos := 0
+  for s, p := range probs {
+    for i := 0; i < p; i++ {
+      t.entries[pos].symbol = uint8(s)
+      pos = (pos + step) & (size - 1)
+      for pos > high { pos = (pos + step) & (size - 1) }
+    }
+  }
+  if pos != 0 { return nil, errFormat }
+  for i := range t.entries {
+    s := t.entries[i].symbol
+    n := next[s]
+    next[s]++
+    if n <= 0 { return nil, errFormat }
+    bits := log - highBit(n)
+    t.entries[i].bits = uint8(bits)
+    t.entries[i].base = uint16((n << uint(bits)) - size)
+  }
+  return t, nil
+}
+
+/*
+  Reads an FSE table description from the start of data for symbols
+  up to maxSymbol with an accuracy log of at most maxLog.
+  Returns the table and the size of the description.
+*/
+func readFSE(data []byte, maxSymbol int, maxLog int) (*fseTable, int, error) {
+  fr := &forwardReader{data:data}
+  v, err := fr.read(4)
+  if err != nil { return nil, 0, err }
+  log := v + 5
+  if log > maxLog { return nil, 0, errFormat }
+  remaining := 1 << uint(log) + 1
+  threshold := 1 << uint(log)
+  bits := log + 1
+  probs := []int{}
+  for remaining > 1 && len(probs) <= maxSymbol {
+    max := 2*threshold - 1 - remaining
+    low, err := fr.read(bits - 1)
+    if err != nil { return nil, 0, err }
+    count := low
+    if low >= max {
+      hi, err := fr.read(1)
+      if err != nil { return nil, 0, err }
+      count = low + hi << uint(bits - 1)
+      if count >= threshold { count -= max }
+    }
+    count--
+    if count < 0 { remaining += count } else { remaining -= count }
+    probs = append(probs, count)
+    if count == 0 {
+      for {
+        r, err := fr.read(2)
+        if err != nil { return nil, 0, err }
+        for i := 0; i < r; i++ { probs = append(probs, 0) }
+        if r != 3 { break }
+      }
+    }
+    for remaining < threshold && threshold > 1 {
+      bits--
+      threshold >>= 1
+    }
+  }
+  if remaining != 1 || len(probs) > maxSymbol + 1 { return nil, 0, errFormat }
+  t, err := buildFSE(probs, log)
+  if err != nil { return nil, 0, err }
+  return t, fr.bytes(), nil
+}
+
+// Returns a table that always decodes symbol without reading bits.
+func rleTable(symbol byte) *fseTable {
+  return &fseTable{log:0, entries:[]fseEntry{{symbol:symbol}}}
+}
+
+// A predefined table, built when it is first used.
+type defaultTable struct {
+  probs []int
+  log int
+  maxSymbol int
+  maxLog int
+  table *fseTable
+}
+
+var llDefault = defaultTable{
+  probs:[]int{4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1, -1, -1, -1, -1},
+  log:6, maxSymbol:35, maxLog:9,
+}
+
+var mlDefault = defaultTable{
+  probs:[]int{1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1, -1, -1},
+  log:6, maxSymbol:52, maxLog:9,
+}
+
+var ofDefault = defaultTable{
+  probs:[]int{1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1},
+  log:5, maxSymbol:31, maxLog:8,
+}
+
+func init() {
+  for _, d := range []*defaultTable{&llDefault, &mlDefault, &ofDefault} {
+    t, err := buildFSE(d.probs, d.log)
+    if err != nil { panic(err) }
+    d.table = t
+  }
+}
+
+/*
+  Reads the table for literal lengths, offsets or match lengths according
+  to mode (0: predefined, 1: RLE, 2: FSE compressed, 3: repeat prev) from
+  the start of data. Returns the table and the rest of data.
+*/
+func readSeqTable(data []byte, mode byte, prev *fseTable, def *defaultTable) (*fseTable, []byte, error) {
+  switch mode {
+    case 0: return def.table, data, nil
+    case 1:
+      if len(data) < 1 || int(data[0]) > def.maxSymbol { return nil, nil, errFormat }
+      return rleTable(data[0]), data[1:], nil
+    case 2:
+      t, n, err := readFSE(data, def.maxSymbol, def.maxLog)
+      if err != nil { return nil, nil, err }
+      return t, data[n:], nil
+  }
+  if prev == nil { return nil, nil, errFormat }
+  return prev, data, nil
+}
+
+// Baselines and extra bits of the literal length codes.
+var llBase = [36]uint32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536}
+var llBits = [36]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+
+// Baselines and extra bits of the match length codes.
+var mlBase = [53]uint32{3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34, 35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051, 4099, 8195, 16387, 32771, 65539}
+var mlBits = [53]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
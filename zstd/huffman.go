@@ -0,0 +1,109 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package zstd
+
+const maxHuffBits = 11
+
+// A decoding table for Huffman coded literals, indexed by the next maxBits bits.
+type huffTable struct {
+  maxBits int
+  symbols []byte
+  bits []uint8
+}
+
+/*
+  Reads a Huffman tree description from the start of data.
+  Returns the table and the size of the description.
+*/
+func readHuffTable(data []byte) (*huffTable, int, error) {
+  if len(data) < 1 { return nil, 0, errFormat }
+  hb := int(data[0])
+  weights := []int{}
+  size := 0
+  if hb < 128 {
+    // The weights are FSE compressed with 2 interleaved states.
+    size = 1 + hb
+    if len(data) < size { return nil, 0, errFormat }
+    t, n, err := readFSE(data[1:size], 255, 6)
+    if err != nil { return nil, 0, err }
+    br, err := newBackwardReader(data[1+n:size])
+    if err != nil { return nil, 0, err }
+    s1 := br.read(t.log)
+    s2 := br.read(t.log)
+    for len(weights) < 255 {
+      weights = append(weights, int(t.entries[s1].symbol))
+      s1 = t.next(s1, br)
+      if br.pos < 0 {
+        weights = append(weights, int(t.entries[s2].symbol))
+        break
+      }
+      weights = append(weights, int(t.entries[s2].symbol))
+      s2 = t.next(s2, br)
+      if br.pos < 0 {
+        weights = append(weights, int(t.entries[s1].symbol))
+        break
+      }
+    }
+  } else {
+    n := hb - 127
+    size = 1 + (n + 1) / 2
+    if len(data) < size { return nil, 0, errFormat }
+    for i := 0; i < n; i++ {
+      b := data[1 + i/2]
+      if i % 2 == 0 { weights = append(weights, int(b >> 4)) } else { weights = append(weights, int(b & 15)) }
+    }
+  }
+  if len(weights) > 255 { return nil, 0, errFormat }
+  
+  // The weight of the last symbol is implied by the others.
+  sum := 0
+  for _, w := range weights {
+    if w > maxHuffBits { return nil, 0, errFormat }
+    if w > 0 { sum += 1 << uint(w - 1) }
+  }
+  if sum == 0 { return nil, 0, errFormat }
+  maxBits := highBit(sum) + 1
+  left := 1 << uint(maxBits) - sum
+  if maxBits > maxHuffBits || left & (left - 1) != 0 { return nil, 0, errFormat }
+  weights = append(weights, highBit(left) + 1)
+  
+  t := &huffTable{maxBits:maxBits, symbols:make([]byte, 1 << uint(maxBits)), bits:make([]uint8, 1 << uint(maxBits))}
+  pos := 0
+  for w := 1; w <= maxBits; w++ {
+    for s, sw := range weights {
+      if sw != w { continue }
+      n := 1 << uint(w - 1)
+      for i := 0; i < n; i++ {
+        t.symbols[pos] = byte(s)
+        t.bits[pos] = uint8(maxBits + 1 - w)
+        pos++
+      }
+    }
+  }
+  return t, size, nil
+}
+
+// Decodes n literals from the Huffman coded stream data and appends them to lit.
+func (t *huffTable) decode(lit []byte, data []byte, n int) ([]byte, error) {
+  br, err := newBackwardReader(data)
+  if err != nil { return nil, err }
+  for i := 0; i < n; i++ {
+    v := br.peek(t.maxBits)
+    lit = append(lit, t.symbols[v])
+    br.pos -= int(t.bits[v])
+  }
+  if !br.finished() { return nil, errFormat }
+  return lit, nil
+}
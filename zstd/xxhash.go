@@ -0,0 +1,106 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package zstd
+
+import (
+         "math/bits"
+         "encoding/binary"
+       )
+
+// Variables rather than constants, so that arithmetic on them wraps around.
+var (
+  prime1 uint64 = 11400714785074694791
+  prime2 uint64 = 14029467366897019727
+  prime3 uint64 = 1609587929392839161
+  prime4 uint64 = 9650029242287828579
+  prime5 uint64 = 2870177450012600261
+)
+
+// XXH64 with seed 0, which is the content checksum of frames.
+type xxhash64 struct {
+  v [4]uint64
+  total uint64
+  buf []byte
+}
+
+func newXXHash64() *xxhash64 {
+  return &xxhash64{v:[4]uint64{prime1 + prime2, prime2, 0, -prime1}}
+}
+
+func round(acc, input uint64) uint64 {
+  acc += input * prime2
+  acc = bits.RotateLeft64(acc, 31)
+  return acc * prime1
+}
+
+func mergeRound(acc, val uint64) uint64 {
+  acc ^= round(0, val)
+  return acc * prime1 + prime4
+}
+
+func (h *xxhash64) write(p []byte) {
+  h.total += uint64(len(p))
+  if len(h.buf) > 0 {
+    n := 32 - len(h.buf)
+    if n > len(p) { n = len(p) }
+    h.buf = append(h.buf, p[:n]...)
+    p = p[n:]
+    if len(h.buf) < 32 { return }
+    h.stripe(h.buf)
+    h.buf = h.buf[:0]
+  }
+  for len(p) >= 32 {
+    h.stripe(p)
+    p = p[32:]
+  }
+  h.buf = append(h.buf, p...)
+}
+
+func (h *xxhash64) stripe(p []byte) {
+  for i := range h.v { h.v[i] = round(h.v[i], binary.LittleEndian.Uint64(p[8*i:])) }
+}
+
+func (h *xxhash64) sum() uint64 {
+  var acc uint64
+  if h.total >= 32 {
+    acc = bits.RotateLeft64(h.v[0], 1) + bits.RotateLeft64(h.v[1], 7) + bits.RotateLeft64(h.v[2], 12) + bits.RotateLeft64(h.v[3], 18)
+    for _, v := range h.v { acc = mergeRound(acc, v) }
+  } else {
+    acc = h.v[2] + prime5
+  }
+  acc += h.total
+  
+  p := h.buf
+  for ; len(p) >= 8; p = p[8:] {
+    acc ^= round(0, binary.LittleEndian.Uint64(p))
+    acc = bits.RotateLeft64(acc, 27) * prime1 + prime4
+  }
+  if len(p) >= 4 {
+    acc ^= uint64(binary.LittleEndian.Uint32(p)) * prime1
+    acc = bits.RotateLeft64(acc, 23) * prime2 + prime3
+    p = p[4:]
+  }
+  for _, b := range p {
+    acc ^= uint64(b) * prime5
+    acc = bits.RotateLeft64(acc, 11) * prime1
+  }
+  
+  acc ^= acc >> 33
+  acc *= prime2
+  acc ^= acc >> 29
+  acc *= prime3
+  acc ^= acc >> 32
+  return acc
+}
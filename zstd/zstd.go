@@ -0,0 +1,451 @@
+/*
+Copyright (c) 2016 Matthias S. Benkmann
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; version 3
+of the License (ONLY this version).
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+/*
+  A decoder for the Zstandard format (RFC 8878), e.g. Arch Linux packages
+  (.pkg.tar.zst). Dictionaries are not supported. Concatenated and
+  skippable frames are.
+*/
+package zstd
+
+import (
+         "io"
+         "bufio"
+         "errors"
+         "encoding/binary"
+       )
+
+var errFormat = errors.New("zstd: invalid format")
+var errUnsupported = errors.New("zstd: dictionaries are not supported")
+var errChecksum = errors.New("zstd: checksum error")
+var errWindow = errors.New("zstd: window too large")
+
+// Window sizes larger than this are rejected to protect against memory exhaustion.
+// This is enough for everything produced by zstd without --long.
+const MaxWindowSize = 128 << 20
+
+const frameMagic = 0xFD2FB528
+const maxBlockSize = 128 << 10
+
+// Reads a .zst file.
+type Reader struct {
+  r *bufio.Reader
+  
+  // The decoded data of the current frame. The last window bytes are
+  // kept for matches of later blocks. out[pending:] has not been read yet.
+  out []byte
+  pending int
+  window int
+  
+  // Set if the current frame has a content checksum.
+  checksum bool
+  hash *xxhash64
+  
+  // The last block of the current frame has been decoded.
+  last bool
+  
+  // Repeated offsets.
+  rep [3]int
+  
+  // Tables that can be repeated by following blocks.
+  huff *huffTable
+  ll, of, ml *fseTable
+  
+  // false until the first frame header has been read.
+  started bool
+  err error
+}
+
+/*
+  Returns a Reader that decompresses the Zstandard data read from r.
+  An error is returned if r does not start with a valid frame.
+*/
+func NewReader(r io.Reader) (*Reader, error) {
+  zr := &Reader{r:bufio.NewReader(r)}
+  if err := zr.nextFrame(); err != nil { return nil, err }
+  zr.started = true
+  return zr, nil
+}
+
+func (zr *Reader) Read(p []byte) (n int, err error) {
+  for zr.err == nil {
+    if zr.pending < len(zr.out) {
+      n = copy(p, zr.out[zr.pending:])
+      zr.pending += n
+      return n, nil
+    }
+    if !zr.last {
+      zr.err = zr.nextBlock()
+      continue
+    }
+    zr.err = zr.finishFrame()
+    if zr.err == nil { zr.err = zr.nextFrame() }
+  }
+  return 0, zr.err
+}
+
+// Reads the next frame header, skipping skippable frames.
+// Returns io.EOF if there are no more frames.
+func (zr *Reader) nextFrame() error {
+  var magic [4]byte
+  for {
+    _, err := io.ReadFull(zr.r, magic[:])
+    if err == io.EOF && zr.started { return io.EOF }
+    if err != nil { return noEOF(err) }
+    m := binary.LittleEndian.Uint32(magic[:])
+    if m == frameMagic { break }
+    if m & 0xFFFFFFF0 != 0x184D2A50 { return errFormat }
+    _, err = io.ReadFull(zr.r, magic[:])
+    if err != nil { return noEOF(err) }
+    _, err = zr.r.Discard(int(binary.LittleEndian.Uint32(magic[:])))
+    if err != nil { return noEOF(err) }
+  }
+  
+  desc, err := zr.r.ReadByte()
+  if err != nil { return noEOF(err) }
+  fcsFlag := desc >> 6
+  single := desc & 0x20 != 0
+  if desc & 0x08 != 0 { return errFormat }
+  zr.checksum = desc & 0x04 != 0
+  if desc & 3 != 0 { return errUnsupported }
+  
+  window := uint64(0)
+  if !single {
+    wd, err := zr.r.ReadByte()
+    if err != nil { return noEOF(err) }
+    exp := uint(wd >> 3) + 10
+    if exp > 41 { return errWindow }
+    base := uint64(1) << exp
+    window = base + (base / 8) * uint64(wd & 7)
+  }
+  
+  fcsSize := []int{0, 2, 4, 8}[fcsFlag]
+  if fcsFlag == 0 && single { fcsSize = 1 }
+  var fcs [8]byte
+  _, err = io.ReadFull(zr.r, fcs[:fcsSize])
+  if err != nil { return noEOF(err) }
+  contentSize := binary.LittleEndian.Uint64(fcs[:])
+  if fcsSize == 2 { contentSize += 256 }
+  if single { window = contentSize }
+  if window > MaxWindowSize { return errWindow }
+  
+  zr.window = int(window)
+  if zr.window < maxBlockSize { zr.window = maxBlockSize }
+  zr.out = zr.out[:0]
+  zr.pending = 0
+  zr.last = false
+  zr.rep = [3]int{1, 4, 8}
+  zr.huff = nil
+  zr.ll, zr.of, zr.ml = nil, nil, nil
+  zr.hash = newXXHash64()
+  return nil
+}
+
+// Checks the content checksum at the end of the current frame.
+func (zr *Reader) finishFrame() error {
+  if !zr.checksum { return nil }
+  var sum [4]byte
+  _, err := io.ReadFull(zr.r, sum[:])
+  if err != nil { return noEOF(err) }
+  if binary.LittleEndian.Uint32(sum[:]) != uint32(zr.hash.sum()) { return errChecksum }
+  return nil
+}
+
+// Decodes the next block of the current frame and appends it to out.
+func (zr *Reader) nextBlock() error {
+  // Drop what is no longer needed for matches.
+  if zr.pending > 2*zr.window {
+    drop := zr.pending - zr.window
+    zr.out = append(zr.out[:0], zr.out[drop:]...)
+    zr.pending -= drop
+  }
+  
+  var hdr [3]byte
+  _, err := io.ReadFull(zr.r, hdr[:])
+  if err != nil { return noEOF(err) }
+  h := int(hdr[0]) | int(hdr[1]) << 8 | int(hdr[2]) << 16
+  zr.last = h & 1 != 0
+  size := h >> 3
+  start := len(zr.out)
+  switch (h >> 1) & 3 {
+    case 0: // raw
+      if size > maxBlockSize { return errFormat }
+      zr.out = append(zr.out, make([]byte, size)...)
+      _, err = io.ReadFull(zr.r, zr.out[start:])
+      if err != nil { return noEOF(err) }
+    case 1: // RLE
+      if size > maxBlockSize { return errFormat }
+      b, err := zr.r.ReadByte()
+      if err != nil { return noEOF(err) }
+      for i := 0; i < size; i++ { zr.out = append(zr.out, b) }
+    case 2:
+      if size > maxBlockSize { return errFormat }
+      data := make([]byte, size)
+      _, err = io.ReadFull(zr.r, data)
+      if err != nil { return noEOF(err) }
+      err = zr.decodeBlock(data)
+      if err != nil { return err }
+      if len(zr.out) - start > maxBlockSize { return errFormat }
+    default:
+      return errFormat
+  }
+  zr.hash.write(zr.out[start:])
+  return nil
+}
+
+// Decodes a compressed block and appends the result to out.
+func (zr *Reader) decodeBlock(data []byte) error {
+  literals, n, err := zr.decodeLiterals(data)
+  if err != nil { return err }
+  data = data[n:]
+  
+  if len(data) < 1 { return errFormat }
+  nseq := int(data[0])
+  switch {
+    case nseq < 128: data = data[1:]
+    case nseq < 255:
+      if len(data) < 2 { return errFormat }
+      nseq = ((nseq - 128) << 8) + int(data[1])
+      data = data[2:]
+    default:
+      if len(data) < 3 { return errFormat }
+      nseq = int(data[1]) + int(data[2]) << 8 + 0x7F00
+      data = data[3:]
+  }
+  if nseq == 0 {
+    zr.out = append(zr.out, literals...)
+    return nil
+  }
+  
+  if len(data) < 1 { return errFormat }
+  modes := data[0]
+  data = data[1:]
+  zr.ll, data, err = readSeqTable(data, (modes >> 6) & 3, zr.ll, &llDefault)
+  if err != nil { return err }
+  zr.of, data, err = readSeqTable(data, (modes >> 4) & 3, zr.of, &ofDefault)
+  if err != nil { return err }
+  zr.ml, data, err = readSeqTable(data, (modes >> 2) & 3, zr.ml, &mlDefault)
+  if err != nil { return err }
+  
+  br, err := newBackwardReader(data)
+  if err != nil { return err }
+  llState := br.read(zr.ll.log)
+  ofState := br.read(zr.of.log)
+  mlState := br.read(zr.ml.log)
+  for i := 0; i < nseq; i++ {
+    llCode := zr.ll.entries[llState].symbol
+    ofCode := zr.of.entries[ofState].symbol
+    mlCode := zr.ml.entries[mlState].symbol
+    if llCode > 35 || mlCode > 52 || ofCode > 31 { return errFormat }
+    
+    ofValue := 1 << ofCode + br.read(int(ofCode))
+    ml := int(mlBase[mlCode]) + br.read(int(mlBits[mlCode]))
+    ll := int(llBase[llCode]) + br.read(int(llBits[llCode]))
+    
+    offset := 0
+    if ofValue > 3 {
+      offset = ofValue - 3
+      zr.rep[2], zr.rep[1], zr.rep[0] = zr.rep[1], zr.rep[0], offset
+    } else {
+      if ll == 0 { ofValue++ }
+      switch ofValue {
+        case 1: offset = zr.rep[0]
+        case 2: offset = zr.rep[1]
+                zr.rep[1], zr.rep[0] = zr.rep[0], offset
+        case 3: offset = zr.rep[2]
+                zr.rep[2], zr.rep[1], zr.rep[0] = zr.rep[1], zr.rep[0], offset
+        case 4: offset = zr.rep[0] - 1
+                zr.rep[2], zr.rep[1], zr.rep[0] = zr.rep[1], zr.rep[0], offset
+      }
+    }
+    
+    if ll > len(literals) { return errFormat }
+    zr.out = append(zr.out, literals[:ll]...)
+    literals = literals[ll:]
+    src := len(zr.out) - offset
+    if offset <= 0 || src < 0 || offset > zr.window { return errFormat }
+    if ml > maxBlockSize { return errFormat }
+    for j := 0; j < ml; j++ { zr.out = append(zr.out, zr.out[src+j]) }
+    
+    if i < nseq-1 {
+      llState = zr.ll.next(llState, br)
+      mlState = zr.ml.next(mlState, br)
+      ofState = zr.of.next(ofState, br)
+    }
+  }
+  if !br.finished() { return errFormat }
+  zr.out = append(zr.out, literals...)
+  return nil
+}
+
+// Decodes the literals section at the start of data. Returns the
+// literals and the size of the section.
+func (zr *Reader) decodeLiterals(data []byte) ([]byte, int, error) {
+  if len(data) < 1 { return nil, 0, errFormat }
+  typ := data[0] & 3
+  format := (data[0] >> 2) & 3
+  
+  if typ < 2 { // raw or RLE
+    size, hdr := 0, 0
+    switch format {
+      case 0, 2: size, hdr = int(data[0] >> 3), 1
+      case 1:
+        if len(data) < 2 { return nil, 0, errFormat }
+        size, hdr = int(data[0] >> 4) + int(data[1]) << 4, 2
+      case 3:
+        if len(data) < 3 { return nil, 0, errFormat }
+        size, hdr = int(data[0] >> 4) + int(data[1]) << 4 + int(data[2]) << 12, 3
+    }
+    if size > maxBlockSize { return nil, 0, errFormat }
+    if typ == 0 {
+      if len(data) < hdr + size { return nil, 0, errFormat }
+      return data[hdr:hdr+size], hdr + size, nil
+    }
+    if len(data) < hdr + 1 { return nil, 0, errFormat }
+    lit := make([]byte, size)
+    for i := range lit { lit[i] = data[hdr] }
+    return lit, hdr + 1, nil
+  }
+  
+  hdr, bits := []int{3, 3, 4, 5}[format], []uint{10, 10, 14, 18}[format]
+  if len(data) < hdr { return nil, 0, errFormat }
+  var b [8]byte
+  copy(b[:], data[:hdr])
+  h := binary.LittleEndian.Uint64(b[:])
+  mask := uint64(1) << bits - 1
+  regen := int((h >> 4) & mask)
+  comp := int((h >> (4 + bits)) & mask)
+  streams := 4
+  if format == 0 { streams = 1 }
+  if regen > maxBlockSize || len(data) < hdr + comp { return nil, 0, errFormat }
+  data = data[hdr:hdr+comp]
+  
+  if typ == 2 {
+    t, n, err := readHuffTable(data)
+    if err != nil { return nil, 0, err }
+    zr.huff = t
+    data = data[n:]
+  } else if zr.huff == nil {
+    return nil, 0, errFormat
+  }
+  
+  lit := make([]byte, 0, regen)
+  var err error
+  if streams == 1 {
+    lit, err = zr.huff.decode(lit, data, regen)
+  } else {
+    if len(data) < 6 { return nil, 0, errFormat }
+    sizes := []int{int(binary.LittleEndian.Uint16(data)), int(binary.LittleEndian.Uint16(data[2:])), int(binary.LittleEndian.Uint16(data[4:]))}
+    data = data[6:]
+    per := (regen + 3) / 4
+    for i := 0; i < 4 && err == nil; i++ {
+      n := per
+      if i == 3 { n = regen - 3*per }
+      size := len(data)
+      if i < 3 { size = sizes[i] }
+      if size > len(data) || n < 0 { return nil, 0, errFormat }
+      lit, err = zr.huff.decode(lit, data[:size], n)
+      data = data[size:]
+    }
+  }
+  if err != nil { return nil, 0, err }
+  return lit, hdr + comp, nil
+}
+
+func noEOF(err error) error {
+  if err == io.EOF { return io.ErrUnexpectedEOF }
+  return err
+}
+
+/*
+  Reads a bitstream backwards, as used by FSE and Huffman coded data.
+  The last byte contains a marker bit above the first bit to be read.
+*/
+type backwardReader struct {
+  data []byte
+  // Number of bits not yet read. Becomes negative if more bits than
+  // available have been read (the missing bits are 0).
+  pos int
+}
+
+func newBackwardReader(data []byte) (*backwardReader, error) {
+  if len(data) == 0 || data[len(data)-1] == 0 { return nil, errFormat }
+  last := data[len(data)-1]
+  pos := len(data)*8 - 1
+  for last & 0x80 == 0 {
+    last <<= 1
+    pos--
+  }
+  return &backwardReader{data:data, pos:pos}, nil
+}
+
+// Returns the n bits below the current position without consuming them.
+func (br *backwardReader) peek(n int) int {
+  if n == 0 { return 0 }
+  start := br.pos - n
+  shift := 0
+  if start < 0 {
+    shift = -start
+    n += start
+    start = 0
+    if n <= 0 { return 0 }
+  }
+  var b [8]byte
+  copy(b[:], br.data[start/8:])
+  v := binary.LittleEndian.Uint64(b[:]) >> uint(start % 8)
+  return int(v & (1 << uint(n) - 1)) << uint(shift)
+}
+
+func (br *backwardReader) read(n int) int {
+  v := br.peek(n)
+  br.pos -= n
+  return v
+}
+
+// Returns true if all bits have been read.
+func (br *backwardReader) finished() bool {
+  return br.pos == 0
+}
+
+// Reads bits forwards, least significant first. Used for table descriptions.
+type forwardReader struct {
+  data []byte
+  pos int
+}
+
+func (fr *forwardReader) read(n int) (int, error) {
+  if fr.pos + n > len(fr.data)*8 { return 0, errFormat }
+  v := 0
+  for i := 0; i < n; i++ {
+    p := fr.pos + i
+    v |= int((fr.data[p/8] >> uint(p%8)) & 1) << uint(i)
+  }
+  fr.pos += n
+  return v, nil
+}
+
+// Returns the number of bytes that contain the bits read so far.
+func (fr *forwardReader) bytes() int {
+  return (fr.pos + 7) / 8
+}
+
+// Returns the position of the highest set bit of v (v > 0).
+func highBit(v int) int {
+  n := -1
+  for v > 0 {
+    v >>= 1
+    n++
+  }
+  return n
+}